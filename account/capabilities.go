@@ -0,0 +1,58 @@
+package account
+
+import "time"
+
+// Endpoints a Capabilities profile covers.
+const (
+	EndpointResponses       = "responses"
+	EndpointChatCompletions = "chat_completions"
+)
+
+// Capabilities is what an account's upstream, such as a relay behind a
+// custom base URL, was found to support.
+type Capabilities struct {
+	Responses       bool      `json:"responses"`
+	ChatCompletions bool      `json:"chat_completions"`
+	Streaming       bool      `json:"streaming"`
+	Tools           bool      `json:"tools"`
+	ProbedAt        time.Time `json:"probed_at"`
+}
+
+// Lacks returns the first feature a request to endpoint, streamed or with
+// tools, needs that c rules out: the endpoint, "streaming" or "tools". It
+// returns "" when c is nil, as for accounts never probed, or supports the
+// request. Endpoints c does not cover are assumed supported, and the
+// Responses API and Chat Completions stand in for each other, see Dialect.
+func (c *Capabilities) Lacks(endpoint string, stream, tools bool) string {
+	switch {
+	case c == nil:
+		return ""
+	case Dialect(endpoint) && !c.Responses && !c.ChatCompletions:
+		return endpoint
+	case stream && !c.Streaming:
+		return "streaming"
+	case tools && !c.Tools:
+		return "tools"
+	}
+	return ""
+}
+
+// Dialect reports whether endpoint is one of the two APIs the proxy
+// translates between, the Responses API and Chat Completions.
+func Dialect(endpoint string) bool {
+	return endpoint == EndpointResponses || endpoint == EndpointChatCompletions
+}
+
+// Serves returns the endpoint a request to endpoint is sent to: endpoint
+// itself, unless c rules it out but supports the other dialect, to which
+// the request is then translated.
+func (c *Capabilities) Serves(endpoint string) string {
+	switch {
+	case c == nil:
+	case endpoint == EndpointResponses && !c.Responses && c.ChatCompletions:
+		return EndpointChatCompletions
+	case endpoint == EndpointChatCompletions && !c.ChatCompletions && c.Responses:
+		return EndpointResponses
+	}
+	return endpoint
+}
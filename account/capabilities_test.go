@@ -0,0 +1,82 @@
+package account
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLacks(t *testing.T) {
+	var none *Capabilities
+	if got := none.Lacks(EndpointChatCompletions, true, true); got != "" {
+		t.Fatalf("unprobed account lacks %q", got)
+	}
+	c := &Capabilities{Responses: true, Streaming: true}
+	for _, tc := range []struct {
+		endpoint      string
+		stream, tools bool
+		want          string
+	}{
+		{EndpointResponses, true, false, ""},
+		// Chat Completions are translated to the Responses API.
+		{EndpointChatCompletions, false, false, ""},
+		{EndpointResponses, true, true, "tools"},
+		{"", false, true, "tools"},
+		{"", false, false, ""},
+	} {
+		if got := c.Lacks(tc.endpoint, tc.stream, tc.tools); got != tc.want {
+			t.Errorf("Lacks(%q, %v, %v) = %q, want %q", tc.endpoint, tc.stream, tc.tools, got, tc.want)
+		}
+	}
+	if got := (&Capabilities{Streaming: true}).Lacks(EndpointResponses, false, false); got != EndpointResponses {
+		t.Errorf("account serving neither dialect lacks %q", got)
+	}
+}
+
+func TestServes(t *testing.T) {
+	var none *Capabilities
+	chat := &Capabilities{ChatCompletions: true}
+	both := &Capabilities{Responses: true, ChatCompletions: true}
+	for _, tc := range []struct {
+		c        *Capabilities
+		endpoint string
+		want     string
+	}{
+		{none, EndpointResponses, EndpointResponses},
+		{chat, EndpointResponses, EndpointChatCompletions},
+		{chat, EndpointChatCompletions, EndpointChatCompletions},
+		{both, EndpointResponses, EndpointResponses},
+		{&Capabilities{Responses: true}, EndpointChatCompletions, EndpointResponses},
+		{&Capabilities{}, EndpointResponses, EndpointResponses},
+		{chat, "", ""},
+	} {
+		if got := tc.c.Serves(tc.endpoint); got != tc.want {
+			t.Errorf("%+v.Serves(%q) = %q, want %q", tc.c, tc.endpoint, got, tc.want)
+		}
+	}
+}
+
+func TestSetCapabilities(t *testing.T) {
+	ctx := context.Background()
+	sqlMgr, err := NewManager(setupTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mgr := range map[string]*Manager{"sqlite": sqlMgr, "memory": NewManagerWithStorage(NewMemoryStore())} {
+		a, _ := mgr.AddAPIKey(ctx, "relay", "k", "https://relay.example/v1", 1)
+		if a.Capabilities != nil {
+			t.Fatalf("%s: new account has capabilities %+v", name, a.Capabilities)
+		}
+		probed := time.Now().UTC().Truncate(time.Second)
+		if err := mgr.SetCapabilities(ctx, a.ID, &Capabilities{ChatCompletions: true, Streaming: true, ProbedAt: probed}); err != nil {
+			t.Fatal(err)
+		}
+		// Update, as from the edit form, keeps the probed profile.
+		a.Name = "renamed"
+		mgr.Update(ctx, a)
+		got, _ := mgr.Get(ctx, a.ID)
+		if got.Name != "renamed" || got.Capabilities == nil || got.Capabilities.Responses || !got.Capabilities.ChatCompletions || !got.Capabilities.ProbedAt.Equal(probed) {
+			t.Fatalf("%s: unexpected account %+v %+v", name, got, got.Capabilities)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+// Package account stores upstream Codex/OpenAI accounts (API keys and
+// ChatGPT OAuth logins) in SQLite or in memory and provides CRUD and
+// quota-state operations through Manager.
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/pricing"
+)
+
+// AccountType distinguishes how credentials are handled.
+type AccountType int
+
+const (
+	APIKeyAccount AccountType = iota
+	ChatGPTAccount
+)
+
+// Account represents an upstream Codex account.
+type Account struct {
+	ID             int64       `json:"id"`
+	AccountID      string      `json:"account_id"`
+	Name           string      `json:"name"`
+	Type           AccountType `json:"type"`
+	APIKey         string      `json:"api_key"`
+	BaseURL        string      `json:"base_url"`
+	RefreshToken   string      `json:"refresh_token"`
+	AccessToken    string      `json:"access_token"`
+	TokenExpiresAt time.Time   `json:"token_expires_at"`
+	Priority       int         `json:"priority"`
+	Exhausted      bool        `json:"exhausted"`
+	ResetAt        time.Time   `json:"reset_at"`
+	// MaxConcurrent caps simultaneous upstream requests; zero is unlimited.
+	MaxConcurrent int `json:"max_concurrent"`
+	// LatencyMs is artificial delay added before each upstream request.
+	LatencyMs int64 `json:"latency_ms"`
+	// BytesPerSec caps the response rate delivered to clients; zero is
+	// unlimited.
+	BytesPerSec int64 `json:"bytes_per_sec"`
+	// PriorityAdjustment is added to Priority by the adaptive scheduler.
+	// It is maintained by the scheduler and not changed by Update.
+	PriorityAdjustment int `json:"priority_adjustment"`
+	// Weight is the account's share of traffic in weighted scheduling.
+	Weight float64 `json:"weight"`
+	// BlockReason explains a long exhaustion such as a billing block, e.g.
+	// "insufficient_quota". It is empty for ordinary rate limits.
+	BlockReason string `json:"block_reason"`
+	// ModelMap translates the model names clients request into the slugs
+	// this account's upstream accepts, e.g. "gpt-5" to "gpt-5-codex" for the
+	// ChatGPT backend. Unlisted models are sent unchanged.
+	ModelMap map[string]string `json:"model_map,omitempty"`
+	// MaintenanceStart and MaintenanceEnd schedule a maintenance window,
+	// e.g. while a key is rotated, during which the scheduler skips the
+	// account. A zero start begins the window at once; a zero end means no
+	// window is scheduled.
+	MaintenanceStart time.Time `json:"maintenance_start"`
+	MaintenanceEnd   time.Time `json:"maintenance_end"`
+	// Backup puts the account in the backup tier, used only while no
+	// primary account is available.
+	Backup bool `json:"backup"`
+	// Prices overrides the model price table for this account, e.g. for a
+	// negotiated discount or a flat-rate plan priced at zero. Least-cost
+	// routing compares accounts by these prices.
+	Prices pricing.Table `json:"prices,omitempty"`
+	// Capabilities is what the account's upstream was found to support by
+	// a capability probe; nil, before any probe, assumes everything. It is
+	// maintained by SetCapabilities and not changed by Update.
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// ProxyURL, when set, is the HTTP or SOCKS5 proxy the account's
+	// upstream traffic and token refreshes leave through instead of the
+	// shared outbound proxy, so accounts can egress from different IPs.
+	ProxyURL string `json:"proxy_url"`
+	// CAFile is a PEM bundle of CAs trusted for the account's upstream in
+	// addition to the system roots, e.g. the internal CA of a self-hosted
+	// BaseURL. InsecureSkipVerify accepts any upstream certificate.
+	CAFile             string `json:"ca_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Static is set for accounts declared in an accounts file, which
+	// SyncStatic maintains and the admin API does not edit. StaticDigest
+	// identifies the credentials the file last declared.
+	Static       bool   `json:"static"`
+	StaticDigest string `json:"-"`
+	// RampUp is the number of consecutive successful requests a new
+	// account still needs before it joins full rotation; until then the
+	// scheduler gives it only part of its traffic. It is maintained by the
+	// scheduler and not changed by Update.
+	RampUp int `json:"ramp_up"`
+	// Notes are operator messages explaining why the account is
+	// unavailable, e.g. "Team plan renews on the 3rd", keyed by the state
+	// they apply to (one of NoteStates) or "*" for any. They are shown on
+	// the dashboard and in the errors clients get while no account can
+	// serve them.
+	Notes map[string]string `json:"notes,omitempty"`
+}
+
+// BlockQuarantined is the BlockReason of an account the upstream keeps
+// refusing with 403, e.g. a soft-banned ChatGPT account. It stays out of
+// rotation until its long cooldown ends or a probe succeeds.
+const BlockQuarantined = "quarantined"
+
+// BlockInvalidToken is the BlockReason of an account whose credentials the
+// upstream keeps rejecting with 401, even after a token refresh. Unlike
+// other blocks it does not expire: the account stays out of rotation until
+// its credentials are replaced.
+const BlockInvalidToken = "invalid_token"
+
+// InvalidToken reports whether a's credentials were found invalid.
+func (a *Account) InvalidToken() bool { return a.BlockReason == BlockInvalidToken }
+
+// NoteStates are the states Account.Notes are keyed by, besides "*".
+var NoteStates = []string{"exhausted", "blocked", "maintenance", "invalid_token", "refresh_failed"}
+
+// CheckNotes returns an error if notes has a key other than "*" and
+// NoteStates.
+func CheckNotes(notes map[string]string) error {
+	for state := range notes {
+		if state != "*" && !slices.Contains(NoteStates, state) {
+			return fmt.Errorf("unknown note state %q: expected * or one of %s", state, strings.Join(NoteStates, ", "))
+		}
+	}
+	return nil
+}
+
+// Note returns the note explaining a is unavailable in state, or its "*"
+// note if it has none for state.
+func (a *Account) Note(state string) string {
+	if n, ok := a.Notes[state]; ok {
+		return n
+	}
+	return a.Notes["*"]
+}
+
+// EffectivePriority is Priority plus the adaptive adjustment.
+func (a *Account) EffectivePriority() int { return a.Priority + a.PriorityAdjustment }
+
+// InMaintenance reports whether t falls in the account's maintenance window.
+func (a *Account) InMaintenance(t time.Time) bool {
+	return !a.MaintenanceEnd.IsZero() && !t.Before(a.MaintenanceStart) && t.Before(a.MaintenanceEnd)
+}
+
+// Available reports whether the account can serve requests at t: it is
+// neither exhausted nor blocked, in maintenance or holding invalid
+// credentials.
+func (a *Account) Available(t time.Time) bool {
+	return !a.InvalidToken() && !a.InMaintenance(t) && (!a.Exhausted || t.After(a.ResetAt))
+}
+
+// Manager handles CRUD operations on accounts kept in a Storage.
+type Manager struct {
+	store Storage
+	// Cipher, when set, encrypts the API key and tokens at rest.
+	Cipher Cipher
+	// RampUp is the RampUp new accounts start with; zero puts them in
+	// full rotation at once.
+	RampUp int
+}
+
+// Cipher encrypts column values before they are stored. Decrypt must
+// return values written before encryption was enabled unchanged.
+type Cipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(stored string) (string, error)
+}
+
+// seal returns a copy of a with its credentials encrypted for storage.
+func (m *Manager) seal(a *Account) (*Account, error) {
+	if m.Cipher == nil {
+		return a, nil
+	}
+	c := *a
+	for _, v := range []*string{&c.APIKey, &c.RefreshToken, &c.AccessToken} {
+		enc, err := m.Cipher.Encrypt(*v)
+		if err != nil {
+			return nil, err
+		}
+		*v = enc
+	}
+	return &c, nil
+}
+
+// open decrypts the credentials of a stored account in place.
+func (m *Manager) open(a *Account) error {
+	if m.Cipher == nil {
+		return nil
+	}
+	for _, v := range []*string{&a.APIKey, &a.RefreshToken, &a.AccessToken} {
+		plain, err := m.Cipher.Decrypt(*v)
+		if err != nil {
+			return fmt.Errorf("decrypt credentials of account %d: %w", a.ID, err)
+		}
+		*v = plain
+	}
+	return nil
+}
+
+// ErrDuplicate indicates the account already exists.
+var ErrDuplicate = errors.New("duplicate account")
+
+// NewManager creates a new Manager and ensures the accounts table exists.
+func NewManager(db *sql.DB) (*Manager, error) {
+	st, err := newSQLStorage(db)
+	if err != nil {
+		logger.Errorf("init accounts table failed: %v", err)
+		return nil, err
+	}
+	return &Manager{store: st}, nil
+}
+
+// NewManagerWithStorage creates a Manager keeping its accounts in st, such
+// as a MemoryStore.
+func NewManagerWithStorage(st Storage) *Manager {
+	return &Manager{store: st}
+}
+
+// List returns all accounts ordered by priority.
+func (m *Manager) List(ctx context.Context) ([]*Account, error) {
+	res, err := m.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range res {
+		if err := m.open(a); err != nil {
+			logger.Errorf("list accounts failed: %v", err)
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// AddAPIKey adds a new API key account.
+func (m *Manager) AddAPIKey(ctx context.Context, name, key, baseURL string, priority int) (*Account, error) {
+	logger.Debugf("adding API key account %s priority %d", name, priority)
+	dup, err := m.exists(ctx, func(a *Account) bool { return a.APIKey == key })
+	if err != nil {
+		logger.Errorf("check duplicate api key failed: %v", err)
+		return nil, err
+	} else if dup {
+		logger.Warnf("duplicate API key account %s", key)
+		return nil, ErrDuplicate
+	}
+	a := &Account{Name: name, Type: APIKeyAccount, APIKey: key, BaseURL: baseURL, Priority: priority, Weight: 1}
+	if err := m.insert(ctx, a); err != nil {
+		return nil, err
+	}
+	logger.Infof("added API key account %d", a.ID)
+	return a, nil
+}
+
+// AddChatGPT adds a new ChatGPT account using refresh token.
+func (m *Manager) AddChatGPT(ctx context.Context, name, refreshToken, accountID string, priority int) (*Account, error) {
+	logger.Debugf("adding ChatGPT account %s priority %d", name, priority)
+	dup, err := m.exists(ctx, func(a *Account) bool { return a.RefreshToken == refreshToken })
+	if err != nil {
+		logger.Errorf("check duplicate chatgpt failed: %v", err)
+		return nil, err
+	} else if dup {
+		logger.Warnf("duplicate ChatGPT account")
+		return nil, ErrDuplicate
+	}
+	a := &Account{Name: name, Type: ChatGPTAccount, RefreshToken: refreshToken, AccountID: accountID, Priority: priority, Weight: 1}
+	if err := m.insert(ctx, a); err != nil {
+		return nil, err
+	}
+	logger.Infof("added ChatGPT account %d", a.ID)
+	return a, nil
+}
+
+// insert stores a new account and sets its ID.
+func (m *Manager) insert(ctx context.Context, a *Account) error {
+	a.RampUp = m.RampUp
+	stored, err := m.seal(a)
+	if err != nil {
+		return err
+	}
+	a.ID, err = m.store.Insert(ctx, stored)
+	return err
+}
+
+// Update updates an existing account.
+func (m *Manager) Update(ctx context.Context, a *Account) error {
+	logger.Debugf("updating account %d", a.ID)
+	stored, err := m.seal(a)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Update(ctx, stored); err != nil {
+		return err
+	}
+	logger.Infof("updated account %d", a.ID)
+	return nil
+}
+
+// exists reports whether an account matches. Credentials are compared
+// after decryption, since encrypted values cannot be matched in storage.
+func (m *Manager) exists(ctx context.Context, match func(*Account) bool) (bool, error) {
+	accounts, err := m.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range accounts {
+		if match(a) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reencrypt rewrites the credentials of every account through Cipher, so
+// values stored before encryption was enabled are encrypted. It returns
+// the number of accounts rewritten.
+func (m *Manager) Reencrypt(ctx context.Context) (int, error) {
+	if m.Cipher == nil {
+		return 0, errors.New("no cipher configured")
+	}
+	accounts, err := m.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i, a := range accounts {
+		if err := m.Update(ctx, a); err != nil {
+			return i, err
+		}
+	}
+	return len(accounts), nil
+}
+
+// Delete removes an account by id.
+func (m *Manager) Delete(ctx context.Context, id int64) error {
+	logger.Debugf("deleting account %d", id)
+	err := m.store.Delete(ctx, id)
+	if err == nil {
+		logger.Infof("deleted account %d", id)
+	}
+	return err
+}
+
+// MarkExhausted marks account exhausted until resetAt.
+func (m *Manager) MarkExhausted(ctx context.Context, id int64, resetAt time.Time) error {
+	logger.Warnf("marking account %d exhausted until %v", id, resetAt)
+	exhausted, reason := true, ""
+	return m.store.Modify(ctx, id, Change{Exhausted: &exhausted, ResetAt: &resetAt, BlockReason: &reason})
+}
+
+// MarkBlocked marks account exhausted until resetAt for reason, such as a
+// billing error, that a retry shortly after would not resolve.
+func (m *Manager) MarkBlocked(ctx context.Context, id int64, reason string, resetAt time.Time) error {
+	logger.Warnf("marking account %d blocked (%s) until %v", id, reason, resetAt)
+	exhausted := true
+	return m.store.Modify(ctx, id, Change{Exhausted: &exhausted, ResetAt: &resetAt, BlockReason: &reason})
+}
+
+// ExpireToken makes the access token of a ChatGPT account due for refresh.
+func (m *Manager) ExpireToken(ctx context.Context, id int64) error {
+	var expires time.Time
+	return m.store.Modify(ctx, id, Change{TokenExpiresAt: &expires})
+}
+
+// Reactivate clears exhaustion flag.
+func (m *Manager) Reactivate(ctx context.Context, id int64) error {
+	logger.Infof("reactivating account %d", id)
+	var exhausted bool
+	var resetAt time.Time
+	var reason string
+	return m.store.Modify(ctx, id, Change{Exhausted: &exhausted, ResetAt: &resetAt, BlockReason: &reason})
+}
+
+// EndMaintenance clears the maintenance window of an account.
+func (m *Manager) EndMaintenance(ctx context.Context, id int64) error {
+	logger.Infof("ending maintenance of account %d", id)
+	var start, end time.Time
+	return m.store.Modify(ctx, id, Change{MaintenanceStart: &start, MaintenanceEnd: &end})
+}
+
+// SetPriorityAdjustment stores the adaptive priority adjustment of an account.
+func (m *Manager) SetPriorityAdjustment(ctx context.Context, id int64, adj int) error {
+	return m.store.Modify(ctx, id, Change{PriorityAdjustment: &adj})
+}
+
+// SetRampUp stores the number of successes account id still needs to
+// join full rotation.
+func (m *Manager) SetRampUp(ctx context.Context, id int64, n int) error {
+	return m.store.Modify(ctx, id, Change{RampUp: &n})
+}
+
+// SetRouting stores the priority and weight of an account, leaving its
+// other settings alone.
+func (m *Manager) SetRouting(ctx context.Context, id int64, priority int, weight float64) error {
+	return m.store.Modify(ctx, id, Change{Priority: &priority, Weight: &weight})
+}
+
+// SetCapabilities stores the capability profile found by a probe.
+func (m *Manager) SetCapabilities(ctx context.Context, id int64, c *Capabilities) error {
+	return m.store.Modify(ctx, id, Change{Capabilities: c})
+}
+
+// Get retrieves account by id.
+func (m *Manager) Get(ctx context.Context, id int64) (*Account, error) {
+	logger.Debugf("getting account %d", id)
+	a, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		logger.Warnf("account %d not found", id)
+		return nil, nil
+	}
+	if err := m.open(a); err != nil {
+		logger.Errorf("get account %d failed: %v", id, err)
+		return nil, err
+	}
+	return a, nil
+}
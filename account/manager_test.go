@@ -4,21 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
+	"strings"
 	"testing"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"github.com/kxn/codex-companion/internal/testdb"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
 	t.Helper()
-	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
-	db, err := sql.Open("sqlite", dsn)
-	if err != nil {
-		t.Fatalf("open db: %v", err)
-	}
-	return db
+	return testdb.Open(t)
 }
 
 func TestAddAndGet(t *testing.T) {
@@ -40,6 +35,8 @@ func TestAddAndGet(t *testing.T) {
 		t.Fatalf("unexpected account: %+v", got)
 	}
 
+	// Accounts added with ramp-up enabled start ramping up.
+	mgr.RampUp = 3
 	a2, err := mgr.AddChatGPT(ctx, "a2", "rt", "", 2)
 	if err != nil {
 		t.Fatalf("add chatgpt: %v", err)
@@ -48,7 +45,7 @@ func TestAddAndGet(t *testing.T) {
 	if err != nil || got2 == nil {
 		t.Fatalf("get2: %v %v", got2, err)
 	}
-	if got2.RefreshToken != "rt" || got2.Type != ChatGPTAccount {
+	if got2.RefreshToken != "rt" || got2.Type != ChatGPTAccount || got2.RampUp != 3 || got.RampUp != 0 {
 		t.Fatalf("unexpected: %+v", got2)
 	}
 }
@@ -68,13 +65,19 @@ func TestListOrderUpdateDelete(t *testing.T) {
 	}
 
 	a1.Name = "new"
+	a1.ModelMap = map[string]string{"gpt-5": "gpt-5-codex"}
+	a1.ProxyURL = "socks5://proxy:1080"
+	a1.Notes = map[string]string{"exhausted": "renews on the 3rd", "*": "ask ops"}
 	if err := mgr.Update(ctx, a1); err != nil {
 		t.Fatalf("update: %v", err)
 	}
 	got, _ := mgr.Get(ctx, a1.ID)
-	if got.Name != "new" {
+	if got.Name != "new" || got.ModelMap["gpt-5"] != "gpt-5-codex" || got.ProxyURL != "socks5://proxy:1080" {
 		t.Fatalf("update failed: %+v", got)
 	}
+	if got.Note("exhausted") != "renews on the 3rd" || got.Note("maintenance") != "ask ops" {
+		t.Fatalf("unexpected notes %v", got.Notes)
+	}
 
 	if err := mgr.Delete(ctx, a1.ID); err != nil {
 		t.Fatalf("delete: %v", err)
@@ -126,3 +129,72 @@ func TestExhaustReactivate(t *testing.T) {
 		t.Fatalf("reactivate failed: %+v", got)
 	}
 }
+
+// testCipher "encrypts" by reversing the value behind a prefix.
+type testCipher struct{}
+
+func (testCipher) Encrypt(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	return "enc:" + reverse(s), nil
+}
+
+func (testCipher) Decrypt(s string) (string, error) {
+	if v, ok := strings.CutPrefix(s, "enc:"); ok {
+		return reverse(v), nil
+	}
+	return s, nil
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func TestCipher(t *testing.T) {
+	db := setupTestDB(t)
+	mgr, _ := NewManager(db)
+	ctx := context.Background()
+	legacy, _ := mgr.AddAPIKey(ctx, "legacy", "plain-key", "", 1)
+	mgr.Cipher = testCipher{}
+
+	a, err := mgr.AddChatGPT(ctx, "chat", "refresh", "acct", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AccessToken = "access"
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	var refresh, access string
+	db.QueryRow(`SELECT refresh_token, access_token FROM accounts WHERE id=?`, a.ID).Scan(&refresh, &access)
+	if refresh != "enc:hserfer" || access != "enc:ssecca" {
+		t.Fatalf("stored %q %q", refresh, access)
+	}
+	if got, _ := mgr.Get(ctx, a.ID); got.RefreshToken != "refresh" || got.AccessToken != "access" {
+		t.Fatalf("unexpected account %+v", got)
+	}
+	// Duplicates are found whether or not the stored value is encrypted.
+	if _, err := mgr.AddChatGPT(ctx, "again", "refresh", "", 3); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected duplicate, got %v", err)
+	}
+	if _, err := mgr.AddAPIKey(ctx, "again", "plain-key", "", 3); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected duplicate, got %v", err)
+	}
+
+	if n, err := mgr.Reencrypt(ctx); err != nil || n != 2 {
+		t.Fatalf("reencrypt %d %v", n, err)
+	}
+	var key string
+	db.QueryRow(`SELECT api_key FROM accounts WHERE id=?`, legacy.ID).Scan(&key)
+	if key != "enc:yek-nialp" {
+		t.Fatalf("legacy key stored as %q", key)
+	}
+	if got, _ := mgr.Get(ctx, legacy.ID); got.APIKey != "plain-key" {
+		t.Fatalf("unexpected account %+v", got)
+	}
+}
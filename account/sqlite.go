@@ -0,0 +1,296 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// sqlStorage keeps accounts in the accounts table of a SQLite database.
+type sqlStorage struct {
+	db *sql.DB
+}
+
+var _ Storage = (*sqlStorage)(nil)
+
+// newSQLStorage creates a sqlStorage and ensures the accounts table exists.
+func newSQLStorage(db *sql.DB) (*sqlStorage, error) {
+	query := `CREATE TABLE IF NOT EXISTS accounts (
+       id INTEGER PRIMARY KEY AUTOINCREMENT,
+       name TEXT,
+       type INTEGER,
+       api_key TEXT,
+       refresh_token TEXT,
+       access_token TEXT,
+       token_expires_at TIMESTAMP,
+       account_id TEXT,
+       base_url TEXT,
+       priority INTEGER,
+       exhausted BOOLEAN,
+       reset_at TIMESTAMP,
+       max_concurrent INTEGER NOT NULL DEFAULT 0,
+       latency_ms INTEGER NOT NULL DEFAULT 0,
+       bytes_per_sec INTEGER NOT NULL DEFAULT 0,
+       priority_adjustment INTEGER NOT NULL DEFAULT 0,
+       weight REAL NOT NULL DEFAULT 1,
+       block_reason TEXT NOT NULL DEFAULT '',
+       model_map TEXT NOT NULL DEFAULT '',
+       maintenance_start TIMESTAMP,
+       maintenance_end TIMESTAMP,
+       backup BOOLEAN NOT NULL DEFAULT 0,
+       prices TEXT NOT NULL DEFAULT '',
+       capabilities TEXT NOT NULL DEFAULT '',
+       proxy_url TEXT NOT NULL DEFAULT '',
+       ca_file TEXT NOT NULL DEFAULT '',
+       insecure_skip_verify BOOLEAN NOT NULL DEFAULT 0,
+       static BOOLEAN NOT NULL DEFAULT 0,
+       static_digest TEXT NOT NULL DEFAULT '',
+       ramp_up INTEGER NOT NULL DEFAULT 0,
+       notes TEXT NOT NULL DEFAULT ''
+   )`
+	if _, err := db.Exec(query); err != nil {
+		logger.Errorf("create accounts table failed: %v", err)
+		return nil, err
+	}
+	// Add new column for existing tables; ignore error if already exists.
+	db.Exec(`ALTER TABLE accounts ADD COLUMN account_id TEXT`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN base_url TEXT`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN max_concurrent INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN latency_ms INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN bytes_per_sec INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN priority_adjustment INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN weight REAL NOT NULL DEFAULT 1`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN block_reason TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN model_map TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN maintenance_start TIMESTAMP`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN maintenance_end TIMESTAMP`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN backup BOOLEAN NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN prices TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN capabilities TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN proxy_url TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN ca_file TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN insecure_skip_verify BOOLEAN NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN static BOOLEAN NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN static_digest TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN ramp_up INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE accounts ADD COLUMN notes TEXT NOT NULL DEFAULT ''`)
+	return &sqlStorage{db: db}, nil
+}
+
+func (s *sqlStorage) List(ctx context.Context) ([]*Account, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+accountColumns+` FROM accounts ORDER BY priority`)
+	if err != nil {
+		logger.Errorf("query accounts failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Account
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			logger.Errorf("scan account row failed: %v", err)
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate account rows failed: %v", err)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *sqlStorage) Get(ctx context.Context, id int64) (*Account, error) {
+	a, err := scanAccount(s.db.QueryRowContext(ctx, `SELECT `+accountColumns+` FROM accounts WHERE id=?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("get account %d failed: %v", id, err)
+		return nil, err
+	}
+	return a, nil
+}
+
+// encodeMaps returns the stored form of the model map, prices and notes
+// of a.
+func encodeMaps(a *Account) (modelMap, prices, notes string, err error) {
+	if len(a.ModelMap) > 0 {
+		b, err := json.Marshal(a.ModelMap)
+		if err != nil {
+			return "", "", "", err
+		}
+		modelMap = string(b)
+	}
+	if len(a.Prices) > 0 {
+		b, err := json.Marshal(a.Prices)
+		if err != nil {
+			return "", "", "", err
+		}
+		prices = string(b)
+	}
+	if len(a.Notes) > 0 {
+		b, err := json.Marshal(a.Notes)
+		if err != nil {
+			return "", "", "", err
+		}
+		notes = string(b)
+	}
+	return modelMap, prices, notes, nil
+}
+
+func (s *sqlStorage) Insert(ctx context.Context, a *Account) (int64, error) {
+	modelMap, prices, notes, err := encodeMaps(a)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO accounts(name, type, api_key, refresh_token, access_token, token_expires_at, account_id, base_url, priority, exhausted, reset_at, max_concurrent, latency_ms, bytes_per_sec, priority_adjustment, weight, block_reason, model_map, maintenance_start, maintenance_end, backup, prices, proxy_url, ca_file, insecure_skip_verify, static, static_digest, ramp_up, notes) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		a.Name, a.Type, a.APIKey, a.RefreshToken, a.AccessToken, nullTime(a.TokenExpiresAt), a.AccountID, a.BaseURL, a.Priority, a.Exhausted, nullTime(a.ResetAt), a.MaxConcurrent, a.LatencyMs, a.BytesPerSec, a.PriorityAdjustment, a.Weight, a.BlockReason, modelMap, nullTime(a.MaintenanceStart), nullTime(a.MaintenanceEnd), a.Backup, prices, a.ProxyURL, a.CAFile, a.InsecureSkipVerify, a.Static, a.StaticDigest, a.RampUp, notes)
+	if err != nil {
+		logger.Errorf("insert account %s failed: %v", a.Name, err)
+		dbhealth.RecordWriteError("accounts")
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		logger.Errorf("get last insert id failed: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *sqlStorage) Update(ctx context.Context, a *Account) error {
+	modelMap, prices, notes, err := encodeMaps(a)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE accounts SET name=?, type=?, api_key=?, refresh_token=?, access_token=?, token_expires_at=?, account_id=?, base_url=?, priority=?, exhausted=?, reset_at=?, max_concurrent=?, latency_ms=?, bytes_per_sec=?, weight=?, block_reason=?, model_map=?, maintenance_start=?, maintenance_end=?, backup=?, prices=?, proxy_url=?, ca_file=?, insecure_skip_verify=?, static=?, static_digest=?, notes=? WHERE id=?`,
+		a.Name, a.Type, a.APIKey, a.RefreshToken, a.AccessToken, a.TokenExpiresAt, a.AccountID, a.BaseURL, a.Priority, a.Exhausted, a.ResetAt, a.MaxConcurrent, a.LatencyMs, a.BytesPerSec, a.Weight, a.BlockReason, modelMap, a.MaintenanceStart, a.MaintenanceEnd, a.Backup, prices, a.ProxyURL, a.CAFile, a.InsecureSkipVerify, a.Static, a.StaticDigest, notes, a.ID)
+	if err != nil {
+		logger.Errorf("update account %d failed: %v", a.ID, err)
+		dbhealth.RecordWriteError("accounts")
+	}
+	return err
+}
+
+func (s *sqlStorage) Delete(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM accounts WHERE id=?`, id)
+	if err != nil {
+		logger.Errorf("delete account %d failed: %v", id, err)
+		dbhealth.RecordWriteError("accounts")
+	}
+	return err
+}
+
+func (s *sqlStorage) Modify(ctx context.Context, id int64, c Change) error {
+	var sets []string
+	var args []any
+	set := func(col string, v any) {
+		sets = append(sets, col+"=?")
+		args = append(args, v)
+	}
+	if c.Exhausted != nil {
+		set("exhausted", *c.Exhausted)
+	}
+	if c.ResetAt != nil {
+		set("reset_at", nullTime(*c.ResetAt))
+	}
+	if c.BlockReason != nil {
+		set("block_reason", *c.BlockReason)
+	}
+	if c.TokenExpiresAt != nil {
+		set("token_expires_at", *c.TokenExpiresAt)
+	}
+	if c.MaintenanceStart != nil {
+		set("maintenance_start", nullTime(*c.MaintenanceStart))
+	}
+	if c.MaintenanceEnd != nil {
+		set("maintenance_end", nullTime(*c.MaintenanceEnd))
+	}
+	if c.PriorityAdjustment != nil {
+		set("priority_adjustment", *c.PriorityAdjustment)
+	}
+	if c.Priority != nil {
+		set("priority", *c.Priority)
+	}
+	if c.Weight != nil {
+		set("weight", *c.Weight)
+	}
+	if c.RampUp != nil {
+		set("ramp_up", *c.RampUp)
+	}
+	if c.Capabilities != nil {
+		b, err := json.Marshal(c.Capabilities)
+		if err != nil {
+			return err
+		}
+		set("capabilities", string(b))
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `UPDATE accounts SET `+strings.Join(sets, ", ")+` WHERE id=?`, append(args, id)...)
+	if err != nil {
+		logger.Errorf("modify account %d failed: %v", id, err)
+		dbhealth.RecordWriteError("accounts")
+	}
+	return err
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// accountColumns is the column list read by scanAccount.
+const accountColumns = `id, account_id, name, type, api_key, refresh_token, access_token, token_expires_at, base_url, priority, exhausted, reset_at, max_concurrent, latency_ms, bytes_per_sec, priority_adjustment, weight, block_reason, model_map, maintenance_start, maintenance_end, backup, prices, capabilities, proxy_url, ca_file, insecure_skip_verify, static, static_digest, ramp_up, notes`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAccount(row scanner) (*Account, error) {
+	var a Account
+	var apiKey, refreshToken, accessToken, accountID, baseURL sql.NullString
+	var tokenExpiresAt sql.NullTime
+	var resetAt, maintenanceStart, maintenanceEnd sql.NullTime
+	var modelMap, prices, capabilities, notes string
+	if err := row.Scan(&a.ID, &accountID, &a.Name, &a.Type, &apiKey, &refreshToken, &accessToken, &tokenExpiresAt, &baseURL, &a.Priority, &a.Exhausted, &resetAt,
+		&a.MaxConcurrent, &a.LatencyMs, &a.BytesPerSec, &a.PriorityAdjustment, &a.Weight, &a.BlockReason, &modelMap, &maintenanceStart, &maintenanceEnd, &a.Backup, &prices, &capabilities, &a.ProxyURL, &a.CAFile, &a.InsecureSkipVerify, &a.Static, &a.StaticDigest, &a.RampUp, &notes); err != nil {
+		return nil, err
+	}
+	if modelMap != "" {
+		if err := json.Unmarshal([]byte(modelMap), &a.ModelMap); err != nil {
+			logger.Warnf("ignoring invalid model map of account %d: %v", a.ID, err)
+		}
+	}
+	if prices != "" {
+		if err := json.Unmarshal([]byte(prices), &a.Prices); err != nil {
+			logger.Warnf("ignoring invalid prices of account %d: %v", a.ID, err)
+		}
+	}
+	if capabilities != "" {
+		if err := json.Unmarshal([]byte(capabilities), &a.Capabilities); err != nil {
+			logger.Warnf("ignoring invalid capabilities of account %d: %v", a.ID, err)
+		}
+	}
+	if notes != "" {
+		if err := json.Unmarshal([]byte(notes), &a.Notes); err != nil {
+			logger.Warnf("ignoring invalid notes of account %d: %v", a.ID, err)
+		}
+	}
+	a.APIKey, a.BaseURL, a.RefreshToken = apiKey.String, baseURL.String, refreshToken.String
+	a.AccessToken, a.AccountID = accessToken.String, accountID.String
+	a.TokenExpiresAt, a.ResetAt = tokenExpiresAt.Time, resetAt.Time
+	a.MaintenanceStart, a.MaintenanceEnd = maintenanceStart.Time, maintenanceEnd.Time
+	return &a, nil
+}
@@ -0,0 +1,208 @@
+package account
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/outbound"
+	"github.com/kxn/codex-companion/internal/pricing"
+)
+
+// StaticAccount declares an account in an accounts file, see LoadStatic.
+type StaticAccount struct {
+	// Name identifies the account across restarts and must be unique in
+	// the file.
+	Name string `json:"name"`
+	// Type is "api_key", the default, or "chatgpt".
+	Type         string `json:"type"`
+	APIKey       string `json:"api_key"`
+	BaseURL      string `json:"base_url"`
+	RefreshToken string `json:"refresh_token"`
+	AccountID    string `json:"account_id"`
+	Priority     int    `json:"priority"`
+	// Weight defaults to 1.
+	Weight             float64           `json:"weight"`
+	Backup             bool              `json:"backup"`
+	MaxConcurrent      int               `json:"max_concurrent"`
+	ModelMap           map[string]string `json:"model_map"`
+	Prices             pricing.Table     `json:"prices"`
+	ProxyURL           string            `json:"proxy_url"`
+	CAFile             string            `json:"ca_file"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	Notes              map[string]string `json:"notes"`
+}
+
+// LoadStatic reads the JSON array of accounts declared in file. Credentials,
+// base and proxy URLs may reference environment variables as $VAR or
+// ${VAR}, so secrets can be injected without writing them to the file.
+func LoadStatic(file string) ([]StaticAccount, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("accounts file: %w", err)
+	}
+	var decls []StaticAccount
+	if err := json.Unmarshal(data, &decls); err != nil {
+		return nil, fmt.Errorf("accounts file %s: %w", file, err)
+	}
+	names := make(map[string]bool, len(decls))
+	for i := range decls {
+		d := &decls[i]
+		for _, v := range []*string{&d.APIKey, &d.RefreshToken, &d.BaseURL, &d.ProxyURL} {
+			*v = os.ExpandEnv(*v)
+		}
+		if err := d.check(); err != nil {
+			return nil, fmt.Errorf("accounts file %s: account %d: %w", file, i+1, err)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("accounts file %s: duplicate account name %q", file, d.Name)
+		}
+		names[d.Name] = true
+	}
+	return decls, nil
+}
+
+func (d *StaticAccount) check() error {
+	if d.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	switch d.Type {
+	case "", "api_key":
+		if d.APIKey == "" {
+			return fmt.Errorf("%s: missing api_key", d.Name)
+		}
+	case "chatgpt":
+		if d.RefreshToken == "" {
+			return fmt.Errorf("%s: missing refresh_token", d.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unknown type %q, want api_key or chatgpt", d.Name, d.Type)
+	}
+	if d.Weight < 0 {
+		return fmt.Errorf("%s: negative weight", d.Name)
+	}
+	if err := CheckNotes(d.Notes); err != nil {
+		return fmt.Errorf("%s: %w", d.Name, err)
+	}
+	if d.ProxyURL != "" {
+		if _, err := outbound.ParseProxy(d.ProxyURL); err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+	}
+	if d.CAFile != "" {
+		if _, err := outbound.LoadCA(d.CAFile); err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+	}
+	return nil
+}
+
+func (d *StaticAccount) accountType() AccountType {
+	if d.Type == "chatgpt" {
+		return ChatGPTAccount
+	}
+	return APIKeyAccount
+}
+
+// digest identifies the declared credentials without storing them twice.
+func (d *StaticAccount) digest() string {
+	return credentialDigest(&Account{Type: d.accountType(), APIKey: d.APIKey, RefreshToken: d.RefreshToken})
+}
+
+// credentialDigest hashes the API key or refresh token of a.
+func credentialDigest(a *Account) string {
+	credential := a.APIKey
+	if a.Type == ChatGPTAccount {
+		credential = a.RefreshToken
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", a.Type, credential)))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply writes the declared settings to a, and the declared credentials
+// when credentials is set.
+func (d *StaticAccount) apply(a *Account, credentials bool) {
+	a.Name, a.Type, a.BaseURL, a.AccountID = d.Name, d.accountType(), d.BaseURL, d.AccountID
+	a.Priority, a.Weight, a.Backup, a.MaxConcurrent = d.Priority, d.Weight, d.Backup, d.MaxConcurrent
+	if a.Weight == 0 {
+		a.Weight = 1
+	}
+	a.ModelMap, a.Prices, a.Notes = d.ModelMap, d.Prices, d.Notes
+	a.ProxyURL, a.CAFile, a.InsecureSkipVerify = d.ProxyURL, d.CAFile, d.InsecureSkipVerify
+	a.Static, a.StaticDigest = true, d.digest()
+	if !credentials {
+		return
+	}
+	a.APIKey = ""
+	if a.Type == APIKeyAccount {
+		a.APIKey = d.APIKey
+	}
+	if a.RefreshToken != d.RefreshToken {
+		a.RefreshToken, a.AccessToken, a.TokenExpiresAt = d.RefreshToken, "", time.Time{}
+	}
+	if a.InvalidToken() {
+		// New credentials end the invalid-token state.
+		a.Exhausted, a.ResetAt, a.BlockReason = false, time.Time{}, ""
+	}
+}
+
+// SyncStatic makes the static accounts match decls, read from an accounts
+// file at startup: declared accounts are added, or updated by name, and
+// static accounts no longer declared are deleted and returned. Runtime
+// state such as exhaustion survives an update, and so do the credentials
+// unless the declared ones changed, since a ChatGPT refresh token is
+// rotated on use. An account added through the admin API with the declared
+// credentials is taken over rather than duplicated.
+func (m *Manager) SyncStatic(ctx context.Context, decls []StaticAccount) ([]*Account, error) {
+	accounts, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	static := make(map[string]*Account)
+	for _, a := range accounts {
+		if a.Static {
+			static[a.Name] = a
+		}
+	}
+	for i := range decls {
+		d := &decls[i]
+		a := static[d.Name]
+		delete(static, d.Name)
+		if a == nil {
+			for _, b := range accounts {
+				if !b.Static && credentialDigest(b) == d.digest() {
+					logger.Infof("account %d is now declared in the accounts file as %s", b.ID, d.Name)
+					a = b
+					break
+				}
+			}
+		}
+		if a == nil {
+			a = &Account{}
+			d.apply(a, true)
+			if err := m.insert(ctx, a); err != nil {
+				return nil, err
+			}
+			logger.Infof("added static account %d %s", a.ID, a.Name)
+			continue
+		}
+		d.apply(a, a.StaticDigest != d.digest())
+		if err := m.Update(ctx, a); err != nil {
+			return nil, err
+		}
+	}
+	var removed []*Account
+	for _, a := range static {
+		if err := m.Delete(ctx, a.ID); err != nil {
+			return removed, err
+		}
+		logger.Infof("deleted static account %d %s, no longer declared", a.ID, a.Name)
+		removed = append(removed, a)
+	}
+	return removed, nil
+}
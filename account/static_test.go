@@ -0,0 +1,111 @@
+package account
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeAccountsFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadStatic(t *testing.T) {
+	t.Setenv("TEST_STATIC_KEY", "sk-secret")
+	decls, err := LoadStatic(writeAccountsFile(t, `[
+		{"name": "relay", "api_key": "${TEST_STATIC_KEY}", "base_url": "https://relay.example/v1", "priority": 2},
+		{"name": "team", "type": "chatgpt", "refresh_token": "rt", "backup": true}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decls) != 2 || decls[0].APIKey != "sk-secret" || decls[1].accountType() != ChatGPTAccount {
+		t.Fatalf("decls %+v", decls)
+	}
+
+	for content, want := range map[string]string{
+		`[{"name": "a"}]`:                                                  "missing api_key",
+		`[{"name": "a", "type": "chatgpt"}]`:                               "missing refresh_token",
+		`[{"name": "a", "type": "azure", "api_key": "k"}]`:                 "unknown type",
+		`[{"api_key": "k"}]`:                                               "missing name",
+		`[{"name": "a", "api_key": "k", "proxy_url": "x"}]`:                "outbound proxy",
+		`[{"name": "a", "api_key": "k1"}, {"name": "a", "api_key": "k2"}]`: "duplicate account name",
+		`{"name": "a"}`:                                                    "cannot unmarshal",
+		`[{"name": "a", "api_key": "k", "notes": {"paused": "x"}}]`:        "unknown note state",
+	} {
+		if _, err := LoadStatic(writeAccountsFile(t, content)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", content, err, want)
+		}
+	}
+}
+
+func TestSyncStatic(t *testing.T) {
+	mgr, err := NewManager(setupTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	manual, _ := mgr.AddAPIKey(ctx, "manual", "k-manual", "", 0)
+	adopted, _ := mgr.AddAPIKey(ctx, "old name", "k-adopt", "", 0)
+	decls := []StaticAccount{
+		{Name: "relay", APIKey: "k1", Priority: 3},
+		{Name: "team", Type: "chatgpt", RefreshToken: "rt1"},
+		{Name: "adopted", APIKey: "k-adopt"},
+	}
+	if removed, err := mgr.SyncStatic(ctx, decls); err != nil || len(removed) != 0 {
+		t.Fatalf("first sync: %v %v", removed, err)
+	}
+	byName := func() map[string]*Account {
+		list, err := mgr.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]*Account)
+		for _, a := range list {
+			res[a.Name] = a
+		}
+		return res
+	}
+	got := byName()
+	if len(got) != 4 || got["manual"].Static || got["adopted"].ID != adopted.ID || !got["adopted"].Static {
+		t.Fatalf("after first sync %+v", got)
+	}
+	if r := got["relay"]; !r.Static || r.Priority != 3 || r.Weight != 1 || r.APIKey != "k1" {
+		t.Fatalf("relay %+v", r)
+	}
+
+	// Runtime changes: the refresh token rotates, the key is rejected.
+	team := got["team"]
+	team.RefreshToken, team.AccessToken = "rt2", "at"
+	mgr.Update(ctx, team)
+	mgr.MarkBlocked(ctx, got["relay"].ID, BlockInvalidToken, time.Now().Add(time.Hour))
+
+	// Unchanged credentials keep the rotated token, new ones replace the
+	// rejected key, and accounts no longer declared are deleted.
+	decls = []StaticAccount{
+		{Name: "relay", APIKey: "k2", Priority: 1},
+		{Name: "team", Type: "chatgpt", RefreshToken: "rt1", Backup: true},
+	}
+	removed, err := mgr.SyncStatic(ctx, decls)
+	if err != nil || len(removed) != 1 || removed[0].ID != adopted.ID {
+		t.Fatalf("second sync: %v %v", removed, err)
+	}
+	got = byName()
+	if len(got) != 3 || got["manual"].ID != manual.ID {
+		t.Fatalf("after second sync %+v", got)
+	}
+	if tm := got["team"]; tm.RefreshToken != "rt2" || tm.AccessToken != "at" || !tm.Backup {
+		t.Fatalf("team %+v", tm)
+	}
+	if r := got["relay"]; r.APIKey != "k2" || r.InvalidToken() || r.Exhausted || r.Priority != 1 {
+		t.Fatalf("relay %+v", r)
+	}
+}
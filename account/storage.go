@@ -0,0 +1,176 @@
+package account
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage persists accounts for a Manager. Credentials reach it already
+// encrypted by the Manager's Cipher. Accounts it returns are copies the
+// caller may modify.
+type Storage interface {
+	// List returns every account ordered by priority.
+	List(ctx context.Context) ([]*Account, error)
+	// Get returns the account with the given ID, or nil if there is none.
+	Get(ctx context.Context, id int64) (*Account, error)
+	// Insert stores a new account and returns its ID; a.ID is ignored.
+	Insert(ctx context.Context, a *Account) (int64, error)
+	// Update stores every field of an existing account except
+	// PriorityAdjustment, Capabilities and RampUp.
+	Update(ctx context.Context, a *Account) error
+	Delete(ctx context.Context, id int64) error
+	// Modify writes the fields set in c to account id, leaving the others
+	// alone. Modifying an unknown account is not an error.
+	Modify(ctx context.Context, id int64, c Change) error
+}
+
+// Change is a partial update of an account: only the non-nil fields are
+// written.
+type Change struct {
+	Exhausted          *bool
+	ResetAt            *time.Time
+	BlockReason        *string
+	TokenExpiresAt     *time.Time
+	MaintenanceStart   *time.Time
+	MaintenanceEnd     *time.Time
+	PriorityAdjustment *int
+	Priority           *int
+	Weight             *float64
+	Capabilities       *Capabilities
+	RampUp             *int
+}
+
+// apply writes the fields set in c to a.
+func (c Change) apply(a *Account) {
+	if c.Exhausted != nil {
+		a.Exhausted = *c.Exhausted
+	}
+	if c.ResetAt != nil {
+		a.ResetAt = *c.ResetAt
+	}
+	if c.BlockReason != nil {
+		a.BlockReason = *c.BlockReason
+	}
+	if c.TokenExpiresAt != nil {
+		a.TokenExpiresAt = *c.TokenExpiresAt
+	}
+	if c.MaintenanceStart != nil {
+		a.MaintenanceStart = *c.MaintenanceStart
+	}
+	if c.MaintenanceEnd != nil {
+		a.MaintenanceEnd = *c.MaintenanceEnd
+	}
+	if c.PriorityAdjustment != nil {
+		a.PriorityAdjustment = *c.PriorityAdjustment
+	}
+	if c.Priority != nil {
+		a.Priority = *c.Priority
+	}
+	if c.Weight != nil {
+		a.Weight = *c.Weight
+	}
+	if c.RampUp != nil {
+		a.RampUp = *c.RampUp
+	}
+	if c.Capabilities != nil {
+		caps := *c.Capabilities
+		a.Capabilities = &caps
+	}
+}
+
+// MemoryStore keeps accounts in memory. They are lost when the process
+// exits, which suits ephemeral deployments and tests.
+type MemoryStore struct {
+	mu       sync.Mutex
+	next     int64
+	accounts map[int64]*Account
+}
+
+var _ Storage = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{accounts: make(map[int64]*Account)}
+}
+
+// clone copies a, including its maps.
+func clone(a *Account) *Account {
+	c := *a
+	c.ModelMap = maps.Clone(a.ModelMap)
+	c.Prices = maps.Clone(a.Prices)
+	c.Notes = maps.Clone(a.Notes)
+	if a.Capabilities != nil {
+		caps := *a.Capabilities
+		c.Capabilities = &caps
+	}
+	return &c
+}
+
+// List returns every account ordered by priority, then by ID.
+func (s *MemoryStore) List(ctx context.Context) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		res = append(res, clone(a))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Priority != res[j].Priority {
+			return res[i].Priority < res[j].Priority
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id int64) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[id]
+	if a == nil {
+		return nil, nil
+	}
+	return clone(a), nil
+}
+
+func (s *MemoryStore) Insert(ctx context.Context, a *Account) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	c := clone(a)
+	c.ID = s.next
+	s.accounts[c.ID] = c
+	return c.ID, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, a *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.accounts[a.ID]
+	if old == nil {
+		return nil
+	}
+	c := clone(a)
+	c.PriorityAdjustment, c.Capabilities, c.RampUp = old.PriorityAdjustment, old.Capabilities, old.RampUp
+	s.accounts[a.ID] = c
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.accounts, id)
+	return nil
+}
+
+func (s *MemoryStore) Modify(ctx context.Context, id int64, c Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.accounts[id]; a != nil {
+		c.apply(a)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	st := NewMemoryStore()
+	mgr := NewManagerWithStorage(st)
+	mgr.Cipher = testCipher{}
+	ctx := context.Background()
+	a, err := mgr.AddAPIKey(ctx, "a", "k1", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := mgr.AddChatGPT(ctx, "b", "rt", "acct", 1)
+	if _, err := mgr.AddAPIKey(ctx, "again", "k1", "", 3); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected duplicate, got %v", err)
+	}
+	if stored, _ := st.Get(ctx, a.ID); stored.APIKey != "enc:1k" {
+		t.Fatalf("credentials stored as %q", stored.APIKey)
+	}
+	list, err := mgr.List(ctx)
+	if err != nil || len(list) != 2 || list[0].ID != b.ID || list[1].APIKey != "k1" {
+		t.Fatalf("unexpected list %+v %v", list, err)
+	}
+
+	// Accounts handed out are copies.
+	list[1].ModelMap = map[string]string{"x": "y"}
+	a.ModelMap = map[string]string{"gpt-5": "gpt-5-codex"}
+	mgr.SetPriorityAdjustment(ctx, a.ID, -2)
+	mgr.SetRampUp(ctx, a.ID, 4)
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	a.ModelMap["gpt-5"] = "changed"
+	got, _ := mgr.Get(ctx, a.ID)
+	if got.ModelMap["gpt-5"] != "gpt-5-codex" || got.PriorityAdjustment != -2 || got.RampUp != 4 {
+		t.Fatalf("unexpected account %+v", got)
+	}
+
+	reset := time.Now().Add(time.Hour)
+	mgr.MarkBlocked(ctx, a.ID, "insufficient_quota", reset)
+	mgr.SetRouting(ctx, a.ID, 0, 3)
+	got, _ = mgr.Get(ctx, a.ID)
+	if !got.Exhausted || !got.ResetAt.Equal(reset) || got.BlockReason != "insufficient_quota" || got.Priority != 0 || got.Weight != 3 || got.Name != "a" {
+		t.Fatalf("unexpected account %+v", got)
+	}
+	mgr.Reactivate(ctx, a.ID)
+	if got, _ = mgr.Get(ctx, a.ID); got.Exhausted || !got.ResetAt.IsZero() || got.BlockReason != "" {
+		t.Fatalf("reactivate failed: %+v", got)
+	}
+	// Modifying an unknown account is a no-op, as in SQLite.
+	if err := mgr.MarkExhausted(ctx, 99, reset); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mgr.Delete(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if gone, err := mgr.Get(ctx, a.ID); gone != nil || err != nil {
+		t.Fatalf("delete not effective: %v %v", gone, err)
+	}
+	if c, _ := mgr.AddAPIKey(ctx, "c", "k3", "", 0); c.ID == a.ID || c.ID == b.ID {
+		t.Fatalf("ID %d reused", c.ID)
+	}
+}
@@ -3,28 +3,426 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	stdlog "log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
-	"codex-companion/internal/account"
-	logstore "codex-companion/internal/log"
-	"codex-companion/internal/logger"
-	"codex-companion/internal/proxy"
-	"codex-companion/internal/scheduler"
-	"codex-companion/internal/webui"
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/anomaly"
+	"github.com/kxn/codex-companion/internal/auth"
+	"github.com/kxn/codex-companion/internal/backup"
+	"github.com/kxn/codex-companion/internal/bench"
+	"github.com/kxn/codex-companion/internal/config"
+	"github.com/kxn/codex-companion/internal/dbcrypt"
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/heartbeat"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/logviews"
+	"github.com/kxn/codex-companion/internal/maintenance"
+	"github.com/kxn/codex-companion/internal/metrics"
+	"github.com/kxn/codex-companion/internal/outbound"
+	"github.com/kxn/codex-companion/internal/portal"
+	"github.com/kxn/codex-companion/internal/pricing"
+	"github.com/kxn/codex-companion/internal/profiles"
+	"github.com/kxn/codex-companion/internal/quota"
+	"github.com/kxn/codex-companion/internal/refreshlog"
+	"github.com/kxn/codex-companion/internal/replay"
+	"github.com/kxn/codex-companion/internal/script"
+	"github.com/kxn/codex-companion/internal/sentry"
+	"github.com/kxn/codex-companion/internal/timeline"
+	"github.com/kxn/codex-companion/internal/tombstone"
+	"github.com/kxn/codex-companion/internal/validate"
+	"github.com/kxn/codex-companion/internal/webhook"
+	"github.com/kxn/codex-companion/internal/webui"
+	logstore "github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/proxy"
+	"github.com/kxn/codex-companion/scheduler"
 
 	_ "modernc.org/sqlite"
 )
 
+// chatgptUpstream is the Codex backend serving ChatGPT-login accounts.
+const chatgptUpstream = "https://chatgpt.com/backend-api/codex"
+
 func main() {
-	db, err := sql.Open("sqlite", "companion.db")
+	cfg := config.FromEnv()
+	if len(os.Args) > 1 && os.Args[1] == "decrypt-backup" {
+		decryptBackup(os.Args[2:], cfg.BackupPassphrase)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:], cfg)
+		return
+	}
+	// --dry-run tries the routing and middleware configuration without
+	// spending quota: requests are selected, normalized and logged as
+	// usual, then answered by the mock upstream.
+	dryRun := flag.Bool("dry-run", false, "answer upstream requests locally with canned replies, like CODEX_COMPANION_MOCK_UPSTREAM")
+	flag.Parse()
+	if *dryRun {
+		cfg.MockUpstream = true
+	}
+	dsn := cfg.DBPath + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	switch cfg.Storage {
+	case "sqlite":
+	case "memory":
+		// Tables other than accounts and logs live in an in-memory
+		// database shared by the pool's connections.
+		dsn = "file:companion?mode=memory&cache=shared&_pragma=busy_timeout(5000)"
+	default:
+		stdlog.Fatalf("unknown storage %q", cfg.Storage)
+	}
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		stdlog.Fatalf("open db: %v", err)
 	}
 	defer db.Close()
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-db" {
+		encryptDB(db, cfg)
+		return
+	}
+
+	var am *account.Manager
+	var ls logstore.Storage
+	if cfg.Storage == "memory" {
+		logger.Warnf("memory storage: accounts and logs are lost when the companion exits")
+		am, ls = account.NewManagerWithStorage(account.NewMemoryStore()), logstore.NewMemoryStore(cfg.MemoryLogs)
+	} else {
+		if am, err = account.NewManager(db); err != nil {
+			stdlog.Fatalf("account manager: %v", err)
+		}
+		store, err := logstore.NewStore(db)
+		if err != nil {
+			stdlog.Fatalf("log store: %v", err)
+		}
+		if c := dbCipher(db, cfg); c != nil {
+			am.Cipher, store.Cipher = c, c
+		}
+		ls = store
+	}
+	am.RampUp = cfg.RampUp
+	sched := scheduler.New(am)
+	if err := sched.SetMode(cfg.SchedulerMode); err != nil {
+		stdlog.Fatalf("scheduler: %v", err)
+	}
+	ctx := context.Background()
+	sched.Adaptive = cfg.AdaptivePriority
+	sched.StartTuner(ctx, time.Minute)
+
+	maint, err := maintenance.New(db, cfg.MaintenanceInterval, cfg.MaintenanceWindow)
+	if err != nil {
+		stdlog.Fatalf("maintenance: %v", err)
+	}
+	maint.Start(ctx, time.Minute)
+
+	health := dbhealth.New(db, cfg.DBPath, cfg.DBSizeWarnBytes)
+	health.Register(metrics.Default)
+	health.Start(ctx, time.Minute)
+	events.Default.Register(metrics.Default)
+	if cfg.StatsDAddr != "" {
+		statsd, err := metrics.NewStatsD(metrics.Default, cfg.StatsDAddr, cfg.StatsDPrefix, cfg.StatsDTags)
+		if err != nil {
+			stdlog.Fatalf("statsd: %v", err)
+		}
+		statsd.Start(ctx, cfg.StatsDInterval)
+	}
+
+	if cfg.SentryDSN != "" {
+		reporter, err := sentry.New(cfg.SentryDSN)
+		if err != nil {
+			stdlog.Fatalf("sentry: %v", err)
+		}
+		reporter.Accounts = am
+		reporter.Environment = cfg.SentryEnvironment
+		reporter.Subscribe(events.Default)
+		reporter.Start(ctx)
+	}
+
+	if cfg.HeartbeatURL != "" {
+		pinger, err := heartbeat.New(db, cfg.HeartbeatURL)
+		if err != nil {
+			stdlog.Fatalf("heartbeat: %v", err)
+		}
+		if cfg.HeartbeatFailURL != "" {
+			pinger.FailURL = cfg.HeartbeatFailURL
+		}
+		pinger.Checks = append(pinger.Checks, heartbeat.AccountsAvailable(am))
+		pinger.Subscribe(events.Default)
+		pinger.Start(ctx, cfg.HeartbeatInterval)
+	}
+
+	hooks, err := webhook.New(db, cfg.WebhookURLs, cfg.WebhookSecret, cfg.WebhookMaxAttempts)
+	if err != nil {
+		stdlog.Fatalf("webhooks: %v", err)
+	}
+	if len(cfg.WebhookURLs) > 0 {
+		hooks.Subscribe(events.Default)
+	}
+	hooks.Start(ctx, 5*time.Second)
+
+	// The upstreams, token endpoint included, may only be reachable
+	// through a proxy; webhooks and other endpoints of the operator's keep
+	// the default client.
+	transport, err := outbound.Transport(cfg.OutboundProxy)
+	if err != nil {
+		stdlog.Fatalf("%v", err)
+	}
+	auth.Client = &http.Client{Transport: transport}
+	auth.Subscribe(events.Default)
+
+	quotaPoller, err := quota.New(db, am, quota.UsageURL(chatgptUpstream))
+	if err != nil {
+		stdlog.Fatalf("quota: %v", err)
+	}
+	quotaPoller.Client.Transport = transport
+	quotaPoller.Subscribe(events.Default)
+	if cfg.MockUpstream {
+		// A dry run polls the mock too, keeping the usage endpoint out
+		// of it like the upstreams.
+		quotaPoller.Client.Transport = &bench.Mock{}
+	}
+	if cfg.QuotaPollInterval > 0 {
+		quotaPoller.Start(ctx, cfg.QuotaPollInterval)
+	}
+
+	refreshes, err := refreshlog.New(db)
+	if err != nil {
+		stdlog.Fatalf("refresh log: %v", err)
+	}
+	refreshes.Subscribe(events.Default)
+
+	transitions, err := timeline.New(db)
+	if err != nil {
+		stdlog.Fatalf("timeline: %v", err)
+	}
+	transitions.Subscribe(events.Default)
+
+	priorityProfiles, err := profiles.New(db, am)
+	if err != nil {
+		stdlog.Fatalf("priority profiles: %v", err)
+	}
+	priorityProfiles.Bus = events.Default
+	priorityProfiles.Start(ctx)
+
+	logViews, err := logviews.New(db)
+	if err != nil {
+		stdlog.Fatalf("log views: %v", err)
+	}
+
+	tombstones, err := tombstone.New(db, am, ls)
+	if err != nil {
+		stdlog.Fatalf("tombstones: %v", err)
+	}
+	if tombstones.Policy, err = tombstone.ParsePolicy(cfg.DeletedLogs); err != nil {
+		stdlog.Fatalf("%v", err)
+	}
+	tombstones.Delay = cfg.DeletedLogsDelay
+	tombstones.Start(ctx, time.Hour)
+
+	if cfg.AccountsFile != "" {
+		decls, err := account.LoadStatic(cfg.AccountsFile)
+		if err != nil {
+			stdlog.Fatalf("%v", err)
+		}
+		removed, err := am.SyncStatic(ctx, decls)
+		if err != nil {
+			stdlog.Fatalf("static accounts: %v", err)
+		}
+		for _, a := range removed {
+			if err := tombstones.AccountDeleted(ctx, a); err != nil {
+				logger.Errorf("tombstone of account %d failed: %v", a.ID, err)
+			}
+		}
+		logger.Infof("loaded %d static accounts from %s", len(decls), cfg.AccountsFile)
+	}
+
+	// Every table exists by now.
+	if _, err := health.CheckIntegrity(ctx, cfg.DBRepair); err != nil {
+		logger.Errorf("database integrity check: %v", err)
+	}
+
+	proxyHandler := proxy.New(sched, ls, "https://api.openai.com", chatgptUpstream)
+	proxyHandler.Client.Transport = transport
+	proxyHandler.Chaos = proxy.NewChaos()
+	proxyHandler.Subscribe(events.Default)
+	proxyHandler.BillingCooldown = cfg.BillingCooldown
+	proxyHandler.SlowThreshold = cfg.SlowRequest
+	proxyHandler.LogBodyLimit = cfg.LogBodyLimit
+	proxyHandler.ThrottlePercent = cfg.ThrottlePercent
+	proxyHandler.Pass429, proxyHandler.Pass429Keys = cfg.Pass429, cfg.Pass429Keys
+	proxyHandler.ForceAccountKeys = cfg.ForceAccountKeys
+	for _, key := range slices.Concat(cfg.Pass429Keys, cfg.ForceAccountKeys) {
+		if err := proxy.CheckClientKeyID(key); err != nil {
+			stdlog.Fatalf("%v", err)
+		}
+	}
+	proxyHandler.QuarantineThreshold, proxyHandler.QuarantineCooldown = cfg.QuarantineThreshold, cfg.QuarantineCooldown
+	proxyHandler.InvalidTokenThreshold = cfg.InvalidTokenThreshold
+	proxyHandler.AccountSummary = cfg.AccountSummary
+	proxyHandler.DecisionTrace = cfg.DecisionTrace
+	proxyHandler.RetryBackoff = cfg.RetryBackoff
+	proxyHandler.CacheAffinity = cfg.CacheAffinity
+	if cfg.ResponseCacheTTL > 0 && cfg.ResponseCacheSize > 0 {
+		proxyHandler.Cache = proxy.NewResponseCache(cfg.ResponseCacheTTL, cfg.ResponseCacheSize)
+	}
+	if proxyHandler.FieldPolicies, err = proxy.ParseFieldPolicies(cfg.FieldPolicies); err != nil {
+		stdlog.Fatalf("field policies: %v", err)
+	}
+	if proxyHandler.Annotations, err = proxy.ParseAnnotations(cfg.Annotations); err != nil {
+		stdlog.Fatalf("annotations: %v", err)
+	}
+	if proxyHandler.ErrorRules, err = proxy.ParseErrorRules(cfg.ErrorRules); err != nil {
+		stdlog.Fatalf("error rules: %v", err)
+	}
+	failover, err := proxy.ParseFailoverStatuses(cfg.FailoverStatuses)
+	if err != nil {
+		stdlog.Fatalf("%v", err)
+	}
+	proxyHandler.ErrorRules = proxy.WithFailover(proxyHandler.ErrorRules, failover)
+	if proxyHandler.ClientPins, err = proxy.ParseClientPins(cfg.ClientPins); err != nil {
+		stdlog.Fatalf("client pins: %v", err)
+	}
+	if proxyHandler.PathRules, err = proxy.ParsePathRules(cfg.PathRules); err != nil {
+		stdlog.Fatalf("path rules: %v", err)
+	}
+	if cfg.ShadowPercent > 0 {
+		if proxyHandler.Shadow, err = proxy.ParseShadow(cfg.ShadowTarget, cfg.ShadowAPIKey, float64(cfg.ShadowPercent)); err != nil {
+			stdlog.Fatalf("shadow: %v", err)
+		}
+	}
+	if cfg.MaxInflight > 0 {
+		proxyHandler.Admission = proxy.NewAdmission(cfg.MaxInflight, max(cfg.InflightQueue, 0), cfg.InflightWait)
+	}
+	if proxyHandler.ClientModels, err = proxy.ParseClientModels(cfg.ClientModels); err != nil {
+		stdlog.Fatalf("client models: %v", err)
+	}
+	if proxyHandler.BandwidthCaps, err = proxy.ParseBandwidthCaps(cfg.BandwidthCaps); err != nil {
+		stdlog.Fatalf("bandwidth caps: %v", err)
+	}
+	if proxyHandler.ResponseHeaders, err = proxy.ParseResponseHeaders(cfg.ResponseHeaders); err != nil {
+		stdlog.Fatalf("response headers: %v", err)
+	}
+	if cfg.AnomalyWindow > 0 {
+		detector := anomaly.New(events.Default)
+		detector.Window = cfg.AnomalyWindow
+		detector.SpikeFactor = float64(cfg.AnomalySpikeFactor)
+		detector.MinRequests, detector.AuthFailures = cfg.AnomalyMinRequests, cfg.AnomalyAuthFailures
+		proxyHandler.Log = detector.Sink(proxyHandler.Log)
+		detector.Start(ctx)
+	}
+	if cfg.LogEnrichWorkers > 0 {
+		// After the anomaly detector so that it sees the enriched usage.
+		sink, ok := proxyHandler.Log.(proxy.LogEnricher)
+		if !ok {
+			stdlog.Fatalf("log enrichment: the log store cannot update logs")
+		}
+		proxyHandler.Enricher = proxy.NewEnricher(sink, cfg.LogEnrichQueue)
+		proxyHandler.Enricher.Start(ctx, cfg.LogEnrichWorkers)
+	}
+	if cfg.WarmupProbe {
+		proxyHandler.WarmupModel = cfg.WarmupModel
+		sched.Warmup = proxyHandler.Warmup
+	}
+	if cfg.MockUpstream {
+		logger.Warnf("mock upstream mode: requests are answered locally, not forwarded")
+		proxyHandler.Client.Transport = &bench.Mock{Latency: cfg.MockLatency, Chunks: 20}
+	}
+	if cfg.RecordDir != "" {
+		rec, err := replay.NewRecorder(filepath.Join(cfg.RecordDir, replay.FixtureName(time.Now())), proxyHandler.Client.Transport)
+		if err != nil {
+			stdlog.Fatalf("record: %v", err)
+		}
+		defer rec.Close()
+		proxyHandler.Client.Transport = rec
+	}
+	// Started once Warmup and the proxy client it uses are configured.
+	sched.StartReactivator(ctx, time.Minute)
+	var validator *validate.Validator
+	if cfg.ValidateConcurrency > 0 {
+		validator = validate.New(am, proxyHandler.Probe)
+		validator.Concurrency, validator.Timeout = cfg.ValidateConcurrency, cfg.ValidateTimeout
+		validator.Start(ctx, cfg.ValidateInterval)
+	}
+	prices, err := pricing.Parse(cfg.ModelPrices)
+	if err != nil {
+		stdlog.Fatalf("model prices: %v", err)
+	}
+	sched.Prices = prices
+	adminHandler := (&webui.Admin{Accounts: am, Logs: ls, Maintenance: maint, DBHealth: health, Events: events.Default, Webhooks: hooks, Chaos: proxyHandler.Chaos, Scheduler: sched, Quota: quotaPoller, Refreshes: refreshes, Timeline: transitions, Tombstones: tombstones, Validator: validator, Profiles: priorityProfiles, Proxy: proxyHandler, Prices: prices, SlowThreshold: cfg.SlowRequest, LogViews: logViews, DB: db, BackupPassphrase: cfg.BackupPassphrase}).Handler()
+	if cfg.ScriptDir != "" {
+		scripts, err := script.LoadDir(cfg.ScriptDir, script.Limits{Timeout: cfg.ScriptTimeout})
+		if err != nil {
+			stdlog.Fatalf("load scripts: %v", err)
+		}
+		for _, s := range scripts {
+			if err := proxyHandler.Register(s); err != nil {
+				stdlog.Fatalf("register script %s: %v", s.Name, err)
+			}
+		}
+	}
 
+	// The proxy listener carries the admin surface too unless it has its
+	// own address, which lets the proxy be exposed while admin stays local.
+	mux := http.NewServeMux()
+	adminMux := mux
+	if cfg.AdminAddr != "" {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.Handle("/admin/", adminHandler)
+	adminMux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/admin/", http.StatusFound)
+	})
+	adminMux.Handle("/metrics", metrics.Handler(metrics.Default))
+	mux.Handle("/portal/", (&portal.Portal{Accounts: am, Logs: ls, Quota: quotaPoller}).Handler())
+	mux.HandleFunc("/portal", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/portal/", http.StatusFound)
+	})
+	mux.Handle("/", proxyHandler)
+
+	if cfg.AdminAddr != "" {
+		go serve("admin", cfg.AdminAddr, adminMux)
+	}
+	serve("proxy", cfg.Addr, mux)
+}
+
+// dbCipher returns the cipher for the database key, or nil when no key is
+// configured. Starting without the key of an encrypted database is fatal.
+func dbCipher(db *sql.DB, cfg *config.Config) *dbcrypt.Cipher {
+	key, err := dbcrypt.LoadKey(cfg.DBKey, cfg.DBKeyFile)
+	if err != nil {
+		stdlog.Fatalf("database key: %v", err)
+	}
+	if key == "" {
+		encrypted, err := dbcrypt.Encrypted(db)
+		if err != nil {
+			stdlog.Fatalf("database encryption: %v", err)
+		}
+		if encrypted {
+			stdlog.Fatal("database is encrypted: set CODEX_COMPANION_DB_KEY or CODEX_COMPANION_DB_KEY_FILE")
+		}
+		return nil
+	}
+	c, err := dbcrypt.Open(db, key)
+	if err != nil {
+		stdlog.Fatalf("database encryption: %v", err)
+	}
+	return c
+}
+
+// encryptDB encrypts the credentials and logged headers and bodies already
+// stored in db, in place. The companion must not be running meanwhile.
+func encryptDB(db *sql.DB, cfg *config.Config) {
+	if cfg.DBKey == "" && cfg.DBKeyFile == "" {
+		stdlog.Fatal("usage: CODEX_COMPANION_DB_KEY=... companion encrypt-db")
+	}
 	am, err := account.NewManager(db)
 	if err != nil {
 		stdlog.Fatalf("account manager: %v", err)
@@ -33,27 +431,103 @@ func main() {
 	if err != nil {
 		stdlog.Fatalf("log store: %v", err)
 	}
-	sched := scheduler.New(am)
+	c := dbCipher(db, cfg)
+	am.Cipher, ls.Cipher = c, c
 	ctx := context.Background()
-	sched.StartReactivator(ctx, time.Minute)
-
-	adminHandler := webui.AdminHandler(am, ls)
-	proxyHandler := proxy.New(sched, ls, "https://api.openai.com", "https://chatgpt.com/backend-api/codex")
+	accounts, err := am.Reencrypt(ctx)
+	if err != nil {
+		stdlog.Fatalf("encrypt accounts: %v", err)
+	}
+	logs, err := ls.Reencrypt(ctx)
+	if err != nil {
+		stdlog.Fatalf("encrypt logs: %v", err)
+	}
+	// The rewritten rows leave their plaintext behind in free pages and
+	// the WAL until both are cleared.
+	if _, err := db.Exec(`VACUUM`); err != nil {
+		stdlog.Fatalf("vacuum: %v", err)
+	}
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		stdlog.Fatalf("checkpoint: %v", err)
+	}
+	logger.Infof("encrypted %d accounts and %d logs in %s", accounts, logs, cfg.DBPath)
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/admin/", adminHandler)
-	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/admin/", http.StatusFound)
+// runBench fires synthetic traffic at a running companion, see
+// internal/bench: bench [-c N] [-d DURATION] [-stream] ...
+func runBench(args []string, cfg *config.Config) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	base := "http://" + cfg.Addr
+	url := fs.String("url", base, "base URL of the companion proxy")
+	metricsURL := fs.String("metrics", base+"/metrics", "metrics URL of the companion, empty to skip database figures")
+	concurrency := fs.Int("c", 10, "concurrent requests")
+	dur := fs.Duration("d", 10*time.Second, "duration of the run")
+	stream := fs.Bool("stream", true, "request event streams")
+	model := fs.String("model", "gpt-5", "model of the requests")
+	key := fs.String("key", "", "client key sent as bearer token")
+	fs.Parse(args)
+	res, err := bench.Run(context.Background(), bench.Options{
+		URL:         *url,
+		MetricsURL:  *metricsURL,
+		Concurrency: *concurrency,
+		Duration:    *dur,
+		Stream:      *stream,
+		Model:       *model,
+		Key:         *key,
 	})
-	mux.Handle("/", proxyHandler)
+	if err != nil {
+		stdlog.Fatalf("bench: %v", err)
+	}
+	res.Report(os.Stdout)
+}
 
-	addr := "127.0.0.1:8080"
-	if v := os.Getenv("CODEX_COMPANION_ADDR"); v != "" {
-		addr = v
+// decryptBackup restores an encrypted backup: decrypt-backup IN OUT.
+func decryptBackup(args []string, passphrase string) {
+	if len(args) != 2 || passphrase == "" {
+		stdlog.Fatal("usage: CODEX_COMPANION_BACKUP_PASSPHRASE=... companion decrypt-backup IN OUT")
+	}
+	in, err := os.Open(args[0])
+	if err != nil {
+		stdlog.Fatalf("decrypt backup: %v", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		stdlog.Fatalf("decrypt backup: %v", err)
+	}
+	if err := backup.Decrypt(out, in, passphrase); err != nil {
+		out.Close()
+		os.Remove(args[1])
+		stdlog.Fatalf("decrypt backup: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		stdlog.Fatalf("decrypt backup: %v", err)
+	}
+}
+
+// serve listens on addr, a TCP address or "unix:/path", and serves h until
+// the server fails, which is fatal.
+func serve(name, addr string, h http.Handler) {
+	var ln net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// A socket left behind by an unclean shutdown blocks the bind.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			stdlog.Fatalf("%s: remove stale socket: %v", name, err)
+		}
+		ln, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0o600)
+		}
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		stdlog.Fatalf("%s listen: %v", name, err)
 	}
-	logger.Infof("Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		logger.Errorf("server error: %v", err)
+	logger.Infof("Starting %s server on %s", name, addr)
+	if err := http.Serve(ln, h); err != nil {
+		logger.Errorf("%s server error: %v", name, err)
 		stdlog.Fatal(err)
 	}
 }
@@ -1,8 +1,11 @@
-module codex-companion
+module github.com/kxn/codex-companion
 
 go 1.24.3
 
-require modernc.org/sqlite v1.38.2
+require (
+	github.com/yuin/gopher-lua v1.1.1
+	modernc.org/sqlite v1.38.2
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
@@ -0,0 +1,263 @@
+// Package anomaly watches the proxied traffic for patterns that hint at a
+// leaked client key or broken credentials: a client key suddenly sending
+// far more requests or tokens than it used to, or an account receiving a
+// burst of 401 responses. Each finding is published as an
+// events.AnomalyDetected event, which reaches webhooks and the admin UI.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/log"
+)
+
+// Kinds of anomalies.
+const (
+	RequestSpike = "request_spike"
+	TokenSpike   = "token_spike"
+	AuthFailures = "auth_failures"
+)
+
+// Anomaly is one unusual pattern seen in a window.
+type Anomaly struct {
+	Kind string `json:"kind"`
+	// ClientKey is set for spikes, AccountID for auth failures.
+	ClientKey string `json:"client_key,omitempty"`
+	AccountID int64  `json:"account_id,omitempty"`
+	// Value is the count in the window, Baseline the average of the
+	// previous windows.
+	Value    int64   `json:"value"`
+	Baseline float64 `json:"baseline"`
+}
+
+// Message describes a for notifications.
+func (a Anomaly) Message(window time.Duration) string {
+	client := a.ClientKey
+	if client == "" {
+		client = "anonymous clients"
+	}
+	switch a.Kind {
+	case RequestSpike:
+		return fmt.Sprintf("%s sent %d requests in %s, against an average of %.1f", client, a.Value, window, a.Baseline)
+	case TokenSpike:
+		return fmt.Sprintf("%s used %d tokens in %s, against an average of %.0f", client, a.Value, window, a.Baseline)
+	default:
+		return fmt.Sprintf("account %d received %d 401 responses in %s", a.AccountID, a.Value, window)
+	}
+}
+
+// window holds the traffic counted in one analysis window.
+type window struct {
+	requests     map[string]int64
+	tokens       map[string]int64
+	unauthorized map[int64]int64
+}
+
+func newWindow() window {
+	return window{requests: make(map[string]int64), tokens: make(map[string]int64), unauthorized: make(map[int64]int64)}
+}
+
+// Detector counts request logs per window and compares each window with
+// the ones before it.
+type Detector struct {
+	// Window is the length of an analysis window.
+	Window time.Duration
+	// Baseline is the number of past windows a window is compared with.
+	// Spikes are only reported once that many windows have been seen.
+	Baseline int
+	// SpikeFactor is how many times its baseline a client key's requests or
+	// tokens must reach to be reported, provided they reach MinRequests or
+	// MinTokens.
+	SpikeFactor float64
+	MinRequests int64
+	MinTokens   int64
+	// AuthFailures is the number of 401 responses of one account within a
+	// window that is reported; zero disables it.
+	AuthFailures int64
+	// Cooldown suppresses repeated reports of the same kind for the same
+	// client key or account.
+	Cooldown time.Duration
+	Bus      *events.Bus
+
+	mu       sync.Mutex
+	cur      window
+	history  []window
+	reported map[string]time.Time
+}
+
+// New creates a Detector with the default thresholds publishing to bus.
+func New(bus *events.Bus) *Detector {
+	return &Detector{
+		Window:       5 * time.Minute,
+		Baseline:     12,
+		SpikeFactor:  5,
+		MinRequests:  100,
+		MinTokens:    1_000_000,
+		AuthFailures: 10,
+		Cooldown:     time.Hour,
+		Bus:          bus,
+		cur:          newWindow(),
+		reported:     make(map[string]time.Time),
+	}
+}
+
+// Observe counts one logged upstream attempt.
+func (d *Detector) Observe(rl *log.RequestLog) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cur.requests[rl.ClientKey]++
+	d.cur.tokens[rl.ClientKey] += rl.InputTokens + rl.OutputTokens
+	if rl.Status == 401 {
+		d.cur.unauthorized[rl.AccountID]++
+	}
+}
+
+// LogSink persists request logs, like proxy.LogSink.
+type LogSink interface {
+	Insert(ctx context.Context, rl *log.RequestLog) error
+}
+
+type sink struct {
+	next LogSink
+	d    *Detector
+}
+
+func (s sink) Insert(ctx context.Context, rl *log.RequestLog) error {
+	s.d.Observe(rl)
+	return s.next.Insert(ctx, rl)
+}
+
+// LogEnricher is a LogSink whose logs are completed after they are
+// inserted, like proxy.LogEnricher.
+type LogEnricher interface {
+	LogSink
+	InsertID(ctx context.Context, rl *log.RequestLog) (int64, error)
+	Enrich(ctx context.Context, rl *log.RequestLog) error
+}
+
+// enrichSink observes the token usage of a log when it is enriched, since
+// the log had none when it was inserted.
+type enrichSink struct {
+	sink
+	next LogEnricher
+}
+
+func (s enrichSink) InsertID(ctx context.Context, rl *log.RequestLog) (int64, error) {
+	s.d.Observe(rl)
+	return s.next.InsertID(ctx, rl)
+}
+
+func (s enrichSink) Enrich(ctx context.Context, rl *log.RequestLog) error {
+	s.d.mu.Lock()
+	s.d.cur.tokens[rl.ClientKey] += rl.InputTokens + rl.OutputTokens
+	s.d.mu.Unlock()
+	return s.next.Enrich(ctx, rl)
+}
+
+// Sink returns a LogSink that observes every request log before passing it
+// on to next. When next is a LogEnricher, so is the returned sink.
+func (d *Detector) Sink(next LogSink) LogSink {
+	if e, ok := next.(LogEnricher); ok {
+		return enrichSink{sink: sink{next: next, d: d}, next: e}
+	}
+	return sink{next: next, d: d}
+}
+
+// Analyze closes the current window, publishes the anomalies found in it
+// that are not in their cooldown and returns them.
+func (d *Detector) Analyze(now time.Time) []Anomaly {
+	d.mu.Lock()
+	w, history := d.cur, d.history
+	d.cur = newWindow()
+	d.history = append(d.history, w)
+	if len(d.history) > d.Baseline {
+		d.history = d.history[len(d.history)-d.Baseline:]
+	}
+	d.mu.Unlock()
+
+	var found []Anomaly
+	if d.Baseline > 0 && len(history) >= d.Baseline {
+		found = append(found, spikes(RequestSpike, w.requests, history, func(w window) map[string]int64 { return w.requests }, d.SpikeFactor, d.MinRequests)...)
+		found = append(found, spikes(TokenSpike, w.tokens, history, func(w window) map[string]int64 { return w.tokens }, d.SpikeFactor, d.MinTokens)...)
+	}
+	if d.AuthFailures > 0 {
+		for id, n := range w.unauthorized {
+			if n >= d.AuthFailures {
+				found = append(found, Anomaly{Kind: AuthFailures, AccountID: id, Value: n})
+			}
+		}
+	}
+	var res []Anomaly
+	for _, a := range found {
+		if d.report(a, now) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// spikes returns the keys whose count in cur reaches min and factor times
+// their average over history.
+func spikes(kind string, cur map[string]int64, history []window, count func(window) map[string]int64, factor float64, min int64) []Anomaly {
+	var res []Anomaly
+	for key, n := range cur {
+		if n < min {
+			continue
+		}
+		var sum int64
+		for _, h := range history {
+			sum += count(h)[key]
+		}
+		base := float64(sum) / float64(len(history))
+		if float64(n) > factor*base {
+			res = append(res, Anomaly{Kind: kind, ClientKey: key, Value: n, Baseline: base})
+		}
+	}
+	return res
+}
+
+// report publishes a unless the same anomaly was reported within the
+// cooldown.
+func (d *Detector) report(a Anomaly, now time.Time) bool {
+	id := fmt.Sprintf("%s/%s/%d", a.Kind, a.ClientKey, a.AccountID)
+	d.mu.Lock()
+	if last, ok := d.reported[id]; ok && now.Sub(last) < d.Cooldown {
+		d.mu.Unlock()
+		return false
+	}
+	d.reported[id] = now
+	d.mu.Unlock()
+	msg := a.Message(d.Window)
+	logger.Warnf("anomaly: %s", msg)
+	if d.Bus != nil {
+		d.Bus.Publish(events.Event{
+			Type:      events.AnomalyDetected,
+			Time:      now,
+			AccountID: a.AccountID,
+			Message:   msg,
+			Data:      map[string]any{"kind": a.Kind, "client_key": a.ClientKey, "value": a.Value, "baseline": a.Baseline, "window": d.Window.String()},
+		})
+	}
+	return true
+}
+
+// Start analyzes a window every Window until ctx is done.
+func (d *Detector) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.Window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				d.Analyze(now)
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package anomaly
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/log"
+)
+
+type nopSink struct{ n int }
+
+func (s *nopSink) Insert(context.Context, *log.RequestLog) error {
+	s.n++
+	return nil
+}
+
+func TestDetector(t *testing.T) {
+	bus := events.NewBus()
+	var got []events.Event
+	unsubscribe := bus.Subscribe(func(e events.Event) { got = append(got, e) }, events.AnomalyDetected)
+	d := New(bus)
+	d.Baseline, d.MinRequests, d.MinTokens, d.AuthFailures = 3, 10, 1000, 3
+	next := &nopSink{}
+	sink := d.Sink(next)
+	send := func(key string, n int, tokens int64) {
+		for i := 0; i < n; i++ {
+			sink.Insert(context.Background(), &log.RequestLog{ClientKey: key, Status: 200, InputTokens: tokens})
+		}
+	}
+	now := time.Now()
+	// Spikes are not reported before the baseline is complete.
+	for i := 0; i < 3; i++ {
+		send("ck-steady", 20, 10)
+		if i == 0 {
+			send("ck-leaked", 100, 10)
+		} else {
+			send("ck-leaked", 2, 10)
+		}
+		if found := d.Analyze(now); len(found) != 0 {
+			t.Fatalf("window %d: unexpected anomalies %+v", i, found)
+		}
+	}
+
+	send("ck-steady", 30, 10)
+	send("ck-leaked", 200, 10)
+	send("ck-small", 9, 0)
+	for i := 0; i < 3; i++ {
+		sink.Insert(context.Background(), &log.RequestLog{AccountID: 7, Status: 401})
+	}
+	found := d.Analyze(now)
+	kinds := make(map[string]Anomaly)
+	for _, a := range found {
+		kinds[a.Kind+" "+a.ClientKey] = a
+	}
+	if len(found) != 3 || kinds["request_spike ck-leaked"].Value != 200 || kinds["request_spike ck-leaked"].Baseline != 104.0/3 || kinds["token_spike ck-leaked"].Value != 2000 || kinds["auth_failures "].AccountID != 7 {
+		t.Fatalf("unexpected anomalies %+v", found)
+	}
+	if next.n != 3*20+104+30+200+9+3 {
+		t.Fatalf("sink passed on %d logs", next.n)
+	}
+
+	// The same anomalies are not reported again within the cooldown.
+	send("ck-leaked", 500, 10)
+	if found := d.Analyze(now.Add(d.Window)); len(found) != 0 {
+		t.Fatalf("reported again within cooldown: %+v", found)
+	}
+	send("ck-leaked", 2000, 10)
+	if found := d.Analyze(now.Add(2 * time.Hour)); len(found) != 2 {
+		t.Fatalf("expected spikes after cooldown, got %+v", found)
+	}
+
+	unsubscribe()
+	if len(got) != 5 || got[0].Type != events.AnomalyDetected || !strings.Contains(got[0].Message, "in 5m0s") {
+		t.Fatalf("unexpected events %+v", got)
+	}
+}
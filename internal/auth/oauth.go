@@ -8,13 +8,30 @@ import (
 	"net/http"
 	"time"
 
-	"codex-companion/internal/account"
-	"codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/outbound"
 )
 
 const tokenURL = "https://auth.openai.com/oauth/token"
 const clientID = "app_EMoamEEZ73f0CkXaXp7hrann"
 
+// Client sends the token requests, e.g. through an outbound proxy; nil
+// means http.DefaultClient.
+var Client *http.Client
+
+// transports are the dedicated transports of accounts refreshing their
+// tokens through their own proxy.
+var transports outbound.Accounts
+
+// Subscribe drops the transport of an account updated or deleted on bus,
+// see outbound.Accounts.Subscribe. It returns the function cancelling the
+// subscription.
+func Subscribe(bus *events.Bus) func() {
+	return transports.Subscribe(bus)
+}
+
 // tokenResponse is response from refresh token exchange.
 type tokenResponse struct {
 	AccessToken  string `json:"access_token"`
@@ -25,6 +42,18 @@ type tokenResponse struct {
 // ExchangeRefreshToken exchanges a refresh token for an access token and
 // returns the new refresh token if rotation occurs.
 func ExchangeRefreshToken(ctx context.Context, rt string) (string, string, time.Duration, error) {
+	return exchange(ctx, client(), rt)
+}
+
+// client returns Client, or http.DefaultClient when it is nil.
+func client() *http.Client {
+	if Client == nil {
+		return http.DefaultClient
+	}
+	return Client
+}
+
+func exchange(ctx context.Context, client *http.Client, rt string) (string, string, time.Duration, error) {
 	payload := map[string]string{
 		"client_id":     clientID,
 		"grant_type":    "refresh_token",
@@ -38,7 +67,7 @@ func ExchangeRefreshToken(ctx context.Context, rt string) (string, string, time.
 		return "", "", 0, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		logger.Errorf("token request failed: %v", err)
 		return "", "", 0, err
@@ -56,7 +85,33 @@ func ExchangeRefreshToken(ctx context.Context, rt string) (string, string, time.
 	return tr.AccessToken, tr.RefreshToken, time.Duration(tr.ExpiresIn) * time.Second, nil
 }
 
-// Refresh updates access token if it's expiring soon.
+// Refresh triggers recorded with every attempt. TriggerRequest is the
+// default: the scheduler refreshing the token of the account it selected.
+const (
+	TriggerRequest  = "request"
+	TriggerQuota    = "quota"
+	TriggerProbe    = "probe"
+	TriggerWarmup   = "warmup"
+	TriggerValidate = "validate"
+)
+
+type triggerKey struct{}
+
+// WithTrigger returns ctx marking refreshes made with it as caused by
+// trigger.
+func WithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+func triggerFrom(ctx context.Context) string {
+	if t, ok := ctx.Value(triggerKey{}).(string); ok {
+		return t
+	}
+	return TriggerRequest
+}
+
+// Refresh updates access token if it's expiring soon. Every attempt is
+// published as an events.TokenRefreshed or events.RefreshFailed event.
 func Refresh(ctx context.Context, mgr *account.Manager, a *account.Account) error {
 	if a.Type != account.ChatGPTAccount {
 		return nil
@@ -64,7 +119,26 @@ func Refresh(ctx context.Context, mgr *account.Manager, a *account.Account) erro
 	if time.Until(a.TokenExpiresAt) > time.Minute {
 		return nil
 	}
-	token, rt, _, err := ExchangeRefreshToken(ctx, a.RefreshToken)
+	start := time.Now()
+	data := map[string]any{"trigger": triggerFrom(ctx)}
+	err := refresh(ctx, mgr, a)
+	data["duration_ms"] = time.Since(start).Milliseconds()
+	if err != nil {
+		events.Publish(events.Event{Type: events.RefreshFailed, AccountID: a.ID, Message: err.Error(), Data: data})
+		return err
+	}
+	data["expires_at"] = a.TokenExpiresAt
+	events.Publish(events.Event{Type: events.TokenRefreshed, AccountID: a.ID, Data: data})
+	return nil
+}
+
+func refresh(ctx context.Context, mgr *account.Manager, a *account.Account) error {
+	// The token endpoint sees the account's own proxy, like its upstream.
+	c, err := transports.Client(client(), a.ID, outbound.Options{ProxyURL: a.ProxyURL})
+	if err != nil {
+		return err
+	}
+	token, rt, _, err := exchange(ctx, c, a.RefreshToken)
 	if err != nil {
 		logger.Errorf("exchange refresh token failed: %v", err)
 		return err
@@ -3,16 +3,14 @@ package auth
 import (
 	"bytes"
 	"context"
-	"database/sql"
-	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
-	"codex-companion/internal/account"
-	_ "modernc.org/sqlite"
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
 )
 
 type roundTripFunc func(*http.Request) (*http.Response, error)
@@ -49,15 +47,7 @@ func TestExchangeRefreshTokenError(t *testing.T) {
 }
 
 func setupAuthTestMgr(t *testing.T) (*account.Manager, *account.Account) {
-	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
-	db, err := sql.Open("sqlite", dsn)
-	if err != nil {
-		t.Fatal(err)
-	}
-	mgr, err := account.NewManager(db)
-	if err != nil {
-		t.Fatal(err)
-	}
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
 	ctx := context.Background()
 	a, err := mgr.AddChatGPT(ctx, "c", "rt", "", 1)
 	if err != nil {
@@ -104,8 +94,7 @@ func TestRefreshNoNeed(t *testing.T) {
 }
 
 func TestRefreshAPIKey(t *testing.T) {
-	db, _ := sql.Open("sqlite", "file:auth2?mode=memory&cache=shared")
-	mgr, _ := account.NewManager(db)
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
 	ctx := context.Background()
 	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
 	defer swapClient(roundTripFunc(func(r *http.Request) (*http.Response, error) {
@@ -116,3 +105,37 @@ func TestRefreshAPIKey(t *testing.T) {
 		t.Fatalf("refresh: %v", err)
 	}
 }
+
+func TestRefreshPublishesAttempts(t *testing.T) {
+	mgr, a := setupAuthTestMgr(t)
+	var got []events.Event
+	unsub := events.Default.Subscribe(func(e events.Event) { got = append(got, e) }, events.TokenRefreshed, events.RefreshFailed)
+	status := 200
+	defer swapClient(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"access_token":"new","refresh_token":"rt2","expires_in":120}`
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	}))()
+	ctx := WithTrigger(context.Background(), TriggerQuota)
+	if err := Refresh(ctx, mgr, a); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	status = 400
+	a.TokenExpiresAt = time.Time{}
+	if err := Refresh(context.Background(), mgr, a); err == nil {
+		t.Fatalf("expected error")
+	}
+	unsub()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %+v", got)
+	}
+	ok, failed := got[0], got[1]
+	if ok.Type != events.TokenRefreshed || ok.AccountID != a.ID || ok.Data["trigger"] != TriggerQuota {
+		t.Fatalf("unexpected success event: %+v", ok)
+	}
+	if exp, _ := ok.Data["expires_at"].(time.Time); time.Until(exp) < 27*24*time.Hour {
+		t.Fatalf("unexpected expiry: %+v", ok.Data)
+	}
+	if failed.Type != events.RefreshFailed || failed.Data["trigger"] != TriggerRequest || failed.Message == "" {
+		t.Fatalf("unexpected failure event: %+v", failed)
+	}
+}
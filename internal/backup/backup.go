@@ -0,0 +1,156 @@
+// Package backup takes consistent snapshots of the SQLite database with the
+// online backup API and optionally encrypts them with a passphrase.
+package backup
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"modernc.org/sqlite"
+)
+
+// Snapshot copies the main database of db to a new SQLite file at path. The
+// copy is a point-in-time image even while other connections keep writing.
+func Snapshot(ctx context.Context, db *sql.DB, path string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(dc any) error {
+		src, ok := dc.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("driver %T does not support online backup", dc)
+		}
+		b, err := src.NewBackup(path)
+		if err != nil {
+			return err
+		}
+		// Copying every page in one step holds the read lock for the whole
+		// copy, which is what makes the snapshot consistent.
+		if _, err := b.Step(-1); err != nil {
+			b.Finish()
+			return err
+		}
+		return b.Finish()
+	})
+}
+
+// An encrypted backup starts with magic and a random salt, followed by the
+// snapshot sealed with AES-256-GCM in chunks of chunkSize bytes. The key is
+// derived from the passphrase with PBKDF2-SHA256. Each chunk's nonce is its
+// sequence number with the last byte marking the final chunk, so chunks can
+// be neither reordered nor dropped from the end.
+const (
+	magic      = "CCBACKUP1\n"
+	saltSize   = 16
+	iterations = 600000
+	chunkSize  = 64 << 10
+)
+
+// ErrDecrypt is returned when an encrypted backup is damaged or the
+// passphrase is wrong.
+var ErrDecrypt = errors.New("backup: wrong passphrase or corrupted data")
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(size int, seq uint64, last bool) []byte {
+	n := make([]byte, size)
+	binary.BigEndian.PutUint64(n[size-9:], seq)
+	if last {
+		n[size-1] = 1
+	}
+	return n
+}
+
+// Encrypt writes src to dst encrypted with passphrase.
+func Encrypt(dst io.Writer, src io.Reader, passphrase string) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(dst, magic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return err
+	}
+	// Reading one byte ahead tells whether a chunk is the last one.
+	buf := make([]byte, chunkSize+1)
+	n, err := io.ReadFull(src, buf)
+	for seq := uint64(0); ; seq++ {
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		chunk := buf[:min(n, chunkSize)]
+		if _, err := dst.Write(aead.Seal(nil, nonce(aead.NonceSize(), seq, last), chunk, nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf[0] = buf[chunkSize]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
+
+// Decrypt writes the backup encrypted by Encrypt in src to dst.
+func Decrypt(dst io.Writer, src io.Reader, passphrase string) error {
+	header := make([]byte, len(magic)+saltSize)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(magic)]) != magic {
+		return errors.New("backup: not an encrypted backup")
+	}
+	aead, err := newAEAD(passphrase, header[len(magic):])
+	if err != nil {
+		return err
+	}
+	sealed := chunkSize + aead.Overhead()
+	buf := make([]byte, sealed+1)
+	n, err := io.ReadFull(src, buf)
+	for seq := uint64(0); ; seq++ {
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		plain, oerr := aead.Open(nil, nonce(aead.NonceSize(), seq, last), buf[:min(n, sealed)], nil)
+		if oerr != nil {
+			return ErrDecrypt
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		buf[0] = buf[sealed]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
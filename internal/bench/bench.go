@@ -0,0 +1,298 @@
+// Package bench measures the proxy under synthetic load. Run fires
+// Responses API requests at a running companion, normally one started with
+// CODEX_COMPANION_MOCK_UPSTREAM so Mock answers instead of a real upstream,
+// and reports throughput, latency percentiles and the cost of writing the
+// request logs as seen in the instance's metrics.
+package bench
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures a run.
+type Options struct {
+	// URL is the base URL of the companion proxy, e.g. http://127.0.0.1:8080.
+	URL string
+	// MetricsURL is scraped before and after the run; empty skips the
+	// database write figures.
+	MetricsURL  string
+	Concurrency int
+	Duration    time.Duration
+	// Stream requests event streams instead of JSON responses.
+	Stream bool
+	Model  string
+	// Key is sent as the bearer token, for instances requiring client keys.
+	Key    string
+	Client *http.Client
+}
+
+// Latency summarizes request durations.
+type Latency struct {
+	Mean, P50, P90, P99, Max time.Duration
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Requests int
+	Errors   int
+	// Statuses counts responses by status code, 0 for transport errors.
+	Statuses map[int]int
+	Elapsed  time.Duration
+	// Total is the time until the whole response was read, FirstByte until
+	// the response headers arrived.
+	Total     Latency
+	FirstByte Latency
+	// DB is nil when no metrics URL was given.
+	DB *DBStats
+}
+
+// Throughput returns the completed requests per second.
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// DBStats is the database work of a run, from the difference between the
+// metrics scraped before and after it.
+type DBStats struct {
+	// LogInserts and LogInsertTime are the request logs written and the
+	// time spent writing them.
+	LogInserts    int
+	LogInsertTime time.Duration
+	WriteErrors   int
+}
+
+// MeanInsert returns the average time of one log insert.
+func (s *DBStats) MeanInsert() time.Duration {
+	if s.LogInserts == 0 {
+		return 0
+	}
+	return s.LogInsertTime / time.Duration(s.LogInserts)
+}
+
+type sample struct {
+	status       int
+	total, first time.Duration
+}
+
+// Run sends requests from opts.Concurrency workers until opts.Duration has
+// passed or ctx is done.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Concurrency <= 0 {
+		return nil, fmt.Errorf("concurrency must be positive")
+	}
+	if opts.Duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: opts.Concurrency}}
+	}
+	var before map[string]float64
+	if opts.MetricsURL != "" {
+		var err error
+		if before, err = scrape(ctx, client, opts.MetricsURL); err != nil {
+			return nil, fmt.Errorf("scrape metrics: %w", err)
+		}
+	}
+	body := fmt.Sprintf(`{"model":%q,"input":"Say hello.","stream":%t}`, opts.Model, opts.Stream)
+	url := strings.TrimSuffix(opts.URL, "/") + "/v1/responses"
+
+	runCtx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	var mu sync.Mutex
+	var samples []sample
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for runCtx.Err() == nil {
+				s := send(runCtx, client, url, body, opts.Key)
+				if runCtx.Err() != nil && s.status == 0 {
+					// Cut off by the end of the run, not a failure.
+					return
+				}
+				mu.Lock()
+				samples = append(samples, s)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res := summarize(samples, time.Since(start))
+	if before != nil {
+		// The last log inserts may still be in flight.
+		time.Sleep(100 * time.Millisecond)
+		after, err := scrape(ctx, client, opts.MetricsURL)
+		if err != nil {
+			return nil, fmt.Errorf("scrape metrics: %w", err)
+		}
+		res.DB = dbStats(before, after)
+	}
+	return res, nil
+}
+
+func send(ctx context.Context, client *http.Client, url, body, key string) sample {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return sample{}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return sample{total: time.Since(start)}
+	}
+	first := time.Since(start)
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	s := sample{status: resp.StatusCode, total: time.Since(start), first: first}
+	if err != nil {
+		s.status = 0
+	}
+	return s
+}
+
+func summarize(samples []sample, elapsed time.Duration) *Result {
+	res := &Result{Requests: len(samples), Statuses: make(map[int]int), Elapsed: elapsed}
+	var total, first []time.Duration
+	for _, s := range samples {
+		res.Statuses[s.status]++
+		if s.status == 0 || s.status >= 400 {
+			res.Errors++
+			continue
+		}
+		total = append(total, s.total)
+		first = append(first, s.first)
+	}
+	res.Total, res.FirstByte = latency(total), latency(first)
+	return res
+}
+
+// latency returns the mean and the nearest-rank percentiles of d.
+func latency(d []time.Duration) Latency {
+	if len(d) == 0 {
+		return Latency{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(p float64) time.Duration {
+		i := int(p*float64(len(d))+0.5) - 1
+		return d[min(max(i, 0), len(d)-1)]
+	}
+	var sum time.Duration
+	for _, v := range d {
+		sum += v
+	}
+	return Latency{Mean: sum / time.Duration(len(d)), P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: d[len(d)-1]}
+}
+
+// scrape returns the metrics in the Prometheus text format at url, each
+// family summed over its labels.
+func scrape(ctx context.Context, client *http.Client, url string) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return parseMetrics(resp.Body)
+}
+
+func parseMetrics(r io.Reader) (map[string]float64, error) {
+	res := make(map[string]float64)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		name := line[:i]
+		if j := strings.IndexByte(name, '{'); j >= 0 {
+			name = name[:j]
+		}
+		res[name] += v
+	}
+	return res, sc.Err()
+}
+
+func dbStats(before, after map[string]float64) *DBStats {
+	diff := func(name string) float64 { return after[name] - before[name] }
+	return &DBStats{
+		LogInserts:    int(diff("companion_log_insert_duration_seconds_count")),
+		LogInsertTime: time.Duration(diff("companion_log_insert_duration_seconds_sum") * float64(time.Second)),
+		WriteErrors:   int(diff("companion_db_write_errors_total")),
+	}
+}
+
+// Report writes a human-readable summary of res.
+func (r *Result) Report(w io.Writer) {
+	fmt.Fprintf(w, "requests:    %d in %s (%.1f req/s)\n", r.Requests, r.Elapsed.Round(time.Millisecond), r.Throughput())
+	codes := make([]int, 0, len(r.Statuses))
+	for c := range r.Statuses {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	parts := make([]string, 0, len(codes))
+	for _, c := range codes {
+		name := strconv.Itoa(c)
+		if c == 0 {
+			name = "transport"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", name, r.Statuses[c]))
+	}
+	fmt.Fprintf(w, "errors:      %d (%s)\n", r.Errors, strings.Join(parts, ", "))
+	lat := func(l Latency) string {
+		return fmt.Sprintf("mean %s  p50 %s  p90 %s  p99 %s  max %s", ms(l.Mean), ms(l.P50), ms(l.P90), ms(l.P99), ms(l.Max))
+	}
+	fmt.Fprintf(w, "latency:     %s\n", lat(r.Total))
+	fmt.Fprintf(w, "first byte:  %s\n", lat(r.FirstByte))
+	if r.DB == nil {
+		fmt.Fprintln(w, "db writes:   not measured (no metrics URL)")
+		return
+	}
+	fmt.Fprintf(w, "db writes:   %d log inserts, mean %s (%.1f%% of mean latency), %d errors\n",
+		r.DB.LogInserts, ms(r.DB.MeanInsert()), r.insertShare(), r.DB.WriteErrors)
+}
+
+// insertShare returns the mean log insert time as a percentage of the mean
+// request latency.
+func (r *Result) insertShare() float64 {
+	if r.DB == nil || r.Total.Mean <= 0 {
+		return 0
+	}
+	return r.DB.MeanInsert().Seconds() / r.Total.Mean.Seconds() * 100
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64) + "ms"
+}
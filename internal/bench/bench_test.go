@@ -0,0 +1,152 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMock(t *testing.T) {
+	m := &Mock{Chunks: 3}
+	for _, stream := range []bool{true, false} {
+		body := fmt.Sprintf(`{"model":"gpt-5","stream":%t}`, stream)
+		req := httptest.NewRequest(http.MethodPost, "https://upstream/v1/responses", strings.NewReader(body))
+		resp, err := m.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		ct := resp.Header.Get("Content-Type")
+		if stream && (ct != "text/event-stream" || strings.Count(string(b), "response.output_text.delta\ndata") != 3) {
+			t.Fatalf("unexpected stream %s:\n%s", ct, b)
+		}
+		if !stream && (ct != "application/json" || resp.ContentLength != int64(len(b))) {
+			t.Fatalf("unexpected JSON reply %s %d:\n%s", ct, resp.ContentLength, b)
+		}
+		if !bytes.Contains(b, []byte(`"output_tokens":40`)) || !bytes.Contains(b, []byte(`"model":"gpt-5"`)) {
+			t.Fatalf("reply lacks model or usage:\n%s", b)
+		}
+	}
+}
+
+func TestMockChatCompletions(t *testing.T) {
+	m := &Mock{Chunks: 3}
+	for _, stream := range []bool{true, false} {
+		body := fmt.Sprintf(`{"model":"gpt-5","stream":%t}`, stream)
+		req := httptest.NewRequest(http.MethodPost, "https://upstream/v1/chat/completions", strings.NewReader(body))
+		resp, err := m.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if stream && (strings.Count(string(b), `"delta":{"content"`) != 3 || !strings.HasSuffix(string(b), "data: [DONE]\n\n")) {
+			t.Fatalf("unexpected stream:\n%s", b)
+		}
+		if !stream && !bytes.Contains(b, []byte(`"object":"chat.completion"`)) {
+			t.Fatalf("unexpected JSON reply:\n%s", b)
+		}
+		if !bytes.Contains(b, []byte(`"completion_tokens":40`)) {
+			t.Fatalf("reply lacks usage:\n%s", b)
+		}
+	}
+}
+
+func TestMockQuota(t *testing.T) {
+	resp, err := (&Mock{}).RoundTrip(httptest.NewRequest(http.MethodGet, "https://chatgpt.com/backend-api/wham/usage", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usage struct {
+		PlanType  string `json:"plan_type"`
+		RateLimit struct {
+			PrimaryWindow struct {
+				LimitWindowSeconds int64 `json:"limit_window_seconds"`
+			} `json:"primary_window"`
+		} `json:"rate_limit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil || usage.PlanType != "mock" || usage.RateLimit.PrimaryWindow.LimitWindowSeconds != 18000 {
+		t.Fatalf("unexpected usage reply %+v %v", usage, err)
+	}
+}
+
+func TestMockLatencyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "https://upstream/v1/responses", nil).WithContext(ctx)
+	if _, err := (&Mock{Latency: time.Hour}).RoundTrip(req); err == nil {
+		t.Fatal("expected the cancelled request to fail")
+	}
+}
+
+func TestRun(t *testing.T) {
+	mock := &Mock{Chunks: 2}
+	var inserts atomic.Int64
+	var streamed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			n := inserts.Load()
+			fmt.Fprintf(w, "# TYPE companion_log_insert_duration_seconds summary\ncompanion_log_insert_duration_seconds_sum %g\ncompanion_log_insert_duration_seconds_count %d\n", float64(n)*0.002, n)
+			fmt.Fprintf(w, "companion_db_write_errors_total{table=\"logs\"} 1\n")
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer ck" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp, err := mock.RoundTrip(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		streamed.Store(resp.Header.Get("Content-Type") == "text/event-stream")
+		inserts.Add(1)
+		io.Copy(w, resp.Body)
+	}))
+	defer srv.Close()
+
+	res, err := Run(context.Background(), Options{URL: srv.URL, MetricsURL: srv.URL + "/metrics", Concurrency: 4, Duration: 200 * time.Millisecond, Stream: true, Model: "gpt-5", Key: "ck"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Requests == 0 || res.Errors != 0 || res.Statuses[200] != res.Requests || !streamed.Load() {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res.Total.P50 <= 0 || res.Total.P50 > res.Total.P99 || res.Total.P99 > res.Total.Max {
+		t.Fatalf("unexpected latency %+v", res.Total)
+	}
+	if res.DB == nil || res.DB.LogInserts < res.Requests || (res.DB.MeanInsert()-2*time.Millisecond).Abs() > time.Microsecond || res.DB.WriteErrors != 0 {
+		t.Fatalf("unexpected db stats %+v for %d requests", res.DB, res.Requests)
+	}
+	var out bytes.Buffer
+	res.Report(&out)
+	if !strings.Contains(out.String(), "req/s") || !strings.Contains(out.String(), "log inserts") {
+		t.Fatalf("unexpected report:\n%s", out.String())
+	}
+
+	res, err = Run(context.Background(), Options{URL: srv.URL, Concurrency: 1, Duration: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Errors != res.Requests || res.Statuses[http.StatusUnauthorized] == 0 || res.DB != nil {
+		t.Fatalf("expected unauthorized errors without db stats: %+v", res)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	var d []time.Duration
+	for i := 100; i >= 1; i-- {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	l := latency(d)
+	if l.P50 != 50*time.Millisecond || l.P90 != 90*time.Millisecond || l.P99 != 99*time.Millisecond || l.Max != 100*time.Millisecond || l.Mean != 50500*time.Microsecond {
+		t.Fatalf("unexpected latency %+v", l)
+	}
+}
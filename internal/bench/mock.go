@@ -0,0 +1,106 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Mock is an http.RoundTripper answering every upstream request locally
+// with a canned Responses API reply, or a Chat Completions one for
+// requests to /chat/completions, so the proxy and its log path can be
+// measured, and its configuration tried, without network or upstream
+// costs. Streamed requests ("stream": true) get an event stream of Chunks
+// deltas, others a JSON body; both report token usage. Quota polls of the
+// ChatGPT usage endpoint (/wham/usage) get unused windows.
+type Mock struct {
+	// Latency delays the response headers, like the upstream's time to
+	// first byte.
+	Latency time.Duration
+	// Chunks is the number of output deltas of a streamed reply.
+	Chunks int
+}
+
+// mockUsage is the usage every reply reports, and mockChatUsage the same
+// in the Chat Completions form. mockQuota is the usage endpoint's reply.
+const (
+	mockQuota     = `{"plan_type":"mock","rate_limit":{"limit_reached":false,"primary_window":{"used_percent":0,"limit_window_seconds":18000,"reset_after_seconds":18000},"secondary_window":{"used_percent":0,"limit_window_seconds":604800,"reset_after_seconds":604800}}}`
+	mockUsage     = `{"input_tokens":120,"input_tokens_details":{"cached_tokens":20},"output_tokens":40}`
+	mockChatUsage = `{"prompt_tokens":120,"prompt_tokens_details":{"cached_tokens":20},"completion_tokens":40,"total_tokens":160}`
+)
+
+// Local marks Mock as answering in process, so accounts' outbound
+// settings do not apply to it.
+func (m *Mock) Local() {}
+
+// RoundTrip implements http.RoundTripper.
+func (m *Mock) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(b, &body)
+	}
+	if m.Latency > 0 {
+		t := time.NewTimer(m.Latency)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	resp.Header.Set("X-Request-Id", fmt.Sprintf("mock-%d", time.Now().UnixNano()))
+	var out bytes.Buffer
+	chat := strings.HasSuffix(req.URL.Path, "/chat/completions")
+	text := strings.Repeat("token ", max(m.Chunks, 1))
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/wham/usage"):
+		resp.Header.Set("Content-Type", "application/json")
+		out.WriteString(mockQuota)
+		resp.ContentLength = int64(out.Len())
+	case chat && body.Stream:
+		resp.Header.Set("Content-Type", "text/event-stream")
+		for i := 0; i < max(m.Chunks, 1); i++ {
+			fmt.Fprintf(&out, "data: {\"object\":\"chat.completion.chunk\",\"model\":%q,\"choices\":[{\"index\":0,\"delta\":{\"content\":\"token %d \"}}]}\n\n", body.Model, i)
+		}
+		fmt.Fprintf(&out, "data: {\"object\":\"chat.completion.chunk\",\"model\":%q,\"choices\":[],\"usage\":%s}\n\ndata: [DONE]\n\n", body.Model, mockChatUsage)
+		resp.ContentLength = -1
+	case chat:
+		resp.Header.Set("Content-Type", "application/json")
+		fmt.Fprintf(&out, `{"object":"chat.completion","model":%q,"choices":[{"index":0,"message":{"role":"assistant","content":%q},"finish_reason":"stop"}],"usage":%s}`, body.Model, text, mockChatUsage)
+		resp.ContentLength = int64(out.Len())
+	case body.Stream:
+		resp.Header.Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(&out, "event: response.created\ndata: {\"type\":\"response.created\",\"response\":{\"model\":%q}}\n\n", body.Model)
+		for i := 0; i < max(m.Chunks, 1); i++ {
+			fmt.Fprintf(&out, "event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"token %d \"}\n\n", i)
+		}
+		fmt.Fprintf(&out, "event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"model\":%q,\"usage\":%s}}\n\n", body.Model, mockUsage)
+		resp.ContentLength = -1
+	default:
+		resp.Header.Set("Content-Type", "application/json")
+		fmt.Fprintf(&out, `{"object":"response","status":"completed","model":%q,"output":[{"type":"message","content":[{"type":"output_text","text":%q}]}],"usage":%s}`, body.Model, text, mockUsage)
+		resp.ContentLength = int64(out.Len())
+	}
+	resp.Body = io.NopCloser(&out)
+	return resp, nil
+}
@@ -0,0 +1,314 @@
+// Package codexconfig reads the model providers and profiles of a Codex CLI
+// config.toml so API-key providers can be imported as accounts. It parses
+// the subset of TOML that config files use: tables, dotted keys, strings,
+// and scalars. Arrays and inline tables are kept as their source text.
+package codexconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Provider is a [model_providers.<id>] entry.
+type Provider struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	BaseURL string `json:"base_url"`
+	// EnvKey names the environment variable holding the API key.
+	EnvKey  string `json:"env_key"`
+	WireAPI string `json:"wire_api,omitempty"`
+}
+
+// Profile is a [profiles.<name>] entry.
+type Profile struct {
+	Name     string `json:"name"`
+	Model    string `json:"model,omitempty"`
+	Provider string `json:"model_provider,omitempty"`
+}
+
+// Config holds the providers and profiles of a config.toml, sorted by ID
+// and name.
+type Config struct {
+	Providers []Provider
+	Profiles  []Profile
+}
+
+// Path returns the location of config.toml: $CODEX_HOME/config.toml, or
+// ~/.codex/config.toml when CODEX_HOME is unset.
+func Path() (string, error) {
+	home := os.Getenv("CODEX_HOME")
+	if home == "" {
+		usr, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		home = filepath.Join(usr, ".codex")
+	}
+	return filepath.Join(home, "config.toml"), nil
+}
+
+// Parse reads the providers and profiles of a config.toml document.
+func Parse(data []byte) (*Config, error) {
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	providers, _ := doc["model_providers"].(map[string]any)
+	for id, v := range providers {
+		t, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		p := Provider{ID: id, Name: str(t, "name"), BaseURL: str(t, "base_url"), EnvKey: str(t, "env_key"), WireAPI: str(t, "wire_api")}
+		if p.Name == "" {
+			p.Name = id
+		}
+		cfg.Providers = append(cfg.Providers, p)
+	}
+	sort.Slice(cfg.Providers, func(i, j int) bool { return cfg.Providers[i].ID < cfg.Providers[j].ID })
+	profiles, _ := doc["profiles"].(map[string]any)
+	for name, v := range profiles {
+		t, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		cfg.Profiles = append(cfg.Profiles, Profile{Name: name, Model: str(t, "model"), Provider: str(t, "model_provider")})
+	}
+	sort.Slice(cfg.Profiles, func(i, j int) bool { return cfg.Profiles[i].Name < cfg.Profiles[j].Name })
+	return cfg, nil
+}
+
+func str(t map[string]any, key string) string {
+	s, _ := t[key].(string)
+	return s
+}
+
+// parseTOML returns the document as nested maps with string values. Values
+// other than strings are kept as their source text.
+func parseTOML(src string) (map[string]any, error) {
+	root := map[string]any{}
+	current := root
+	lines := strings.Split(src, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		lineNo := i + 1
+		if strings.HasPrefix(line, "[[") {
+			// Arrays of tables are not needed; their keys go nowhere.
+			current = map[string]any{}
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineNo)
+			}
+			path, err := splitKey(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if current, err = table(root, path); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			continue
+		}
+		k, v, ok := cutUnquoted(strings.TrimSpace(lines[i]), '=')
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		path, err := splitKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		// Arrays, inline tables and multi-line strings may continue on the
+		// following lines; the latter verbatim, as they may contain #.
+		v = strings.TrimSpace(v)
+		verbatim := strings.HasPrefix(v, `"""`) || strings.HasPrefix(v, "'''")
+		if !verbatim {
+			v = strings.TrimSpace(stripComment(v))
+		}
+		for !complete(v) && i+1 < len(lines) {
+			i++
+			if verbatim {
+				v += "\n" + lines[i]
+			} else {
+				v += "\n" + stripComment(lines[i])
+			}
+		}
+		t, err := table(current, path[:len(path)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		value, err := parseValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		t[path[len(path)-1]] = value
+	}
+	return root, nil
+}
+
+// table returns the table at path below t, creating missing tables.
+func table(t map[string]any, path []string) (map[string]any, error) {
+	for _, k := range path {
+		switch next := t[k].(type) {
+		case nil:
+			m := map[string]any{}
+			t[k] = m
+			t = m
+		case map[string]any:
+			t = next
+		default:
+			return nil, fmt.Errorf("key %q is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+// splitKey splits a dotted key whose parts may be quoted.
+func splitKey(s string) ([]string, error) {
+	var parts []string
+	for {
+		s = strings.TrimSpace(s)
+		var part string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			end := closingQuote(s)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated key %s", s)
+			}
+			v, err := parseValue(s[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			part, s = v.(string), strings.TrimSpace(s[end+1:])
+		} else {
+			i := strings.IndexByte(s, '.')
+			if i < 0 {
+				i = len(s)
+			}
+			part, s = strings.TrimSpace(s[:i]), s[i:]
+			if part == "" {
+				return nil, fmt.Errorf("empty key")
+			}
+		}
+		parts = append(parts, part)
+		if s == "" {
+			return parts, nil
+		}
+		if s[0] != '.' {
+			return nil, fmt.Errorf("unexpected %q in key", s)
+		}
+		s = s[1:]
+	}
+}
+
+func parseValue(v string) (any, error) {
+	switch {
+	case strings.HasPrefix(v, `"""`) || strings.HasPrefix(v, "'''"):
+		q := v[:3]
+		end := strings.Index(v[3:], q)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		s := strings.TrimPrefix(v[3:3+end], "\n")
+		if q == "'''" {
+			return s, nil
+		}
+		return unescape(s)
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || closingQuote(v) != len(v)-1 {
+			return nil, fmt.Errorf("invalid string %s", v)
+		}
+		return unescape(v[1 : len(v)-1])
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || closingQuote(v) != len(v)-1 {
+			return nil, fmt.Errorf("invalid string %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	case v == "":
+		return nil, fmt.Errorf("missing value")
+	}
+	return v, nil
+}
+
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	// The escapes of TOML basic strings are a subset of Go's.
+	u, err := strconv.Unquote(`"` + strings.ReplaceAll(s, "\n", `\n`) + `"`)
+	if err != nil {
+		return "", fmt.Errorf("invalid escape in %q", s)
+	}
+	return u, nil
+}
+
+// closingQuote returns the index of the quote closing the string s starts
+// with, or -1.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && q == '"':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// cutUnquoted splits s around the first sep outside a string.
+func cutUnquoted(s string, sep byte) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			end := closingQuote(s[i:])
+			if end < 0 {
+				return s, "", false
+			}
+			i += end
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// stripComment removes a # comment outside strings.
+func stripComment(line string) string {
+	before, _, _ := cutUnquoted(line, '#')
+	return before
+}
+
+// complete reports whether a value has no unclosed brackets or multi-line
+// string.
+func complete(v string) bool {
+	for _, q := range []string{`"""`, "'''"} {
+		if strings.HasPrefix(v, q) {
+			return strings.Contains(v[3:], q)
+		}
+	}
+	depth := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"', '\'':
+			end := closingQuote(v[i:])
+			if end < 0 {
+				return true
+			}
+			i += end
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
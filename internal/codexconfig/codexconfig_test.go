@@ -0,0 +1,81 @@
+package codexconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+const sample = `# Codex CLI settings
+model = "gpt-5-codex"
+model_provider = "azure"
+notify = [
+  "notify-send",   # a comment ]
+  "Codex",
+]
+instructions = """
+Answer briefly. # not a comment
+"""
+
+[model_providers.azure]
+name = "Azure OpenAI"   # display name
+base_url = "https://example.openai.azure.com/openai"
+env_key = "AZURE_OPENAI_API_KEY"
+query_params = { api-version = "2025-04-01-preview" }
+wire_api = "responses"
+
+[model_providers."local.llm"]
+base_url = 'http://localhost:11434/v1'
+
+[model_providers]
+openrouter.base_url = "https://openrouter.ai/api/v1"
+openrouter.env_key = "OPENROUTER_API_KEY"
+
+[profiles.fast]
+model = "gpt-5-mini"
+model_provider = "openrouter"
+
+[[mcp_servers.tools]]
+command = "npx"
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Provider{
+		{ID: "azure", Name: "Azure OpenAI", BaseURL: "https://example.openai.azure.com/openai", EnvKey: "AZURE_OPENAI_API_KEY", WireAPI: "responses"},
+		{ID: "local.llm", Name: "local.llm", BaseURL: "http://localhost:11434/v1"},
+		{ID: "openrouter", Name: "openrouter", BaseURL: "https://openrouter.ai/api/v1", EnvKey: "OPENROUTER_API_KEY"},
+	}
+	if !reflect.DeepEqual(cfg.Providers, want) {
+		t.Fatalf("providers %+v", cfg.Providers)
+	}
+	if len(cfg.Profiles) != 1 || cfg.Profiles[0] != (Profile{Name: "fast", Model: "gpt-5-mini", Provider: "openrouter"}) {
+		t.Fatalf("profiles %+v", cfg.Profiles)
+	}
+}
+
+func TestParseTOMLValues(t *testing.T) {
+	doc, err := parseTOML("a = \"tab\\there\"\nb = '''\nraw \\n # kept\n'''\n\"c.d\" = 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["a"] != "tab\there" || doc["b"] != "raw \\n # kept\n" || doc["c.d"] != "1" {
+		t.Fatalf("unexpected values %q", doc)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"[model_providers.azure",
+		"just a line",
+		"a = \"unterminated",
+		"a = 1\na.b = 2",
+		"a = \"\\q\"",
+	} {
+		if _, err := Parse([]byte(src)); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Package config loads companion settings from environment variables.
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Config holds settings read once at startup.
+type Config struct {
+	// Addr is the listen address of the HTTP server.
+	Addr string
+	// AdminAddr, when set, serves /admin and /metrics on a separate listener
+	// instead of Addr. Either address may be "unix:/path/to/socket".
+	AdminAddr string
+	// DBPath is the SQLite database file.
+	DBPath string
+	// Storage is "sqlite" (default) or "memory", which keeps accounts, logs
+	// and every other table in memory and never touches DBPath.
+	Storage string
+	// MemoryLogs is how many request logs memory storage keeps.
+	MemoryLogs int
+	// AccountsFile declares static accounts, see account.LoadStatic, which
+	// are synced into the account table at startup and read-only in the
+	// admin API. Empty declares none.
+	AccountsFile string
+	// MaintenanceInterval is the minimum time between database maintenance
+	// runs. Zero disables scheduled maintenance.
+	MaintenanceInterval time.Duration
+	// MaintenanceWindow restricts scheduled maintenance to a daily local time
+	// range such as "02:00-05:00". Empty means any time.
+	MaintenanceWindow string
+	// DBSizeWarnBytes logs a warning when the database file plus WAL grows
+	// beyond it. Zero disables the warning.
+	DBSizeWarnBytes int64
+	// DBRepair repairs what the startup integrity check finds: it rebuilds
+	// the indexes of a database failing PRAGMA integrity_check and deletes
+	// rows kept for deleted accounts.
+	DBRepair bool
+	// DeletedLogs is the policy for the request logs of deleted accounts:
+	// "keep" (default), "immediate" or "delayed", which deletes them
+	// DeletedLogsDelay after the account.
+	DeletedLogs      string
+	DeletedLogsDelay time.Duration
+	// ScriptDir holds Lua hook scripts (*.lua). Empty disables scripting.
+	ScriptDir string
+	// ScriptTimeout bounds each script hook call.
+	ScriptTimeout time.Duration
+	// WebhookURLs receive every system event as a JSON POST.
+	WebhookURLs []string
+	// WebhookSecret signs webhook payloads. Empty disables signing.
+	WebhookSecret string
+	// WebhookMaxAttempts is the number of failed attempts after which a
+	// delivery is moved to the dead-letter state.
+	WebhookMaxAttempts int
+	// RecordDir enables recording of sanitized upstream interactions into
+	// replay fixtures in this directory. Empty disables recording.
+	RecordDir string
+	// WarmupProbe makes the reactivator send a tiny request with an
+	// exhausted account, using WarmupModel, before returning it to rotation.
+	WarmupProbe bool
+	WarmupModel string
+	// ValidateConcurrency is the number of accounts whose credentials are
+	// probed at once at startup and every ValidateInterval, each probe
+	// bounded by ValidateTimeout. Zero disables validation, a zero interval
+	// validates at startup only.
+	ValidateConcurrency int
+	ValidateInterval    time.Duration
+	ValidateTimeout     time.Duration
+	// OutboundProxy is the HTTP or SOCKS5 proxy URL the upstreams are
+	// reached through, see outbound.Transport. Empty uses HTTP_PROXY and
+	// HTTPS_PROXY.
+	OutboundProxy string
+	// MockUpstream answers every upstream request locally with a canned
+	// reply after MockLatency, for benchmarking the proxy itself.
+	MockUpstream bool
+	MockLatency  time.Duration
+	// AdaptivePriority lets the scheduler adjust account priorities from
+	// observed error rates and latency.
+	AdaptivePriority bool
+	// RampUp is the number of consecutive successful requests a new
+	// account needs before it joins full rotation; until then it only
+	// receives a growing share of its traffic. Zero disables ramp-up.
+	RampUp int
+	// SchedulerMode is "priority" (strict failover), "weighted" or "cost"
+	// (least-cost routing).
+	SchedulerMode string
+	// BillingCooldown keeps an API key account that returned a quota or
+	// billing error out of rotation for this long.
+	BillingCooldown time.Duration
+	// ErrorRules overrides the classification of upstream error responses,
+	// e.g. "403=account/30m,500:server_error=rotate".
+	ErrorRules string
+	// FailoverStatuses are the upstream 5xx statuses retried on the next
+	// account, by default 500, 502, 503 and 504, see
+	// proxy.ParseFailoverStatuses; "none" returns them all to the client
+	// at once.
+	FailoverStatuses string
+	// FieldPolicies adjusts Responses API body fields per account type, e.g.
+	// `apikey:instructions=strip;chatgpt:reasoning.summary=set:"auto"`.
+	FieldPolicies string
+	// Annotations set fields identifying the deployment or client in the
+	// bodies sent upstream, e.g. `apikey:safety_identifier=team-a/{client}`.
+	Annotations string
+	// QuotaPollInterval is how often ChatGPT account rate-limit snapshots
+	// are taken; 0 disables polling.
+	QuotaPollInterval time.Duration
+	// ModelPrices adds or overrides per-model prices used for cost
+	// estimates, e.g. "gpt-5=1.25/10" (USD per million input/output tokens).
+	ModelPrices string
+	// SlowRequest is the duration from which upstream attempts are logged
+	// as slow; 0 disables slow request logging.
+	SlowRequest time.Duration
+	// RetryBackoff is the base delay, doubled per attempt and jittered,
+	// before retrying a request after a transport error.
+	RetryBackoff time.Duration
+	// Pass429 forwards the last upstream 429 to clients instead of a 503
+	// once every account is exhausted; Pass429Keys limits this to the
+	// listed client key IDs.
+	Pass429     bool
+	Pass429Keys []string
+	// ClientPins pins client key IDs to accounts, see
+	// proxy.ParseClientPins.
+	ClientPins string
+	// ForceAccountKeys lists the client key IDs that may force requests
+	// onto an account with proxy.ForceAccountHeader.
+	ForceAccountKeys []string
+	// PathRules allows or denies client requests by method and path, see
+	// proxy.ParsePathRules.
+	PathRules string
+	// ShadowPercent of the requests are mirrored to ShadowTarget, an
+	// account ID or an upstream URL used with ShadowAPIKey, see
+	// proxy.ParseShadow; zero disables shadowing.
+	ShadowPercent int
+	ShadowTarget  string
+	ShadowAPIKey  string
+	// MaxInflight caps the client requests the proxy handles at once; up
+	// to InflightQueue more wait for InflightWait before being rejected
+	// with 429. Zero disables the cap, see proxy.Admission.
+	MaxInflight   int
+	InflightQueue int
+	InflightWait  time.Duration
+	// ClientModels limits client key IDs to models, see
+	// proxy.ParseClientModels.
+	ClientModels string
+	// BandwidthCaps limits the monthly traffic in total and of client key
+	// IDs, see proxy.ParseBandwidthCaps.
+	BandwidthCaps string
+	// ResponseHeaders enables informational client response headers, see
+	// proxy.ParseResponseHeaders.
+	ResponseHeaders string
+	// QuarantineThreshold consecutive 403 responses quarantine a ChatGPT
+	// account for QuarantineCooldown; zero disables quarantining.
+	QuarantineThreshold int
+	QuarantineCooldown  time.Duration
+	// InvalidTokenThreshold consecutive 401 responses mark an account's
+	// credentials invalid; zero disables it.
+	InvalidTokenThreshold int
+	// AccountSummary adds counts of exhausted and blocked accounts and
+	// their reset times to the error returned when no account is available.
+	AccountSummary bool
+	// LogBodyLimit is how many bytes of each response body are stored in
+	// request logs; zero stores them all.
+	LogBodyLimit int
+	// LogEnrichWorkers derive the body fields of request logs in the
+	// background, after the insert, see proxy.Enricher; zero derives them
+	// in the request path. LogEnrichQueue bounds the logs waiting for them.
+	LogEnrichWorkers int
+	LogEnrichQueue   int
+	// ThrottlePercent slows or pauses accounts with less than this
+	// percentage of an upstream rate limit left; 0 disables it.
+	ThrottlePercent int
+	// DecisionTrace records the scheduler's decisions with every request
+	// log; without it only requests sending X-Companion-Trace are traced.
+	DecisionTrace bool
+	// CacheAffinity pins requests sharing a prompt cache key to the account
+	// that last served one for this long; 0 disables pinning.
+	CacheAffinity time.Duration
+	// ResponseCacheTTL keeps the responses of deterministic requests this
+	// long to answer repeats locally; 0 disables the cache.
+	// ResponseCacheSize bounds the cached responses in bytes.
+	ResponseCacheTTL  time.Duration
+	ResponseCacheSize int
+	// StatsDAddr is the host:port metrics are pushed to over UDP; empty
+	// disables StatsD. StatsDPrefix is prepended to every metric name and
+	// StatsDTags sends labels as DogStatsD tags instead of name segments.
+	StatsDAddr     string
+	StatsDPrefix   string
+	StatsDTags     bool
+	StatsDInterval time.Duration
+	// SentryDSN enables reporting panics, refresh failures and repeated
+	// request failures to a Sentry-compatible server; SentryEnvironment
+	// is attached to the reports.
+	SentryDSN         string
+	SentryEnvironment string
+	// HeartbeatURL is pinged every HeartbeatInterval while the companion is
+	// healthy; HeartbeatFailURL (default HeartbeatURL + "/fail") is pinged
+	// instead when the database is unwritable or no account is available.
+	// Empty disables heartbeats.
+	HeartbeatURL      string
+	HeartbeatFailURL  string
+	HeartbeatInterval time.Duration
+	// AnomalyWindow is the length of the traffic windows compared by the
+	// anomaly detector; zero disables it. A client key's requests must
+	// reach AnomalyMinRequests and AnomalySpikeFactor times its average to
+	// be reported, an account's 401 responses AnomalyAuthFailures.
+	AnomalyWindow       time.Duration
+	AnomalySpikeFactor  int64
+	AnomalyMinRequests  int64
+	AnomalyAuthFailures int64
+	// BackupPassphrase encrypts database backups downloaded from the admin
+	// API without a passphrase of their own.
+	BackupPassphrase string
+	// DBKey, or the contents of DBKeyFile, encrypts account credentials
+	// and logged headers and bodies in the database.
+	DBKey     string
+	DBKeyFile string
+}
+
+// FromEnv builds a Config from CODEX_COMPANION_* environment variables,
+// falling back to defaults for unset or invalid values.
+func FromEnv() *Config {
+	return &Config{
+		Addr:                  str("CODEX_COMPANION_ADDR", "127.0.0.1:8080"),
+		AdminAddr:             str("CODEX_COMPANION_ADMIN_ADDR", ""),
+		DBPath:                str("CODEX_COMPANION_DB", "companion.db"),
+		Storage:               str("CODEX_COMPANION_STORAGE", "sqlite"),
+		MemoryLogs:            int(integer("CODEX_COMPANION_MEMORY_LOGS", 10000)),
+		AccountsFile:          str("CODEX_COMPANION_ACCOUNTS_FILE", ""),
+		MaintenanceInterval:   duration("CODEX_COMPANION_MAINTENANCE_INTERVAL", 24*time.Hour),
+		MaintenanceWindow:     str("CODEX_COMPANION_MAINTENANCE_WINDOW", ""),
+		DBSizeWarnBytes:       integer("CODEX_COMPANION_DB_SIZE_WARN_MB", 0) << 20,
+		DBRepair:              boolean("CODEX_COMPANION_DB_REPAIR", false),
+		DeletedLogs:           str("CODEX_COMPANION_DELETED_ACCOUNT_LOGS", "keep"),
+		DeletedLogsDelay:      duration("CODEX_COMPANION_DELETED_ACCOUNT_LOGS_DELAY", 30*24*time.Hour),
+		ScriptDir:             str("CODEX_COMPANION_SCRIPT_DIR", ""),
+		ScriptTimeout:         duration("CODEX_COMPANION_SCRIPT_TIMEOUT", 100*time.Millisecond),
+		WebhookURLs:           list("CODEX_COMPANION_WEBHOOK_URLS"),
+		WebhookSecret:         str("CODEX_COMPANION_WEBHOOK_SECRET", ""),
+		WebhookMaxAttempts:    int(integer("CODEX_COMPANION_WEBHOOK_MAX_ATTEMPTS", 8)),
+		RecordDir:             str("CODEX_COMPANION_RECORD_DIR", ""),
+		WarmupProbe:           boolean("CODEX_COMPANION_WARMUP_PROBE", false),
+		WarmupModel:           str("CODEX_COMPANION_WARMUP_MODEL", ""),
+		ValidateConcurrency:   int(integer("CODEX_COMPANION_VALIDATE_CONCURRENCY", 8)),
+		ValidateInterval:      duration("CODEX_COMPANION_VALIDATE_INTERVAL", 0),
+		ValidateTimeout:       duration("CODEX_COMPANION_VALIDATE_TIMEOUT", 15*time.Second),
+		OutboundProxy:         str("CODEX_COMPANION_OUTBOUND_PROXY", ""),
+		MockUpstream:          boolean("CODEX_COMPANION_MOCK_UPSTREAM", false),
+		MockLatency:           duration("CODEX_COMPANION_MOCK_LATENCY", 0),
+		AdaptivePriority:      boolean("CODEX_COMPANION_ADAPTIVE_PRIORITY", false),
+		RampUp:                int(integer("CODEX_COMPANION_RAMP_UP", 0)),
+		SchedulerMode:         str("CODEX_COMPANION_SCHEDULER_MODE", "priority"),
+		BillingCooldown:       duration("CODEX_COMPANION_BILLING_COOLDOWN", 24*time.Hour),
+		ErrorRules:            str("CODEX_COMPANION_ERROR_RULES", ""),
+		FailoverStatuses:      str("CODEX_COMPANION_FAILOVER_STATUSES", "500,502,503,504"),
+		FieldPolicies:         str("CODEX_COMPANION_FIELD_POLICIES", ""),
+		Annotations:           str("CODEX_COMPANION_ANNOTATIONS", ""),
+		QuotaPollInterval:     duration("CODEX_COMPANION_QUOTA_POLL_INTERVAL", 15*time.Minute),
+		ModelPrices:           str("CODEX_COMPANION_MODEL_PRICES", ""),
+		SlowRequest:           duration("CODEX_COMPANION_SLOW_REQUEST", 30*time.Second),
+		RetryBackoff:          duration("CODEX_COMPANION_RETRY_BACKOFF", 100*time.Millisecond),
+		Pass429:               boolean("CODEX_COMPANION_PASS_429", false),
+		Pass429Keys:           list("CODEX_COMPANION_PASS_429_KEYS"),
+		ClientPins:            str("CODEX_COMPANION_CLIENT_PINS", ""),
+		ForceAccountKeys:      list("CODEX_COMPANION_FORCE_ACCOUNT_KEYS"),
+		PathRules:             str("CODEX_COMPANION_PATH_RULES", ""),
+		ShadowPercent:         int(integer("CODEX_COMPANION_SHADOW_PERCENT", 0)),
+		ShadowTarget:          str("CODEX_COMPANION_SHADOW_TARGET", ""),
+		ShadowAPIKey:          str("CODEX_COMPANION_SHADOW_API_KEY", ""),
+		MaxInflight:           int(integer("CODEX_COMPANION_MAX_INFLIGHT", 0)),
+		InflightQueue:         int(integer("CODEX_COMPANION_INFLIGHT_QUEUE", 100)),
+		InflightWait:          duration("CODEX_COMPANION_INFLIGHT_WAIT", 10*time.Second),
+		ClientModels:          str("CODEX_COMPANION_CLIENT_MODELS", ""),
+		BandwidthCaps:         str("CODEX_COMPANION_BANDWIDTH_CAPS", ""),
+		ResponseHeaders:       str("CODEX_COMPANION_RESPONSE_HEADERS", ""),
+		QuarantineThreshold:   int(integer("CODEX_COMPANION_QUARANTINE_THRESHOLD", 3)),
+		QuarantineCooldown:    duration("CODEX_COMPANION_QUARANTINE_COOLDOWN", 7*24*time.Hour),
+		InvalidTokenThreshold: int(integer("CODEX_COMPANION_INVALID_TOKEN_THRESHOLD", 2)),
+		AccountSummary:        boolean("CODEX_COMPANION_ACCOUNT_SUMMARY", false),
+		DecisionTrace:         boolean("CODEX_COMPANION_DECISION_TRACE", false),
+		ThrottlePercent:       int(integer("CODEX_COMPANION_THROTTLE_PERCENT", 0)),
+		LogBodyLimit:          int(integer("CODEX_COMPANION_LOG_BODY_LIMIT_KB", 0) << 10),
+		LogEnrichWorkers:      int(integer("CODEX_COMPANION_LOG_ENRICH_WORKERS", 0)),
+		LogEnrichQueue:        int(integer("CODEX_COMPANION_LOG_ENRICH_QUEUE", 1000)),
+		CacheAffinity:         duration("CODEX_COMPANION_CACHE_AFFINITY", 0),
+		ResponseCacheTTL:      duration("CODEX_COMPANION_RESPONSE_CACHE_TTL", 0),
+		ResponseCacheSize:     int(integer("CODEX_COMPANION_RESPONSE_CACHE_MB", 64) << 20),
+		StatsDAddr:            str("CODEX_COMPANION_STATSD_ADDR", ""),
+		StatsDPrefix:          str("CODEX_COMPANION_STATSD_PREFIX", ""),
+		StatsDTags:            boolean("CODEX_COMPANION_STATSD_TAGS", true),
+		StatsDInterval:        duration("CODEX_COMPANION_STATSD_INTERVAL", 10*time.Second),
+		SentryDSN:             str("CODEX_COMPANION_SENTRY_DSN", ""),
+		SentryEnvironment:     str("CODEX_COMPANION_SENTRY_ENVIRONMENT", ""),
+		HeartbeatURL:          str("CODEX_COMPANION_HEARTBEAT_URL", ""),
+		HeartbeatFailURL:      str("CODEX_COMPANION_HEARTBEAT_FAIL_URL", ""),
+		HeartbeatInterval:     duration("CODEX_COMPANION_HEARTBEAT_INTERVAL", time.Minute),
+		AnomalyWindow:         duration("CODEX_COMPANION_ANOMALY_WINDOW", 5*time.Minute),
+		AnomalySpikeFactor:    integer("CODEX_COMPANION_ANOMALY_SPIKE_FACTOR", 5),
+		AnomalyMinRequests:    integer("CODEX_COMPANION_ANOMALY_MIN_REQUESTS", 100),
+		AnomalyAuthFailures:   integer("CODEX_COMPANION_ANOMALY_AUTH_FAILURES", 10),
+		BackupPassphrase:      str("CODEX_COMPANION_BACKUP_PASSPHRASE", ""),
+		DBKey:                 str("CODEX_COMPANION_DB_KEY", ""),
+		DBKeyFile:             str("CODEX_COMPANION_DB_KEY_FILE", ""),
+	}
+}
+
+func str(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// list splits a comma-separated variable, dropping empty entries.
+func list(key string) []string {
+	var res []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func integer(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logger.Warnf("invalid %s %q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+func boolean(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Warnf("invalid %s %q: %v", key, v, err)
+		return def
+	}
+	return b
+}
+
+func duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Warnf("invalid %s %q: %v", key, v, err)
+		return def
+	}
+	return d
+}
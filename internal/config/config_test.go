@@ -0,0 +1,62 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFromEnvDefaults(t *testing.T) {
+	t.Setenv("CODEX_COMPANION_ADDR", "")
+	t.Setenv("CODEX_COMPANION_MAINTENANCE_INTERVAL", "")
+	c := FromEnv()
+	if c.Addr != "127.0.0.1:8080" || c.DBPath != "companion.db" || c.MaintenanceInterval != 24*time.Hour {
+		t.Fatalf("unexpected defaults: %+v", c)
+	}
+}
+
+func TestFromEnvOverrides(t *testing.T) {
+	t.Setenv("CODEX_COMPANION_ADDR", "0.0.0.0:9000")
+	t.Setenv("CODEX_COMPANION_MAINTENANCE_INTERVAL", "6h")
+	t.Setenv("CODEX_COMPANION_MAINTENANCE_WINDOW", "02:00-05:00")
+	c := FromEnv()
+	if c.Addr != "0.0.0.0:9000" || c.MaintenanceInterval != 6*time.Hour || c.MaintenanceWindow != "02:00-05:00" {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+}
+
+func TestFromEnvInvalidDuration(t *testing.T) {
+	t.Setenv("CODEX_COMPANION_MAINTENANCE_INTERVAL", "soon")
+	if c := FromEnv(); c.MaintenanceInterval != 24*time.Hour {
+		t.Fatalf("expected default on invalid value, got %v", c.MaintenanceInterval)
+	}
+}
+
+func TestFromEnvWebhookURLs(t *testing.T) {
+	t.Setenv("CODEX_COMPANION_WEBHOOK_URLS", " https://a.example/hook, ,https://b.example/hook")
+	c := FromEnv()
+	if len(c.WebhookURLs) != 2 || c.WebhookURLs[0] != "https://a.example/hook" || c.WebhookMaxAttempts != 8 {
+		t.Fatalf("unexpected webhook config: %+v", c)
+	}
+}
+
+func TestFromEnvBoolean(t *testing.T) {
+	t.Setenv("CODEX_COMPANION_ADAPTIVE_PRIORITY", "true")
+	if c := FromEnv(); !c.AdaptivePriority {
+		t.Fatalf("expected adaptive priority enabled")
+	}
+	t.Setenv("CODEX_COMPANION_ADAPTIVE_PRIORITY", "maybe")
+	if c := FromEnv(); c.AdaptivePriority {
+		t.Fatalf("expected default on invalid value")
+	}
+}
+
+func TestFromEnvAdminAddr(t *testing.T) {
+	t.Setenv("CODEX_COMPANION_ADMIN_ADDR", "")
+	if c := FromEnv(); c.AdminAddr != "" {
+		t.Fatalf("admin listener should default to the proxy listener, got %q", c.AdminAddr)
+	}
+	t.Setenv("CODEX_COMPANION_ADMIN_ADDR", "unix:/run/companion/admin.sock")
+	if c := FromEnv(); c.AdminAddr != "unix:/run/companion/admin.sock" {
+		t.Fatalf("unexpected admin addr %q", c.AdminAddr)
+	}
+}
@@ -0,0 +1,172 @@
+// Package dbcrypt encrypts the sensitive columns of the companion database,
+// account credentials and logged headers and bodies, with a key taken from
+// the environment or a key file. The rest of the schema stays readable so
+// scheduling, statistics and error triage keep working in SQL.
+package dbcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// prefix marks encrypted values; values without it are plaintext written
+// before the database was encrypted.
+const prefix = "enc:v1:"
+
+// check is encrypted into the database so a wrong key is detected at
+// startup rather than on the first credential read.
+const check = "codex-companion"
+
+// iterations of PBKDF2-SHA256 deriving the column key from the passphrase.
+const iterations = 600000
+
+// ErrWrongKey is returned by Open when the key does not match the one the
+// database was encrypted with.
+var ErrWrongKey = errors.New("wrong database key")
+
+// Cipher encrypts and decrypts column values with AES-256-GCM.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// LoadKey returns the passphrase from key or, when that is empty, from the
+// contents of keyFile with surrounding whitespace removed. It returns ""
+// when neither is set.
+func LoadKey(key, keyFile string) (string, error) {
+	if key != "" || keyFile == "" {
+		return key, nil
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	if key = strings.TrimSpace(string(b)); key == "" {
+		return "", errors.New("key file is empty")
+	}
+	return key, nil
+}
+
+// Encrypted reports whether db was set up for encryption by Open.
+func Encrypted(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='encryption'`).Scan(&n)
+	if err != nil || n == 0 {
+		return false, err
+	}
+	err = db.QueryRow(`SELECT COUNT(*) FROM encryption`).Scan(&n)
+	return n > 0, err
+}
+
+// Open returns the Cipher for db derived from passphrase. The first call
+// on a database stores a random salt and a check value; later calls fail
+// with ErrWrongKey when passphrase differs.
+func Open(db *sql.DB, passphrase string) (*Cipher, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS encryption (
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        salt BLOB NOT NULL,
+        check_value TEXT NOT NULL
+    )`); err != nil {
+		logger.Errorf("create encryption table failed: %v", err)
+		return nil, err
+	}
+	var salt []byte
+	var checkValue string
+	err := db.QueryRow(`SELECT salt, check_value FROM encryption WHERE id = 1`).Scan(&salt, &checkValue)
+	if err == nil {
+		c, err := newCipher(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if v, err := c.Decrypt(checkValue); err != nil || v != check {
+			return nil, ErrWrongKey
+		}
+		return c, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	c, err := newCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if checkValue, err = c.Encrypt(check); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`INSERT INTO encryption(id, salt, check_value) VALUES(1, ?, ?)`, salt, checkValue); err != nil {
+		logger.Errorf("store encryption salt failed: %v", err)
+		return nil, err
+	}
+	logger.Infof("database encryption enabled")
+	return c, nil
+}
+
+func newCipher(passphrase string, salt []byte) (*Cipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty database key")
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns s encrypted for storage. Empty strings stay empty so
+// checks for a missing credential still work.
+func (c *Cipher) Encrypt(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(s), nil)
+	return prefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of a stored value. Values that were never
+// encrypted are returned unchanged.
+func (c *Cipher) Decrypt(s string) (string, error) {
+	enc, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return s, nil
+	}
+	b, err := base64.RawStdEncoding.DecodeString(enc)
+	if err != nil || len(b) < c.aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", ErrWrongKey
+	}
+	return string(plain), nil
+}
+
+// IsEncrypted reports whether s is a value produced by Encrypt.
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
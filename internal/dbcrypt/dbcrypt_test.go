@@ -0,0 +1,63 @@
+package dbcrypt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func TestOpen(t *testing.T) {
+	db := testdb.Open(t)
+	if enc, err := Encrypted(db); err != nil || enc {
+		t.Fatalf("fresh database reported encrypted: %v", err)
+	}
+	c, err := Open(db, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc, _ := Encrypted(db); !enc {
+		t.Fatal("database not reported encrypted")
+	}
+	v, err := c.Encrypt("sk-123")
+	if err != nil || !IsEncrypted(v) || strings.Contains(v, "sk-123") {
+		t.Fatalf("encrypted %q %v", v, err)
+	}
+
+	again, err := Open(db, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := again.Decrypt(v); err != nil || plain != "sk-123" {
+		t.Fatalf("decrypted %q %v", plain, err)
+	}
+	if plain, _ := again.Decrypt("legacy"); plain != "legacy" {
+		t.Fatalf("plaintext changed to %q", plain)
+	}
+	if e, _ := again.Encrypt(""); e != "" {
+		t.Fatalf("empty value encrypted to %q", e)
+	}
+	if _, err := Open(db, "other"); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("from-file\n"), 0o600)
+	if k, err := LoadKey("", path); err != nil || k != "from-file" {
+		t.Fatalf("key %q %v", k, err)
+	}
+	if k, _ := LoadKey("env", path); k != "env" {
+		t.Fatalf("key %q", k)
+	}
+	if k, err := LoadKey("", ""); err != nil || k != "" {
+		t.Fatalf("key %q %v", k, err)
+	}
+	if _, err := LoadKey("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected error for missing key file")
+	}
+}
@@ -0,0 +1,159 @@
+// Package dbhealth tracks database file sizes, table row counts and write
+// errors so operators are warned before the disk fills up.
+package dbhealth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+)
+
+var writeErrors = metrics.Default.NewCounter("companion_db_write_errors_total", "Failed database writes by table.", "table")
+
+// RecordWriteError counts a failed write to table.
+func RecordWriteError(table string) { writeErrors.Inc(table) }
+
+// Health is a point-in-time view of the database.
+type Health struct {
+	CheckedAt     time.Time        `json:"checked_at"`
+	FileBytes     int64            `json:"file_bytes"`
+	WALBytes      int64            `json:"wal_bytes"`
+	PageCount     int64            `json:"page_count"`
+	FreelistCount int64            `json:"freelist_count"`
+	Tables        map[string]int64 `json:"tables"`
+	WriteErrors   map[string]int64 `json:"write_errors"`
+	Warning       string           `json:"warning,omitempty"`
+}
+
+// Monitor collects Health for a database.
+type Monitor struct {
+	db   *sql.DB
+	path string
+	// WarnBytes logs a warning when file plus WAL size exceeds it. Zero
+	// disables the warning.
+	WarnBytes int64
+
+	mu        sync.Mutex
+	last      Health
+	integrity *Integrity
+}
+
+// New creates a Monitor for db stored at path. path may be empty for
+// in-memory databases, in which case file sizes are reported as zero.
+func New(db *sql.DB, path string, warnBytes int64) *Monitor {
+	return &Monitor{db: db, path: path, WarnBytes: warnBytes}
+}
+
+// Check collects fresh Health and caches it for Last.
+func (m *Monitor) Check(ctx context.Context) (Health, error) {
+	h := Health{CheckedAt: time.Now(), Tables: make(map[string]int64), WriteErrors: make(map[string]int64)}
+	if m.path != "" {
+		if fi, err := os.Stat(m.path); err == nil {
+			h.FileBytes = fi.Size()
+		}
+		if fi, err := os.Stat(m.path + "-wal"); err == nil {
+			h.WALBytes = fi.Size()
+		}
+	}
+	if err := m.db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&h.PageCount); err != nil {
+		logger.Errorf("query page_count failed: %v", err)
+		return h, err
+	}
+	if err := m.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&h.FreelistCount); err != nil {
+		logger.Errorf("query freelist_count failed: %v", err)
+		return h, err
+	}
+	tables, err := m.tables(ctx)
+	if err != nil {
+		return h, err
+	}
+	for _, t := range tables {
+		var n int64
+		if err := m.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %q`, t)).Scan(&n); err != nil {
+			logger.Warnf("count rows in %s failed: %v", t, err)
+			continue
+		}
+		h.Tables[t] = n
+	}
+	for _, s := range writeErrors.Samples() {
+		h.WriteErrors[s.Labels["table"]] = int64(s.Value)
+	}
+	if m.WarnBytes > 0 && h.FileBytes+h.WALBytes > m.WarnBytes {
+		h.Warning = fmt.Sprintf("database size %d bytes exceeds warning threshold %d", h.FileBytes+h.WALBytes, m.WarnBytes)
+		logger.Warnf("%s", h.Warning)
+	}
+	m.mu.Lock()
+	m.last = h
+	m.mu.Unlock()
+	return h, nil
+}
+
+// tables returns the names of the database's tables.
+func (m *Monitor) tables(ctx context.Context) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		logger.Errorf("list tables failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// Last returns the most recently collected Health.
+func (m *Monitor) Last() Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// Start runs Check immediately and then every interval.
+func (m *Monitor) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		m.Check(ctx)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Check(ctx)
+			}
+		}
+	}()
+}
+
+// Register exposes the cached Health as gauges in r.
+func (m *Monitor) Register(r *metrics.Registry) {
+	r.NewGaugeFunc("companion_db_file_bytes", "Size of the database file.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(m.Last().FileBytes)}}
+	})
+	r.NewGaugeFunc("companion_db_wal_bytes", "Size of the write-ahead log.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(m.Last().WALBytes)}}
+	})
+	r.NewGaugeFunc("companion_db_freelist_pages", "Unused pages reclaimable by vacuum.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(m.Last().FreelistCount)}}
+	})
+	r.NewGaugeFunc("companion_db_table_rows", "Row count per table.", func() []metrics.Sample {
+		h := m.Last()
+		res := make([]metrics.Sample, 0, len(h.Tables))
+		for t, n := range h.Tables {
+			res = append(res, metrics.Sample{Labels: map[string]string{"table": t}, Value: float64(n)})
+		}
+		return res
+	})
+}
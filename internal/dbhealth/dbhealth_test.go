@@ -0,0 +1,91 @@
+package dbhealth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kxn/codex-companion/internal/metrics"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "h.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE logs (v TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		db.Exec(`INSERT INTO logs(v) VALUES('x')`)
+	}
+	RecordWriteError("logs")
+	m := New(db, path, 1)
+	h, err := m.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Tables["logs"] != 3 || h.FileBytes+h.WALBytes == 0 || h.PageCount == 0 {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+	if h.WriteErrors["logs"] < 1 {
+		t.Fatalf("write errors not reported: %+v", h.WriteErrors)
+	}
+	if h.Warning == "" {
+		t.Fatalf("expected size warning")
+	}
+
+	r := metrics.NewRegistry()
+	m.Register(r)
+	var buf bytes.Buffer
+	r.WritePrometheus(&buf)
+	if !strings.Contains(buf.String(), `companion_db_table_rows{table="logs"} 3`) {
+		t.Fatalf("metrics: %s", buf.String())
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db := testdb.Open(t)
+	for _, q := range []string{
+		`CREATE TABLE accounts (id INTEGER PRIMARY KEY)`,
+		`CREATE TABLE token_refreshes (account_id INTEGER)`,
+		`CREATE TABLE logs (account_id INTEGER)`,
+		`INSERT INTO accounts(id) VALUES(1)`,
+		`INSERT INTO token_refreshes(account_id) VALUES(1), (2), (2)`,
+		`INSERT INTO logs(account_id) VALUES(1), (2), (0), (NULL)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := New(db, "", 0)
+	if m.LastIntegrity() != nil {
+		t.Fatal("expected no report before a check")
+	}
+	ctx := context.Background()
+	res, err := m.CheckIntegrity(ctx, false)
+	if err != nil || res.OK() || len(res.Problems) != 0 || res.Orphans["token_refreshes"] != 2 || res.DeletedAccountLogs != 1 {
+		t.Fatalf("unexpected report %+v %v", res, err)
+	}
+	if res, err = m.CheckIntegrity(ctx, true); err != nil || !res.OK() || len(res.Repaired) != 1 {
+		t.Fatalf("unexpected repair %+v %v", res, err)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM token_refreshes`).Scan(&n)
+	if n != 1 {
+		t.Fatalf("expected the orphans deleted, %d rows left", n)
+	}
+	// Logs of deleted accounts are kept.
+	if db.QueryRow(`SELECT COUNT(*) FROM logs`).Scan(&n); n != 4 {
+		t.Fatalf("logs deleted, %d left", n)
+	}
+	if last := m.LastIntegrity(); last == nil || !last.OK() {
+		t.Fatalf("unexpected last report %+v", last)
+	}
+}
@@ -0,0 +1,149 @@
+package dbhealth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Integrity is the result of an integrity check.
+type Integrity struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// Problems lists what PRAGMA integrity_check found; it is empty for a
+	// sound database.
+	Problems []string `json:"problems"`
+	// Orphans counts, per table, the rows kept for accounts that no longer
+	// exist, such as token refreshes and quota snapshots.
+	Orphans map[string]int64 `json:"orphans"`
+	// DeletedAccountLogs counts the request logs of deleted accounts. They
+	// are the usage history of those accounts, so repairs keep them.
+	DeletedAccountLogs int64 `json:"deleted_account_logs"`
+	// Repaired describes the repairs made, if any.
+	Repaired []string `json:"repaired,omitempty"`
+}
+
+// OK reports whether the check found nothing to repair.
+func (i Integrity) OK() bool { return len(i.Problems) == 0 && len(i.Orphans) == 0 }
+
+// accountRefs are the tables whose account_id column refers to accounts.
+// Rows of deleted accounts in the tables marked orphan are useless and
+// removed by repairs.
+var accountRefs = []struct {
+	table  string
+	orphan bool
+}{
+	{"token_refreshes", true},
+	{"account_transitions", true},
+	{"quota_snapshots", true},
+	{"logs", false},
+}
+
+// maxProblems bounds the errors integrity_check reports.
+const maxProblems = 100
+
+// CheckIntegrity runs PRAGMA integrity_check and looks for rows referring
+// to deleted accounts. With repair it rebuilds the indexes of a database
+// that fails the check, which fixes index corruption, and deletes orphaned
+// rows. The report is logged and cached for LastIntegrity.
+func (m *Monitor) CheckIntegrity(ctx context.Context, repair bool) (Integrity, error) {
+	res := Integrity{CheckedAt: time.Now(), Problems: []string{}, Orphans: make(map[string]int64)}
+	var err error
+	if res.Problems, err = m.integrityProblems(ctx); err != nil {
+		return res, err
+	}
+	if repair && len(res.Problems) > 0 {
+		if _, err := m.db.ExecContext(ctx, `REINDEX`); err != nil {
+			logger.Errorf("reindex failed: %v", err)
+			return res, err
+		}
+		res.Repaired = append(res.Repaired, "rebuilt indexes")
+		if res.Problems, err = m.integrityProblems(ctx); err != nil {
+			return res, err
+		}
+	}
+	tables, err := m.tables(ctx)
+	if err != nil {
+		return res, err
+	}
+	exists := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		exists[t] = true
+	}
+	// Memory storage keeps accounts outside the database.
+	if exists["accounts"] {
+		for _, ref := range accountRefs {
+			if !exists[ref.table] {
+				continue
+			}
+			cond := fmt.Sprintf(`FROM %q WHERE account_id != 0 AND account_id NOT IN (SELECT id FROM accounts)`, ref.table)
+			var n int64
+			if err := m.db.QueryRowContext(ctx, `SELECT COUNT(*) `+cond).Scan(&n); err != nil {
+				logger.Errorf("count orphans in %s failed: %v", ref.table, err)
+				return res, err
+			}
+			switch {
+			case !ref.orphan:
+				res.DeletedAccountLogs = n
+			case n > 0 && repair:
+				if _, err := m.db.ExecContext(ctx, `DELETE `+cond); err != nil {
+					logger.Errorf("delete orphans in %s failed: %v", ref.table, err)
+					RecordWriteError(ref.table)
+					return res, err
+				}
+				res.Repaired = append(res.Repaired, fmt.Sprintf("deleted %d orphaned rows from %s", n, ref.table))
+			case n > 0:
+				res.Orphans[ref.table] = n
+			}
+		}
+	}
+	for _, r := range res.Repaired {
+		logger.Warnf("database repair: %s", r)
+	}
+	for _, p := range res.Problems {
+		logger.Errorf("database integrity: %s", p)
+	}
+	if len(res.Problems) > 0 {
+		logger.Errorf("database integrity check failed; restore a backup if a repair does not help")
+	}
+	for t, n := range res.Orphans {
+		logger.Warnf("database integrity: %d rows of %s refer to deleted accounts; set CODEX_COMPANION_DB_REPAIR or repair from the admin UI", n, t)
+	}
+	if res.OK() {
+		logger.Infof("database integrity ok")
+	}
+	m.mu.Lock()
+	m.integrity = &res
+	m.mu.Unlock()
+	return res, nil
+}
+
+// LastIntegrity returns the report of the latest CheckIntegrity, or nil
+// when none ran.
+func (m *Monitor) LastIntegrity() *Integrity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.integrity
+}
+
+// integrityProblems returns the errors of PRAGMA integrity_check.
+func (m *Monitor) integrityProblems(ctx context.Context) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf(`PRAGMA integrity_check(%d)`, maxProblems))
+	if err != nil {
+		logger.Errorf("integrity check failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	problems := []string{}
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	return problems, rows.Err()
+}
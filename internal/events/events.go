@@ -0,0 +1,202 @@
+// Package events is a small in-process pub/sub bus for system events.
+// Producers publish to Default; notifications, webhooks, metrics and the
+// admin UI subscribe instead of being called directly by each producer.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+)
+
+// Type identifies the kind of an Event.
+type Type string
+
+const (
+	// AccountExhausted is published when an account hits its quota.
+	AccountExhausted Type = "account.exhausted"
+	// AccountBillingBlocked is published when an account is taken out of
+	// rotation for a quota or billing error.
+	AccountBillingBlocked Type = "account.billing_blocked"
+	// AccountQuarantined is published when an account is taken out of
+	// rotation because the upstream keeps refusing it with 403.
+	AccountQuarantined Type = "account.quarantined"
+	// AccountInvalidToken is published when an account is taken out of
+	// rotation until its credentials are replaced because the upstream
+	// keeps rejecting them with 401.
+	AccountInvalidToken Type = "account.invalid_token"
+	// AccountReactivated is published when an exhausted account returns to
+	// rotation.
+	AccountReactivated Type = "account.reactivated"
+	// AccountTrusted is published when a new account joins full rotation
+	// after its ramp-up.
+	AccountTrusted Type = "account.trusted"
+	// ValidationStarted and ValidationFinished bracket a pass validating
+	// the credentials of every account, which publishes AccountValidated
+	// for each account as its probe completes, with the upstream status,
+	// whether the account is valid and the probe duration in Data.
+	ValidationStarted  Type = "validation.started"
+	AccountValidated   Type = "account.validated"
+	ValidationFinished Type = "validation.finished"
+	// FailoverToBackup is published when the scheduler starts serving
+	// requests from backup accounts because no primary is available, and
+	// FailbackToPrimary when a primary serves requests again.
+	FailoverToBackup  Type = "scheduler.failover"
+	FailbackToPrimary Type = "scheduler.failback"
+	// TokenRefreshed is published when a ChatGPT token refresh succeeds
+	// and RefreshFailed when it fails. Both carry the trigger and duration
+	// of the attempt in Data, TokenRefreshed also the new expiry.
+	TokenRefreshed Type = "account.token_refreshed"
+	RefreshFailed  Type = "account.refresh_failed"
+	// RequestFailed is published when a client request could not be served.
+	RequestFailed Type = "request.failed"
+	// Panic is published when serving a request panicked.
+	Panic Type = "panic"
+	// AnomalyDetected is published when the traffic shows an unusual
+	// pattern, such as a request spike from one client key; Data carries
+	// its kind, the client key, the value and its baseline.
+	AnomalyDetected Type = "anomaly.detected"
+	// ConfigChanged is published when accounts or settings are changed
+	// through the admin API.
+	ConfigChanged Type = "config.changed"
+)
+
+// Event is a single system event.
+type Event struct {
+	Type      Type           `json:"type"`
+	Time      time.Time      `json:"time"`
+	AccountID int64          `json:"account_id,omitempty"`
+	Message   string         `json:"message,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// subscriberBuffer is the number of events queued per subscriber before new
+// events are dropped for it.
+const subscriberBuffer = 256
+
+type subscriber struct {
+	types map[Type]bool
+	ch    chan Event
+	done  chan struct{}
+	// sync is called by Publish itself, for subscribers that must not
+	// miss events; ch and done are nil then.
+	sync func(Event)
+}
+
+// Bus delivers published events to subscribers. Each subscriber has its own
+// goroutine and queue, so a slow subscriber never blocks the publisher; its
+// events are dropped once the queue is full. Subscribers added with
+// SubscribeSync are called by the publisher instead and miss nothing.
+type Bus struct {
+	mu     sync.RWMutex
+	subs   map[*subscriber]struct{}
+	counts *metrics.Counter
+	drops  *metrics.Counter
+}
+
+// NewBus creates an empty Bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*subscriber]struct{})}
+}
+
+// Default is the process-wide bus.
+var Default = NewBus()
+
+// Publish sends e to Default.
+func Publish(e Event) { Default.Publish(e) }
+
+// Publish sends e to every subscriber interested in its type. A zero Time is
+// set to now.
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.counts != nil {
+		b.counts.Inc(string(e.Type))
+	}
+	for s := range b.subs {
+		if len(s.types) > 0 && !s.types[e.Type] {
+			continue
+		}
+		if s.sync != nil {
+			s.sync(e)
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			logger.Warnf("event subscriber queue full, dropping %s", e.Type)
+			if b.drops != nil {
+				b.drops.Inc(string(e.Type))
+			}
+		}
+	}
+}
+
+// Subscribe calls fn for every event of the given types, or of every type
+// when none are given. Events are delivered in publish order on a dedicated
+// goroutine. The returned function unsubscribes and waits for fn to return.
+func (b *Bus) Subscribe(fn func(Event), types ...Type) (unsubscribe func()) {
+	s := &subscriber{ch: make(chan Event, subscriberBuffer), done: make(chan struct{})}
+	if len(types) > 0 {
+		s.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		defer close(s.done)
+		for e := range s.ch {
+			fn(e)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			b.mu.Unlock()
+			close(s.ch)
+			<-s.done
+		})
+	}
+}
+
+// SubscribeSync is Subscribe for subscribers that must see every event,
+// such as the persistent webhook queue: fn is called by Publish itself, in
+// the publisher's goroutine, so it is never dropped but delays the
+// publisher. fn must be quick, such as handing the event to a goroutine of
+// the subscriber's, and must not block, publish or subscribe. The returned
+// function unsubscribes and waits for running calls of fn.
+func (b *Bus) SubscribeSync(fn func(Event), types ...Type) (unsubscribe func()) {
+	s := &subscriber{sync: fn}
+	if len(types) > 0 {
+		s.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+	}
+}
+
+// Register exports published and dropped event counts to r.
+func (b *Bus) Register(r *metrics.Registry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counts = r.NewCounter("companion_events_total", "System events published by type.", "type")
+	b.drops = r.NewCounter("companion_events_dropped_total", "Events dropped because a subscriber was too slow.", "type")
+}
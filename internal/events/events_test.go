@@ -0,0 +1,66 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/metrics"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	b := NewBus()
+	r := metrics.NewRegistry()
+	b.Register(r)
+
+	all := make(chan Event, 10)
+	exhausted := make(chan Event, 10)
+	unsubAll := b.Subscribe(func(e Event) { all <- e })
+	unsubEx := b.Subscribe(func(e Event) { exhausted <- e }, AccountExhausted)
+
+	b.Publish(Event{Type: AccountExhausted, AccountID: 1})
+	b.Publish(Event{Type: RequestFailed, Message: "upstream error"})
+
+	for _, want := range []Type{AccountExhausted, RequestFailed} {
+		select {
+		case e := <-all:
+			if e.Type != want || e.Time.IsZero() {
+				t.Fatalf("unexpected event %+v, want %s", e, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	select {
+	case e := <-exhausted:
+		if e.AccountID != 1 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("filtered subscriber got nothing")
+	}
+	unsubEx()
+	unsubEx()
+	b.Publish(Event{Type: AccountExhausted})
+	unsubAll()
+	if len(exhausted) != 0 {
+		t.Fatalf("unsubscribed handler still called")
+	}
+	if got := b.counts.Value(string(AccountExhausted)); got != 2 {
+		t.Fatalf("events_total = %v", got)
+	}
+}
+
+func TestSlowSubscriberDrops(t *testing.T) {
+	b := NewBus()
+	b.Register(metrics.NewRegistry())
+	block := make(chan struct{})
+	unsub := b.Subscribe(func(Event) { <-block })
+	for i := 0; i < subscriberBuffer+10; i++ {
+		b.Publish(Event{Type: ConfigChanged})
+	}
+	if b.drops.Value(string(ConfigChanged)) == 0 {
+		t.Fatalf("expected dropped events")
+	}
+	close(block)
+	unsub()
+}
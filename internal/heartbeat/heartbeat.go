@@ -0,0 +1,181 @@
+// Package heartbeat pings an external uptime monitor such as healthchecks.io
+// on a schedule, so the operator is paged when the companion stops running.
+// Before each ping it runs health checks; when one fails the failure URL is
+// pinged instead with the problems in the body.
+package heartbeat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Check reports a critical condition as a non-nil error.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Pinger sends heartbeats.
+type Pinger struct {
+	// URL is pinged with a GET while every check passes.
+	URL string
+	// FailURL receives a POST with the failed checks; it defaults to URL
+	// followed by "/fail" as healthchecks.io expects.
+	FailURL string
+	Checks  []Check
+	Client  *http.Client
+
+	mu      sync.Mutex
+	failing bool
+}
+
+// New creates a Pinger for url whose first check verifies that db accepts
+// writes, and ensures the table it writes to exists.
+func New(db *sql.DB, url string) (*Pinger, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS heartbeat (
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        time TIMESTAMP NOT NULL
+    )`); err != nil {
+		logger.Errorf("create heartbeat table failed: %v", err)
+		return nil, err
+	}
+	p := &Pinger{
+		URL:     url,
+		FailURL: strings.TrimSuffix(url, "/") + "/fail",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	p.Checks = []Check{{Name: "database", Run: func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO heartbeat(id, time) VALUES(1, ?)`, time.Now())
+		if err != nil {
+			return fmt.Errorf("database not writable: %w", err)
+		}
+		return nil
+	}}}
+	return p, nil
+}
+
+// AccountsAvailable is a Check failing when no account can serve requests
+// because there are none or all are exhausted, blocked, in maintenance or
+// holding invalid credentials.
+func AccountsAvailable(am *account.Manager) Check {
+	return Check{Name: "accounts", Run: func(ctx context.Context) error {
+		accounts, err := am.List(ctx)
+		if err != nil {
+			return fmt.Errorf("list accounts: %w", err)
+		}
+		if len(accounts) == 0 {
+			return errors.New("no accounts configured")
+		}
+		now := time.Now()
+		next := time.Time{}
+		for _, a := range accounts {
+			if a.Available(now) {
+				return nil
+			}
+			reset := a.ResetAt
+			if a.InMaintenance(now) {
+				reset = a.MaintenanceEnd
+			} else if a.InvalidToken() {
+				continue
+			}
+			if next.IsZero() || reset.Before(next) {
+				next = reset
+			}
+		}
+		if next.IsZero() {
+			return fmt.Errorf("all %d accounts unavailable until their credentials are replaced", len(accounts))
+		}
+		return fmt.Errorf("all %d accounts unavailable, first back at %s", len(accounts), next.UTC().Format(time.RFC3339))
+	}}
+}
+
+// Ping runs the checks and pings URL, or FailURL when a check failed.
+func (p *Pinger) Ping(ctx context.Context) error {
+	problems := p.check(ctx)
+	p.mu.Lock()
+	p.failing = len(problems) > 0
+	p.mu.Unlock()
+	return p.send(ctx, problems)
+}
+
+// check returns the messages of the failed checks.
+func (p *Pinger) check(ctx context.Context) []string {
+	var problems []string
+	for _, c := range p.Checks {
+		if err := c.Run(ctx); err != nil {
+			problems = append(problems, c.Name+": "+err.Error())
+		}
+	}
+	return problems
+}
+
+func (p *Pinger) send(ctx context.Context, problems []string) error {
+	method, url, body := http.MethodGet, p.URL, ""
+	if len(problems) > 0 {
+		method, url, body = http.MethodPost, p.FailURL, strings.Join(problems, "\n")
+		logger.Warnf("heartbeat failing: %s", strings.Join(problems, "; "))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("heartbeat status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Subscribe runs the checks whenever an account leaves rotation and pings
+// FailURL at once if that made them fail, instead of waiting for the next
+// scheduled heartbeat. It returns the unsubscribe function.
+func (p *Pinger) Subscribe(bus *events.Bus) func() {
+	return bus.Subscribe(func(events.Event) {
+		ctx := context.Background()
+		problems := p.check(ctx)
+		p.mu.Lock()
+		changed := len(problems) > 0 && !p.failing
+		if changed {
+			p.failing = true
+		}
+		p.mu.Unlock()
+		if !changed {
+			return
+		}
+		if err := p.send(ctx, problems); err != nil {
+			logger.Warnf("heartbeat failure ping: %v", err)
+		}
+	}, events.AccountExhausted, events.AccountBillingBlocked, events.AccountQuarantined, events.AccountInvalidToken)
+}
+
+// Start pings immediately and then every interval until ctx is done.
+func (p *Pinger) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := p.Ping(ctx); err != nil {
+				logger.Warnf("heartbeat: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,115 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+type ping struct {
+	method, path, body string
+}
+
+func monitor(t *testing.T) (*httptest.Server, func() []ping) {
+	t.Helper()
+	var mu sync.Mutex
+	var pings []ping
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pings = append(pings, ping{r.Method, r.URL.Path, string(b)})
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []ping {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]ping(nil), pings...)
+	}
+}
+
+func setup(t *testing.T, url string) (*Pinger, *account.Manager) {
+	t.Helper()
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
+	p, err := New(testdb.Open(t), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Checks = append(p.Checks, AccountsAvailable(mgr))
+	return p, mgr
+}
+
+func TestPing(t *testing.T) {
+	srv, pings := monitor(t)
+	p, mgr := setup(t, srv.URL+"/uuid")
+	ctx := context.Background()
+
+	// Without accounts nothing can be served.
+	if err := p.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	if err := p.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(time.Hour))
+	if err := p.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := pings()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 pings, got %+v", got)
+	}
+	if got[0].method != http.MethodPost || got[0].path != "/uuid/fail" || got[0].body != "accounts: no accounts configured" {
+		t.Fatalf("unexpected first ping %+v", got[0])
+	}
+	if got[1].method != http.MethodGet || got[1].path != "/uuid" {
+		t.Fatalf("unexpected success ping %+v", got[1])
+	}
+	if got[2].path != "/uuid/fail" || !strings.Contains(got[2].body, "all 1 accounts unavailable") {
+		t.Fatalf("unexpected exhaustion ping %+v", got[2])
+	}
+}
+
+func TestPingFailedCheck(t *testing.T) {
+	srv, pings := monitor(t)
+	p, _ := setup(t, srv.URL)
+	p.Checks = append(p.Checks[:1], Check{Name: "disk", Run: func(context.Context) error { return errors.New("full") }})
+	if err := p.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := pings(); len(got) != 1 || got[0].path != "/fail" || got[0].body != "disk: full" {
+		t.Fatalf("unexpected pings %+v", got)
+	}
+}
+
+func TestSubscribeFailsImmediately(t *testing.T) {
+	srv, pings := monitor(t)
+	p, mgr := setup(t, srv.URL)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	b, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 1)
+	bus := events.NewBus()
+	unsubscribe := p.Subscribe(bus)
+
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(time.Hour))
+	bus.Publish(events.Event{Type: events.AccountExhausted, AccountID: a.ID})
+	mgr.MarkExhausted(ctx, b.ID, time.Now().Add(time.Hour))
+	bus.Publish(events.Event{Type: events.AccountExhausted, AccountID: b.ID})
+	bus.Publish(events.Event{Type: events.AccountExhausted, AccountID: b.ID})
+	unsubscribe()
+	// Only the transition to failing is reported.
+	if got := pings(); len(got) != 1 || got[0].path != "/fail" {
+		t.Fatalf("unexpected pings %+v", got)
+	}
+}
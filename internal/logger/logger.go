@@ -1,10 +1,12 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 type Level int
@@ -16,45 +18,98 @@ const (
 	Error
 )
 
-var level = Info
+// level is the minimum Level written to the log. It may change at runtime
+// through the admin API while requests are logging.
+var level atomic.Int32
 
 func init() {
+	level.Store(int32(Info))
 	if v := os.Getenv("LOG_LEVEL"); v != "" {
-		switch strings.ToLower(v) {
-		case "debug":
-			level = Debug
-		case "info":
-			level = Info
-		case "warn", "warning":
-			level = Warn
-		case "error":
-			level = Error
+		if l, err := ParseLevel(v); err == nil {
+			SetLevel(l)
 		}
 	}
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-func SetLevel(l Level) { level = l }
+// ParseLevel returns the Level named s: debug, info, warn (or warning) or
+// error, in any case.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "error":
+		return Error, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
 
-func logf(l Level, format string, v ...interface{}) {
-	if l < level {
-		return
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
 	}
-	var prefix string
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+func SetLevel(l Level) { level.Store(int32(l)) }
+
+// GetLevel returns the current minimum Level.
+func GetLevel() Level { return Level(level.Load()) }
+
+func prefix(l Level) string {
 	switch l {
 	case Debug:
-		prefix = "[DEBUG] "
+		return "[DEBUG] "
 	case Info:
-		prefix = "[INFO] "
+		return "[INFO] "
 	case Warn:
-		prefix = "[WARN] "
+		return "[WARN] "
 	case Error:
-		prefix = "[ERROR] "
+		return "[ERROR] "
+	}
+	return ""
+}
+
+func logf(l Level, format string, v ...interface{}) {
+	if l < GetLevel() {
+		return
+	}
+	log.Output(3, prefix(l)+fmt.Sprintf(format, v...))
+}
+
+// logc is logf for a request context: the line is also recorded in the
+// request's Trace, if it is being captured, whatever the level.
+func logc(ctx context.Context, l Level, format string, v ...interface{}) {
+	t := traceFrom(ctx)
+	if t == nil && l < GetLevel() {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if t != nil {
+		t.add(prefix(l) + msg)
+	}
+	if l >= GetLevel() {
+		log.Output(3, prefix(l)+msg)
 	}
-	log.Output(3, prefix+fmt.Sprintf(format, v...))
 }
 
 func Debugf(format string, v ...interface{}) { logf(Debug, format, v...) }
 func Infof(format string, v ...interface{})  { logf(Info, format, v...) }
 func Warnf(format string, v ...interface{})  { logf(Warn, format, v...) }
 func Errorf(format string, v ...interface{}) { logf(Error, format, v...) }
+
+func Debugc(ctx context.Context, format string, v ...interface{}) { logc(ctx, Debug, format, v...) }
+func Infoc(ctx context.Context, format string, v ...interface{})  { logc(ctx, Info, format, v...) }
+func Warnc(ctx context.Context, format string, v ...interface{})  { logc(ctx, Warn, format, v...) }
+func Errorc(ctx context.Context, format string, v ...interface{}) { logc(ctx, Error, format, v...) }
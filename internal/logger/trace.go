@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Debug capture records a verbose trace of the next few requests without
+// lowering the level for everything else. While armed, BeginTrace attaches a
+// Trace to a request's context and the context variants of the log
+// functions (Debugc, Infoc, ...) append to it at every level.
+
+const (
+	// maxTraces is how many finished traces are kept; older ones are
+	// dropped first.
+	maxTraces = 100
+	// maxTraceLines caps the lines recorded per trace.
+	maxTraceLines = 2000
+)
+
+// Trace is the verbose log of one captured request.
+type Trace struct {
+	ID      string    `json:"id"`
+	Request string    `json:"request"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end,omitempty"`
+	Lines   []string  `json:"lines"`
+	// Truncated is set when lines beyond maxTraceLines were dropped.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// liveTrace is a Trace still being recorded.
+type liveTrace struct {
+	mu sync.Mutex
+	t  Trace
+}
+
+func (lt *liveTrace) add(line string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if len(lt.t.Lines) >= maxTraceLines {
+		lt.t.Truncated = true
+		return
+	}
+	lt.t.Lines = append(lt.t.Lines, time.Now().Format("15:04:05.000000")+" "+line)
+}
+
+func (lt *liveTrace) finish() {
+	lt.mu.Lock()
+	lt.t.End = time.Now()
+	lt.mu.Unlock()
+}
+
+func (lt *liveTrace) snapshot() Trace {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	t := lt.t
+	t.Lines = append([]string{}, t.Lines...)
+	return t
+}
+
+type traceKey struct{}
+
+func traceFrom(ctx context.Context) *liveTrace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(traceKey{}).(*liveTrace)
+	return t
+}
+
+var capture struct {
+	mu        sync.Mutex
+	remaining int
+	traces    []*liveTrace
+}
+
+// StartCapture arms debug capture for the next n requests, replacing any
+// capture still pending. n <= 0 stops capturing.
+func StartCapture(n int) {
+	capture.mu.Lock()
+	capture.remaining = max(n, 0)
+	capture.mu.Unlock()
+	if n > 0 {
+		Infof("debug capture armed for %d requests", n)
+	}
+}
+
+// ClearCaptured stops capturing and discards the recorded traces.
+func ClearCaptured() {
+	capture.mu.Lock()
+	capture.remaining = 0
+	capture.traces = nil
+	capture.mu.Unlock()
+}
+
+// Captured returns how many requests are still to be captured and the
+// recorded traces, oldest first. Traces of requests in flight have no End.
+func Captured() (remaining int, traces []Trace) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	traces = make([]Trace, 0, len(capture.traces))
+	for _, t := range capture.traces {
+		traces = append(traces, t.snapshot())
+	}
+	return capture.remaining, traces
+}
+
+// BeginTrace returns ctx carrying a new trace of the request described by
+// id and request when debug capture is armed, using up one of its requests,
+// and the function marking the end of the request. Otherwise it returns ctx
+// unchanged and a no-op function.
+func BeginTrace(ctx context.Context, id, request string) (context.Context, func()) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.remaining == 0 {
+		return ctx, func() {}
+	}
+	capture.remaining--
+	lt := &liveTrace{t: Trace{ID: id, Request: request, Start: time.Now()}}
+	capture.traces = append(capture.traces, lt)
+	if n := len(capture.traces) - maxTraces; n > 0 {
+		capture.traces = append([]*liveTrace(nil), capture.traces[n:]...)
+	}
+	return context.WithValue(ctx, traceKey{}, lt), lt.finish
+}
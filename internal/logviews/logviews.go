@@ -0,0 +1,112 @@
+// Package logviews keeps the named log filters admins save in the logs UI,
+// such as "errors on account 3 in the last 24h", so that every browser sees
+// the same views.
+package logviews
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// View is a saved log filter. Query holds the filter parameters of the logs
+// API, such as "account=3&errors=1&window=24h"; relative windows are
+// resolved whenever the view is applied.
+type View struct {
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	// ErrNotFound is returned for unknown views.
+	ErrNotFound = errors.New("log view not found")
+	// ErrInvalid wraps the errors of invalid names.
+	ErrInvalid = errors.New("invalid log view")
+)
+
+// maxName bounds the length of view names.
+const maxName = 100
+
+// Store keeps views in the log_views table.
+type Store struct {
+	db *sql.DB
+}
+
+// New creates a Store and ensures its table exists.
+func New(db *sql.DB) (*Store, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS log_views (
+        name TEXT PRIMARY KEY,
+        query TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL
+    )`); err != nil {
+		logger.Errorf("create log_views table failed: %v", err)
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Save creates or replaces the view v.Name.
+func (s *Store) Save(ctx context.Context, v *View) error {
+	v.Name = strings.TrimSpace(v.Name)
+	if v.Name == "" || len(v.Name) > maxName {
+		return fmt.Errorf("%w: name must have 1 to %d characters", ErrInvalid, maxName)
+	}
+	now := time.Now()
+	if v.CreatedAt.IsZero() {
+		v.CreatedAt = now
+	}
+	v.UpdatedAt = now
+	_, err := s.db.ExecContext(ctx, `INSERT INTO log_views(name, query, created_at, updated_at) VALUES(?, ?, ?, ?)
+        ON CONFLICT(name) DO UPDATE SET query=excluded.query, updated_at=excluded.updated_at`,
+		v.Name, v.Query, v.CreatedAt.UnixMilli(), v.UpdatedAt.UnixMilli())
+	if err != nil {
+		logger.Errorf("save log view %s failed: %v", v.Name, err)
+		dbhealth.RecordWriteError("log_views")
+	}
+	return err
+}
+
+// Delete removes the view name.
+func (s *Store) Delete(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM log_views WHERE name=?`, name)
+	if err != nil {
+		logger.Errorf("delete log view %s failed: %v", name, err)
+		dbhealth.RecordWriteError("log_views")
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List returns every view ordered by name.
+func (s *Store) List(ctx context.Context) ([]View, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, query, created_at, updated_at FROM log_views ORDER BY name`)
+	if err != nil {
+		logger.Errorf("list log views failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []View{}
+	for rows.Next() {
+		var v View
+		var created, updated int64
+		if err := rows.Scan(&v.Name, &v.Query, &created, &updated); err != nil {
+			logger.Errorf("scan log view failed: %v", err)
+			return nil, err
+		}
+		v.CreatedAt, v.UpdatedAt = time.UnixMilli(created), time.UnixMilli(updated)
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
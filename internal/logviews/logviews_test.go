@@ -0,0 +1,44 @@
+package logviews
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func TestStore(t *testing.T) {
+	db := testdb.Open(t)
+	s, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if list, err := s.List(ctx); err != nil || len(list) != 0 {
+		t.Fatalf("expected no views, got %v %v", list, err)
+	}
+	s.Save(ctx, &View{Name: "slow", Query: "slow=1"})
+	v := &View{Name: " errors on account 3 ", Query: "account=3&errors=1&window=24h"}
+	if err := s.Save(ctx, v); err != nil || v.Name != "errors on account 3" {
+		t.Fatalf("save: %v %+v", err, v)
+	}
+	// Saving under an existing name replaces the query.
+	s.Save(ctx, &View{Name: "slow", Query: "slow=1&window=1h"})
+	list, err := s.List(ctx)
+	if err != nil || len(list) != 2 || list[0].Name != "errors on account 3" || list[1].Query != "slow=1&window=1h" {
+		t.Fatalf("unexpected views %+v %v", list, err)
+	}
+	for _, name := range []string{"", "  ", strings.Repeat("x", 101)} {
+		if err := s.Save(ctx, &View{Name: name}); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected invalid name error for %q, got %v", name, err)
+		}
+	}
+	if err := s.Delete(ctx, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "slow"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
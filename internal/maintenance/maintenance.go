@@ -0,0 +1,201 @@
+// Package maintenance runs periodic SQLite housekeeping (WAL checkpoint,
+// incremental vacuum and ANALYZE) during a configurable quiet window.
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Window is a daily local time range. A zero Window allows any time.
+type Window struct {
+	Start time.Duration // offset from midnight
+	End   time.Duration // offset from midnight; may be before Start to wrap
+}
+
+// ParseWindow parses a range like "02:00-05:00". An empty string returns a
+// zero Window.
+func ParseWindow(s string) (Window, error) {
+	if s == "" {
+		return Window{}, nil
+	}
+	var sh, sm, eh, em int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &sh, &sm, &eh, &em); err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if sh < 0 || sh > 23 || eh < 0 || eh > 23 || sm < 0 || sm > 59 || em < 0 || em > 59 {
+		return Window{}, fmt.Errorf("invalid window %q", s)
+	}
+	return Window{
+		Start: time.Duration(sh)*time.Hour + time.Duration(sm)*time.Minute,
+		End:   time.Duration(eh)*time.Hour + time.Duration(em)*time.Minute,
+	}, nil
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	off := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.Start < w.End {
+		return off >= w.Start && off < w.End
+	}
+	return off >= w.Start || off < w.End
+}
+
+// StepResult records the outcome of a single maintenance statement.
+type StepResult struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Status describes the most recent maintenance run.
+type Status struct {
+	Running    bool         `json:"running"`
+	LastRun    time.Time    `json:"last_run"`
+	DurationMs int64        `json:"duration_ms"`
+	Steps      []StepResult `json:"steps"`
+	Error      string       `json:"error,omitempty"`
+	Interval   string       `json:"interval"`
+	Window     string       `json:"window"`
+}
+
+// Runner executes maintenance against a database.
+type Runner struct {
+	db       *sql.DB
+	interval time.Duration
+	window   Window
+	windowS  string
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New creates a Runner. window uses the ParseWindow format.
+func New(db *sql.DB, interval time.Duration, window string) (*Runner, error) {
+	w, err := ParseWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{db: db, interval: interval, window: w, windowS: window}, nil
+}
+
+// Status returns a copy of the last run status.
+func (r *Runner) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.status
+	st.Steps = append([]StepResult(nil), r.status.Steps...)
+	st.Interval = r.interval.String()
+	st.Window = r.windowS
+	return st
+}
+
+// due reports whether a scheduled run should happen at now.
+func (r *Runner) due(now time.Time) bool {
+	if r.interval <= 0 || !r.window.Contains(now) {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.status.Running && now.Sub(r.status.LastRun) >= r.interval
+}
+
+// Start checks every tick whether maintenance is due and runs it.
+func (r *Runner) Start(ctx context.Context, tick time.Duration) {
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if r.due(now) {
+					r.Run(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// Run performs maintenance immediately and returns the resulting status.
+func (r *Runner) Run(ctx context.Context) Status {
+	r.mu.Lock()
+	if r.status.Running {
+		r.mu.Unlock()
+		logger.Warnf("maintenance already running")
+		return r.Status()
+	}
+	r.status.Running = true
+	r.mu.Unlock()
+
+	logger.Infof("database maintenance started")
+	start := time.Now()
+	var steps []StepResult
+	var firstErr string
+	step := func(name string, fn func() error) {
+		t := time.Now()
+		res := StepResult{Name: name}
+		if err := fn(); err != nil {
+			logger.Errorf("maintenance step %s failed: %v", name, err)
+			res.Error = err.Error()
+			if firstErr == "" {
+				firstErr = name + ": " + err.Error()
+			}
+		}
+		res.DurationMs = time.Since(t).Milliseconds()
+		steps = append(steps, res)
+	}
+	step("wal_checkpoint", func() error {
+		_, err := r.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`)
+		return err
+	})
+	step("incremental_vacuum", func() error { return r.incrementalVacuum(ctx) })
+	step("analyze", func() error {
+		_, err := r.db.ExecContext(ctx, `ANALYZE`)
+		return err
+	})
+
+	r.mu.Lock()
+	r.status = Status{
+		LastRun:    start,
+		DurationMs: time.Since(start).Milliseconds(),
+		Steps:      steps,
+		Error:      firstErr,
+	}
+	r.mu.Unlock()
+	logger.Infof("database maintenance finished in %dms", time.Since(start).Milliseconds())
+	return r.Status()
+}
+
+// incrementalVacuum frees unused pages. Databases created without
+// auto_vacuum=INCREMENTAL are converted once with a full VACUUM.
+func (r *Runner) incrementalVacuum(ctx context.Context) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var mode int
+	if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return err
+	}
+	if mode != 2 {
+		logger.Infof("converting database to incremental auto_vacuum")
+		if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum=INCREMENTAL`); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, `VACUUM`)
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `PRAGMA incremental_vacuum`)
+	return err
+}
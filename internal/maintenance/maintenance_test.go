@@ -0,0 +1,97 @@
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func setupRunner(t *testing.T, interval time.Duration, window string) (*Runner, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "m.db")+"?_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE t (v TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(db, interval, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, db
+}
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow("22:30-04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(h, m int) time.Time { return time.Date(2024, 1, 1, h, m, 0, 0, time.Local) }
+	if !w.Contains(at(23, 0)) || !w.Contains(at(3, 59)) || w.Contains(at(4, 0)) || w.Contains(at(12, 0)) {
+		t.Fatalf("wrap-around window wrong: %+v", w)
+	}
+	w, _ = ParseWindow("02:00-05:00")
+	if !w.Contains(at(2, 0)) || w.Contains(at(5, 0)) {
+		t.Fatalf("window wrong: %+v", w)
+	}
+	if _, err := ParseWindow("25:00-01:00"); err == nil {
+		t.Fatalf("expected error for invalid hour")
+	}
+	if w, err := ParseWindow(""); err != nil || !w.Contains(at(12, 0)) {
+		t.Fatalf("empty window should allow any time: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	r, db := setupRunner(t, time.Hour, "")
+	ctx := context.Background()
+	st := r.Run(ctx)
+	if st.Error != "" || len(st.Steps) != 3 || st.LastRun.IsZero() {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	var mode int
+	if err := db.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil || mode != 2 {
+		t.Fatalf("auto_vacuum not incremental: %d %v", mode, err)
+	}
+	// second run uses incremental vacuum only
+	if st := r.Run(ctx); st.Error != "" {
+		t.Fatalf("second run: %+v", st)
+	}
+}
+
+func TestDue(t *testing.T) {
+	r, _ := setupRunner(t, time.Hour, "")
+	now := time.Now()
+	if !r.due(now) {
+		t.Fatalf("never-run runner should be due")
+	}
+	r.Run(context.Background())
+	if r.due(time.Now()) {
+		t.Fatalf("should not be due right after a run")
+	}
+	if !r.due(time.Now().Add(2 * time.Hour)) {
+		t.Fatalf("should be due after interval")
+	}
+
+	disabled, _ := setupRunner(t, 0, "")
+	if disabled.due(now) {
+		t.Fatalf("zero interval disables scheduling")
+	}
+}
+
+func TestStart(t *testing.T) {
+	r, _ := setupRunner(t, time.Hour, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if r.Status().LastRun.IsZero() {
+		t.Fatalf("maintenance not run")
+	}
+}
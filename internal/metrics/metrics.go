@@ -0,0 +1,275 @@
+// Package metrics is a minimal registry of counters and gauges that can be
+// rendered in the Prometheus text exposition format without pulling in the
+// Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Sample is a single labelled value.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string // "counter", "gauge" or "summary"
+	labels  []string
+	mu      sync.Mutex
+	values  map[string]float64
+	counts  map[string]float64 // observations per key, summaries only
+	collect func() []Sample
+}
+
+// Registry holds metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	// sinks receive every timer observation, for exporters that forward
+	// individual timings.
+	sinks []func(name string, labels map[string]string, d time.Duration)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Default is the process-wide registry served on /metrics.
+var Default = NewRegistry()
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.families[f.name]; ok {
+		return existing
+	}
+	r.families[f.name] = f
+	return f
+}
+
+// Counter is a monotonically increasing metric with optional labels.
+type Counter struct{ f *family }
+
+// NewCounter registers a counter. Registering the same name twice returns the
+// existing counter.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]float64)})}
+}
+
+// Inc adds one for the given label values.
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Add adds v for the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.f.mu.Lock()
+	c.f.values[key] += v
+	c.f.mu.Unlock()
+}
+
+// Value returns the current value for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := strings.Join(labelValues, "\xff")
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	return c.f.values[key]
+}
+
+// Samples returns the current labelled values of the counter.
+func (c *Counter) Samples() []Sample { return c.f.samples() }
+
+// Gauge is a metric that can go up and down.
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, kind: "gauge", labels: labels, values: make(map[string]float64)})}
+}
+
+// Set sets the value for the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	g.f.mu.Lock()
+	g.f.values[key] = v
+	g.f.mu.Unlock()
+}
+
+// Add adds v (which may be negative) for the given label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	g.f.mu.Lock()
+	g.f.values[key] += v
+	g.f.mu.Unlock()
+}
+
+// Timer records durations. It is exposed to Prometheus as a summary of the
+// total seconds and the number of observations.
+type Timer struct {
+	f *family
+	r *Registry
+}
+
+// NewTimer registers a timer.
+func (r *Registry) NewTimer(name, help string, labels ...string) *Timer {
+	f := r.register(&family{name: name, help: help, kind: "summary", labels: labels, values: make(map[string]float64), counts: make(map[string]float64)})
+	return &Timer{f, r}
+}
+
+// Observe records d for the given label values.
+func (t *Timer) Observe(d time.Duration, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	t.f.mu.Lock()
+	t.f.values[key] += d.Seconds()
+	t.f.counts[key]++
+	t.f.mu.Unlock()
+	t.r.mu.Lock()
+	sinks := t.r.sinks
+	t.r.mu.Unlock()
+	if len(sinks) == 0 {
+		return
+	}
+	labels := t.f.labelMap(key)
+	for _, sink := range sinks {
+		sink(t.f.name, labels, d)
+	}
+}
+
+// Count returns the number of observations for the given label values.
+func (t *Timer) Count(labelValues ...string) float64 {
+	key := strings.Join(labelValues, "\xff")
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	return t.f.counts[key]
+}
+
+// OnTiming calls fn for every later timer observation in r.
+func (r *Registry) OnTiming(fn func(name string, labels map[string]string, d time.Duration)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sinks = append(r.sinks, fn)
+}
+
+// NewGaugeFunc registers a gauge whose samples are produced by fn at
+// collection time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() []Sample) {
+	r.register(&family{name: name, help: help, kind: "gauge", collect: fn})
+}
+
+func (f *family) samples() []Sample {
+	if f.collect != nil {
+		return f.collect()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := make([]Sample, 0, len(f.values))
+	for key, v := range f.values {
+		res = append(res, Sample{Labels: f.labelMap(key), Value: v})
+	}
+	return res
+}
+
+// countSamples returns the observation counts of a summary.
+func (f *family) countSamples() []Sample {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := make([]Sample, 0, len(f.counts))
+	for key, v := range f.counts {
+		res = append(res, Sample{Labels: f.labelMap(key), Value: v})
+	}
+	return res
+}
+
+// labelMap pairs the label names with the values joined in key.
+func (f *family) labelMap(key string) map[string]string {
+	if len(f.labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(f.labels))
+	vals := strings.Split(key, "\xff")
+	for i, l := range f.labels {
+		if i < len(vals) {
+			labels[l] = vals[i]
+		}
+	}
+	return labels
+}
+
+// WritePrometheus renders all families in the text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for n := range r.families {
+		names = append(names, n)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+	for _, n := range names {
+		r.mu.Lock()
+		f := r.families[n]
+		r.mu.Unlock()
+		var lines []string
+		if f.kind == "summary" {
+			lines = sampleLines(f.name+"_sum", f.samples())
+			lines = append(lines, sampleLines(f.name+"_count", f.countSamples())...)
+		} else {
+			lines = sampleLines(f.name, f.samples())
+		}
+		sort.Strings(lines)
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+			return err
+		}
+		for _, l := range lines {
+			if _, err := io.WriteString(w, l+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sampleLines(name string, samples []Sample) []string {
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		lines = append(lines, name+formatLabels(s.Labels)+" "+strconv.FormatFloat(s.Value, 'g', -1, 64))
+	}
+	return lines
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := r.WritePrometheus(w); err != nil {
+			logger.Warnf("write metrics: %v", err)
+		}
+	})
+}
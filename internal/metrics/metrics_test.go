@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "status")
+	c.Inc("200")
+	c.Add(2, "429")
+	g := r.NewGauge("in_flight", "In flight.")
+	g.Set(3)
+	r.NewGaugeFunc("rows", "Rows.", func() []Sample {
+		return []Sample{{Labels: map[string]string{"table": "logs"}, Value: 7}}
+	})
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE requests_total counter",
+		`requests_total{status="200"} 1`,
+		`requests_total{status="429"} 2`,
+		"in_flight 3",
+		`rows{table="logs"} 7`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	if c.Value("429") != 2 {
+		t.Fatalf("value %v", c.Value("429"))
+	}
+}
+
+func TestRegisterTwiceReturnsExisting(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("x_total", "X.").Inc()
+	r.NewCounter("x_total", "X.").Inc()
+	if v := r.NewCounter("x_total", "X.").Value(); v != 2 {
+		t.Fatalf("expected shared counter, got %v", v)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("up", "Up.").Set(1)
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "up 1") {
+		t.Fatalf("body: %s", rec.Body.String())
+	}
+}
+
+func TestTimer(t *testing.T) {
+	r := NewRegistry()
+	tm := r.NewTimer("latency_seconds", "Latency.", "status")
+	tm.Observe(500*time.Millisecond, "200")
+	tm.Observe(time.Second, "200")
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE latency_seconds summary",
+		`latency_seconds_sum{status="200"} 1.5`,
+		`latency_seconds_count{status="200"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	if tm.Count("200") != 2 {
+		t.Fatalf("count %v", tm.Count("200"))
+	}
+}
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// statsdPacket bounds the size of one UDP datagram so it is not fragmented
+// on common networks.
+const statsdPacket = 1432
+
+// statsdPending caps the timings buffered between flushes; later ones are
+// dropped.
+const statsdPending = 10000
+
+// StatsD pushes a Registry to a StatsD server over UDP. Counters are sent as
+// the increase since the previous flush, gauges as their current value and
+// every timer observation as a timing in milliseconds. With tags, labels are
+// sent as DogStatsD tags; otherwise their values are appended to the metric
+// name.
+type StatsD struct {
+	r      *Registry
+	conn   net.Conn
+	prefix string
+	tags   bool
+
+	mu      sync.Mutex
+	last    map[string]float64
+	timings []string
+}
+
+// NewStatsD sends the metrics of r to the StatsD server at addr (host:port),
+// naming each metric prefix followed by its registry name.
+func NewStatsD(r *Registry, addr, prefix string, tags bool) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{r: r, conn: conn, prefix: prefix, tags: tags, last: make(map[string]float64)}
+	r.OnTiming(s.timing)
+	return s, nil
+}
+
+func (s *StatsD) timing(name string, labels map[string]string, d time.Duration) {
+	line := s.line(name, labels, float64(d.Microseconds())/1000, "ms")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.timings) < statsdPending {
+		s.timings = append(s.timings, line)
+	}
+}
+
+// Start flushes every interval until ctx is done, then flushes once more.
+func (s *StatsD) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.Flush()
+				return
+			case <-t.C:
+				if err := s.Flush(); err != nil {
+					logger.Warnf("statsd flush: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Flush sends the buffered timings and the current counters and gauges.
+func (s *StatsD) Flush() error {
+	s.r.mu.Lock()
+	families := make([]*family, 0, len(s.r.families))
+	for _, f := range s.r.families {
+		families = append(families, f)
+	}
+	s.r.mu.Unlock()
+
+	s.mu.Lock()
+	lines := s.timings
+	s.timings = nil
+	for _, f := range families {
+		switch f.kind {
+		case "counter":
+			for _, smp := range f.samples() {
+				key := f.name + formatLabels(smp.Labels)
+				if delta := smp.Value - s.last[key]; delta > 0 {
+					lines = append(lines, s.line(f.name, smp.Labels, delta, "c"))
+				}
+				s.last[key] = smp.Value
+			}
+		case "gauge":
+			for _, smp := range f.samples() {
+				lines = append(lines, s.line(f.name, smp.Labels, smp.Value, "g"))
+			}
+		}
+	}
+	s.mu.Unlock()
+	return s.send(lines)
+}
+
+// send writes lines in datagrams of at most statsdPacket bytes.
+func (s *StatsD) send(lines []string) error {
+	var buf strings.Builder
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write([]byte(buf.String()))
+		buf.Reset()
+		return err
+	}
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(l) > statsdPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	return flush()
+}
+
+// line formats one StatsD metric line.
+func (s *StatsD) line(name string, labels map[string]string, v float64, kind string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	name = s.prefix + name
+	var tags []string
+	for _, k := range keys {
+		if s.tags {
+			tags = append(tags, statsdSafe(k)+":"+statsdSafe(labels[k]))
+		} else if val := labels[k]; val != "" {
+			name += "." + statsdSafe(val)
+		} else {
+			name += ".none"
+		}
+	}
+	line := name + ":" + strconv.FormatFloat(v, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdSafe replaces the characters that delimit StatsD lines and tags.
+func statsdSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', ',', '#', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Close stops forwarding to the server.
+func (s *StatsD) Close() error { return s.conn.Close() }
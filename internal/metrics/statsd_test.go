@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenStatsD(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receive returns the sorted lines of the next datagram.
+func receive(t *testing.T, conn *net.UDPConn) []string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 65536)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestStatsDFlush(t *testing.T) {
+	conn := listenStatsD(t)
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "status")
+	g := r.NewGauge("in_flight", "In flight.")
+	tm := r.NewTimer("latency_seconds", "Latency.", "account", "status")
+	s, err := NewStatsD(r, conn.LocalAddr().String(), "cc.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c.Add(3, "200")
+	g.Set(2)
+	tm.Observe(1500*time.Microsecond, "1", "200")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"cc.in_flight:2|g",
+		"cc.latency_seconds:1.5|ms|#account:1,status:200",
+		"cc.requests_total:3|c|#status:200",
+	}
+	if got := receive(t, conn); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("first flush:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Counters are sent as deltas; unchanged ones are skipped.
+	c.Inc("200")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"cc.in_flight:2|g", "cc.requests_total:1|c|#status:200"}
+	if got := receive(t, conn); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("second flush:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestStatsDWithoutTags(t *testing.T) {
+	conn := listenStatsD(t)
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "account", "status")
+	s, err := NewStatsD(r, conn.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c.Inc("", "5:0|x")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, conn); len(got) != 1 || got[0] != "requests_total.none.5_0_x:1|c" {
+		t.Fatalf("unexpected lines %q", got)
+	}
+}
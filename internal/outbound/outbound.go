@@ -0,0 +1,257 @@
+// Package outbound builds the transport of requests to the upstreams, which
+// may have to leave through an HTTP or SOCKS5 proxy, shared or dedicated to
+// an account, and may need TLS settings of their own.
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// HeaderTimeout is how long a Transport waits for the response headers
+// once the request is sent. Connecting is bounded by the dial and TLS
+// handshake timeouts of http.DefaultTransport; nothing bounds reading the
+// body, as an event stream may run for minutes.
+const HeaderTimeout = 60 * time.Second
+
+// Transport returns a transport configured like http.DefaultTransport,
+// waiting at most HeaderTimeout for response headers, that connects through
+// proxyURL, an http, https, socks5 or socks5h URL with optional
+// user:password credentials; socks5h resolves host names on the proxy. An
+// empty proxyURL uses the proxy named by HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY, as the default transport does.
+func Transport(proxyURL string) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = HeaderTimeout
+	if proxyURL == "" {
+		return t, nil
+	}
+	u, err := ParseProxy(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	t.Proxy = http.ProxyURL(u)
+	return t, nil
+}
+
+// ParseProxy parses and checks a proxy URL as Transport accepts it.
+func ParseProxy(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("outbound proxy %s: unsupported scheme %q", u.Redacted(), u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("outbound proxy %s: missing host", u.Redacted())
+	}
+	return u, nil
+}
+
+// LoadCA returns the system roots extended with the PEM certificates in
+// file, e.g. the CA of a self-hosted upstream.
+func LoadCA(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %s: no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// Options are the outbound settings of an account. The zero value uses the
+// shared transport.
+type Options struct {
+	// ProxyURL is a proxy as Transport accepts it.
+	ProxyURL string
+	// CAFile is a PEM bundle of CAs trusted in addition to the system
+	// roots.
+	CAFile string
+	// InsecureSkipVerify accepts any server certificate.
+	InsecureSkipVerify bool
+}
+
+// caCheckInterval is how often Accounts looks for a modified CAFile.
+var caCheckInterval = time.Minute
+
+// Accounts keeps a dedicated transport for every account with Options of
+// its own, so each account's connections leave through its proxy with its
+// TLS settings and are never reused for another account. The zero value is
+// ready to use.
+type Accounts struct {
+	mu sync.Mutex
+	m  map[int64]*accountTransport
+}
+
+type accountTransport struct {
+	base http.RoundTripper
+	opts Options
+	// caTime is the modification time of CAFile when it was read, and
+	// checked when it was last looked at.
+	caTime, checked time.Time
+	t               *http.Transport
+	// rt is t inside the wrappers of base.
+	rt http.RoundTripper
+}
+
+// Wrapper is implemented by transports that wrap another, such as the
+// fixture recorder, so that Accounts applies an account's Options to the
+// transport inside.
+type Wrapper interface {
+	// Unwrap returns the wrapped transport.
+	Unwrap() http.RoundTripper
+	// Rewrap returns a transport wrapping t the same way.
+	Rewrap(t http.RoundTripper) http.RoundTripper
+}
+
+// Local is implemented by transports answering in process, such as the
+// mock upstream, which no Options apply to.
+type Local interface {
+	Local()
+}
+
+// Client returns the client to reach the upstream of account id with:
+// base itself for zero Options, otherwise a copy of base whose transport,
+// a clone of base's, applies opts. Wrappers around base's transport are
+// kept around the clone, and a Local transport is used as it is; any other
+// transport that is not an *http.Transport cannot apply opts and is an
+// error. The transport is built once and replaced when opts change or, as
+// noticed within a minute, CAFile is modified.
+func (c *Accounts) Client(base *http.Client, id int64, opts Options) (*http.Client, error) {
+	if opts == (Options{}) {
+		c.Remove(id)
+		return base, nil
+	}
+	bt := base.Transport
+	if bt == nil {
+		bt = http.DefaultTransport
+	}
+	var wrappers []Wrapper
+	inner := bt
+	for {
+		w, ok := inner.(Wrapper)
+		if !ok {
+			break
+		}
+		wrappers = append(wrappers, w)
+		if inner = w.Unwrap(); inner == nil {
+			inner = http.DefaultTransport
+		}
+	}
+	if _, ok := inner.(Local); ok {
+		return base, nil
+	}
+	ht, ok := inner.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("account %d: outbound settings cannot be applied to a %T transport", id, inner)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at := c.m[id]
+	stale := at == nil || at.base != bt || at.opts != opts
+	var caTime, checked time.Time
+	if !stale {
+		caTime, checked = at.caTime, at.checked
+	}
+	if opts.CAFile != "" && (stale || time.Since(checked) >= caCheckInterval) {
+		caTime, checked = time.Time{}, time.Now()
+		if fi, err := os.Stat(opts.CAFile); err == nil {
+			caTime = fi.ModTime()
+		}
+		if at != nil {
+			at.checked = checked
+		}
+	}
+	if stale || !at.caTime.Equal(caTime) {
+		t, err := build(ht, opts)
+		if err != nil {
+			return nil, fmt.Errorf("account %d: %w", id, err)
+		}
+		if opts.InsecureSkipVerify {
+			logger.Warnf("account %d: upstream TLS certificates are not verified", id)
+		}
+		if at != nil {
+			at.t.CloseIdleConnections()
+		}
+		at = &accountTransport{base: bt, opts: opts, caTime: caTime, checked: checked, t: t, rt: t}
+		for i := len(wrappers) - 1; i >= 0; i-- {
+			at.rt = wrappers[i].Rewrap(at.rt)
+		}
+		if c.m == nil {
+			c.m = make(map[int64]*accountTransport)
+		}
+		c.m[id] = at
+	}
+	client := *base
+	client.Transport = at.rt
+	return &client, nil
+}
+
+// Remove drops the transport of account id, closing its idle connections.
+func (c *Accounts) Remove(id int64) {
+	c.mu.Lock()
+	at := c.m[id]
+	delete(c.m, id)
+	c.mu.Unlock()
+	if at != nil {
+		at.t.CloseIdleConnections()
+	}
+}
+
+// Subscribe removes the transport of an account when the admin UI updates
+// or deletes it, so a deleted account's connections are closed and an
+// updated one reads its CAFile again on its next request. The subscription
+// is synchronous, as a dropped event would keep the transport. It returns
+// the function cancelling the subscription.
+func (c *Accounts) Subscribe(bus *events.Bus) func() {
+	return bus.SubscribeSync(func(e events.Event) {
+		if e.AccountID != 0 && (e.Message == "account.updated" || e.Message == "account.deleted") {
+			c.Remove(e.AccountID)
+		}
+	}, events.ConfigChanged)
+}
+
+// build returns a clone of base applying opts.
+func build(base *http.Transport, opts Options) (*http.Transport, error) {
+	t := base.Clone()
+	if opts.ProxyURL != "" {
+		u, err := ParseProxy(opts.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if opts.CAFile == "" && !opts.InsecureSkipVerify {
+		return t, nil
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	if opts.CAFile != "" {
+		pool, err := LoadCA(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	t.TLSClientConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+	return t, nil
+}
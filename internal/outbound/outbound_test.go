@@ -0,0 +1,246 @@
+package outbound
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+)
+
+func TestTransport(t *testing.T) {
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+	tr, err := Transport(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Get("http://upstream.invalid/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got != "http://upstream.invalid/v1/models" || string(b) != "via proxy" {
+		t.Fatalf("proxy saw %q and answered %q", got, b)
+	}
+
+	if tr, err := Transport(""); err != nil || tr.Proxy == nil {
+		t.Fatalf("environment proxy not kept: %v", err)
+	}
+	for _, bad := range []string{"ftp://proxy:21", "socks5://", "://"} {
+		if _, err := Transport(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	var via []string
+	proxy := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			via = append(via, name)
+		}))
+	}
+	p1, p2 := proxy("p1"), proxy("p2")
+	defer p1.Close()
+	defer p2.Close()
+	base := &http.Client{Transport: &http.Transport{}}
+	var c Accounts
+	get := func(id int64, proxyURL string) *http.Client {
+		t.Helper()
+		client, err := c.Client(base, id, Options{ProxyURL: proxyURL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get("http://upstream.invalid/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return client
+	}
+
+	first := get(1, p1.URL)
+	if again := get(1, p1.URL); again.Transport != first.Transport {
+		t.Error("account transport rebuilt")
+	}
+	if other := get(2, p1.URL); other.Transport == first.Transport {
+		t.Error("accounts share a transport")
+	}
+	if changed := get(1, p2.URL); changed.Transport == first.Transport {
+		t.Error("transport kept after the proxy changed")
+	}
+	if len(via) != 4 || via[0] != "p1" || via[2] != "p1" || via[3] != "p2" {
+		t.Fatalf("requests went through %v", via)
+	}
+	if client, _ := c.Client(base, 3, Options{}); client != base {
+		t.Error("account without a proxy got its own client")
+	}
+	if _, err := c.Client(base, 3, Options{ProxyURL: "ftp://proxy:21"}); err == nil {
+		t.Error("bad proxy accepted")
+	}
+}
+
+func TestAccountsRemove(t *testing.T) {
+	base := &http.Client{Transport: &http.Transport{}}
+	var c Accounts
+	opts := Options{ProxyURL: "http://proxy.invalid:8080"}
+	get := func(id int64, opts Options) http.RoundTripper {
+		t.Helper()
+		client, err := c.Client(base, id, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.Transport
+	}
+	cached := func(id int64) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.m[id] != nil
+	}
+
+	bus := events.NewBus()
+	defer c.Subscribe(bus)()
+	first := get(1, opts)
+	get(2, opts)
+	bus.Publish(events.Event{Type: events.ConfigChanged, AccountID: 1, Message: "account.deleted"})
+	bus.Publish(events.Event{Type: events.ConfigChanged, AccountID: 2, Message: "account.capabilities"})
+	if cached(1) || !cached(2) {
+		t.Fatalf("cached after the events: 1 %v, 2 %v", cached(1), cached(2))
+	}
+	if get(1, opts) == first {
+		t.Error("transport of a deleted account reused")
+	}
+	bus.Publish(events.Event{Type: events.ConfigChanged, AccountID: 2, Message: "account.updated"})
+	if cached(2) {
+		t.Error("transport of an updated account kept")
+	}
+	get(1, Options{})
+	if cached(1) {
+		t.Error("transport kept after the account's options were cleared")
+	}
+}
+
+func TestAccountTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	base := &http.Client{}
+	var c Accounts
+	for _, tc := range []struct {
+		opts Options
+		ok   bool
+	}{
+		{Options{}, false},
+		{Options{CAFile: ca}, true},
+		{Options{InsecureSkipVerify: true}, true},
+	} {
+		client, err := c.Client(base, 1, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v: %v", tc.opts, err)
+		}
+	}
+	if base.Transport != nil {
+		t.Error("base transport changed")
+	}
+	// A modified bundle is read again once it is due for a check, not on
+	// every request.
+	if _, err := c.Client(base, 1, Options{CAFile: ca}); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(ca, []byte("rotated"), 0o600)
+	os.Chtimes(ca, time.Now(), time.Now().Add(time.Hour))
+	if _, err := c.Client(base, 1, Options{CAFile: ca}); err != nil {
+		t.Errorf("bundle checked before it was due: %v", err)
+	}
+	defer func(d time.Duration) { caCheckInterval = d }(caCheckInterval)
+	caCheckInterval = 0
+	if _, err := c.Client(base, 1, Options{CAFile: ca}); err == nil {
+		t.Error("modified bundle not read again")
+	}
+	if _, err := c.Client(base, 1, Options{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("missing CA bundle accepted")
+	}
+	if _, err := LoadCA(ca); err == nil {
+		t.Error("bundle without certificates accepted")
+	}
+}
+
+// counting is a Wrapper counting the requests it forwards.
+type counting struct {
+	next http.RoundTripper
+	n    *int
+}
+
+func (c *counting) RoundTrip(r *http.Request) (*http.Response, error) {
+	*c.n++
+	return c.next.RoundTrip(r)
+}
+
+func (c *counting) Unwrap() http.RoundTripper { return c.next }
+
+func (c *counting) Rewrap(t http.RoundTripper) http.RoundTripper {
+	return &counting{next: t, n: c.n}
+}
+
+type local struct{ http.RoundTripper }
+
+func (local) Local() {}
+
+func TestAccountsWrappedTransport(t *testing.T) {
+	var proxied int
+	p := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+	}))
+	defer p.Close()
+	var forwarded int
+	base := &http.Client{Transport: &counting{next: &http.Transport{}, n: &forwarded}}
+	var c Accounts
+	client, err := c.Client(base, 1, Options{ProxyURL: p.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://upstream.invalid/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// The request went through the wrapper and the account's proxy.
+	if forwarded != 1 || proxied != 1 {
+		t.Fatalf("forwarded %d, proxied %d", forwarded, proxied)
+	}
+	if again, _ := c.Client(base, 1, Options{ProxyURL: p.URL}); again.Transport != client.Transport {
+		t.Error("wrapped transport rebuilt")
+	}
+
+	// Transports that cannot apply the options fail rather than ignoring
+	// them, unless they answer in process.
+	other := &http.Client{Transport: &counting{next: http.NewFileTransport(http.Dir(".")), n: &forwarded}}
+	if _, err := c.Client(other, 2, Options{ProxyURL: p.URL}); err == nil {
+		t.Error("options ignored for an unknown transport")
+	}
+	mock := &http.Client{Transport: local{http.NewFileTransport(http.Dir("."))}}
+	if client, err := c.Client(mock, 2, Options{ProxyURL: p.URL}); err != nil || client != mock {
+		t.Errorf("local transport not used as it is: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Package portal serves a self-service page for proxy clients. A client
+// authenticates with the same bearer token it uses for API calls and sees only
+// the usage and request history recorded for that key, plus an anonymous
+// summary of the account pool's remaining capacity. Account names, secrets,
+// request bodies and other clients' data are never returned.
+package portal
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/quota"
+	logpkg "github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/proxy"
+)
+
+//go:embed static/*
+var staticFiles embed.FS
+
+// Portal bundles the components the portal reads from. Quota may be nil.
+type Portal struct {
+	Accounts *account.Manager
+	Logs     logpkg.Storage
+	Quota    *quota.Poller
+	// Days is how many days of usage are reported (default 7).
+	Days int
+	// Recent is how many recent requests are listed (default 20).
+	Recent int
+}
+
+// Request is the client-visible part of a logged attempt.
+type Request struct {
+	Time         time.Time `json:"time"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Model        string    `json:"model"`
+	Status       int       `json:"status"`
+	DurationMs   int64     `json:"duration_ms"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+}
+
+// Capacity summarizes the account pool without identifying accounts.
+type Capacity struct {
+	Accounts  int `json:"accounts"`
+	Available int `json:"available"`
+	// PrimaryRemaining and SecondaryRemaining average the remaining
+	// percentage of the ChatGPT accounts' short and weekly windows; they are
+	// omitted without quota snapshots.
+	PrimaryRemaining   *float64 `json:"primary_remaining,omitempty"`
+	SecondaryRemaining *float64 `json:"secondary_remaining,omitempty"`
+}
+
+// Me is the payload of GET /portal/api/me.
+type Me struct {
+	ClientKey string         `json:"client_key"`
+	Usage     []logpkg.Usage `json:"usage"`
+	Requests  []Request      `json:"requests"`
+	Capacity  Capacity       `json:"capacity"`
+}
+
+// Handler returns the handler to mount at /portal/.
+func (p *Portal) Handler() http.Handler {
+	mux := http.NewServeMux()
+	fsys, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		logger.Errorf("load portal files: %v", err)
+	}
+	mux.Handle("/", http.FileServer(http.FS(fsys)))
+	mux.HandleFunc("/api/me", p.me)
+	return http.StripPrefix("/portal", mux)
+}
+
+func (p *Portal) me(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	key := proxy.ClientKeyFrom(r)
+	if key == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing client key", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	days, recent := p.Days, p.Recent
+	if days <= 0 {
+		days = 7
+	}
+	if recent <= 0 {
+		recent = 20
+	}
+	res := Me{ClientKey: key, Usage: []logpkg.Usage{}, Requests: []Request{}}
+
+	until := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	usage, err := p.Logs.Usage(ctx, until.AddDate(0, 0, -days), until)
+	if err != nil {
+		http.Error(w, "usage unavailable", http.StatusInternalServerError)
+		return
+	}
+	for _, u := range usage {
+		if u.ClientKey == key {
+			res.Usage = append(res.Usage, u)
+		}
+	}
+	logs, err := p.Logs.ClientRequests(ctx, key, recent)
+	if err != nil {
+		http.Error(w, "requests unavailable", http.StatusInternalServerError)
+		return
+	}
+	for _, l := range logs {
+		// Only the path: the upstream host may be an account's own base URL.
+		path := l.URL
+		if u, err := url.Parse(l.URL); err == nil {
+			path = u.Path
+		}
+		res.Requests = append(res.Requests, Request{l.Time, l.Method, path, l.Model, l.Status, l.DurationMs, l.InputTokens, l.OutputTokens})
+	}
+	if res.Capacity, err = p.capacity(r); err != nil {
+		http.Error(w, "capacity unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logger.Errorf("encode portal response failed: %v", err)
+	}
+}
+
+func (p *Portal) capacity(r *http.Request) (Capacity, error) {
+	var c Capacity
+	accounts, err := p.Accounts.List(r.Context())
+	if err != nil {
+		logger.Errorf("list accounts for portal: %v", err)
+		return c, err
+	}
+	now := time.Now()
+	ids := make(map[int64]bool)
+	for _, a := range accounts {
+		ids[a.ID] = true
+		c.Accounts++
+		if a.Available(now) {
+			c.Available++
+		}
+	}
+	if p.Quota == nil {
+		return c, nil
+	}
+	all, err := p.Quota.Latest(r.Context())
+	if err != nil {
+		return c, err
+	}
+	var latest []quota.Snapshot
+	for _, s := range all {
+		if ids[s.AccountID] {
+			latest = append(latest, s)
+		}
+	}
+	c.PrimaryRemaining = averageRemaining(latest, func(s quota.Snapshot) *quota.Window { return s.Primary })
+	c.SecondaryRemaining = averageRemaining(latest, func(s quota.Snapshot) *quota.Window { return s.Secondary })
+	return c, nil
+}
+
+func averageRemaining(snaps []quota.Snapshot, window func(quota.Snapshot) *quota.Window) *float64 {
+	var sum float64
+	n := 0
+	for _, s := range snaps {
+		if w := window(s); w != nil {
+			sum += 100 - w.UsedPercent
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	avg := sum / float64(n)
+	return &avg
+}
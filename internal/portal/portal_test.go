@@ -0,0 +1,72 @@
+package portal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	logpkg "github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/proxy"
+)
+
+func setupPortal(t *testing.T) (*account.Manager, *logpkg.MemoryStore, http.Handler) {
+	t.Helper()
+	mgr, ls := account.NewManagerWithStorage(account.NewMemoryStore()), logpkg.NewMemoryStore(100)
+	return mgr, ls, (&Portal{Accounts: mgr, Logs: ls}).Handler()
+}
+
+func TestMe(t *testing.T) {
+	mgr, ls, h := setupPortal(t)
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "secret-account", "sk-upstream", "https://private.example/v1", 1)
+	b, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	mgr.MarkExhausted(ctx, b.ID, time.Now().Add(time.Hour))
+	mine, other := proxy.ClientKeyID("mine"), proxy.ClientKeyID("other")
+	now := time.Now()
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Method: "POST", URL: "https://private.example/v1/responses", Status: 200, ClientKey: mine, Model: "gpt-5", InputTokens: 5, OutputTokens: 2, ReqBody: "prompt", Error: ""})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Method: "POST", URL: "https://private.example/v1/responses", Status: 500, ClientKey: mine, Error: "org-123 failed"})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Method: "POST", URL: "u", Status: 200, ClientKey: other, InputTokens: 99})
+
+	req := httptest.NewRequest(http.MethodGet, "/portal/api/me", nil)
+	req.Header.Set("Authorization", "Bearer mine")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	for _, leak := range []string{"private.example", "secret-account", "sk-upstream", "org-123", "prompt", other} {
+		if strings.Contains(body, leak) {
+			t.Fatalf("response leaks %q: %s", leak, body)
+		}
+	}
+	var me Me
+	if err := json.Unmarshal([]byte(body), &me); err != nil {
+		t.Fatal(err)
+	}
+	if me.ClientKey != mine || len(me.Usage) != 1 || me.Usage[0].Requests != 1 || me.Usage[0].InputTokens != 5 {
+		t.Fatalf("unexpected usage %+v", me)
+	}
+	if len(me.Requests) != 2 || me.Requests[0].Status != 500 || me.Requests[1].Path != "/v1/responses" || me.Requests[1].Model != "gpt-5" {
+		t.Fatalf("unexpected requests %+v", me.Requests)
+	}
+	if me.Capacity.Accounts != 2 || me.Capacity.Available != 1 || me.Capacity.PrimaryRemaining != nil {
+		t.Fatalf("unexpected capacity %+v", me.Capacity)
+	}
+}
+
+func TestMeRequiresKey(t *testing.T) {
+	_, _, h := setupPortal(t)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/portal/api/me", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/portal/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "My Usage") {
+		t.Fatalf("index status %d", rec.Code)
+	}
+}
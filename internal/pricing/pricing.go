@@ -0,0 +1,95 @@
+// Package pricing converts token counts into list-price costs so usage can
+// be compared across models. Costs are estimates: ChatGPT-login accounts are
+// not billed per token, and upstream prices change.
+package pricing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Price is the cost in USD per million tokens.
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// Table maps model names to prices. A model without an exact entry uses the
+// longest entry that is a prefix of its name, so "gpt-5-2025-08-07" is
+// priced as "gpt-5".
+type Table map[string]Price
+
+// Default holds the public list prices of common Codex models.
+var Default = Table{
+	"gpt-5":        {1.25, 10},
+	"gpt-5-codex":  {1.25, 10},
+	"gpt-5-mini":   {0.25, 2},
+	"gpt-5-nano":   {0.05, 0.4},
+	"gpt-4.1":      {2, 8},
+	"gpt-4.1-mini": {0.4, 1.6},
+	"gpt-4.1-nano": {0.1, 0.4},
+	"gpt-4o":       {2.5, 10},
+	"gpt-4o-mini":  {0.15, 0.6},
+	"o3":           {2, 8},
+	"o4-mini":      {1.1, 4.4},
+	"codex-mini":   {1.5, 6},
+}
+
+// Parse reads a comma-separated list of model=input/output prices, such as
+// "gpt-5=1.25/10,my-model=0/0", and returns Default with those entries added
+// or replaced.
+func Parse(s string) (Table, error) {
+	t := make(Table, len(Default))
+	for m, p := range Default {
+		t[m] = p
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, prices, ok := strings.Cut(entry, "=")
+		in, out, ok2 := strings.Cut(prices, "/")
+		if !ok || !ok2 || model == "" {
+			return nil, fmt.Errorf("invalid price %q, expected model=input/output", entry)
+		}
+		var p Price
+		var err error
+		if p.Input, err = strconv.ParseFloat(in, 64); err != nil || p.Input < 0 {
+			return nil, fmt.Errorf("invalid input price in %q", entry)
+		}
+		if p.Output, err = strconv.ParseFloat(out, 64); err != nil || p.Output < 0 {
+			return nil, fmt.Errorf("invalid output price in %q", entry)
+		}
+		t[strings.TrimSpace(model)] = p
+	}
+	return t, nil
+}
+
+// Lookup returns the price of model.
+func (t Table) Lookup(model string) (Price, bool) {
+	if p, ok := t[model]; ok {
+		return p, true
+	}
+	best := ""
+	for m := range t {
+		if strings.HasPrefix(model, m) && len(m) > len(best) {
+			best = m
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return t[best], true
+}
+
+// Cost returns the USD cost of the given token counts, or 0 for models
+// without a price.
+func (t Table) Cost(model string, input, output int64) float64 {
+	p, ok := t.Lookup(model)
+	if !ok {
+		return 0
+	}
+	return (float64(input)*p.Input + float64(output)*p.Output) / 1e6
+}
@@ -0,0 +1,44 @@
+package pricing
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	cases := map[string]Price{
+		"gpt-5":                 {1.25, 10},
+		"gpt-5-2025-08-07":      {1.25, 10},
+		"gpt-5-mini-2025-08-07": {0.25, 2},
+		"o4-mini":               {1.1, 4.4},
+	}
+	for model, want := range cases {
+		if got, ok := Default.Lookup(model); !ok || got != want {
+			t.Fatalf("%s: got %v %v, want %v", model, got, ok, want)
+		}
+	}
+	if _, ok := Default.Lookup("llama"); ok {
+		t.Fatalf("unknown model priced")
+	}
+}
+
+func TestParseAndCost(t *testing.T) {
+	tbl, err := Parse("gpt-5=2/20, local=0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tbl.Cost("gpt-5", 1_000_000, 500_000); math.Abs(got-12) > 1e-9 {
+		t.Fatalf("cost %v, want 12", got)
+	}
+	if got := tbl.Cost("gpt-5-mini", 1_000_000, 0); got != 0.25 {
+		t.Fatalf("default entry lost: %v", got)
+	}
+	if Default["gpt-5"].Input != 1.25 {
+		t.Fatalf("Parse modified Default")
+	}
+	for _, bad := range []string{"gpt-5", "gpt-5=1", "gpt-5=a/1", "=1/1", "x=-1/1"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Package profiles keeps named priority profiles: snapshots of every
+// account's priority and weight that can be activated manually or on a cron
+// schedule, switching the routing strategy (e.g. "weekday", "weekend",
+// "crunch-mode") without editing each account.
+package profiles
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Entry is the routing of one account in a profile.
+type Entry struct {
+	AccountID int64   `json:"account_id"`
+	Priority  int     `json:"priority"`
+	Weight    float64 `json:"weight"`
+}
+
+// Profile is a named set of account priorities and weights. Schedule, a
+// cron expression, activates it automatically; empty means manual only.
+type Profile struct {
+	Name      string    `json:"name"`
+	Schedule  string    `json:"schedule"`
+	Entries   []Entry   `json:"entries"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Triggers of an activation.
+const (
+	TriggerManual   = "manual"
+	TriggerSchedule = "schedule"
+)
+
+var (
+	// ErrNotFound is returned for unknown profiles.
+	ErrNotFound = errors.New("profile not found")
+	// ErrInvalid wraps the errors of invalid names and schedules.
+	ErrInvalid = errors.New("invalid profile")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Store keeps profiles in the priority_profiles table and applies them to
+// the accounts of a Manager.
+type Store struct {
+	db       *sql.DB
+	accounts *account.Manager
+	// Bus receives a config.changed event for every activation.
+	Bus *events.Bus
+
+	mu sync.Mutex
+	// fired is the minute scheduled activations last ran for.
+	fired time.Time
+}
+
+// New creates a Store and ensures its tables exist.
+func New(db *sql.DB, am *account.Manager) (*Store, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS priority_profiles (
+        name TEXT PRIMARY KEY,
+        schedule TEXT NOT NULL DEFAULT '',
+        entries TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL
+    )`); err != nil {
+		logger.Errorf("create priority_profiles table failed: %v", err)
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS priority_profile_state (
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        active TEXT NOT NULL,
+        trigger TEXT NOT NULL,
+        activated_at INTEGER NOT NULL
+    )`); err != nil {
+		logger.Errorf("create priority_profile_state table failed: %v", err)
+		return nil, err
+	}
+	return &Store{db: db, accounts: am}, nil
+}
+
+// validate checks the name and schedule of p.
+func validate(p *Profile) error {
+	if !validName.MatchString(p.Name) {
+		return fmt.Errorf("%w: name %q", ErrInvalid, p.Name)
+	}
+	if p.Schedule != "" {
+		if _, err := ParseSchedule(p.Schedule); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	return nil
+}
+
+// Snapshot saves the current priority and weight of every account as the
+// profile name, replacing a profile of that name but keeping its schedule
+// when schedule is nil.
+func (s *Store) Snapshot(ctx context.Context, name string, schedule *string) (*Profile, error) {
+	accounts, err := s.accounts.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := &Profile{Name: name, Entries: make([]Entry, 0, len(accounts))}
+	if old, err := s.Get(ctx, name); err == nil {
+		p.Schedule, p.CreatedAt = old.Schedule, old.CreatedAt
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if schedule != nil {
+		p.Schedule = *schedule
+	}
+	for _, a := range accounts {
+		p.Entries = append(p.Entries, Entry{AccountID: a.ID, Priority: a.Priority, Weight: a.Weight})
+	}
+	if err := s.Save(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Save creates or replaces p.
+func (s *Store) Save(ctx context.Context, p *Profile) error {
+	if err := validate(p); err != nil {
+		return err
+	}
+	if p.Entries == nil {
+		p.Entries = []Entry{}
+	}
+	entries, err := json.Marshal(p.Entries)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = now
+	}
+	p.UpdatedAt = now
+	_, err = s.db.ExecContext(ctx, `INSERT INTO priority_profiles(name, schedule, entries, created_at, updated_at) VALUES(?, ?, ?, ?, ?)
+        ON CONFLICT(name) DO UPDATE SET schedule=excluded.schedule, entries=excluded.entries, updated_at=excluded.updated_at`,
+		p.Name, p.Schedule, string(entries), p.CreatedAt.UnixMilli(), p.UpdatedAt.UnixMilli())
+	if err != nil {
+		logger.Errorf("save profile %s failed: %v", p.Name, err)
+		dbhealth.RecordWriteError("priority_profiles")
+	}
+	return err
+}
+
+// Delete removes the profile name.
+func (s *Store) Delete(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM priority_profiles WHERE name=?`, name)
+	if err != nil {
+		logger.Errorf("delete profile %s failed: %v", name, err)
+		dbhealth.RecordWriteError("priority_profiles")
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List returns every profile ordered by name.
+func (s *Store) List(ctx context.Context) ([]Profile, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, schedule, entries, created_at, updated_at FROM priority_profiles ORDER BY name`)
+	if err != nil {
+		logger.Errorf("list profiles failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Profile{}
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *p)
+	}
+	return res, rows.Err()
+}
+
+// Get returns the profile name or ErrNotFound.
+func (s *Store) Get(ctx context.Context, name string) (*Profile, error) {
+	p, err := scanProfile(s.db.QueryRowContext(ctx, `SELECT name, schedule, entries, created_at, updated_at FROM priority_profiles WHERE name=?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProfile(row scanner) (*Profile, error) {
+	var p Profile
+	var entries string
+	var created, updated int64
+	if err := row.Scan(&p.Name, &p.Schedule, &entries, &created, &updated); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Errorf("scan profile failed: %v", err)
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(entries), &p.Entries); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	p.CreatedAt, p.UpdatedAt = time.UnixMilli(created), time.UnixMilli(updated)
+	return &p, nil
+}
+
+// Active is the last activated profile.
+type Active struct {
+	Name        string    `json:"name"`
+	Trigger     string    `json:"trigger"`
+	ActivatedAt time.Time `json:"activated_at"`
+}
+
+// Active returns the last activated profile, or nil when none was.
+func (s *Store) Active(ctx context.Context) (*Active, error) {
+	var a Active
+	var at int64
+	err := s.db.QueryRowContext(ctx, `SELECT active, trigger, activated_at FROM priority_profile_state WHERE id=1`).Scan(&a.Name, &a.Trigger, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("query active profile failed: %v", err)
+		return nil, err
+	}
+	a.ActivatedAt = time.UnixMilli(at)
+	return &a, nil
+}
+
+// Activate applies the profile name to the accounts. Accounts added after
+// the profile was saved keep their routing; entries of deleted accounts
+// are skipped.
+func (s *Store) Activate(ctx context.Context, name, trigger string) error {
+	p, err := s.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	accounts, err := s.accounts.List(ctx)
+	if err != nil {
+		return err
+	}
+	exists := make(map[int64]bool, len(accounts))
+	for _, a := range accounts {
+		exists[a.ID] = true
+	}
+	for _, e := range p.Entries {
+		if !exists[e.AccountID] {
+			continue
+		}
+		if err := s.accounts.SetRouting(ctx, e.AccountID, e.Priority, e.Weight); err != nil {
+			return err
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO priority_profile_state(id, active, trigger, activated_at) VALUES(1, ?, ?, ?)`,
+		name, trigger, time.Now().UnixMilli()); err != nil {
+		logger.Errorf("record active profile failed: %v", err)
+		dbhealth.RecordWriteError("priority_profile_state")
+		return err
+	}
+	logger.Infof("priority profile %s activated (%s)", name, trigger)
+	if s.Bus != nil {
+		s.Bus.Publish(events.Event{Type: events.ConfigChanged, Message: "profile.activated", Data: map[string]any{"profile": name, "trigger": trigger}})
+	}
+	return nil
+}
+
+// Tick activates the profiles whose schedule matches the minute of now, in
+// name order so the last one wins when several match. Each minute is
+// handled once.
+func (s *Store) Tick(ctx context.Context, now time.Time) {
+	minute := now.Truncate(time.Minute)
+	s.mu.Lock()
+	if !minute.After(s.fired) {
+		s.mu.Unlock()
+		return
+	}
+	s.fired = minute
+	s.mu.Unlock()
+	list, err := s.List(ctx)
+	if err != nil {
+		return
+	}
+	for _, p := range list {
+		if p.Schedule == "" {
+			continue
+		}
+		sched, err := ParseSchedule(p.Schedule)
+		if err != nil {
+			logger.Warnf("profile %s: %v", p.Name, err)
+			continue
+		}
+		if !sched.Matches(now) {
+			continue
+		}
+		if err := s.Activate(ctx, p.Name, TriggerSchedule); err != nil {
+			logger.Warnf("activate profile %s: %v", p.Name, err)
+		}
+	}
+}
+
+// Start runs Tick at the start of every minute until ctx is done.
+func (s *Store) Start(ctx context.Context) {
+	go func() {
+		for {
+			now := time.Now()
+			t := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case now := <-t.C:
+				s.Tick(ctx, now)
+			}
+		}
+	}()
+}
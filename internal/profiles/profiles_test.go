@@ -0,0 +1,157 @@
+package profiles
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func setupStore(t *testing.T) (*Store, *account.Manager) {
+	t.Helper()
+	am := account.NewManagerWithStorage(account.NewMemoryStore())
+	s, err := New(testdb.Open(t), am)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, am
+}
+
+func TestParseSchedule(t *testing.T) {
+	// 2026-10-16 is a Friday.
+	at := func(day, hour, minute int) time.Time { return time.Date(2026, 10, day, hour, minute, 30, 0, time.UTC) }
+	cases := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(16, 3, 7), true},
+		{"0 8 * * 1-5", at(16, 8, 0), true},
+		{"0 8 * * 1-5", at(17, 8, 0), false},
+		{"0 8 * * 1-5", at(16, 8, 1), false},
+		{"*/15 * * * *", at(16, 9, 45), true},
+		{"*/15 * * * *", at(16, 9, 46), false},
+		{"0-30/10 9,18 * * *", at(16, 18, 20), true},
+		{"0 0 * * 0", at(18, 0, 0), true},
+		{"0 0 * * 7", at(18, 0, 0), true},
+		{"0 0 * 10 *", at(16, 0, 0), true},
+		{"0 0 * 11 *", at(16, 0, 0), false},
+		// Day of month or day of week when both are restricted.
+		{"0 0 1 * 5", at(16, 0, 0), true},
+		{"0 0 1 * 6", at(16, 0, 0), false},
+		{"0 0 16 * *", at(16, 0, 0), true},
+	}
+	for _, c := range cases {
+		s, err := ParseSchedule(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		if got := s.Matches(c.t); got != c.want {
+			t.Fatalf("%s at %s: got %v", c.expr, c.t, got)
+		}
+	}
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSnapshotAndActivate(t *testing.T) {
+	s, am := setupStore(t)
+	bus := events.NewBus()
+	var got []events.Event
+	unsub := bus.Subscribe(func(e events.Event) { got = append(got, e) }, events.ConfigChanged)
+	s.Bus = bus
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "a", "k1", "", 1)
+	b, _ := am.AddAPIKey(ctx, "b", "k2", "", 2)
+
+	weekday := "0 8 * * 1-5"
+	if _, err := s.Snapshot(ctx, "weekday", &weekday); err != nil {
+		t.Fatal(err)
+	}
+	am.SetRouting(ctx, a.ID, 5, 0.5)
+	am.SetRouting(ctx, b.ID, 0, 3)
+	crunch, err := s.Snapshot(ctx, "crunch-mode", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crunch.Schedule != "" || len(crunch.Entries) != 2 || crunch.Entries[1] != (Entry{AccountID: a.ID, Priority: 5, Weight: 0.5}) {
+		t.Fatalf("unexpected snapshot %+v", crunch)
+	}
+	// Re-snapshotting without a schedule keeps the old one.
+	if p, err := s.Snapshot(ctx, "weekday", nil); err != nil || p.Schedule != weekday {
+		t.Fatalf("schedule not kept: %+v %v", p, err)
+	}
+	am.SetRouting(ctx, a.ID, 1, 1)
+	am.SetRouting(ctx, b.ID, 2, 1)
+	s.Snapshot(ctx, "weekday", nil)
+	c, _ := am.AddAPIKey(ctx, "c", "k3", "", 9)
+
+	if err := s.Activate(ctx, "crunch-mode", TriggerManual); err != nil {
+		t.Fatal(err)
+	}
+	ga, _ := am.Get(ctx, a.ID)
+	gb, _ := am.Get(ctx, b.ID)
+	gc, _ := am.Get(ctx, c.ID)
+	if ga.Priority != 5 || ga.Weight != 0.5 || gb.Priority != 0 || gb.Weight != 3 || gc.Priority != 9 || ga.APIKey != "k1" {
+		t.Fatalf("profile not applied: %+v %+v %+v", ga, gb, gc)
+	}
+	if active, _ := s.Active(ctx); active == nil || active.Name != "crunch-mode" || active.Trigger != TriggerManual {
+		t.Fatalf("unexpected active profile %+v", active)
+	}
+
+	if err := s.Activate(ctx, "missing", TriggerManual); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Snapshot(ctx, "bad name", nil); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+	bad := "every day"
+	if _, err := s.Snapshot(ctx, "x", &bad); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+	if err := s.Delete(ctx, "crunch-mode"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.List(ctx); len(list) != 1 || list[0].Name != "weekday" {
+		t.Fatalf("unexpected profiles %+v", list)
+	}
+	unsub()
+	if len(got) != 1 || got[0].Message != "profile.activated" || got[0].Data["trigger"] != TriggerManual {
+		t.Fatalf("unexpected events %+v", got)
+	}
+}
+
+func TestTick(t *testing.T) {
+	s, am := setupStore(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "a", "k1", "", 1)
+	weekend := "0 0 * * 6"
+	s.Snapshot(ctx, "weekend", &weekend)
+	am.SetRouting(ctx, a.ID, 4, 1)
+
+	sat := time.Date(2026, 10, 17, 0, 0, 5, 0, time.Local)
+	s.Tick(ctx, sat.Add(-time.Minute))
+	if got, _ := am.Get(ctx, a.ID); got.Priority != 4 {
+		t.Fatalf("profile activated early: priority %d", got.Priority)
+	}
+	s.Tick(ctx, sat)
+	if got, _ := am.Get(ctx, a.ID); got.Priority != 1 {
+		t.Fatalf("profile not activated: priority %d", got.Priority)
+	}
+	if active, _ := s.Active(ctx); active == nil || active.Trigger != TriggerSchedule {
+		t.Fatalf("unexpected active profile %+v", active)
+	}
+	// A minute is handled once, so a manual change made during it stays.
+	am.SetRouting(ctx, a.ID, 4, 1)
+	s.Tick(ctx, sat.Add(20*time.Second))
+	if got, _ := am.Get(ctx, a.ID); got.Priority != 4 {
+		t.Fatalf("profile activated twice in a minute: priority %d", got.Priority)
+	}
+}
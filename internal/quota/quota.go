@@ -0,0 +1,311 @@
+// Package quota periodically records the rate-limit status the Codex backend
+// reports for each ChatGPT account, so the admin UI can chart how quickly
+// accounts approach their limits.
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/auth"
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/outbound"
+)
+
+// Window is the usage of one rate-limit window.
+type Window struct {
+	UsedPercent   float64   `json:"used_percent"`
+	WindowMinutes int64     `json:"window_minutes"`
+	ResetAt       time.Time `json:"reset_at"`
+}
+
+// Snapshot is the rate-limit status of an account at one point in time.
+// Primary is the short (five hour) window and Secondary the weekly one;
+// either is nil when the backend did not report it.
+type Snapshot struct {
+	ID           int64     `json:"id"`
+	AccountID    int64     `json:"account_id"`
+	Time         time.Time `json:"time"`
+	PlanType     string    `json:"plan_type"`
+	LimitReached bool      `json:"limit_reached"`
+	Primary      *Window   `json:"primary,omitempty"`
+	Secondary    *Window   `json:"secondary,omitempty"`
+}
+
+// UsageURL derives the usage endpoint from the Codex backend base URL, e.g.
+// https://chatgpt.com/backend-api/codex becomes
+// https://chatgpt.com/backend-api/wham/usage.
+func UsageURL(chatgptUpstream string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(chatgptUpstream, "/"), "/codex")
+	return base + "/wham/usage"
+}
+
+// Poller fetches and stores quota snapshots.
+type Poller struct {
+	db  *sql.DB
+	mgr *account.Manager
+	// URL is the usage endpoint, see UsageURL.
+	URL    string
+	Client *http.Client
+	// Retention is how long snapshots are kept.
+	Retention time.Duration
+
+	now        func() time.Time
+	transports outbound.Accounts
+}
+
+// New creates a Poller querying url and ensures its table exists.
+func New(db *sql.DB, mgr *account.Manager, url string) (*Poller, error) {
+	p := &Poller{
+		db:        db,
+		mgr:       mgr,
+		URL:       url,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		Retention: 30 * 24 * time.Hour,
+		now:       time.Now,
+	}
+	if err := p.init(); err != nil {
+		logger.Errorf("init quota_snapshots table failed: %v", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Poller) init() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS quota_snapshots (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        account_id INTEGER NOT NULL,
+        time INTEGER NOT NULL,
+        plan_type TEXT NOT NULL DEFAULT '',
+        limit_reached INTEGER NOT NULL DEFAULT 0,
+        primary_used REAL,
+        primary_window INTEGER,
+        primary_reset INTEGER,
+        secondary_used REAL,
+        secondary_window INTEGER,
+        secondary_reset INTEGER
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`CREATE INDEX IF NOT EXISTS quota_snapshots_account ON quota_snapshots(account_id, time)`)
+	return err
+}
+
+// Subscribe drops the transport of an account updated or deleted on bus,
+// see outbound.Accounts.Subscribe. It returns the function cancelling the
+// subscription.
+func (p *Poller) Subscribe(bus *events.Bus) func() {
+	return p.transports.Subscribe(bus)
+}
+
+// Start polls immediately and then every interval until ctx is done.
+func (p *Poller) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			p.Poll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Poll stores a snapshot for every ChatGPT account, prunes snapshots older
+// than Retention and returns how many snapshots were stored. Failures are
+// logged and skip the account.
+func (p *Poller) Poll(ctx context.Context) int {
+	accounts, err := p.mgr.List(ctx)
+	if err != nil {
+		logger.Errorf("list accounts for quota poll: %v", err)
+		return 0
+	}
+	n := 0
+	for _, a := range accounts {
+		if a.Type != account.ChatGPTAccount {
+			continue
+		}
+		if _, err := p.PollAccount(ctx, a); err != nil {
+			logger.Warnf("quota poll for account %d: %v", a.ID, err)
+			continue
+		}
+		n++
+	}
+	cutoff := p.now().Add(-p.Retention).UnixMilli()
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM quota_snapshots WHERE time < ?`, cutoff); err != nil {
+		logger.Errorf("prune quota snapshots: %v", err)
+	}
+	return n
+}
+
+// usagePayload is the response of the usage endpoint.
+type usagePayload struct {
+	PlanType  string `json:"plan_type"`
+	RateLimit *struct {
+		LimitReached    bool           `json:"limit_reached"`
+		PrimaryWindow   *windowPayload `json:"primary_window"`
+		SecondaryWindow *windowPayload `json:"secondary_window"`
+	} `json:"rate_limit"`
+}
+
+type windowPayload struct {
+	UsedPercent        float64 `json:"used_percent"`
+	LimitWindowSeconds int64   `json:"limit_window_seconds"`
+	ResetAfterSeconds  int64   `json:"reset_after_seconds"`
+	ResetAt            int64   `json:"reset_at"`
+}
+
+func (w *windowPayload) window(now time.Time) *Window {
+	if w == nil {
+		return nil
+	}
+	res := &Window{UsedPercent: w.UsedPercent, WindowMinutes: w.LimitWindowSeconds / 60}
+	switch {
+	case w.ResetAt > 0:
+		res.ResetAt = time.Unix(w.ResetAt, 0)
+	case w.ResetAfterSeconds > 0:
+		res.ResetAt = now.Add(time.Duration(w.ResetAfterSeconds) * time.Second)
+	}
+	return res
+}
+
+// PollAccount fetches and stores the current snapshot of a ChatGPT account,
+// refreshing its access token first when due.
+func (p *Poller) PollAccount(ctx context.Context, a *account.Account) (*Snapshot, error) {
+	if err := auth.Refresh(auth.WithTrigger(ctx, auth.TriggerQuota), p.mgr, a); err != nil {
+		return nil, fmt.Errorf("refresh token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.AccessToken)
+	if a.AccountID != "" {
+		req.Header.Set("chatgpt-account-id", a.AccountID)
+	}
+	// The usage endpoint sees the account's own proxy, like its upstream.
+	client, err := p.transports.Client(p.Client, a.ID, outbound.Options{ProxyURL: a.ProxyURL})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var payload usagePayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("decode usage: %w", err)
+	}
+	now := p.now()
+	s := &Snapshot{AccountID: a.ID, Time: now, PlanType: payload.PlanType}
+	if rl := payload.RateLimit; rl != nil {
+		s.LimitReached = rl.LimitReached
+		s.Primary = rl.PrimaryWindow.window(now)
+		s.Secondary = rl.SecondaryWindow.window(now)
+	}
+	if err := p.insert(ctx, s); err != nil {
+		return nil, err
+	}
+	logger.Debugf("quota snapshot for account %d stored", a.ID)
+	return s, nil
+}
+
+func windowArgs(w *Window) []any {
+	if w == nil {
+		return []any{nil, nil, nil}
+	}
+	var reset any
+	if !w.ResetAt.IsZero() {
+		reset = w.ResetAt.UnixMilli()
+	}
+	return []any{w.UsedPercent, w.WindowMinutes, reset}
+}
+
+func (p *Poller) insert(ctx context.Context, s *Snapshot) error {
+	args := []any{s.AccountID, s.Time.UnixMilli(), s.PlanType, s.LimitReached}
+	args = append(args, windowArgs(s.Primary)...)
+	args = append(args, windowArgs(s.Secondary)...)
+	res, err := p.db.ExecContext(ctx, `INSERT INTO quota_snapshots(account_id, time, plan_type, limit_reached, primary_used, primary_window, primary_reset, secondary_used, secondary_window, secondary_reset) VALUES(?,?,?,?,?,?,?,?,?,?)`, args...)
+	if err != nil {
+		logger.Errorf("insert quota snapshot failed: %v", err)
+		dbhealth.RecordWriteError("quota_snapshots")
+		return err
+	}
+	s.ID, _ = res.LastInsertId()
+	return nil
+}
+
+const columns = `id, account_id, time, plan_type, limit_reached, primary_used, primary_window, primary_reset, secondary_used, secondary_window, secondary_reset`
+
+// History returns the snapshots of an account taken at or after since,
+// oldest first.
+func (p *Poller) History(ctx context.Context, accountID int64, since time.Time) ([]Snapshot, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+columns+` FROM quota_snapshots WHERE account_id=? AND time>=? ORDER BY time`, accountID, since.UnixMilli())
+	if err != nil {
+		logger.Errorf("query quota history failed: %v", err)
+		return nil, err
+	}
+	return scanSnapshots(rows)
+}
+
+// Latest returns the most recent snapshot of every account that has one.
+func (p *Poller) Latest(ctx context.Context) ([]Snapshot, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+columns+` FROM quota_snapshots WHERE id IN (SELECT MAX(id) FROM quota_snapshots GROUP BY account_id) ORDER BY account_id`)
+	if err != nil {
+		logger.Errorf("query latest quota failed: %v", err)
+		return nil, err
+	}
+	return scanSnapshots(rows)
+}
+
+func scanSnapshots(rows *sql.Rows) ([]Snapshot, error) {
+	defer rows.Close()
+	res := []Snapshot{}
+	for rows.Next() {
+		var s Snapshot
+		var t int64
+		var pUsed, sUsed sql.NullFloat64
+		var pWin, pReset, sWin, sReset sql.NullInt64
+		if err := rows.Scan(&s.ID, &s.AccountID, &t, &s.PlanType, &s.LimitReached, &pUsed, &pWin, &pReset, &sUsed, &sWin, &sReset); err != nil {
+			logger.Errorf("scan quota snapshot failed: %v", err)
+			return nil, err
+		}
+		s.Time = time.UnixMilli(t)
+		s.Primary = scanWindow(pUsed, pWin, pReset)
+		s.Secondary = scanWindow(sUsed, sWin, sReset)
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+func scanWindow(used sql.NullFloat64, win, reset sql.NullInt64) *Window {
+	if !used.Valid {
+		return nil
+	}
+	w := &Window{UsedPercent: used.Float64, WindowMinutes: win.Int64}
+	if reset.Valid {
+		w.ResetAt = time.UnixMilli(reset.Int64)
+	}
+	return w
+}
@@ -0,0 +1,104 @@
+package quota
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func setupPoller(t *testing.T, h http.HandlerFunc) (*Poller, *account.Manager) {
+	t.Helper()
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	p, err := New(testdb.Open(t), mgr, srv.URL+"/wham/usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, mgr
+}
+
+func addChatGPT(t *testing.T, mgr *account.Manager, name, token string) *account.Account {
+	t.Helper()
+	ctx := context.Background()
+	a, err := mgr.AddChatGPT(ctx, name, "rt-"+name, "acct-"+name, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AccessToken = token
+	a.TokenExpiresAt = time.Now().Add(time.Hour)
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestUsageURL(t *testing.T) {
+	if got := UsageURL("https://chatgpt.com/backend-api/codex/"); got != "https://chatgpt.com/backend-api/wham/usage" {
+		t.Fatalf("unexpected url %s", got)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	p, mgr := setupPoller(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			if r.Header.Get("chatgpt-account-id") != "acct-a" {
+				t.Errorf("missing account id header")
+			}
+			io.WriteString(w, `{"plan_type":"plus","rate_limit":{"limit_reached":false,
+				"primary_window":{"used_percent":42.5,"limit_window_seconds":18000,"reset_at":1900000000},
+				"secondary_window":{"used_percent":10,"limit_window_seconds":604800,"reset_after_seconds":60}}}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	ctx := context.Background()
+	a := addChatGPT(t, mgr, "a", "good")
+	addChatGPT(t, mgr, "b", "bad")
+	mgr.AddAPIKey(ctx, "key", "k", "", 1)
+
+	if n := p.Poll(ctx); n != 1 {
+		t.Fatalf("stored %d snapshots, want 1", n)
+	}
+	hist, err := p.History(ctx, a.ID, time.Now().Add(-time.Hour))
+	if err != nil || len(hist) != 1 {
+		t.Fatalf("history: %v %+v", err, hist)
+	}
+	s := hist[0]
+	if s.PlanType != "plus" || s.Primary == nil || s.Primary.UsedPercent != 42.5 || s.Primary.WindowMinutes != 300 || s.Primary.ResetAt.Unix() != 1900000000 {
+		t.Fatalf("unexpected primary %+v %+v", s, s.Primary)
+	}
+	if s.Secondary == nil || s.Secondary.WindowMinutes != 7*24*60 || time.Until(s.Secondary.ResetAt) > time.Minute {
+		t.Fatalf("unexpected secondary %+v", s.Secondary)
+	}
+
+	p.Poll(ctx)
+	latest, err := p.Latest(ctx)
+	if err != nil || len(latest) != 1 || latest[0].ID != 2 {
+		t.Fatalf("latest: %v %+v", err, latest)
+	}
+}
+
+func TestPollPrunes(t *testing.T) {
+	p, mgr := setupPoller(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"plan_type":"pro"}`)
+	})
+	ctx := context.Background()
+	a := addChatGPT(t, mgr, "a", "t")
+	now := time.Now()
+	p.now = func() time.Time { return now.Add(-60 * 24 * time.Hour) }
+	p.Poll(ctx)
+	p.now = func() time.Time { return now }
+	p.Poll(ctx)
+	hist, err := p.History(ctx, a.ID, time.Time{})
+	if err != nil || len(hist) != 1 || hist[0].Primary != nil {
+		t.Fatalf("old snapshot not pruned: %v %+v", err, hist)
+	}
+}
@@ -0,0 +1,281 @@
+// Package ratesim simulates hypothetical traffic against the rate limits
+// tracked for the account pool, to estimate how long the pool lasts under a
+// planned load and when accounts would hit their limits.
+package ratesim
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/quota"
+)
+
+// Units a Limit is counted in.
+const (
+	UnitRequests = "requests"
+	UnitTokens   = "tokens"
+)
+
+// Kinds of simulation events.
+const (
+	// EventLimited is an account reaching a limit; the upstream would
+	// answer it with 429 until the window resets.
+	EventLimited = "limited"
+	// EventReset is the window of a reached limit resetting.
+	EventReset = "reset"
+	// EventPoolExhausted is the pool starting to reject requests, which
+	// clients see as 429 or 503 responses.
+	EventPoolExhausted = "pool_exhausted"
+	// EventPoolRecovered is the pool serving all requests again.
+	EventPoolRecovered = "pool_recovered"
+)
+
+// Step is the resolution of the simulation.
+const Step = time.Minute
+
+// maxEvents bounds the events of a Result.
+const maxEvents = 500
+
+// Limit is a rate limit of an account: Capacity requests or tokens per
+// Window, of which Used are taken in the window ending at ResetAt.
+type Limit struct {
+	Name     string        `json:"name"`
+	Unit     string        `json:"unit"`
+	Capacity float64       `json:"capacity"`
+	Window   time.Duration `json:"-"`
+	Used     float64       `json:"used"`
+	ResetAt  time.Time     `json:"reset_at"`
+	// Estimated marks a capacity derived from the account's usage instead
+	// of reported by the upstream.
+	Estimated bool `json:"estimated"`
+	// WindowMinutes is Window for JSON.
+	WindowMinutes float64 `json:"window_minutes"`
+}
+
+// Account is an account of the simulated pool. AvailableAt delays its
+// first request, e.g. while it is exhausted or in maintenance.
+type Account struct {
+	ID          int64
+	Name        string
+	Priority    int
+	Backup      bool
+	AvailableAt time.Time
+	Limits      []Limit
+}
+
+// Traffic is the hypothetical load.
+type Traffic struct {
+	RequestsPerHour  float64
+	TokensPerRequest float64
+	Duration         time.Duration
+}
+
+// Event is a change in the pool during the simulation.
+type Event struct {
+	At        time.Time `json:"at"`
+	Kind      string    `json:"kind"`
+	AccountID int64     `json:"account_id,omitempty"`
+	Limit     string    `json:"limit,omitempty"`
+}
+
+// AccountResult is what an account served in the simulation.
+type AccountResult struct {
+	ID       int64   `json:"id"`
+	Name     string  `json:"name"`
+	Requests float64 `json:"requests"`
+	Tokens   float64 `json:"tokens"`
+	// FirstLimited is when the account first reached a limit, nil when it
+	// never did.
+	FirstLimited *time.Time `json:"first_limited,omitempty"`
+	// Limits are the account's limits as the simulation started; none
+	// means no limit is tracked and the account is treated as unlimited.
+	Limits []Limit `json:"limits"`
+}
+
+// Result is the outcome of a simulation.
+type Result struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Requests float64   `json:"requests"`
+	Served   float64   `json:"served"`
+	Rejected float64   `json:"rejected"`
+	// Exhausted is when the pool first failed to serve the traffic, nil
+	// when it lasted until End.
+	Exhausted *time.Time      `json:"exhausted,omitempty"`
+	Accounts  []AccountResult `json:"accounts"`
+	Events    []Event         `json:"events"`
+	// Truncated is set when events beyond maxEvents were dropped.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Run simulates t against accounts from now in steps of a minute. Each step
+// the requests are served in the scheduler's priority order, primary
+// accounts before backups, every account taking what its limits leave
+// room for; what no account can take is rejected. Windows reset in the
+// step they expire in. Limit events are recorded for windows longer than a
+// step; limits per minute just cap an account's throughput.
+func Run(accounts []Account, t Traffic, now time.Time) Result {
+	res := Result{Start: now, End: now.Add(t.Duration), Accounts: make([]AccountResult, len(accounts)), Events: []Event{}}
+	pool := make([]*Account, len(accounts))
+	results := make(map[int64]*AccountResult, len(accounts))
+	for i := range accounts {
+		a := accounts[i]
+		a.Limits = append([]Limit(nil), a.Limits...)
+		for j := range a.Limits {
+			l := &a.Limits[j]
+			l.WindowMinutes = l.Window.Minutes()
+			if l.ResetAt.IsZero() {
+				l.ResetAt = now.Add(l.Window)
+			}
+		}
+		res.Accounts[i] = AccountResult{ID: a.ID, Name: a.Name, Limits: append([]Limit{}, a.Limits...)}
+		pool[i], results[a.ID] = &a, &res.Accounts[i]
+	}
+	sort.SliceStable(pool, func(i, j int) bool {
+		if pool[i].Backup != pool[j].Backup {
+			return !pool[i].Backup
+		}
+		return pool[i].Priority < pool[j].Priority
+	})
+	event := func(e Event) {
+		if len(res.Events) == maxEvents {
+			res.Truncated = true
+			return
+		}
+		res.Events = append(res.Events, e)
+	}
+	perStep := t.RequestsPerHour * Step.Hours()
+	limited := make(map[*Limit]bool)
+	short := false
+	for at := now; at.Before(res.End); at = at.Add(Step) {
+		for _, a := range pool {
+			for j := range a.Limits {
+				l := &a.Limits[j]
+				// A window resetting during the step serves all of it.
+				stepEnd := at.Add(Step)
+				if !l.ResetAt.Before(stepEnd) || l.Window <= 0 {
+					continue
+				}
+				n := (stepEnd.Sub(l.ResetAt) + l.Window - 1) / l.Window
+				l.ResetAt = l.ResetAt.Add(n * l.Window)
+				l.Used = 0
+				if limited[l] {
+					delete(limited, l)
+					event(Event{At: at, Kind: EventReset, AccountID: a.ID, Limit: l.Name})
+				}
+			}
+		}
+		demand := perStep
+		res.Requests += demand
+		for _, a := range pool {
+			if demand <= 0 {
+				break
+			}
+			if at.Before(a.AvailableAt) {
+				continue
+			}
+			take := demand
+			for _, l := range a.Limits {
+				if per := l.cost(t); per > 0 {
+					take = math.Min(take, math.Max(l.Capacity-l.Used, 0)/per)
+				}
+			}
+			demand -= take
+			r := results[a.ID]
+			r.Requests += take
+			r.Tokens += take * t.TokensPerRequest
+			for j := range a.Limits {
+				l := &a.Limits[j]
+				l.Used += take * l.cost(t)
+				if l.Used < l.Capacity*(1-1e-9) || limited[l] || l.Window <= Step {
+					continue
+				}
+				limited[l] = true
+				event(Event{At: at, Kind: EventLimited, AccountID: a.ID, Limit: l.Name})
+				if r.FirstLimited == nil {
+					first := at
+					r.FirstLimited = &first
+				}
+			}
+		}
+		// Fractions of a request left over are rounding, not rejections.
+		if demand > 1e-6 {
+			res.Rejected += demand
+			if !short {
+				short = true
+				event(Event{At: at, Kind: EventPoolExhausted})
+			}
+			if res.Exhausted == nil {
+				first := at
+				res.Exhausted = &first
+			}
+		} else if short {
+			short = false
+			event(Event{At: at, Kind: EventPoolRecovered})
+		}
+	}
+	res.Served = res.Requests - res.Rejected
+	return res
+}
+
+// cost returns what a request takes of l under t.
+func (l Limit) cost(t Traffic) float64 {
+	if l.Unit == UnitTokens {
+		return t.TokensPerRequest
+	}
+	return 1
+}
+
+// QuotaLimits returns the windows of a ChatGPT quota snapshot s as limits.
+// The backend reports windows as a used percentage only, so the capacity is
+// estimated from the tokens the account used in the window so far, which
+// tokens returns for the time since a window's start. Windows without
+// usage to estimate from are left out.
+func QuotaLimits(s quota.Snapshot, tokens func(since time.Time) (int64, error)) ([]Limit, error) {
+	var res []Limit
+	for _, w := range []struct {
+		name string
+		w    *quota.Window
+	}{{"primary window", s.Primary}, {"secondary window", s.Secondary}} {
+		if w.w == nil || w.w.UsedPercent <= 0 || w.w.WindowMinutes <= 0 {
+			continue
+		}
+		window := time.Duration(w.w.WindowMinutes) * time.Minute
+		used, err := tokens(w.w.ResetAt.Add(-window))
+		if err != nil {
+			return nil, err
+		}
+		if used <= 0 {
+			continue
+		}
+		res = append(res, Limit{
+			Name: w.name, Unit: UnitTokens, Window: window, ResetAt: w.w.ResetAt, Estimated: true,
+			Capacity: float64(used) * 100 / w.w.UsedPercent, Used: float64(used),
+		})
+	}
+	return res, nil
+}
+
+// HeaderLimits returns the x-ratelimit-* request and token limits of an
+// upstream response header received at, which the OpenAI API counts per
+// minute.
+func HeaderLimits(header http.Header, at time.Time) []Limit {
+	var res []Limit
+	for _, unit := range []string{UnitRequests, UnitTokens} {
+		limit, err := strconv.ParseFloat(strings.TrimSpace(header.Get("X-Ratelimit-Limit-"+unit)), 64)
+		if err != nil || limit <= 0 {
+			continue
+		}
+		l := Limit{Name: unit + " per minute", Unit: unit, Capacity: limit, Window: time.Minute}
+		remaining, err := strconv.ParseFloat(strings.TrimSpace(header.Get("X-Ratelimit-Remaining-"+unit)), 64)
+		if d, derr := time.ParseDuration(strings.TrimSpace(header.Get("X-Ratelimit-Reset-" + unit))); err == nil && derr == nil {
+			l.Used, l.ResetAt = math.Max(limit-remaining, 0), at.Add(d)
+		}
+		res = append(res, l)
+	}
+	return res
+}
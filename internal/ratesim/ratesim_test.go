@@ -0,0 +1,87 @@
+package ratesim
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/quota"
+)
+
+func TestRun(t *testing.T) {
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	accounts := []Account{
+		{ID: 2, Name: "backup", Backup: true, Limits: []Limit{{Name: "hourly", Unit: UnitTokens, Capacity: 200, Window: time.Hour}}},
+		{ID: 1, Name: "main", Priority: 1, Limits: []Limit{{Name: "5h", Unit: UnitTokens, Capacity: 300, Window: 5 * time.Hour}}},
+		// Exhausted for the whole run.
+		{ID: 3, Name: "later", AvailableAt: now.Add(4 * time.Hour)},
+	}
+	res := Run(accounts, Traffic{RequestsPerHour: 60, TokensPerRequest: 10, Duration: 3 * time.Hour}, now)
+	at := func(min int) time.Time { return now.Add(time.Duration(min) * time.Minute) }
+	if res.Exhausted == nil || !res.Exhausted.Equal(at(50)) {
+		t.Fatalf("pool exhausted at %v, want %v", res.Exhausted, at(50))
+	}
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-6 }
+	if !near(res.Requests, 180) || !near(res.Served, 90) || !near(res.Rejected, 90) {
+		t.Fatalf("requests %v served %v rejected %v", res.Requests, res.Served, res.Rejected)
+	}
+	if !near(res.Accounts[1].Requests, 30) || !near(res.Accounts[0].Requests, 60) || res.Accounts[2].Requests != 0 {
+		t.Fatalf("unexpected accounts %+v", res.Accounts)
+	}
+	if res.Accounts[1].FirstLimited == nil || !res.Accounts[1].FirstLimited.Equal(at(29)) || res.Accounts[1].Limits[0].Used != 0 {
+		t.Fatalf("unexpected main account %+v", res.Accounts[1])
+	}
+	want := []Event{
+		{At: at(29), Kind: EventLimited, AccountID: 1, Limit: "5h"},
+		{At: at(49), Kind: EventLimited, AccountID: 2, Limit: "hourly"},
+		{At: at(50), Kind: EventPoolExhausted},
+		{At: at(60), Kind: EventReset, AccountID: 2, Limit: "hourly"},
+		{At: at(60), Kind: EventPoolRecovered},
+		{At: at(79), Kind: EventLimited, AccountID: 2, Limit: "hourly"},
+		{At: at(80), Kind: EventPoolExhausted},
+	}
+	if !reflect.DeepEqual(res.Events[:len(want)], want) {
+		t.Fatalf("events %+v", res.Events)
+	}
+
+	// An unlimited account lasts.
+	res = Run([]Account{{ID: 1}}, Traffic{RequestsPerHour: 1000, TokensPerRequest: 1000, Duration: time.Hour}, now)
+	if res.Exhausted != nil || res.Rejected != 0 || len(res.Events) != 0 {
+		t.Fatalf("unlimited pool ran out: %+v", res)
+	}
+}
+
+func TestQuotaLimits(t *testing.T) {
+	reset := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := quota.Snapshot{
+		Primary:   &quota.Window{UsedPercent: 25, WindowMinutes: 300, ResetAt: reset},
+		Secondary: &quota.Window{UsedPercent: 0, WindowMinutes: 10080, ResetAt: reset},
+	}
+	var since time.Time
+	limits, err := QuotaLimits(s, func(t time.Time) (int64, error) { since = t; return 1000, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !since.Equal(reset.Add(-5*time.Hour)) || len(limits) != 1 || limits[0].Capacity != 4000 || limits[0].Used != 1000 || !limits[0].Estimated {
+		t.Fatalf("unexpected limits %+v since %v", limits, since)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	h := http.Header{}
+	h.Set("X-Ratelimit-Limit-Requests", "500")
+	h.Set("X-Ratelimit-Remaining-Requests", "499")
+	h.Set("X-Ratelimit-Reset-Requests", "120ms")
+	h.Set("X-Ratelimit-Limit-Tokens", "30000")
+	limits := HeaderLimits(h, at)
+	want := []Limit{
+		{Name: "requests per minute", Unit: UnitRequests, Capacity: 500, Window: time.Minute, Used: 1, ResetAt: at.Add(120 * time.Millisecond)},
+		{Name: "tokens per minute", Unit: UnitTokens, Capacity: 30000, Window: time.Minute},
+	}
+	if !reflect.DeepEqual(limits, want) {
+		t.Fatalf("limits %+v", limits)
+	}
+}
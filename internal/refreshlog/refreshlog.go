@@ -0,0 +1,150 @@
+// Package refreshlog records every ChatGPT token refresh attempt published
+// on the event bus, so the admin UI can show when an account's tokens were
+// refreshed, what triggered it and how often refreshing failed.
+package refreshlog
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Attempt is one token refresh of an account. ExpiresAt is the new token
+// expiry and only set for successful attempts, Error only for failed ones.
+type Attempt struct {
+	ID         int64     `json:"id"`
+	AccountID  int64     `json:"account_id"`
+	Time       time.Time `json:"time"`
+	Trigger    string    `json:"trigger"`
+	Success    bool      `json:"success"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// Store keeps refresh attempts in the token_refreshes table.
+type Store struct {
+	db *sql.DB
+	// Retention is how long attempts are kept.
+	Retention time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// New creates a Store and ensures its table exists.
+func New(db *sql.DB) (*Store, error) {
+	s := &Store{db: db, Retention: 90 * 24 * time.Hour, now: time.Now}
+	if err := s.init(); err != nil {
+		logger.Errorf("init token_refreshes table failed: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) init() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS token_refreshes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        account_id INTEGER NOT NULL,
+        time INTEGER NOT NULL,
+        trigger TEXT NOT NULL DEFAULT '',
+        success INTEGER NOT NULL DEFAULT 0,
+        expires_at INTEGER,
+        error TEXT NOT NULL DEFAULT '',
+        duration_ms INTEGER NOT NULL DEFAULT 0
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS token_refreshes_account ON token_refreshes(account_id, time)`)
+	return err
+}
+
+// Subscribe records the refresh events published on bus. It returns the
+// function cancelling the subscription.
+func (s *Store) Subscribe(bus *events.Bus) func() {
+	return bus.Subscribe(s.handle, events.TokenRefreshed, events.RefreshFailed)
+}
+
+func (s *Store) handle(e events.Event) {
+	a := &Attempt{AccountID: e.AccountID, Time: e.Time, Success: e.Type == events.TokenRefreshed}
+	a.Trigger, _ = e.Data["trigger"].(string)
+	a.DurationMs, _ = e.Data["duration_ms"].(int64)
+	if a.Success {
+		a.ExpiresAt, _ = e.Data["expires_at"].(time.Time)
+	} else {
+		a.Error = e.Message
+	}
+	if err := s.Record(context.Background(), a); err != nil {
+		logger.Warnf("record token refresh of account %d: %v", a.AccountID, err)
+	}
+}
+
+// Record stores a and prunes attempts older than Retention at most once an
+// hour.
+func (s *Store) Record(ctx context.Context, a *Attempt) error {
+	var expires any
+	if !a.ExpiresAt.IsZero() {
+		expires = a.ExpiresAt.UnixMilli()
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO token_refreshes(account_id, time, trigger, success, expires_at, error, duration_ms) VALUES(?,?,?,?,?,?,?)`,
+		a.AccountID, a.Time.UnixMilli(), a.Trigger, a.Success, expires, a.Error, a.DurationMs)
+	if err != nil {
+		logger.Errorf("insert token refresh failed: %v", err)
+		dbhealth.RecordWriteError("token_refreshes")
+		return err
+	}
+	a.ID, _ = res.LastInsertId()
+	s.prune(ctx)
+	return nil
+}
+
+func (s *Store) prune(ctx context.Context) {
+	now := s.now()
+	s.mu.Lock()
+	due := now.Sub(s.lastPrune) >= time.Hour
+	if due {
+		s.lastPrune = now
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	cutoff := now.Add(-s.Retention).UnixMilli()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM token_refreshes WHERE time < ?`, cutoff); err != nil {
+		logger.Errorf("prune token refreshes: %v", err)
+	}
+}
+
+// History returns the refresh attempts of an account made at or after
+// since, oldest first.
+func (s *Store) History(ctx context.Context, accountID int64, since time.Time) ([]Attempt, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, account_id, time, trigger, success, expires_at, error, duration_ms FROM token_refreshes WHERE account_id=? AND time>=? ORDER BY time, id`, accountID, since.UnixMilli())
+	if err != nil {
+		logger.Errorf("query token refresh history failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		var t int64
+		var expires sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.AccountID, &t, &a.Trigger, &a.Success, &expires, &a.Error, &a.DurationMs); err != nil {
+			logger.Errorf("scan token refresh failed: %v", err)
+			return nil, err
+		}
+		a.Time = time.UnixMilli(t)
+		if expires.Valid {
+			a.ExpiresAt = time.UnixMilli(expires.Int64)
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,74 @@
+package refreshlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func setupStore(t *testing.T) *Store {
+	t.Helper()
+	db := testdb.Open(t)
+	s, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSubscribeRecordsAttempts(t *testing.T) {
+	s := setupStore(t)
+	bus := events.NewBus()
+	unsub := s.Subscribe(bus)
+	expires := time.Now().Add(28 * 24 * time.Hour).Truncate(time.Millisecond)
+	bus.Publish(events.Event{Type: events.TokenRefreshed, AccountID: 1, Data: map[string]any{"trigger": "quota", "duration_ms": int64(42), "expires_at": expires}})
+	bus.Publish(events.Event{Type: events.RefreshFailed, AccountID: 1, Message: "status 400", Data: map[string]any{"trigger": "request", "duration_ms": int64(7)}})
+	bus.Publish(events.Event{Type: events.RefreshFailed, AccountID: 2, Message: "other account"})
+	bus.Publish(events.Event{Type: events.AccountExhausted, AccountID: 1})
+	unsub()
+
+	list, err := s.History(context.Background(), 1, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 attempts, got %+v", list)
+	}
+	ok, failed := list[0], list[1]
+	if !ok.Success || ok.Trigger != "quota" || ok.DurationMs != 42 || !ok.ExpiresAt.Equal(expires) || ok.Error != "" {
+		t.Fatalf("unexpected success: %+v", ok)
+	}
+	if failed.Success || failed.Trigger != "request" || failed.Error != "status 400" || !failed.ExpiresAt.IsZero() {
+		t.Fatalf("unexpected failure: %+v", failed)
+	}
+}
+
+func TestRecordPrunes(t *testing.T) {
+	s := setupStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	s.Retention = 24 * time.Hour
+	if err := s.Record(ctx, &Attempt{AccountID: 1, Time: now, Trigger: "request", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(ctx, &Attempt{AccountID: 1, Time: now.Add(-48 * time.Hour), Trigger: "request"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.History(ctx, 1, time.Time{}); len(list) != 2 {
+		t.Fatalf("pruned again within the hour: %+v", list)
+	}
+	s.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if err := s.Record(ctx, &Attempt{AccountID: 1, Time: now.Add(time.Hour), Trigger: "probe", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.History(ctx, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !list[0].Success || list[1].Trigger != "probe" {
+		t.Fatalf("old attempt not pruned: %+v", list)
+	}
+}
@@ -0,0 +1,322 @@
+// Package replay records sanitized upstream HTTP interactions into fixture
+// files and serves them back in tests, so the proxy's normalization, retry
+// and streaming behaviour can be exercised without real API credentials.
+//
+// A fixture is a JSON Lines file with one Interaction per line. Recorder
+// wraps a live transport and appends to a fixture; Replayer is a transport
+// that answers requests from one.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Redacted replaces secret header and body values in fixtures.
+const Redacted = "REDACTED"
+
+// sensitiveHeaders are replaced by Redacted when recording.
+var sensitiveHeaders = []string{"Authorization", "Chatgpt-Account-Id", "Cookie", "Set-Cookie", "Openai-Organization", "Openai-Project", "X-Api-Key"}
+
+// sensitiveFields matches JSON string fields whose values are secrets.
+var sensitiveFields = regexp.MustCompile(`("(?:access_token|refresh_token|id_token|api_key)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// Message is the recorded half of an interaction.
+type Message struct {
+	Header http.Header `json:"header,omitempty"`
+	// Body is the payload, base64 encoded when Base64 is set.
+	Body   string `json:"body,omitempty"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+func newMessage(h http.Header, body []byte) Message {
+	m := Message{Header: SanitizeHeader(h)}
+	if utf8.Valid(body) {
+		m.Body = sensitiveFields.ReplaceAllString(string(body), `$1"`+Redacted+`"`)
+	} else {
+		m.Body = base64.StdEncoding.EncodeToString(body)
+		m.Base64 = true
+	}
+	return m
+}
+
+// Bytes returns the decoded body.
+func (m Message) Bytes() []byte {
+	if m.Base64 {
+		b, err := base64.StdEncoding.DecodeString(m.Body)
+		if err != nil {
+			logger.Warnf("decode fixture body: %v", err)
+		}
+		return b
+	}
+	return []byte(m.Body)
+}
+
+// Interaction is one upstream request and its response.
+type Interaction struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	Request  Message   `json:"request"`
+	Status   int       `json:"status"`
+	Response Message   `json:"response"`
+	// Error records a transport error instead of a response.
+	Error string `json:"error,omitempty"`
+}
+
+// SanitizeHeader returns a copy of h with the values of credential headers
+// replaced by Redacted.
+func SanitizeHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	h = h.Clone()
+	for _, k := range sensitiveHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, Redacted)
+		}
+	}
+	return h
+}
+
+// Recorder is an http.RoundTripper that forwards to Transport and appends
+// every interaction to a fixture file.
+type Recorder struct {
+	Transport http.RoundTripper
+
+	out *fixture
+}
+
+// fixture is the file a Recorder and its copies from Rewrap append to.
+type fixture struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder appends interactions to the fixture at path, creating it if
+// needed. A nil transport means http.DefaultTransport.
+func NewRecorder(path string, transport http.RoundTripper) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	logger.Infof("recording upstream interactions to %s", path)
+	return &Recorder{Transport: transport, out: &fixture{f: f}}, nil
+}
+
+// Close closes the fixture file.
+func (r *Recorder) Close() error { return r.out.f.Close() }
+
+// Unwrap returns the transport the Recorder forwards to.
+func (r *Recorder) Unwrap() http.RoundTripper { return r.Transport }
+
+// Rewrap returns a Recorder forwarding to t and appending to the same
+// fixture, such as one for an account with an outbound proxy of its own.
+func (r *Recorder) Rewrap(t http.RoundTripper) http.RoundTripper {
+	return &Recorder{Transport: t, out: r.out}
+}
+
+// RoundTrip implements http.RoundTripper. The response body is buffered so
+// it can be recorded; streamed responses are recorded once complete.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	in := Interaction{
+		Time:    time.Now(),
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.RawQuery,
+		Request: newMessage(req.Header, reqBody),
+	}
+	resp, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		in.Error = err.Error()
+		r.write(in)
+		return nil, err
+	}
+	respBody, rerr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	in.Status = resp.StatusCode
+	in.Response = newMessage(resp.Header, respBody)
+	if rerr != nil {
+		in.Error = rerr.Error()
+	}
+	r.write(in)
+	return resp, rerr
+}
+
+func (r *Recorder) write(in Interaction) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		logger.Errorf("encode interaction: %v", err)
+		return
+	}
+	r.out.mu.Lock()
+	defer r.out.mu.Unlock()
+	if _, err := r.out.f.Write(append(b, '\n')); err != nil {
+		logger.Errorf("write fixture: %v", err)
+	}
+}
+
+// Load reads a fixture file.
+func Load(path string) ([]Interaction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []Interaction
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var in Interaction
+		if err := json.Unmarshal(sc.Bytes(), &in); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		res = append(res, in)
+	}
+	return res, sc.Err()
+}
+
+// Received is a request seen by a Replayer.
+type Received struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+// Replayer is an http.RoundTripper answering from recorded interactions.
+// Each request consumes the first unused interaction with the same method
+// and path, so repeated calls to one endpoint replay in recorded order.
+type Replayer struct {
+	mu       sync.Mutex
+	pending  []Interaction
+	received []Received
+}
+
+// NewReplayer serves the given interactions.
+func NewReplayer(in []Interaction) *Replayer {
+	return &Replayer{pending: append([]Interaction(nil), in...)}
+}
+
+// LoadReplayer serves the fixture at path.
+func LoadReplayer(path string) (*Replayer, error) {
+	in, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(in), nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (p *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.received = append(p.received, Received{Method: req.Method, Path: req.URL.Path, Query: req.URL.RawQuery, Header: req.Header.Clone(), Body: body})
+	for i, in := range p.pending {
+		if in.Method != req.Method || in.Path != req.URL.Path {
+			continue
+		}
+		p.pending = append(p.pending[:i], p.pending[i+1:]...)
+		if in.Error != "" && in.Status == 0 {
+			return nil, fmt.Errorf("replayed error: %s", in.Error)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode:    in.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        in.Response.Header.Clone(),
+			Body:          &lineReader{r: bytes.NewReader(in.Response.Bytes())},
+			ContentLength: -1,
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("replay: no recorded interaction for %s %s", req.Method, req.URL.Path)
+}
+
+// Received returns the requests served so far.
+func (p *Replayer) Received() []Received {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Received(nil), p.received...)
+}
+
+// Unused returns interactions that no request has consumed.
+func (p *Replayer) Unused() []Interaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Interaction(nil), p.pending...)
+}
+
+// lineReader returns at most one line per Read so replayed event streams
+// reach the client in chunks, as they would from a live upstream.
+type lineReader struct {
+	r *bytes.Reader
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		p[n] = c
+		n++
+		if c == '\n' {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (l *lineReader) Close() error { return nil }
+
+// FixtureName returns a file name for a recording started at t.
+func FixtureName(t time.Time) string {
+	return "upstream-" + t.UTC().Format("20060102-150405") + ".jsonl"
+}
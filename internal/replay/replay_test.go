@@ -0,0 +1,82 @@
+package replay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordSanitizeAndReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: one\n\ndata: two\n\n")
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), FixtureName(fixedTime))
+	rec, err := NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rec}
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/responses?x=1", strings.NewReader(`{"model":"m","refresh_token":"rt-secret"}`))
+	req.Header.Set("Authorization", "Bearer sk-secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "data: one\n\ndata: two\n\n" {
+		t.Fatalf("recorder altered body %q", body)
+	}
+	rec.Close()
+
+	in, err := Load(path)
+	if err != nil || len(in) != 1 {
+		t.Fatalf("load: %v %d", err, len(in))
+	}
+	got := in[0]
+	if got.Path != "/v1/responses" || got.Query != "x=1" || got.Status != 200 {
+		t.Fatalf("unexpected interaction %+v", got)
+	}
+	if got.Request.Header.Get("Authorization") != Redacted || got.Response.Header.Get("Set-Cookie") != Redacted {
+		t.Fatalf("headers not sanitized: %v %v", got.Request.Header, got.Response.Header)
+	}
+	if strings.Contains(got.Request.Body, "rt-secret") || !strings.Contains(got.Request.Body, `"refresh_token":"REDACTED"`) {
+		t.Fatalf("body not sanitized: %s", got.Request.Body)
+	}
+
+	rp := NewReplayer(in)
+	client = &http.Client{Transport: rp}
+	resp, err = client.Post("http://example.invalid/v1/responses", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _ := resp.Body.Read(buf)
+	if string(buf[:n]) != "data: one\n" {
+		t.Fatalf("expected line-sized chunk, got %q", buf[:n])
+	}
+	resp.Body.Close()
+	if _, err := client.Post("http://example.invalid/v1/responses", "application/json", nil); err == nil {
+		t.Fatalf("expected error once interactions are consumed")
+	}
+	if r := rp.Received(); len(r) != 2 || string(r[0].Body) != "{}" {
+		t.Fatalf("received %+v", r)
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	m := newMessage(nil, []byte{0x1f, 0x8b, 0xff})
+	if !m.Base64 || string(m.Bytes()) != string([]byte{0x1f, 0x8b, 0xff}) {
+		t.Fatalf("binary body not round-tripped: %+v", m)
+	}
+}
+
+var fixedTime = time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
@@ -0,0 +1,409 @@
+// Package script runs small sandboxed Lua scripts as proxy hooks so
+// deployment-specific quirks can be handled without patching the proxy.
+//
+// A script may define any of these global functions:
+//
+//	on_request(req)           -- return status, message to reject
+//	on_account(req, account)  -- return false to skip the account
+//	on_response(req, resp)    -- may modify resp.headers
+//
+// req has fields method, path, query, headers and body; changes to
+// req.headers and req.body in on_request are applied to the forwarded
+// request. account has id, name and type ("api_key" or "chatgpt"). resp has
+// status and headers. A global routes table of path prefixes limits which
+// requests the script sees; without it the script applies to every route.
+//
+// Only the base, table, string and math libraries are available, so scripts
+// cannot reach files, processes or the network. Each call is bounded by
+// Limits.Timeout, the interpreter's call stack and registry sizes are capped,
+// and the strings a call builds, by concatenation or the string and table
+// libraries, count against Limits.MaxMemory before they are allocated;
+// tables are bounded by the time a call may run. The timeout cannot
+// interrupt a single library call, such as a pattern match backtracking
+// through a large body. Every call starts from the globals the script's top
+// level left, whatever earlier calls changed. Script errors are logged and
+// the request proceeds as if the script were absent.
+package script
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/proxy"
+)
+
+// Limits bounds the resources a script call may use.
+type Limits struct {
+	// Timeout caps the wall-clock time of a single hook call.
+	Timeout time.Duration
+	// CallStackSize caps the Lua call depth.
+	CallStackSize int
+	// RegistryMaxSize caps the interpreter's value stack.
+	RegistryMaxSize int
+	// MaxMemory caps the bytes of the strings a single call builds,
+	// counting every string as it is built.
+	MaxMemory int
+}
+
+// DefaultLimits are used for zero fields of Limits.
+var DefaultLimits = Limits{Timeout: 100 * time.Millisecond, CallStackSize: 64, RegistryMaxSize: 64 * 1024, MaxMemory: 64 << 20}
+
+// Script is a compiled Lua script usable as a proxy hook.
+type Script struct {
+	Name   string
+	routes []string
+	proto  *lua.FunctionProto
+	limits Limits
+	pool   sync.Pool
+}
+
+var (
+	_ proxy.RequestHook         = (*Script)(nil)
+	_ proxy.AccountSelectedHook = (*Script)(nil)
+	_ proxy.ResponseHook        = (*Script)(nil)
+)
+
+// Load compiles src and evaluates its top level once to read routes.
+func Load(name, src string, limits Limits) (*Script, error) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultLimits.Timeout
+	}
+	if limits.CallStackSize <= 0 {
+		limits.CallStackSize = DefaultLimits.CallStackSize
+	}
+	if limits.RegistryMaxSize <= 0 {
+		limits.RegistryMaxSize = DefaultLimits.RegistryMaxSize
+	}
+	if limits.MaxMemory <= 0 {
+		limits.MaxMemory = DefaultLimits.MaxMemory
+	}
+	chunk, err := parse.Parse(strings.NewReader(src), name)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	proto, err := lua.Compile(rewriteConcat(chunk), name)
+	if err != nil {
+		return nil, fmt.Errorf("compile %s: %w", name, err)
+	}
+	s := &Script{Name: name, proto: proto, limits: limits}
+	st, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	if rt, ok := st.L.GetGlobal("routes").(*lua.LTable); ok {
+		rt.ForEach(func(_, v lua.LValue) {
+			if str, ok := v.(lua.LString); ok {
+				s.routes = append(s.routes, string(str))
+			}
+		})
+	}
+	s.pool.Put(st)
+	return s, nil
+}
+
+// LoadDir loads every *.lua file in dir in lexical order.
+func LoadDir(dir string, limits Limits) ([]*Script, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var res []*Script
+	for _, p := range paths {
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		s, err := Load(filepath.Base(p), string(src), limits)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("loaded script %s routes %v", s.Name, s.routes)
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// state is a pooled interpreter with the budget of its running call and
+// the globals its script's top level left.
+type state struct {
+	L      *lua.LState
+	budget budget
+	// fields holds the fields of the global table and of the tables among
+	// the globals, such as the libraries, and meta the global table's
+	// metatable.
+	fields map[*lua.LTable]map[lua.LValue]lua.LValue
+	meta   lua.LValue
+}
+
+func (s *Script) newState() (*state, error) {
+	st := &state{budget: budget{max: s.limits.MaxMemory}}
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   s.limits.CallStackSize,
+		RegistrySize:    1024,
+		RegistryMaxSize: s.limits.RegistryMaxSize,
+	})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	limitStrings(L, &st.budget)
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, 0, L.GetTop())
+		for i := 1; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		logger.Infof("script %s: %s", s.Name, strings.Join(parts, " "))
+		return 0
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), s.limits.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("run %s: %w", s.Name, err)
+	}
+	L.SetGlobal(concatName, lua.LNil)
+	st.L = L
+	st.snapshot()
+	st.budget.used = 0
+	return st, nil
+}
+
+// snapshot records the globals for reset.
+func (st *state) snapshot() {
+	st.fields = make(map[*lua.LTable]map[lua.LValue]lua.LValue)
+	save := func(t *lua.LTable) {
+		m := make(map[lua.LValue]lua.LValue)
+		t.ForEach(func(k, v lua.LValue) { m[k] = v })
+		st.fields[t] = m
+	}
+	g := st.L.G.Global
+	st.meta = st.L.GetMetatable(g)
+	save(g)
+	g.ForEach(func(_, v lua.LValue) {
+		if t, ok := v.(*lua.LTable); ok && st.fields[t] == nil {
+			save(t)
+		}
+	})
+}
+
+// reset restores the globals recorded by snapshot, so that no call sees
+// what an earlier one left behind.
+func (st *state) reset() {
+	for t, m := range st.fields {
+		var extra []lua.LValue
+		t.ForEach(func(k, _ lua.LValue) {
+			if _, ok := m[k]; !ok {
+				extra = append(extra, k)
+			}
+		})
+		for _, k := range extra {
+			t.RawSet(k, lua.LNil)
+		}
+		for k, v := range m {
+			t.RawSet(k, v)
+		}
+	}
+	st.L.SetMetatable(st.L.G.Global, st.meta)
+	st.budget.used = 0
+}
+
+// Matches reports whether the script applies to path.
+func (s *Script) Matches(path string) bool {
+	if len(s.routes) == 0 {
+		return true
+	}
+	for _, r := range s.routes {
+		if strings.HasPrefix(path, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// call invokes the global function fn and returns its results. A missing
+// function yields no results and no error.
+func (s *Script) call(ctx context.Context, fn string, args ...func(*lua.LState) lua.LValue) ([]lua.LValue, []lua.LValue, error) {
+	st, _ := s.pool.Get().(*state)
+	if st == nil {
+		var err error
+		if st, err = s.newState(); err != nil {
+			return nil, nil, err
+		}
+	}
+	L := st.L
+	f, ok := L.GetGlobal(fn).(*lua.LFunction)
+	if !ok {
+		s.pool.Put(st)
+		return nil, nil, nil
+	}
+	cctx, cancel := context.WithTimeout(ctx, s.limits.Timeout)
+	defer cancel()
+	L.SetContext(cctx)
+	argv := make([]lua.LValue, len(args))
+	for i, a := range args {
+		argv[i] = a(L)
+	}
+	top := L.GetTop()
+	if err := L.CallByParam(lua.P{Fn: f, NRet: lua.MultRet, Protect: true}, argv...); err != nil {
+		// The state may be left inconsistent; do not reuse it.
+		L.Close()
+		return nil, nil, fmt.Errorf("script %s %s: %w", s.Name, fn, err)
+	}
+	L.RemoveContext()
+	var rets []lua.LValue
+	for i := top + 1; i <= L.GetTop(); i++ {
+		rets = append(rets, L.Get(i))
+	}
+	L.SetTop(top)
+	st.reset()
+	s.pool.Put(st)
+	return rets, argv, nil
+}
+
+func headerTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.NewTable()
+	for k := range h {
+		t.RawSetString(http.CanonicalHeaderKey(k), lua.LString(h.Get(k)))
+	}
+	return t
+}
+
+// applyHeaders copies a Lua header table back into h, deleting headers the
+// script removed.
+func applyHeaders(t lua.LValue, h http.Header) {
+	tbl, ok := t.(*lua.LTable)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	tbl.ForEach(func(k, v lua.LValue) {
+		key := http.CanonicalHeaderKey(k.String())
+		seen[key] = true
+		if h.Get(key) != v.String() {
+			h.Set(key, v.String())
+		}
+	})
+	for k := range h {
+		if !seen[http.CanonicalHeaderKey(k)] {
+			h.Del(k)
+		}
+	}
+}
+
+func requestTable(hc *proxy.HookContext) func(*lua.LState) lua.LValue {
+	return func(L *lua.LState) lua.LValue {
+		t := L.NewTable()
+		t.RawSetString("method", lua.LString(hc.Request.Method))
+		t.RawSetString("path", lua.LString(hc.Request.URL.Path))
+		t.RawSetString("query", lua.LString(hc.Request.URL.RawQuery))
+		t.RawSetString("headers", headerTable(L, hc.Request.Header))
+		t.RawSetString("body", lua.LString(hc.Body))
+		return t
+	}
+}
+
+// OnRequest implements proxy.RequestHook.
+func (s *Script) OnRequest(hc *proxy.HookContext) error {
+	if !s.Matches(hc.Request.URL.Path) {
+		return nil
+	}
+	rets, args, err := s.call(hc.Context, "on_request", requestTable(hc))
+	if err != nil {
+		logger.Warnf("%v", err)
+		return nil
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	req := args[0].(*lua.LTable)
+	applyHeaders(req.RawGetString("headers"), hc.Request.Header)
+	if body, ok := req.RawGetString("body").(lua.LString); ok && string(body) != string(hc.Body) {
+		hc.Body = []byte(body)
+	}
+	if len(rets) > 0 {
+		if status, ok := rets[0].(lua.LNumber); ok {
+			msg := http.StatusText(int(status))
+			if len(rets) > 1 && rets[1] != lua.LNil {
+				msg = rets[1].String()
+			}
+			return &proxy.HookError{Status: int(status), Message: msg}
+		}
+	}
+	return nil
+}
+
+// OnAccountSelected implements proxy.AccountSelectedHook.
+func (s *Script) OnAccountSelected(hc *proxy.HookContext, a *account.Account) error {
+	if !s.Matches(hc.Request.URL.Path) {
+		return nil
+	}
+	rets, _, err := s.call(hc.Context, "on_account", requestTable(hc), func(L *lua.LState) lua.LValue {
+		t := L.NewTable()
+		t.RawSetString("id", lua.LNumber(a.ID))
+		t.RawSetString("name", lua.LString(a.Name))
+		typ := "api_key"
+		if a.Type == account.ChatGPTAccount {
+			typ = "chatgpt"
+		}
+		t.RawSetString("type", lua.LString(typ))
+		return t
+	})
+	if err != nil {
+		logger.Warnf("%v", err)
+		return nil
+	}
+	if len(rets) > 0 && rets[0] == lua.LFalse {
+		return fmt.Errorf("account %d rejected by script %s", a.ID, s.Name)
+	}
+	return nil
+}
+
+// OnResponse implements proxy.ResponseHook.
+func (s *Script) OnResponse(hc *proxy.HookContext, resp *http.Response) error {
+	if !s.Matches(hc.Request.URL.Path) {
+		return nil
+	}
+	_, args, err := s.call(hc.Context, "on_response", requestTable(hc), func(L *lua.LState) lua.LValue {
+		t := L.NewTable()
+		t.RawSetString("status", lua.LNumber(resp.StatusCode))
+		t.RawSetString("headers", headerTable(L, resp.Header))
+		return t
+	})
+	if err != nil {
+		logger.Warnf("%v", err)
+		return nil
+	}
+	if len(args) > 1 {
+		applyHeaders(args[1].(*lua.LTable).RawGetString("headers"), resp.Header)
+	}
+	return nil
+}
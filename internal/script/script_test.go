@@ -0,0 +1,211 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/proxy"
+)
+
+func hookContext(method, target, body string) *proxy.HookContext {
+	r := httptest.NewRequest(method, target, nil)
+	return &proxy.HookContext{Context: context.Background(), Request: r, Body: []byte(body), Values: map[string]any{}}
+}
+
+func TestOnRequestModifiesAndRejects(t *testing.T) {
+	s, err := Load("t.lua", `
+routes = {"/v1/responses"}
+function on_request(req)
+  req.headers["X-Script"] = "yes"
+  req.headers["X-Drop"] = nil
+  req.body = string.gsub(req.body, "gpt%-4", "gpt-5")
+  if req.headers["X-Block"] == "1" then
+    return 418, "blocked by script"
+  end
+end
+`, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := hookContext("POST", "http://localhost/v1/responses", `{"model":"gpt-4"}`)
+	hc.Request.Header.Set("X-Drop", "1")
+	if err := s.OnRequest(hc); err != nil {
+		t.Fatalf("unexpected reject: %v", err)
+	}
+	if hc.Request.Header.Get("X-Script") != "yes" || hc.Request.Header.Get("X-Drop") != "" {
+		t.Fatalf("headers not applied: %v", hc.Request.Header)
+	}
+	if string(hc.Body) != `{"model":"gpt-5"}` {
+		t.Fatalf("body not rewritten: %s", hc.Body)
+	}
+
+	hc = hookContext("POST", "http://localhost/v1/responses", `{}`)
+	hc.Request.Header.Set("X-Block", "1")
+	err = s.OnRequest(hc)
+	var he *proxy.HookError
+	if !errors.As(err, &he) || he.Status != 418 || he.Message != "blocked by script" {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+
+	// other routes are untouched
+	hc = hookContext("GET", "http://localhost/v1/models", "")
+	hc.Request.Header.Set("X-Block", "1")
+	if err := s.OnRequest(hc); err != nil || hc.Request.Header.Get("X-Script") != "" {
+		t.Fatalf("script applied to unmatched route: %v", err)
+	}
+}
+
+func TestOnAccountAndResponse(t *testing.T) {
+	s, err := Load("t.lua", `
+function on_account(req, account)
+  return account.type ~= "chatgpt"
+end
+function on_response(req, resp)
+  resp.headers["X-Status"] = tostring(resp.status)
+end
+`, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := hookContext("GET", "http://localhost/v1/models", "")
+	if err := s.OnAccountSelected(hc, &account.Account{ID: 1, Type: account.ChatGPTAccount}); err == nil {
+		t.Fatalf("expected chatgpt account to be skipped")
+	}
+	if err := s.OnAccountSelected(hc, &account.Account{ID: 2, Type: account.APIKeyAccount}); err != nil {
+		t.Fatalf("api key account skipped: %v", err)
+	}
+	resp := &http.Response{StatusCode: 201, Header: http.Header{}}
+	if err := s.OnResponse(hc, resp); err != nil || resp.Header.Get("X-Status") != "201" {
+		t.Fatalf("response header not set: %v %v", err, resp.Header)
+	}
+}
+
+func TestSandboxAndLimits(t *testing.T) {
+	if _, err := Load("bad.lua", `os.exit(1)`, Limits{}); err == nil {
+		t.Fatalf("os library should not be available")
+	}
+	s, err := Load("loop.lua", `
+function on_request(req)
+  while true do end
+end
+`, Limits{Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := hookContext("GET", "http://localhost/v1/models", "")
+	start := time.Now()
+	if err := s.OnRequest(hc); err != nil {
+		t.Fatalf("script errors must fail open: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout not enforced")
+	}
+	// the pool recovers after a discarded state
+	if err := s.OnRequest(hc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	// 2^40 is 1<<40; Lua 5.1 has no shift operator.
+	start := time.Now()
+	if _, err := Load("rep.lua", `local s = string.rep("x", 2^40)`, Limits{}); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Fatalf("expected string.rep to be refused, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("string.rep was not refused up front")
+	}
+	limits := Limits{MaxMemory: 1 << 10}
+	if _, err := Load("format.lua", `local s = string.format("%999999999d", 1)`, limits); err == nil {
+		t.Error("expected a width of 999999999 to be refused")
+	}
+	for name, src := range map[string]string{
+		"gsub":      `local s = string.gsub(string.rep("x", 100), "x", string.rep("y", 100))`,
+		"concat":    `local t = {} for i = 1, 100 do t[i] = string.rep("x", 100) end local s = table.concat(t)`,
+		"..":        `local s = "x" for i = 1, 40 do s = s .. s end`,
+		"nested ..": `function f(s) return s .. s .. "!" end local s = "x" for i = 1, 40 do s = f(s) end`,
+		"many":      `local t = {} for i = 1, 100 do t[i] = string.rep("x", 100) end`,
+		"upper":     `local t = {} local s = string.rep("x", 100) for i = 1, 100 do t[i] = s:upper() end`,
+	} {
+		if _, err := Load(name+".lua", src, limits); err == nil || !strings.Contains(err.Error(), "memory limit") {
+			t.Errorf("%s: expected the memory limit, got %v", name, err)
+		}
+	}
+
+	// The limit is per call.
+	s, err := Load("calls.lua", `
+function on_request(req)
+  req.headers["X-Len"] = tostring(#(string.rep("x", 400) .. "y"))
+end
+`, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		hc := hookContext("GET", "http://localhost/v1/models", "")
+		if s.OnRequest(hc); hc.Request.Header.Get("X-Len") != "401" {
+			t.Fatalf("call failed: %v", hc.Request.Header)
+		}
+	}
+
+	s, err = Load("ok.lua", `
+a = string.gsub("hello world", "(o)(%s?)", "[%1%%%2]")
+b = string.gsub("$x $y $z", "%$(%w)", {x = "1", y = false})
+c, n = string.gsub("abc", ".", function(c) if c ~= "b" then return c:upper() end end)
+d = string.format("%5.2f|%-3s|%%", 1, "a")
+e = table.concat({"a", "b", "c"}, ",", 2)
+f = 1 .. "|" .. 2.5
+g = setmetatable({}, {__concat = function(a, b) return "meta" end}) .. "x"
+`, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L := s.pool.Get().(*state).L
+	defer L.Close()
+	for name, want := range map[string]string{"a": "hell[o% ]w[o%]rld", "b": "1 $y $z", "c": "AbC", "n": "3", "d": " 1.00|a  |%", "e": "b,c", "f": "1|2.5", "g": "meta"} {
+		if got := L.GetGlobal(name).String(); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGlobalsReset(t *testing.T) {
+	s, err := Load("state.lua", `
+seen = {}
+function on_request(req)
+  calls = (calls or 0) + 1
+  table.insert(seen, req.path)
+  req.headers["X-Calls"] = tostring(calls) .. "/" .. #seen .. "/" .. string.upper("a")
+  string.upper = function() return "leaked" end
+  setmetatable(_G, {__index = function() return "leaked" end})
+end
+`, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		hc := hookContext("GET", "http://localhost/v1/models", "")
+		if s.OnRequest(hc); hc.Request.Header.Get("X-Calls") != "1/1/A" {
+			t.Fatalf("state leaked between calls: %v", hc.Request.Header)
+		}
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "b.lua"), []byte(`x = 1`), 0644)
+	os.WriteFile(filepath.Join(dir, "a.lua"), []byte(`y = 2`), 0644)
+	os.WriteFile(filepath.Join(dir, "README"), []byte(`not lua`), 0644)
+	scripts, err := LoadDir(dir, Limits{})
+	if err != nil || len(scripts) != 2 || scripts[0].Name != "a.lua" {
+		t.Fatalf("unexpected scripts: %v %v", scripts, err)
+	}
+}
@@ -0,0 +1,294 @@
+package script
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+// budget counts the bytes of the strings a call builds against
+// Limits.MaxMemory. Strings count as they are built, so ones the call
+// drops again still count.
+type budget struct {
+	max, used int
+}
+
+// charge adds n bytes, raising an error in L once the total exceeds max.
+func (b *budget) charge(L *lua.LState, n int) {
+	if n > b.max-b.used {
+		L.RaiseError("script exceeds its memory limit of %d bytes", b.max)
+	}
+	b.used += n
+}
+
+// left returns the bytes still available.
+func (b *budget) left() int { return b.max - b.used }
+
+// concatName is the local holding concat in every compiled script; see
+// rewriteConcat.
+const concatName = "__concat"
+
+// rewriteConcat replaces every a .. b in chunk by a call concat(a, b), as
+// gopher-lua concatenates strings without any hook, and prepends the local
+// holding concat. The local is set from the global of the same name, which
+// newState removes once the chunk ran.
+func rewriteConcat(chunk []ast.Stmt) []ast.Stmt {
+	rewrite(reflect.ValueOf(chunk))
+	local := &ast.LocalAssignStmt{Names: []string{concatName}, Exprs: []ast.Expr{&ast.IdentExpr{Value: concatName}}}
+	return append([]ast.Stmt{local}, chunk...)
+}
+
+func rewrite(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			rewrite(v.Index(i))
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		rewrite(v.Elem())
+		if c, ok := v.Interface().(*ast.StringConcatOpExpr); ok && v.Kind() == reflect.Interface {
+			fn := &ast.IdentExpr{Value: concatName}
+			fn.SetLine(c.Line())
+			call := &ast.FuncCallExpr{Func: fn, Args: []ast.Expr{c.Lhs, c.Rhs}, AdjustRet: true}
+			call.SetLine(c.Line())
+			call.SetLastLine(c.LastLine())
+			v.Set(reflect.ValueOf(call))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				rewrite(v.Field(i))
+			}
+		}
+	}
+}
+
+// concat is the .. operator charging the budget for the strings it
+// builds. Other operands go to their __concat metamethod as in gopher-lua.
+func concat(b *budget) lua.LGFunction {
+	return func(L *lua.LState) int {
+		lhs, rhs := L.Get(1), L.Get(2)
+		if lua.LVCanConvToString(lhs) && lua.LVCanConvToString(rhs) {
+			l, r := lua.LVAsString(lhs), lua.LVAsString(rhs)
+			b.charge(L, len(l)+len(r))
+			L.Push(lua.LString(l + r))
+			return 1
+		}
+		op := L.GetMetaField(lhs, "__concat")
+		if op == lua.LNil {
+			op = L.GetMetaField(rhs, "__concat")
+		}
+		if op.Type() != lua.LTFunction {
+			L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type(), rhs.Type())
+		}
+		L.Push(op)
+		L.Push(lhs)
+		L.Push(rhs)
+		L.Call(2, 1)
+		return 1
+	}
+}
+
+// limitStrings installs concat and replaces the library functions that
+// build strings with ones charging b before they allocate: gopher-lua has
+// no allocation limit, and the call timeout cannot interrupt a Go builtin
+// once it is running.
+func limitStrings(L *lua.LState, b *budget) {
+	L.SetGlobal(concatName, L.NewFunction(concat(b)))
+	str := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	L.SetField(str, "rep", L.NewFunction(func(L *lua.LState) int {
+		s := L.CheckString(1)
+		n := L.CheckInt(2)
+		if n <= 0 || s == "" {
+			L.Push(lua.LString(""))
+			return 1
+		}
+		if n > b.left()/len(s) {
+			L.RaiseError("string.rep result exceeds the memory limit of %d bytes", b.max)
+		}
+		b.charge(L, n*len(s))
+		L.Push(lua.LString(strings.Repeat(s, n)))
+		return 1
+	}))
+	L.SetField(str, "gsub", L.NewFunction(func(L *lua.LState) int { return gsub(L, b) }))
+	for _, name := range []string{"upper", "lower", "reverse"} {
+		fn := L.GetField(str, name).(*lua.LFunction)
+		L.SetField(str, name, L.NewFunction(func(L *lua.LState) int {
+			b.charge(L, len(L.CheckString(1)))
+			return call(L, fn)
+		}))
+	}
+	format := L.GetField(str, "format").(*lua.LFunction)
+	L.SetField(str, "format", L.NewFunction(func(L *lua.LState) int {
+		if err := checkFormat(L.CheckString(1)); err != nil {
+			L.RaiseError("%v", err)
+		}
+		n := call(L, format)
+		b.charge(L, len(L.ToString(-1)))
+		return n
+	}))
+
+	tbl := L.GetGlobal(lua.TabLibName).(*lua.LTable)
+	tconcat := L.GetField(tbl, "concat").(*lua.LFunction)
+	L.SetField(tbl, "concat", L.NewFunction(func(L *lua.LState) int {
+		t := L.CheckTable(1)
+		sep := L.OptString(2, "")
+		i := max(L.OptInt(3, 1), 1)
+		j := min(L.OptInt(4, t.Len()), t.Len())
+		size := 0
+		for k := i; k <= j; k++ {
+			if v := t.RawGetInt(k); lua.LVCanConvToString(v) {
+				size += len(lua.LVAsString(v))
+			}
+			if k < j {
+				size += len(sep)
+			}
+			if size > b.left() {
+				L.RaiseError("table.concat result exceeds the memory limit of %d bytes", b.max)
+			}
+		}
+		b.charge(L, size)
+		return call(L, tconcat)
+	}))
+}
+
+// call calls fn with the arguments of the running function and returns its
+// single result.
+func call(L *lua.LState, fn *lua.LFunction) int {
+	L.Push(fn)
+	top := L.GetTop()
+	for i := 1; i < top; i++ {
+		L.Push(L.Get(i))
+	}
+	L.Call(top-1, 1)
+	return 1
+}
+
+// checkFormat rejects string.format directives whose width or precision
+// has more than two digits, as the reference Lua implementation does;
+// gopher-lua hands them to fmt, which pads to any width.
+func checkFormat(f string) error {
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(f) && f[i] == '%' {
+			continue
+		}
+		for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+			i++
+		}
+		digits := func() bool {
+			start := i
+			for i < len(f) && f[i] >= '0' && f[i] <= '9' {
+				i++
+			}
+			return i-start <= 2
+		}
+		ok := digits()
+		if ok && i < len(f) && f[i] == '.' {
+			i++
+			ok = digits()
+		}
+		if !ok {
+			return fmt.Errorf("invalid format (width or precision too long)")
+		}
+	}
+	return nil
+}
+
+// gsub is string.gsub building its result in one pass and failing once it
+// exceeds what is left of b. gopher-lua's own copies the whole string for
+// every match. Replacement strings, tables and functions behave as in
+// gopher-lua.
+func gsub(L *lua.LState, b *budget) int {
+	src := L.CheckString(1)
+	pat := L.CheckString(2)
+	L.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	repl := L.Get(3)
+	limit := L.OptInt(4, -1)
+	mds, err := pm.Find(pat, []byte(src), 0, limit)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	var sb strings.Builder
+	write := func(s string) {
+		if sb.Len()+len(s) > b.left() {
+			L.RaiseError("string.gsub result exceeds the memory limit of %d bytes", b.max)
+		}
+		sb.WriteString(s)
+	}
+	capture := func(md *pm.MatchData, idx int) lua.LValue {
+		if idx >= md.CaptureLength() {
+			if idx != 2 {
+				L.RaiseError("invalid capture index")
+			}
+			idx = 0
+		}
+		if md.IsPosCapture(idx) {
+			return lua.LNumber(md.Capture(idx))
+		}
+		return lua.LString(src[md.Capture(idx):md.Capture(idx+1)])
+	}
+	last := 0
+	for _, md := range mds {
+		start, end := md.Capture(0), md.Capture(1)
+		write(src[last:start])
+		last = end
+		switch r := repl.(type) {
+		case lua.LString:
+			s := string(r)
+			for i := 0; i < len(s); i++ {
+				switch {
+				case s[i] != '%' || i == len(s)-1:
+					write(s[i : i+1])
+				case s[i+1] == '%':
+					write("%")
+					i++
+				case s[i+1] >= '0' && s[i+1] <= '9':
+					write(lua.LVAsString(capture(md, 2*int(s[i+1]-'0'))))
+					i++
+				default:
+					write(s[i : i+2])
+					i++
+				}
+			}
+			continue
+		case *lua.LTable:
+			v := L.GetTable(r, capture(md, 2))
+			if !lua.LVIsFalse(v) {
+				write(lua.LVAsString(v))
+				continue
+			}
+		case *lua.LFunction:
+			var args []lua.LValue
+			for i := 2; i < md.CaptureLength(); i += 2 {
+				args = append(args, capture(md, i))
+			}
+			if len(args) == 0 {
+				args = append(args, capture(md, 0))
+			}
+			L.CallByParam(lua.P{Fn: r, NRet: 1, Protect: false}, args...)
+			v := L.Get(-1)
+			L.Pop(1)
+			if !lua.LVIsFalse(v) {
+				write(lua.LVAsString(v))
+				continue
+			}
+		}
+		write(src[start:end])
+	}
+	write(src[last:])
+	b.charge(L, sb.Len())
+	L.Push(lua.LString(sb.String()))
+	L.Push(lua.LNumber(len(mds)))
+	return 2
+}
@@ -0,0 +1,266 @@
+// Package sentry reports problems to a Sentry-compatible server (Sentry,
+// GlitchTip and others accepting the envelope API) without the Sentry SDK.
+// A Reporter subscribes to the event bus and sends panics, ChatGPT token
+// refresh failures and repeated failures to serve requests, tagged with the
+// account and request they concern.
+package sentry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// queueSize bounds the reports waiting to be sent; later ones are dropped.
+const queueSize = 100
+
+// Reporter sends error reports to the project identified by a DSN.
+type Reporter struct {
+	// Accounts resolves account IDs to names for the report tags; nil tags
+	// reports with the ID only.
+	Accounts *account.Manager
+	// Environment and ServerName are attached to every report.
+	Environment string
+	ServerName  string
+	// Threshold RequestFailed events for the same account within Window
+	// make one report; further failures are not reported until Window has
+	// passed since it. Refresh failures are reported at most once per
+	// account and Window.
+	Threshold int
+	Window    time.Duration
+	Client    *http.Client
+
+	endpoint string
+	auth     string
+	dsn      string
+	queue    chan []byte
+	now      func() time.Time
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	reported map[string]time.Time
+}
+
+// Event is a report sent to Sentry.
+type Event struct {
+	ID        string            `json:"event_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Platform  string            `json:"platform"`
+	Level     string            `json:"level"`
+	Logger    string            `json:"logger"`
+	Message   string            `json:"message"`
+	Exception *exceptions       `json:"exception,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Extra     map[string]any    `json:"extra,omitempty"`
+	// Environment and ServerName are filled in by the Reporter.
+	Environment string `json:"environment,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+type exceptions struct {
+	Values []exception `json:"values"`
+}
+
+type exception struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// New creates a Reporter for dsn, e.g. "https://key@o1.ingest.sentry.io/42".
+func New(dsn string) (*Reporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse DSN: %w", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("DSN has no public key")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	project := path[i+1:]
+	if _, err := strconv.Atoi(project); err != nil {
+		return nil, fmt.Errorf("DSN has no project ID: %q", project)
+	}
+	host, _ := os.Hostname()
+	return &Reporter{
+		Threshold:  5,
+		Window:     10 * time.Minute,
+		ServerName: host,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		endpoint:   u.Scheme + "://" + u.Host + path[:i] + "/api/" + project + "/envelope/",
+		auth:       "Sentry sentry_version=7, sentry_client=codex-companion/1.0, sentry_key=" + u.User.Username(),
+		dsn:        dsn,
+		queue:      make(chan []byte, queueSize),
+		now:        time.Now,
+		failures:   make(map[string][]time.Time),
+		reported:   make(map[string]time.Time),
+	}, nil
+}
+
+// Subscribe reports the relevant events published on bus. It returns the
+// unsubscribe function.
+func (r *Reporter) Subscribe(bus *events.Bus) func() {
+	return bus.Subscribe(r.handle, events.Panic, events.RefreshFailed, events.RequestFailed)
+}
+
+func (r *Reporter) handle(e events.Event) {
+	ev := Event{Level: "error", Message: e.Message, Tags: map[string]string{"event": string(e.Type)}, Extra: map[string]any{}}
+	for k, v := range e.Data {
+		switch k {
+		case "request_id", "path", "status":
+			ev.Tags[k] = fmt.Sprint(v)
+		default:
+			ev.Extra[k] = v
+		}
+	}
+	if e.AccountID != 0 {
+		ev.Tags["account_id"] = strconv.FormatInt(e.AccountID, 10)
+		if r.Accounts != nil {
+			if a, err := r.Accounts.Get(context.Background(), e.AccountID); err == nil && a != nil {
+				ev.Tags["account"] = a.Name
+			}
+		}
+	}
+	key := strconv.FormatInt(e.AccountID, 10)
+	switch e.Type {
+	case events.Panic:
+		ev.Level = "fatal"
+		ev.Exception = &exceptions{[]exception{{Type: "panic", Value: e.Message}}}
+	case events.RefreshFailed:
+		if !r.due("refresh:" + key) {
+			return
+		}
+		ev.Message = "token refresh failed: " + e.Message
+	case events.RequestFailed:
+		n, ok := r.repeated("request:" + key)
+		if !ok {
+			return
+		}
+		ev.Message = fmt.Sprintf("%d requests failed within %s: %s", n, r.Window, e.Message)
+	}
+	r.Capture(ev)
+}
+
+// due reports whether key was not reported within Window and marks it
+// reported.
+func (r *Reporter) due(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if last, ok := r.reported[key]; ok && now.Sub(last) < r.Window {
+		return false
+	}
+	r.reported[key] = now
+	return true
+}
+
+// repeated records a failure for key and reports whether Threshold of them
+// occurred within Window and no report was made for key within Window.
+func (r *Reporter) repeated(key string) (int, bool) {
+	r.mu.Lock()
+	now := r.now()
+	recent := r.failures[key][:0]
+	for _, t := range r.failures[key] {
+		if now.Sub(t) < r.Window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	r.failures[key] = recent
+	n := len(recent)
+	r.mu.Unlock()
+	if n < r.Threshold {
+		return n, false
+	}
+	return n, r.due(key)
+}
+
+// Capture queues ev to be sent. It never blocks: reports are dropped while
+// the queue is full.
+func (r *Reporter) Capture(ev Event) {
+	if ev.ID == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		ev.ID = hex.EncodeToString(b)
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = r.now()
+	}
+	ev.Platform, ev.Logger = "go", "codex-companion"
+	ev.Environment, ev.ServerName = r.Environment, r.ServerName
+	envelope, err := r.envelope(ev)
+	if err != nil {
+		logger.Errorf("encode error report: %v", err)
+		return
+	}
+	select {
+	case r.queue <- envelope:
+	default:
+		logger.Warnf("error report queue full, dropping report")
+	}
+}
+
+// envelope encodes ev in the envelope format: an envelope header, an item
+// header and the event, one JSON document per line.
+func (r *Reporter) envelope(ev Event) ([]byte, error) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(map[string]any{"event_id": ev.ID, "sent_at": r.now().UTC().Format(time.RFC3339), "dsn": r.dsn})
+	enc.Encode(map[string]any{"type": "event", "length": len(payload)})
+	buf.Write(payload)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Start sends queued reports until ctx is done.
+func (r *Reporter) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case envelope := <-r.queue:
+				if err := r.send(ctx, envelope); err != nil {
+					logger.Warnf("send error report: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *Reporter) send(ctx context.Context, envelope []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package sentry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+)
+
+// sentryServer records the events posted to the envelope endpoint of
+// project 42.
+func sentryServer(t *testing.T) (*httptest.Server, chan Event) {
+	t.Helper()
+	got := make(chan Event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=pub") {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		b, _ := io.ReadAll(r.Body)
+		lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+		if len(lines) != 3 {
+			t.Errorf("envelope has %d lines: %s", len(lines), b)
+			return
+		}
+		var item struct {
+			Type   string `json:"type"`
+			Length int    `json:"length"`
+		}
+		json.Unmarshal(lines[1], &item)
+		if item.Type != "event" || item.Length != len(lines[2]) {
+			t.Errorf("unexpected item header %s", lines[1])
+		}
+		var ev Event
+		json.Unmarshal(lines[2], &ev)
+		got <- ev
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func newReporter(t *testing.T, srv *httptest.Server) *Reporter {
+	t.Helper()
+	dsn := strings.Replace(srv.URL, "http://", "http://pub@", 1) + "/prefix/42"
+	r, err := New(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	r.Start(ctx)
+	return r
+}
+
+func receive(t *testing.T, got chan Event) Event {
+	t.Helper()
+	select {
+	case ev := <-got:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no report received")
+	}
+	return Event{}
+}
+
+func TestNewInvalidDSN(t *testing.T) {
+	for _, dsn := range []string{"https://o1.ingest.sentry.io/42", "https://key@o1.ingest.sentry.io/", "://"} {
+		if _, err := New(dsn); err == nil {
+			t.Fatalf("expected error for %q", dsn)
+		}
+	}
+}
+
+func TestReportPanic(t *testing.T) {
+	srv, got := sentryServer(t)
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
+	a, _ := mgr.AddAPIKey(context.Background(), "home", "k", "", 1)
+	r := newReporter(t, srv)
+	r.Accounts = mgr
+	r.Environment = "test"
+	bus := events.NewBus()
+	defer r.Subscribe(bus)()
+
+	bus.Publish(events.Event{Type: events.Panic, AccountID: a.ID, Message: "boom", Data: map[string]any{"request_id": "req-1", "stack": "goroutine 1"}})
+	ev := receive(t, got)
+	if ev.Level != "fatal" || ev.Exception == nil || ev.Exception.Values[0].Value != "boom" || ev.Environment != "test" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if ev.Tags["account"] != "home" || ev.Tags["request_id"] != "req-1" || ev.Extra["stack"] != "goroutine 1" {
+		t.Fatalf("unexpected context %+v %+v", ev.Tags, ev.Extra)
+	}
+}
+
+func TestReportRepeatedFailures(t *testing.T) {
+	srv, got := sentryServer(t)
+	r := newReporter(t, srv)
+	r.Threshold = 3
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	fail := events.Event{Type: events.RequestFailed, AccountID: 1, Message: "upstream error"}
+	for range 2 {
+		r.handle(fail)
+	}
+	if len(r.queue) != 0 {
+		t.Fatal("reported below threshold")
+	}
+	r.handle(fail)
+	ev := receive(t, got)
+	if !strings.HasPrefix(ev.Message, "3 requests failed") || ev.Tags["account_id"] != "1" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	// Further failures within the window are not reported again.
+	r.handle(fail)
+	r.handle(events.Event{Type: events.RefreshFailed, AccountID: 1, Message: "invalid_grant"})
+	r.handle(events.Event{Type: events.RefreshFailed, AccountID: 1, Message: "invalid_grant"})
+	if ev := receive(t, got); ev.Message != "token refresh failed: invalid_grant" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	now = now.Add(r.Window)
+	r.handle(events.Event{Type: events.RefreshFailed, AccountID: 1, Message: "invalid_grant"})
+	receive(t, got)
+	select {
+	case ev := <-got:
+		t.Fatalf("unexpected extra report %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
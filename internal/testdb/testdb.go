@@ -0,0 +1,25 @@
+// Package testdb opens the SQLite databases of tests exercising SQL
+// stores. Tests that only need accounts or logs use the in-memory stores
+// instead, see account.NewMemoryStore and log.NewMemoryStore.
+package testdb
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// Open returns an in-memory database named after t and closed when t
+// ends. Every connection of the pool, and every Open in the same test,
+// shares it.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
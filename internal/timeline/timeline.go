@@ -0,0 +1,221 @@
+// Package timeline records every transition of an account out of and back
+// into rotation published on the event bus, so the admin UI can show which
+// accounts keep hitting their limits and when.
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Kinds of transitions. All but KindReactivated take the account out of
+// rotation.
+const (
+	KindExhausted    = "exhausted"
+	KindBlocked      = "billing_blocked"
+	KindQuarantined  = "quarantined"
+	KindInvalidToken = "invalid_token"
+	KindReactivated  = "reactivated"
+)
+
+// kinds maps the recorded event types to their transition kinds.
+var kinds = map[events.Type]string{
+	events.AccountExhausted:      KindExhausted,
+	events.AccountBillingBlocked: KindBlocked,
+	events.AccountQuarantined:    KindQuarantined,
+	events.AccountInvalidToken:   KindInvalidToken,
+	events.AccountReactivated:    KindReactivated,
+}
+
+// Transition is an account leaving or returning to rotation. Until is when
+// an account taken out of rotation was expected back, if known.
+type Transition struct {
+	ID        int64     `json:"id"`
+	AccountID int64     `json:"account_id"`
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Reason    string    `json:"reason,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+}
+
+// Period is a span an account spent out of rotation, named after the
+// transition that started it. Ongoing periods end now.
+type Period struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Kind    string    `json:"kind"`
+	Reason  string    `json:"reason,omitempty"`
+	Ongoing bool      `json:"ongoing,omitempty"`
+}
+
+// Store keeps transitions in the account_transitions table.
+type Store struct {
+	db *sql.DB
+	// Retention is how long transitions are kept.
+	Retention time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// New creates a Store and ensures its table exists.
+func New(db *sql.DB) (*Store, error) {
+	s := &Store{db: db, Retention: 90 * 24 * time.Hour, now: time.Now}
+	if err := s.init(); err != nil {
+		logger.Errorf("init account_transitions table failed: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) init() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS account_transitions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        account_id INTEGER NOT NULL,
+        time INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        reason TEXT NOT NULL DEFAULT '',
+        until INTEGER
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS account_transitions_account ON account_transitions(account_id, time)`)
+	return err
+}
+
+// Subscribe records the transition events published on bus. It returns
+// the function cancelling the subscription.
+func (s *Store) Subscribe(bus *events.Bus) func() {
+	return bus.Subscribe(s.handle, events.AccountExhausted, events.AccountBillingBlocked, events.AccountQuarantined, events.AccountInvalidToken, events.AccountReactivated)
+}
+
+func (s *Store) handle(e events.Event) {
+	t := &Transition{AccountID: e.AccountID, Time: e.Time, Kind: kinds[e.Type], Reason: e.Message}
+	t.Until, _ = e.Data["reset_at"].(time.Time)
+	if err := s.Record(context.Background(), t); err != nil {
+		logger.Warnf("record %s transition of account %d: %v", t.Kind, t.AccountID, err)
+	}
+}
+
+// Record stores t and prunes transitions older than Retention at most once
+// an hour.
+func (s *Store) Record(ctx context.Context, t *Transition) error {
+	var until any
+	if !t.Until.IsZero() {
+		until = t.Until.UnixMilli()
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO account_transitions(account_id, time, kind, reason, until) VALUES(?,?,?,?,?)`,
+		t.AccountID, t.Time.UnixMilli(), t.Kind, t.Reason, until)
+	if err != nil {
+		logger.Errorf("insert account transition failed: %v", err)
+		dbhealth.RecordWriteError("account_transitions")
+		return err
+	}
+	t.ID, _ = res.LastInsertId()
+	s.prune(ctx)
+	return nil
+}
+
+func (s *Store) prune(ctx context.Context) {
+	now := s.now()
+	s.mu.Lock()
+	due := now.Sub(s.lastPrune) >= time.Hour
+	if due {
+		s.lastPrune = now
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	cutoff := now.Add(-s.Retention).UnixMilli()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM account_transitions WHERE time < ?`, cutoff); err != nil {
+		logger.Errorf("prune account transitions: %v", err)
+	}
+}
+
+const columns = `id, account_id, time, kind, reason, until`
+
+// History returns the transitions of an account made at or after since,
+// oldest first, and the last one before since, nil when there is none,
+// which tells the state the account was in at since.
+func (s *Store) History(ctx context.Context, accountID int64, since time.Time) ([]Transition, *Transition, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+columns+` FROM account_transitions WHERE account_id=? AND time>=? ORDER BY time, id`, accountID, since.UnixMilli())
+	if err != nil {
+		logger.Errorf("query account transitions failed: %v", err)
+		return nil, nil, err
+	}
+	res, err := scan(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err = s.db.QueryContext(ctx, `SELECT `+columns+` FROM account_transitions WHERE account_id=? AND time<? ORDER BY time DESC, id DESC LIMIT 1`, accountID, since.UnixMilli())
+	if err != nil {
+		logger.Errorf("query account transitions failed: %v", err)
+		return nil, nil, err
+	}
+	before, err := scan(rows)
+	if err != nil || len(before) == 0 {
+		return res, nil, err
+	}
+	return res, &before[0], nil
+}
+
+func scan(rows *sql.Rows) ([]Transition, error) {
+	defer rows.Close()
+	res := []Transition{}
+	for rows.Next() {
+		var t Transition
+		var at int64
+		var until sql.NullInt64
+		if err := rows.Scan(&t.ID, &t.AccountID, &at, &t.Kind, &t.Reason, &until); err != nil {
+			logger.Errorf("scan account transition failed: %v", err)
+			return nil, err
+		}
+		t.Time = time.UnixMilli(at)
+		if until.Valid {
+			t.Until = time.UnixMilli(until.Int64)
+		}
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+// Periods returns the spans out of rotation between since and now that the
+// transitions, oldest first, describe; before is the last transition before
+// since, if any. A reactivation without a matching earlier transition, such
+// as the end of a maintenance window, starts no period. Repeated
+// transitions out of rotation extend the current period, which takes the
+// latest kind and reason.
+func Periods(transitions []Transition, before *Transition, since, now time.Time) []Period {
+	res := []Period{}
+	var open *Period
+	if before != nil && before.Kind != KindReactivated {
+		open = &Period{Start: since, Kind: before.Kind, Reason: before.Reason}
+	}
+	for _, t := range transitions {
+		switch {
+		case t.Kind == KindReactivated && open != nil:
+			open.End = t.Time
+			res = append(res, *open)
+			open = nil
+		case t.Kind == KindReactivated:
+		case open == nil:
+			open = &Period{Start: t.Time, Kind: t.Kind, Reason: t.Reason}
+		default:
+			open.Kind, open.Reason = t.Kind, t.Reason
+		}
+	}
+	if open != nil {
+		open.End, open.Ongoing = now, true
+		res = append(res, *open)
+	}
+	return res
+}
@@ -0,0 +1,74 @@
+package timeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func setupStore(t *testing.T) *Store {
+	t.Helper()
+	db := testdb.Open(t)
+	s, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSubscribeRecordsTransitions(t *testing.T) {
+	s := setupStore(t)
+	bus := events.NewBus()
+	unsub := s.Subscribe(bus)
+	reset := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	bus.Publish(events.Event{Type: events.AccountExhausted, AccountID: 1, Data: map[string]any{"reset_at": reset}})
+	bus.Publish(events.Event{Type: events.AccountReactivated, AccountID: 1, Message: "warm-up probe succeeded"})
+	bus.Publish(events.Event{Type: events.AccountQuarantined, AccountID: 2, Message: "3 consecutive 403"})
+	bus.Publish(events.Event{Type: events.TokenRefreshed, AccountID: 1})
+	unsub()
+
+	ctx := context.Background()
+	list, before, err := s.History(ctx, 1, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != nil || len(list) != 2 {
+		t.Fatalf("unexpected transitions %+v before %+v", list, before)
+	}
+	if list[0].Kind != KindExhausted || !list[0].Until.Equal(reset) || list[1].Kind != KindReactivated || list[1].Reason != "warm-up probe succeeded" || !list[1].Until.IsZero() {
+		t.Fatalf("unexpected transitions %+v", list)
+	}
+	if list, before, err = s.History(ctx, 1, time.Now().Add(time.Hour)); err != nil || len(list) != 0 || before == nil || before.Kind != KindReactivated {
+		t.Fatalf("expected the reactivation before the period, got %+v %+v %v", list, before, err)
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return since.Add(time.Duration(h) * time.Hour) }
+	now := at(24)
+	transitions := []Transition{
+		{Time: at(1), Kind: KindReactivated},
+		{Time: at(2), Kind: KindReactivated, Reason: "maintenance ended"},
+		{Time: at(5), Kind: KindExhausted},
+		{Time: at(6), Kind: KindBlocked, Reason: "insufficient_quota"},
+		{Time: at(8), Kind: KindReactivated},
+		{Time: at(20), Kind: KindQuarantined, Reason: "3 consecutive 403"},
+	}
+	got := Periods(transitions, &Transition{Kind: KindExhausted}, since, now)
+	want := []Period{
+		{Start: since, End: at(1), Kind: KindExhausted},
+		{Start: at(5), End: at(8), Kind: KindBlocked, Reason: "insufficient_quota"},
+		{Start: at(20), End: now, Kind: KindQuarantined, Reason: "3 consecutive 403", Ongoing: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("periods %+v", got)
+	}
+	if got := Periods(nil, nil, since, now); len(got) != 0 {
+		t.Fatalf("periods without transitions %+v", got)
+	}
+}
@@ -0,0 +1,173 @@
+// Package tokenizer estimates how many tokens a model reads from a text or
+// a request body, for showing prompt sizes when the upstream reports no
+// usage. It has no vocabulary: text is split the way tiktoken's o200k_base
+// pre-tokenizer splits it, into words with a leading space or symbol,
+// digit groups of at most three, symbol runs and whitespace, and each piece
+// is costed from its length and script. Counts come close to tiktoken's on
+// English prose and code but are estimates, not a basis for billing.
+package tokenizer
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// Estimate returns the estimated number of tokens of text.
+func Estimate(text string) int {
+	rs := []rune(text)
+	n := 0
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case isLetter(r) || (r == ' ' || !unicode.IsSpace(r) && !unicode.IsNumber(r)) && i+1 < len(rs) && isLetter(rs[i+1]):
+			// A word, taking along one leading space or symbol.
+			j := i + 1
+			for j < len(rs) && isLetter(rs[j]) {
+				j++
+			}
+			n += wordTokens(rs[i:j])
+			i = j
+		case unicode.IsNumber(r):
+			j := i
+			for j < len(rs) && unicode.IsNumber(rs[j]) {
+				j++
+			}
+			n += (j - i + 2) / 3
+			i = j
+		case unicode.IsSpace(r):
+			j := i
+			for j < len(rs) && unicode.IsSpace(rs[j]) {
+				j++
+			}
+			// The last space of a run before a word belongs to the word.
+			if j < len(rs) && j-1 > i && rs[j-1] == ' ' && isLetter(rs[j]) {
+				j--
+			}
+			n++
+			i = j
+		default:
+			j := i
+			for j < len(rs) && !isLetter(rs[j]) && !unicode.IsNumber(rs[j]) && !unicode.IsSpace(rs[j]) {
+				j++
+			}
+			// Common symbol pairs such as "()" or "\":" are single tokens.
+			n += (j - i + 1) / 2
+			i = j
+		}
+	}
+	return n
+}
+
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r)
+}
+
+// wordTokens costs a word, which may start with a space or a symbol. Short
+// Latin words are mostly in the vocabulary; longer ones split into pieces
+// of about four letters. CJK text takes about a token per character, other
+// scripts about one per three letters.
+func wordTokens(w []rune) int {
+	latin, cjk, other := 0, 0, 0
+	for _, r := range w {
+		switch {
+		case !isLetter(r):
+		case r < unicode.MaxASCII || unicode.Is(unicode.Latin, r):
+			latin++
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			cjk++
+		default:
+			other++
+		}
+	}
+	n := cjk + (other+2)/3
+	switch {
+	case latin == 0:
+	case latin <= 6:
+		n++
+	default:
+		n += (latin + 3) / 4
+	}
+	return max(n, 1)
+}
+
+// Per-message overheads of the chat format, as counted by OpenAI's
+// guidance for tiktoken: every message is framed by a few tokens and the
+// reply is primed with a few more.
+const (
+	messageTokens = 3
+	replyTokens   = 3
+)
+
+// schemaKeys hold tool and output definitions, which the model reads as
+// JSON text, keys included.
+var schemaKeys = map[string]bool{"tools": true, "functions": true, "response_format": true, "text": true}
+
+// skipKeys hold request parameters and identifiers the model does not read
+// as text, encrypted reasoning and file or image references.
+var skipKeys = map[string]bool{
+	"model": true, "type": true, "role": true, "id": true, "call_id": true, "status": true,
+	"tool_choice": true, "previous_response_id": true, "prompt_cache_key": true, "user": true,
+	"safety_identifier": true, "service_tier": true, "metadata": true, "encrypted_content": true,
+	"image_url": true, "file_id": true, "file_data": true, "file_url": true, "detail": true,
+}
+
+// EstimateRequest returns the estimated input tokens of a JSON request
+// body of the Responses API, Chat Completions, completions or embeddings:
+// the text of its instructions, messages, input items and prompt, its tool
+// definitions and the framing of its messages. Images and files are not
+// counted. Bodies that are not JSON objects count as text.
+func EstimateRequest(body []byte) int {
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil || m == nil {
+		return Estimate(string(body))
+	}
+	n := 0
+	for _, key := range []string{"messages", "input"} {
+		if items, ok := m[key].([]any); ok && len(items) > 0 {
+			n += len(items)*messageTokens + replyTokens
+		}
+	}
+	return n + value("", m)
+}
+
+// value estimates the tokens of v found under key.
+func value(key string, v any) int {
+	if skipKeys[key] {
+		return 0
+	}
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "data:") {
+			return 0
+		}
+		return Estimate(v)
+	case map[string]any:
+		if schemaKeys[key] {
+			return schema(v)
+		}
+		n := 0
+		for k, e := range v {
+			n += value(k, e)
+		}
+		return n
+	case []any:
+		if schemaKeys[key] {
+			return schema(v)
+		}
+		n := 0
+		for _, e := range v {
+			n += value(key, e)
+		}
+		return n
+	}
+	return 0
+}
+
+func schema(v any) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return Estimate(string(b))
+}
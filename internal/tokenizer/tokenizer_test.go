@@ -0,0 +1,40 @@
+package tokenizer
+
+import "testing"
+
+func TestEstimate(t *testing.T) {
+	// Counts of tiktoken's o200k_base encoding.
+	for text, want := range map[string]int{
+		"":              0,
+		"Hello, world!": 4,
+		"The quick brown fox jumps over the lazy dog.": 10,
+		"1234567":    3,
+		"Привет мир": 3,
+		"func main() {\n\tfmt.Println(\"hi\")\n}": 13,
+	} {
+		// Estimates may be off by a token or two on short texts.
+		if got := Estimate(text); got < want-2 || got > want+2 {
+			t.Errorf("Estimate(%q) = %d, want about %d", text, got, want)
+		}
+	}
+}
+
+func TestEstimateRequest(t *testing.T) {
+	chat := EstimateRequest([]byte(`{"model":"gpt-5","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hello, world!"}]}`))
+	// Two messages of 3 and 4 tokens, framing and reply priming.
+	if want := 3 + 4 + 2*messageTokens + replyTokens; chat != want {
+		t.Fatalf("chat request %d tokens, want %d", chat, want)
+	}
+	responses := EstimateRequest([]byte(`{"model":"gpt-5","instructions":"Be brief.","input":[{"role":"user","content":[{"type":"input_text","text":"Hello, world!"},{"type":"input_image","image_url":"data:image/png;base64,AAAA"}]}]}`))
+	if want := 3 + 4 + messageTokens + replyTokens; responses != want {
+		t.Fatalf("responses request %d tokens, want %d", responses, want)
+	}
+	plain := EstimateRequest([]byte(`{"model":"gpt-5","input":"Hello, world!"}`))
+	withTools := EstimateRequest([]byte(`{"model":"gpt-5","input":"Hello, world!","tools":[{"type":"function","name":"lookup","parameters":{"type":"object"}}]}`))
+	if plain != 4 || withTools <= plain+5 {
+		t.Fatalf("tool definitions not counted: %d without, %d with", plain, withTools)
+	}
+	if got := EstimateRequest([]byte("Hello, world!")); got != 4 {
+		t.Fatalf("text body %d tokens", got)
+	}
+}
@@ -0,0 +1,241 @@
+// Package tombstone governs the request logs of deleted accounts. Every
+// deleted account leaves a tombstone with its name, under which its logs
+// are shown; the Policy decides whether the logs are kept, deleted with the
+// account or deleted after a delay.
+package tombstone
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/logger"
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+// Policies for the logs of deleted accounts.
+const (
+	// PolicyKeep keeps the logs as the usage history of the account.
+	PolicyKeep = "keep"
+	// PolicyImmediate deletes the logs with the account.
+	PolicyImmediate = "immediate"
+	// PolicyDelayed deletes the logs Delay after the account.
+	PolicyDelayed = "delayed"
+)
+
+// ParsePolicy checks a policy name; empty means PolicyKeep.
+func ParsePolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return PolicyKeep, nil
+	case PolicyKeep, PolicyImmediate, PolicyDelayed:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown deleted account log policy %q, want keep, immediate or delayed", s)
+}
+
+// Tombstone records a deleted account. Name is empty for accounts found
+// deleted by Apply, whose name was no longer known.
+type Tombstone struct {
+	AccountID int64     `json:"account_id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// DisplayName is how the logs of the account are labelled.
+func (t Tombstone) DisplayName() string {
+	if t.Name == "" {
+		return fmt.Sprintf("deleted account %d", t.AccountID)
+	}
+	return t.Name + " (deleted)"
+}
+
+// Result reports what Apply did.
+type Result struct {
+	Policy string `json:"policy"`
+	// Tombstoned lists the accounts found deleted without a tombstone.
+	Tombstoned []int64 `json:"tombstoned"`
+	// DeletedLogs counts the logs deleted, per account.
+	DeletedLogs map[int64]int64 `json:"deleted_logs"`
+}
+
+// Store keeps tombstones in the account_tombstones table and deletes the
+// logs of deleted accounts as its Policy says.
+type Store struct {
+	db       *sql.DB
+	accounts *account.Manager
+	logs     logpkg.Storage
+	// Policy is one of the policies above; empty means PolicyKeep.
+	Policy string
+	// Delay is how long PolicyDelayed keeps the logs.
+	Delay time.Duration
+
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+// New creates a Store for the logs of the accounts in am and ensures its
+// table exists.
+func New(db *sql.DB, am *account.Manager, logs logpkg.Storage) (*Store, error) {
+	s := &Store{db: db, accounts: am, logs: logs, Policy: PolicyKeep, Delay: 30 * 24 * time.Hour, now: time.Now}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS account_tombstones (
+        account_id INTEGER PRIMARY KEY,
+        name TEXT NOT NULL DEFAULT '',
+        deleted_at INTEGER NOT NULL
+    )`); err != nil {
+		logger.Errorf("create account_tombstones table failed: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// AccountDeleted records the tombstone of account a, which was just
+// deleted, and deletes its logs under PolicyImmediate.
+func (s *Store) AccountDeleted(ctx context.Context, a *account.Account) error {
+	if err := s.bury(ctx, Tombstone{AccountID: a.ID, Name: a.Name, DeletedAt: s.now()}); err != nil {
+		return err
+	}
+	if s.Policy != PolicyImmediate {
+		return nil
+	}
+	n, err := s.logs.DeleteAccount(ctx, a.ID)
+	if err == nil {
+		logger.Infof("deleted %d logs of deleted account %d", n, a.ID)
+	}
+	return err
+}
+
+func (s *Store) bury(ctx context.Context, t Tombstone) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO account_tombstones(account_id, name, deleted_at) VALUES(?,?,?)`,
+		t.AccountID, t.Name, t.DeletedAt.UnixMilli())
+	if err != nil {
+		logger.Errorf("insert tombstone of account %d failed: %v", t.AccountID, err)
+		dbhealth.RecordWriteError("account_tombstones")
+	}
+	return err
+}
+
+// List returns the tombstones, oldest first.
+func (s *Store) List(ctx context.Context) ([]Tombstone, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT account_id, name, deleted_at FROM account_tombstones ORDER BY deleted_at, account_id`)
+	if err != nil {
+		logger.Errorf("query tombstones failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Tombstone{}
+	for rows.Next() {
+		var t Tombstone
+		var at int64
+		if err := rows.Scan(&t.AccountID, &t.Name, &at); err != nil {
+			logger.Errorf("scan tombstone failed: %v", err)
+			return nil, err
+		}
+		t.DeletedAt = time.UnixMilli(at)
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+// Names returns the display names of the deleted accounts by ID.
+func (s *Store) Names(ctx context.Context) (map[int64]string, error) {
+	list, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]string, len(list))
+	for _, t := range list {
+		res[t.AccountID] = t.DisplayName()
+	}
+	return res, nil
+}
+
+// Apply brings the logs in line with the policy: accounts that have logs
+// but no longer exist get a tombstone, e.g. those deleted before tombstones
+// were kept, and the logs due for deletion are deleted, which under
+// PolicyDelayed counts the delay of those accounts from now.
+func (s *Store) Apply(ctx context.Context) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := Result{Policy: s.Policy, Tombstoned: []int64{}, DeletedLogs: make(map[int64]int64)}
+	if res.Policy == "" {
+		res.Policy = PolicyKeep
+	}
+	accounts, err := s.accounts.List(ctx)
+	if err != nil {
+		return res, err
+	}
+	exists := make(map[int64]bool, len(accounts))
+	for _, a := range accounts {
+		exists[a.ID] = true
+	}
+	list, err := s.List(ctx)
+	if err != nil {
+		return res, err
+	}
+	buried := make(map[int64]Tombstone, len(list))
+	for _, t := range list {
+		buried[t.AccountID] = t
+	}
+	logged, err := s.logs.LoggedAccounts(ctx)
+	if err != nil {
+		return res, err
+	}
+	now := s.now()
+	for _, id := range logged {
+		// Requests no account served are logged with ID zero.
+		if id == 0 || exists[id] {
+			continue
+		}
+		t, ok := buried[id]
+		if !ok {
+			t = Tombstone{AccountID: id, DeletedAt: now}
+			if err := s.bury(ctx, t); err != nil {
+				return res, err
+			}
+			res.Tombstoned = append(res.Tombstoned, id)
+		}
+		switch {
+		case res.Policy == PolicyImmediate:
+		case res.Policy == PolicyDelayed && !now.Before(t.DeletedAt.Add(s.Delay)):
+		default:
+			continue
+		}
+		n, err := s.logs.DeleteAccount(ctx, id)
+		if err != nil {
+			return res, err
+		}
+		res.DeletedLogs[id] = n
+	}
+	for id, n := range res.DeletedLogs {
+		logger.Infof("deleted %d logs of deleted account %d", n, id)
+	}
+	return res, nil
+}
+
+// Start applies the policy every interval until ctx is done, which deletes
+// the logs PolicyDelayed keeps once their delay is over. It does nothing
+// under the other policies, which need no scheduled work.
+func (s *Store) Start(ctx context.Context, interval time.Duration) {
+	if s.Policy != PolicyDelayed || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := s.Apply(ctx); err != nil {
+					logger.Errorf("apply deleted account log policy: %v", err)
+				}
+			}
+		}
+	}()
+}
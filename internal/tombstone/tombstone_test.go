@@ -0,0 +1,130 @@
+package tombstone
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/testdb"
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+func setupStore(t *testing.T) (*Store, *account.Manager, *logpkg.Store) {
+	t.Helper()
+	db := testdb.Open(t)
+	am, err := account.NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := logpkg.NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(db, am, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, am, ls
+}
+
+// logCounts returns the number of logs per account.
+func logCounts(t *testing.T, ls *logpkg.Store) map[int64]int {
+	t.Helper()
+	logs, err := ls.List(context.Background(), 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[int64]int)
+	for _, l := range logs {
+		res[l.AccountID]++
+	}
+	return res
+}
+
+func TestAccountDeleted(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		kept   int
+	}{{PolicyKeep, 1}, {PolicyDelayed, 1}, {PolicyImmediate, 0}} {
+		t.Run(tc.policy, func(t *testing.T) {
+			s, am, ls := setupStore(t)
+			s.Policy = tc.policy
+			ctx := context.Background()
+			a, _ := am.AddAPIKey(ctx, "gone", "k", "", 1)
+			ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Status: 200})
+			am.Delete(ctx, a.ID)
+			if err := s.AccountDeleted(ctx, a); err != nil {
+				t.Fatal(err)
+			}
+			if got := logCounts(t, ls)[a.ID]; got != tc.kept {
+				t.Fatalf("%d logs kept", got)
+			}
+			names, err := s.Names(ctx)
+			if err != nil || names[a.ID] != "gone (deleted)" {
+				t.Fatalf("names %v: %v", names, err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	s, am, ls := setupStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	live, _ := am.AddAPIKey(ctx, "live", "k1", "", 1)
+	old, _ := am.AddAPIKey(ctx, "old", "k2", "", 2)
+	recent, _ := am.AddAPIKey(ctx, "recent", "k3", "", 3)
+	for _, id := range []int64{0, live.ID, old.ID, recent.ID, 99} {
+		ls.Insert(ctx, &logpkg.RequestLog{Time: now, AccountID: id, Status: 200})
+	}
+	for _, a := range []*account.Account{old, recent} {
+		am.Delete(ctx, a.ID)
+	}
+	s.now = func() time.Time { return now.Add(-40 * 24 * time.Hour) }
+	s.AccountDeleted(ctx, old)
+	s.now = func() time.Time { return now.Add(-time.Hour) }
+	s.AccountDeleted(ctx, recent)
+	s.now = func() time.Time { return now }
+
+	// Keeping the logs only adds the missing tombstone.
+	res, err := s.Apply(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tombstoned) != 1 || res.Tombstoned[0] != 99 || len(res.DeletedLogs) != 0 {
+		t.Fatalf("keep: %+v", res)
+	}
+	if names, _ := s.Names(ctx); names[99] != "deleted account 99" || names[old.ID] != "old (deleted)" {
+		t.Fatalf("names %v", names)
+	}
+
+	s.Policy = PolicyDelayed
+	if res, err = s.Apply(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tombstoned) != 0 || len(res.DeletedLogs) != 1 || res.DeletedLogs[old.ID] != 1 {
+		t.Fatalf("delayed: %+v", res)
+	}
+
+	s.Policy = PolicyImmediate
+	if res, err = s.Apply(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.DeletedLogs) != 2 || res.DeletedLogs[recent.ID] != 1 || res.DeletedLogs[99] != 1 {
+		t.Fatalf("immediate: %+v", res)
+	}
+	if got := logCounts(t, ls); len(got) != 2 || got[0] != 1 || got[live.ID] != 1 {
+		t.Fatalf("logs left %v", got)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	if p, err := ParsePolicy(""); err != nil || p != PolicyKeep {
+		t.Fatalf("default %q: %v", p, err)
+	}
+	if _, err := ParsePolicy("never"); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
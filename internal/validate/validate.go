@@ -0,0 +1,232 @@
+// Package validate checks the credentials of every account against its
+// upstream, at startup and periodically, so accounts the upstream no longer
+// accepts show up before requests are routed to them. Accounts are probed
+// by a bounded pool of workers, each probe under its own timeout, and every
+// result is published on the event bus as soon as it is known.
+package validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/auth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// ErrRunning is returned when a validation pass is started while another
+// one is in progress.
+var ErrRunning = errors.New("validation already running")
+
+// ProbeFunc sends a request upstream with a's credentials and returns the
+// response status, see proxy.Handler.Probe.
+type ProbeFunc func(ctx context.Context, a *account.Account) (int, error)
+
+// Result is the validation of one account.
+type Result struct {
+	AccountID int64     `json:"account_id"`
+	Time      time.Time `json:"time"`
+	// Status is the upstream status of the probe, 0 when it failed.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Valid is set when the upstream accepted the credentials, which
+	// includes a rate-limited probe.
+	Valid      bool  `json:"valid"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// Run is a validation pass, in progress while Finished is zero. Results are
+// in the order the probes completed.
+type Run struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Accounts int       `json:"accounts"`
+	Results  []Result  `json:"results"`
+}
+
+// Validator validates the accounts of a Manager.
+type Validator struct {
+	mgr   *account.Manager
+	probe ProbeFunc
+	// Events receives the validation events; nil means events.Default.
+	Events *events.Bus
+	// Concurrency is the number of accounts probed at once.
+	Concurrency int
+	// Timeout bounds each probe, including the token refresh before it.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	running bool
+	last    *Run
+}
+
+// New creates a Validator probing the accounts of mgr with probe.
+func New(mgr *account.Manager, probe ProbeFunc) *Validator {
+	return &Validator{mgr: mgr, probe: probe, Concurrency: 8, Timeout: 15 * time.Second}
+}
+
+// Last returns the running or last validation pass, nil before the first.
+func (v *Validator) Last() *Run {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.last == nil {
+		return nil
+	}
+	r := *v.last
+	r.Results = append([]Result(nil), v.last.Results...)
+	return &r
+}
+
+// Run validates every account and returns the pass once all probes
+// completed.
+func (v *Validator) Run(ctx context.Context) (*Run, error) {
+	accounts, err := v.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v.run(ctx, accounts), nil
+}
+
+// Go starts validating every account in the background; the results are
+// published as they arrive and kept in Last.
+func (v *Validator) Go(ctx context.Context) error {
+	accounts, err := v.begin(ctx)
+	if err != nil {
+		return err
+	}
+	go v.run(ctx, accounts)
+	return nil
+}
+
+// Start validates every account now and then every interval until ctx is
+// done; a zero interval validates only once.
+func (v *Validator) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		v.runLogged(ctx)
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				v.runLogged(ctx)
+			}
+		}
+	}()
+}
+
+func (v *Validator) runLogged(ctx context.Context) {
+	if _, err := v.Run(ctx); err != nil {
+		logger.Warnf("validate accounts: %v", err)
+	}
+}
+
+func (v *Validator) bus() *events.Bus {
+	if v.Events != nil {
+		return v.Events
+	}
+	return events.Default
+}
+
+// begin marks a pass as running and lists the accounts to validate.
+func (v *Validator) begin(ctx context.Context) ([]*account.Account, error) {
+	v.mu.Lock()
+	if v.running {
+		v.mu.Unlock()
+		return nil, ErrRunning
+	}
+	v.running = true
+	v.mu.Unlock()
+	accounts, err := v.mgr.List(ctx)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err != nil {
+		v.running = false
+		return nil, fmt.Errorf("list accounts: %w", err)
+	}
+	v.last = &Run{Started: time.Now(), Accounts: len(accounts), Results: []Result{}}
+	v.bus().Publish(events.Event{Type: events.ValidationStarted, Data: map[string]any{"accounts": len(accounts)}})
+	return accounts, nil
+}
+
+// run probes accounts with at most Concurrency workers and finishes the
+// pass begin started.
+func (v *Validator) run(ctx context.Context, accounts []*account.Account) *Run {
+	jobs := make(chan *account.Account)
+	workers := min(max(v.Concurrency, 1), len(accounts))
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range jobs {
+				v.record(v.check(ctx, a))
+			}
+		}()
+	}
+	for _, a := range accounts {
+		jobs <- a
+	}
+	close(jobs)
+	wg.Wait()
+
+	v.mu.Lock()
+	v.running = false
+	v.last.Finished = time.Now()
+	invalid := 0
+	for _, r := range v.last.Results {
+		if !r.Valid {
+			invalid++
+		}
+	}
+	took := v.last.Finished.Sub(v.last.Started)
+	v.mu.Unlock()
+	logger.Infof("validated %d accounts in %v, %d invalid", len(accounts), took.Round(time.Millisecond), invalid)
+	v.bus().Publish(events.Event{Type: events.ValidationFinished, Data: map[string]any{
+		"accounts": len(accounts), "invalid": invalid, "duration_ms": took.Milliseconds(),
+	}})
+	return v.Last()
+}
+
+// check probes a under Timeout, refreshing a ChatGPT token first when due.
+func (v *Validator) check(ctx context.Context, a *account.Account) Result {
+	start := time.Now()
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+	res := Result{AccountID: a.ID}
+	if err := auth.Refresh(auth.WithTrigger(ctx, auth.TriggerValidate), v.mgr, a); err != nil {
+		res.Error = "token refresh failed: " + err.Error()
+	} else if res.Status, err = v.probe(ctx, a); err != nil {
+		res.Error = err.Error()
+	} else if res.Status >= 400 && res.Status != http.StatusTooManyRequests {
+		res.Error = fmt.Sprintf("upstream status %d", res.Status)
+	}
+	res.Valid = res.Error == ""
+	res.Time = time.Now()
+	res.DurationMs = res.Time.Sub(start).Milliseconds()
+	return res
+}
+
+func (v *Validator) record(r Result) {
+	v.mu.Lock()
+	v.last.Results = append(v.last.Results, r)
+	v.mu.Unlock()
+	if !r.Valid {
+		logger.Warnf("validation of account %d failed: %s", r.AccountID, r.Error)
+	}
+	v.bus().Publish(events.Event{Type: events.AccountValidated, AccountID: r.AccountID, Time: r.Time, Message: r.Error, Data: map[string]any{
+		"status": r.Status, "valid": r.Valid, "duration_ms": r.DurationMs,
+	}})
+}
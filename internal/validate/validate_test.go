@@ -0,0 +1,131 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+)
+
+func setupManager(t *testing.T, n int) *account.Manager {
+	t.Helper()
+	am := account.NewManagerWithStorage(account.NewMemoryStore())
+	for i := range n {
+		if _, err := am.AddAPIKey(context.Background(), fmt.Sprintf("a%d", i), fmt.Sprintf("k%d", i), "", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return am
+}
+
+func TestRunConcurrency(t *testing.T) {
+	am := setupManager(t, 10)
+	var active, peak atomic.Int32
+	v := New(am, func(ctx context.Context, a *account.Account) (int, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		switch a.Name {
+		case "a1":
+			return 401, nil
+		case "a2":
+			return 429, nil
+		case "a3":
+			// Hangs until the per-probe timeout.
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+		return 200, nil
+	})
+	v.Events = events.NewBus()
+	v.Concurrency = 3
+	v.Timeout = 100 * time.Millisecond
+	var mu sync.Mutex
+	var got []events.Event
+	unsubscribe := v.Events.Subscribe(func(e events.Event) {
+		mu.Lock()
+		got = append(got, e)
+		mu.Unlock()
+	})
+
+	start := time.Now()
+	run, err := v.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("validation took %v", took)
+	}
+	if p := peak.Load(); p != 3 {
+		t.Fatalf("peak concurrency %d, want 3", p)
+	}
+	if run.Accounts != 10 || len(run.Results) != 10 || run.Finished.IsZero() {
+		t.Fatalf("run %+v", run)
+	}
+	invalid := map[int64]string{}
+	for _, r := range run.Results {
+		if !r.Valid {
+			invalid[r.AccountID] = r.Error
+		}
+	}
+	if len(invalid) != 2 || invalid[2] != "upstream status 401" || invalid[4] == "" {
+		t.Fatalf("invalid %v", invalid)
+	}
+
+	unsubscribe()
+	if len(got) != 12 || got[0].Type != events.ValidationStarted || got[11].Type != events.ValidationFinished {
+		t.Fatalf("events %+v", got)
+	}
+	for _, e := range got[1:11] {
+		if e.Type != events.AccountValidated || e.AccountID == 0 || e.Data["valid"] == nil {
+			t.Fatalf("event %+v", e)
+		}
+	}
+	if got[11].Data["invalid"] != 2 {
+		t.Fatalf("finished %+v", got[11])
+	}
+}
+
+func TestGoRunning(t *testing.T) {
+	am := setupManager(t, 2)
+	release := make(chan struct{})
+	v := New(am, func(ctx context.Context, a *account.Account) (int, error) {
+		<-release
+		return 200, nil
+	})
+	v.Events = events.NewBus()
+	if v.Last() != nil {
+		t.Fatal("last run before the first")
+	}
+	if err := v.Go(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Go(context.Background()); err != ErrRunning {
+		t.Fatalf("second run: %v", err)
+	}
+	if last := v.Last(); last == nil || !last.Finished.IsZero() || last.Accounts != 2 {
+		t.Fatalf("running %+v", last)
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for v.Last().Finished.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("validation did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := v.Run(context.Background()); err != nil {
+		t.Fatalf("run after finish: %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+// Package webhook delivers system events to operator-configured HTTP
+// endpoints. Deliveries are persisted before they are attempted so they
+// survive restarts, retried with exponential backoff and parked as dead
+// letters after too many failures, from where they can be replayed.
+// Delivered rows are pruned after Queue.Retention.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Delivery states.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Delivery is one event queued for one endpoint.
+type Delivery struct {
+	ID            int64     `json:"id"`
+	URL           string    `json:"url"`
+	EventType     string    `json:"event_type"`
+	Payload       string    `json:"payload"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastStatus    int       `json:"last_status"`
+	LastError     string    `json:"last_error"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ErrNotFound is returned by Replay for unknown deliveries.
+var ErrNotFound = errors.New("delivery not found")
+
+// Queue persists and sends webhook deliveries.
+type Queue struct {
+	db   *sql.DB
+	urls []string
+	// Secret signs payloads with HMAC-SHA256 in the X-Companion-Signature
+	// header. Empty disables signing.
+	Secret string
+	// MaxAttempts moves a delivery to the dead-letter state after this many
+	// failed attempts.
+	MaxAttempts int
+	// BaseBackoff is the delay after the first failure; it doubles with each
+	// further failure up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	Client      *http.Client
+	// Retention is how long delivered deliveries are kept. Dead letters
+	// are kept until replayed.
+	Retention time.Duration
+
+	mu        sync.Mutex
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// New creates a Queue sending to urls and ensures its table exists.
+func New(db *sql.DB, urls []string, secret string, maxAttempts int) (*Queue, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = 8
+	}
+	q := &Queue{
+		db:          db,
+		urls:        urls,
+		Secret:      secret,
+		MaxAttempts: maxAttempts,
+		BaseBackoff: 30 * time.Second,
+		MaxBackoff:  time.Hour,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Retention:   7 * 24 * time.Hour,
+		now:         time.Now,
+	}
+	if err := q.init(); err != nil {
+		logger.Errorf("init webhook_deliveries table failed: %v", err)
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) init() error {
+	_, err := q.db.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        event_type TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        next_attempt_at INTEGER NOT NULL,
+        last_status INTEGER NOT NULL DEFAULT 0,
+        last_error TEXT NOT NULL DEFAULT '',
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)`)
+	return err
+}
+
+// Subscribe enqueues every event published on bus for each configured URL.
+// Publishing only appends the event to a backlog in memory, which a
+// goroutine of its own writes to the database: a burst loses no event to a
+// full subscriber queue, and a slow write does not hold up the publisher,
+// which may be serving a request or selecting an account. The backlog only
+// grows while writes are slower than events arrive. The returned function
+// unsubscribes and waits until the backlog is written.
+func (q *Queue) Subscribe(bus *events.Bus) func() {
+	var (
+		mu      sync.Mutex
+		backlog []events.Event
+	)
+	wake := make(chan struct{}, 1)
+	unsubscribe := bus.SubscribeSync(func(e events.Event) {
+		mu.Lock()
+		backlog = append(backlog, e)
+		mu.Unlock()
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+	write := func() {
+		mu.Lock()
+		batch := backlog
+		backlog = nil
+		mu.Unlock()
+		for _, e := range batch {
+			q.store(e)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range wake {
+			write()
+		}
+		write()
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			close(wake)
+			<-done
+		})
+	}
+}
+
+// store enqueues e for each configured URL.
+func (q *Queue) store(e events.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("encode webhook event: %v", err)
+		return
+	}
+	for _, u := range q.urls {
+		if _, err := q.Enqueue(context.Background(), u, string(e.Type), payload); err != nil {
+			logger.Errorf("enqueue webhook %s: %v", u, err)
+		}
+	}
+}
+
+// Enqueue stores a pending delivery due immediately.
+func (q *Queue) Enqueue(ctx context.Context, url, eventType string, payload []byte) (int64, error) {
+	now := q.now().UnixMilli()
+	res, err := q.db.ExecContext(ctx, `INSERT INTO webhook_deliveries(url, event_type, payload, status, next_attempt_at, created_at, updated_at) VALUES(?,?,?,?,?,?,?)`,
+		url, eventType, string(payload), StatusPending, now, now, now)
+	if err != nil {
+		dbhealth.RecordWriteError("webhook_deliveries")
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Start processes due deliveries every tick until ctx is done.
+func (q *Queue) Start(ctx context.Context, tick time.Duration) {
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				q.Process(ctx)
+			}
+		}
+	}()
+}
+
+// Process attempts every pending delivery that is due and returns how many
+// were attempted. It prunes delivered deliveries older than Retention at
+// most once an hour.
+func (q *Queue) Process(ctx context.Context) int {
+	q.prune(ctx)
+	rows, err := q.db.QueryContext(ctx, `SELECT `+columns+` FROM webhook_deliveries WHERE status=? AND next_attempt_at<=? ORDER BY next_attempt_at LIMIT 100`,
+		StatusPending, q.now().UnixMilli())
+	if err != nil {
+		logger.Errorf("list due webhooks: %v", err)
+		return 0
+	}
+	due, err := scanDeliveries(rows)
+	if err != nil {
+		logger.Errorf("scan due webhooks: %v", err)
+		return 0
+	}
+	for _, d := range due {
+		q.attempt(ctx, d)
+	}
+	return len(due)
+}
+
+func (q *Queue) attempt(ctx context.Context, d *Delivery) {
+	status, err := q.send(ctx, d)
+	d.Attempts++
+	d.LastStatus = status
+	d.LastError = ""
+	now := q.now()
+	switch {
+	case err == nil:
+		d.Status = StatusDelivered
+		logger.Debugf("webhook %d delivered to %s", d.ID, d.URL)
+	case d.Attempts >= q.MaxAttempts:
+		d.Status = StatusDead
+		d.LastError = err.Error()
+		logger.Errorf("webhook %d to %s dead after %d attempts: %v", d.ID, d.URL, d.Attempts, err)
+	default:
+		d.LastError = err.Error()
+		d.NextAttemptAt = now.Add(q.backoff(d.Attempts))
+		logger.Warnf("webhook %d to %s failed (attempt %d), retrying at %v: %v", d.ID, d.URL, d.Attempts, d.NextAttemptAt, err)
+	}
+	if _, err := q.db.ExecContext(ctx, `UPDATE webhook_deliveries SET status=?, attempts=?, next_attempt_at=?, last_status=?, last_error=?, updated_at=? WHERE id=?`,
+		d.Status, d.Attempts, d.NextAttemptAt.UnixMilli(), d.LastStatus, d.LastError, now.UnixMilli(), d.ID); err != nil {
+		logger.Errorf("update webhook %d: %v", d.ID, err)
+		dbhealth.RecordWriteError("webhook_deliveries")
+	}
+}
+
+func (q *Queue) prune(ctx context.Context) {
+	now := q.now()
+	q.mu.Lock()
+	due := now.Sub(q.lastPrune) >= time.Hour
+	if due {
+		q.lastPrune = now
+	}
+	q.mu.Unlock()
+	if !due {
+		return
+	}
+	cutoff := now.Add(-q.Retention).UnixMilli()
+	if _, err := q.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE status=? AND updated_at < ?`, StatusDelivered, cutoff); err != nil {
+		logger.Errorf("prune webhooks: %v", err)
+	}
+}
+
+// backoff returns the delay after the n-th failed attempt.
+func (q *Queue) backoff(n int) time.Duration {
+	d := q.BaseBackoff
+	for i := 1; i < n && d < q.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.MaxBackoff {
+		d = q.MaxBackoff
+	}
+	return d
+}
+
+func (q *Queue) send(ctx context.Context, d *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Companion-Event", d.EventType)
+	req.Header.Set("X-Companion-Delivery", fmt.Sprint(d.ID))
+	if q.Secret != "" {
+		req.Header.Set("X-Companion-Signature", "sha256="+Sign(q.Secret, []byte(d.Payload)))
+	}
+	resp, err := q.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of payload keyed by secret.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// List returns deliveries newest first, optionally filtered by status.
+func (q *Queue) List(ctx context.Context, status string, limit, offset int) ([]*Delivery, error) {
+	query := `SELECT ` + columns + ` FROM webhook_deliveries`
+	var args []any
+	if status != "" {
+		query += ` WHERE status=?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+	rows, err := q.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Errorf("list webhooks: %v", err)
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// Replay resets a delivery to pending so it is sent on the next Process,
+// regardless of its previous state.
+func (q *Queue) Replay(ctx context.Context, id int64) error {
+	now := q.now().UnixMilli()
+	res, err := q.db.ExecContext(ctx, `UPDATE webhook_deliveries SET status=?, attempts=0, next_attempt_at=?, last_error='', updated_at=? WHERE id=?`,
+		StatusPending, now, now, id)
+	if err != nil {
+		logger.Errorf("replay webhook %d: %v", id, err)
+		dbhealth.RecordWriteError("webhook_deliveries")
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	logger.Infof("webhook %d queued for replay", id)
+	return nil
+}
+
+const columns = `id, url, event_type, payload, status, attempts, next_attempt_at, last_status, last_error, created_at, updated_at`
+
+func scanDeliveries(rows *sql.Rows) ([]*Delivery, error) {
+	defer rows.Close()
+	var res []*Delivery
+	for rows.Next() {
+		var d Delivery
+		var next, created, updated int64
+		if err := rows.Scan(&d.ID, &d.URL, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &next, &d.LastStatus, &d.LastError, &created, &updated); err != nil {
+			return nil, err
+		}
+		d.NextAttemptAt = time.UnixMilli(next)
+		d.CreatedAt = time.UnixMilli(created)
+		d.UpdatedAt = time.UnixMilli(updated)
+		res = append(res, &d)
+	}
+	return res, rows.Err()
+}
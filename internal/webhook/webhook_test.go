@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func setupQueue(t *testing.T, url string) *Queue {
+	t.Helper()
+	db := testdb.Open(t)
+	q, err := New(db, []string{url}, "s3cret", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestDeliverSigned(t *testing.T) {
+	var gotSig, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		gotSig = r.Header.Get("X-Companion-Signature")
+	}))
+	defer srv.Close()
+	q := setupQueue(t, srv.URL)
+	ctx := context.Background()
+	if _, err := q.Enqueue(ctx, srv.URL, "account.exhausted", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Process(ctx); n != 1 {
+		t.Fatalf("processed %d", n)
+	}
+	if gotBody != `{"a":1}` || gotSig != "sha256="+Sign("s3cret", []byte(`{"a":1}`)) {
+		t.Fatalf("unexpected delivery %q %q", gotBody, gotSig)
+	}
+	list, _ := q.List(ctx, StatusDelivered, 10, 0)
+	if len(list) != 1 || list[0].Attempts != 1 {
+		t.Fatalf("unexpected deliveries %+v", list)
+	}
+}
+
+func TestRetryBackoffAndDeadLetter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	q := setupQueue(t, srv.URL)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	ctx := context.Background()
+	id, _ := q.Enqueue(ctx, srv.URL, "request.failed", []byte(`{}`))
+
+	q.Process(ctx)
+	list, _ := q.List(ctx, StatusPending, 10, 0)
+	if len(list) != 1 || list[0].Attempts != 1 || list[0].LastStatus != 500 {
+		t.Fatalf("unexpected state after first failure %+v", list)
+	}
+	if got := list[0].NextAttemptAt.Sub(now); got < 29*time.Second || got > 31*time.Second {
+		t.Fatalf("first backoff %v", got)
+	}
+	if n := q.Process(ctx); n != 0 {
+		t.Fatalf("delivery retried before backoff elapsed")
+	}
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		q.Process(ctx)
+	}
+	dead, _ := q.List(ctx, StatusDead, 10, 0)
+	if len(dead) != 1 || dead[0].Attempts != 3 || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected dead letter after 3 attempts: %+v calls=%d", dead, calls)
+	}
+
+	if err := q.Replay(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Process(ctx); n != 1 {
+		t.Fatalf("replayed delivery not processed")
+	}
+	if err := q.Replay(ctx, id+100); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBackoffCap(t *testing.T) {
+	q := &Queue{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 40: 5 * time.Second} {
+		if got := q.backoff(n); got != want {
+			t.Fatalf("backoff(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestSubscribeEnqueues(t *testing.T) {
+	q := setupQueue(t, "http://127.0.0.1:1/hook")
+	bus := events.NewBus()
+	unsub := q.Subscribe(bus)
+	bus.Publish(events.Event{Type: events.AccountExhausted, AccountID: 7})
+	// A burst beyond a bus subscriber's queue is not dropped.
+	for range 400 {
+		bus.Publish(events.Event{Type: events.RequestFailed})
+	}
+	unsub()
+	list, _ := q.List(context.Background(), "", 1000, 0)
+	if len(list) != 401 || list[400].EventType != "account.exhausted" {
+		t.Fatalf("%d of 401 events enqueued", len(list))
+	}
+}
+
+func TestPruneDelivered(t *testing.T) {
+	ok := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	q := setupQueue(t, srv.URL)
+	q.MaxAttempts = 1
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	ctx := context.Background()
+	q.Enqueue(ctx, srv.URL, "request.failed", []byte(`{}`))
+	q.Process(ctx)
+	ok = false
+	q.Enqueue(ctx, srv.URL, "request.failed", []byte(`{}`))
+	q.Process(ctx)
+
+	// Delivered rows go once older than Retention; dead letters stay.
+	now = now.Add(q.Retention + time.Hour)
+	q.Enqueue(ctx, srv.URL, "request.failed", []byte(`{}`))
+	q.Process(ctx)
+	if list, _ := q.List(ctx, StatusDelivered, 10, 0); len(list) != 0 {
+		t.Fatalf("old delivery kept: %+v", list)
+	}
+	if list, _ := q.List(ctx, StatusDead, 10, 0); len(list) != 2 {
+		t.Fatalf("dead letters pruned: %+v", list)
+	}
+}
@@ -0,0 +1,71 @@
+package webui
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/backup"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// BackupPassphraseHeader carries the passphrase encrypting a backup download.
+const BackupPassphraseHeader = "X-Backup-Passphrase"
+
+// registerBackup serves GET /api/backup: a point-in-time snapshot of the
+// database, encrypted when a passphrase is given or configured.
+func (s *Admin) registerBackup(mux *http.ServeMux) {
+	mux.HandleFunc("/api/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dir, err := os.MkdirTemp("", "companion-backup-")
+		if err != nil {
+			logger.Errorf("create backup dir failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "snapshot.db")
+		if err := backup.Snapshot(r.Context(), s.DB, path); err != nil {
+			logger.Errorf("database snapshot failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			logger.Errorf("open snapshot failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		passphrase := r.Header.Get(BackupPassphraseHeader)
+		if passphrase == "" {
+			passphrase = s.BackupPassphrase
+		}
+		name := "companion-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+		if passphrase != "" {
+			name += ".enc"
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if passphrase != "" {
+			err = backup.Encrypt(w, f, passphrase)
+		} else {
+			if fi, serr := f.Stat(); serr == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+			}
+			_, err = io.Copy(w, f)
+		}
+		if err != nil {
+			logger.Errorf("send backup failed: %v", err)
+			return
+		}
+		logger.Infof("database backup %s sent", name)
+	})
+}
@@ -0,0 +1,36 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/proxy"
+)
+
+// registerChaos exposes the proxy fault-injection settings.
+func (s *Admin) registerChaos(mux *http.ServeMux) {
+	mux.HandleFunc("/api/chaos", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var cfg proxy.ChaosConfig
+			if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+				logger.Warnf("bad chaos request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.Chaos.SetConfig(cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.configChanged("chaos.updated", 0)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(s.Chaos.Config()); err != nil {
+			logger.Errorf("encode chaos config failed: %v", err)
+		}
+	})
+}
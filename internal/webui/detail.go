@@ -0,0 +1,122 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/quota"
+	"github.com/kxn/codex-companion/internal/refreshlog"
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+// detailRecent is how many recent requests the account detail lists.
+const detailRecent = 20
+
+// accountDetail is the payload of GET /admin/api/accounts/{id}/detail.
+// Sections backed by components that are not configured are omitted.
+type accountDetail struct {
+	Account *account.Account `json:"account"`
+	// Token is only reported for ChatGPT accounts.
+	Token *tokenStatus `json:"token,omitempty"`
+	// Stats, Errors, Quota and Refreshes cover the last days (default 7,
+	// ?days=N).
+	Stats     *logpkg.AccountStats `json:"stats,omitempty"`
+	Recent    []*logpkg.RequestLog `json:"recent,omitempty"`
+	Errors    []*logpkg.ErrorGroup `json:"errors,omitempty"`
+	Quota     []quota.Snapshot     `json:"quota,omitempty"`
+	Refreshes []refreshlog.Attempt `json:"refreshes,omitempty"`
+}
+
+// tokenStatus describes the OAuth tokens of a ChatGPT account. The access
+// token is refreshed once RefreshAt has passed.
+type tokenStatus struct {
+	HasAccessToken bool      `json:"has_access_token"`
+	LastRefresh    time.Time `json:"last_refresh,omitempty"`
+	RefreshAt      time.Time `json:"refresh_at"`
+	RefreshDue     bool      `json:"refresh_due"`
+}
+
+func (s *Admin) registerAccountDetail(mux *http.ServeMux) {
+	mux.HandleFunc("/api/accounts/{id}/detail", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			logger.Warnf("bad account id %s", r.PathValue("id"))
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			if days, err = strconv.Atoi(v); err != nil || days <= 0 {
+				http.Error(w, "bad days", http.StatusBadRequest)
+				return
+			}
+		}
+		since := time.Now().AddDate(0, 0, -days)
+		a, err := s.Accounts.Get(ctx, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a == nil {
+			http.NotFound(w, r)
+			return
+		}
+		res := accountDetail{Account: a}
+		if a.Type == account.ChatGPTAccount {
+			res.Token = &tokenStatus{
+				HasAccessToken: a.AccessToken != "",
+				RefreshAt:      a.TokenExpiresAt,
+				RefreshDue:     time.Until(a.TokenExpiresAt) <= time.Minute,
+			}
+			if !a.TokenExpiresAt.IsZero() {
+				res.Token.LastRefresh = a.TokenExpiresAt.Add(-28 * 24 * time.Hour)
+			}
+		}
+		if s.Logs != nil {
+			st, err := s.Logs.AccountStats(ctx, id, since)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Stats = &st
+			if res.Recent, err = s.Logs.ListAccount(ctx, id, detailRecent); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			groups, err := s.Logs.ErrorGroups(ctx, since, 3)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, g := range groups {
+				if g.AccountID == id {
+					res.Errors = append(res.Errors, g)
+				}
+			}
+		}
+		if s.Quota != nil && a.Type == account.ChatGPTAccount {
+			if res.Quota, err = s.Quota.History(ctx, id, since); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if s.Refreshes != nil && a.Type == account.ChatGPTAccount {
+			if res.Refreshes, err = s.Refreshes.History(ctx, id, since); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode account detail failed: %v", err)
+		}
+	})
+}
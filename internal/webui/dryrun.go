@@ -0,0 +1,137 @@
+package webui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/proxy"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// maxDryRunRequests bounds how many logged requests a dry run replays.
+const maxDryRunRequests = 1000
+
+// dryRunRequest is the body of POST /api/routing/dry-run. Each entry of
+// Accounts holds an account's "id" and the fields to change, in the form
+// PUT /api/accounts/{id} takes; a model_map or prices given replaces the
+// current one. An empty Mode keeps the scheduler's.
+type dryRunRequest struct {
+	Accounts []json.RawMessage `json:"accounts"`
+	Mode     string            `json:"mode"`
+	Requests int               `json:"requests"`
+}
+
+// dryRunResult is the response of POST /api/routing/dry-run.
+type dryRunResult struct {
+	// Requests is the number of logged requests replayed.
+	Requests int            `json:"requests"`
+	Changes  []proxy.Change `json:"changes"`
+}
+
+// registerDryRun serves POST /api/routing/dry-run, which replays the latest
+// logged requests (100 by default) through proposed account settings and
+// scheduler mode without applying them, and reports the requests that
+// would be routed or transformed differently.
+func (s *Admin) registerDryRun(mux *http.ServeMux) {
+	mux.HandleFunc("/api/routing/dry-run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		var req dryRunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Warnf("bad dry run request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Requests <= 0 {
+			req.Requests = 100
+		}
+		if req.Requests > maxDryRunRequests {
+			req.Requests = maxDryRunRequests
+		}
+		current := proxy.Rules{Mode: s.Scheduler.Mode()}
+		proposed := proxy.Rules{Mode: current.Mode}
+		if req.Mode != "" {
+			if req.Mode != scheduler.ModePriority && req.Mode != scheduler.ModeWeighted && req.Mode != scheduler.ModeCost {
+				http.Error(w, fmt.Sprintf("unknown scheduler mode %q", req.Mode), http.StatusBadRequest)
+				return
+			}
+			proposed.Mode = req.Mode
+		}
+		var err error
+		if current.Accounts, err = s.Accounts.List(ctx); err != nil {
+			logger.Errorf("list accounts failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if proposed.Accounts, err = proposeAccounts(current.Accounts, req.Accounts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		list, err := s.Logs.List(ctx, req.Requests, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Listed logs are summaries; routing needs the request bodies.
+		for i, l := range list {
+			if list[i], err = s.Logs.Get(ctx, l.ID); err != nil {
+				logger.Errorf("get log %d failed: %v", l.ID, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		res := dryRunResult{Requests: len(list), Changes: []proxy.Change{}}
+		if c := s.Proxy.DryRun(s.Scheduler, current, proposed, list, time.Now()); c != nil {
+			res.Changes = c
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode dry run failed: %v", err)
+		}
+	})
+}
+
+// proposeAccounts returns copies of accounts with the changes applied.
+func proposeAccounts(accounts []*account.Account, changes []json.RawMessage) ([]*account.Account, error) {
+	byID := make(map[int64]*account.Account, len(accounts))
+	res := make([]*account.Account, len(accounts))
+	for i, a := range accounts {
+		c := *a
+		res[i], byID[a.ID] = &c, &c
+	}
+	for _, raw := range changes {
+		var fields map[string]json.RawMessage
+		var id struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return nil, err
+		}
+		a, ok := byID[id.ID]
+		if !ok {
+			return nil, fmt.Errorf("unknown account %d", id.ID)
+		}
+		// Decoding into the copy would merge into the maps it shares
+		// with the current account.
+		if _, ok := fields["model_map"]; ok {
+			a.ModelMap = nil
+		}
+		if _, ok := fields["prices"]; ok {
+			a.Prices = nil
+		}
+		if err := json.Unmarshal(raw, a); err != nil {
+			return nil, err
+		}
+		a.ID = id.ID
+	}
+	return res, nil
+}
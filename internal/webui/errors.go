@@ -0,0 +1,47 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// registerLogErrors exposes recent failures grouped by status class and
+// account: GET /api/logs/errors?hours=N (default 24) with up to three
+// example entries per group.
+func (s *Admin) registerLogErrors(mux *http.ServeMux) {
+	mux.HandleFunc("/api/logs/errors", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		hours := 24
+		if v := r.URL.Query().Get("hours"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "bad hours", http.StatusBadRequest)
+				return
+			}
+			hours = n
+		}
+		groups, err := s.Logs.ErrorGroups(ctx, time.Now().Add(-time.Duration(hours)*time.Hour), 3)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names := s.accountNames(ctx)
+		for _, g := range groups {
+			g.AccountName = names[g.AccountID]
+			for _, e := range g.Examples {
+				e.AccountName = g.AccountName
+			}
+		}
+		if err := json.NewEncoder(w).Encode(groups); err != nil {
+			logger.Errorf("encode error groups failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package webui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// configChanged publishes a ConfigChanged event for an admin edit.
+func (s *Admin) configChanged(action string, accountID int64) {
+	if s.Events == nil {
+		return
+	}
+	s.Events.Publish(events.Event{Type: events.ConfigChanged, AccountID: accountID, Message: action})
+}
+
+// registerEvents serves GET /api/events, a server-sent event stream of system
+// events for the live UI.
+func (s *Admin) registerEvents(mux *http.ServeMux) {
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ch := make(chan events.Event, 16)
+		stop := make(chan struct{})
+		unsubscribe := s.Events.Subscribe(func(e events.Event) {
+			select {
+			case ch <- e:
+			case <-stop:
+			}
+		})
+		defer func() {
+			close(stop)
+			unsubscribe()
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e := <-ch:
+				data, err := json.Marshal(e)
+				if err != nil {
+					logger.Errorf("encode event failed: %v", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+					logger.Debugf("event stream closed: %v", err)
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package webui
 
 import (
 	"context"
+	"database/sql"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -14,16 +15,74 @@ import (
 	"strconv"
 	"time"
 
-	"codex-companion/internal/account"
-	logpkg "codex-companion/internal/log"
-	"codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/logviews"
+	"github.com/kxn/codex-companion/internal/maintenance"
+	"github.com/kxn/codex-companion/internal/pricing"
+	"github.com/kxn/codex-companion/internal/profiles"
+	"github.com/kxn/codex-companion/internal/quota"
+	"github.com/kxn/codex-companion/internal/refreshlog"
+	"github.com/kxn/codex-companion/internal/timeline"
+	"github.com/kxn/codex-companion/internal/tombstone"
+	"github.com/kxn/codex-companion/internal/validate"
+	"github.com/kxn/codex-companion/internal/webhook"
+	logpkg "github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/proxy"
+	"github.com/kxn/codex-companion/scheduler"
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
+// Admin bundles the components served under /admin. Optional components may
+// be nil, in which case their endpoints are not registered.
+type Admin struct {
+	Accounts    *account.Manager
+	Logs        logpkg.Storage
+	Maintenance *maintenance.Runner
+	DBHealth    *dbhealth.Monitor
+	Events      *events.Bus
+	Webhooks    *webhook.Queue
+	Chaos       *proxy.Chaos
+	Scheduler   *scheduler.Scheduler
+	Quota       *quota.Poller
+	// Refreshes backs the token refresh history of the account detail.
+	Refreshes *refreshlog.Store
+	// Timeline backs the exhaustion timeline of the account detail.
+	Timeline *timeline.Store
+	// Tombstones names the logs of deleted accounts and applies the
+	// policy for them when accounts are deleted.
+	Tombstones *tombstone.Store
+	// Validator checks the credentials of every account on demand.
+	Validator *validate.Validator
+	// Profiles backs the priority profile endpoints.
+	Profiles *profiles.Store
+	// Proxy probes accounts for the "probe and restore" action.
+	Proxy *proxy.Handler
+	// Prices converts token usage into cost; nil means pricing.Default.
+	Prices pricing.Table
+	// SlowThreshold backs the ?slow=1 filter of the logs API.
+	SlowThreshold time.Duration
+	// LogViews backs the saved log views.
+	LogViews *logviews.Store
+	// DB is served as a snapshot by GET /api/backup.
+	DB *sql.DB
+	// BackupPassphrase encrypts backups requested without the
+	// X-Backup-Passphrase header. Empty leaves them unencrypted.
+	BackupPassphrase string
+}
+
 // AdminHandler registers routes on /admin.
-func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
+func AdminHandler(am *account.Manager, ls logpkg.Storage) http.Handler {
+	return (&Admin{Accounts: am, Logs: ls}).Handler()
+}
+
+// Handler returns the /admin handler for the configured components.
+func (s *Admin) Handler() http.Handler {
+	am, ls := s.Accounts, s.Logs
 	mux := http.NewServeMux()
 	// Static files
 	fsys, err := fs.Sub(staticFiles, "static")
@@ -57,12 +116,19 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 				AccountID    string `json:"account_id"`
 				Priority     int    `json:"priority"`
 				LastRefresh  string `json:"last_refresh"`
+				ProxyURL     string `json:"proxy_url"`
+				CAFile       string `json:"ca_file"`
+				Insecure     bool   `json:"insecure_skip_verify"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				logger.Warnf("bad add account request: %v", err)
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			if err := checkOutbound(&account.Account{ProxyURL: req.ProxyURL, CAFile: req.CAFile, InsecureSkipVerify: req.Insecure}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
 			// Determine priority if not provided
 			priority := req.Priority
@@ -112,6 +178,15 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 				}
 				return
 			}
+			if req.ProxyURL != "" || req.CAFile != "" || req.Insecure {
+				a.ProxyURL, a.CAFile, a.InsecureSkipVerify = req.ProxyURL, req.CAFile, req.Insecure
+				if err := am.Update(ctx, a); err != nil {
+					logger.Errorf("update account outbound settings: %v", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			s.configChanged("account.added", a.ID)
 			if err := json.NewEncoder(w).Encode(a); err != nil {
 				logger.Errorf("encode account failed: %v", err)
 			}
@@ -144,6 +219,7 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		s.configChanged("account.imported", a.ID)
 		if err := json.NewEncoder(w).Encode(a); err != nil {
 			logger.Errorf("encode account failed: %v", err)
 		}
@@ -160,6 +236,7 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		s.configChanged("account.imported", a.ID)
 		if err := json.NewEncoder(w).Encode(a); err != nil {
 			logger.Errorf("encode account failed: %v", err)
 		}
@@ -174,6 +251,12 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 			http.Error(w, "bad id", http.StatusBadRequest)
 			return
 		}
+		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			if old, err := am.Get(ctx, id); err == nil && old != nil && old.Static {
+				http.Error(w, "account is declared in the accounts file", http.StatusForbidden)
+				return
+			}
+		}
 		switch r.Method {
 		case http.MethodPut:
 			var a account.Account
@@ -182,19 +265,65 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			a.ID = id
+			// Only the accounts file declares static accounts.
+			a.ID, a.Static = id, false
+			if !a.MaintenanceEnd.IsZero() && !a.MaintenanceEnd.After(a.MaintenanceStart) {
+				http.Error(w, "maintenance must end after it starts", http.StatusBadRequest)
+				return
+			}
+			if err := checkOutbound(&a); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for model, p := range a.Prices {
+				if p.Input < 0 || p.Output < 0 {
+					http.Error(w, "negative price for "+model, http.StatusBadRequest)
+					return
+				}
+			}
+			if err := account.CheckNotes(a.Notes); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			restored := false
+			if old, err := am.Get(ctx, id); err == nil && old != nil && old.InvalidToken() &&
+				(replaced(a.APIKey, old.APIKey) || replaced(a.RefreshToken, old.RefreshToken) || replaced(a.AccessToken, old.AccessToken)) {
+				// New credentials end the invalid-token state; a new
+				// refresh token is exchanged before the account is used.
+				a.Exhausted, a.ResetAt, a.BlockReason = false, time.Time{}, ""
+				if a.RefreshToken != old.RefreshToken {
+					a.TokenExpiresAt = time.Time{}
+				}
+				restored = true
+			}
 			if err := am.Update(ctx, &a); err != nil {
 				logger.Errorf("update account %d failed: %v", id, err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			s.configChanged("account.updated", id)
+			if restored && s.Events != nil {
+				s.Events.Publish(events.Event{Type: events.AccountReactivated, AccountID: id, Message: "credentials replaced"})
+			}
 			w.WriteHeader(http.StatusNoContent)
 		case http.MethodDelete:
+			old, err := am.Get(ctx, id)
+			if err != nil {
+				logger.Errorf("get account %d failed: %v", id, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if err := am.Delete(ctx, id); err != nil {
 				logger.Errorf("delete account %d failed: %v", id, err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if old != nil && s.Tombstones != nil {
+				if err := s.Tombstones.AccountDeleted(ctx, old); err != nil {
+					logger.Errorf("tombstone of account %d failed: %v", id, err)
+				}
+			}
+			s.configChanged("account.deleted", id)
 			w.WriteHeader(http.StatusNoContent)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -213,21 +342,19 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 			size = 100
 		}
 		offset := (page - 1) * size
-               logs, err := ls.List(ctx, size+1, offset)
+		f, err := s.logFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logs, err := ls.Find(ctx, f, size+1, offset)
                if err != nil {
                        logger.Errorf("list logs failed: %v", err)
                        http.Error(w, err.Error(), http.StatusInternalServerError)
                        return
                }
 
-               accts, err := am.List(ctx)
-               if err != nil {
-                       logger.Errorf("list accounts failed: %v", err)
-               }
-               nameMap := make(map[int64]string)
-               for _, a := range accts {
-                       nameMap[a.ID] = a.Name
-               }
+               nameMap := s.accountNames(ctx)
                for _, l := range logs {
                        if name, ok := nameMap[l.AccountID]; ok {
                                l.AccountName = name
@@ -248,9 +375,100 @@ func AdminHandler(am *account.Manager, ls *logpkg.Store) http.Handler {
 		}
 	})
 
+	mux.HandleFunc("/api/logs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		l, err := ls.Get(ctx, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if l == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if a, err := am.Get(ctx, l.AccountID); err == nil && a != nil {
+			l.AccountName = a.Name
+		} else if s.Tombstones != nil {
+			l.AccountName = s.accountNames(ctx)[l.AccountID]
+		}
+		if err := json.NewEncoder(w).Encode(l); err != nil {
+			logger.Errorf("encode log failed: %v", err)
+		}
+	})
+
+	s.registerStats(mux)
+	s.registerAccountDetail(mux)
+	s.registerProviderImport(mux)
+	s.registerSettings(mux)
+	if s.Logs != nil {
+		s.registerUsage(mux)
+		s.registerLogErrors(mux)
+		s.registerSessions(mux)
+	}
+	if s.Maintenance != nil {
+		s.registerMaintenance(mux)
+	}
+	if s.DBHealth != nil {
+		s.registerIntegrity(mux)
+	}
+	if s.LogViews != nil {
+		s.registerLogViews(mux)
+	}
+	if s.Events != nil {
+		s.registerEvents(mux)
+	}
+	if s.Webhooks != nil {
+		s.registerWebhooks(mux)
+	}
+	if s.Chaos != nil {
+		s.registerChaos(mux)
+	}
+	if s.Scheduler != nil {
+		s.registerScheduler(mux)
+	}
+	if s.Proxy != nil {
+		s.registerProbe(mux)
+	}
+	if s.Proxy != nil && s.Scheduler != nil {
+		s.registerDryRun(mux)
+	}
+	s.registerSimulation(mux)
+	if s.Quota != nil {
+		s.registerQuota(mux)
+	}
+	if s.Timeline != nil {
+		s.registerTimeline(mux)
+	}
+	if s.Tombstones != nil {
+		s.registerTombstones(mux)
+	}
+	if s.Validator != nil {
+		s.registerValidation(mux)
+	}
+	if s.DB != nil {
+		s.registerBackup(mux)
+	}
+	if s.Profiles != nil {
+		s.registerProfiles(mux)
+	}
+
 	return http.StripPrefix("/admin", mux)
 }
 
+// replaced reports whether a credential was changed to a new, non-empty value.
+func replaced(credential, old string) bool {
+	return credential != "" && credential != old
+}
+
 // ImportAuth reads auth.json from CODEX_HOME.
 func ImportAuth(ctx context.Context, am *account.Manager) (*account.Account, error) {
 	logger.Debugf("reading auth.json")
@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -13,29 +14,36 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"codex-companion/internal/account"
-	logpkg "codex-companion/internal/log"
-	_ "modernc.org/sqlite"
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/backup"
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/maintenance"
+	"github.com/kxn/codex-companion/internal/pricing"
+	"github.com/kxn/codex-companion/internal/profiles"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/logviews"
+	"github.com/kxn/codex-companion/internal/quota"
+	"github.com/kxn/codex-companion/internal/ratesim"
+	"github.com/kxn/codex-companion/internal/refreshlog"
+	"github.com/kxn/codex-companion/internal/testdb"
+	"github.com/kxn/codex-companion/internal/timeline"
+	"github.com/kxn/codex-companion/internal/tombstone"
+	"github.com/kxn/codex-companion/internal/validate"
+	"github.com/kxn/codex-companion/internal/webhook"
+	logpkg "github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/proxy"
+	"github.com/kxn/codex-companion/scheduler"
 )
 
-func setupWebUI(t *testing.T) (*account.Manager, *logpkg.Store, http.Handler) {
+func setupWebUI(t *testing.T) (*account.Manager, *logpkg.MemoryStore, http.Handler) {
 	t.Helper()
-	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
-	db, err := sql.Open("sqlite", dsn)
-	if err != nil {
-		t.Fatal(err)
-	}
-	mgr, err := account.NewManager(db)
-	if err != nil {
-		t.Fatal(err)
-	}
-	ls, err := logpkg.NewStore(db)
-	if err != nil {
-		t.Fatal(err)
-	}
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
+	ls := logpkg.NewMemoryStore(1000)
 	h := AdminHandler(mgr, ls)
 	return mgr, ls, h
 }
@@ -120,7 +128,7 @@ func TestAccountsAPI(t *testing.T) {
 		t.Fatalf("post chatgpt: %d", rec.Code)
 	}
 
-	body = `{"type":"api_key","name":"ak","api_key":"k","base_url":"http://example.com"}`
+	body = `{"type":"api_key","name":"ak","api_key":"k","base_url":"http://example.com","proxy_url":"socks5://proxy:1080"}`
 	req = httptest.NewRequest(http.MethodPost, "/admin/api/accounts", strings.NewReader(body))
 	rec = httptest.NewRecorder()
 	h.ServeHTTP(rec, req)
@@ -131,8 +139,8 @@ func TestAccountsAPI(t *testing.T) {
 	if err := json.NewDecoder(rec.Body).Decode(&a); err != nil {
 		t.Fatal(err)
 	}
-	if a.BaseURL != "http://example.com" {
-		t.Fatalf("unexpected base url: %s", a.BaseURL)
+	if a.BaseURL != "http://example.com" || a.ProxyURL != "socks5://proxy:1080" {
+		t.Fatalf("unexpected base url %s or proxy %s", a.BaseURL, a.ProxyURL)
 	}
 
 	// duplicate API key should be rejected
@@ -143,9 +151,36 @@ func TestAccountsAPI(t *testing.T) {
 		t.Fatalf("expected conflict for duplicate api key, got %d", rec.Code)
 	}
 
+	a.ProxyURL = "ftp://proxy:21"
+	buf, _ := json.Marshal(&a)
+	req = httptest.NewRequest(http.MethodPut, "/admin/api/accounts/"+strconv.FormatInt(a.ID, 10), bytes.NewReader(buf))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("put with bad proxy: %d", rec.Code)
+	}
+	a.ProxyURL, a.CAFile = "", "/nonexistent/ca.pem"
+	buf, _ = json.Marshal(&a)
+	req = httptest.NewRequest(http.MethodPut, "/admin/api/accounts/"+strconv.FormatInt(a.ID, 10), bytes.NewReader(buf))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("put with missing CA bundle: %d", rec.Code)
+	}
+	a.CAFile, a.Notes = "", map[string]string{"paused": "back soon"}
+	buf, _ = json.Marshal(&a)
+	req = httptest.NewRequest(http.MethodPut, "/admin/api/accounts/"+strconv.FormatInt(a.ID, 10), bytes.NewReader(buf))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("put with unknown note state: %d", rec.Code)
+	}
+	a.Notes = nil
+
 	a.Name = "new"
 	a.BaseURL = "http://new.example.com"
-	buf, _ := json.Marshal(&a)
+	a.CAFile = ""
+	buf, _ = json.Marshal(&a)
 	req = httptest.NewRequest(http.MethodPut, "/admin/api/accounts/"+strconv.FormatInt(a.ID, 10), bytes.NewReader(buf))
 	rec = httptest.NewRecorder()
 	h.ServeHTTP(rec, req)
@@ -213,3 +248,1270 @@ func TestLogsAPI(t *testing.T) {
                t.Fatalf("logs decode: %v %+v", err, res)
        }
 }
+
+func TestMaintenanceAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	db := testdb.Open(t)
+	mr, err := maintenance.New(db, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&Admin{Accounts: mgr, Logs: ls, Maintenance: mr}).Handler()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/api/maintenance/run", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("run status %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/api/maintenance", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var st maintenance.Status
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil || st.LastRun.IsZero() || len(st.Steps) != 3 || st.Interval != "1h0m0s" {
+		t.Fatalf("status decode: %v %+v", err, st)
+	}
+}
+
+func TestStatsAPI(t *testing.T) {
+	db := testdb.Open(t)
+	mgr, _ := account.NewManager(db)
+	ls, _ := logpkg.NewStore(db)
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	h := (&Admin{Accounts: mgr, Logs: ls, DBHealth: dbhealth.New(db, "", 0)}).Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/api/stats", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stats status %d", rec.Code)
+	}
+	var res struct {
+		DB dbhealth.Health `json:"db"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.DB.Tables["accounts"] != 1 {
+		t.Fatalf("stats decode: %v %+v", err, res)
+	}
+}
+
+func TestIntegrityAPI(t *testing.T) {
+	db := testdb.Open(t)
+	mgr, _ := account.NewManager(db)
+	ls, _ := logpkg.NewStore(db)
+	refreshes, _ := refreshlog.New(db)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	refreshes.Record(ctx, &refreshlog.Attempt{AccountID: a.ID, Time: time.Now()})
+	mgr.Delete(ctx, a.ID)
+	h := (&Admin{Accounts: mgr, Logs: ls, DBHealth: dbhealth.New(db, "", 0)}).Handler()
+
+	call := func(method, path string) (int, *dbhealth.Integrity) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var res *dbhealth.Integrity
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+	if code, res := call(http.MethodGet, "/admin/api/db/integrity"); code != http.StatusOK || res != nil {
+		t.Fatalf("expected no report yet: %d %+v", code, res)
+	}
+	if code, res := call(http.MethodPost, "/admin/api/db/integrity"); code != http.StatusOK || res.Orphans["token_refreshes"] != 1 {
+		t.Fatalf("check: %d %+v", code, res)
+	}
+	if code, res := call(http.MethodPost, "/admin/api/db/integrity?repair=1"); code != http.StatusOK || !res.OK() || len(res.Repaired) != 1 {
+		t.Fatalf("repair: %d %+v", code, res)
+	}
+	if code, res := call(http.MethodGet, "/admin/api/db/integrity"); code != http.StatusOK || res == nil || !res.OK() {
+		t.Fatalf("last report: %d %+v", code, res)
+	}
+}
+
+func TestEventsAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	bus := events.NewBus()
+	srv := httptest.NewServer((&Admin{Accounts: mgr, Logs: ls, Events: bus}).Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/admin/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+
+	body := `{"type":"api_key","name":"a","api_key":"k"}`
+	r, err := http.Post(srv.URL+"/admin/api/accounts", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	buf := make([]byte, 512)
+	n, err := resp.Body.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	if !strings.HasPrefix(got, "event: config.changed\n") || !strings.Contains(got, `"message":"account.added"`) {
+		t.Fatalf("unexpected stream %q", got)
+	}
+}
+
+func TestWebhooksAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	db := testdb.Open(t)
+	q, err := webhook.New(db, nil, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := q.Enqueue(context.Background(), "http://127.0.0.1:1/hook", "config.changed", []byte(`{}`))
+	q.Process(context.Background())
+	h := (&Admin{Accounts: mgr, Logs: ls, Webhooks: q}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/webhooks?status=dead", nil))
+	var res struct {
+		Deliveries []webhook.Delivery `json:"deliveries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Deliveries) != 1 || res.Deliveries[0].ID != id {
+		t.Fatalf("list webhooks: %v %+v", err, res)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/api/webhooks/%d/replay", id), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("replay status %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/api/webhooks/999/replay", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("replay unknown status %d", rec.Code)
+	}
+}
+
+func TestChaosAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	h := (&Admin{Accounts: mgr, Logs: ls, Chaos: proxy.NewChaos()}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/api/chaos", strings.NewReader(`{"enabled":true,"percent":20,"faults":["500"]}`)))
+	var cfg proxy.ChaosConfig
+	if err := json.NewDecoder(rec.Body).Decode(&cfg); err != nil || !cfg.Enabled || cfg.Percent != 20 {
+		t.Fatalf("put chaos: %d %v %+v", rec.Code, err, cfg)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/api/chaos", strings.NewReader(`{"percent":200}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid config, got %d", rec.Code)
+	}
+}
+
+func TestLogLevelAPI(t *testing.T) {
+	_, _, h := setupWebUI(t)
+	t.Cleanup(func() { logger.SetLevel(logger.Info) })
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/api/settings/loglevel", strings.NewReader(`{"level":"DEBUG"}`)))
+	var res logLevel
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Level != "debug" || logger.GetLevel() != logger.Debug {
+		t.Fatalf("put log level: %d %v %+v", rec.Code, err, res)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/api/settings/loglevel", strings.NewReader(`{"level":"verbose"}`)))
+	if rec.Code != http.StatusBadRequest || logger.GetLevel() != logger.Debug {
+		t.Fatalf("expected 400 for unknown level, got %d", rec.Code)
+	}
+}
+
+func TestDebugCaptureAPI(t *testing.T) {
+	_, _, h := setupWebUI(t)
+	t.Cleanup(logger.ClearCaptured)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/api/settings/debug-capture", strings.NewReader(`{"requests":2}`)))
+	var res debugCapture
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Remaining != 2 {
+		t.Fatalf("arm capture: %d %v %+v", rec.Code, err, res)
+	}
+	ctx, endTrace := logger.BeginTrace(context.Background(), "req-1", "POST /v1/responses")
+	logger.Debugc(ctx, "captured line")
+	endTrace()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/settings/debug-capture", nil))
+	res = debugCapture{}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Remaining != 1 || len(res.Traces) != 1 {
+		t.Fatalf("get capture: %v %+v", err, res)
+	}
+	if tr := res.Traces[0]; tr.ID != "req-1" || len(tr.Lines) != 1 || !strings.Contains(tr.Lines[0], "[DEBUG] captured line") {
+		t.Fatalf("unexpected trace %+v", tr)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/api/settings/debug-capture", nil))
+	res = debugCapture{}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Remaining != 0 || len(res.Traces) != 0 {
+		t.Fatalf("clear capture: %v %+v", err, res)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/api/settings/debug-capture", strings.NewReader(`{"requests":0}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for zero requests, got %d", rec.Code)
+	}
+}
+
+func TestSchedulerAdaptiveAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	mgr.SetPriorityAdjustment(ctx, a.ID, 3)
+	h := (&Admin{Accounts: mgr, Logs: ls, Scheduler: scheduler.New(mgr)}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/scheduler/adaptive", nil))
+	var res struct {
+		Accounts []scheduler.AccountStats `json:"accounts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Accounts) != 1 || res.Accounts[0].Adjustment != 3 {
+		t.Fatalf("adaptive stats: %v %+v", err, res)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/admin/api/scheduler/adaptive/%d", a.ID), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("reset status %d", rec.Code)
+	}
+	if got, _ := mgr.Get(ctx, a.ID); got.PriorityAdjustment != 0 {
+		t.Fatalf("adjustment not reset: %d", got.PriorityAdjustment)
+	}
+}
+
+func TestSchedulerRampUpAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	mgr.RampUp = 5
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	h := (&Admin{Accounts: mgr, Logs: ls, Scheduler: scheduler.New(mgr)}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/scheduler/ramp-up", nil))
+	var res []scheduler.RampUpStats
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res) != 1 || res[0].Remaining != 5 || res[0].Trust >= 0.1 {
+		t.Fatalf("ramp-up stats: %v %+v", err, res)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/admin/api/scheduler/ramp-up/%d", a.ID), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("end status %d", rec.Code)
+	}
+	if got, _ := mgr.Get(ctx, a.ID); got.RampUp != 0 {
+		t.Fatalf("ramp-up not ended: %d", got.RampUp)
+	}
+}
+
+func TestUsageAPI(t *testing.T) {
+	_, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	now := time.Now()
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, ClientKey: "ck-a", InputTokens: 10, OutputTokens: 5})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, ClientKey: "ck-a", InputTokens: 1, OutputTokens: 1})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 429, ClientKey: "ck-a"})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now.AddDate(0, 0, -30), Status: 200, ClientKey: "ck-b", InputTokens: 7})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/usage?days=2", nil))
+	var res []logpkg.Usage
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res) != 1 {
+		t.Fatalf("usage: %v %+v", err, res)
+	}
+	if u := res[0]; u.ClientKey != "ck-a" || u.Requests != 2 || u.InputTokens != 11 || u.OutputTokens != 6 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/usage?days=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad days status %d", rec.Code)
+	}
+}
+
+func TestQuotaAPI(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := mgr.AddChatGPT(ctx, "a", "rt", "acct", 1)
+	a.AccessToken = "t"
+	a.TokenExpiresAt = time.Now().Add(time.Hour)
+	mgr.Update(ctx, a)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"plan_type":"plus","rate_limit":{"primary_window":{"used_percent":30,"limit_window_seconds":18000}}}`)
+	}))
+	defer srv.Close()
+	db := testdb.Open(t)
+	p, err := quota.New(db, mgr, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Poll(ctx)
+	h := (&Admin{Accounts: mgr, Logs: ls, Quota: p}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/quota", nil))
+	var latest []quota.Snapshot
+	if err := json.NewDecoder(rec.Body).Decode(&latest); err != nil || len(latest) != 1 || latest[0].Primary.UsedPercent != 30 {
+		t.Fatalf("latest quota: %v %+v", err, latest)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/quota/%d?hours=1", a.ID), nil))
+	var hist []quota.Snapshot
+	if err := json.NewDecoder(rec.Body).Decode(&hist); err != nil || len(hist) != 1 || hist[0].PlanType != "plus" {
+		t.Fatalf("quota history: %v %+v", err, hist)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/quota/x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad id status %d", rec.Code)
+	}
+}
+
+func TestStatsModels(t *testing.T) {
+	mgr, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	now := time.Now()
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, Model: "gpt-5", InputTokens: 1_000_000, OutputTokens: 100_000, ClientKey: "c1", ReqSize: 300, RespSize: 700})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 500, Model: "gpt-5", Error: "boom"})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, Model: "local", InputTokens: 5})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now.AddDate(0, 0, -60), Status: 200, Model: "o3"})
+	h := (&Admin{Accounts: mgr, Logs: ls, Prices: pricing.Table{"gpt-5": {Input: 1, Output: 10}}}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/stats", nil))
+	var res struct {
+		Models    []logpkg.ModelStats `json:"models"`
+		Bandwidth logpkg.Bandwidth    `json:"bandwidth"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Models) != 2 {
+		t.Fatalf("stats models: %v %+v", err, res)
+	}
+	if bw := res.Bandwidth; bw.Total.Bytes() != 1000 || len(bw.Clients) != 2 || bw.Clients[1].ClientKey != "c1" || bw.Clients[1].SentBytes != 300 {
+		t.Fatalf("unexpected bandwidth %+v", bw)
+	}
+	m := res.Models[0]
+	if m.Model != "gpt-5" || m.Requests != 2 || m.Errors != 1 || m.ErrorRate != 0.5 || m.CostUSD != 2 {
+		t.Fatalf("unexpected gpt-5 stats %+v", m)
+	}
+	if res.Models[1].Model != "local" || res.Models[1].CostUSD != 0 {
+		t.Fatalf("unexpected local stats %+v", res.Models[1])
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/stats?days=90", nil))
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Models) != 3 {
+		t.Fatalf("stats with days: %v %+v", err, res)
+	}
+}
+
+func TestLogsAPISlowFilter(t *testing.T) {
+	mgr, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), Method: "POST", URL: "fast", DurationMs: 100})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), Method: "POST", URL: "slow", DurationMs: 5000, TTFBMs: 4000})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/logs?slow=1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("slow filter without threshold: %d", rec.Code)
+	}
+
+	h = (&Admin{Accounts: mgr, Logs: ls, SlowThreshold: time.Second}).Handler()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/logs?slow=1", nil))
+	var res struct {
+		Logs []logpkg.RequestLog `json:"logs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Logs) != 1 || res.Logs[0].URL != "slow" || res.Logs[0].TTFBMs != 4000 {
+		t.Fatalf("slow logs: %v %+v", err, res)
+	}
+}
+
+func TestLogsAPIFilters(t *testing.T) {
+	am, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now().Add(-48 * time.Hour), AccountID: a.ID, URL: "old", Status: 500})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, URL: "ok", Status: 200})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, URL: "failed", Status: 502, Model: "gpt-5"})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID + 1, URL: "other", Status: 429})
+
+	urls := func(query string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/logs?"+query, nil))
+		if rec.Code != http.StatusOK {
+			return fmt.Sprint(rec.Code)
+		}
+		var res struct {
+			Logs []logpkg.RequestLog `json:"logs"`
+		}
+		json.NewDecoder(rec.Body).Decode(&res)
+		var got []string
+		for _, l := range res.Logs {
+			got = append(got, l.URL)
+		}
+		return strings.Join(got, ",")
+	}
+	for query, want := range map[string]string{
+		"":                              "other,failed,ok,old",
+		fmt.Sprintf("account=%d", a.ID): "failed,ok,old",
+		fmt.Sprintf("account=%d&errors=1&window=24h", a.ID): "failed",
+		"errors=1&size=2&page=2":                            "old",
+		"model=gpt-5&status=502":                            "failed",
+		"account=x":                                         "400",
+		"window=-1h":                                        "400",
+	} {
+		if got := urls(query); got != want {
+			t.Fatalf("%q: got %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestLogViewsAPI(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	db := testdb.Open(t)
+	views, err := logviews.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&Admin{Accounts: am, Logs: ls, LogViews: views}).Handler()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	if rec := do(http.MethodPost, "/admin/api/log-views", `{"name":"recent errors","query":"errors=1&window=24h&page=3"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("save view: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, body := range []string{`{"name":"bad","query":"window=soon"}`, `{"name":"slow","query":"slow=1"}`, `{"name":"","query":""}`} {
+		if rec := do(http.MethodPost, "/admin/api/log-views", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+	var list []logviews.View
+	if err := json.NewDecoder(do(http.MethodGet, "/admin/api/log-views", "").Body).Decode(&list); err != nil || len(list) != 1 || list[0].Query != "errors=1&window=24h" {
+		t.Fatalf("unexpected views %+v %v", list, err)
+	}
+	if rec := do(http.MethodDelete, "/admin/api/log-views/recent%20errors", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete view: %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/api/log-views/recent%20errors", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete missing view: %d", rec.Code)
+	}
+}
+
+func TestLogErrorsAPI(t *testing.T) {
+	am, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Status: 200})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Status: 503, Error: "unavailable"})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/logs/errors?hours=1", nil))
+	var groups []logpkg.ErrorGroup
+	if err := json.NewDecoder(rec.Body).Decode(&groups); err != nil || len(groups) != 1 {
+		t.Fatalf("error groups: %v %+v", err, groups)
+	}
+	g := groups[0]
+	if g.Class != logpkg.Class5xx || g.AccountName != "acc" || g.Count != 1 || len(g.Examples) != 1 || g.Examples[0].Error != "unavailable" {
+		t.Fatalf("unexpected group %+v", g)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/logs/errors?hours=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad hours status %d", rec.Code)
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	_, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	now := time.Now()
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, AccountID: 2, InputTokens: 100, CachedTokens: 75})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, AccountID: 2, InputTokens: 100, CachedTokens: 25})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 200, AccountID: 1, InputTokens: 10})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, Status: 500, AccountID: 1, InputTokens: 10, CachedTokens: 10})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/stats", nil))
+	var res struct {
+		Cache []logpkg.CacheStats `json:"cache"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Cache) != 2 {
+		t.Fatalf("stats cache: %v %+v", err, res)
+	}
+	if c := res.Cache[0]; c.AccountID != 1 || c.Requests != 1 || c.HitRatio != 0 {
+		t.Fatalf("unexpected account 1 cache stats %+v", c)
+	}
+	if c := res.Cache[1]; c.AccountID != 2 || c.Requests != 2 || c.CachedTokens != 100 || c.HitRatio != 0.5 {
+		t.Fatalf("unexpected account 2 cache stats %+v", c)
+	}
+}
+
+func TestAccountDetail(t *testing.T) {
+	am, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	other, _ := am.AddAPIKey(ctx, "other", "k2", "", 1)
+	now := time.Now()
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, AccountID: a.ID, Status: 200, DurationMs: 100, InputTokens: 10, OutputTokens: 5, CachedTokens: 4})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, AccountID: a.ID, Status: 503, DurationMs: 300, Error: "unavailable"})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now, AccountID: other.ID, Status: 500, Error: "other"})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: now.AddDate(0, 0, -10), AccountID: a.ID, Status: 200, InputTokens: 1000})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/accounts/%d/detail", a.ID), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var d struct {
+		Account *account.Account     `json:"account"`
+		Token   *tokenStatus         `json:"token"`
+		Stats   *logpkg.AccountStats `json:"stats"`
+		Recent  []*logpkg.RequestLog `json:"recent"`
+		Errors  []*logpkg.ErrorGroup `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Account == nil || d.Account.Name != "acc" || d.Token != nil {
+		t.Fatalf("unexpected account section %+v %+v", d.Account, d.Token)
+	}
+	if s := d.Stats; s == nil || s.Requests != 2 || s.Errors != 1 || s.AvgDurationMs != 200 || s.InputTokens != 10 || s.CachedTokens != 4 {
+		t.Fatalf("unexpected stats %+v", d.Stats)
+	}
+	if len(d.Recent) != 3 {
+		t.Fatalf("expected all 3 logs of the account, got %d", len(d.Recent))
+	}
+	if len(d.Errors) != 1 || d.Errors[0].Examples[0].Error != "unavailable" {
+		t.Fatalf("unexpected errors %+v", d.Errors)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/accounts/%d/detail?days=30", a.ID), nil))
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil || d.Stats.Requests != 3 {
+		t.Fatalf("days=30 stats: %v %+v", err, d.Stats)
+	}
+
+	for path, want := range map[string]int{
+		"/admin/api/accounts/999/detail":                         http.StatusNotFound,
+		"/admin/api/accounts/x/detail":                           http.StatusBadRequest,
+		fmt.Sprintf("/admin/api/accounts/%d/detail?days=0", a.ID): http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Fatalf("%s: status %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestAccountDetailToken(t *testing.T) {
+	am, _, h := setupWebUI(t)
+	ctx := context.Background()
+	a, err := am.AddChatGPT(ctx, "gpt", "rt", "acct", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AccessToken = "at"
+	a.TokenExpiresAt = time.Now().Add(time.Hour)
+	if err := am.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/accounts/%d/detail", a.ID), nil))
+	var d struct {
+		Token *tokenStatus `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil || d.Token == nil {
+		t.Fatalf("token section: %v %s", err, rec.Body.String())
+	}
+	if !d.Token.HasAccessToken || d.Token.RefreshDue {
+		t.Fatalf("unexpected token status %+v", d.Token)
+	}
+}
+
+func TestAccountDetailRefreshes(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddChatGPT(ctx, "gpt", "rt", "acct", 1)
+	db := testdb.Open(t)
+	refreshes, err := refreshlog.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	refreshes.Record(ctx, &refreshlog.Attempt{AccountID: a.ID, Time: now.Add(-time.Hour), Trigger: "request", Error: "status 400"})
+	refreshes.Record(ctx, &refreshlog.Attempt{AccountID: a.ID, Time: now, Trigger: "quota", Success: true, ExpiresAt: now.Add(time.Hour)})
+	refreshes.Record(ctx, &refreshlog.Attempt{AccountID: a.ID, Time: now.AddDate(0, 0, -10), Trigger: "request", Error: "old"})
+	h := (&Admin{Accounts: am, Logs: ls, Refreshes: refreshes}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/accounts/%d/detail", a.ID), nil))
+	var d struct {
+		Refreshes []refreshlog.Attempt `json:"refreshes"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Refreshes) != 2 || d.Refreshes[0].Error != "status 400" || !d.Refreshes[1].Success || d.Refreshes[1].Trigger != "quota" {
+		t.Fatalf("unexpected refreshes %+v", d.Refreshes)
+	}
+}
+
+func TestAccountTimelineAPI(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	db := testdb.Open(t)
+	transitions, err := timeline.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	transitions.Record(ctx, &timeline.Transition{AccountID: a.ID, Time: now.AddDate(0, 0, -10), Kind: timeline.KindExhausted})
+	transitions.Record(ctx, &timeline.Transition{AccountID: a.ID, Time: now.Add(-2 * time.Hour), Kind: timeline.KindReactivated})
+	transitions.Record(ctx, &timeline.Transition{AccountID: a.ID, Time: now.Add(-time.Hour), Kind: timeline.KindBlocked, Reason: "insufficient_quota", Until: now.Add(time.Hour)})
+	h := (&Admin{Accounts: am, Logs: ls, Timeline: transitions}).Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/accounts/%d/timeline", a.ID), nil))
+	var res accountTimeline
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Transitions) != 2 || res.Transitions[1].Reason != "insufficient_quota" {
+		t.Fatalf("unexpected transitions %+v", res.Transitions)
+	}
+	// The exhaustion before the period still counts from its start.
+	p := res.Periods
+	if len(p) != 2 || !p[0].Start.Equal(res.Since) || p[0].Kind != timeline.KindExhausted || p[1].Kind != timeline.KindBlocked || !p[1].Ongoing {
+		t.Fatalf("unexpected periods %+v", p)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/accounts/%d/timeline?days=0", a.ID), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad days accepted: %d", rec.Code)
+	}
+}
+
+func TestStaticAccountReadOnly(t *testing.T) {
+	am, _, h := setupWebUI(t)
+	ctx := context.Background()
+	if _, err := am.SyncStatic(ctx, []account.StaticAccount{{Name: "declared", APIKey: "k"}}); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := am.List(ctx)
+	a := list[0]
+	body, _ := json.Marshal(a)
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, fmt.Sprintf("/admin/api/accounts/%d", a.ID), bytes.NewReader(body)))
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("%s static account: %d", method, rec.Code)
+		}
+	}
+
+	// An edited account cannot make itself static.
+	other, _ := am.AddAPIKey(ctx, "manual", "k2", "", 1)
+	other.Static = true
+	body, _ = json.Marshal(other)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/api/accounts/%d", other.ID), bytes.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("put: %d %s", rec.Code, rec.Body)
+	}
+	if got, _ := am.Get(ctx, other.ID); got.Static {
+		t.Fatal("account made static through the admin API")
+	}
+}
+
+func TestAccountValidation(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	release := make(chan struct{})
+	v := validate.New(am, func(ctx context.Context, _ *account.Account) (int, error) {
+		<-release
+		return http.StatusUnauthorized, nil
+	})
+	bus := events.NewBus()
+	v.Events = bus
+	validated := make(chan events.Event, 1)
+	defer bus.Subscribe(func(e events.Event) { validated <- e }, events.AccountValidated)()
+	h := (&Admin{Accounts: am, Logs: ls, Validator: v}).Handler()
+	do := func(method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/admin/api/accounts/validation", nil))
+		return rec
+	}
+
+	if rec := do(http.MethodGet); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "null" {
+		t.Fatalf("before the first run: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost); rec.Code != http.StatusAccepted {
+		t.Fatalf("start: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost); rec.Code != http.StatusConflict {
+		t.Fatalf("start while running: %d", rec.Code)
+	}
+	close(release)
+	select {
+	case e := <-validated:
+		if e.AccountID != a.ID || e.Data["valid"] != false || e.Data["status"] != http.StatusUnauthorized {
+			t.Fatalf("event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no validation event")
+	}
+	var run validate.Run
+	if err := json.NewDecoder(do(http.MethodGet).Body).Decode(&run); err != nil {
+		t.Fatal(err)
+	}
+	if run.Accounts != 1 || len(run.Results) != 1 || run.Results[0].Valid {
+		t.Fatalf("run %+v", run)
+	}
+}
+
+func TestDeletedAccountLogs(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Method: "POST", URL: "u", Status: 200})
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: 42, Method: "POST", URL: "u", Status: 200})
+	db := testdb.Open(t)
+	tombstones, err := tombstone.New(db, am, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&Admin{Accounts: am, Logs: ls, Tombstones: tombstones}).Handler()
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	names := func() map[string]bool {
+		var res struct{ Logs []*logpkg.RequestLog }
+		if err := json.NewDecoder(do(http.MethodGet, "/admin/api/logs").Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, l := range res.Logs {
+			got[l.AccountName] = true
+		}
+		return got
+	}
+
+	if rec := do(http.MethodDelete, fmt.Sprintf("/admin/api/accounts/%d", a.ID)); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	if got := names(); !got["acc (deleted)"] || len(got) != 2 {
+		t.Fatalf("logs named %v", got)
+	}
+	// The account deleted before tombstones were kept gets one on apply.
+	var res tombstone.Result
+	if err := json.NewDecoder(do(http.MethodPost, "/admin/api/maintenance/deleted-account-logs").Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Policy != tombstone.PolicyKeep || len(res.Tombstoned) != 1 || res.Tombstoned[0] != 42 || len(res.DeletedLogs) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got := names(); !got["acc (deleted)"] || !got["deleted account 42"] {
+		t.Fatalf("logs named %v", got)
+	}
+
+	tombstones.Policy = tombstone.PolicyImmediate
+	do(http.MethodPost, "/admin/api/maintenance/deleted-account-logs")
+	if logs, _ := ls.List(ctx, 10, 0); len(logs) != 0 {
+		t.Fatalf("%d logs left", len(logs))
+	}
+	var status deletedAccountLogs
+	if err := json.NewDecoder(do(http.MethodGet, "/admin/api/maintenance/deleted-account-logs").Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Policy != tombstone.PolicyImmediate || len(status.Tombstones) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestLogDetailAPI(t *testing.T) {
+	am, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Method: "POST", URL: "u", ReqBody: "prompt", RespBody: "answer", RespHeader: http.Header{"X": {"1"}}, Status: 200})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/logs", nil))
+	var list struct {
+		Logs []logpkg.RequestLog `json:"logs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list.Logs) != 1 {
+		t.Fatalf("logs: %v %+v", err, list)
+	}
+	if l := list.Logs[0]; l.ReqBody != "" || l.RespBody != "" || l.RespHeader != nil {
+		t.Fatalf("list carried bodies: %+v", l)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/admin/api/logs/%d", list.Logs[0].ID), nil))
+	var l logpkg.RequestLog
+	if err := json.NewDecoder(rec.Body).Decode(&l); err != nil {
+		t.Fatal(err)
+	}
+	if l.ReqBody != "prompt" || l.RespBody != "answer" || l.RespHeader.Get("X") != "1" || l.AccountName != "acc" {
+		t.Fatalf("unexpected log detail %+v", l)
+	}
+
+	for path, want := range map[string]int{"/admin/api/logs/999": http.StatusNotFound, "/admin/api/logs/x": http.StatusBadRequest} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Fatalf("%s: status %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestUpdateMaintenanceWindow(t *testing.T) {
+	am, _, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	start := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	for _, tc := range []struct {
+		end  time.Time
+		want int
+	}{{start.Add(-time.Minute), http.StatusBadRequest}, {start.Add(time.Hour), http.StatusNoContent}} {
+		a.MaintenanceStart, a.MaintenanceEnd = start, tc.end
+		body, _ := json.Marshal(a)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/api/accounts/%d", a.ID), bytes.NewReader(body)))
+		if rec.Code != tc.want {
+			t.Fatalf("end %v: status %d, want %d", tc.end, rec.Code, tc.want)
+		}
+	}
+	got, _ := am.Get(ctx, a.ID)
+	if !got.MaintenanceStart.Equal(start) || !got.MaintenanceEnd.Equal(start.Add(time.Hour)) || got.InMaintenance(time.Now()) {
+		t.Fatalf("unexpected window %v - %v", got.MaintenanceStart, got.MaintenanceEnd)
+	}
+}
+
+func TestUpdatePrices(t *testing.T) {
+	am, _, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	for _, tc := range []struct {
+		price pricing.Price
+		want  int
+	}{{pricing.Price{Input: -1, Output: 1}, http.StatusBadRequest}, {pricing.Price{Input: 0.5, Output: 4}, http.StatusNoContent}} {
+		a.Prices = pricing.Table{"gpt-5": tc.price}
+		body, _ := json.Marshal(a)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/api/accounts/%d", a.ID), bytes.NewReader(body)))
+		if rec.Code != tc.want {
+			t.Fatalf("price %v: status %d, want %d", tc.price, rec.Code, tc.want)
+		}
+	}
+	got, _ := am.Get(ctx, a.ID)
+	if p, ok := got.Prices.Lookup("gpt-5"); !ok || p.Output != 4 {
+		t.Fatalf("prices not stored: %+v", got.Prices)
+	}
+}
+
+func TestProbeAndRestore(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusForbidden)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer k" {
+			t.Errorf("unexpected probe %s %v", r.URL.Path, r.Header)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+	am, ls, _ := setupWebUI(t)
+	bus := events.NewBus()
+	h := (&Admin{Accounts: am, Logs: ls, Events: bus, Proxy: proxy.New(nil, nil, upstream.URL+"/v1", upstream.URL)}).Handler()
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	am.MarkBlocked(ctx, a.ID, account.BlockQuarantined, time.Now().Add(time.Hour))
+	got := make(chan events.Event, 1)
+	defer bus.Subscribe(func(e events.Event) { got <- e }, events.AccountReactivated)()
+
+	probe := func() probeResult {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/api/accounts/%d/probe", a.ID), nil))
+		var res probeResult
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &res) != nil {
+			t.Fatalf("status %d %s", rec.Code, rec.Body.String())
+		}
+		return res
+	}
+	if res := probe(); res.Status != http.StatusForbidden || res.Restored {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	status.Store(http.StatusOK)
+	if res := probe(); res.Status != http.StatusOK || !res.Restored {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got, _ := am.Get(ctx, a.ID); got.Exhausted || got.BlockReason != "" {
+		t.Fatalf("account not restored: %+v", got)
+	}
+	if e := <-got; e.AccountID != a.ID || e.Message != "probe succeeded" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestRoutingDryRunAPI(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	h := (&Admin{Accounts: am, Logs: ls, Scheduler: scheduler.New(am), Proxy: proxy.New(nil, nil, "https://api.openai.com/v1", "")}).Handler()
+	ctx := context.Background()
+	a1, _ := am.AddAPIKey(ctx, "a1", "k1", "", 1)
+	a2, _ := am.AddAPIKey(ctx, "a2", "k2", "", 2)
+	for _, model := range []string{"gpt-5", "gpt-5-mini"} {
+		ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a1.ID, URL: "https://api.openai.com/v1/responses", Model: model, Status: 200,
+			ReqBody: fmt.Sprintf(`{"model":%q,"store":true}`, model)})
+	}
+	dryRun := func(body string) (int, dryRunResult) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/api/routing/dry-run", strings.NewReader(body)))
+		var res dryRunResult
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+	if code, res := dryRun(`{}`); code != http.StatusOK || res.Requests != 2 || len(res.Changes) != 0 {
+		t.Fatalf("unchanged rules: %d %+v", code, res)
+	}
+	code, res := dryRun(fmt.Sprintf(`{"accounts":[{"id":%d,"model_map":{"gpt-5":"gpt-5-codex"}}]}`, a1.ID))
+	if code != http.StatusOK || len(res.Changes) != 1 || res.Changes[0].Model != "gpt-5" || res.Changes[0].After.Model != "gpt-5-codex" {
+		t.Fatalf("model map: %d %+v", code, res)
+	}
+	code, res = dryRun(fmt.Sprintf(`{"accounts":[{"id":%d,"priority":5}],"requests":1}`, a1.ID))
+	if code != http.StatusOK || res.Requests != 1 || len(res.Changes) != 1 || res.Changes[0].After.Account != a2.ID {
+		t.Fatalf("priority: %d %+v", code, res)
+	}
+	// Nothing is applied.
+	if got, _ := am.Get(ctx, a1.ID); got.Priority != 1 || got.ModelMap != nil {
+		t.Fatalf("account changed: %+v", got)
+	}
+	for _, body := range []string{`{"accounts":[{"id":99}]}`, `{"mode":"random"}`, `[`} {
+		if code, _ := dryRun(body); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, code)
+		}
+	}
+}
+
+func TestRateLimitSimulationAPI(t *testing.T) {
+	am, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "key", "k", "", 1)
+	bad, _ := am.AddAPIKey(ctx, "bad", "k2", "", 2)
+	bad.BlockReason = account.BlockInvalidToken
+	am.Update(ctx, bad)
+	header := http.Header{}
+	header.Set("X-Ratelimit-Limit-Requests", "10")
+	header.Set("X-Ratelimit-Remaining-Requests", "9")
+	header.Set("X-Ratelimit-Reset-Requests", "6s")
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Status: 200, RespHeader: header})
+	simulate := func(body string) (int, ratesim.Result) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/api/rate-limit-simulation", strings.NewReader(body)))
+		var res ratesim.Result
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+	code, res := simulate(`{"requests_per_hour":1200,"tokens_per_request":1000,"hours":1}`)
+	if code != http.StatusOK || len(res.Accounts) != 1 || res.Exhausted == nil || res.Served < 590 || res.Served > 600 || res.Rejected < 600 {
+		t.Fatalf("simulation: %d %+v", code, res)
+	}
+	if l := res.Accounts[0].Limits; len(l) != 1 || l[0].Capacity != 10 || l[0].WindowMinutes != 1 {
+		t.Fatalf("limits %+v", l)
+	}
+	if code, res := simulate(`{"requests_per_hour":300}`); code != http.StatusOK || res.Exhausted != nil || !res.End.Equal(res.Start.Add(8*time.Hour)) {
+		t.Fatalf("within limits: %d %+v", code, res)
+	}
+	for _, body := range []string{`{}`, `{"requests_per_hour":10,"hours":1000}`, `[`} {
+		if code, _ := simulate(body); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, code)
+		}
+	}
+}
+
+func TestProbeCapabilitiesAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/responses" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {}\n\n")
+	}))
+	defer upstream.Close()
+	am, ls, _ := setupWebUI(t)
+	h := (&Admin{Accounts: am, Logs: ls, Proxy: proxy.New(nil, nil, upstream.URL, upstream.URL)}).Handler()
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "relay", "k", "", 1)
+	cg, _ := am.AddChatGPT(ctx, "cg", "rt", "acct", 2)
+
+	probe := func(id int64) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/api/accounts/%d/capabilities", id), nil))
+		return rec
+	}
+	rec := probe(a.ID)
+	var caps account.Capabilities
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &caps) != nil || !caps.Responses || caps.ChatCompletions || !caps.Streaming || !caps.Tools {
+		t.Fatalf("probe: %d %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := am.Get(ctx, a.ID); got.Capabilities == nil || got.Capabilities.ChatCompletions {
+		t.Fatalf("capabilities not stored: %+v", got.Capabilities)
+	}
+	if rec := probe(cg.ID); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a ChatGPT account, got %d", rec.Code)
+	}
+	if rec := probe(99); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestUpdateReplacesInvalidToken(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	bus := events.NewBus()
+	h := (&Admin{Accounts: am, Logs: ls, Events: bus}).Handler()
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "old", "", 1)
+	am.MarkBlocked(ctx, a.ID, account.BlockInvalidToken, time.Time{})
+	a, _ = am.Get(ctx, a.ID)
+	got := make(chan events.Event, 1)
+	defer bus.Subscribe(func(e events.Event) { got <- e }, events.AccountReactivated)()
+
+	put := func(key string) {
+		a.APIKey = key
+		body, _ := json.Marshal(a)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/api/accounts/%d", a.ID), bytes.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	// Other edits keep the account out of rotation.
+	put("old")
+	if got, _ := am.Get(ctx, a.ID); !got.InvalidToken() {
+		t.Fatalf("invalid token cleared without new credentials: %+v", got)
+	}
+	put("new")
+	if got, _ := am.Get(ctx, a.ID); got.InvalidToken() || got.Exhausted || got.APIKey != "new" {
+		t.Fatalf("account not restored: %+v", got)
+	}
+	if e := <-got; e.Message != "credentials replaced" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestBackupDownload(t *testing.T) {
+	db := testdb.Open(t)
+	am, _ := account.NewManager(db)
+	am.AddAPIKey(context.Background(), "home", "k", "", 1)
+	h := (&Admin{Accounts: am, DB: db}).Handler()
+
+	// accountName opens a downloaded snapshot and returns its account's name.
+	accountName := func(data []byte) string {
+		path := filepath.Join(t.TempDir(), "backup.db")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		snap, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+		var name string
+		if err := snap.QueryRow(`SELECT name FROM accounts`).Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/backup", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Disposition"), ".db\"") {
+		t.Fatalf("status %d headers %v", rec.Code, rec.Header())
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+		t.Fatalf("content length %s for %d bytes", rec.Header().Get("Content-Length"), rec.Body.Len())
+	}
+	if name := accountName(rec.Body.Bytes()); name != "home" {
+		t.Fatalf("unexpected account %q", name)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/api/backup", nil)
+	req.Header.Set(BackupPassphraseHeader, "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Disposition"), ".db.enc") {
+		t.Fatalf("status %d headers %v", rec.Code, rec.Header())
+	}
+	var plain bytes.Buffer
+	if err := backup.Decrypt(&plain, rec.Body, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if name := accountName(plain.Bytes()); name != "home" {
+		t.Fatalf("unexpected account %q", name)
+	}
+}
+
+func TestImportProviders(t *testing.T) {
+	am, _, h := setupWebUI(t)
+	home := t.TempDir()
+	t.Setenv("CODEX_HOME", home)
+	t.Setenv("OPENROUTER_API_KEY", "or-key")
+	t.Setenv("AZURE_OPENAI_API_KEY", "")
+	config := `model_provider = "openrouter"
+
+[model_providers.openrouter]
+name = "OpenRouter"
+base_url = "https://openrouter.ai/api/v1"
+env_key = "OPENROUTER_API_KEY"
+
+[model_providers.azure]
+base_url = "https://example.openai.azure.com/openai/v1"
+env_key = "AZURE_OPENAI_API_KEY"
+
+[profiles.cheap]
+model_provider = "openrouter"
+`
+	if err := os.WriteFile(filepath.Join(home, "config.toml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/accounts/import/providers", nil))
+	var candidates []providerCandidate
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &candidates) != nil {
+		t.Fatalf("status %d %s", rec.Code, rec.Body.String())
+	}
+	if len(candidates) != 2 || candidates[0].ID != "azure" || candidates[0].KeyFound ||
+		candidates[1].Name != "OpenRouter" || !candidates[1].KeyFound || len(candidates[1].Profiles) != 1 {
+		t.Fatalf("unexpected candidates %+v", candidates)
+	}
+
+	importProviders := func(body string) []providerResult {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/api/accounts/import/providers", strings.NewReader(body)))
+		var res []providerResult
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &res) != nil {
+			t.Fatalf("status %d %s", rec.Code, rec.Body.String())
+		}
+		return res
+	}
+	res := importProviders(`[{"id":"openrouter"},{"id":"azure"},{"id":"missing"}]`)
+	if len(res) != 3 || res[0].Account == nil || res[1].Error == "" || res[2].Error == "" {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	if res = importProviders(`[{"id":"azure","api_key":"az-key"}]`); res[0].Error != "" {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	accounts, _ := am.List(context.Background())
+	if len(accounts) != 2 || accounts[0].Name != "OpenRouter" || accounts[0].APIKey != "or-key" ||
+		accounts[1].Name != "azure" || accounts[1].APIKey != "az-key" || accounts[1].BaseURL != "https://example.openai.azure.com/openai/v1" {
+		t.Fatalf("unexpected accounts %+v %+v", accounts[0], accounts[1])
+	}
+}
+
+func TestProfilesAPI(t *testing.T) {
+	am, ls, _ := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "a", "k", "", 1)
+	db := testdb.Open(t)
+	store, err := profiles.New(db, am)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&Admin{Accounts: am, Logs: ls, Profiles: store}).Handler()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/admin/api/profiles", `{"name":"weekend","schedule":"0 0 * * 6"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("snapshot: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/admin/api/profiles", `{"name":"x","schedule":"weekly"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad schedule, got %d", rec.Code)
+	}
+	rec := do(http.MethodPut, "/admin/api/profiles/weekend", fmt.Sprintf(`{"entries":[{"account_id":%d,"priority":7,"weight":2}]}`, a.ID))
+	var p profiles.Profile
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil || p.Schedule != "0 0 * * 6" || len(p.Entries) != 1 || p.Entries[0].Priority != 7 {
+		t.Fatalf("put: %d %v %+v", rec.Code, err, p)
+	}
+	if rec := do(http.MethodPost, "/admin/api/profiles/weekend/activate", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("activate: %d %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := am.Get(ctx, a.ID); got.Priority != 7 || got.Weight != 2 {
+		t.Fatalf("profile not applied: %+v", got)
+	}
+	rec = do(http.MethodGet, "/admin/api/profiles", "")
+	var list struct {
+		Active   *profiles.Active   `json:"active"`
+		Profiles []profiles.Profile `json:"profiles"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || list.Active == nil || list.Active.Name != "weekend" || list.Active.Trigger != "manual" || len(list.Profiles) != 1 {
+		t.Fatalf("list: %v %+v", err, list)
+	}
+	if rec := do(http.MethodDelete, "/admin/api/profiles/weekend", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/api/profiles/weekend/activate", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestSessionTranscriptAPI(t *testing.T) {
+	am, ls, h := setupWebUI(t)
+	ctx := context.Background()
+	a, _ := am.AddAPIKey(ctx, "acc", "k", "", 1)
+	for i, body := range []string{`{"input":"first"}`, `{"input":"other"}`, `{"input":"second"}`} {
+		session := "conv-1"
+		if i == 1 {
+			session = "conv-2"
+		}
+		ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), AccountID: a.ID, Method: "POST", URL: "u", Session: session,
+			ReqHeader: http.Header{"Authorization": {"Bearer secret"}}, ReqBody: body, RespBody: "event: response.completed\n\n", Status: 200})
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/sessions/conv-1?download=1", nil))
+	var tr struct {
+		Session string `json:"session"`
+		Entries []struct {
+			AccountName   string          `json:"account_name"`
+			RequestHeader http.Header     `json:"request_header"`
+			Request       json.RawMessage `json:"request"`
+			Response      string          `json:"response"`
+		} `json:"entries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Session != "conv-1" || len(tr.Entries) != 2 || string(tr.Entries[0].Request) != `{"input":"first"}` || string(tr.Entries[1].Request) != `{"input":"second"}` {
+		t.Fatalf("unexpected transcript %+v", tr)
+	}
+	if e := tr.Entries[0]; e.AccountName != "acc" || e.Response != "event: response.completed\n\n" || strings.Contains(e.RequestHeader.Get("Authorization"), "secret") {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), `filename=session-conv-1.json`) {
+		t.Fatalf("not served as a download: %v", rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/api/sessions/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown session: status %d", rec.Code)
+	}
+}
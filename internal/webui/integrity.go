@@ -0,0 +1,34 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// registerIntegrity serves the database integrity report: GET
+// /api/db/integrity returns the latest one, null before the first check,
+// and POST runs the check again, repairing what it finds with ?repair=1.
+func (s *Admin) registerIntegrity(mux *http.ServeMux) {
+	mux.HandleFunc("/api/db/integrity", func(w http.ResponseWriter, r *http.Request) {
+		var res any
+		switch r.Method {
+		case http.MethodGet:
+			res = s.DBHealth.LastIntegrity()
+		case http.MethodPost:
+			report, err := s.DBHealth.CheckIntegrity(r.Context(), r.URL.Query().Get("repair") != "")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res = report
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode integrity report failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/logviews"
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+// logFilter reads the filter parameters of GET /api/logs, which saved views
+// store as their query: account, client, model and status match exactly,
+// errors=1 keeps failed attempts, slow=1 those over the slow threshold and
+// window, a duration such as 24h, the most recent ones.
+func (s *Admin) logFilter(q url.Values) (logpkg.Filter, error) {
+	var f logpkg.Filter
+	var err error
+	if v := q.Get("account"); v != "" {
+		if f.AccountID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return f, fmt.Errorf("bad account %q", v)
+		}
+	}
+	if v := q.Get("status"); v != "" {
+		if f.Status, err = strconv.Atoi(v); err != nil {
+			return f, fmt.Errorf("bad status %q", v)
+		}
+	}
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return f, fmt.Errorf("bad window %q", v)
+		}
+		f.Since = time.Now().Add(-d)
+	}
+	if q.Get("slow") != "" {
+		if s.SlowThreshold <= 0 {
+			return f, errors.New("slow request threshold not configured")
+		}
+		f.MinDuration = s.SlowThreshold
+	}
+	f.ClientKey, f.Model, f.Errors = q.Get("client"), q.Get("model"), q.Get("errors") != ""
+	return f, nil
+}
+
+// registerLogViews serves the saved log views: GET /api/log-views lists
+// them, POST {"name", "query"} saves the filter query under a name,
+// replacing a view of that name, and DELETE /api/log-views/{name} removes
+// one.
+func (s *Admin) registerLogViews(mux *http.ServeMux) {
+	mux.HandleFunc("/api/log-views", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.LogViews.List(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := json.NewEncoder(w).Encode(list); err != nil {
+				logger.Errorf("encode log views failed: %v", err)
+			}
+		case http.MethodPost:
+			var v logviews.View
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+				logger.Warnf("bad log view request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			q, err := url.ParseQuery(v.Query)
+			if err == nil {
+				_, err = s.logFilter(q)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Paging is not part of a view.
+			q.Del("page")
+			q.Del("size")
+			v.Query = q.Encode()
+			if err := s.LogViews.Save(r.Context(), &v); err != nil {
+				http.Error(w, err.Error(), logViewStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(w).Encode(v); err != nil {
+				logger.Errorf("encode log view failed: %v", err)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/log-views/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.LogViews.Delete(r.Context(), r.PathValue("name")); err != nil {
+			http.Error(w, err.Error(), logViewStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// logViewStatus maps a logviews error to an HTTP status.
+func logViewStatus(err error) int {
+	switch {
+	case errors.Is(err, logviews.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, logviews.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
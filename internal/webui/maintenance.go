@@ -0,0 +1,32 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// registerMaintenance exposes the database maintenance status and a manual
+// trigger.
+func (s *Admin) registerMaintenance(mux *http.ServeMux) {
+	mux.HandleFunc("/api/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(s.Maintenance.Status()); err != nil {
+			logger.Errorf("encode maintenance status failed: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/maintenance/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		st := s.Maintenance.Run(r.Context())
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			logger.Errorf("encode maintenance status failed: %v", err)
+		}
+	})
+}
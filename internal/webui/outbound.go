@@ -0,0 +1,22 @@
+package webui
+
+import (
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/outbound"
+)
+
+// checkOutbound reports account outbound settings the proxy could not use:
+// an invalid proxy URL or a CA bundle that does not load.
+func checkOutbound(a *account.Account) error {
+	if a.ProxyURL != "" {
+		if _, err := outbound.ParseProxy(a.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if a.CAFile != "" {
+		if _, err := outbound.LoadCA(a.CAFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
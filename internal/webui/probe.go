@@ -0,0 +1,115 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/auth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// probeResult is the payload of POST /admin/api/accounts/{id}/probe.
+type probeResult struct {
+	// Status is the upstream status of the probe, 0 when it failed.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Restored is set when the probe succeeded and the account, which was
+	// out of rotation, was returned to it.
+	Restored bool `json:"restored"`
+}
+
+// registerProbe serves the "probe and restore" action: it sends a request
+// upstream with the account's credentials and, when it is accepted, returns
+// a quarantined or otherwise blocked account to rotation. POST
+// /api/accounts/{id}/capabilities probes what the upstream of an API key
+// account supports and stores the profile routing checks requests against.
+func (s *Admin) registerProbe(mux *http.ServeMux) {
+	mux.HandleFunc("/api/accounts/{id}/probe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			logger.Warnf("bad account id %s", r.PathValue("id"))
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		a, err := s.Accounts.Get(ctx, id)
+		if err != nil {
+			logger.Errorf("get account %d failed: %v", id, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a == nil {
+			http.NotFound(w, r)
+			return
+		}
+		var res probeResult
+		if err := auth.Refresh(auth.WithTrigger(ctx, auth.TriggerProbe), s.Accounts, a); err != nil {
+			res.Error = "token refresh failed: " + err.Error()
+		} else if res.Status, err = s.Proxy.Probe(ctx, a); err != nil {
+			res.Error = err.Error()
+		}
+		if res.Error == "" && res.Status < 400 && a.Exhausted {
+			if err := s.Accounts.Reactivate(ctx, id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Restored = true
+			logger.Infof("account %d restored after successful probe", id)
+			if s.Events != nil {
+				s.Events.Publish(events.Event{Type: events.AccountReactivated, AccountID: id, Message: "probe succeeded"})
+			}
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode probe result failed: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/accounts/{id}/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			logger.Warnf("bad account id %s", r.PathValue("id"))
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		a, err := s.Accounts.Get(ctx, id)
+		if err != nil {
+			logger.Errorf("get account %d failed: %v", id, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if a.Type != account.APIKeyAccount {
+			http.Error(w, "capability probes are for API key accounts", http.StatusBadRequest)
+			return
+		}
+		caps, err := s.Proxy.ProbeCapabilities(ctx, a)
+		if err != nil {
+			logger.Warnf("capability probe of account %d failed: %v", id, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if err := s.Accounts.SetCapabilities(ctx, id, caps); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Infof("account %d capabilities: %+v", id, *caps)
+		s.configChanged("account.capabilities", id)
+		if err := json.NewEncoder(w).Encode(caps); err != nil {
+			logger.Errorf("encode capabilities failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/profiles"
+)
+
+// profileRequest is the body of POST /api/profiles and PUT
+// /api/profiles/{name}. A nil Schedule keeps the current one; nil Entries
+// keep the current entries on PUT.
+type profileRequest struct {
+	Name     string           `json:"name"`
+	Schedule *string          `json:"schedule"`
+	Entries  []profiles.Entry `json:"entries"`
+}
+
+// registerProfiles serves the priority profiles: GET /api/profiles lists
+// them with the active one, POST snapshots the current account priorities
+// and weights under a name, PUT /api/profiles/{name} edits the schedule or
+// entries, DELETE removes it and POST /api/profiles/{name}/activate applies
+// it to the accounts.
+func (s *Admin) registerProfiles(mux *http.ServeMux) {
+	mux.HandleFunc("/api/profiles", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.Profiles.List(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			active, err := s.Profiles.Active(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := json.NewEncoder(w).Encode(struct {
+				Active   *profiles.Active   `json:"active"`
+				Profiles []profiles.Profile `json:"profiles"`
+			}{active, list}); err != nil {
+				logger.Errorf("encode profiles failed: %v", err)
+			}
+		case http.MethodPost:
+			var req profileRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				logger.Warnf("bad profile request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p, err := s.Profiles.Snapshot(r.Context(), req.Name, req.Schedule)
+			if err != nil {
+				http.Error(w, err.Error(), profileStatus(err))
+				return
+			}
+			s.configChanged("profile.saved", 0)
+			w.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(w).Encode(p); err != nil {
+				logger.Errorf("encode profile failed: %v", err)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/profiles/", func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/api/profiles/")
+		name, action, _ := strings.Cut(rest, "/")
+		switch {
+		case action == "activate" && r.Method == http.MethodPost:
+			if err := s.Profiles.Activate(r.Context(), name, profiles.TriggerManual); err != nil {
+				http.Error(w, err.Error(), profileStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case action != "":
+			http.NotFound(w, r)
+		case r.Method == http.MethodGet:
+			p, err := s.Profiles.Get(r.Context(), name)
+			if err != nil {
+				http.Error(w, err.Error(), profileStatus(err))
+				return
+			}
+			if err := json.NewEncoder(w).Encode(p); err != nil {
+				logger.Errorf("encode profile failed: %v", err)
+			}
+		case r.Method == http.MethodPut:
+			var req profileRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				logger.Warnf("bad profile request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p, err := s.Profiles.Get(r.Context(), name)
+			if err != nil {
+				http.Error(w, err.Error(), profileStatus(err))
+				return
+			}
+			if req.Schedule != nil {
+				p.Schedule = *req.Schedule
+			}
+			if req.Entries != nil {
+				p.Entries = req.Entries
+			}
+			if err := s.Profiles.Save(r.Context(), p); err != nil {
+				http.Error(w, err.Error(), profileStatus(err))
+				return
+			}
+			s.configChanged("profile.saved", 0)
+			if err := json.NewEncoder(w).Encode(p); err != nil {
+				logger.Errorf("encode profile failed: %v", err)
+			}
+		case r.Method == http.MethodDelete:
+			if err := s.Profiles.Delete(r.Context(), name); err != nil {
+				http.Error(w, err.Error(), profileStatus(err))
+				return
+			}
+			s.configChanged("profile.deleted", 0)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// profileStatus maps a profiles error to an HTTP status: unknown profiles
+// are 404, invalid names and schedules 400.
+func profileStatus(err error) int {
+	switch {
+	case errors.Is(err, profiles.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, profiles.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,155 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/codexconfig"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// providerCandidate is a model provider of the local config.toml offered
+// for import.
+type providerCandidate struct {
+	codexconfig.Provider
+	// Profiles lists the profiles using the provider.
+	Profiles []string `json:"profiles,omitempty"`
+	// KeyFound is set when the provider needs no key or its env_key
+	// variable is set in the companion's environment.
+	KeyFound bool `json:"key_found"`
+	// Exists is set when an API key account already has the provider's name.
+	Exists bool `json:"exists"`
+}
+
+// providerImport selects a provider to import. APIKey is used when the
+// provider's env_key variable is not set for the companion.
+type providerImport struct {
+	ID     string `json:"id"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+// providerResult reports the import of one provider.
+type providerResult struct {
+	ID      string           `json:"id"`
+	Account *account.Account `json:"account,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// registerProviderImport serves the import of the API-key model providers
+// in $CODEX_HOME/config.toml: GET lists them, POST imports the selected
+// ones as accounts named after the providers.
+func (s *Admin) registerProviderImport(mux *http.ServeMux) {
+	mux.HandleFunc("/api/accounts/import/providers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		cfg, err := readCodexConfig()
+		if err != nil {
+			logger.Errorf("read config.toml failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var res any
+		if r.Method == http.MethodGet {
+			res, err = s.providerCandidates(ctx, cfg)
+		} else {
+			var req []providerImport
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				logger.Warnf("bad provider import request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res, err = s.importProviders(ctx, cfg, req)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode providers failed: %v", err)
+		}
+	})
+}
+
+func readCodexConfig() (*codexconfig.Config, error) {
+	path, err := codexconfig.Path()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return codexconfig.Parse(data)
+}
+
+func (s *Admin) providerCandidates(ctx context.Context, cfg *codexconfig.Config) ([]providerCandidate, error) {
+	accounts, err := s.Accounts.List(ctx)
+	if err != nil {
+		logger.Errorf("list accounts failed: %v", err)
+		return nil, err
+	}
+	res := []providerCandidate{}
+	for _, p := range cfg.Providers {
+		c := providerCandidate{Provider: p, KeyFound: p.EnvKey == "" || os.Getenv(p.EnvKey) != ""}
+		for _, prof := range cfg.Profiles {
+			if prof.Provider == p.ID {
+				c.Profiles = append(c.Profiles, prof.Name)
+			}
+		}
+		for _, a := range accounts {
+			if a.Type == account.APIKeyAccount && a.Name == p.Name {
+				c.Exists = true
+			}
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+func (s *Admin) importProviders(ctx context.Context, cfg *codexconfig.Config, req []providerImport) ([]providerResult, error) {
+	accounts, err := s.Accounts.List(ctx)
+	if err != nil {
+		logger.Errorf("list accounts failed: %v", err)
+		return nil, err
+	}
+	priority := 0
+	if len(accounts) > 0 {
+		priority = accounts[len(accounts)-1].Priority + 1
+	}
+	providers := make(map[string]codexconfig.Provider, len(cfg.Providers))
+	for _, p := range cfg.Providers {
+		providers[p.ID] = p
+	}
+	res := []providerResult{}
+	for _, sel := range req {
+		r := providerResult{ID: sel.ID}
+		p, ok := providers[sel.ID]
+		key := sel.APIKey
+		if key == "" && p.EnvKey != "" {
+			key = os.Getenv(p.EnvKey)
+		}
+		switch {
+		case !ok:
+			r.Error = "provider not found in config.toml"
+		case key == "" && p.EnvKey != "":
+			r.Error = fmt.Sprintf("%s is not set; enter the API key", p.EnvKey)
+		default:
+			logger.Infof("importing provider %s as API key account", p.ID)
+			if r.Account, err = s.Accounts.AddAPIKey(ctx, p.Name, key, p.BaseURL, priority); err != nil {
+				r.Error = err.Error()
+			} else {
+				priority++
+				s.configChanged("account.imported", r.Account.ID)
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
@@ -0,0 +1,61 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// registerQuota exposes the ChatGPT quota snapshots: GET /api/quota lists
+// the latest snapshot per account and GET /api/quota/{id}?hours=N the
+// history of one account (default one week).
+func (s *Admin) registerQuota(mux *http.ServeMux) {
+	mux.HandleFunc("/api/quota", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		latest, err := s.Quota.Latest(r.Context())
+		if err != nil {
+			logger.Errorf("latest quota failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(latest); err != nil {
+			logger.Errorf("encode quota failed: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/quota/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		idStr := strings.TrimPrefix(r.URL.Path, "/api/quota/")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || id <= 0 {
+			logger.Warnf("bad account id %s", idStr)
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		hours := 7 * 24
+		if v := r.URL.Query().Get("hours"); v != "" {
+			if hours, err = strconv.Atoi(v); err != nil || hours <= 0 {
+				http.Error(w, "bad hours", http.StatusBadRequest)
+				return
+			}
+		}
+		hist, err := s.Quota.History(r.Context(), id, time.Now().Add(-time.Duration(hours)*time.Hour))
+		if err != nil {
+			logger.Errorf("quota history failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(hist); err != nil {
+			logger.Errorf("encode quota history failed: %v", err)
+		}
+	})
+}
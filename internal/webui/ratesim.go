@@ -0,0 +1,128 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/quota"
+	"github.com/kxn/codex-companion/internal/ratesim"
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+// maxSimulationHours bounds the duration of a rate-limit simulation.
+const maxSimulationHours = 7 * 24
+
+// simulationRequest is the body of POST /api/rate-limit-simulation. Hours
+// defaults to a working day of eight.
+type simulationRequest struct {
+	RequestsPerHour  float64 `json:"requests_per_hour"`
+	TokensPerRequest float64 `json:"tokens_per_request"`
+	Hours            float64 `json:"hours"`
+}
+
+// registerSimulation serves POST /api/rate-limit-simulation, which runs the
+// planned traffic against the limits tracked for the account pool and
+// reports how long it lasts and when accounts would be rate limited.
+func (s *Admin) registerSimulation(mux *http.ServeMux) {
+	mux.HandleFunc("/api/rate-limit-simulation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req simulationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Warnf("bad simulation request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Hours == 0 {
+			req.Hours = 8
+		}
+		if req.RequestsPerHour <= 0 || req.TokensPerRequest < 0 || req.Hours < 0 || req.Hours > maxSimulationHours {
+			http.Error(w, "requests_per_hour must be positive, tokens_per_request not negative and hours at most 168", http.StatusBadRequest)
+			return
+		}
+		now := time.Now().Truncate(time.Minute)
+		pool, err := s.simulatedPool(r.Context(), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := ratesim.Run(pool, ratesim.Traffic{
+			RequestsPerHour:  req.RequestsPerHour,
+			TokensPerRequest: req.TokensPerRequest,
+			Duration:         time.Duration(req.Hours * float64(time.Hour)),
+		}, now)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode simulation failed: %v", err)
+		}
+	})
+}
+
+// simulatedPool returns the accounts that can serve requests at or after
+// now with their tracked limits: the quota windows of ChatGPT accounts and
+// the rate limits the latest response of API key accounts reported.
+// Accounts with invalid credentials never return and are left out.
+func (s *Admin) simulatedPool(ctx context.Context, now time.Time) ([]ratesim.Account, error) {
+	list, err := s.Accounts.List(ctx)
+	if err != nil {
+		logger.Errorf("list accounts failed: %v", err)
+		return nil, err
+	}
+	snapshots := make(map[int64]quota.Snapshot)
+	if s.Quota != nil {
+		latest, err := s.Quota.Latest(ctx)
+		if err != nil {
+			logger.Errorf("latest quota failed: %v", err)
+			return nil, err
+		}
+		for _, snap := range latest {
+			snapshots[snap.AccountID] = snap
+		}
+	}
+	var pool []ratesim.Account
+	for _, a := range list {
+		if a.InvalidToken() {
+			continue
+		}
+		sa := ratesim.Account{ID: a.ID, Name: a.Name, Priority: a.Priority, Backup: a.Backup}
+		if a.Exhausted && a.ResetAt.After(now) {
+			sa.AvailableAt = a.ResetAt
+		}
+		if a.InMaintenance(now) && a.MaintenanceEnd.After(sa.AvailableAt) {
+			sa.AvailableAt = a.MaintenanceEnd
+		}
+		if a.Type == account.ChatGPTAccount {
+			if snap, ok := snapshots[a.ID]; ok {
+				sa.Limits, err = ratesim.QuotaLimits(snap, func(since time.Time) (int64, error) {
+					st, err := s.Logs.AccountStats(ctx, a.ID, since)
+					return st.InputTokens + st.OutputTokens, err
+				})
+				if err != nil {
+					logger.Errorf("account %d usage failed: %v", a.ID, err)
+					return nil, err
+				}
+			}
+		} else {
+			latest, err := s.Logs.Find(ctx, logpkg.Filter{AccountID: a.ID}, 1, 0)
+			if err != nil {
+				return nil, err
+			}
+			if len(latest) > 0 {
+				// Summaries lack the headers.
+				rl, err := s.Logs.Get(ctx, latest[0].ID)
+				if err != nil {
+					logger.Errorf("get log %d failed: %v", latest[0].ID, err)
+					return nil, err
+				}
+				sa.Limits = ratesim.HeaderLimits(rl.RespHeader, rl.Time)
+			}
+		}
+		pool = append(pool, sa)
+	}
+	return pool, nil
+}
@@ -0,0 +1,98 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// registerScheduler exposes the adaptive priority statistics and the
+// accounts ramping up, and lets the operator revert adjustments and end
+// ramp-ups.
+func (s *Admin) registerScheduler(mux *http.ServeMux) {
+	mux.HandleFunc("/api/scheduler/adaptive", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			stats, err := s.Scheduler.Stats(r.Context())
+			if err != nil {
+				logger.Errorf("adaptive stats failed: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := json.NewEncoder(w).Encode(struct {
+				Mode     string                   `json:"mode"`
+				Enabled  bool                     `json:"enabled"`
+				Accounts []scheduler.AccountStats `json:"accounts"`
+			}{s.Scheduler.Mode(), s.Scheduler.Adaptive, stats}); err != nil {
+				logger.Errorf("encode adaptive stats failed: %v", err)
+			}
+		case http.MethodDelete:
+			s.resetAdjustment(w, r, 0)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/scheduler/adaptive/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		idStr := strings.TrimPrefix(r.URL.Path, "/api/scheduler/adaptive/")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || id <= 0 {
+			logger.Warnf("bad account id %s", idStr)
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		s.resetAdjustment(w, r, id)
+	})
+	mux.HandleFunc("/api/scheduler/ramp-up", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		stats, err := s.Scheduler.RampUp(r.Context())
+		if err != nil {
+			logger.Errorf("ramp-up stats failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			logger.Errorf("encode ramp-up stats failed: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/scheduler/ramp-up/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		idStr := strings.TrimPrefix(r.URL.Path, "/api/scheduler/ramp-up/")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || id <= 0 {
+			logger.Warnf("bad account id %s", idStr)
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		if err := s.Scheduler.EndRampUp(r.Context(), id); err != nil {
+			logger.Errorf("end ramp-up failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.configChanged("ramp_up.end", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *Admin) resetAdjustment(w http.ResponseWriter, r *http.Request, id int64) {
+	if err := s.Scheduler.ResetAdjustment(r.Context(), id); err != nil {
+		logger.Errorf("reset adjustment failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.configChanged("priority_adjustment.reset", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package webui
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/replay"
+)
+
+// maxTranscript bounds the attempts exported for one session.
+const maxTranscript = 5000
+
+// transcriptEntry is one upstream attempt of a session transcript. Request
+// and Response hold the bodies as JSON when they are JSON and as strings
+// otherwise, such as summarized event streams.
+type transcriptEntry struct {
+	LogID          int64       `json:"log_id"`
+	Time           time.Time   `json:"time"`
+	AccountID      int64       `json:"account_id"`
+	AccountName    string      `json:"account_name"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	Model          string      `json:"model,omitempty"`
+	Status         int         `json:"status"`
+	DurationMs     int64       `json:"duration_ms"`
+	Error          string      `json:"error,omitempty"`
+	RequestHeader  http.Header `json:"request_header"`
+	Request        any         `json:"request"`
+	ResponseHeader http.Header `json:"response_header"`
+	Response       any         `json:"response"`
+}
+
+// rawOrString returns s as raw JSON if it is valid JSON and as a string
+// otherwise.
+func rawOrString(s string) any {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	return s
+}
+
+// registerSessions exports the transcript of a Codex session: GET
+// /api/sessions/{id} returns every logged attempt carrying the session or
+// prompt cache key id, oldest first, with credentials redacted from the
+// headers. ?download=1 serves it as an attachment.
+func (s *Admin) registerSessions(mux *http.ServeMux) {
+	mux.HandleFunc("/api/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		id := r.PathValue("id")
+		logs, err := s.Logs.Session(ctx, id, maxTranscript)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(logs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		names := s.accountNames(ctx)
+		entries := make([]transcriptEntry, 0, len(logs))
+		for _, l := range logs {
+			entries = append(entries, transcriptEntry{
+				LogID: l.ID, Time: l.Time, AccountID: l.AccountID, AccountName: names[l.AccountID],
+				Method: l.Method, URL: l.URL, Model: l.Model, Status: l.Status, DurationMs: l.DurationMs, Error: l.Error,
+				RequestHeader: replay.SanitizeHeader(l.ReqHeader), Request: rawOrString(l.ReqBody),
+				ResponseHeader: replay.SanitizeHeader(l.RespHeader), Response: rawOrString(l.RespBody),
+			})
+		}
+		if r.URL.Query().Get("download") != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "session-" + id + ".json"}))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Session string            `json:"session"`
+			Entries []transcriptEntry `json:"entries"`
+		}{id, entries}); err != nil {
+			logger.Errorf("encode session transcript failed: %v", err)
+		}
+	})
+}
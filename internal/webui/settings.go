@@ -0,0 +1,82 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// logLevel is the payload of /api/settings/loglevel.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// debugCapture is the state of debug capture: how many of the next
+// requests are still to be traced and the traces recorded so far.
+type debugCapture struct {
+	Remaining int            `json:"remaining"`
+	Traces    []logger.Trace `json:"traces"`
+}
+
+// registerSettings serves the runtime logging settings: GET and PUT
+// /api/settings/loglevel read and change the log level without a restart,
+// and /api/settings/debug-capture traces the next requests verbosely (POST
+// {"requests":N} arms it, GET returns the traces, DELETE stops and clears).
+func (s *Admin) registerSettings(mux *http.ServeMux) {
+	mux.HandleFunc("/api/settings/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req logLevel
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				logger.Warnf("bad log level request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l, err := logger.ParseLevel(req.Level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.SetLevel(l)
+			logger.Warnf("log level set to %s", l)
+			s.configChanged("loglevel.updated", 0)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(logLevel{Level: logger.GetLevel().String()}); err != nil {
+			logger.Errorf("encode log level failed: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/settings/debug-capture", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Requests int `json:"requests"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				logger.Warnf("bad debug capture request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Requests <= 0 {
+				http.Error(w, "requests must be positive", http.StatusBadRequest)
+				return
+			}
+			logger.StartCapture(req.Requests)
+		case http.MethodDelete:
+			logger.ClearCaptured()
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var res debugCapture
+		res.Remaining, res.Traces = logger.Captured()
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode debug capture failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/pricing"
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+// statsResponse is the payload of GET /admin/api/stats. Sections are omitted
+// when the corresponding component is not configured.
+type statsResponse struct {
+	DB *dbhealth.Health `json:"db,omitempty"`
+	// Models breaks the logged attempts of the last days (default 30, set
+	// with ?days=N) down per requested model.
+	Models []logpkg.ModelStats `json:"models,omitempty"`
+	// Cache reports the prompt cache hit ratio per account over the same
+	// days.
+	Cache []logpkg.CacheStats `json:"cache,omitempty"`
+	// Bandwidth reports the bytes exchanged with the upstream per account
+	// and client key over the same days.
+	Bandwidth *logpkg.Bandwidth `json:"bandwidth,omitempty"`
+}
+
+func (s *Admin) registerStats(mux *http.ServeMux) {
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		days := 30
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "bad days", http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+		var res statsResponse
+		if s.DBHealth != nil {
+			h, err := s.DBHealth.Check(ctx)
+			if err != nil {
+				logger.Errorf("check db health failed: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.DB = &h
+		}
+		if s.Logs != nil {
+			since := time.Now().AddDate(0, 0, -days)
+			models, err := s.Logs.ModelStats(ctx, since)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			prices := s.Prices
+			if prices == nil {
+				prices = pricing.Default
+			}
+			for i := range models {
+				models[i].CostUSD = prices.Cost(models[i].Model, models[i].InputTokens, models[i].OutputTokens)
+			}
+			res.Models = models
+			if res.Cache, err = s.Logs.CacheStats(ctx, since); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			bw, err := s.Logs.Bandwidth(ctx, since)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Bandwidth = &bw
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode stats failed: %v", err)
+		}
+	})
+}
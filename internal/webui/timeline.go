@@ -0,0 +1,55 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/timeline"
+)
+
+// accountTimeline is the payload of GET /admin/api/accounts/{id}/timeline.
+type accountTimeline struct {
+	Since       time.Time             `json:"since"`
+	Now         time.Time             `json:"now"`
+	Transitions []timeline.Transition `json:"transitions"`
+	Periods     []timeline.Period     `json:"periods"`
+}
+
+// registerTimeline serves the transitions of an account out of and back
+// into rotation over the last days (default 7, ?days=N), with the periods
+// it spent out of rotation.
+func (s *Admin) registerTimeline(mux *http.ServeMux) {
+	mux.HandleFunc("/api/accounts/{id}/timeline", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			logger.Warnf("bad account id %s", r.PathValue("id"))
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			if days, err = strconv.Atoi(v); err != nil || days <= 0 {
+				http.Error(w, "bad days", http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now()
+		res := accountTimeline{Since: now.AddDate(0, 0, -days), Now: now}
+		var before *timeline.Transition
+		if res.Transitions, before, err = s.Timeline.History(r.Context(), id, res.Since); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Periods = timeline.Periods(res.Transitions, before, res.Since, now)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode account timeline failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/tombstone"
+)
+
+// deletedAccountLogs is the body of GET
+// /api/maintenance/deleted-account-logs.
+type deletedAccountLogs struct {
+	Policy     string                `json:"policy"`
+	DelayHours float64               `json:"delay_hours"`
+	Tombstones []tombstone.Tombstone `json:"tombstones"`
+}
+
+// registerTombstones serves /api/maintenance/deleted-account-logs: GET
+// returns the policy for the logs of deleted accounts and their tombstones,
+// and POST applies the policy retroactively, e.g. to accounts deleted
+// before it was set.
+func (s *Admin) registerTombstones(mux *http.ServeMux) {
+	mux.HandleFunc("/api/maintenance/deleted-account-logs", func(w http.ResponseWriter, r *http.Request) {
+		var res any
+		switch r.Method {
+		case http.MethodGet:
+			list, err := s.Tombstones.List(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res = deletedAccountLogs{Policy: s.Tombstones.Policy, DelayHours: s.Tombstones.Delay.Hours(), Tombstones: list}
+		case http.MethodPost:
+			applied, err := s.Tombstones.Apply(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res = applied
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			logger.Errorf("encode deleted account logs failed: %v", err)
+		}
+	})
+}
+
+// accountNames returns the account names by ID, including the tombstone
+// names of deleted accounts when tombstones are kept.
+func (s *Admin) accountNames(ctx context.Context) map[int64]string {
+	names := make(map[int64]string)
+	if s.Tombstones != nil {
+		buried, err := s.Tombstones.Names(ctx)
+		if err != nil {
+			logger.Errorf("list tombstones failed: %v", err)
+		}
+		for id, name := range buried {
+			names[id] = name
+		}
+	}
+	accts, err := s.Accounts.List(ctx)
+	if err != nil {
+		logger.Errorf("list accounts failed: %v", err)
+	}
+	for _, a := range accts {
+		names[a.ID] = a.Name
+	}
+	return names
+}
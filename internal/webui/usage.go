@@ -0,0 +1,42 @@
+package webui
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// registerUsage exposes the per-client-key consumption recorded in the logs.
+// GET /api/usage?days=N covers the last N UTC days including today
+// (default 7).
+func (s *Admin) registerUsage(mux *http.ServeMux) {
+	mux.HandleFunc("/api/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "bad days", http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+		until := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		since := until.AddDate(0, 0, -days)
+		usage, err := s.Logs.Usage(r.Context(), since, until)
+		if err != nil {
+			logger.Errorf("usage failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(usage); err != nil {
+			logger.Errorf("encode usage failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package webui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/validate"
+)
+
+// registerValidation serves /api/accounts/validation: GET returns the
+// running or last validation of every account's credentials, null before
+// the first, and POST starts one in the background, whose results arrive on
+// /api/events as they complete.
+func (s *Admin) registerValidation(mux *http.ServeMux) {
+	mux.HandleFunc("/api/accounts/validation", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if err := json.NewEncoder(w).Encode(s.Validator.Last()); err != nil {
+				logger.Errorf("encode validation failed: %v", err)
+			}
+		case http.MethodPost:
+			// The pass outlives the request that started it.
+			err := s.Validator.Go(context.WithoutCancel(r.Context()))
+			if errors.Is(err, validate.ErrRunning) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/webhook"
+)
+
+// registerWebhooks exposes the webhook delivery queue and manual replay.
+func (s *Admin) registerWebhooks(mux *http.ServeMux) {
+	mux.HandleFunc("/api/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		page, _ := strconv.Atoi(q.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		size, _ := strconv.Atoi(q.Get("size"))
+		if size <= 0 {
+			size = 100
+		}
+		list, err := s.Webhooks.List(r.Context(), q.Get("status"), size+1, (page-1)*size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hasMore := len(list) > size
+		if hasMore {
+			list = list[:size]
+		}
+		if err := json.NewEncoder(w).Encode(struct {
+			Deliveries []*webhook.Delivery `json:"deliveries"`
+			Page       int                 `json:"page"`
+			HasMore    bool                `json:"has_more"`
+		}{list, page, hasMore}); err != nil {
+			logger.Errorf("encode webhooks failed: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/webhooks/", func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/api/webhooks/")
+		idStr, action, _ := strings.Cut(rest, "/")
+		if action != "replay" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			logger.Warnf("bad webhook id %s", idStr)
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		if err := s.Webhooks.Replay(r.Context(), id); err != nil {
+			if errors.Is(err, webhook.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
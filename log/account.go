@@ -0,0 +1,129 @@
+package log
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// AccountStats aggregates the attempts logged for one account.
+type AccountStats struct {
+	Requests      int64   `json:"requests"`
+	Errors        int64   `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	AvgDurationMs int64   `json:"avg_duration_ms"`
+	AvgTTFBMs     int64   `json:"avg_ttfb_ms"`
+	InputTokens   int64   `json:"input_tokens"`
+	OutputTokens  int64   `json:"output_tokens"`
+	CachedTokens  int64   `json:"cached_tokens"`
+	// ReqBytes and RespBytes are the request and response bytes exchanged
+	// with the upstream.
+	ReqBytes  int64     `json:"req_bytes"`
+	RespBytes int64     `json:"resp_bytes"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// AccountStats aggregates the attempts logged for account id since the
+// given time. Errors are counted as in ModelStats.
+func (s *Store) AccountStats(ctx context.Context, id int64, since time.Time) (AccountStats, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time, status, COALESCE(error,''), COALESCE(duration_ms,0), ttfb_ms, input_tokens, output_tokens, cached_tokens, req_size, resp_size FROM logs WHERE account_id=?`, id)
+	if err != nil {
+		logger.Errorf("query account stats failed: %v", err)
+		return AccountStats{}, err
+	}
+	defer rows.Close()
+	agg := accountAgg{id: id, since: since}
+	for rows.Next() {
+		rl := RequestLog{AccountID: id}
+		if err := rows.Scan(&rl.Time, &rl.Status, &rl.Error, &rl.DurationMs, &rl.TTFBMs, &rl.InputTokens, &rl.OutputTokens, &rl.CachedTokens, &rl.ReqSize, &rl.RespSize); err != nil {
+			logger.Errorf("scan account stats row failed: %v", err)
+			return AccountStats{}, err
+		}
+		agg.add(&rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate account stats failed: %v", err)
+		return AccountStats{}, err
+	}
+	return agg.result(), nil
+}
+
+// LoggedAccounts returns the IDs of the accounts with logs in ascending
+// order.
+func (s *Store) LoggedAccounts(ctx context.Context) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT account_id FROM logs ORDER BY account_id`)
+	if err != nil {
+		logger.Errorf("query logged accounts failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []int64{}
+	for rows.Next() {
+		var id sql.NullInt64
+		if err := rows.Scan(&id); err != nil {
+			logger.Errorf("scan logged account failed: %v", err)
+			return nil, err
+		}
+		res = append(res, id.Int64)
+	}
+	return res, rows.Err()
+}
+
+// DeleteAccount deletes the logs of account id and returns how many there
+// were.
+func (s *Store) DeleteAccount(ctx context.Context, id int64) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM logs WHERE account_id=?`, id)
+	if err != nil {
+		logger.Errorf("delete logs of account %d failed: %v", id, err)
+		dbhealth.RecordWriteError("logs")
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// accountAgg computes the AccountStats of one account from the logs passed
+// to add.
+type accountAgg struct {
+	id             int64
+	since          time.Time
+	st             AccountStats
+	duration, ttfb int64
+}
+
+func (g *accountAgg) add(rl *RequestLog) {
+	if rl.AccountID != g.id || rl.Time.Before(g.since) {
+		return
+	}
+	g.st.Requests++
+	if failed(rl) {
+		g.st.Errors++
+	}
+	g.duration += rl.DurationMs
+	g.ttfb += rl.TTFBMs
+	g.st.InputTokens += rl.InputTokens
+	g.st.OutputTokens += rl.OutputTokens
+	g.st.CachedTokens += rl.CachedTokens
+	g.st.ReqBytes += int64(rl.ReqSize)
+	g.st.RespBytes += int64(rl.RespSize)
+	if rl.Time.After(g.st.LastUsed) {
+		g.st.LastUsed = rl.Time
+	}
+}
+
+func (g *accountAgg) result() AccountStats {
+	st := g.st
+	if st.Requests > 0 {
+		st.ErrorRate = float64(st.Errors) / float64(st.Requests)
+		st.AvgDurationMs = g.duration / st.Requests
+		st.AvgTTFBMs = g.ttfb / st.Requests
+	}
+	return st
+}
+
+// ListAccount returns the latest n logs of account id, newest first.
+func (s *Store) ListAccount(ctx context.Context, id int64, n int) ([]*RequestLog, error) {
+	return s.list(ctx, "WHERE account_id=?", []any{id}, n, 0)
+}
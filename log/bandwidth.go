@@ -0,0 +1,116 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Traffic is the data exchanged with the upstream over some attempts:
+// SentBytes are request bodies sent, ReceivedBytes response bodies
+// received.
+type Traffic struct {
+	Requests      int64 `json:"requests"`
+	SentBytes     int64 `json:"sent_bytes"`
+	ReceivedBytes int64 `json:"received_bytes"`
+}
+
+// Bytes returns the bytes sent and received.
+func (t Traffic) Bytes() int64 { return t.SentBytes + t.ReceivedBytes }
+
+func (t *Traffic) add(rl *RequestLog) {
+	t.Requests++
+	t.SentBytes += int64(rl.ReqSize)
+	t.ReceivedBytes += int64(rl.RespSize)
+}
+
+// AccountTraffic is the Traffic of one account.
+type AccountTraffic struct {
+	AccountID int64 `json:"account_id"`
+	Traffic
+}
+
+// ClientTraffic is the Traffic of one client key.
+type ClientTraffic struct {
+	ClientKey string `json:"client_key"`
+	Traffic
+}
+
+// Bandwidth breaks the traffic of the logged attempts down per account,
+// ordered by ID, and per client key, ordered by key.
+type Bandwidth struct {
+	Total    Traffic          `json:"total"`
+	Accounts []AccountTraffic `json:"accounts"`
+	Clients  []ClientTraffic  `json:"clients"`
+}
+
+// Bandwidth aggregates every attempt logged since the given time. Failed
+// attempts count too, since their bytes were transferred all the same.
+func (s *Store) Bandwidth(ctx context.Context, since time.Time) (Bandwidth, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time, account_id, client_key, req_size, resp_size FROM logs`)
+	if err != nil {
+		logger.Errorf("query bandwidth failed: %v", err)
+		return Bandwidth{}, err
+	}
+	defer rows.Close()
+	agg := newBandwidthAgg(since)
+	for rows.Next() {
+		var rl RequestLog
+		if err := rows.Scan(&rl.Time, &rl.AccountID, &rl.ClientKey, &rl.ReqSize, &rl.RespSize); err != nil {
+			logger.Errorf("scan bandwidth row failed: %v", err)
+			return Bandwidth{}, err
+		}
+		agg.add(&rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate bandwidth failed: %v", err)
+		return Bandwidth{}, err
+	}
+	return agg.result(), nil
+}
+
+// bandwidthAgg computes Bandwidth from the logs passed to add.
+type bandwidthAgg struct {
+	since    time.Time
+	total    Traffic
+	accounts map[int64]*Traffic
+	clients  map[string]*Traffic
+}
+
+func newBandwidthAgg(since time.Time) *bandwidthAgg {
+	return &bandwidthAgg{since: since, accounts: make(map[int64]*Traffic), clients: make(map[string]*Traffic)}
+}
+
+func (g *bandwidthAgg) add(rl *RequestLog) {
+	if rl.Time.Before(g.since) {
+		return
+	}
+	g.total.add(rl)
+	a := g.accounts[rl.AccountID]
+	if a == nil {
+		a = &Traffic{}
+		g.accounts[rl.AccountID] = a
+	}
+	a.add(rl)
+	c := g.clients[rl.ClientKey]
+	if c == nil {
+		c = &Traffic{}
+		g.clients[rl.ClientKey] = c
+	}
+	c.add(rl)
+}
+
+func (g *bandwidthAgg) result() Bandwidth {
+	res := Bandwidth{Total: g.total, Accounts: []AccountTraffic{}, Clients: []ClientTraffic{}}
+	for id, t := range g.accounts {
+		res.Accounts = append(res.Accounts, AccountTraffic{AccountID: id, Traffic: *t})
+	}
+	for key, t := range g.clients {
+		res.Clients = append(res.Clients, ClientTraffic{ClientKey: key, Traffic: *t})
+	}
+	sort.Slice(res.Accounts, func(i, j int) bool { return res.Accounts[i].AccountID < res.Accounts[j].AccountID })
+	sort.Slice(res.Clients, func(i, j int) bool { return res.Clients[i].ClientKey < res.Clients[j].ClientKey })
+	return res
+}
@@ -0,0 +1,34 @@
+package log
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBandwidth(t *testing.T) {
+	s := NewMemoryStore(10)
+	ctx := context.Background()
+	now := time.Now()
+	for _, rl := range []*RequestLog{
+		{Time: now.Add(-48 * time.Hour), AccountID: 1, ClientKey: "c1", ReqSize: 1000, RespSize: 1000},
+		{Time: now, AccountID: 1, ClientKey: "c1", Status: 200, ReqSize: 100, RespSize: 2000},
+		{Time: now, AccountID: 2, ClientKey: "c1", Status: 500, ReqSize: 100, RespSize: 50},
+		{Time: now, AccountID: 2, ClientKey: "c2", Error: "timeout", ReqSize: 10},
+	} {
+		s.Insert(ctx, rl)
+	}
+	bw, err := s.Bandwidth(ctx, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bw.Total != (Traffic{Requests: 3, SentBytes: 210, ReceivedBytes: 2050}) || bw.Total.Bytes() != 2260 {
+		t.Fatalf("unexpected total %+v", bw.Total)
+	}
+	if len(bw.Accounts) != 2 || bw.Accounts[0].AccountID != 1 || bw.Accounts[0].Bytes() != 2100 || bw.Accounts[1].Traffic != (Traffic{Requests: 2, SentBytes: 110, ReceivedBytes: 50}) {
+		t.Fatalf("unexpected accounts %+v", bw.Accounts)
+	}
+	if len(bw.Clients) != 2 || bw.Clients[0].ClientKey != "c1" || bw.Clients[0].Bytes() != 2250 || bw.Clients[1].Bytes() != 10 {
+		t.Fatalf("unexpected clients %+v", bw.Clients)
+	}
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"context"
+	"errors"
+)
+
+// reencryptBatch is the number of logs rewritten per transaction.
+const reencryptBatch = 500
+
+// Reencrypt rewrites the headers and bodies of every log through Cipher,
+// so logs stored before encryption was enabled are encrypted. It returns
+// the number of logs rewritten.
+func (s *Store) Reencrypt(ctx context.Context) (int, error) {
+	if s.Cipher == nil {
+		return 0, errors.New("no cipher configured")
+	}
+	var last int64
+	total := 0
+	for {
+		n, next, err := s.reencryptBatch(ctx, last)
+		total += n
+		if err != nil || next == last {
+			return total, err
+		}
+		last = next
+	}
+}
+
+// reencryptBatch rewrites the logs after id last and returns how many it
+// rewrote and the highest id it saw.
+func (s *Store) reencryptBatch(ctx context.Context, last int64) (int, int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, last, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT id, COALESCE(req_header,''), COALESCE(req_body,''), COALESCE(resp_header,''), COALESCE(resp_body,'') FROM logs WHERE id > ? ORDER BY id LIMIT ?`, last, reencryptBatch)
+	if err != nil {
+		return 0, last, err
+	}
+	type row struct {
+		id     int64
+		values [4]string
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		var reqHeader, respHeader []byte
+		if err := rows.Scan(&r.id, &reqHeader, &r.values[1], &respHeader, &r.values[3]); err != nil {
+			rows.Close()
+			return 0, last, err
+		}
+		r.values[0], r.values[2] = string(reqHeader), string(respHeader)
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, last, err
+	}
+	for _, r := range batch {
+		var plain [4]string
+		for i, v := range r.values {
+			if plain[i], err = s.Cipher.Decrypt(v); err != nil {
+				return 0, last, err
+			}
+		}
+		stored, err := s.encrypt(plain[:]...)
+		if err != nil {
+			return 0, last, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE logs SET req_header=?, req_body=?, resp_header=?, resp_body=? WHERE id=?`,
+			[]byte(stored[0]), stored[1], []byte(stored[2]), stored[3], r.id); err != nil {
+			return 0, last, err
+		}
+		last = r.id
+	}
+	return len(batch), last, tx.Commit()
+}
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+// testCipher "encrypts" by reversing the value behind a prefix.
+type testCipher struct{}
+
+func (testCipher) Encrypt(s string) (string, error) { return "enc:" + reverse(s), nil }
+
+func (testCipher) Decrypt(s string) (string, error) {
+	if v, ok := strings.CutPrefix(s, "enc:"); ok {
+		return reverse(v), nil
+	}
+	return s, nil
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func TestEncryptedLogs(t *testing.T) {
+	db := testdb.Open(t)
+	s, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rl := func() *RequestLog {
+		return &RequestLog{Time: time.Now(), ReqHeader: http.Header{"X-A": {"a"}}, ReqBody: "req", RespHeader: http.Header{"X-B": {"b"}}, RespBody: "resp", Status: 200}
+	}
+	if _, err := s.Reencrypt(ctx); err == nil {
+		t.Fatal("expected error without cipher")
+	}
+	s.Insert(ctx, rl())
+	s.Cipher = testCipher{}
+	s.Insert(ctx, rl())
+
+	var body string
+	db.QueryRow(`SELECT resp_body FROM logs WHERE id=2`).Scan(&body)
+	if body != "enc:pser" {
+		t.Fatalf("stored body %q", body)
+	}
+	for id := int64(1); id <= 2; id++ {
+		got, err := s.Get(ctx, id)
+		if err != nil || got.ReqBody != "req" || got.RespBody != "resp" || got.ReqHeader.Get("X-A") != "a" || got.RespHeader.Get("X-B") != "b" {
+			t.Fatalf("log %d: %+v %v", id, got, err)
+		}
+	}
+	if n, err := s.Reencrypt(ctx); err != nil || n != 2 {
+		t.Fatalf("reencrypt %d %v", n, err)
+	}
+	var header []byte
+	db.QueryRow(`SELECT req_header, req_body FROM logs WHERE id=1`).Scan(&header, &body)
+	if !strings.HasPrefix(string(header), "enc:") || body != "enc:qer" {
+		t.Fatalf("legacy log stored as %q %q", header, body)
+	}
+	if got, _ := s.Get(ctx, 1); got.ReqBody != "req" || got.ReqHeader.Get("X-A") != "a" {
+		t.Fatalf("unexpected log %+v", got)
+	}
+}
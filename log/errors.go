@@ -0,0 +1,127 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Status classes of failed attempts.
+const (
+	ClassTransport = "transport"
+	Class4xx       = "4xx"
+	Class5xx       = "5xx"
+)
+
+// ErrorGroup collects the failed attempts of one status class on one
+// account.
+type ErrorGroup struct {
+	Class     string `json:"class"`
+	AccountID int64  `json:"account_id"`
+	// AccountName is filled in by callers that know the accounts.
+	AccountName string    `json:"account_name"`
+	Count       int       `json:"count"`
+	LastTime    time.Time `json:"last_time"`
+	// Statuses counts the attempts per HTTP status; 0 is a transport error.
+	Statuses map[int]int `json:"statuses"`
+	// Examples are the most recent attempts of the group, newest first,
+	// without headers or bodies.
+	Examples []*RequestLog `json:"examples"`
+}
+
+// statusClass returns the class of a failed attempt.
+func statusClass(status int) string {
+	switch {
+	case status == 0:
+		return ClassTransport
+	case status >= 500:
+		return Class5xx
+	default:
+		return Class4xx
+	}
+}
+
+// ErrorGroups groups the failed attempts logged since the given time by
+// status class and account, largest group first, keeping up to examples
+// recent entries per group.
+func (s *Store) ErrorGroups(ctx context.Context, since time.Time, examples int) ([]*ErrorGroup, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, time, account_id, method, url, status, COALESCE(duration_ms,0), COALESCE(error,''), model FROM logs WHERE status >= 400 OR status = 0 OR COALESCE(error,'') != '' ORDER BY id DESC`)
+	if err != nil {
+		logger.Errorf("query error logs failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	agg := newErrorAgg(since, examples)
+	for rows.Next() {
+		var rl RequestLog
+		if err := rows.Scan(&rl.ID, &rl.Time, &rl.AccountID, &rl.Method, &rl.URL, &rl.Status, &rl.DurationMs, &rl.Error, &rl.Model); err != nil {
+			logger.Errorf("scan error log failed: %v", err)
+			return nil, err
+		}
+		agg.add(&rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate error logs failed: %v", err)
+		return nil, err
+	}
+	return agg.result(), nil
+}
+
+type errorKey struct {
+	class   string
+	account int64
+}
+
+// errorAgg computes ErrorGroups from the logs passed to add, newest first.
+type errorAgg struct {
+	since    time.Time
+	examples int
+	groups   map[errorKey]*ErrorGroup
+}
+
+func newErrorAgg(since time.Time, examples int) *errorAgg {
+	return &errorAgg{since: since, examples: examples, groups: make(map[errorKey]*ErrorGroup)}
+}
+
+func (g *errorAgg) add(rl *RequestLog) {
+	if !failed(rl) || rl.Time.Before(g.since) {
+		return
+	}
+	k := errorKey{statusClass(rl.Status), rl.AccountID}
+	e := g.groups[k]
+	if e == nil {
+		e = &ErrorGroup{Class: k.class, AccountID: k.account, LastTime: rl.Time, Statuses: make(map[int]int)}
+		g.groups[k] = e
+	}
+	e.Count++
+	e.Statuses[rl.Status]++
+	if len(e.Examples) < g.examples {
+		ex := &RequestLog{ID: rl.ID, Time: rl.Time, AccountID: rl.AccountID, Method: rl.Method, URL: rl.URL, Status: rl.Status, DurationMs: rl.DurationMs, Error: rl.Error, Model: rl.Model}
+		if len(ex.Error) > 500 {
+			ex.Error = ex.Error[:500] + "…"
+		}
+		e.Examples = append(e.Examples, ex)
+	}
+}
+
+func (g *errorAgg) result() []*ErrorGroup {
+	res := make([]*ErrorGroup, 0, len(g.groups))
+	for _, e := range g.groups {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		if !res[i].LastTime.Equal(res[j].LastTime) {
+			return res[i].LastTime.After(res[j].LastTime)
+		}
+		if res[i].Class != res[j].Class {
+			return res[i].Class < res[j].Class
+		}
+		return res[i].AccountID < res[j].AccountID
+	})
+	return res
+}
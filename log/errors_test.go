@@ -0,0 +1,57 @@
+package log
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func TestErrorGroups(t *testing.T) {
+	db := testdb.Open(t)
+	s, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	for _, rl := range []*RequestLog{
+		{Time: now, AccountID: 1, Status: 200},
+		{Time: now, AccountID: 1, Status: 429, Error: "rate limited"},
+		{Time: now, AccountID: 1, Status: 401, Error: strings.Repeat("x", 600)},
+		{Time: now, AccountID: 1, Status: 429, Error: "rate limited"},
+		{Time: now, AccountID: 2, Status: 502, Error: "bad gateway"},
+		{Time: now, AccountID: 2, Error: "dial tcp: timeout"},
+		{Time: now.Add(-48 * time.Hour), AccountID: 3, Status: 500, Error: "old"},
+	} {
+		if err := s.Insert(ctx, rl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := s.ErrorGroups(ctx, now.Add(-time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(groups))
+	}
+	g := groups[0]
+	if g.Class != Class4xx || g.AccountID != 1 || g.Count != 3 || g.Statuses[429] != 2 || len(g.Examples) != 2 {
+		t.Fatalf("unexpected 4xx group %+v", g)
+	}
+	if g.Examples[0].ID <= g.Examples[1].ID {
+		t.Fatalf("examples not newest first")
+	}
+	if g.Examples[1].Status != 401 || len(g.Examples[1].Error) > 510 {
+		t.Fatalf("example error not truncated: %d", len(g.Examples[1].Error))
+	}
+	classes := map[string]bool{}
+	for _, g := range groups[1:] {
+		classes[g.Class] = g.AccountID == 2 && g.Count == 1
+	}
+	if !classes[Class5xx] || !classes[ClassTransport] {
+		t.Fatalf("unexpected groups %+v %+v", groups[1], groups[2])
+	}
+}
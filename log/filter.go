@@ -0,0 +1,83 @@
+package log
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Filter selects the logs Find returns. Zero fields do not restrict.
+type Filter struct {
+	AccountID int64
+	ClientKey string
+	Model     string
+	Status    int
+	// Errors keeps failed attempts only: transport errors and statuses of
+	// 400 or above.
+	Errors bool
+	// MinDuration keeps attempts that took at least this long.
+	MinDuration time.Duration
+	// Since keeps attempts logged at or after this time.
+	Since time.Time
+}
+
+// match reports whether rl passes f.
+func (f Filter) match(rl *RequestLog) bool {
+	return (f.AccountID == 0 || rl.AccountID == f.AccountID) &&
+		(f.ClientKey == "" || rl.ClientKey == f.ClientKey) &&
+		(f.Model == "" || rl.Model == f.Model) &&
+		(f.Status == 0 || rl.Status == f.Status) &&
+		(!f.Errors || failed(rl)) &&
+		(f.MinDuration == 0 || rl.DurationMs >= f.MinDuration.Milliseconds()) &&
+		!rl.Time.Before(f.Since)
+}
+
+// where returns the SQL condition of f, except for Since, which the
+// timestamps' text encoding does not allow comparing in SQL.
+func (f Filter) where() (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if f.AccountID != 0 {
+		add("account_id=?", f.AccountID)
+	}
+	if f.ClientKey != "" {
+		add("client_key=?", f.ClientKey)
+	}
+	if f.Model != "" {
+		add("model=?", f.Model)
+	}
+	if f.Status != 0 {
+		add("status=?", f.Status)
+	}
+	if f.MinDuration != 0 {
+		add("duration_ms >= ?", f.MinDuration.Milliseconds())
+	}
+	if f.Errors {
+		conds = append(conds, "(status = 0 OR status >= 400 OR COALESCE(error,'') != '')")
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Find returns summaries of the latest logs passing f, limited by n with
+// offset. Logs are inserted in time order, so the page ends at the first
+// log older than f.Since.
+func (s *Store) Find(ctx context.Context, f Filter, n, offset int) ([]*RequestLog, error) {
+	where, args := f.where()
+	res, err := s.list(ctx, where, args, n, offset)
+	if err != nil {
+		return nil, err
+	}
+	for i, rl := range res {
+		if rl.Time.Before(f.Since) {
+			return res[:i], nil
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,41 @@
+package log
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+func TestFind(t *testing.T) {
+	db := testdb.Open(t)
+	s, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	for _, rl := range []*RequestLog{
+		{Time: now.Add(-48 * time.Hour), AccountID: 7, Status: 500},
+		{Time: now.Add(-time.Hour), AccountID: 7, Status: 200},
+		{Time: now.Add(-time.Hour), AccountID: 7, Error: "dial tcp: timeout"},
+		{Time: now, AccountID: 8, Status: 429},
+		{Time: now, AccountID: 7, Status: 502},
+	} {
+		if err := s.Insert(ctx, rl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := Filter{AccountID: 7, Errors: true, Since: now.Add(-24 * time.Hour)}
+	logs, err := s.Find(ctx, f, 10, 0)
+	if err != nil || len(logs) != 2 || logs[0].Status != 502 || logs[1].Error == "" {
+		t.Fatalf("unexpected logs %+v %v", logs, err)
+	}
+	if logs, _ = s.Find(ctx, f, 10, 1); len(logs) != 1 || logs[0].Error == "" {
+		t.Fatalf("unexpected second page %+v", logs)
+	}
+	if logs, _ = s.Find(ctx, Filter{AccountID: 7, Errors: true}, 10, 0); len(logs) != 3 {
+		t.Fatalf("expected old errors without Since, got %+v", logs)
+	}
+}
@@ -0,0 +1,251 @@
+package log
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Storage keeps RequestLogs and answers the admin UI's and portal's
+// queries about them. Store keeps them in SQLite, MemoryStore in memory.
+type Storage interface {
+	Insert(ctx context.Context, rl *RequestLog) error
+	// InsertID is Insert returning the ID of the new log.
+	InsertID(ctx context.Context, rl *RequestLog) (int64, error)
+	// Enrich completes an inserted log with the fields derived from its
+	// bodies, see Store.Enrich.
+	Enrich(ctx context.Context, rl *RequestLog) error
+	List(ctx context.Context, n, offset int) ([]*RequestLog, error)
+	ListSlow(ctx context.Context, min time.Duration, n, offset int) ([]*RequestLog, error)
+	ListAccount(ctx context.Context, id int64, n int) ([]*RequestLog, error)
+	Find(ctx context.Context, f Filter, n, offset int) ([]*RequestLog, error)
+	Get(ctx context.Context, id int64) (*RequestLog, error)
+	Session(ctx context.Context, session string, n int) ([]*RequestLog, error)
+	ClientRequests(ctx context.Context, clientKey string, n int) ([]*RequestLog, error)
+	AccountStats(ctx context.Context, id int64, since time.Time) (AccountStats, error)
+	ErrorGroups(ctx context.Context, since time.Time, examples int) ([]*ErrorGroup, error)
+	Usage(ctx context.Context, since, until time.Time) ([]Usage, error)
+	ModelStats(ctx context.Context, since time.Time) ([]ModelStats, error)
+	CacheStats(ctx context.Context, since time.Time) ([]CacheStats, error)
+	Bandwidth(ctx context.Context, since time.Time) (Bandwidth, error)
+	// LoggedAccounts returns the IDs of the accounts with logs in
+	// ascending order.
+	LoggedAccounts(ctx context.Context) ([]int64, error)
+	// DeleteAccount deletes the logs of account id and returns how many
+	// there were.
+	DeleteAccount(ctx context.Context, id int64) (int64, error)
+}
+
+var (
+	_ Storage = (*Store)(nil)
+	_ Storage = (*MemoryStore)(nil)
+)
+
+// MemoryStore keeps the latest RequestLogs in memory, dropping the oldest
+// beyond its limit. Logs are lost when the process exits, which suits
+// ephemeral deployments and tests.
+type MemoryStore struct {
+	mu    sync.Mutex
+	limit int
+	next  int64
+	// logs are oldest first.
+	logs []*RequestLog
+}
+
+// NewMemoryStore returns a MemoryStore keeping up to limit logs.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{limit: limit}
+}
+
+// full returns a copy of rl the caller may modify.
+func full(rl *RequestLog) *RequestLog {
+	c := *rl
+	c.ReqHeader, c.RespHeader = rl.ReqHeader.Clone(), rl.RespHeader.Clone()
+	return &c
+}
+
+// summary returns a copy of rl without headers, bodies and decision, as
+// Store.List loads it.
+func summary(rl *RequestLog) *RequestLog {
+	c := *rl
+	c.ReqHeader, c.ReqBody, c.RespHeader, c.RespBody, c.Decision = nil, "", nil, "", ""
+	return &c
+}
+
+// Insert saves a copy of rl under the next ID.
+func (s *MemoryStore) Insert(ctx context.Context, rl *RequestLog) error {
+	_, err := s.InsertID(ctx, rl)
+	return err
+}
+
+func (s *MemoryStore) InsertID(ctx context.Context, rl *RequestLog) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	c := full(rl)
+	c.ID = s.next
+	s.logs = append(s.logs, c)
+	if len(s.logs) > s.limit {
+		s.logs[0] = nil
+		s.logs = s.logs[1:]
+	}
+	return c.ID, nil
+}
+
+func (s *MemoryStore) Enrich(ctx context.Context, rl *RequestLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.logs {
+		if c.ID == rl.ID {
+			c.ReqBody, c.RespBody, c.Decision = rl.ReqBody, rl.RespBody, rl.Decision
+			c.InputTokens, c.OutputTokens, c.CachedTokens, c.EstimatedTokens = rl.InputTokens, rl.OutputTokens, rl.CachedTokens, rl.EstimatedTokens
+		}
+	}
+	return nil
+}
+
+// newest returns up to n summaries of the logs matching keep, newest
+// first, skipping the first offset.
+func (s *MemoryStore) newest(keep func(*RequestLog) bool, n, offset int) []*RequestLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*RequestLog
+	for i := len(s.logs) - 1; i >= 0 && len(res) < n; i-- {
+		if !keep(s.logs[i]) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		res = append(res, summary(s.logs[i]))
+	}
+	return res
+}
+
+func (s *MemoryStore) List(ctx context.Context, n, offset int) ([]*RequestLog, error) {
+	return s.newest(func(*RequestLog) bool { return true }, n, offset), nil
+}
+
+func (s *MemoryStore) ListSlow(ctx context.Context, min time.Duration, n, offset int) ([]*RequestLog, error) {
+	return s.newest(func(rl *RequestLog) bool { return rl.DurationMs >= min.Milliseconds() }, n, offset), nil
+}
+
+func (s *MemoryStore) ListAccount(ctx context.Context, id int64, n int) ([]*RequestLog, error) {
+	return s.newest(func(rl *RequestLog) bool { return rl.AccountID == id }, n, 0), nil
+}
+
+func (s *MemoryStore) Find(ctx context.Context, f Filter, n, offset int) ([]*RequestLog, error) {
+	return s.newest(f.match, n, offset), nil
+}
+
+// ClientRequests returns the metadata of the latest n attempts made for a
+// client key, newest first, as Store.ClientRequests does.
+func (s *MemoryStore) ClientRequests(ctx context.Context, clientKey string, n int) ([]*RequestLog, error) {
+	res := []*RequestLog{}
+	for _, rl := range s.newest(func(rl *RequestLog) bool { return rl.ClientKey == clientKey }, n, 0) {
+		res = append(res, &RequestLog{ID: rl.ID, Time: rl.Time, Method: rl.Method, URL: rl.URL, Status: rl.Status, DurationMs: rl.DurationMs, Model: rl.Model,
+			InputTokens: rl.InputTokens, OutputTokens: rl.OutputTokens, ClientKey: clientKey})
+	}
+	return res, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id int64) (*RequestLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rl := range s.logs {
+		if rl.ID == id {
+			return full(rl), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Session(ctx context.Context, session string, n int) ([]*RequestLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*RequestLog
+	for _, rl := range s.logs {
+		if len(res) == n {
+			break
+		}
+		if session != "" && rl.Session == session {
+			res = append(res, full(rl))
+		}
+	}
+	return res, nil
+}
+
+// each calls add for every log, newest first.
+func (s *MemoryStore) each(add func(*RequestLog)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.logs) - 1; i >= 0; i-- {
+		add(s.logs[i])
+	}
+}
+
+func (s *MemoryStore) AccountStats(ctx context.Context, id int64, since time.Time) (AccountStats, error) {
+	agg := accountAgg{id: id, since: since}
+	s.each(agg.add)
+	return agg.result(), nil
+}
+
+func (s *MemoryStore) ErrorGroups(ctx context.Context, since time.Time, examples int) ([]*ErrorGroup, error) {
+	agg := newErrorAgg(since, examples)
+	s.each(agg.add)
+	return agg.result(), nil
+}
+
+func (s *MemoryStore) Usage(ctx context.Context, since, until time.Time) ([]Usage, error) {
+	agg := newUsageAgg(since, until)
+	s.each(agg.add)
+	return agg.result(), nil
+}
+
+func (s *MemoryStore) ModelStats(ctx context.Context, since time.Time) ([]ModelStats, error) {
+	agg := newModelAgg(since)
+	s.each(agg.add)
+	return agg.result(), nil
+}
+
+func (s *MemoryStore) CacheStats(ctx context.Context, since time.Time) ([]CacheStats, error) {
+	agg := newCacheAgg(since)
+	s.each(agg.add)
+	return agg.result(), nil
+}
+
+func (s *MemoryStore) Bandwidth(ctx context.Context, since time.Time) (Bandwidth, error) {
+	agg := newBandwidthAgg(since)
+	s.each(agg.add)
+	return agg.result(), nil
+}
+
+func (s *MemoryStore) LoggedAccounts(ctx context.Context) ([]int64, error) {
+	seen := make(map[int64]bool)
+	res := []int64{}
+	s.each(func(rl *RequestLog) {
+		if !seen[rl.AccountID] {
+			seen[rl.AccountID] = true
+			res = append(res, rl.AccountID)
+		}
+	})
+	slices.Sort(res)
+	return res, nil
+}
+
+func (s *MemoryStore) DeleteAccount(ctx context.Context, id int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.logs[:0]
+	for _, rl := range s.logs {
+		if rl.AccountID != id {
+			kept = append(kept, rl)
+		}
+	}
+	n := int64(len(s.logs) - len(kept))
+	clear(s.logs[len(kept):])
+	s.logs = kept
+	return n, nil
+}
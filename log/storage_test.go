@@ -0,0 +1,137 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/testdb"
+)
+
+// TestMemoryStore checks that MemoryStore answers every query as Store does
+// for the same logs.
+func TestMemoryStore(t *testing.T) {
+	db := testdb.Open(t)
+	sqlStore, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemoryStore(100)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	logs := []*RequestLog{
+		{Time: now.Add(-50 * time.Hour), AccountID: 1, Method: "POST", URL: "u", Status: 200, ClientKey: "c1", Model: "gpt-5", InputTokens: 10, OutputTokens: 1},
+		{Time: now, AccountID: 1, Method: "POST", URL: "u", Status: 200, DurationMs: 900, TTFBMs: 100, ClientKey: "c1", Model: "gpt-5", InputTokens: 20, OutputTokens: 2, CachedTokens: 5, EstimatedTokens: 18, Session: "s1", ReqSize: 300, RespSize: 4000,
+			ReqHeader: http.Header{"A": {"1"}}, ReqBody: "req", RespHeader: http.Header{"B": {"2"}}, RespBody: "resp", Decision: `{"mode":"priority"}`},
+		{Time: now, AccountID: 2, Method: "POST", URL: "u", Status: 429, DurationMs: 10, ClientKey: "c2", Model: "gpt-5-mini", Error: "rate limited", Session: "s1", EstimatedTokens: 40},
+		{Time: now, AccountID: 2, Method: "GET", URL: "u", Error: "dial tcp: timeout", ClientKey: "c1"},
+		{Time: now, AccountID: 1, Method: "POST", URL: "u", Status: 200, DurationMs: 2000, ClientKey: "c2", Model: "gpt-5", InputTokens: 7, OutputTokens: 3, Session: "s2", ReqSize: 20, RespSize: 100},
+	}
+	for _, rl := range logs {
+		if err := sqlStore.Insert(ctx, rl); err != nil {
+			t.Fatal(err)
+		}
+		if err := mem.Insert(ctx, rl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	since := now.Add(-time.Hour)
+	queries := map[string]func(Storage) (any, error){
+		"List":           func(s Storage) (any, error) { return s.List(ctx, 3, 1) },
+		"ListSlow":       func(s Storage) (any, error) { return s.ListSlow(ctx, 500*time.Millisecond, 10, 0) },
+		"ListAccount":    func(s Storage) (any, error) { return s.ListAccount(ctx, 2, 10) },
+		"FindErrors":     func(s Storage) (any, error) { return s.Find(ctx, Filter{AccountID: 2, Errors: true}, 10, 0) },
+		"FindSince":      func(s Storage) (any, error) { return s.Find(ctx, Filter{ClientKey: "c1", Since: since}, 10, 0) },
+		"FindModel":      func(s Storage) (any, error) { return s.Find(ctx, Filter{Model: "gpt-5", Status: 200}, 10, 0) },
+		"Get":            func(s Storage) (any, error) { return s.Get(ctx, 2) },
+		"GetMissing":     func(s Storage) (any, error) { return s.Get(ctx, 99) },
+		"Session":        func(s Storage) (any, error) { return s.Session(ctx, "s1", 10) },
+		"ClientRequests": func(s Storage) (any, error) { return s.ClientRequests(ctx, "c1", 10) },
+		"AccountStats":   func(s Storage) (any, error) { return s.AccountStats(ctx, 1, since) },
+		"ErrorGroups":    func(s Storage) (any, error) { return s.ErrorGroups(ctx, since, 1) },
+		"Usage":          func(s Storage) (any, error) { return s.Usage(ctx, now.Add(-72*time.Hour), now.Add(time.Hour)) },
+		"ModelStats":     func(s Storage) (any, error) { return s.ModelStats(ctx, since) },
+		"CacheStats":     func(s Storage) (any, error) { return s.CacheStats(ctx, since) },
+		"Bandwidth":      func(s Storage) (any, error) { return s.Bandwidth(ctx, since) },
+		"LoggedAccounts": func(s Storage) (any, error) { return s.LoggedAccounts(ctx) },
+	}
+	for name, q := range queries {
+		want, err := q(sqlStore)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := q(mem)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		wantJSON, _ := json.Marshal(want)
+		gotJSON, _ := json.Marshal(got)
+		if string(gotJSON) != string(wantJSON) {
+			t.Fatalf("%s:\n got %s\nwant %s", name, gotJSON, wantJSON)
+		}
+	}
+
+	// Failed requests count their estimate though the upstream reported
+	// no usage.
+	for _, s := range []Storage{sqlStore, mem} {
+		stats, err := s.ModelStats(ctx, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range stats {
+			if want := map[string]int64{"gpt-5": 18, "gpt-5-mini": 40}[m.Model]; m.EstimatedTokens != want {
+				t.Fatalf("%T: %s estimated %d tokens, want %d", s, m.Model, m.EstimatedTokens, want)
+			}
+		}
+	}
+
+	// A log inserted without its body fields gets them later.
+	for _, s := range []Storage{sqlStore, mem} {
+		id, err := s.InsertID(ctx, &RequestLog{Time: now, AccountID: 1, Method: "POST", URL: "u", Status: 200, ReqHeader: http.Header{}, RespHeader: http.Header{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Enrich(ctx, &RequestLog{ID: id, ReqBody: "req", RespBody: "resp", InputTokens: 4, OutputTokens: 2, CachedTokens: 1, EstimatedTokens: 5, Decision: "{}"}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, id)
+		if err != nil || got.ReqBody != "req" || got.RespBody != "resp" || got.InputTokens != 4 || got.OutputTokens != 2 || got.CachedTokens != 1 || got.EstimatedTokens != 5 || got.Decision != "{}" || got.Status != 200 {
+			t.Fatalf("%T: unexpected enriched log %+v %v", s, got, err)
+		}
+	}
+
+	for _, s := range []Storage{sqlStore, mem} {
+		if n, err := s.DeleteAccount(ctx, 2); err != nil || n != 2 {
+			t.Fatalf("%T deleted %d logs: %v", s, n, err)
+		}
+		if ids, err := s.LoggedAccounts(ctx); err != nil || len(ids) != 1 || ids[0] != 1 {
+			t.Fatalf("%T kept logs of %v: %v", s, ids, err)
+		}
+	}
+}
+
+func TestMemoryStoreLimit(t *testing.T) {
+	s := NewMemoryStore(2)
+	ctx := context.Background()
+	rl := &RequestLog{Time: time.Now(), Status: 200, ReqHeader: http.Header{"A": {"1"}}}
+	for range 3 {
+		s.Insert(ctx, rl)
+	}
+	if rl.ID != 0 {
+		t.Fatalf("Insert changed the caller's log: %+v", rl)
+	}
+	list, _ := s.List(ctx, 10, 0)
+	if len(list) != 2 || list[0].ID != 3 || list[1].ID != 2 || list[0].ReqHeader != nil {
+		t.Fatalf("unexpected logs %+v", list)
+	}
+	if got, _ := s.Get(ctx, 1); got != nil {
+		t.Fatalf("oldest log kept: %+v", got)
+	}
+	got, _ := s.Get(ctx, 3)
+	got.ReqHeader.Set("A", "changed")
+	if again, _ := s.Get(ctx, 3); again.ReqHeader.Get("A") != "1" {
+		t.Fatalf("stored log modified through Get: %+v", again)
+	}
+}
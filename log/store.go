@@ -0,0 +1,362 @@
+// Package log persists proxied request/response records in SQLite, or keeps
+// them in memory, for the admin UI.
+package log
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/dbhealth"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// RequestLog records a proxied request.
+type RequestLog struct {
+        ID         int64
+        Time       time.Time
+       AccountID  int64
+       AccountName string
+       Method     string
+        URL        string
+        ReqHeader  http.Header
+        ReqBody    string
+        ReqSize    int
+        RespHeader http.Header
+	RespBody   string
+	RespSize   int
+	Status     int
+	DurationMs int64
+	Error      string
+	// ClientKey identifies the client that made the request; empty for
+	// unauthenticated clients.
+	ClientKey string
+	// InputTokens and OutputTokens are the upstream-reported usage, zero
+	// when the response carried none.
+	InputTokens  int64
+	OutputTokens int64
+	// CachedTokens is the part of InputTokens served from the upstream
+	// prompt cache.
+	CachedTokens int64
+	// EstimatedTokens is the input of the request as estimated from its
+	// body by package tokenizer, known even when the upstream reported no
+	// usage, as on errors.
+	EstimatedTokens int64
+	// CacheHit is set when the response was served from the proxy's
+	// response cache, without an account.
+	CacheHit bool
+	// Shadow is set on the mirrored copies of client requests sent by the
+	// proxy's shadow mode, whose responses the client never saw.
+	Shadow bool
+	// Model is the model requested by the client, if any.
+	Model string
+	// DNSMs, ConnectMs and TLSMs are the upstream connection setup phases;
+	// all are zero when a pooled connection was reused. TTFBMs runs from
+	// sending the request to the first response byte and StreamMs from
+	// there to the end of the body.
+	DNSMs     int64
+	ConnectMs int64
+	TLSMs     int64
+	TTFBMs    int64
+	StreamMs  int64
+	// Session is the Codex session or prompt cache key the request
+	// belonged to, if any.
+	Session string
+	// Decision is the JSON scheduler.Trace of how the account was
+	// selected, empty unless the request was traced. Only Get loads it.
+	Decision string
+}
+
+// Store persists RequestLogs in SQLite.
+type Store struct {
+	db *sql.DB
+	// Cipher, when set, encrypts headers and bodies at rest.
+	Cipher Cipher
+}
+
+// Cipher encrypts column values before they are stored. Decrypt must
+// return values written before encryption was enabled unchanged.
+type Cipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(stored string) (string, error)
+}
+
+// encrypt returns the stored form of the header and body columns.
+func (s *Store) encrypt(values ...string) ([]string, error) {
+	if s.Cipher == nil {
+		return values, nil
+	}
+	res := make([]string, len(values))
+	for i, v := range values {
+		enc, err := s.Cipher.Encrypt(v)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = enc
+	}
+	return res, nil
+}
+
+// NewStore creates log store and ensures table exists.
+func NewStore(db *sql.DB) (*Store, error) {
+	s := &Store{db: db}
+	if err := s.init(); err != nil {
+		logger.Errorf("init logs table failed: %v", err)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) init() error {
+	query := `CREATE TABLE IF NOT EXISTS logs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        time TIMESTAMP,
+        account_id INTEGER,
+        method TEXT,
+        url TEXT,
+        req_header BLOB,
+       req_body TEXT,
+       req_size INTEGER NOT NULL DEFAULT 0,
+       resp_header BLOB,
+       resp_body TEXT,
+       resp_size INTEGER NOT NULL DEFAULT 0,
+        status INTEGER,
+        duration_ms INTEGER NOT NULL DEFAULT 0,
+        error TEXT,
+        client_key TEXT NOT NULL DEFAULT '',
+        input_tokens INTEGER NOT NULL DEFAULT 0,
+        output_tokens INTEGER NOT NULL DEFAULT 0,
+        model TEXT NOT NULL DEFAULT '',
+        dns_ms INTEGER NOT NULL DEFAULT 0,
+        connect_ms INTEGER NOT NULL DEFAULT 0,
+        tls_ms INTEGER NOT NULL DEFAULT 0,
+        ttfb_ms INTEGER NOT NULL DEFAULT 0,
+        stream_ms INTEGER NOT NULL DEFAULT 0,
+        cached_tokens INTEGER NOT NULL DEFAULT 0,
+        decision TEXT NOT NULL DEFAULT '',
+        session TEXT NOT NULL DEFAULT '',
+        estimated_tokens INTEGER NOT NULL DEFAULT 0,
+        cache_hit BOOLEAN NOT NULL DEFAULT 0,
+        shadow BOOLEAN NOT NULL DEFAULT 0
+    )`
+	if _, err := s.db.Exec(query); err != nil {
+		logger.Errorf("create logs table failed: %v", err)
+		return err
+	}
+	if _, err := s.db.Exec(`ALTER TABLE logs ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0`); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			logger.Errorf("add duration_ms column failed: %v", err)
+			return err
+		}
+	}
+	if _, err := s.db.Exec(`ALTER TABLE logs ADD COLUMN req_size INTEGER NOT NULL DEFAULT 0`); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			logger.Errorf("add req_size column failed: %v", err)
+			return err
+		}
+	}
+	if _, err := s.db.Exec(`ALTER TABLE logs ADD COLUMN resp_size INTEGER NOT NULL DEFAULT 0`); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			logger.Errorf("add resp_size column failed: %v", err)
+			return err
+		}
+	}
+	for _, col := range []string{
+		`client_key TEXT NOT NULL DEFAULT ''`,
+		`input_tokens INTEGER NOT NULL DEFAULT 0`,
+		`output_tokens INTEGER NOT NULL DEFAULT 0`,
+		`model TEXT NOT NULL DEFAULT ''`,
+		`dns_ms INTEGER NOT NULL DEFAULT 0`,
+		`connect_ms INTEGER NOT NULL DEFAULT 0`,
+		`tls_ms INTEGER NOT NULL DEFAULT 0`,
+		`ttfb_ms INTEGER NOT NULL DEFAULT 0`,
+		`stream_ms INTEGER NOT NULL DEFAULT 0`,
+		`cached_tokens INTEGER NOT NULL DEFAULT 0`,
+		`decision TEXT NOT NULL DEFAULT ''`,
+		`session TEXT NOT NULL DEFAULT ''`,
+		`estimated_tokens INTEGER NOT NULL DEFAULT 0`,
+		`cache_hit BOOLEAN NOT NULL DEFAULT 0`,
+		`shadow BOOLEAN NOT NULL DEFAULT 0`,
+	} {
+		if _, err := s.db.Exec(`ALTER TABLE logs ADD COLUMN ` + col); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				logger.Errorf("add %s column failed: %v", strings.Fields(col)[0], err)
+				return err
+			}
+		}
+	}
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS logs_session ON logs(session) WHERE session != ''`); err != nil {
+		logger.Errorf("create logs session index failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Insert saves a RequestLog.
+func (s *Store) Insert(ctx context.Context, rl *RequestLog) error {
+	_, err := s.InsertID(ctx, rl)
+	return err
+}
+
+// InsertID saves a RequestLog and returns its ID.
+func (s *Store) InsertID(ctx context.Context, rl *RequestLog) (int64, error) {
+	reqHeader, err := json.Marshal(rl.ReqHeader)
+	if err != nil {
+		logger.Warnf("marshal req header failed: %v", err)
+	}
+	respHeader, err := json.Marshal(rl.RespHeader)
+	if err != nil {
+		logger.Warnf("marshal resp header failed: %v", err)
+	}
+	stored, err := s.encrypt(string(reqHeader), rl.ReqBody, string(respHeader), rl.RespBody)
+	if err != nil {
+		logger.Errorf("encrypt request log failed: %v", err)
+		return 0, err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO logs(time, account_id, method, url, req_header, req_body, req_size, resp_header, resp_body, resp_size, status, duration_ms, error, client_key, input_tokens, output_tokens, model, dns_ms, connect_ms, tls_ms, ttfb_ms, stream_ms, cached_tokens, decision, session, estimated_tokens, cache_hit, shadow) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		rl.Time, rl.AccountID, rl.Method, rl.URL, []byte(stored[0]), stored[1], rl.ReqSize, []byte(stored[2]), stored[3], rl.RespSize, rl.Status, rl.DurationMs, rl.Error, rl.ClientKey, rl.InputTokens, rl.OutputTokens, rl.Model, rl.DNSMs, rl.ConnectMs, rl.TLSMs, rl.TTFBMs, rl.StreamMs, rl.CachedTokens, rl.Decision, rl.Session, rl.EstimatedTokens, rl.CacheHit, rl.Shadow)
+	if err != nil {
+		logger.Errorf("insert request log failed: %v", err)
+		dbhealth.RecordWriteError("logs")
+		return 0, err
+	}
+	logger.Debugf("logged request account %d status %d", rl.AccountID, rl.Status)
+	return res.LastInsertId()
+}
+
+// Enrich stores the fields of the inserted log rl.ID that are derived from
+// its bodies: the bodies themselves, the token usage and estimate and the
+// decision.
+func (s *Store) Enrich(ctx context.Context, rl *RequestLog) error {
+	stored, err := s.encrypt(rl.ReqBody, rl.RespBody)
+	if err != nil {
+		logger.Errorf("encrypt request log failed: %v", err)
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE logs SET req_body=?, resp_body=?, input_tokens=?, output_tokens=?, cached_tokens=?, estimated_tokens=?, decision=? WHERE id=?`,
+		stored[0], stored[1], rl.InputTokens, rl.OutputTokens, rl.CachedTokens, rl.EstimatedTokens, rl.Decision, rl.ID)
+	if err != nil {
+		logger.Errorf("enrich request log %d failed: %v", rl.ID, err)
+		dbhealth.RecordWriteError("logs")
+		return err
+	}
+	return nil
+}
+
+// List returns latest logs limited by n with offset. Only summaries are
+// loaded: headers and bodies are left empty, use Get for a full record.
+func (s *Store) List(ctx context.Context, n, offset int) ([]*RequestLog, error) {
+	return s.list(ctx, "", nil, n, offset)
+}
+
+// ListSlow returns summaries of the latest logs of attempts that took at
+// least min, limited by n with offset.
+func (s *Store) ListSlow(ctx context.Context, min time.Duration, n, offset int) ([]*RequestLog, error) {
+	return s.list(ctx, "WHERE duration_ms >= ?", []any{min.Milliseconds()}, n, offset)
+}
+
+// summaryColumns are the columns loaded by list, in scanSummary order.
+const summaryColumns = `id, time, account_id, method, url, req_size, resp_size, status, COALESCE(duration_ms,0), error, client_key, input_tokens, output_tokens, model, dns_ms, connect_ms, tls_ms, ttfb_ms, stream_ms, cached_tokens, session, estimated_tokens, cache_hit, shadow`
+
+func scanSummary(sc interface{ Scan(...any) error }, rl *RequestLog, extra ...any) error {
+	return sc.Scan(append([]any{&rl.ID, &rl.Time, &rl.AccountID, &rl.Method, &rl.URL, &rl.ReqSize, &rl.RespSize, &rl.Status, &rl.DurationMs, &rl.Error, &rl.ClientKey, &rl.InputTokens, &rl.OutputTokens, &rl.Model, &rl.DNSMs, &rl.ConnectMs, &rl.TLSMs, &rl.TTFBMs, &rl.StreamMs, &rl.CachedTokens, &rl.Session, &rl.EstimatedTokens, &rl.CacheHit, &rl.Shadow}, extra...)...)
+}
+
+// Get returns the full log with the given ID, including headers and bodies,
+// or nil if there is none.
+func (s *Store) Get(ctx context.Context, id int64) (*RequestLog, error) {
+	var rl RequestLog
+	var reqHeader, respHeader []byte
+	err := scanSummary(s.db.QueryRowContext(ctx, `SELECT `+summaryColumns+`, req_header, req_body, resp_header, resp_body, decision FROM logs WHERE id=?`, id), &rl, &reqHeader, &rl.ReqBody, &respHeader, &rl.RespBody, &rl.Decision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Errorf("get log %d failed: %v", id, err)
+		return nil, err
+	}
+	if err := s.decode(&rl, reqHeader, respHeader); err != nil {
+		return nil, err
+	}
+	return &rl, nil
+}
+
+// Session returns the full logs of session, oldest first, at most n of
+// them.
+func (s *Store) Session(ctx context.Context, session string, n int) ([]*RequestLog, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+summaryColumns+`, req_header, req_body, resp_header, resp_body, decision FROM logs WHERE session=? AND session != '' ORDER BY id LIMIT ?`, session, n)
+	if err != nil {
+		logger.Errorf("query session %s logs failed: %v", session, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*RequestLog
+	for rows.Next() {
+		var rl RequestLog
+		var reqHeader, respHeader []byte
+		if err := scanSummary(rows, &rl, &reqHeader, &rl.ReqBody, &respHeader, &rl.RespBody, &rl.Decision); err != nil {
+			logger.Errorf("scan log row failed: %v", err)
+			return nil, err
+		}
+		if err := s.decode(&rl, reqHeader, respHeader); err != nil {
+			return nil, err
+		}
+		res = append(res, &rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate logs failed: %v", err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// decode decrypts the headers and bodies of rl, as loaded from the
+// database, and unmarshals the headers.
+func (s *Store) decode(rl *RequestLog, reqHeader, respHeader []byte) error {
+	if s.Cipher != nil {
+		var values [4]string
+		for i, v := range []string{string(reqHeader), rl.ReqBody, string(respHeader), rl.RespBody} {
+			var err error
+			if values[i], err = s.Cipher.Decrypt(v); err != nil {
+				logger.Errorf("decrypt log %d failed: %v", rl.ID, err)
+				return err
+			}
+		}
+		reqHeader, rl.ReqBody, respHeader, rl.RespBody = []byte(values[0]), values[1], []byte(values[2]), values[3]
+	}
+	if err := json.Unmarshal(reqHeader, &rl.ReqHeader); err != nil {
+		logger.Warnf("unmarshal req header failed: %v", err)
+	}
+	if err := json.Unmarshal(respHeader, &rl.RespHeader); err != nil {
+		logger.Warnf("unmarshal resp header failed: %v", err)
+	}
+	return nil
+}
+
+func (s *Store) list(ctx context.Context, where string, args []any, n, offset int) ([]*RequestLog, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+summaryColumns+` FROM logs `+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, n, offset)...)
+	if err != nil {
+		logger.Errorf("query logs failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*RequestLog
+	for rows.Next() {
+		var rl RequestLog
+		if err := scanSummary(rows, &rl); err != nil {
+			logger.Errorf("scan log row failed: %v", err)
+			return nil, err
+		}
+		res = append(res, &rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate logs failed: %v", err)
+		return nil, err
+	}
+	logger.Debugf("retrieved %d logs", len(res))
+	return res, nil
+}
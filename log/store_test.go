@@ -2,21 +2,16 @@ package log
 
 import (
 	"context"
-	"database/sql"
-	"fmt"
 	"net/http"
 	"testing"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"github.com/kxn/codex-companion/internal/testdb"
 )
 
 func setupLogDB(t *testing.T) *Store {
 	t.Helper()
-	db, err := sql.Open("sqlite", "file:log?mode=memory&cache=shared")
-	if err != nil {
-		t.Fatal(err)
-	}
+	db := testdb.Open(t)
 	s, err := NewStore(db)
 	if err != nil {
 		t.Fatal(err)
@@ -82,9 +77,22 @@ func TestInsertList(t *testing.T) {
 	if len(logs) != 2 || logs[0].ID <= logs[1].ID {
 		t.Fatalf("unexpected order: %+v", logs)
 	}
-	if logs[0].ReqHeader.Get("C") != "3" || logs[0].ReqBody != "req3" || logs[0].ReqSize != 4 || logs[0].RespHeader.Get("Z") != "3" || logs[0].RespBody != "resp3" || logs[0].RespSize != 5 || logs[0].DurationMs != 30 {
+	if logs[0].ReqSize != 4 || logs[0].RespSize != 5 || logs[0].DurationMs != 30 {
 		t.Fatalf("log fields not restored: %+v", logs[0])
 	}
+	if logs[0].ReqHeader != nil || logs[0].ReqBody != "" || logs[0].RespHeader != nil || logs[0].RespBody != "" {
+		t.Fatalf("list returned full log: %+v", logs[0])
+	}
+	full, err := s.Get(ctx, logs[0].ID)
+	if err != nil || full == nil {
+		t.Fatalf("get: %v %v", full, err)
+	}
+	if full.ReqHeader.Get("C") != "3" || full.ReqBody != "req3" || full.ReqSize != 4 || full.RespHeader.Get("Z") != "3" || full.RespBody != "resp3" || full.RespSize != 5 || full.DurationMs != 30 {
+		t.Fatalf("log fields not restored: %+v", full)
+	}
+	if missing, err := s.Get(ctx, 999); err != nil || missing != nil {
+		t.Fatalf("get missing: %v %v", missing, err)
+	}
 
 	// test offset
 	logs, err = s.List(ctx, 1, 1)
@@ -94,12 +102,8 @@ func TestInsertList(t *testing.T) {
 }
 
 func TestStoreMigrateDurationMs(t *testing.T) {
-	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
-	db, err := sql.Open("sqlite", dsn)
-	if err != nil {
-		t.Fatal(err)
-	}
-	_, err = db.Exec(`CREATE TABLE logs (
+	db := testdb.Open(t)
+	_, err := db.Exec(`CREATE TABLE logs (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         time TIMESTAMP,
         account_id INTEGER,
@@ -149,12 +153,8 @@ func TestStoreMigrateDurationMs(t *testing.T) {
 }
 
 func TestStoreMigrateReqSize(t *testing.T) {
-	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
-	db, err := sql.Open("sqlite", dsn)
-	if err != nil {
-		t.Fatal(err)
-	}
-	_, err = db.Exec(`CREATE TABLE logs (
+	db := testdb.Open(t)
+	_, err := db.Exec(`CREATE TABLE logs (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         time TIMESTAMP,
         account_id INTEGER,
@@ -0,0 +1,271 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Usage is the consumption of one client key on one UTC day.
+type Usage struct {
+	Day          time.Time `json:"day"`
+	ClientKey    string    `json:"client_key"`
+	Requests     int64     `json:"requests"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+}
+
+// Usage aggregates successful requests logged in [since, until) per UTC day
+// and client key, ordered by day and then key. Failed attempts are not
+// counted since the client was not served by them.
+func (s *Store) Usage(ctx context.Context, since, until time.Time) ([]Usage, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time, status, client_key, input_tokens, output_tokens FROM logs WHERE status >= 200 AND status < 400`)
+	if err != nil {
+		logger.Errorf("query usage failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	agg := newUsageAgg(since, until)
+	for rows.Next() {
+		var rl RequestLog
+		if err := rows.Scan(&rl.Time, &rl.Status, &rl.ClientKey, &rl.InputTokens, &rl.OutputTokens); err != nil {
+			logger.Errorf("scan usage row failed: %v", err)
+			return nil, err
+		}
+		agg.add(&rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate usage failed: %v", err)
+		return nil, err
+	}
+	return agg.result(), nil
+}
+
+type usageBucket struct {
+	day int64
+	key string
+}
+
+// usageAgg computes Usage from the logs passed to add.
+type usageAgg struct {
+	since, until time.Time
+	m            map[usageBucket]*Usage
+}
+
+func newUsageAgg(since, until time.Time) *usageAgg {
+	return &usageAgg{since: since, until: until, m: make(map[usageBucket]*Usage)}
+}
+
+func (g *usageAgg) add(rl *RequestLog) {
+	if rl.Status < 200 || rl.Status >= 400 || rl.Time.Before(g.since) || !rl.Time.Before(g.until) {
+		return
+	}
+	day := rl.Time.UTC().Truncate(24 * time.Hour)
+	b := usageBucket{day.Unix(), rl.ClientKey}
+	cur := g.m[b]
+	if cur == nil {
+		cur = &Usage{Day: day, ClientKey: rl.ClientKey}
+		g.m[b] = cur
+	}
+	cur.Requests++
+	cur.InputTokens += rl.InputTokens
+	cur.OutputTokens += rl.OutputTokens
+}
+
+func (g *usageAgg) result() []Usage {
+	res := make([]Usage, 0, len(g.m))
+	for _, u := range g.m {
+		res = append(res, *u)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Day.Equal(res[j].Day) {
+			return res[i].Day.Before(res[j].Day)
+		}
+		return res[i].ClientKey < res[j].ClientKey
+	})
+	return res
+}
+
+// ModelStats aggregates the attempts logged for one model. CostUSD is left
+// for the caller to fill in from a price table.
+type ModelStats struct {
+	Model        string  `json:"model"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	// EstimatedTokens sums the estimated input of every attempt, failed
+	// ones included, whose usage the upstream may not have reported.
+	EstimatedTokens int64 `json:"estimated_tokens"`
+}
+
+// ModelStats aggregates every attempt logged since the given time per
+// requested model, busiest model first. Transport errors and responses with
+// status 400 or above count as errors.
+func (s *Store) ModelStats(ctx context.Context, since time.Time) ([]ModelStats, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time, model, status, COALESCE(error,''), input_tokens, output_tokens, estimated_tokens FROM logs`)
+	if err != nil {
+		logger.Errorf("query model stats failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	agg := newModelAgg(since)
+	for rows.Next() {
+		var rl RequestLog
+		if err := rows.Scan(&rl.Time, &rl.Model, &rl.Status, &rl.Error, &rl.InputTokens, &rl.OutputTokens, &rl.EstimatedTokens); err != nil {
+			logger.Errorf("scan model stats row failed: %v", err)
+			return nil, err
+		}
+		agg.add(&rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate model stats failed: %v", err)
+		return nil, err
+	}
+	return agg.result(), nil
+}
+
+// failed reports whether rl counts as an error in the statistics.
+func failed(rl *RequestLog) bool {
+	return rl.Status == 0 || rl.Status >= 400 || rl.Error != ""
+}
+
+// modelAgg computes ModelStats from the logs passed to add.
+type modelAgg struct {
+	since time.Time
+	m     map[string]*ModelStats
+}
+
+func newModelAgg(since time.Time) *modelAgg {
+	return &modelAgg{since: since, m: make(map[string]*ModelStats)}
+}
+
+func (g *modelAgg) add(rl *RequestLog) {
+	if rl.Time.Before(g.since) {
+		return
+	}
+	m := g.m[rl.Model]
+	if m == nil {
+		m = &ModelStats{Model: rl.Model}
+		g.m[rl.Model] = m
+	}
+	m.Requests++
+	if failed(rl) {
+		m.Errors++
+	}
+	m.InputTokens += rl.InputTokens
+	m.OutputTokens += rl.OutputTokens
+	m.EstimatedTokens += rl.EstimatedTokens
+}
+
+func (g *modelAgg) result() []ModelStats {
+	res := make([]ModelStats, 0, len(g.m))
+	for _, m := range g.m {
+		m.ErrorRate = float64(m.Errors) / float64(m.Requests)
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Requests != res[j].Requests {
+			return res[i].Requests > res[j].Requests
+		}
+		return res[i].Model < res[j].Model
+	})
+	return res
+}
+
+// CacheStats is the prompt cache use of one account. HitRatio is the share
+// of input tokens read from the cache.
+type CacheStats struct {
+	AccountID    int64   `json:"account_id"`
+	Requests     int64   `json:"requests"`
+	InputTokens  int64   `json:"input_tokens"`
+	CachedTokens int64   `json:"cached_tokens"`
+	HitRatio     float64 `json:"hit_ratio"`
+}
+
+// CacheStats aggregates the successful requests logged since the given time
+// per account, ordered by account ID.
+func (s *Store) CacheStats(ctx context.Context, since time.Time) ([]CacheStats, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time, status, account_id, input_tokens, cached_tokens FROM logs WHERE status >= 200 AND status < 400`)
+	if err != nil {
+		logger.Errorf("query cache stats failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	agg := newCacheAgg(since)
+	for rows.Next() {
+		var rl RequestLog
+		if err := rows.Scan(&rl.Time, &rl.Status, &rl.AccountID, &rl.InputTokens, &rl.CachedTokens); err != nil {
+			logger.Errorf("scan cache stats row failed: %v", err)
+			return nil, err
+		}
+		agg.add(&rl)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("iterate cache stats failed: %v", err)
+		return nil, err
+	}
+	return agg.result(), nil
+}
+
+// cacheAgg computes CacheStats from the logs passed to add.
+type cacheAgg struct {
+	since time.Time
+	m     map[int64]*CacheStats
+}
+
+func newCacheAgg(since time.Time) *cacheAgg {
+	return &cacheAgg{since: since, m: make(map[int64]*CacheStats)}
+}
+
+func (g *cacheAgg) add(rl *RequestLog) {
+	if rl.Status < 200 || rl.Status >= 400 || rl.Time.Before(g.since) {
+		return
+	}
+	c := g.m[rl.AccountID]
+	if c == nil {
+		c = &CacheStats{AccountID: rl.AccountID}
+		g.m[rl.AccountID] = c
+	}
+	c.Requests++
+	c.InputTokens += rl.InputTokens
+	c.CachedTokens += rl.CachedTokens
+}
+
+func (g *cacheAgg) result() []CacheStats {
+	res := make([]CacheStats, 0, len(g.m))
+	for _, c := range g.m {
+		if c.InputTokens > 0 {
+			c.HitRatio = float64(c.CachedTokens) / float64(c.InputTokens)
+		}
+		res = append(res, *c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].AccountID < res[j].AccountID })
+	return res
+}
+
+// ClientRequests returns the latest n attempts made for a client key, newest
+// first. Only metadata is loaded: headers, bodies and error texts may carry
+// upstream account details and are left empty.
+func (s *Store) ClientRequests(ctx context.Context, clientKey string, n int) ([]*RequestLog, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, time, method, url, status, COALESCE(duration_ms,0), model, input_tokens, output_tokens FROM logs WHERE client_key=? ORDER BY id DESC LIMIT ?`, clientKey, n)
+	if err != nil {
+		logger.Errorf("query client requests failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []*RequestLog{}
+	for rows.Next() {
+		rl := &RequestLog{ClientKey: clientKey}
+		if err := rows.Scan(&rl.ID, &rl.Time, &rl.Method, &rl.URL, &rl.Status, &rl.DurationMs, &rl.Model, &rl.InputTokens, &rl.OutputTokens); err != nil {
+			logger.Errorf("scan client request failed: %v", err)
+			return nil, err
+		}
+		res = append(res, rl)
+	}
+	return res, rows.Err()
+}
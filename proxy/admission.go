@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+)
+
+// Admission caps the client requests the proxy handles at once, so that a
+// burst queues up in front of the single process and its database instead
+// of piling up inside it. Requests beyond the cap wait in a bounded queue
+// for a slot; once the queue is full, or a request waited too long, it is
+// rejected with 429 and a Retry-After. Create it with NewAdmission.
+type Admission struct {
+	// Wait is how long a queued request waits for a slot.
+	Wait time.Duration
+
+	slots chan struct{}
+	queue chan struct{}
+}
+
+var (
+	admissionInflight = metrics.Default.NewGauge("companion_inflight_requests", "Client requests being handled, by whether they hold a slot or wait for one.", "state")
+	admissionRejected = metrics.Default.NewCounter("companion_admission_rejected_total", "Client requests rejected by the global in-flight cap, by reason.", "reason")
+)
+
+// NewAdmission lets max requests be handled at once and up to queue more
+// wait for a slot for up to wait.
+func NewAdmission(max, queue int, wait time.Duration) *Admission {
+	return &Admission{Wait: wait, slots: make(chan struct{}, max), queue: make(chan struct{}, queue)}
+}
+
+// acquire takes a slot, waiting in the queue if all are taken. It returns
+// the reason the request was turned away, or "" with the slot held.
+func (a *Admission) acquire(ctx context.Context) string {
+	select {
+	case a.slots <- struct{}{}:
+		return ""
+	default:
+	}
+	select {
+	case a.queue <- struct{}{}:
+	default:
+		return "queue_full"
+	}
+	admissionInflight.Add(1, "queued")
+	defer func() {
+		<-a.queue
+		admissionInflight.Add(-1, "queued")
+	}()
+	t := time.NewTimer(a.Wait)
+	defer t.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return ""
+	case <-t.C:
+		return "timeout"
+	case <-ctx.Done():
+		return "canceled"
+	}
+}
+
+func (a *Admission) release() { <-a.slots }
+
+// retryAfter is the Retry-After of rejected requests in seconds: the
+// queue wait, as a burst is expected to have drained by then.
+func (a *Admission) retryAfter() int64 {
+	return max(1, int64(math.Ceil(a.Wait.Seconds())))
+}
+
+// admission holds requests to the Admission cap. Upgrades, such as
+// Realtime sessions, are not counted: they would hold a slot for as long
+// as the session lasts.
+func (h *Handler) admission(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := h.Admission
+		if a == nil || upgradeType(r.Header) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch reason := a.acquire(r.Context()); reason {
+		case "":
+		case "canceled":
+			// The client left, or its X-Request-Timeout ended, while
+			// waiting.
+			admissionRejected.Inc(reason)
+			fail(w, RequestFrom(r), http.StatusGatewayTimeout, "request timeout", r.Context().Err())
+			return
+		default:
+			admissionRejected.Inc(reason)
+			logger.Warnc(r.Context(), "request rejected by the in-flight cap: %s", reason)
+			secs := a.retryAfter()
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+			writeError(w, http.StatusTooManyRequests, map[string]any{
+				"message":     "too many requests in flight, retry later",
+				"type":        "rate_limit_error",
+				"code":        "server_busy",
+				"retry_after": secs,
+			})
+			return
+		}
+		admissionInflight.Add(1, "handling")
+		defer func() {
+			a.release()
+			admissionInflight.Add(-1, "handling")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	h.Admission = NewAdmission(1, 1, 50*time.Millisecond)
+	send := func(ctx context.Context) chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil).WithContext(ctx))
+			done <- rec
+		}()
+		return done
+	}
+
+	// The first request holds the slot; the second waits in the queue
+	// until it times out, while the third finds the queue full.
+	first := send(context.Background())
+	<-started
+	queued := send(context.Background())
+	for deadline := time.Now().Add(time.Second); len(h.Admission.queue) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("second request not queued")
+		}
+	}
+	rec := <-send(context.Background())
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with a full queue, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := <-queued; rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after the wait, got %d", rec.Code)
+	}
+
+	// A queued request gets the slot once it is free.
+	h.Admission.Wait = time.Minute
+	queued = send(context.Background())
+	for len(h.Admission.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+	if rec := <-first; rec.Code != http.StatusOK {
+		t.Fatalf("first request got %d", rec.Code)
+	}
+	<-started
+	release <- struct{}{}
+	if rec := <-queued; rec.Code != http.StatusOK {
+		t.Fatalf("queued request got %d", rec.Code)
+	}
+
+	// A client leaving while queued does not wait for the slot.
+	blocking := send(context.Background())
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := send(ctx)
+	for len(h.Admission.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if rec := <-gone; rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 for the canceled request, got %d", rec.Code)
+	}
+	close(release)
+	<-blocking
+	if len(h.Admission.slots) != 0 || len(h.Admission.queue) != 0 {
+		t.Fatalf("%d slots and %d queue places still taken", len(h.Admission.slots), len(h.Admission.queue))
+	}
+}
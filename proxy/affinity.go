@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+// AffinitySelector is optionally implemented by a Selector that can prefer
+// one account. The proxy uses it to send requests sharing a prompt cache key
+// to the account whose upstream cache already holds their prefix.
+type AffinitySelector interface {
+	NextFor(ctx context.Context, exclude map[int64]bool, preferred int64) (*acct.Account, error)
+}
+
+// maxPins bounds the cache keys remembered for CacheAffinity.
+const maxPins = 10000
+
+// pins remembers which account last served each prompt cache key.
+type pins struct {
+	mu sync.Mutex
+	m  map[string]pin
+}
+
+type pin struct {
+	account int64
+	until   time.Time
+}
+
+func (p *pins) get(key string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.m[key]; ok && time.Now().Before(e.until) {
+		return e.account
+	}
+	return 0
+}
+
+func (p *pins) set(key string, account int64, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.m == nil {
+		p.m = make(map[string]pin)
+	}
+	if len(p.m) >= maxPins {
+		for k, e := range p.m {
+			if now.After(e.until) {
+				delete(p.m, k)
+			}
+		}
+		if len(p.m) >= maxPins {
+			p.m = make(map[string]pin)
+		}
+	}
+	p.m[key] = pin{account, now.Add(ttl)}
+}
+
+// cacheKey returns the key under which the upstream caches the prompt of a
+// request: the body's prompt_cache_key, else the Codex CLI's session_id
+// header. It is empty when the request has neither.
+func cacheKey(r *http.Request, body []byte) string {
+	var m struct {
+		PromptCacheKey string `json:"prompt_cache_key"`
+	}
+	if json.Unmarshal(body, &m) == nil && m.PromptCacheKey != "" {
+		return m.PromptCacheKey
+	}
+	return r.Header.Get("session_id")
+}
+
+// next asks the Selector for an account, preferring the one pinned to the
+// request's cache key when CacheAffinity is enabled.
+func (h *Handler) next(ctx context.Context, exclude map[int64]bool, key string) (*acct.Account, error) {
+	if as, ok := h.Scheduler.(AffinitySelector); ok && key != "" {
+		if id := h.pins.get(key); id != 0 {
+			return as.NextFor(ctx, exclude, id)
+		}
+	}
+	return h.Scheduler.Next(ctx, exclude)
+}
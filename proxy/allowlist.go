@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// allowedPrefixes are the Codex API paths forwarded upstream.
+var allowedPrefixes = []string{"/v1/responses", "/v1/chat/completions", "/v1/models", "/v1/realtime", "/v1/embeddings", "/v1/images/generations", "/v1/images/edits", "/v1/audio/transcriptions", "/v1/audio/speech"}
+
+// apiKeyOnlyPaths are the allowed paths the ChatGPT backend does not
+// serve.
+var apiKeyOnlyPaths = mustCompilePathPatterns("/v1/embeddings**", "/v1/images/**", "/v1/audio/**")
+
+// apiKeyOnly reports whether path is served by the API only, not by the
+// ChatGPT backend, so that only API key accounts can take the request.
+func apiKeyOnly(path string) bool {
+	for _, p := range apiKeyOnlyPaths {
+		if p.match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathPattern is a compiled path pattern. Patterns without wildcards, or
+// with a single trailing "**", are compared as strings; others are
+// matched by a regular expression.
+type pathPattern struct {
+	literal string
+	prefix  bool
+	re      *regexp.Regexp
+}
+
+// compilePathPattern compiles a glob pattern, in which "*" matches within a
+// path segment, "?" one character of it and "**" anything, or a regular
+// expression prefixed with "~". Either must match the whole path.
+func compilePathPattern(s string) (pathPattern, error) {
+	if expr, ok := strings.CutPrefix(s, "~"); ok {
+		re, err := regexp.Compile(`^(?:` + expr + `)$`)
+		return pathPattern{re: re}, err
+	}
+	if !strings.HasPrefix(s, "/") {
+		return pathPattern{}, fmt.Errorf("pattern must start with / or ~")
+	}
+	if lit := strings.TrimSuffix(s, "**"); !strings.ContainsAny(lit, "*?") {
+		return pathPattern{literal: lit, prefix: len(lit) < len(s)}, nil
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case s[i] == '*':
+			b.WriteString("[^/]*")
+		case s[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return pathPattern{re: regexp.MustCompile(b.String())}, nil
+}
+
+func mustCompilePathPatterns(patterns ...string) []pathPattern {
+	res := make([]pathPattern, len(patterns))
+	for i, s := range patterns {
+		p, err := compilePathPattern(s)
+		if err != nil {
+			panic(err)
+		}
+		res[i] = p
+	}
+	return res
+}
+
+func (p pathPattern) match(path string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(path)
+	case p.prefix:
+		return strings.HasPrefix(path, p.literal)
+	default:
+		return path == p.literal
+	}
+}
+
+// pathRule allows or denies the requests whose method is one of methods,
+// or any method when there are none, and whose path matches pattern.
+type pathRule struct {
+	text    string
+	allow   bool
+	methods []string
+	pattern pathPattern
+}
+
+// PathRules decides which client requests the allowlist stage passes on,
+// by method and path. The first matching rule wins; requests no rule
+// matches are denied. Rules are indexed by method when compiled, so a
+// request is only checked against the rules that can apply to it.
+type PathRules struct {
+	// byMethod holds, for every method named by a rule, the rules that
+	// apply to it in order; other methods use anyMethod.
+	byMethod  map[string][]*pathRule
+	anyMethod []*pathRule
+}
+
+// defaultPathRules forward the Codex API paths, see ParsePathRules.
+var defaultPathRules, _ = ParsePathRules("")
+
+// ParsePathRules reads a comma-separated list of rules of the form
+// "allow|deny [METHOD|METHOD] PATTERN", such as
+// "deny DELETE /**,allow GET /v1/files/*". Patterns are globs or "~"
+// regular expressions, see compilePathPattern; regular expressions cannot
+// contain commas. The rules are checked after one denying /admin, which
+// cannot be overridden, and before the defaults allowing the Codex API
+// paths, so an empty list forwards exactly those.
+func ParsePathRules(s string) (*PathRules, error) {
+	entries := []string{"deny /admin**"}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			entries = append(entries, part)
+		}
+	}
+	for _, p := range allowedPrefixes {
+		entries = append(entries, "allow "+p+"**")
+	}
+	var rules []*pathRule
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 || len(fields) > 3 || fields[0] != "allow" && fields[0] != "deny" {
+			return nil, fmt.Errorf("path rule %q: expected allow|deny [methods] pattern", entry)
+		}
+		rule := &pathRule{text: entry, allow: fields[0] == "allow"}
+		if len(fields) == 3 {
+			for _, m := range strings.Split(fields[1], "|") {
+				if m = strings.ToUpper(strings.TrimSpace(m)); m != "" && m != "*" {
+					rule.methods = append(rule.methods, m)
+				}
+			}
+		}
+		var err error
+		if rule.pattern, err = compilePathPattern(fields[len(fields)-1]); err != nil {
+			return nil, fmt.Errorf("path rule %q: %w", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	res := &PathRules{byMethod: make(map[string][]*pathRule)}
+	for _, rule := range rules {
+		if len(rule.methods) == 0 {
+			res.anyMethod = append(res.anyMethod, rule)
+		}
+		for _, m := range rule.methods {
+			res.byMethod[m] = nil
+		}
+	}
+	for m := range res.byMethod {
+		for _, rule := range rules {
+			if len(rule.methods) == 0 || slices.Contains(rule.methods, m) {
+				res.byMethod[m] = append(res.byMethod[m], rule)
+			}
+		}
+	}
+	return res, nil
+}
+
+// match returns the first rule matching a request, or nil.
+func (p *PathRules) match(method, path string) *pathRule {
+	rules, ok := p.byMethod[method]
+	if !ok {
+		rules = p.anyMethod
+	}
+	for _, rule := range rules {
+		if rule.pattern.match(path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether a request with method and path is forwarded.
+func (p *PathRules) Allowed(method, path string) bool {
+	rule := p.match(method, path)
+	return rule != nil && rule.allow
+}
+
+// allowlist rejects requests the PathRules deny, admin and non-Codex paths
+// by default, with 404 without contacting the upstream.
+func (h *Handler) allowlist(next http.Handler) http.Handler {
+	rules := h.PathRules
+	if rules == nil {
+		rules = defaultPathRules
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := rules.match(r.Method, r.URL.Path)
+		if rule != nil && rule.allow {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rule != nil {
+			logger.Warnc(r.Context(), "blocked %s %s by path rule %q", r.Method, r.URL.Path, rule.text)
+		} else {
+			logger.Warnc(r.Context(), "blocked path %s", r.URL.Path)
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// readBody reads the client body into the ProxyRequest so it can be logged
+// and replayed on every attempt. A gzip-compressed body is decompressed and
+// its Content-Encoding dropped, so that normalization, hooks and logging
+// see the JSON and the upstream is sent the plain body.
+func (h *Handler) readBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr := RequestFrom(r)
+		if r.Body != nil {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.Warnc(r.Context(), "read request body: %v", err)
+			}
+			if err := r.Body.Close(); err != nil {
+				logger.Warnc(r.Context(), "close request body: %v", err)
+			}
+			if len(body) > 0 && gzipEncoded(r.Header) {
+				if body, err = gunzipBody(body); err != nil {
+					logger.Warnc(r.Context(), "decompress request body: %v", err)
+					writeError(w, http.StatusBadRequest, map[string]any{
+						"message": "invalid gzip request body: " + err.Error(),
+						"type":    "invalid_request_error",
+					})
+					return
+				}
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+			}
+			pr.Body = body
+		}
+		next.ServeHTTP(w, r)
+	})
+}
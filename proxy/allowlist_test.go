@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePathRules(t *testing.T) {
+	rules, err := ParsePathRules(" deny DELETE /** , allow get|head /v1/files/*, deny ~/v1/models/o[0-9].* ,allow /v1/vector_stores/**/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method, path string
+		want         bool
+	}{
+		{"POST", "/v1/responses", true},
+		{"GET", "/v1/responses/resp_1", true},
+		{"GET", "/v1/models", true},
+		{"GET", "/v1/models/o3", false},
+		{"GET", "/v1/models/gpt-5", true},
+		{"DELETE", "/v1/responses/resp_1", false},
+		{"GET", "/v1/files/file_1", true},
+		{"HEAD", "/v1/files/file_1", true},
+		{"POST", "/v1/files/file_1", false},
+		{"GET", "/v1/files/file_1/content", false},
+		{"POST", "/v1/vector_stores/vs_1/files", true},
+		{"GET", "/admin/api/accounts", false},
+		{"GET", "/other", false},
+	} {
+		if got := rules.Allowed(c.method, c.path); got != c.want {
+			t.Errorf("%s %s allowed %v, want %v", c.method, c.path, got, c.want)
+		}
+	}
+	// The admin rule comes first.
+	if rules, _ := ParsePathRules("allow /**"); rules.Allowed("GET", "/admin") || !rules.Allowed("GET", "/anything") {
+		t.Fatal("unexpected catch-all rules")
+	}
+	for _, bad := range []string{"permit /v1/files", "allow", "allow GET POST /x", "allow v1/files", "deny ~(", "allow GET /a extra"} {
+		if _, err := ParsePathRules(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestPathRulesAllowlist(t *testing.T) {
+	calls := 0
+	h, _, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+	h.PathRules, _ = ParsePathRules("deny DELETE /**")
+	req := httptest.NewRequest("DELETE", "http://localhost/v1/responses/resp_1", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound || calls != 0 {
+		t.Fatalf("expected 404 without upstream call, got %d after %d calls", rec.Code, calls)
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Annotation sets a string field of the Responses API and Chat Completions
+// bodies sent to accounts of a type, such as "user", "safety_identifier" or
+// "metadata.deployment", so the usage dashboards of an upstream shared with
+// others can attribute the traffic of this deployment or of its clients.
+type Annotation struct {
+	// AccountType is "apikey", "chatgpt" or "*" for both.
+	AccountType string
+	Field       string
+	// Value is the value set; "{client}" in it expands to the ClientKeyID
+	// of the request, or "anonymous".
+	Value string
+}
+
+// ParseAnnotations parses a semicolon-separated list of annotations in the
+// form type:field=value, e.g. `apikey:safety_identifier=team-a/{client}`.
+func ParseAnnotations(s string) ([]Annotation, error) {
+	var res []Annotation
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("annotation %q: want type:field=value", part)
+		}
+		var a Annotation
+		if a.AccountType, a.Field, ok = strings.Cut(key, ":"); !ok || a.Field == "" {
+			return nil, fmt.Errorf("annotation %q: want type:field", part)
+		}
+		switch a.AccountType {
+		case "apikey", "chatgpt", "*":
+		default:
+			return nil, fmt.Errorf("annotation %q: unknown account type %q", part, a.AccountType)
+		}
+		a.Value = val
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+// annotate is the built-in upstream middleware applying Annotations, which
+// replace the values clients set. Other endpoints reject unknown fields.
+func (h *Handler) annotate(at *Attempt) error {
+	if len(h.Annotations) == 0 || isForm(at.Request.Header) ||
+		!strings.HasPrefix(at.Endpoint, "/v1/responses") && !strings.HasPrefix(at.Endpoint, "/v1/chat/completions") {
+		return nil
+	}
+	client := at.ClientKey
+	if client == "" {
+		client = "anonymous"
+	}
+	// Annotations are set through field policies, which resolve a policy
+	// for the account type against a "*" one.
+	policies := make([]FieldPolicy, 0, len(h.Annotations))
+	for _, a := range h.Annotations {
+		v, _ := json.Marshal(strings.ReplaceAll(a.Value, "{client}", client))
+		policies = append(policies, FieldPolicy{AccountType: a.AccountType, Field: a.Field, Action: FieldSet, Value: v})
+	}
+	at.UpstreamBody = applyFieldPolicies(policies, at.Account.Type, at.UpstreamBody)
+	return nil
+}
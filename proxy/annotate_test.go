@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	as, err := ParseAnnotations(` apikey:safety_identifier=team-a/{client}; *:metadata.deployment=prod `)
+	if err != nil || len(as) != 2 {
+		t.Fatalf("parse: %v %+v", err, as)
+	}
+	if as[1].AccountType != "*" || as[1].Field != "metadata.deployment" || as[1].Value != "prod" {
+		t.Fatalf("unexpected annotation %+v", as[1])
+	}
+	for _, bad := range []string{"user=x", "team:user=x", "apikey:user", "apikey:user=", "apikey:=x"} {
+		if _, err := ParseAnnotations(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	var bodies []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+	})
+	h.Annotations, _ = ParseAnnotations("*:user=prod/{client};chatgpt:user=never;apikey:metadata.deployment=prod")
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	send := func(path, token, body string) {
+		req := httptest.NewRequest("POST", "http://localhost"+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("/v1/responses", "client-secret", `{"model":"gpt-5","user":"spoofed"}`)
+	send("/v1/chat/completions", "", `{"model":"gpt-5"}`)
+	send("/v1/embeddings", "client-secret", `{"model":"e"}`)
+	want := []string{
+		`{"metadata":{"deployment":"prod"},"model":"gpt-5","store":true,"user":"prod/` + ClientKeyID("client-secret") + `"}`,
+		`{"metadata":{"deployment":"prod"},"model":"gpt-5","store":true,"user":"prod/anonymous"}`,
+		`{"model":"e"}`,
+	}
+	if len(bodies) != len(want) {
+		t.Fatalf("upstream bodies %q", bodies)
+	}
+	for i, w := range want {
+		if bodies[i] != w {
+			t.Errorf("body %d: got %s, want %s", i, bodies[i], w)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// clientKeyDigits is the number of hex digits of a ClientKeyID: 128 bits,
+// so that no two tokens share the ID their authorization, limits and cached
+// responses go by.
+const clientKeyDigits = 32
+
+// ClientKeyID returns the identifier recorded for a client bearer token: the
+// first 32 hex digits of its SHA-256, prefixed with "ck-". The token itself
+// is never stored. An empty token yields an empty ID.
+func ClientKeyID(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "ck-" + hex.EncodeToString(sum[:])[:clientKeyDigits]
+}
+
+// CheckClientKeyID returns an error unless id has the form ClientKeyID
+// returns. Configured IDs are checked so that one of the 12 digits used
+// before, which no request matches any more, is not silently ignored.
+func CheckClientKeyID(id string) error {
+	digits, ok := strings.CutPrefix(id, "ck-")
+	if _, err := hex.DecodeString(digits); ok && err == nil && len(digits) == clientKeyDigits {
+		return nil
+	}
+	if ok && len(digits) == 12 {
+		return fmt.Errorf("client key ID %s has the 12 hex digits of earlier versions; take the %d-digit ID from the client portal", id, clientKeyDigits)
+	}
+	return fmt.Errorf("client key ID %q: expected ck- and %d hex digits", id, clientKeyDigits)
+}
+
+// ClientKeyFrom returns the ClientKeyID of the bearer token presented by r,
+// or "" when there is none.
+func ClientKeyFrom(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ClientKeyID(strings.TrimSpace(token))
+}
+
+// auth identifies the client by the bearer token it presents so usage can be
+// attributed to it. Requests without a token are served anonymously.
+func (h *Handler) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RequestFrom(r).ClientKey = ClientKeyFrom(r)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientKeyID(t *testing.T) {
+	id := ClientKeyID("client-secret")
+	if len(id) != len("ck-")+32 || id != ClientKeyID("client-secret") || id == ClientKeyID("client-secret2") {
+		t.Fatalf("unexpected ID %q", id)
+	}
+	if ClientKeyID("") != "" {
+		t.Fatal("empty token has an ID")
+	}
+	if err := CheckClientKeyID(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckClientKeyID(id[:15]); err == nil || !strings.Contains(err.Error(), "12 hex digits") {
+		t.Fatalf("expected a hint for the old ID length, got %v", err)
+	}
+	for _, bad := range []string{"", "ck-", id[3:], id + "0", "ck-" + strings.Repeat("g", 32)} {
+		if err := CheckClientKeyID(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/log"
+)
+
+// BandwidthSource reports the traffic of the logged attempts, letting
+// BandwidthCaps count the current month from before a restart. *log.Store
+// implements it.
+type BandwidthSource interface {
+	Bandwidth(ctx context.Context, since time.Time) (log.Bandwidth, error)
+}
+
+var _ BandwidthSource = (*log.Store)(nil)
+
+// byteUnits are the suffixes ParseBandwidthCaps accepts, longest first.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// parseBytes reads a size such as "50GB" or "512MB". Units are powers of
+// 1024; a plain number counts bytes.
+func parseBytes(s string) (int64, error) {
+	num, unit := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// ParseBandwidthCaps reads a comma-separated list of monthly bandwidth
+// caps, such as "200GB,ck-0123456789abcdef0123456789abcdef=10GB". An entry
+// without a key caps the traffic of the whole deployment and is stored under
+// the empty key; the others cap client key IDs.
+func ParseBandwidthCaps(s string) (map[string]int64, error) {
+	caps := make(map[string]int64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			key, val = "", part
+		} else if key = strings.TrimSpace(key); key == "" {
+			return nil, fmt.Errorf("bandwidth cap %q: expected key=size", part)
+		} else if err := CheckClientKeyID(key); err != nil {
+			return nil, fmt.Errorf("bandwidth cap %q: %w", part, err)
+		}
+		n, err := parseBytes(val)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth cap %q: %w", part, err)
+		}
+		caps[key] = n
+	}
+	return caps, nil
+}
+
+// monthStart returns the start of the calendar month (UTC) of t.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// meter counts the bytes exchanged with the upstream in the current month,
+// in total and per client key.
+type meter struct {
+	mu      sync.Mutex
+	month   time.Time
+	loaded  bool
+	total   int64
+	clients map[string]int64
+}
+
+// roll starts counting afresh when the month of now differs from the one
+// counted. The caller holds mu.
+func (m *meter) roll(now time.Time) {
+	if start := monthStart(now); !start.Equal(m.month) {
+		m.month, m.total, m.clients = start, 0, make(map[string]int64)
+	}
+}
+
+// add counts the traffic of a logged attempt, once the month was loaded.
+func (m *meter) add(rl *log.RequestLog) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.loaded {
+		return
+	}
+	m.roll(time.Now())
+	n := int64(rl.ReqSize + rl.RespSize)
+	m.total += n
+	m.clients[rl.ClientKey] += n
+}
+
+// usage returns the bytes of the current month in total and for clientKey.
+// The first call loads the traffic already logged this month from src.
+func (m *meter) usage(ctx context.Context, src BandwidthSource, clientKey string) (total, client int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.roll(now)
+	if !m.loaded {
+		m.loaded = true
+		if src != nil {
+			bw, err := src.Bandwidth(ctx, m.month)
+			if err != nil {
+				logger.Errorc(ctx, "load bandwidth of the month: %v", err)
+			}
+			m.total = bw.Total.Bytes()
+			for _, c := range bw.Clients {
+				m.clients[c.ClientKey] = c.Bytes()
+			}
+		}
+	}
+	return m.total, m.clients[clientKey]
+}
+
+// limits rejects requests with 429 once the month's traffic reached one of
+// the BandwidthCaps, the deployment's or the client key's, until the month
+// ends. Requests under way when a cap is reached are not interrupted.
+func (h *Handler) limits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(h.BandwidthCaps) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pr := RequestFrom(r)
+		src, _ := h.Log.(BandwidthSource)
+		total, client := h.meter.usage(r.Context(), src, pr.ClientKey)
+		limit := int64(-1)
+		if c, ok := h.BandwidthCaps[""]; ok && total >= c {
+			limit = c
+		}
+		if c, ok := h.BandwidthCaps[pr.ClientKey]; ok && pr.ClientKey != "" && client >= c {
+			limit = c
+		}
+		if limit < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Warnc(r.Context(), "monthly bandwidth cap of %d bytes reached for client %q", limit, pr.ClientKey)
+		reset := monthStart(time.Now()).AddDate(0, 1, 0)
+		secs := int64(time.Until(reset).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		writeError(w, http.StatusTooManyRequests, map[string]any{
+			"message":     "monthly bandwidth cap reached",
+			"type":        "rate_limit_error",
+			"code":        "bandwidth_cap_exceeded",
+			"retry_after": secs,
+			"reset_at":    reset.Format(time.RFC3339),
+		})
+	})
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+func TestParseBandwidthCaps(t *testing.T) {
+	a, b := ClientKeyID("a"), ClientKeyID("b")
+	caps, err := ParseBandwidthCaps(" 200GB, " + a + "=1.5mb ," + b + "=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 3 || caps[""] != 200<<30 || caps[a] != 3<<19 || caps[b] != 4096 {
+		t.Fatalf("unexpected caps %v", caps)
+	}
+	for _, bad := range []string{"=1GB", a + "=", a + "=lots", "0", "-1GB", "ck-0123456789ab=1GB"} {
+		if _, err := ParseBandwidthCaps(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestBandwidthCaps(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 200))
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	// Traffic logged this month before the handler started counts.
+	ls.Insert(ctx, &logpkg.RequestLog{Time: time.Now(), ClientKey: ClientKeyID("old"), RespSize: 1000})
+	h.BandwidthCaps = map[string]int64{ClientKeyID("heavy"): 100, ClientKeyID("old"): 500}
+	send := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := send("old"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), "bandwidth_cap_exceeded") {
+		t.Fatalf("expected the logged traffic to count, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := send("heavy"); rec.Code != http.StatusOK {
+		t.Fatalf("first request rejected: %d", rec.Code)
+	}
+	if rec := send("heavy"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the cap to be reached, got %d", rec.Code)
+	}
+	if rec := send("light"); rec.Code != http.StatusOK {
+		t.Fatalf("uncapped client rejected: %d", rec.Code)
+	}
+
+	// The deployment's cap covers every client.
+	h.BandwidthCaps[""] = 1400
+	if rec := send("light"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the total cap to be reached, got %d", rec.Code)
+	}
+}
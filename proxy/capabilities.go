@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+// ProbeCapabilities finds out which features the upstream of the API key
+// account a supports, such as a relay behind a custom base URL, with tiny
+// requests: the Responses API and Chat Completions, then streaming and a
+// function tool on the first of them that works. A request rejected with
+// 400, 404, 405, 422 or 501 marks its feature unsupported, unless the error
+// is about the probe model; that and any other failure, such as a rate
+// limit, aborts the probe, as it says nothing about the feature.
+func (h *Handler) ProbeCapabilities(ctx context.Context, a *acct.Account) (*acct.Capabilities, error) {
+	if a.Type != acct.APIKeyAccount {
+		return nil, errors.New("capability probes are for API key accounts")
+	}
+	model := h.WarmupModel
+	if model == "" {
+		model = DefaultWarmupModel
+	}
+	requests := map[string]func(stream, tools bool) map[string]any{
+		"/v1/responses": func(stream, tools bool) map[string]any {
+			m := map[string]any{"model": model, "instructions": "Reply with one word.", "input": "ping", "max_output_tokens": 16}
+			if stream {
+				m["stream"] = true
+			}
+			if tools {
+				m["tools"] = []map[string]any{{"type": "function", "name": "ping", "description": "Does nothing.", "parameters": map[string]any{"type": "object", "properties": map[string]any{}}}}
+			}
+			return m
+		},
+		"/v1/chat/completions": func(stream, tools bool) map[string]any {
+			m := map[string]any{"model": model, "messages": []map[string]any{{"role": "system", "content": "Reply with one word."}, {"role": "user", "content": "ping"}}}
+			if stream {
+				m["stream"] = true
+			}
+			if tools {
+				m["tools"] = []map[string]any{{"type": "function", "function": map[string]any{"name": "ping", "description": "Does nothing.", "parameters": map[string]any{"type": "object", "properties": map[string]any{}}}}}
+			}
+			return m
+		},
+	}
+	c := &acct.Capabilities{ProbedAt: time.Now()}
+	var err error
+	if c.Responses, err = h.probeFeature(ctx, a, "/v1/responses", requests["/v1/responses"](false, false), false); err != nil {
+		return nil, err
+	}
+	if c.ChatCompletions, err = h.probeFeature(ctx, a, "/v1/chat/completions", requests["/v1/chat/completions"](false, false), false); err != nil {
+		return nil, err
+	}
+	path := "/v1/responses"
+	switch {
+	case c.Responses:
+	case c.ChatCompletions:
+		path = "/v1/chat/completions"
+	default:
+		return c, nil
+	}
+	if c.Streaming, err = h.probeFeature(ctx, a, path, requests[path](true, false), true); err != nil {
+		return nil, err
+	}
+	if c.Tools, err = h.probeFeature(ctx, a, path, requests[path](false, true), false); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// probeFeature sends the request m to path with a's credentials and
+// reports whether it was served, as an event stream when stream is set.
+func (h *Handler) probeFeature(ctx context.Context, a *acct.Account, path string, m map[string]any, stream bool) (bool, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	body = normalizeBody(a, path, body)
+	base, upstreamPath := h.upstreamTarget(a, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+upstreamPath, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setCredentials(req.Header, a)
+	client, err := h.client(a)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// Read the short answer to the end so the connection can be reused.
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		// An unknown or unavailable model fails every probe alike, so
+		// it tells nothing about the feature.
+		if msg, ok := modelError(answer); ok {
+			return false, fmt.Errorf("%s: probe model %v unavailable: %s", path, m["model"], msg)
+		}
+		return false, nil
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return false, nil
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("%s returned %d", path, resp.StatusCode)
+	}
+	return !stream || isEventStream(resp), nil
+}
+
+// modelMessages are phrases of error messages about the requested model
+// rather than the request's features.
+var modelMessages = []string{"does not exist", "not found", "not available", "unavailable", "unknown model", "invalid model", "no such model", "do not have access", "does not have access"}
+
+// modelError reports whether the OpenAI-style error body is about the
+// requested model, such as model_not_found, and returns its message.
+func modelError(body []byte) (string, bool) {
+	var e struct {
+		Error struct {
+			Message string          `json:"message"`
+			Param   string          `json:"param"`
+			Code    json.RawMessage `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return "", false
+	}
+	msg := e.Error.Message
+	if e.Error.Param == "model" || strings.Contains(strings.ToLower(string(e.Error.Code)), "model") {
+		return msg, true
+	}
+	lower := strings.ToLower(msg)
+	if !strings.Contains(lower, "model") {
+		return "", false
+	}
+	for _, p := range modelMessages {
+		if strings.Contains(lower, p) {
+			return msg, true
+		}
+	}
+	return "", false
+}
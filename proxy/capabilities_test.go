@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kxn/codex-companion/account"
+)
+
+func TestProbeCapabilities(t *testing.T) {
+	var limited atomic.Bool
+	var lastKey atomic.Value
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]any
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &m)
+		lastKey.Store(r.Header.Get("Authorization"))
+		switch {
+		case limited.Load():
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.Header.Get("Authorization") == "Bearer full":
+			io.WriteString(w, `{}`)
+		// The relay speaks Chat Completions only and ignores stream.
+		case r.URL.Path != "/v1/chat/completions":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			if m["model"] != "gpt-5-mini" {
+				t.Errorf("probe model %v", m["model"])
+			}
+			io.WriteString(w, `{"choices":[]}`)
+		}
+	})
+	ctx := context.Background()
+	relay, _ := mgr.AddAPIKey(ctx, "relay", "relay", "", 0)
+	relay.ModelMap = map[string]string{"gpt-5": "gpt-5-mini"}
+	mgr.Update(ctx, relay)
+	caps, err := h.ProbeCapabilities(ctx, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Responses || !caps.ChatCompletions || caps.Streaming || !caps.Tools || caps.ProbedAt.IsZero() {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+	limited.Store(true)
+	if _, err := h.ProbeCapabilities(ctx, relay); err == nil {
+		t.Fatal("expected a rate-limited probe to fail")
+	}
+	limited.Store(false)
+	if _, err := h.ProbeCapabilities(ctx, &account.Account{Type: account.ChatGPTAccount}); err == nil {
+		t.Fatal("expected ChatGPT accounts to be refused")
+	}
+
+	// Routing keeps what the relay lacks away from it.
+	mgr.SetCapabilities(ctx, relay.ID, caps)
+	mgr.AddAPIKey(ctx, "full", "full", "", 1)
+	for _, c := range []struct{ path, body, key string }{
+		{"/v1/chat/completions", `{"model":"gpt-5"}`, "Bearer relay"},
+		{"/v1/chat/completions", `{"model":"gpt-5","stream":true}`, "Bearer full"},
+		// The relay serves the Responses API through Chat Completions.
+		{"/v1/responses", `{"model":"gpt-5"}`, "Bearer relay"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", c.path, strings.NewReader(c.body)))
+		if rec.Code != http.StatusOK || lastKey.Load() != c.key {
+			t.Fatalf("%s %s: status %d via %v, want %s", c.path, c.body, rec.Code, lastKey.Load(), c.key)
+		}
+	}
+}
+
+func TestProbeCapabilitiesModelError(t *testing.T) {
+	var answer atomic.Value
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, answer.Load().(string))
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "relay", "k", "", 0)
+	for _, body := range []string{
+		`{"error":{"message":"The model 'gpt-5' does not exist","type":"invalid_request_error","code":"model_not_found"}}`,
+		`{"error":{"message":"gpt-5 is not served here","param":"model"}}`,
+		`{"error":{"message":"Unknown model: gpt-5"}}`,
+	} {
+		answer.Store(body)
+		if caps, err := h.ProbeCapabilities(ctx, a); err == nil || !strings.Contains(err.Error(), "probe model gpt-5") {
+			t.Errorf("%s: expected an inconclusive probe, got %+v %v", body, caps, err)
+		}
+	}
+	// Other rejections still mark the feature unsupported.
+	answer.Store(`{"error":{"message":"Unrecognized request URL","type":"invalid_request_error"}}`)
+	if caps, err := h.ProbeCapabilities(ctx, a); err != nil || caps.Responses || caps.ChatCompletions {
+		t.Fatalf("unexpected capabilities %+v %v", caps, err)
+	}
+}
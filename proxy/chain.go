@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// ProxyRequest carries the state of one client request through the chain.
+type ProxyRequest struct {
+	// Request is the client request.
+	Request *http.Request
+	// Body is the client request body. Request hooks may replace it; it is
+	// not yet normalized for a particular account.
+	Body []byte
+	// Hook is the context handed to lifecycle hooks.
+	Hook *HookContext
+	// ClientKey identifies the client, see ClientKeyID.
+	ClientKey string
+	// ID identifies the request in events and error reports. It is the
+	// client's X-Request-Id when given and random otherwise, and is echoed
+	// in the response's X-Request-Id header.
+	ID string
+
+	// interrupted is set when the response broke off after part of it was
+	// forwarded.
+	interrupted bool
+}
+
+type proxyRequestKey struct{}
+
+// RequestFrom returns the ProxyRequest of a request passing through the
+// Handler's chain, or nil outside of it.
+func RequestFrom(r *http.Request) *ProxyRequest {
+	pr, _ := r.Context().Value(proxyRequestKey{}).(*ProxyRequest)
+	return pr
+}
+
+// Middleware wraps the next handler of the request chain.
+type Middleware func(next http.Handler) http.Handler
+
+// Chain wraps h so that mws run in order, the first being outermost.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Attempt is a single upstream try on behalf of a ProxyRequest.
+type Attempt struct {
+	*ProxyRequest
+	// Index is the zero-based attempt number.
+	Index int
+	// Account is the account serving this attempt.
+	Account *acct.Account
+	// Decision is how the scheduler selected Account, when the request is
+	// traced.
+	Decision *scheduler.Trace
+	// Upstream is the outgoing request, built by the normalization stage.
+	Upstream *http.Request
+	// UpstreamBody is the normalized body sent upstream.
+	UpstreamBody []byte
+	// Endpoint is the API path, such as /v1/responses, the upstream request
+	// is for. It differs from the client's path when the request is
+	// translated to another dialect.
+	Endpoint string
+	// Start is when the attempt began.
+	Start time.Time
+	// Shadow is set on the attempts mirroring a request, see Shadow.
+	Shadow bool
+}
+
+// AttemptFunc performs an attempt and returns the upstream response.
+type AttemptFunc func(at *Attempt) (*http.Response, error)
+
+// AttemptMiddleware wraps the next stage of the attempt chain.
+type AttemptMiddleware func(next AttemptFunc) AttemptFunc
+
+// ChainAttempt wraps f so that mws run in order, the first being outermost.
+func ChainAttempt(f AttemptFunc, mws ...AttemptMiddleware) AttemptFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		f = mws[i](f)
+	}
+	return f
+}
+
+// abortError stops the retry loop and fails the client request with status
+// instead of trying another account.
+type abortError struct {
+	status int
+	msg    string
+	err    error
+}
+
+func (e *abortError) Error() string { return e.msg + ": " + e.err.Error() }
+
+func (e *abortError) Unwrap() error { return e.err }
+
+// withProxyRequest attaches pr to ctx.
+func withProxyRequest(ctx context.Context, pr *ProxyRequest) context.Context {
+	return context.WithValue(ctx, proxyRequestKey{}, pr)
+}
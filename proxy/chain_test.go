@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "final")
+	}), mw("a"), mw("b"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !reflect.DeepEqual(order, []string{"a", "b", "final"}) {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	order = nil
+	amw := func(name string) AttemptMiddleware {
+		return func(next AttemptFunc) AttemptFunc {
+			return func(at *Attempt) (*http.Response, error) {
+				order = append(order, name)
+				return next(at)
+			}
+		}
+	}
+	f := ChainAttempt(func(at *Attempt) (*http.Response, error) {
+		order = append(order, "send")
+		return nil, nil
+	}, amw("a"), amw("b"))
+	f(&Attempt{})
+	if !reflect.DeepEqual(order, []string{"a", "b", "send"}) {
+		t.Fatalf("unexpected attempt order %v", order)
+	}
+}
+
+func TestNormalizeBody(t *testing.T) {
+	api := &acct.Account{Type: acct.APIKeyAccount}
+	got := string(normalizeBody(api, "/v1/responses", []byte(`{"store":false,"include":["x"]}`)))
+	if got != `{"store":true}` {
+		t.Fatalf("api key body %s", got)
+	}
+	chat := &acct.Account{Type: acct.ChatGPTAccount}
+	got = string(normalizeBody(chat, "/v1/responses", []byte(`{"store":true}`)))
+	if got != `{"include":["reasoning.encrypted_content"],"store":false}` {
+		t.Fatalf("chatgpt body %s", got)
+	}
+	if got := string(normalizeBody(api, "/v1/responses", []byte("not json"))); got != "not json" {
+		t.Fatalf("invalid json should pass through, got %s", got)
+	}
+	chat.ModelMap = map[string]string{"gpt-5": "gpt-5-codex"}
+	got = string(normalizeBody(chat, "/v1/responses", []byte(`{"model":"gpt-5"}`)))
+	if got != `{"include":["reasoning.encrypted_content"],"model":"gpt-5-codex","store":false}` {
+		t.Fatalf("mapped body %s", got)
+	}
+	if got = string(normalizeBody(chat, "/v1/responses", []byte(`{"model":"o3"}`))); !strings.Contains(got, `"model":"o3"`) {
+		t.Fatalf("unmapped model changed: %s", got)
+	}
+	api.ModelMap = map[string]string{"small": "text-embedding-3-small"}
+	if got = string(normalizeBody(api, "/v1/embeddings", []byte(`{"input":"x","model":"small"}`))); got != `{"input":"x","model":"text-embedding-3-small"}` {
+		t.Fatalf("embeddings body %s", got)
+	}
+}
+
+func TestRequestFromOutsideChain(t *testing.T) {
+	if RequestFrom(httptest.NewRequest("GET", "/", nil)) != nil {
+		t.Fatalf("expected nil outside the chain")
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Chaos faults.
+const (
+	FaultTooManyRequests = "429"
+	FaultServerError     = "500"
+	FaultLatency         = "latency"
+	FaultDropStream      = "drop"
+)
+
+var validFaults = map[string]bool{FaultTooManyRequests: true, FaultServerError: true, FaultLatency: true, FaultDropStream: true}
+
+// ChaosConfig configures fault injection.
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+	// Percent of requests that receive a fault, 0-100.
+	Percent float64 `json:"percent"`
+	// Faults to pick from uniformly; empty means all of them.
+	Faults []string `json:"faults"`
+	// LatencyMs is the delay added by the latency fault.
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// Validate reports invalid settings.
+func (c ChaosConfig) Validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.New("percent must be between 0 and 100")
+	}
+	if c.LatencyMs < 0 {
+		return errors.New("latency_ms must not be negative")
+	}
+	for _, f := range c.Faults {
+		if !validFaults[f] {
+			return fmt.Errorf("unknown fault %q", f)
+		}
+	}
+	return nil
+}
+
+// Chaos injects failures into a share of proxied requests so clients can
+// exercise their retry logic. It is disabled until configured.
+type Chaos struct {
+	mu   sync.RWMutex
+	cfg  ChaosConfig
+	rand func() float64
+}
+
+// NewChaos returns a disabled Chaos.
+func NewChaos() *Chaos {
+	return &Chaos{rand: rand.Float64}
+}
+
+// Config returns the current settings.
+func (c *Chaos) Config() ChaosConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg
+}
+
+// SetConfig replaces the settings after validating them.
+func (c *Chaos) SetConfig(cfg ChaosConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cfg = cfg
+	c.mu.Unlock()
+	logger.Infof("chaos mode enabled=%v percent=%v faults=%v latency=%dms", cfg.Enabled, cfg.Percent, cfg.Faults, cfg.LatencyMs)
+	return nil
+}
+
+// pick returns the fault for the next request, or "" for none.
+func (c *Chaos) pick() (string, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.cfg.Enabled || c.rand()*100 >= c.cfg.Percent {
+		return "", 0
+	}
+	faults := c.cfg.Faults
+	if len(faults) == 0 {
+		faults = []string{FaultTooManyRequests, FaultServerError, FaultLatency, FaultDropStream}
+	}
+	return faults[int(c.rand()*float64(len(faults)))%len(faults)], time.Duration(c.cfg.LatencyMs) * time.Millisecond
+}
+
+// chaos is the request stage injecting faults configured on Handler.Chaos.
+// Injected responses carry an X-Companion-Chaos header naming the fault.
+func (h *Handler) chaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Chaos == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fault, latency := h.Chaos.pick()
+		if fault == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Infof("chaos: injecting %s into %s", fault, r.URL.Path)
+		w.Header().Set("X-Companion-Chaos", fault)
+		switch fault {
+		case FaultTooManyRequests:
+			w.Header().Set("Retry-After", "1")
+			writeChaosError(w, http.StatusTooManyRequests, "rate_limit_exceeded")
+		case FaultServerError:
+			writeChaosError(w, http.StatusInternalServerError, "server_error")
+		case FaultLatency:
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+			next.ServeHTTP(w, r)
+		case FaultDropStream:
+			next.ServeHTTP(&dropWriter{ResponseWriter: w}, r)
+		}
+	})
+}
+
+func writeChaosError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"message":"injected by companion chaos mode","type":%q,"code":%q}}`, code, code)
+}
+
+// dropWriter forwards half of the first body write and then aborts the
+// connection, simulating a stream cut mid-response.
+type dropWriter struct {
+	http.ResponseWriter
+}
+
+func (d *dropWriter) Write(p []byte) (int, error) {
+	d.ResponseWriter.Write(p[:len(p)/2])
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
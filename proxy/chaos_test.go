@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChaosConfigValidate(t *testing.T) {
+	c := NewChaos()
+	for _, cfg := range []ChaosConfig{
+		{Percent: 101},
+		{Percent: 10, LatencyMs: -1},
+		{Percent: 10, Faults: []string{"teapot"}},
+	} {
+		if err := c.SetConfig(cfg); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestChaosInjectsFaults(t *testing.T) {
+	var upstreamCalls int
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		io.WriteString(w, "ok")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	h.Chaos = NewChaos()
+	h.Chaos.rand = func() float64 { return 0 }
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/responses", nil))
+		return rec
+	}
+
+	// disabled: requests pass through
+	if rec := serve(); rec.Code != 200 || rec.Header().Get("X-Companion-Chaos") != "" {
+		t.Fatalf("chaos applied while disabled: %d", rec.Code)
+	}
+
+	h.Chaos.SetConfig(ChaosConfig{Enabled: true, Percent: 100, Faults: []string{FaultTooManyRequests}})
+	rec := serve()
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "1" || rec.Header().Get("X-Companion-Chaos") != "429" {
+		t.Fatalf("expected injected 429, got %d %v", rec.Code, rec.Header())
+	}
+
+	h.Chaos.SetConfig(ChaosConfig{Enabled: true, Percent: 100, Faults: []string{FaultLatency}, LatencyMs: 1})
+	if rec := serve(); rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("latency fault should still proxy, got %d", rec.Code)
+	}
+
+	h.Chaos.SetConfig(ChaosConfig{Enabled: true, Percent: 100, Faults: []string{FaultDropStream}})
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Fatalf("expected aborted handler, got %v", r)
+			}
+		}()
+		serve()
+	}()
+
+	h.Chaos.rand = func() float64 { return 0.5 }
+	h.Chaos.SetConfig(ChaosConfig{Enabled: true, Percent: 10})
+	if rec := serve(); rec.Code != 200 {
+		t.Fatalf("request outside percent got fault %d", rec.Code)
+	}
+	if upstreamCalls != 4 {
+		t.Fatalf("upstream calls %d", upstreamCalls)
+	}
+}
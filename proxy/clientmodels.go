@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// ParseClientModels reads a comma-separated list of key=models entries,
+// such as
+// "ck-0123456789abcdef0123456789abcdef=gpt-5-mini|gpt-4.1-mini,ck-fedcba9876543210fedcba9876543210=gpt-5*",
+// mapping client key IDs to the models they may request. Models are
+// separated by "|" and may be path.Match patterns. The key "*" applies to
+// every client key not listed, and to clients sending none; "*=" alone
+// refuses them every request, so that only listed keys are served.
+func ParseClientModels(s string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("client models %q: expected key=models", part)
+		}
+		var models []string
+		for _, m := range strings.Split(val, "|") {
+			m = strings.TrimSpace(m)
+			if m == "" {
+				continue
+			}
+			if _, err := path.Match(m, ""); err != nil {
+				return nil, fmt.Errorf("client models %q: invalid pattern %q", part, m)
+			}
+			models = append(models, m)
+		}
+		if key != "*" {
+			if err := CheckClientKeyID(key); err != nil {
+				return nil, fmt.Errorf("client models %q: %w", part, err)
+			}
+		}
+		if len(models) == 0 && key != "*" {
+			return nil, fmt.Errorf("client models %q: no models", part)
+		}
+		res[key] = append(res[key], models...)
+		if res[key] == nil {
+			res[key] = []string{}
+		}
+	}
+	return res, nil
+}
+
+// modelAllowed reports whether model matches one of the patterns.
+func modelAllowed(patterns []string, model string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clientModels rejects, with 403 and before any account is selected, a
+// request for a model outside the client key's ClientModels. It runs after
+// the request hooks so that it sees the model actually requested upstream.
+// Requests naming no model, such as model listings, pass. Keys without an
+// entry of their own get the "*" entry, if there is one; when it lists no
+// models they are refused outright.
+func (h *Handler) clientModels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr := RequestFrom(r)
+		allowed, ok := h.ClientModels[pr.ClientKey]
+		if !ok || pr.ClientKey == "" {
+			allowed, ok = h.ClientModels["*"]
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(allowed) == 0 {
+			logger.Warnc(r.Context(), "client %q is not a registered client key", pr.ClientKey)
+			writeError(w, http.StatusForbidden, map[string]any{
+				"message": "this client key is not allowed to use the proxy",
+				"type":    "invalid_request_error",
+				"code":    "client_key_not_allowed",
+			})
+			return
+		}
+		model := pr.model()
+		if model == "" || modelAllowed(allowed, model) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Warnc(r.Context(), "client %s may not use model %s", pr.ClientKey, model)
+		writeError(w, http.StatusForbidden, map[string]any{
+			"message": fmt.Sprintf("model %q is not allowed for this client key; allowed models: %s", model, strings.Join(allowed, ", ")),
+			"type":    "invalid_request_error",
+			"code":    "model_not_allowed",
+			"param":   "model",
+		})
+	})
+}
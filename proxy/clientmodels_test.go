@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseClientModels(t *testing.T) {
+	a, b := ClientKeyID("a"), ClientKeyID("b")
+	models, err := ParseClientModels(" " + a + "=gpt-5-mini | gpt-4.1-mini, " + b + "=gpt-5* ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(models[a], ",") != "gpt-5-mini,gpt-4.1-mini" || strings.Join(models[b], ",") != "gpt-5*" {
+		t.Fatalf("unexpected models %q", models)
+	}
+	if models, err := ParseClientModels(a + "=gpt-5,*="); err != nil || models["*"] == nil || len(models["*"]) != 0 {
+		t.Fatalf("unexpected catch-all %q %v", models, err)
+	}
+	for _, bad := range []string{a, "=gpt-5", a + "=", a + "=|", a + "=gpt-[5", "ck-aaa=gpt-5"} {
+		if _, err := ParseClientModels(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestClientModels(t *testing.T) {
+	var upstream int
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		upstream++
+	})
+	mgr.AddAPIKey(context.Background(), "key", "k", "", 1)
+	h.ClientModels = map[string][]string{ClientKeyID("cheap"): {"gpt-5-mini", "gpt-4.1-*"}}
+	send := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, c := range []struct{ token, body string }{
+		{"cheap", `{"model":"gpt-5-mini"}`},
+		{"cheap", `{"model":"gpt-4.1-nano"}`},
+		{"cheap", `{}`},
+		{"other", `{"model":"gpt-5"}`},
+	} {
+		if rec := send(c.token, c.body); rec.Code != 200 {
+			t.Fatalf("%s %s: status %d", c.token, c.body, rec.Code)
+		}
+	}
+
+	rec := send("cheap", `{"model":"gpt-5"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	var body struct {
+		Error struct {
+			Message, Type, Code string
+		}
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Error.Code != "model_not_allowed" || !strings.Contains(body.Error.Message, `"gpt-5"`) || !strings.Contains(body.Error.Message, "gpt-5-mini, gpt-4.1-*") {
+		t.Fatalf("unexpected error %+v", body.Error)
+	}
+	if upstream != 4 {
+		t.Fatalf("rejected request reached the upstream: %d requests", upstream)
+	}
+
+	// A restricted client cannot get around its list with another token
+	// once unknown keys get the "*" entry.
+	h.ClientModels["*"] = []string{"gpt-4.1-*"}
+	if rec := send("other", `{"model":"gpt-5"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("unknown key used a model outside the catch-all: %d", rec.Code)
+	}
+	if rec := send("other", `{"model":"gpt-4.1-mini"}`); rec.Code != 200 {
+		t.Fatalf("unknown key refused a catch-all model: %d", rec.Code)
+	}
+	h.ClientModels["*"] = []string{}
+	for _, token := range []string{"other", ""} {
+		rec := send(token, `{}`)
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusForbidden || body.Error.Code != "client_key_not_allowed" {
+			t.Fatalf("unknown key %q not refused: %d %+v", token, rec.Code, body.Error)
+		}
+	}
+	if rec := send("cheap", `{"model":"gpt-5-mini"}`); rec.Code != 200 {
+		t.Fatalf("listed key refused: %d", rec.Code)
+	}
+	if upstream != 6 {
+		t.Fatalf("refused requests reached the upstream: %d requests", upstream)
+	}
+}
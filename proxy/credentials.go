@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// TokenInvalidator is optionally implemented by a Selector that can force a
+// token refresh and keep accounts with invalid credentials out of rotation.
+// Without it 401 responses are only handled by the error rules.
+type TokenInvalidator interface {
+	ExpireToken(ctx context.Context, id int64)
+	MarkInvalidToken(ctx context.Context, id int64, msg string)
+}
+
+// invalidToken handles resp, the nth consecutive 401 of account a. It
+// expires a ChatGPT token on the first and marks the credentials invalid
+// once InvalidTokenThreshold is reached, reporting whether it did so.
+func (h *Handler) invalidToken(ctx context.Context, a *acct.Account, resp *http.Response, n int) bool {
+	ti, ok := h.Scheduler.(TokenInvalidator)
+	if !ok || h.InvalidTokenThreshold <= 0 || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	if n < h.InvalidTokenThreshold {
+		if n == 1 && a.Type == acct.ChatGPTAccount {
+			ti.ExpireToken(ctx, a.ID)
+		}
+		return false
+	}
+	h.streaks.reset(a.ID)
+	msg := fmt.Sprintf("%d consecutive 401 responses", n)
+	logger.Warnc(ctx, "account %d credentials invalid: %s", a.ID, msg)
+	ti.MarkInvalidToken(ctx, a.ID, msg)
+	return true
+}
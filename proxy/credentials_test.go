@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+)
+
+func TestInvalidTokenAfterRepeated401(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth == "Bearer bad" || auth == "Bearer at" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	ctx := context.Background()
+	bad, _ := mgr.AddAPIKey(ctx, "bad", "bad", "", 1)
+	cg, _ := mgr.AddChatGPT(ctx, "cg", "rt", "aid", 2)
+	cg.AccessToken, cg.TokenExpiresAt = "at", time.Now().Add(time.Hour)
+	mgr.Update(ctx, cg)
+	mgr.AddAPIKey(ctx, "good", "good", "", 3)
+	got := make(chan events.Event, 1)
+	defer events.Default.Subscribe(func(e events.Event) { got <- e }, events.AccountInvalidToken)()
+
+	send := func() {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`)))
+		if rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	// The first 401 only rotates, and has the ChatGPT token refreshed.
+	send()
+	a, _ := mgr.Get(ctx, bad.ID)
+	if a.InvalidToken() || !a.Exhausted {
+		t.Fatalf("expected ordinary exhaustion, got %+v", a)
+	}
+	if a, _ := mgr.Get(ctx, cg.ID); !a.TokenExpiresAt.IsZero() {
+		t.Fatalf("ChatGPT token not expired: %v", a.TokenExpiresAt)
+	}
+	// Once the cooldown ends a second 401 marks the credentials invalid.
+	mgr.Reactivate(ctx, bad.ID)
+	send()
+	if e := <-got; e.AccountID != bad.ID {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if a, _ := mgr.Get(ctx, bad.ID); !a.InvalidToken() {
+		t.Fatalf("credentials not marked invalid: %+v", a)
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader lets a client bound the time the proxy spends on its
+// request, retries included. The value is a Go duration ("90s") or a number
+// of seconds.
+const TimeoutHeader = "X-Request-Timeout"
+
+// deadline applies the client's TimeoutHeader to the request context; invalid
+// values are rejected with 400. The header is not forwarded upstream.
+func (h *Handler) deadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(TimeoutHeader)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(TimeoutHeader)
+		d, ok := parseTimeout(v)
+		if !ok {
+			writeError(w, http.StatusBadRequest, map[string]any{
+				"message": "invalid " + TimeoutHeader + " header " + strconv.Quote(v),
+				"type":    "invalid_request_error",
+			})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+		pr := RequestFrom(r)
+		pr.Request = r
+		pr.Hook.Context, pr.Hook.Request = ctx, r
+		next.ServeHTTP(w, r)
+	})
+}
+
+func parseTimeout(v string) (time.Duration, bool) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if !(secs > 0) || secs > math.MaxInt64/float64(time.Second) {
+			return 0, false
+		}
+		return time.Duration(secs * float64(time.Second)), true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	for v, want := range map[string]time.Duration{"30": 30 * time.Second, "1.5": 1500 * time.Millisecond, "90s": 90 * time.Second, "0": 0, "-1s": 0, "NaN": 0, "1e30": 0, "soon": 0} {
+		d, ok := parseTimeout(v)
+		if ok != (want > 0) || d != want {
+			t.Errorf("parseTimeout(%q) = %v %v, want %v", v, d, ok, want)
+		}
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	var forwarded []string
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get(TimeoutHeader))
+		if r.URL.Path == "/v1/responses" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	send := func(path, timeout string) int {
+		req := httptest.NewRequest("POST", "http://localhost"+path, nil)
+		req.Header.Set(TimeoutHeader, timeout)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("/v1/models", "later"); code != 400 {
+		t.Fatalf("expected 400 for invalid timeout, got %d", code)
+	}
+	if code := send("/v1/models", "5"); code != 200 || len(forwarded) != 1 || forwarded[0] != "" {
+		t.Fatalf("unexpected %d, forwarded %q", code, forwarded)
+	}
+	start := time.Now()
+	if code := send("/v1/responses", "100ms"); code != 504 {
+		t.Fatalf("expected 504, got %d", code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("deadline not applied, took %v", d)
+	}
+	logs, _ := ls.List(ctx, 10, 0)
+	if len(logs) != 2 || logs[0].Error == "" {
+		t.Fatalf("timed out attempt not logged: %+v", logs)
+	}
+}
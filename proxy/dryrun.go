@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// Rules are the routing and normalization settings a dry run compares: the
+// accounts with their priorities, weights, tiers, model maps and prices,
+// and the scheduler's selection mode.
+type Rules struct {
+	Accounts []*acct.Account
+	Mode     string
+}
+
+// Outcome is how a request would be sent: the account of its first
+// attempt, 0 when none is available, and the model named upstream.
+type Outcome struct {
+	Account int64  `json:"account"`
+	Model   string `json:"model,omitempty"`
+	body    []byte
+}
+
+// Change is a logged request that two sets of Rules treat differently.
+type Change struct {
+	LogID     int64     `json:"log_id"`
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Model     string    `json:"model,omitempty"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Before    Outcome   `json:"before"`
+	After     Outcome   `json:"after"`
+	// Differences names what changed: "account", "model" and "body".
+	Differences []string `json:"differences"`
+}
+
+// DryRun replays logs, which need their request headers and bodies, through
+// the current and the proposed Rules as chosen by s at now and returns the
+// requests that would be routed or transformed differently. Client pins
+// apply as configured; the premium route header and cache affinity are not
+// logged and so not considered.
+func (h *Handler) DryRun(s *scheduler.Scheduler, current, proposed Rules, logs []*log.RequestLog, now time.Time) []Change {
+	var res []Change
+	for _, rl := range logs {
+		path := clientPath(rl.URL)
+		route := scheduler.Route{Model: rl.Model, APIKeyOnly: apiKeyOnly(path)}
+		if p, ok := h.ClientPins[rl.ClientKey]; ok && rl.ClientKey != "" {
+			route.Account, route.Fallback = p.Account, p.Fallback
+		}
+		routeFeatures(&route, path, rl.ReqHeader, []byte(rl.ReqBody))
+		c := Change{
+			LogID: rl.ID, Time: rl.Time, Path: path, Model: rl.Model, ClientKey: rl.ClientKey,
+			Before: h.outcome(s.Preview(current.Accounts, current.Mode, route, now), path, rl),
+			After:  h.outcome(s.Preview(proposed.Accounts, proposed.Mode, route, now), path, rl),
+		}
+		if c.Before.Account != c.After.Account {
+			c.Differences = append(c.Differences, "account")
+		}
+		if c.Before.Model != c.After.Model {
+			c.Differences = append(c.Differences, "model")
+		} else if !bytes.Equal(c.Before.body, c.After.body) {
+			c.Differences = append(c.Differences, "body")
+		}
+		if c.Differences != nil {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// outcome returns the Outcome of sending the logged request rl for path
+// through a, which may be nil. Like normalize it leaves forms unchanged.
+func (h *Handler) outcome(a *acct.Account, path string, rl *log.RequestLog) Outcome {
+	if a == nil {
+		return Outcome{}
+	}
+	o := Outcome{Account: a.ID, Model: rl.Model, body: []byte(rl.ReqBody)}
+	if isForm(rl.ReqHeader) {
+		return o
+	}
+	o.body = normalizeBody(a, path, o.body)
+	if strings.HasPrefix(path, "/v1/responses") {
+		o.body = applyFieldPolicies(h.FieldPolicies, a.Type, o.body)
+	}
+	if m := requestModel(o.body); m != "" {
+		o.Model = m
+	}
+	return o
+}
+
+// clientPath recovers the client path of a logged upstream URL, which lacks
+// the /v1 prefix for ChatGPT accounts and carries the base path of API key
+// accounts.
+func clientPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	for _, p := range allowedPrefixes {
+		if i := strings.LastIndex(u.Path, strings.TrimPrefix(p, "/v1")); i >= 0 {
+			return p + u.Path[i+len(p)-len("/v1"):]
+		}
+	}
+	return u.Path
+}
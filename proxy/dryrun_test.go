@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+func TestClientPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"https://chatgpt.com/backend-api/codex/responses":       "/v1/responses",
+		"https://api.openai.com/v1/embeddings":                  "/v1/embeddings",
+		"https://open.bigmodel.cn/api/paas/v4/chat/completions": "/v1/chat/completions",
+		"https://api.openai.com/v1/responses/resp_1/cancel":     "/v1/responses/resp_1/cancel",
+	} {
+		if got := clientPath(in); got != want {
+			t.Errorf("clientPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	h := &Handler{ClientPins: map[string]ClientPin{"ck-pinned": {Account: 1}}}
+	s := scheduler.New(nil)
+	current := Rules{Mode: scheduler.ModePriority, Accounts: []*acct.Account{
+		{ID: 1, Type: acct.ChatGPTAccount, Priority: 0},
+		{ID: 2, Priority: 1},
+	}}
+	proposed := Rules{Mode: scheduler.ModePriority, Accounts: []*acct.Account{
+		{ID: 1, Type: acct.ChatGPTAccount, Priority: 2, ModelMap: map[string]string{"gpt-5": "gpt-5-codex"}},
+		{ID: 2, Priority: 1},
+	}}
+	logs := []*log.RequestLog{
+		{ID: 1, URL: "https://chatgpt.com/backend-api/codex/responses", Model: "gpt-5", ReqBody: `{"model":"gpt-5"}`},
+		{ID: 2, URL: "https://api.openai.com/v1/embeddings", Model: "text-embedding-3-small", ReqBody: `{"model":"text-embedding-3-small"}`},
+		{ID: 3, URL: "https://chatgpt.com/backend-api/codex/responses", Model: "gpt-5", ClientKey: "ck-pinned", ReqBody: `{"model":"gpt-5"}`},
+	}
+	changes := h.DryRun(s, current, proposed, logs, time.Now())
+	// Embeddings go to the API key account either way.
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %+v", changes)
+	}
+	// Moving to an API key account also changes the body's store field.
+	if c := changes[0]; c.LogID != 1 || c.Path != "/v1/responses" || c.Before.Account != 1 || c.After.Account != 2 ||
+		!reflect.DeepEqual(c.Differences, []string{"account", "body"}) {
+		t.Fatalf("unexpected rerouted request %+v", c)
+	}
+	// The pinned client stays on account 1, whose model map now applies.
+	if c := changes[1]; c.LogID != 3 || c.After.Account != 1 || c.Before.Model != "gpt-5" || c.After.Model != "gpt-5-codex" ||
+		!reflect.DeepEqual(c.Differences, []string{"model"}) {
+		t.Fatalf("unexpected remapped request %+v", c)
+	}
+	proposed.Accounts[1].Exhausted, proposed.Accounts[1].ResetAt = true, time.Now().Add(time.Hour)
+	changes = h.DryRun(s, current, proposed, logs[1:2], time.Now())
+	if len(changes) != 1 || changes[0].After.Account != 0 {
+		t.Fatalf("expected the embeddings request to find no account, got %+v", changes)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxDecodedBody bounds a decompressed request body, so that a small
+// compressed body cannot expand to exhaust memory.
+const maxDecodedBody = 64 << 20
+
+// gzipEncoded reports whether header announces a gzip-compressed body.
+func gzipEncoded(header http.Header) bool {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		return true
+	}
+	return false
+}
+
+// gunzipBody decompresses a gzip-compressed request body.
+func gunzipBody(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecodedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecodedBody {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxDecodedBody)
+	}
+	return out, nil
+}
+
+// decodeResponse decompresses resp when the upstream gzip-compressed it
+// unasked; responses to the transport's own Accept-Encoding arrive
+// decompressed already. The stages reading the body, such as logging and
+// translation, need it plain, and the client gets it so too.
+func decodeResponse(resp *http.Response) {
+	if !gzipEncoded(resp.Header) || resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	resp.Body = &gunzipReader{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// gunzipReader decompresses body, reading the gzip header on the first
+// Read so that an empty body is not an error until it is read.
+type gunzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.zr == nil && g.err == nil {
+		g.zr, g.err = gzip.NewReader(g.body)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gunzipReader) Close() error { return g.body.Close() }
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipBodies(t *testing.T) {
+	var upstream http.Header
+	var upstreamBody string
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		b, _ := io.ReadAll(r.Body)
+		upstreamBody = string(b)
+		// Compressed whatever the request asked for.
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped(t, `{"output_text":"hi","usage":{"input_tokens":5,"output_tokens":1}}`))
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+
+	req := httptest.NewRequest("POST", "/v1/responses", bytes.NewReader(gzipped(t, `{"model":"gpt-5","input":"hi"}`)))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "" || !strings.Contains(rec.Body.String(), "output_text") {
+		t.Fatalf("unexpected response %d %v %q", rec.Code, rec.Header(), rec.Body)
+	}
+	// The body was normalized and sent plain.
+	if upstream.Get("Content-Encoding") != "" || !strings.Contains(upstreamBody, `"store":true`) {
+		t.Fatalf("upstream got %v %q", upstream, upstreamBody)
+	}
+	logs, _ := ls.List(ctx, 1, 0)
+	rl, _ := ls.Get(ctx, logs[0].ID)
+	if rl.Model != "gpt-5" || rl.InputTokens != 5 || !strings.Contains(rl.ReqBody, `"input":"hi"`) || !strings.Contains(rl.RespBody, "output_text") {
+		t.Fatalf("unexpected log %+v", rl)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-5"}`))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a corrupt gzip body, got %d", rec.Code)
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {"10"}}, Body: io.NopCloser(bytes.NewReader(nil))}
+	decodeResponse(resp)
+	if b, err := io.ReadAll(resp.Body); err != nil || len(b) != 0 || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+		t.Fatalf("unexpected empty response %q %v %+v", b, err, resp)
+	}
+	resp = &http.Response{Header: http.Header{"Content-Encoding": {"br"}}, Body: io.NopCloser(strings.NewReader("x"))}
+	decodeResponse(resp)
+	if b, _ := io.ReadAll(resp.Body); string(b) != "x" || resp.Header.Get("Content-Encoding") != "br" {
+		t.Fatal("other encodings must pass unchanged")
+	}
+}
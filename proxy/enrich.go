@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+	"github.com/kxn/codex-companion/log"
+)
+
+// LogEnricher is implemented by a LogSink whose logs can be completed after
+// they are inserted. *log.Store implements it.
+type LogEnricher interface {
+	LogSink
+	// InsertID is Insert returning the ID of the new log.
+	InsertID(ctx context.Context, rl *log.RequestLog) (int64, error)
+	// Enrich stores the fields of log rl.ID derived from its bodies.
+	Enrich(ctx context.Context, rl *log.RequestLog) error
+}
+
+var _ LogEnricher = (*log.Store)(nil)
+
+// Enricher moves the expensive part of logging out of the request path.
+// Attempts are logged at once with what the proxy measured, such as the
+// status, sizes and timings, and queued; its workers then derive the rest
+// from the bodies, the stored request body, token usage and estimate and
+// the decision trace, and store it with LogEnricher.Enrich. When the queue
+// is full a log is enriched in the request path, as without an Enricher,
+// so that no log stays incomplete.
+type Enricher struct {
+	sink    LogEnricher
+	queue   chan enrichJob
+	pending sync.WaitGroup
+}
+
+// enrichJob is an inserted log and the function completing it.
+type enrichJob struct {
+	rl   *log.RequestLog
+	fill func(*log.RequestLog)
+}
+
+var (
+	enrichQueued = metrics.Default.NewCounter("companion_log_enrich_total", "Request logs enriched, by whether the background workers or the request path did it.", "where")
+	enrichDelay  = metrics.Default.NewTimer("companion_log_enrich_delay_seconds", "Time from inserting a request log to storing its enrichment.")
+)
+
+// NewEnricher creates an Enricher storing into sink and queueing up to
+// size logs. Start its workers with Start.
+func NewEnricher(sink LogEnricher, size int) *Enricher {
+	return &Enricher{sink: sink, queue: make(chan enrichJob, size)}
+}
+
+// Start runs workers enriching queued logs until ctx is done.
+func (e *Enricher) Start(ctx context.Context, workers int) {
+	for range workers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-e.queue:
+					e.enrich(job)
+					e.pending.Done()
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until every queued log is enriched.
+func (e *Enricher) Wait() {
+	e.pending.Wait()
+}
+
+// record inserts rl and has fill complete it later, or at once when the
+// queue is full.
+func (e *Enricher) record(ctx context.Context, rl *log.RequestLog, fill func(*log.RequestLog)) {
+	id, err := e.sink.InsertID(ctx, rl)
+	if err != nil {
+		logger.Errorf("insert log failed: %v", err)
+		return
+	}
+	rl.ID = id
+	job := enrichJob{rl: rl, fill: fill}
+	e.pending.Add(1)
+	select {
+	case e.queue <- job:
+		enrichQueued.Inc("background")
+	default:
+		enrichQueued.Inc("request")
+		e.enrich(job)
+		e.pending.Done()
+	}
+}
+
+func (e *Enricher) enrich(job enrichJob) {
+	job.fill(job.rl)
+	if err := e.sink.Enrich(context.Background(), job.rl); err != nil {
+		logger.Errorf("enrich log %d failed: %v", job.rl.ID, err)
+	}
+	enrichDelay.Observe(time.Since(job.rl.Time))
+}
+
+// recordLog persists rl, completed by fill with the fields derived from
+// the bodies, through the Enricher if there is one.
+func (h *Handler) recordLog(ctx context.Context, rl *log.RequestLog, fill func(*log.RequestLog)) {
+	// The attempt is recorded even when the client's deadline ended it.
+	ctx = context.WithoutCancel(ctx)
+	start := time.Now()
+	defer func() { logInsertDuration.Observe(time.Since(start)) }()
+	if h.Enricher != nil {
+		h.Enricher.record(ctx, rl, fill)
+		return
+	}
+	fill(rl)
+	if err := h.Log.Insert(ctx, rl); err != nil {
+		logger.Errorf("insert log failed: %v", err)
+	}
+}
+
+// countTokens adds the usage of a logged attempt to the token metrics.
+func countTokens(rl *log.RequestLog) {
+	id := strconv.FormatInt(rl.AccountID, 10)
+	tokens.Add(float64(rl.InputTokens), id, "input")
+	tokens.Add(float64(rl.OutputTokens), id, "output")
+	tokens.Add(float64(rl.CachedTokens), id, "cached")
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnricher(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"output_text":"hi","usage":{"input_tokens":5,"output_tokens":1,"input_tokens_details":{"cached_tokens":2}}}`)
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	send := func() {
+		req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-5","input":"Hello, world!"}`))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	check := func() {
+		t.Helper()
+		logs, _ := ls.List(ctx, 1, 0)
+		rl, _ := ls.Get(ctx, logs[0].ID)
+		if rl.Status != 200 || rl.InputTokens != 5 || rl.OutputTokens != 1 || rl.CachedTokens != 2 || rl.EstimatedTokens != 4 ||
+			!strings.Contains(rl.ReqBody, "Hello") || !strings.Contains(rl.RespBody, "output_text") {
+			t.Fatalf("unexpected log %+v", rl)
+		}
+	}
+
+	// Without workers the queue fills up and the request path enriches.
+	h.Enricher = NewEnricher(ls, 0)
+	send()
+	check()
+
+	h.Enricher = NewEnricher(ls, 10)
+	h.Enricher.Start(ctx, 2)
+	send()
+	h.Enricher.Wait()
+	check()
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// ErrorScope says who an upstream error response is attributed to.
+type ErrorScope string
+
+const (
+	// ScopeRequest errors are caused by the client request; they are
+	// returned to the client and never retried on another account.
+	ScopeRequest ErrorScope = "request"
+	// ScopeAccount errors are caused by the account; it is marked exhausted
+	// for the rule's cooldown and the request moves to the next account.
+	ScopeAccount ErrorScope = "account"
+	// ScopeRotate errors are retried on the next account without taking the
+	// current one out of rotation.
+	ScopeRotate ErrorScope = "rotate"
+)
+
+// ErrorRule classifies upstream error responses with Status and, if Code is
+// set, an error code or type in the JSON body.
+type ErrorRule struct {
+	Status   int
+	Code     string
+	Scope    ErrorScope
+	Cooldown time.Duration
+}
+
+func (r ErrorRule) String() string {
+	s := strconv.Itoa(r.Status)
+	if r.Code != "" {
+		s += ":" + r.Code
+	}
+	s += "=" + string(r.Scope)
+	if r.Cooldown > 0 {
+		s += "/" + r.Cooldown.String()
+	}
+	return s
+}
+
+// DefaultErrorRules marks rate-limited and unauthorized accounts; every
+// other error status is request-scoped.
+var DefaultErrorRules = []ErrorRule{
+	{Status: http.StatusUnauthorized, Scope: ScopeAccount, Cooldown: 10 * time.Minute},
+	{Status: http.StatusTooManyRequests, Scope: ScopeAccount, Cooldown: time.Hour},
+}
+
+// ParseErrorRules parses a comma-separated list of rules in the form
+// status[:code]=scope[/cooldown], e.g. "403=account/30m,500:server_error=rotate".
+// The result contains DefaultErrorRules with the parsed rules overriding
+// entries for the same status and code.
+func ParseErrorRules(s string) ([]ErrorRule, error) {
+	rules := append([]ErrorRule(nil), DefaultErrorRules...)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("error rule %q: missing '='", part)
+		}
+		var r ErrorRule
+		statusStr, code, _ := strings.Cut(key, ":")
+		status, err := strconv.Atoi(statusStr)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("error rule %q: invalid status", part)
+		}
+		r.Status, r.Code = status, code
+		scope, cooldown, hasCooldown := strings.Cut(val, "/")
+		r.Scope = ErrorScope(scope)
+		switch r.Scope {
+		case ScopeRequest, ScopeAccount, ScopeRotate:
+		default:
+			return nil, fmt.Errorf("error rule %q: unknown scope %q", part, scope)
+		}
+		if hasCooldown {
+			if r.Cooldown, err = time.ParseDuration(cooldown); err != nil {
+				return nil, fmt.Errorf("error rule %q: %w", part, err)
+			}
+		}
+		if r.Scope == ScopeAccount && r.Cooldown <= 0 {
+			r.Cooldown = time.Hour
+		}
+		replaced := false
+		for i := range rules {
+			if rules[i].Status == r.Status && rules[i].Code == r.Code {
+				rules[i], replaced = r, true
+			}
+		}
+		if !replaced {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// ParseFailoverStatuses parses a comma-separated list of 5xx statuses, such
+// as "500,502,503,504", or "none" for an empty one. Server errors usually
+// come from the account's upstream or the route to it, so another account
+// may well succeed, see WithFailover.
+func ParseFailoverStatuses(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "none" {
+		return nil, nil
+	}
+	var statuses []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		status, err := strconv.Atoi(part)
+		if err != nil || status < 500 || status > 599 {
+			return nil, fmt.Errorf("failover status %q: expected a 5xx status", part)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// WithFailover returns rules with a rotate rule added for each of the
+// statuses that has no status-only rule yet, so rules configured for a
+// status keep precedence. Once every account has failed with one of them,
+// the last response is returned to the client.
+func WithFailover(rules []ErrorRule, statuses []int) []ErrorRule {
+	rules = append([]ErrorRule(nil), rules...)
+	for _, status := range statuses {
+		if !slices.ContainsFunc(rules, func(r ErrorRule) bool { return r.Status == status && r.Code == "" }) {
+			rules = append(rules, ErrorRule{Status: status, Scope: ScopeRotate})
+		}
+	}
+	return rules
+}
+
+// classify returns the rule matching an error response. Rules with a code
+// take precedence over status-only rules. Successful and unmatched
+// responses are request-scoped.
+func (h *Handler) classify(resp *http.Response) ErrorRule {
+	if resp.StatusCode < 400 {
+		return ErrorRule{Status: resp.StatusCode, Scope: ScopeRequest}
+	}
+	rules := h.ErrorRules
+	if rules == nil {
+		rules = DefaultErrorRules
+	}
+	var code, typ string
+	var byStatus *ErrorRule
+	for i, r := range rules {
+		if r.Status != resp.StatusCode {
+			continue
+		}
+		if r.Code == "" {
+			if byStatus == nil {
+				byStatus = &rules[i]
+			}
+			continue
+		}
+		if code == "" && typ == "" {
+			code, typ = errorCode(resp)
+		}
+		if r.Code == code || r.Code == typ {
+			return r
+		}
+	}
+	if byStatus != nil {
+		return *byStatus
+	}
+	return ErrorRule{Status: resp.StatusCode, Scope: ScopeRequest}
+}
+
+// errorCode returns the code and type of an OpenAI-style JSON error body.
+// The body is restored so it can still be sent to the client.
+func errorCode(resp *http.Response) (code, typ string) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		logger.Warnf("read error body: %v", err)
+		return "", ""
+	}
+	var e struct {
+		Error struct {
+			Code string `json:"code"`
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return "", ""
+	}
+	return e.Error.Code, e.Error.Type
+}
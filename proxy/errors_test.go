@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrorRules(t *testing.T) {
+	rules, err := ParseErrorRules("401=request, 500:server_error=rotate,403=account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.String())
+	}
+	want := "401=request,429=account/1h0m0s,500:server_error=rotate,403=account/1h0m0s"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("rules %v, want %s", got, want)
+	}
+	for _, bad := range []string{"401", "abc=request", "200=request", "401=maybe", "401=account/soon"} {
+		if _, err := ParseErrorRules(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestWithFailover(t *testing.T) {
+	statuses, err := ParseFailoverStatuses("500, 502,503")
+	if err != nil || len(statuses) != 3 {
+		t.Fatalf("statuses %v %v", statuses, err)
+	}
+	if none, err := ParseFailoverStatuses("none"); err != nil || none != nil {
+		t.Fatalf("none parsed as %v %v", none, err)
+	}
+	for _, bad := range []string{"429", "5xx", "600"} {
+		if _, err := ParseFailoverStatuses(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	// A configured rule for a status wins; one with a code does not stop
+	// the status from failing over.
+	rules, _ := ParseErrorRules("502=request,500:invalid_prompt=request")
+	var got []string
+	for _, r := range WithFailover(rules, statuses) {
+		got = append(got, r.String())
+	}
+	want := "401=account/10m0s,429=account/1h0m0s,502=request,500:invalid_prompt=request,500=rotate,503=rotate"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("rules %v, want %s", got, want)
+	}
+}
+
+func TestServeHTTPFailover(t *testing.T) {
+	var calls []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer k1" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	statuses, _ := ParseFailoverStatuses("500,502,503,504")
+	h.ErrorRules = WithFailover(DefaultErrorRules, statuses)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" || len(calls) != 2 {
+		t.Fatalf("expected failover to the second account, got %d %q after %v", rec.Code, rec.Body, calls)
+	}
+	// The failing account stays in rotation.
+	if got, _ := mgr.Get(ctx, a1.ID); got.Exhausted {
+		t.Fatal("account taken out of rotation by a server error")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	h := &Handler{}
+	h.ErrorRules, _ = ParseErrorRules("500=rotate,500:invalid_prompt=request")
+	resp := func(status int, body string) *http.Response {
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body))}
+	}
+	cases := []struct {
+		status int
+		body   string
+		want   ErrorScope
+	}{
+		{200, "", ScopeRequest},
+		{400, `{"error":{"code":"invalid_json"}}`, ScopeRequest},
+		{429, "", ScopeAccount},
+		{500, `{"error":{"type":"server_error"}}`, ScopeRotate},
+		{500, `{"error":{"code":"invalid_prompt"}}`, ScopeRequest},
+	}
+	for _, c := range cases {
+		r := resp(c.status, c.body)
+		if got := h.classify(r).Scope; got != c.want {
+			t.Fatalf("%d %s: got %s, want %s", c.status, c.body, got, c.want)
+		}
+		if b, _ := io.ReadAll(r.Body); string(b) != c.body {
+			t.Fatalf("body not restored: %q", b)
+		}
+	}
+}
+
+func TestServeHTTPRequestErrorNotRetried(t *testing.T) {
+	calls := 0
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"code":"invalid_json"}}`)
+	})
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest || calls != 1 {
+		t.Fatalf("request error retried: status %d calls %d", rec.Code, calls)
+	}
+	if got, _ := mgr.Get(ctx, a1.ID); got.Exhausted {
+		t.Fatalf("account marked for a request error")
+	}
+}
+
+func TestServeHTTPAccountErrorCooldown(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer k1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	h.ErrorRules, _ = ParseErrorRules("403=account/30m")
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected rotation to the second account, got %d", rec.Code)
+	}
+	got, _ := mgr.Get(ctx, a1.ID)
+	if !got.Exhausted || got.ResetAt.After(time.Now().Add(31*time.Minute)) || got.ResetAt.Before(time.Now().Add(29*time.Minute)) {
+		t.Fatalf("unexpected cooldown %+v", got)
+	}
+}
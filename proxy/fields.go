@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+// FieldAction says what happens to a Responses API body field.
+type FieldAction string
+
+const (
+	// FieldKeep forwards the field as sent; it overrides a wildcard policy.
+	FieldKeep FieldAction = "keep"
+	// FieldStrip removes the field.
+	FieldStrip FieldAction = "strip"
+	// FieldSet replaces the field, or adds it, with the policy's Value.
+	FieldSet FieldAction = "set"
+)
+
+// FieldPolicy handles one field of Responses API bodies sent to accounts of
+// a type. Field is a dotted path such as "reasoning.summary".
+type FieldPolicy struct {
+	// AccountType is "apikey", "chatgpt" or "*" for both.
+	AccountType string
+	Field       string
+	Action      FieldAction
+	// Value is the JSON set by FieldSet.
+	Value json.RawMessage
+}
+
+// ParseFieldPolicies parses a semicolon-separated list of policies in the
+// form type:field=action[:json], e.g.
+// `apikey:instructions=strip;chatgpt:reasoning.summary=set:"auto"`.
+func ParseFieldPolicies(s string) ([]FieldPolicy, error) {
+	var policies []FieldPolicy
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("field policy %q: missing '='", part)
+		}
+		var p FieldPolicy
+		if p.AccountType, p.Field, ok = strings.Cut(key, ":"); !ok || p.Field == "" {
+			return nil, fmt.Errorf("field policy %q: want type:field", part)
+		}
+		switch p.AccountType {
+		case "apikey", "chatgpt", "*":
+		default:
+			return nil, fmt.Errorf("field policy %q: unknown account type %q", part, p.AccountType)
+		}
+		action, value, hasValue := strings.Cut(val, ":")
+		p.Action = FieldAction(action)
+		switch p.Action {
+		case FieldKeep, FieldStrip:
+			if hasValue {
+				return nil, fmt.Errorf("field policy %q: %s takes no value", part, action)
+			}
+		case FieldSet:
+			if !json.Valid([]byte(value)) {
+				return nil, fmt.Errorf("field policy %q: value is not JSON", part)
+			}
+			p.Value = json.RawMessage(value)
+		default:
+			return nil, fmt.Errorf("field policy %q: unknown action %q", part, action)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// accountTypeName returns the AccountType used in field policies.
+func accountTypeName(t acct.AccountType) string {
+	if t == acct.ChatGPTAccount {
+		return "chatgpt"
+	}
+	return "apikey"
+}
+
+// applyFieldPolicies applies the policies for account type t to a JSON
+// object body. A policy for the type wins over a "*" policy for the same
+// field. Bodies that are not JSON objects are returned unchanged.
+func applyFieldPolicies(policies []FieldPolicy, t acct.AccountType, body []byte) []byte {
+	if len(policies) == 0 {
+		return body
+	}
+	typ := accountTypeName(t)
+	effective := make(map[string]FieldPolicy)
+	var fields []string
+	for _, p := range policies {
+		if p.AccountType != typ && p.AccountType != "*" {
+			continue
+		}
+		cur, seen := effective[p.Field]
+		if !seen {
+			fields = append(fields, p.Field)
+		}
+		if !seen || p.AccountType == typ || cur.AccountType == "*" {
+			effective[p.Field] = p
+		}
+	}
+	if len(fields) == 0 {
+		return body
+	}
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil || m == nil {
+		return body
+	}
+	for _, f := range fields {
+		p := effective[f]
+		path := strings.Split(f, ".")
+		parent := m
+		for _, k := range path[:len(path)-1] {
+			next, ok := parent[k].(map[string]any)
+			if !ok {
+				if p.Action != FieldSet {
+					parent = nil
+					break
+				}
+				next = make(map[string]any)
+				parent[k] = next
+			}
+			parent = next
+		}
+		if parent == nil {
+			continue
+		}
+		last := path[len(path)-1]
+		switch p.Action {
+		case FieldStrip:
+			delete(parent, last)
+		case FieldSet:
+			var v any
+			json.Unmarshal(p.Value, &v)
+			parent[last] = v
+		}
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+func TestParseFieldPolicies(t *testing.T) {
+	ps, err := ParseFieldPolicies(` apikey:instructions=strip; chatgpt:reasoning.summary=set:"auto";*:tools=keep `)
+	if err != nil || len(ps) != 3 {
+		t.Fatalf("parse: %v %+v", err, ps)
+	}
+	if ps[1].AccountType != "chatgpt" || ps[1].Field != "reasoning.summary" || ps[1].Action != FieldSet || string(ps[1].Value) != `"auto"` {
+		t.Fatalf("unexpected policy %+v", ps[1])
+	}
+	for _, bad := range []string{"instructions=strip", "team:tools=strip", "apikey:tools=drop", "apikey:tools=strip:1", "apikey:tools=set:{", "apikey:tools"} {
+		if _, err := ParseFieldPolicies(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestApplyFieldPolicies(t *testing.T) {
+	ps, _ := ParseFieldPolicies(`*:tools=strip;chatgpt:tools=keep;apikey:instructions=strip;*:reasoning.summary=set:"auto";*:text.verbosity=strip`)
+	body := []byte(`{"instructions":"be brief","tools":[{"type":"x"}],"reasoning":{"effort":"high"}}`)
+	got := string(applyFieldPolicies(ps, acct.APIKeyAccount, body))
+	if got != `{"reasoning":{"effort":"high","summary":"auto"}}` {
+		t.Fatalf("api key body %s", got)
+	}
+	got = string(applyFieldPolicies(ps, acct.ChatGPTAccount, body))
+	if got != `{"instructions":"be brief","reasoning":{"effort":"high","summary":"auto"},"tools":[{"type":"x"}]}` {
+		t.Fatalf("chatgpt body %s", got)
+	}
+	if got := string(applyFieldPolicies(ps, acct.APIKeyAccount, []byte("[1]"))); got != "[1]" {
+		t.Fatalf("non-object body changed: %s", got)
+	}
+}
+
+func TestFieldPoliciesResponsesOnly(t *testing.T) {
+	var bodies []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+	})
+	h.FieldPolicies, _ = ParseFieldPolicies("apikey:instructions=strip")
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	for _, path := range []string{"/v1/responses", "/v1/chat/completions"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://localhost"+path, strings.NewReader(`{"instructions":"x"}`)))
+	}
+	if len(bodies) != 2 || strings.Contains(bodies[0], "instructions") || !strings.Contains(bodies[1], "instructions") {
+		t.Fatalf("unexpected upstream bodies %q", bodies)
+	}
+}
@@ -0,0 +1,324 @@
+// Package proxy implements the companion's reverse proxy. A Handler accepts
+// Codex/OpenAI API requests, picks an upstream account from a Selector,
+// rewrites credentials and request bodies for that account type and records
+// each attempt through a LogSink.
+//
+// Embedding the proxy in another service only requires an account manager,
+// a scheduler and a log store sharing one SQLite database:
+//
+//	mgr, _ := account.NewManager(db)
+//	logs, _ := log.NewStore(db)
+//	h := proxy.New(scheduler.New(mgr), logs, "https://api.openai.com", "https://chatgpt.com/backend-api/codex")
+//	http.Handle("/v1/", h)
+//
+// # Middleware order
+//
+// Each client request passes through a chain of Middleware, outermost first:
+//
+//  1. auth      – identify the client by its bearer token
+//  2. usage     – answer usage endpoints from the companion's own records
+//  3. allowlist – reject requests the PathRules deny, by default those that are not Codex API calls
+//  4. deadline  – bound the request by the client's X-Request-Timeout
+//  5. admission – hold requests beyond the global in-flight cap (see Admission)
+//  6. chaos     – inject configured faults (see Chaos)
+//  7. limits    – reject clients over their monthly bandwidth caps
+//  8. body      – read the client body into the ProxyRequest
+//  9. hooks     – run RequestHooks, which may rewrite or reject the request
+//  10. models    – reject models the client key may not use
+//  11. cache     – answer repeated deterministic requests from the ResponseCache
+//  12. shadow    – mirror a share of the requests to the Shadow target
+//  13. retry     – select accounts and run attempts until one succeeds
+//
+// Every upstream attempt made by the retry stage then runs through a chain of
+// AttemptMiddleware, outermost first:
+//
+//  1. normalization  – build the upstream request for the selected account and run UpstreamMiddleware
+//  2. shaping        – apply the account's concurrency, latency and bandwidth limits
+//  3. throttling     – pace accounts running low on upstream rate limits
+//  4. logging        – persist the attempt through the LogSink
+//  5. response hooks – run ResponseHooks on the upstream response
+//  6. transport      – send the request with Handler.Client, through the account's own proxy and TLS settings if it has them
+//
+// An upgrade handshake, such as a /v1/realtime WebSocket session, takes the
+// same path; when the upstream answers 101 Switching Protocols the retry
+// stage tunnels the client connection to the upstream one.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/outbound"
+	"github.com/kxn/codex-companion/internal/replay"
+	"github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// Selector chooses upstream accounts and records quota exhaustion.
+// *scheduler.Scheduler implements it.
+type Selector interface {
+	// Next returns the account to use for the next upstream attempt,
+	// skipping the accounts in exclude, which already served the request.
+	Next(ctx context.Context, exclude map[int64]bool) (*acct.Account, error)
+	// MarkExhausted removes the account from rotation until resetAt.
+	MarkExhausted(ctx context.Context, id int64, resetAt time.Time)
+}
+
+// AttemptObserver is optionally implemented by a Selector that learns from
+// the outcome of each upstream attempt.
+type AttemptObserver interface {
+	ObserveAttempt(accountID int64, status int, latency time.Duration, err error)
+}
+
+// LogSink persists request logs. *log.Store implements it.
+type LogSink interface {
+	Insert(ctx context.Context, rl *log.RequestLog) error
+}
+
+var (
+	_ Selector         = (*scheduler.Scheduler)(nil)
+	_ AttemptObserver  = (*scheduler.Scheduler)(nil)
+	_ Blocker          = (*scheduler.Scheduler)(nil)
+	_ Quarantiner      = (*scheduler.Scheduler)(nil)
+	_ TokenInvalidator = (*scheduler.Scheduler)(nil)
+	_ AffinitySelector = (*scheduler.Scheduler)(nil)
+	_ RetryAfterError  = (*scheduler.NoAccountsError)(nil)
+	_ LogSink          = (*log.Store)(nil)
+)
+
+// maxAttempts bounds the upstream attempts made for one client request.
+const maxAttempts = 3
+
+// Handler implements reverse proxy logic.
+type Handler struct {
+	Scheduler       Selector
+	Log             LogSink
+	UpstreamAPI     string
+	UpstreamChatGPT string
+	Client          *http.Client
+	// ErrorRules classifies upstream error responses as request- or
+	// account-scoped. Nil means DefaultErrorRules.
+	ErrorRules []ErrorRule
+	// FieldPolicies keep, strip or set fields of Responses API bodies per
+	// account type after normalization.
+	FieldPolicies []FieldPolicy
+	// Annotations identify the deployment or client in the bodies sent
+	// upstream, after FieldPolicies.
+	Annotations []Annotation
+	// BillingCooldown is how long an API key account returning a quota or
+	// billing error stays out of rotation.
+	BillingCooldown time.Duration
+	// RetryBackoff is the base delay before retrying after a transport
+	// error; it doubles per attempt and is jittered. Zero retries at once.
+	RetryBackoff time.Duration
+	// Pass429 forwards the last upstream 429 to every client, headers and
+	// body intact, when all accounts are exhausted instead of answering 503.
+	// Pass429Keys enables the same for individual client keys (ClientKeyID).
+	Pass429     bool
+	Pass429Keys []string
+	// AccountSummary adds a scheduler.Summary of the account pool to the
+	// error body returned when no account is available.
+	AccountSummary bool
+	// DecisionTrace records the scheduler's decisions with every attempt's
+	// log entry; without it only requests sending TraceHeader are traced.
+	// The Selector must honour scheduler.WithTrace, as *scheduler.Scheduler
+	// does.
+	DecisionTrace bool
+	// CacheAffinity pins requests sharing a prompt cache key to the account
+	// that last served one of them, for this long after each success, so
+	// the upstream prompt cache is reused. Zero disables it; the Selector
+	// must implement AffinitySelector.
+	CacheAffinity time.Duration
+	// ClientPins sends the requests of the listed client keys (ClientKeyID)
+	// to one account each, for attribution or compliance. The Selector
+	// must honour scheduler.Route, as *scheduler.Scheduler does.
+	ClientPins map[string]ClientPin
+	// ForceAccountKeys lists the client keys (ClientKeyID) allowed to send
+	// ForceAccountHeader; other clients sending it are rejected with 403.
+	ForceAccountKeys []string
+	// PathRules decides which methods and paths are forwarded, see
+	// ParsePathRules. Nil forwards the Codex API paths.
+	PathRules *PathRules
+	// ClientModels limits the listed client keys (ClientKeyID) to the
+	// models matching their patterns; other models are rejected with 403
+	// before an account is selected. Keys not listed may use any model.
+	ClientModels map[string][]string
+	// ResponseHeaders lists the informational headers, such as
+	// AccountHeader, added to the responses served by an account, see
+	// ParseResponseHeaders. Responses sent once no account is left, the 503
+	// or a passed-through 429, get none.
+	ResponseHeaders []string
+	// QuarantineThreshold consecutive 403 responses from a ChatGPT
+	// account quarantine it for QuarantineCooldown. Zero disables it.
+	QuarantineThreshold int
+	QuarantineCooldown  time.Duration
+	// InvalidTokenThreshold consecutive 401 responses mark an account's
+	// credentials invalid, taking it out of rotation until they are
+	// replaced. The first 401 of a ChatGPT account also expires its token,
+	// so the next attempt uses a refreshed one. Zero disables it.
+	InvalidTokenThreshold int
+	// SlowThreshold logs a warning with the timing breakdown for attempts
+	// taking at least this long; zero disables it.
+	SlowThreshold time.Duration
+	// LogBodyLimit is how many bytes of each response body are stored in
+	// the log; zero stores them all. Large bodies are streamed to the
+	// client either way, but only a limit keeps them out of memory.
+	LogBodyLimit int
+	// Shadow, when set, mirrors a share of the requests to a second target
+	// for comparison, see ParseShadow.
+	Shadow *Shadow
+	// Enricher, when set, inserts logs with what the request path measured
+	// and derives the rest from the bodies in the background. It must
+	// store into Log.
+	Enricher *Enricher
+	// ThrottlePercent slows or pauses an account once a successful response
+	// reports less than this percentage of an upstream rate limit left in
+	// its x-ratelimit-* headers, before the limit is hit. Zero disables it.
+	ThrottlePercent int
+	// WarmupModel is the model Warmup probes with; empty means
+	// DefaultWarmupModel.
+	WarmupModel string
+	// Cache answers repeated deterministic requests without contacting the
+	// upstream when non-nil.
+	Cache *ResponseCache
+	// Chaos injects faults for client testing when non-nil and enabled.
+	Chaos *Chaos
+	// Admission, when set, caps the client requests handled at once.
+	Admission *Admission
+	// Usage answers the usage endpoints when non-nil. New sets it when the
+	// LogSink implements UsageSource.
+	Usage UsageSource
+	// BandwidthCaps limits the bytes exchanged with the upstream per
+	// calendar month (UTC), see ParseBandwidthCaps. The month's traffic
+	// logged before a restart counts when the LogSink is a
+	// BandwidthSource.
+	BandwidthCaps map[string]int64
+
+	meter    meter
+	hooks    []any
+	rewrites []UpstreamMiddleware
+	shaper   shaper
+	pins     pins
+	streaks  streaks
+	pacer    pacer
+	// transports are the dedicated transports of accounts with a ProxyURL
+	// or TLS settings.
+	transports outbound.Accounts
+}
+
+// New creates a new proxy Handler. Its Client has no overall timeout, which
+// would cut long event streams off: the transport bounds connecting and the
+// wait for response headers, see outbound.HeaderTimeout, and the request
+// context, with its X-Request-Timeout, bounds the rest.
+func New(s Selector, l LogSink, apiUpstream, chatgptUpstream string) *Handler {
+	transport, _ := outbound.Transport("")
+	h := &Handler{
+		Scheduler:             s,
+		Log:                   l,
+		UpstreamAPI:           apiUpstream,
+		UpstreamChatGPT:       chatgptUpstream,
+		Client:                &http.Client{Transport: transport},
+		BillingCooldown:       24 * time.Hour,
+		RetryBackoff:          100 * time.Millisecond,
+		QuarantineThreshold:   3,
+		QuarantineCooldown:    7 * 24 * time.Hour,
+		InvalidTokenThreshold: 2,
+	}
+	if u, ok := l.(UsageSource); ok {
+		h.Usage = u
+	}
+	return h
+}
+
+// middlewares returns the request chain in the documented order.
+func (h *Handler) middlewares() []Middleware {
+	return []Middleware{
+		h.auth,
+		h.usage,
+		h.allowlist,
+		h.deadline,
+		h.admission,
+		h.chaos,
+		h.limits,
+		h.readBody,
+		h.requestHooks,
+		h.clientModels,
+		h.responseCache,
+		h.shadow,
+	}
+}
+
+// attemptMiddlewares returns the per-attempt chain in the documented order.
+func (h *Handler) attemptMiddlewares() []AttemptMiddleware {
+	return []AttemptMiddleware{
+		h.normalize,
+		h.shaping,
+		h.throttling,
+		h.logAttempt,
+		h.responseHooks,
+	}
+}
+
+// RequestIDHeader carries the ID of a proxied request, see ProxyRequest.ID.
+const RequestIDHeader = "X-Request-Id"
+
+// UpstreamRequestIDHeader carries the upstream's own request ID, which it
+// sends as X-Request-Id, in responses to the client.
+const UpstreamRequestIDHeader = "X-Upstream-Request-Id"
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pr := &ProxyRequest{ID: r.Header.Get(RequestIDHeader)}
+	if pr.ID == "" || len(pr.ID) > 128 {
+		pr.ID = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, pr.ID)
+	ctx, endTrace := logger.BeginTrace(withProxyRequest(r.Context(), pr), pr.ID, r.Method+" "+r.URL.Path)
+	defer endTrace()
+	r = r.WithContext(ctx)
+	logger.Infoc(ctx, "proxy %s %s", r.Method, r.URL.String())
+	logger.Debugc(ctx, "request %s headers %v", pr.ID, replay.SanitizeHeader(r.Header))
+	pr.Request = r
+	pr.Hook = &HookContext{Context: r.Context(), Request: r, Values: make(map[string]any)}
+	defer h.recoverPanic(w, pr)
+	Chain(http.HandlerFunc(h.retry), h.middlewares()...).ServeHTTP(w, r)
+}
+
+// recoverPanic turns a panic in the request chain into a 500 response and a
+// Panic event carrying the stack, so it reaches error reporting instead of
+// only the server log.
+func (h *Handler) recoverPanic(w http.ResponseWriter, pr *ProxyRequest) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	stack := string(debug.Stack())
+	logger.Errorc(pr.Request.Context(), "panic serving %s: %v\n%s", pr.Request.URL.Path, v, stack)
+	e := events.Event{
+		Type:    events.Panic,
+		Message: fmt.Sprint(v),
+		Data:    map[string]any{"path": pr.Request.URL.Path, "request_id": pr.ID, "stack": stack},
+	}
+	if pr.Hook.Account != nil {
+		e.AccountID = pr.Hook.Account.ID
+	}
+	events.Publish(e)
+	writeError(w, http.StatusInternalServerError, map[string]any{"message": "internal error", "type": "server_error"})
+}
+
+// newRequestID returns a random 128-bit hex ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,603 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	logpkg "github.com/kxn/codex-companion/log"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+func setupProxy(t *testing.T, upstream http.HandlerFunc) (*Handler, *account.Manager, *logpkg.MemoryStore) {
+	t.Helper()
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
+	ls := logpkg.NewMemoryStore(1000)
+	s := scheduler.New(mgr)
+	srv := httptest.NewServer(upstream)
+	t.Cleanup(srv.Close)
+	h := New(s, ls, srv.URL, srv.URL)
+	return h, mgr, ls
+}
+
+func TestServeHTTPForwardAndLog(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k" {
+			w.WriteHeader(401)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	req := httptest.NewRequest("GET", "http://localhost/v1/responses", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("bad resp %d %s", rec.Code, rec.Body.String())
+	}
+	logs, err := ls.List(ctx, 10, 0)
+	if err != nil || len(logs) != 1 || logs[0].Status != 200 {
+		t.Fatalf("logs %v %v", logs, err)
+	}
+}
+
+func TestServeHTTP429(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(429)
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	req := httptest.NewRequest("GET", "http://localhost/v1/responses", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 503 {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	got, _ := mgr.Get(ctx, a.ID)
+	if !got.Exhausted {
+		t.Fatalf("account not marked exhausted")
+	}
+}
+
+func TestServeHTTPRetryNextAccount(t *testing.T) {
+	calls := 0
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") == "Bearer k1" {
+			w.WriteHeader(429)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a1", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "a2", "k2", "", 2)
+	req := httptest.NewRequest("GET", "http://localhost/v1/responses", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", calls)
+	}
+	got, _ := mgr.Get(ctx, a1.ID)
+	if !got.Exhausted {
+		t.Fatalf("first account not exhausted")
+	}
+}
+
+func TestServeHTTPChatGPTAccount(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/responses" {
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer at" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.Header.Get("chatgpt-account-id") != "aid" {
+			t.Fatalf("missing chatgpt-account-id header")
+		}
+		b, _ := io.ReadAll(r.Body)
+		var m map[string]any
+		json.Unmarshal(b, &m)
+		if v, ok := m["store"].(bool); !ok || v {
+			t.Fatalf("store not false: %v", m["store"])
+		}
+		inc, ok := m["include"].([]any)
+		if !ok || len(inc) != 1 || inc[0] != "reasoning.encrypted_content" {
+			t.Fatalf("include not normalized: %v", m["include"])
+		}
+		io.WriteString(w, "ok")
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddChatGPT(ctx, "cg", "rt", "aid", 1)
+	a.AccessToken = "at"
+	a.TokenExpiresAt = time.Now().Add(time.Hour)
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"store":true}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServeHTTPAPIKeyNormalize(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("chatgpt-account-id") != "" {
+			t.Fatalf("chatgpt-account-id should be empty")
+		}
+		b, _ := io.ReadAll(r.Body)
+		var m map[string]any
+		json.Unmarshal(b, &m)
+		if v, ok := m["store"].(bool); !ok || !v {
+			t.Fatalf("store not true: %v", m["store"])
+		}
+		if _, ok := m["include"]; ok {
+			t.Fatalf("include should be removed")
+		}
+		io.WriteString(w, "ok")
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"store":false,"include":["x"]}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServeHTTPEmbeddings(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/v1/embeddings" || r.Header.Get("Authorization") != "Bearer k" || string(body) != `{"input":"hi","model":"text-embedding-3-small"}` {
+			t.Errorf("unexpected upstream request %s %q", r.URL.Path, body)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `{"object":"list","data":[],"usage":{"prompt_tokens":2,"total_tokens":2}}`)
+	})
+	ctx := context.Background()
+	// The ChatGPT account comes first but cannot serve embeddings.
+	mgr.AddChatGPT(ctx, "c", "rt", "acct", 0)
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"input":"hi","model":"text-embedding-3-small"}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	logs, _ := ls.List(ctx, 1, 0)
+	if len(logs) != 1 || logs[0].InputTokens != 2 || logs[0].EstimatedTokens != 1 || logs[0].Model != "text-embedding-3-small" {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+}
+
+func TestServeHTTPImages(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("model", "gpt-image-1")
+	fw, _ := mw.CreateFormFile("image", "cat.png")
+	fw.Write([]byte("\x89PNG{\"store\":false}\x00"))
+	mw.Close()
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v1/images/edits":
+			if r.Header.Get("Content-Type") != mw.FormDataContentType() || !bytes.Equal(body, form.Bytes()) {
+				t.Errorf("form altered: %q", body)
+			}
+		case "/v1/images/generations":
+			if string(body) != `{"model":"gpt-image-1","prompt":"a cat"}` {
+				t.Errorf("unexpected generation body %s", body)
+			}
+		}
+		if r.Header.Get("Authorization") != "Bearer k" {
+			t.Errorf("image request sent to %s", r.Header.Get("Authorization"))
+		}
+		io.WriteString(w, `{"data":[]}`)
+	})
+	ctx := context.Background()
+	mgr.AddChatGPT(ctx, "c", "rt", "acct", 0)
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	h.ClientModels = map[string][]string{ClientKeyID("text"): {"gpt-5*"}}
+	send := func(path, contentType, token string, body []byte) int {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("/v1/images/edits", mw.FormDataContentType(), "client", form.Bytes()); code != http.StatusOK {
+		t.Fatalf("edit status %d", code)
+	}
+	logs, _ := ls.List(ctx, 1, 0)
+	if len(logs) != 1 || logs[0].Model != "gpt-image-1" || logs[0].ReqSize != form.Len() || logs[0].EstimatedTokens != 0 {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+	if code := send("/v1/images/generations", "application/json", "client", []byte(`{"model":"gpt-image-1","prompt":"a cat"}`)); code != http.StatusOK {
+		t.Fatalf("generation status %d", code)
+	}
+	// The form's model is subject to client model allowlists.
+	if code := send("/v1/images/edits", mw.FormDataContentType(), "text", form.Bytes()); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a disallowed model, got %d", code)
+	}
+}
+
+func TestServeHTTPAudio(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("model", "whisper-1")
+	fw, _ := mw.CreateFormFile("file", "talk.mp3")
+	fw.Write([]byte("ID3\x00\x01audio"))
+	mw.Close()
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v1/audio/transcriptions":
+			if !bytes.Equal(body, form.Bytes()) {
+				t.Errorf("form altered: %q", body)
+			}
+			io.WriteString(w, `{"text":"hello"}`)
+		case "/v1/audio/speech":
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.Write([]byte("ID3\x00\x02speech"))
+		}
+	})
+	ctx := context.Background()
+	mgr.AddChatGPT(ctx, "c", "rt", "acct", 0)
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	send := func(path, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := send("/v1/audio/transcriptions", mw.FormDataContentType(), form.Bytes()); rec.Code != http.StatusOK || rec.Body.String() != `{"text":"hello"}` {
+		t.Fatalf("transcription %d %s", rec.Code, rec.Body.String())
+	}
+	logs, _ := ls.List(ctx, 1, 0)
+	rl, _ := ls.Get(ctx, logs[0].ID)
+	// The log keeps the fields and only the size of the audio file.
+	want := "model: whisper-1\nfile: [file \"talk.mp3\", application/octet-stream, 10 bytes]\n"
+	if rl.Model != "whisper-1" || rl.ReqBody != want || rl.ReqSize != form.Len() {
+		t.Fatalf("unexpected transcription log %+v", rl)
+	}
+	rec := send("/v1/audio/speech", "application/json", []byte(`{"model":"tts-1","input":"hello","voice":"alloy"}`))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ID3\x00\x02speech" {
+		t.Fatalf("speech %d %q", rec.Code, rec.Body.String())
+	}
+	logs, _ = ls.List(ctx, 1, 0)
+	rl, _ = ls.Get(ctx, logs[0].ID)
+	if rl.RespBody != "[audio/mpeg, 11 bytes]" || rl.RespSize != 11 || rl.Model != "tts-1" {
+		t.Fatalf("unexpected speech log %+v", rl)
+	}
+}
+
+func TestServeHTTPDisallowedPath(t *testing.T) {
+	h, _, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("should not be called")
+	})
+	req := httptest.NewRequest("GET", "http://localhost/other", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 404 {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTPAccountBaseURL(t *testing.T) {
+	badCalls := 0
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		badCalls++
+		w.WriteHeader(500)
+	})
+	goodSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer goodSrv.Close()
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", goodSrv.URL, 1)
+	req := httptest.NewRequest("GET", "http://localhost/v1/responses", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+	if badCalls != 0 {
+		t.Fatalf("default upstream was called")
+	}
+}
+
+func TestServeHTTPAPIKeyBaseWithVersion(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/responses" {
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+		io.WriteString(w, "ok")
+	})
+	h.UpstreamAPI = h.UpstreamAPI + "/v4"
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	req := httptest.NewRequest("GET", "http://localhost/v1/responses", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+type stubSelector struct {
+	a         *account.Account
+	exhausted []int64
+}
+
+func (s *stubSelector) Next(ctx context.Context, exclude map[int64]bool) (*account.Account, error) {
+	if exclude[s.a.ID] {
+		return nil, &scheduler.NoAccountsError{}
+	}
+	return s.a, nil
+}
+func (s *stubSelector) MarkExhausted(ctx context.Context, id int64, resetAt time.Time) {
+	s.exhausted = append(s.exhausted, id)
+}
+
+type sliceSink struct{ logs []*logpkg.RequestLog }
+
+func (s *sliceSink) Insert(ctx context.Context, rl *logpkg.RequestLog) error {
+	s.logs = append(s.logs, rl)
+	return nil
+}
+
+func TestServeHTTPCustomSelectorAndSink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer stub" {
+			w.WriteHeader(401)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	sel := &stubSelector{a: &account.Account{ID: 7, Type: account.APIKeyAccount, APIKey: "stub"}}
+	sink := &sliceSink{}
+	h := New(sel, sink, srv.URL, srv.URL)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/models", nil))
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+	if len(sink.logs) != 1 || sink.logs[0].AccountID != 7 {
+		t.Fatalf("logs not recorded: %+v", sink.logs)
+	}
+}
+
+func TestServeHTTPRetryAfter(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(429)
+	})
+	h.ErrorRules, _ = ParseErrorRules("429=account/10m")
+	ctx := context.Background()
+	// The last attempt is exhausted too.
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	mgr.AddAPIKey(ctx, "c", "k3", "", 3)
+	d, _ := mgr.AddAPIKey(ctx, "d", "k4", "", 4)
+	mgr.MarkExhausted(ctx, d.ID, time.Now().Add(time.Hour))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if rec.Code != 503 {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	secs, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || secs < 595 || secs > 600 {
+		t.Fatalf("unexpected Retry-After %q", rec.Header().Get("Retry-After"))
+	}
+	var body struct {
+		Error struct {
+			Message    string `json:"message"`
+			RetryAfter int    `json:"retry_after"`
+			ResetAt    string `json:"reset_at"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error.RetryAfter != secs || body.Error.Message != "no accounts available" || body.Error.ResetAt == "" {
+		t.Fatalf("unexpected body %v %+v", err, body)
+	}
+}
+
+func TestServeHTTPPass429(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ratelimit-Reset", "42")
+		w.WriteHeader(429)
+		io.WriteString(w, `{"error":{"message":"slow down `+r.Header.Get("Authorization")+`"}}`)
+	})
+	h.ErrorRules, _ = ParseErrorRules("429=account/10m")
+	h.Pass429Keys = []string{ClientKeyID("client")}
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	b, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	c, _ := mgr.AddAPIKey(ctx, "c", "k3", "", 3)
+	send := func(token string) *httptest.ResponseRecorder {
+		for _, id := range []int64{a.ID, b.ID, c.ID} {
+			mgr.Reactivate(ctx, id)
+		}
+		req := httptest.NewRequest("POST", "http://localhost/v1/responses", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := send("other"); rec.Code != 503 || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After for other clients, got %d %v", rec.Code, rec.Header())
+	}
+	rec := send("client")
+	if rec.Code != 429 || rec.Header().Get("X-Ratelimit-Reset") != "42" || !strings.Contains(rec.Body.String(), "slow down Bearer k3") {
+		t.Fatalf("expected last upstream 429, got %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	h.Pass429Keys = nil
+	h.Pass429 = true
+	if rec := send("other"); rec.Code != 429 {
+		t.Fatalf("expected 429 with global pass-through, got %d", rec.Code)
+	}
+}
+
+func TestServeHTTPAccountSummary(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(time.Hour))
+	send := func() map[string]any {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+		var body struct {
+			Error map[string]any `json:"error"`
+		}
+		if rec.Code != 503 || json.NewDecoder(rec.Body).Decode(&body) != nil {
+			t.Fatalf("unexpected response %d", rec.Code)
+		}
+		return body.Error
+	}
+	if e := send(); e["accounts"] != nil || e["notes"] != nil {
+		t.Fatalf("summary included by default: %v", e)
+	}
+	// Operator notes reach clients with or without the summary.
+	a.Notes = map[string]string{"exhausted": "Team plan renews on the 3rd"}
+	mgr.Update(ctx, a)
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(time.Hour))
+	if e := send(); e["message"] != "no accounts available: Team plan renews on the 3rd" || len(e["notes"].([]any)) != 1 {
+		t.Fatalf("unexpected error %v", e)
+	}
+	h.AccountSummary = true
+	sum, _ := send()["accounts"].(map[string]any)
+	if sum["accounts"] != 1.0 || sum["exhausted"] != 1.0 || sum["blocked"] != 0.0 || len(sum["resets"].([]any)) != 1 {
+		t.Fatalf("unexpected summary %v", sum)
+	}
+}
+
+func TestServeHTTPTriesEachAccountOnce(t *testing.T) {
+	var calls []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Header.Get("Authorization"))
+		w.WriteHeader(500)
+		io.WriteString(w, `{"error":{"type":"server_error"}}`)
+	})
+	h.ErrorRules, _ = ParseErrorRules("500=rotate")
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if len(calls) != 2 || calls[0] != "Bearer k1" || calls[1] != "Bearer k2" {
+		t.Fatalf("expected each account once, got %v", calls)
+	}
+	if rec.Code != 500 || !strings.Contains(rec.Body.String(), "server_error") {
+		t.Fatalf("expected last upstream error, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServeHTTPRetryBackoff(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	h.RetryBackoff = 40 * time.Millisecond
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "c"} {
+		mgr.AddAPIKey(ctx, name, "k-"+name, "", 1)
+	}
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if rec.Code != 502 {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	// 20-40ms before the second attempt and 40-80ms before the third.
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Fatalf("retried without backoff in %v", d)
+	}
+}
+
+func TestServeHTTPCacheAffinity(t *testing.T) {
+	var used []string
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		used = append(used, r.Header.Get("Authorization"))
+		io.WriteString(w, `{"usage":{"input_tokens":100,"output_tokens":5,"input_tokens_details":{"cached_tokens":80}}}`)
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k1", "", 2)
+	b, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 1)
+	send := func(body string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(body)))
+		if rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	h.CacheAffinity = time.Hour
+	// Served by a while b is exhausted, the conversation stays on a once b
+	// is back even though b comes first in priority order.
+	mgr.MarkExhausted(ctx, b.ID, time.Now().Add(time.Hour))
+	send(`{"prompt_cache_key":"conv-1"}`)
+	mgr.Reactivate(ctx, b.ID)
+	send(`{"prompt_cache_key":"conv-1"}`)
+	send(`{"prompt_cache_key":"conv-2"}`)
+	if strings.Join(used, ",") != "Bearer k1,Bearer k1,Bearer k2" {
+		t.Fatalf("unexpected accounts %v", used)
+	}
+	logs, _ := ls.List(ctx, 1, 0)
+	if len(logs) != 1 || logs[0].CachedTokens != 80 {
+		t.Fatalf("cached tokens not logged: %+v", logs)
+	}
+	if logs[0].Session != "conv-2" {
+		t.Fatalf("session not logged: %q", logs[0].Session)
+	}
+}
+
+func TestServeHTTPDebugCapture(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "secret-key", "", 1)
+	logger.ClearCaptured()
+	t.Cleanup(logger.ClearCaptured)
+	logger.StartCapture(1)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "http://localhost/v1/responses", nil)
+		req.Header.Set("Authorization", "Bearer client-secret")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	remaining, traces := logger.Captured()
+	if remaining != 0 || len(traces) != 1 {
+		t.Fatalf("expected one trace, got %d remaining %+v", remaining, traces)
+	}
+	tr := traces[0]
+	if tr.Request != "GET /v1/responses" || tr.End.IsZero() {
+		t.Fatalf("unexpected trace %+v", tr)
+	}
+	lines := strings.Join(tr.Lines, "\n")
+	for _, want := range []string{"[DEBUG] request " + tr.ID, "[DEBUG] selected account", "[DEBUG] upstream GET", "[INFO] proxied /v1/responses"} {
+		if !strings.Contains(lines, want) {
+			t.Fatalf("trace lacks %q:\n%s", want, lines)
+		}
+	}
+	if strings.Contains(lines, "secret") {
+		t.Fatalf("trace leaks credentials:\n%s", lines)
+	}
+}
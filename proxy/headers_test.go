@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":        {"close, X-Conn-Scoped", " x-other "},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"websocket"},
+		"Te":                {"trailers"},
+		"X-Conn-Scoped":     {"1"},
+		"X-Other":           {"1"},
+		"Content-Type":      {"text/event-stream"},
+	}
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+}
+
+func TestHopHeadersNotForwarded(t *testing.T) {
+	var upstream http.Header
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Request-Id", "up")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	req := httptest.NewRequest("GET", "http://localhost/v1/models", nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status %d", rec.Code)
+	}
+	for _, k := range []string{"X-Client-Hop", "Proxy-Authorization", "Te"} {
+		if upstream.Get(k) != "" {
+			t.Errorf("request header %s forwarded", k)
+		}
+	}
+	if upstream.Get("Accept") != "application/json" {
+		t.Errorf("end-to-end request header dropped: %v", upstream)
+	}
+	for _, k := range []string{"Connection", "X-Upstream-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if rec.Header().Get(k) != "" {
+			t.Errorf("response header %s forwarded", k)
+		}
+	}
+	if ids := rec.Header().Values(RequestIDHeader); len(ids) != 1 || ids[0] == "up" || rec.Header().Get(UpstreamRequestIDHeader) != "up" {
+		t.Errorf("unexpected request IDs %v", rec.Header())
+	}
+}
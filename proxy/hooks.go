@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// HookContext carries per-request state through the lifecycle hooks.
+type HookContext struct {
+	Context context.Context
+	// Request is the client request. OnRequest hooks may modify its headers.
+	Request *http.Request
+	// Body is the client request body before account-specific
+	// normalization. OnRequest hooks may replace it.
+	Body []byte
+	// Attempt is the zero-based upstream attempt number.
+	Attempt int
+	// Account is the account selected for the current attempt, if any.
+	Account *acct.Account
+	// Values is free-form state shared between hooks of one request.
+	Values map[string]any
+}
+
+// RequestHook runs once per client request before account selection.
+// Returning an error rejects the request; use *HookError to choose the status.
+type RequestHook interface {
+	OnRequest(hc *HookContext) error
+}
+
+// AccountSelectedHook runs after the scheduler picks an account for an
+// attempt. Returning an error skips that account for the attempt.
+type AccountSelectedHook interface {
+	OnAccountSelected(hc *HookContext, a *acct.Account) error
+}
+
+// ResponseHook runs when an upstream response arrives, before it is logged
+// or written to the client. Hooks may modify the headers or wrap the body;
+// the Content-Length sent to the client is measured from the final body.
+// Returning an error discards the response and fails the request with 502.
+type ResponseHook interface {
+	OnResponse(hc *HookContext, resp *http.Response) error
+}
+
+// ErrorHook observes failures: transport errors, hook rejections and
+// requests that could not be served by any account.
+type ErrorHook interface {
+	OnError(hc *HookContext, err error)
+}
+
+// HookError lets a hook reject a request with a specific HTTP status.
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func (e *HookError) Error() string { return e.Message }
+
+// ErrInvalidHook is returned by Register for values implementing no hook
+// interface.
+var ErrInvalidHook = errors.New("value implements no hook interface")
+
+// Register adds a hook implementing one or more of RequestHook,
+// AccountSelectedHook, ResponseHook and ErrorHook. Hooks run in registration
+// order. Register must not be called while the Handler is serving requests.
+func (h *Handler) Register(hook any) error {
+	switch hook.(type) {
+	case RequestHook, AccountSelectedHook, ResponseHook, ErrorHook:
+		h.hooks = append(h.hooks, hook)
+		return nil
+	}
+	return fmt.Errorf("%w: %T", ErrInvalidHook, hook)
+}
+
+func (h *Handler) runRequestHooks(hc *HookContext) error {
+	for _, hook := range h.hooks {
+		if rh, ok := hook.(RequestHook); ok {
+			if err := rh.OnRequest(hc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) runAccountSelectedHooks(hc *HookContext, a *acct.Account) error {
+	for _, hook := range h.hooks {
+		if ah, ok := hook.(AccountSelectedHook); ok {
+			if err := ah.OnAccountSelected(hc, a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) runResponseHooks(hc *HookContext, resp *http.Response) error {
+	for _, hook := range h.hooks {
+		if rh, ok := hook.(ResponseHook); ok {
+			if err := rh.OnResponse(hc, resp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) runErrorHooks(hc *HookContext, err error) {
+	for _, hook := range h.hooks {
+		if eh, ok := hook.(ErrorHook); ok {
+			eh.OnError(hc, err)
+		}
+	}
+}
+
+// requestHooks is the request stage running RequestHooks. Hooks see and may
+// replace the body read by the previous stage.
+func (h *Handler) requestHooks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr := RequestFrom(r)
+		pr.Hook.Body = pr.Body
+		if err := h.runRequestHooks(pr.Hook); err != nil {
+			h.runErrorHooks(pr.Hook, err)
+			writeHookError(w, err)
+			return
+		}
+		pr.Body = pr.Hook.Body
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseHooks is the attempt stage running ResponseHooks on the upstream
+// response before it is logged. A rejection fails the request with 502.
+func (h *Handler) responseHooks(next AttemptFunc) AttemptFunc {
+	return func(at *Attempt) (*http.Response, error) {
+		resp, err := next(at)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.runResponseHooks(at.Hook, resp); err != nil {
+			logger.Warnc(at.Request.Context(), "response rejected by hook: %v", err)
+			h.runErrorHooks(at.Hook, err)
+			resp.Body.Close()
+			return nil, &abortError{status: http.StatusBadGateway, msg: "upstream response rejected", err: err}
+		}
+		return resp, nil
+	}
+}
+
+// writeHookError responds to a request rejected by a RequestHook.
+func writeHookError(w http.ResponseWriter, err error) {
+	var he *HookError
+	if errors.As(err, &he) && he.Status != 0 {
+		http.Error(w, he.Message, he.Status)
+		return
+	}
+	logger.Warnf("request rejected by hook: %v", err)
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
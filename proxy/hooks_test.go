@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+)
+
+type recordingHook struct {
+	calls    []string
+	reject   error
+	skipKey  string
+	errs     []error
+	respHdr  string
+	newBody  string
+	accounts []int64
+}
+
+func (h *recordingHook) OnRequest(hc *HookContext) error {
+	h.calls = append(h.calls, "request")
+	if h.newBody != "" {
+		hc.Body = []byte(h.newBody)
+	}
+	return h.reject
+}
+
+func (h *recordingHook) OnAccountSelected(hc *HookContext, a *account.Account) error {
+	h.calls = append(h.calls, "account")
+	h.accounts = append(h.accounts, a.ID)
+	if a.APIKey == h.skipKey {
+		return errors.New("skip")
+	}
+	return nil
+}
+
+func (h *recordingHook) OnResponse(hc *HookContext, resp *http.Response) error {
+	h.calls = append(h.calls, "response")
+	if h.respHdr != "" {
+		resp.Header.Set("X-Hook", h.respHdr)
+	}
+	return nil
+}
+
+func (h *recordingHook) OnError(hc *HookContext, err error) {
+	h.errs = append(h.errs, err)
+}
+
+func TestRegisterRejectsNonHook(t *testing.T) {
+	h := &Handler{}
+	if err := h.Register(42); !errors.Is(err, ErrInvalidHook) {
+		t.Fatalf("expected ErrInvalidHook, got %v", err)
+	}
+}
+
+func TestHooksLifecycle(t *testing.T) {
+	var gotBody string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		io.WriteString(w, "ok")
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	hook := &recordingHook{respHdr: "seen", newBody: `{"model":"m"}`}
+	if err := h.Register(hook); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`)))
+	if rec.Code != 200 || rec.Header().Get("X-Hook") != "seen" {
+		t.Fatalf("unexpected resp %d %v", rec.Code, rec.Header())
+	}
+	if strings.Join(hook.calls, ",") != "request,account,response" {
+		t.Fatalf("unexpected call order: %v", hook.calls)
+	}
+	if !strings.Contains(gotBody, `"model":"m"`) {
+		t.Fatalf("body not replaced by hook: %s", gotBody)
+	}
+}
+
+func TestRequestHookRejects(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("upstream should not be called")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	hook := &recordingHook{reject: &HookError{Status: http.StatusPaymentRequired, Message: "over budget"}}
+	h.Register(hook)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/models", nil))
+	if rec.Code != http.StatusPaymentRequired || !strings.Contains(rec.Body.String(), "over budget") {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+	if len(hook.errs) != 1 {
+		t.Fatalf("error hook not called: %v", hook.errs)
+	}
+}
+
+func TestAccountSelectedHookSkips(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("upstream should not be called")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	hook := &recordingHook{skipKey: "k"}
+	h.Register(hook)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/models", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	// The skipped account is not offered again within the request.
+	if len(hook.accounts) != 1 || len(hook.errs) != 2 {
+		t.Fatalf("unexpected hook calls: %v %v", hook.accounts, hook.errs)
+	}
+}
+
+type panicHook struct{}
+
+func (panicHook) OnRequest(hc *HookContext) error { panic("hook exploded") }
+
+func TestPanicRecovered(t *testing.T) {
+	h, _, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("upstream called")
+	})
+	h.Register(panicHook{})
+	got := make(chan events.Event, 1)
+	defer events.Default.Subscribe(func(e events.Event) { got <- e }, events.Panic)()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{}`))
+	req.Header.Set(RequestIDHeader, "req-42")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get(RequestIDHeader) != "req-42" {
+		t.Fatalf("status %d, request id %q", rec.Code, rec.Header().Get(RequestIDHeader))
+	}
+	e := <-got
+	if e.Message != "hook exploded" || e.Data["request_id"] != "req-42" || !strings.Contains(e.Data["stack"].(string), "OnRequest") {
+		t.Fatalf("unexpected panic event %+v", e)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{}`)))
+	if id := rec.Header().Get(RequestIDHeader); len(id) != 32 {
+		t.Fatalf("expected generated request id, got %q", id)
+	}
+}
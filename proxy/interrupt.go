@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// InterruptedCode is the error code reported to a client whose response
+// broke off after part of it was forwarded. Such a request is not retried
+// on another account, since the client already consumed the partial output
+// and a second run could repeat its side effects.
+const InterruptedCode = "stream_interrupted"
+
+// awaitBody waits for the first byte of resp's body, before anything is
+// forwarded to the client, so that an upstream failing at once can still be
+// retried on another account. It returns the error of a body failing
+// before its first byte; an empty body is not an error.
+func awaitBody(resp *http.Response) error {
+	if !bodyAllowed(resp.StatusCode) {
+		return nil
+	}
+	br := bufio.NewReader(resp.Body)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	return nil
+}
+
+// sourceReader records the error of the upstream body it reads, telling it
+// apart from errors writing to the client.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// interrupted reports a response of pr that broke off with err after part
+// of it reached the client. Event streams end with an error event carrying
+// InterruptedCode in the dialect of the client path; other bodies cannot
+// signal an error once their header is sent, so the connection is aborted
+// instead of letting the truncated body look complete.
+func (h *Handler) interrupted(w http.ResponseWriter, pr *ProxyRequest, resp *http.Response, err error) {
+	logger.Errorc(pr.Request.Context(), "response interrupted after partial output, not retrying: %v", err)
+	pr.interrupted = true
+	h.runErrorHooks(pr.Hook, err)
+	e := events.Event{
+		Type:    events.RequestFailed,
+		Message: "response interrupted",
+		Data:    map[string]any{"path": pr.Request.URL.Path, "status": resp.StatusCode, "error": err.Error(), "request_id": pr.ID, "code": InterruptedCode},
+	}
+	if pr.Hook.Account != nil {
+		e.AccountID = pr.Hook.Account.ID
+	}
+	events.Publish(e)
+	if !isEventStream(resp) {
+		panic(http.ErrAbortHandler)
+	}
+	msg := fmt.Sprintf("upstream response interrupted: %v", err)
+	var event string
+	if pr.Request.URL.Path == "/v1/chat/completions" {
+		b, _ := json.Marshal(map[string]any{"error": map[string]any{"message": msg, "type": "server_error", "code": InterruptedCode}})
+		event = "data: " + string(b) + "\n\n"
+	} else {
+		b, _ := json.Marshal(map[string]any{"type": "error", "code": InterruptedCode, "message": msg})
+		event = "event: error\ndata: " + string(b) + "\n\n"
+	}
+	// The leading newline ends an event the upstream broke off in.
+	if _, err := io.WriteString(flushWriter{w}, "\n"+event); err != nil {
+		logger.Warnc(pr.Request.Context(), "write interruption: %v", err)
+	}
+}
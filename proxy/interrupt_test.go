@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamInterruption(t *testing.T) {
+	// breakOff sends an event stream's header and prefix, then drops the
+	// connection.
+	breakOff := func(w http.ResponseWriter, contentType, prefix string) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, prefix)
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	var keys []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		keys = append(keys, key)
+		switch {
+		case r.URL.Path == "/v1/embeddings" && key == "k1":
+			breakOff(w, "application/json", `{"data":[`)
+		case r.URL.Path == "/v1/embeddings":
+			io.WriteString(w, `{"data":[]}`)
+		case key == "k1":
+			breakOff(w, "text/event-stream", "")
+		case strings.Contains(r.URL.Path, "chat"):
+			breakOff(w, "text/event-stream", "data: {\"choices\":[]}\n\ndata: {\"cho")
+		default:
+			breakOff(w, "text/event-stream", "event: response.created\ndata: {}\n\n")
+		}
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	h.RetryBackoff = 0
+
+	// Failing before the first byte moves on to the next account, which
+	// breaks off after an event the client has already received.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"stream":true}`)))
+	if strings.Join(keys, ",") != "k1,k2" || rec.Code != 200 {
+		t.Fatalf("status %d after attempts %v", rec.Code, keys)
+	}
+	want := "event: response.created\ndata: {}\n\n\nevent: error\ndata: {\"code\":\"" + InterruptedCode + "\""
+	if !strings.HasPrefix(rec.Body.String(), want) {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+
+	// Chat Completions clients get the error in their dialect.
+	keys = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"stream":true}`)))
+	body := rec.Body.String()
+	if strings.Join(keys, ",") != "k1,k2" || !strings.Contains(body, "\ndata: {\"error\":{\"code\":\""+InterruptedCode+"\"") {
+		t.Fatalf("unexpected body %q after attempts %v", body, keys)
+	}
+
+	// A body buffered before it is forwarded is retried too rather than
+	// passed on truncated.
+	keys = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/embeddings", strings.NewReader(`{}`)))
+	if strings.Join(keys, ",") != "k1,k2" || rec.Code != 200 || rec.Body.String() != `{"data":[]}` {
+		t.Fatalf("unexpected resp %d %q after attempts %v", rec.Code, rec.Body.String(), keys)
+	}
+}
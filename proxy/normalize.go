@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// normalize builds the upstream request for the attempt's account: it picks
+// the base URL, rewrites the path, replaces the credentials, on upgrade
+// handshakes too, and runs the upstream middleware, which adjust the body
+// for the account type. Form uploads, such as image edits, are passed on
+// byte for byte by the built-in middleware. Requests for the Responses API
+// or Chat Completions are translated to the other when the account's upstream
+// only serves that one, and so is the response.
+func (h *Handler) normalize(next AttemptFunc) AttemptFunc {
+	return func(at *Attempt) (*http.Response, error) {
+		r := at.Request
+		clientPath, body := r.URL.Path, at.Body
+		tr := translate(at.Account, r, at.Body)
+		if tr != nil {
+			logger.Debugc(r.Context(), "translating %s to %s for account %d", clientPath, tr.path, at.Account.ID)
+			clientPath, body = tr.path, tr.body
+		}
+		base, path := h.upstreamTarget(at.Account, clientPath)
+		at.Endpoint, at.UpstreamBody = clientPath, body
+		upstreamURL := base + path
+		if r.URL.RawQuery != "" {
+			upstreamURL += "?" + r.URL.RawQuery
+		}
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, nil)
+		if err != nil {
+			logger.Errorc(r.Context(), "new upstream request: %v", err)
+			return nil, &abortError{status: http.StatusBadRequest, msg: "bad request", err: err}
+		}
+		req.Header = r.Header.Clone()
+		removeHopHeaders(req.Header)
+		// The transport asks for gzip itself and decompresses the response,
+		// which logging, usage and translation read; the client gets it
+		// uncompressed.
+		req.Header.Del("Accept-Encoding")
+		// An upgrade, such as a Realtime WebSocket session, is the one
+		// hop-by-hop request passed on; the transport then returns the
+		// upgraded connection as the body of a 101 response.
+		if up := upgradeType(r.Header); up != "" {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", up)
+		}
+		setCredentials(req.Header, at.Account)
+		at.Upstream = req
+		if err := h.rewrite(at); err != nil {
+			return nil, err
+		}
+		setBody(req, at.UpstreamBody)
+		resp, err := next(at)
+		if err != nil || tr == nil {
+			return resp, err
+		}
+		return tr.response(resp)
+	}
+}
+
+// setBody makes body the body of req, as http.NewRequest does.
+func setBody(req *http.Request, body []byte) {
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body, req.GetBody = http.NoBody, func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+}
+
+// isForm reports whether header announces a form body, whose multipart
+// encoding must reach the upstream unchanged.
+func isForm(header http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mt == "multipart/form-data" || mt == "application/x-www-form-urlencoded"
+}
+
+// formModel returns the model field of a form body with header, or "".
+func formModel(header http.Header, body []byte) string {
+	mt, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mt == "application/x-www-form-urlencoded" {
+		v, _ := url.ParseQuery(string(body))
+		return v.Get("model")
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return ""
+		}
+		if p.FormName() == "model" {
+			// Model names are short; the limit only guards against a file
+			// uploaded under that name.
+			v, _ := io.ReadAll(io.LimitReader(p, 256))
+			return string(v)
+		}
+	}
+}
+
+// setCredentials replaces the client's credentials in header with a's.
+func setCredentials(header http.Header, a *acct.Account) {
+	if a.Type == acct.APIKeyAccount {
+		header.Set("Authorization", "Bearer "+a.APIKey)
+		header.Del("chatgpt-account-id")
+		return
+	}
+	header.Set("Authorization", "Bearer "+a.AccessToken)
+	if a.AccountID != "" {
+		header.Set("chatgpt-account-id", a.AccountID)
+	}
+}
+
+// upstreamTarget returns the base URL and path for a client path served by a.
+// API key accounts use their own BaseURL when set, and the client's /v1 prefix
+// is dropped when the base already ends in a version segment such as /v4.
+// ChatGPT accounts always use the Codex backend without the /v1 prefix.
+func (h *Handler) upstreamTarget(a *acct.Account, path string) (string, string) {
+	if a.Type != acct.APIKeyAccount {
+		return h.UpstreamChatGPT, strings.TrimPrefix(path, "/v1")
+	}
+	base := h.UpstreamAPI
+	if a.BaseURL != "" {
+		base = a.BaseURL
+	}
+	if u, err := url.Parse(base); err == nil {
+		segs := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(segs) > 0 {
+			last := segs[len(segs)-1]
+			if len(last) > 1 && last[0] == 'v' {
+				if _, err := strconv.Atoi(last[1:]); err == nil {
+					path = strings.TrimPrefix(path, "/v1")
+					if path == "" {
+						path = "/"
+					}
+				}
+			}
+		}
+	}
+	return base, path
+}
+
+// requestModel returns the model named in a JSON request body, or "".
+func requestModel(body []byte) string {
+	var m struct {
+		Model string `json:"model"`
+	}
+	if json.Unmarshal(body, &m) != nil {
+		return ""
+	}
+	return m.Model
+}
+
+// normalizeBody adjusts a JSON body for the account type and the client
+// path. API key accounts store responses server-side and must not request
+// encrypted reasoning; ChatGPT accounts cannot store and need reasoning
+// returned encrypted. Endpoints only the API serves, such as embeddings and
+// images, take neither parameter. The model is translated through the account's ModelMap.
+// Non-JSON bodies are returned unchanged.
+func normalizeBody(a *acct.Account, path string, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil {
+		return body
+	}
+	switch {
+	case apiKeyOnly(path):
+	case a.Type == acct.APIKeyAccount:
+		m["store"] = true
+		delete(m, "include")
+	default:
+		m["store"] = false
+		m["include"] = []string{"reasoning.encrypted_content"}
+	}
+	if model, ok := m["model"].(string); ok {
+		if to, ok := a.ModelMap[model]; ok {
+			m["model"] = to
+		}
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Quarantiner is optionally implemented by a Selector that distinguishes
+// quarantined accounts from exhausted ones. Without it MarkExhausted is
+// used.
+type Quarantiner interface {
+	Quarantine(ctx context.Context, id int64, msg string, resetAt time.Time)
+}
+
+// streaks counts the consecutive 401 or 403 responses of each account.
+type streaks struct {
+	mu sync.Mutex
+	m  map[int64]streak
+}
+
+type streak struct {
+	status, n int
+}
+
+// record notes the status of a response from account id and returns how
+// many consecutive responses, including it, had that status. Statuses other
+// than 401 and 403 end the streak and return 0.
+func (s *streaks) record(id int64, status int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		delete(s.m, id)
+		return 0
+	}
+	if s.m == nil {
+		s.m = make(map[int64]streak)
+	}
+	st := s.m[id]
+	if st.status != status {
+		st = streak{status: status}
+	}
+	st.n++
+	s.m[id] = st
+	return st.n
+}
+
+func (s *streaks) reset(id int64) {
+	s.mu.Lock()
+	delete(s.m, id)
+	s.mu.Unlock()
+}
+
+// quarantine quarantines a ChatGPT account once QuarantineThreshold
+// consecutive responses, the last being resp, were 403, n of them according
+// to the streak. It reports whether it did.
+func (h *Handler) quarantine(ctx context.Context, a *acct.Account, resp *http.Response, n int) bool {
+	if h.QuarantineThreshold <= 0 || a.Type != acct.ChatGPTAccount || resp.StatusCode != http.StatusForbidden || n < h.QuarantineThreshold {
+		return false
+	}
+	h.streaks.reset(a.ID)
+	until := time.Now().Add(h.QuarantineCooldown)
+	msg := fmt.Sprintf("%d consecutive 403 responses", n)
+	logger.Warnc(ctx, "account %d quarantined until %v: %s", a.ID, until, msg)
+	if q, ok := h.Scheduler.(Quarantiner); ok {
+		q.Quarantine(ctx, a.ID, msg, until)
+	} else {
+		h.Scheduler.MarkExhausted(ctx, a.ID, until)
+	}
+	return true
+}
+
+// Probe sends a model listing request upstream with a's credentials and
+// returns the response status, so an operator can check whether a
+// quarantined account is accepted again. ChatGPT tokens must be current.
+func (h *Handler) Probe(ctx context.Context, a *acct.Account) (int, error) {
+	base, path := h.upstreamTarget(a, "/v1/models")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	setCredentials(req.Header, a)
+	client, err := h.client(a)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	h.streaks.record(a.ID, resp.StatusCode)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+)
+
+func TestQuarantineRepeated403(t *testing.T) {
+	var banned atomic.Bool
+	banned.Store(true)
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer at" && banned.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	h.QuarantineThreshold = 2
+	ctx := context.Background()
+	a, _ := mgr.AddChatGPT(ctx, "cg", "rt", "aid", 1)
+	a.AccessToken, a.TokenExpiresAt = "at", time.Now().Add(time.Hour)
+	mgr.Update(ctx, a)
+	mgr.AddAPIKey(ctx, "key", "k", "", 2)
+	got := make(chan events.Event, 1)
+	defer events.Default.Subscribe(func(e events.Event) { got <- e }, events.AccountQuarantined)()
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`)))
+		return rec
+	}
+	// A single 403 is the client's, as the error rules say.
+	if rec := send(); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if rec := send(); rec.Code != 200 || rec.Body.String() != "Bearer k" {
+		t.Fatalf("expected rotation after quarantine, got %d %s", rec.Code, rec.Body.String())
+	}
+	if e := <-got; e.AccountID != a.ID {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	a, _ = mgr.Get(ctx, a.ID)
+	if a.BlockReason != account.BlockQuarantined || time.Until(a.ResetAt) < 24*time.Hour {
+		t.Fatalf("account not quarantined: %+v", a)
+	}
+
+	if status, err := h.Probe(ctx, a); err != nil || status != http.StatusForbidden {
+		t.Fatalf("probe: %d %v", status, err)
+	}
+	banned.Store(false)
+	if status, err := h.Probe(ctx, a); err != nil || status != http.StatusOK {
+		t.Fatalf("probe: %d %v", status, err)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Blocker is optionally implemented by a Selector that distinguishes
+// billing blocks from ordinary exhaustion. Without it MarkExhausted is used.
+type Blocker interface {
+	MarkBlocked(ctx context.Context, id int64, reason string, resetAt time.Time)
+}
+
+// billingErrorCodes are OpenAI error codes meaning an API key cannot be used
+// until its billing is fixed. Retrying such an account on the next request
+// only fails again.
+var billingErrorCodes = map[string]bool{
+	"insufficient_quota":          true,
+	"billing_hard_limit_reached":  true,
+	"billing_not_active":          true,
+	"account_deactivated":         true,
+	"access_terminated":           true,
+	"organization_quota_exceeded": true,
+}
+
+// billingError returns the billing error code of a 4xx response from an API
+// key account, or "" if it is not one. The body is restored for the client.
+func billingError(a *acct.Account, resp *http.Response) string {
+	if a.Type != acct.APIKeyAccount || resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		return ""
+	}
+	code, typ := errorCode(resp)
+	for _, c := range []string{code, typ} {
+		if billingErrorCodes[c] {
+			return c
+		}
+	}
+	return ""
+}
+
+// block takes a billing-blocked account out of rotation for BillingCooldown.
+func (h *Handler) block(ctx context.Context, a *acct.Account, reason string) {
+	until := time.Now().Add(h.BillingCooldown)
+	logger.Warnc(ctx, "account %d billing blocked: %s", a.ID, reason)
+	if b, ok := h.Scheduler.(Blocker); ok {
+		b.MarkBlocked(ctx, a.ID, reason, until)
+		return
+	}
+	h.Scheduler.MarkExhausted(ctx, a.ID, until)
+}
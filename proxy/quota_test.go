@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPBillingBlocked(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer k1":
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`)
+		case "Bearer k2":
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"message":"bad model","type":"invalid_request_error","code":"model_not_found"}}`)
+		}
+	})
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the second account's 400, got %d", rec.Code)
+	}
+	got, _ := mgr.Get(ctx, a1.ID)
+	if !got.Exhausted || got.BlockReason != "insufficient_quota" || got.ResetAt.Before(time.Now().Add(23*time.Hour)) {
+		t.Fatalf("account not billing blocked: %+v", got)
+	}
+	// ordinary client errors do not block the account
+	if got, _ := mgr.Get(ctx, a2.ID); got.Exhausted || got.BlockReason != "" {
+		t.Fatalf("account blocked by non-billing error: %+v", got)
+	}
+	// reactivation clears the reason
+	mgr.Reactivate(ctx, a1.ID)
+	if got, _ := mgr.Get(ctx, a1.ID); got.BlockReason != "" {
+		t.Fatalf("block reason not cleared: %q", got.BlockReason)
+	}
+}
+
+func TestBillingErrorSingleAccount(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"error":{"code":"billing_hard_limit_reached"}}`)
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the only account is blocked, got %d", rec.Code)
+	}
+	if got, _ := mgr.Get(ctx, a.ID); got.BlockReason != "billing_hard_limit_reached" {
+		t.Fatalf("unexpected block reason %q", got.BlockReason)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// rateLimitReset returns when an account rejected by resp may be used
+// again according to the upstream, or the zero time when it does not say.
+// The sources, in order of preference, are Retry-After (seconds or an HTTP
+// date), the x-ratelimit-reset-* headers (e.g. "6m0s") of the limits whose
+// x-ratelimit-remaining-* is 0, or of all of them if none is, and the
+// resets_in_seconds or resets_at fields of the error body. Of several
+// reset headers the latest wins. Times not after now are ignored.
+func rateLimitReset(resp *http.Response, now time.Time) time.Time {
+	if t := retryAfter(resp.Header.Get("Retry-After"), now); t.After(now) {
+		return t
+	}
+	var latest, latestExhausted time.Time
+	for k, v := range resp.Header {
+		limit, ok := strings.CutPrefix(strings.ToLower(k), "x-ratelimit-reset-")
+		if !ok || len(v) == 0 {
+			continue
+		}
+		d, ok := parseReset(v[0])
+		if !ok {
+			continue
+		}
+		t := now.Add(d)
+		if t.After(latest) {
+			latest = t
+		}
+		if resp.Header.Get("X-Ratelimit-Remaining-"+limit) == "0" && t.After(latestExhausted) {
+			latestExhausted = t
+		}
+	}
+	if latestExhausted.After(now) {
+		return latestExhausted
+	}
+	if latest.After(now) {
+		return latest
+	}
+	if t := bodyReset(resp, now); t.After(now) {
+		return t
+	}
+	return time.Time{}
+}
+
+// retryAfter parses a Retry-After value relative to now.
+func retryAfter(v string, now time.Time) time.Time {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return now.Add(time.Duration(secs) * time.Second)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// parseReset parses an x-ratelimit-reset-* value: a duration such as "1s",
+// "6m0s" or "20ms", or a number of seconds.
+func parseReset(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, true
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(secs, 0) && !math.IsNaN(secs) {
+		return time.Duration(secs * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// bodyReset reads the reset time of a ChatGPT usage limit error, whose body
+// carries resets_in_seconds and resets_at (Unix seconds). The body is
+// restored so it can still be sent to the client.
+func bodyReset(resp *http.Response, now time.Time) time.Time {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		logger.Warnf("read error body: %v", err)
+		return time.Time{}
+	}
+	var e struct {
+		Error struct {
+			ResetsInSeconds float64 `json:"resets_in_seconds"`
+			ResetsAt        int64   `json:"resets_at"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return time.Time{}
+	}
+	switch {
+	case e.Error.ResetsInSeconds > 0:
+		return now.Add(time.Duration(e.Error.ResetsInSeconds * float64(time.Second)))
+	case e.Error.ResetsAt > 0:
+		return time.Unix(e.Error.ResetsAt, 0)
+	}
+	return time.Time{}
+}
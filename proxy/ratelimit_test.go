@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitReset(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   time.Duration
+	}{
+		{"retry after seconds", http.Header{"Retry-After": {"120"}}, "", 2 * time.Minute},
+		{"retry after date", http.Header{"Retry-After": {now.Add(time.Hour).Format(http.TimeFormat)}}, "", time.Hour},
+		{"retry after wins", http.Header{"Retry-After": {"5"}, "X-Ratelimit-Reset-Requests": {"1m"}}, "", 5 * time.Second},
+		{"exhausted limit", http.Header{
+			"X-Ratelimit-Reset-Requests":     {"6m0s"},
+			"X-Ratelimit-Remaining-Requests": {"12"},
+			"X-Ratelimit-Reset-Tokens":       {"20ms"},
+			"X-Ratelimit-Remaining-Tokens":   {"0"},
+		}, "", 20 * time.Millisecond},
+		{"latest reset", http.Header{"X-Ratelimit-Reset-Requests": {"1s"}, "X-Ratelimit-Reset-Tokens": {"1.5"}}, "", 1500 * time.Millisecond},
+		{"body seconds", nil, `{"error":{"type":"usage_limit_reached","resets_in_seconds":3600}}`, time.Hour},
+		{"body time", nil, `{"error":{"type":"usage_limit_reached","resets_at":` + strconv.FormatInt(now.Add(90*time.Minute).Unix(), 10) + `}}`, 90 * time.Minute},
+		{"past", http.Header{"Retry-After": {"0"}}, `{"error":{"resets_at":1}}`, 0},
+		{"none", http.Header{"Retry-After": {"soon"}}, `not json`, 0},
+	}
+	for _, c := range cases {
+		resp := &http.Response{Header: c.header, Body: io.NopCloser(strings.NewReader(c.body))}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		got := rateLimitReset(resp, now)
+		if b, _ := io.ReadAll(resp.Body); string(b) != c.body {
+			t.Fatalf("%s: body not restored: %q", c.name, b)
+		}
+		if c.want == 0 {
+			if !got.IsZero() {
+				t.Fatalf("%s: expected no reset, got %s", c.name, got)
+			}
+			continue
+		}
+		if !got.Equal(now.Add(c.want)) {
+			t.Fatalf("%s: got %s, want %s", c.name, got, now.Add(c.want))
+		}
+	}
+}
+
+func TestRateLimitedAccountReset(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer k1" {
+			w.Header().Set("Retry-After", "90")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "limited", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "spare", "k2", "", 2)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`)))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	got, _ := mgr.Get(ctx, a.ID)
+	if d := time.Until(got.ResetAt); d < 80*time.Second || d > 90*time.Second {
+		t.Fatalf("expected a reset in 90s, got %s", d)
+	}
+}
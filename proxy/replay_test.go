@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kxn/codex-companion/internal/replay"
+)
+
+// TestReplayRetryAndStream replays a recorded 429 followed by a streamed
+// response and checks retry, normalization and passthrough end to end.
+func TestReplayRetryAndStream(t *testing.T) {
+	h, mgr, ls := setupProxy(t, nil)
+	rp, err := replay.LoadReplayer("testdata/retry_stream.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.UpstreamAPI = "https://api.openai.com"
+	h.Client.Transport = rp
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"model":"gpt-5","stream":true,"include":["reasoning.encrypted_content"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("bad resp %d %v", rec.Code, rec.Header())
+	}
+	if !strings.Contains(rec.Body.String(), "event: response.completed") {
+		t.Fatalf("stream not passed through: %s", rec.Body.String())
+	}
+	got := rp.Received()
+	if len(got) != 2 || got[0].Header.Get("Authorization") != "Bearer k1" || got[1].Header.Get("Authorization") != "Bearer k2" {
+		t.Fatalf("unexpected upstream requests %+v", got)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(got[1].Body, &body); err != nil || body["store"] != true || body["include"] != nil {
+		t.Fatalf("body not normalized: %s", got[1].Body)
+	}
+	if len(rp.Unused()) != 0 {
+		t.Fatalf("unused interactions: %d", len(rp.Unused()))
+	}
+	if a, _ := mgr.Get(ctx, a1.ID); !a.Exhausted {
+		t.Fatalf("account %d not marked exhausted", a1.ID)
+	}
+	logs, _ := ls.List(ctx, 10, 0)
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 logged attempts, got %d", len(logs))
+	}
+}
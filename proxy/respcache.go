@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+	"github.com/kxn/codex-companion/internal/tokenizer"
+	"github.com/kxn/codex-companion/log"
+)
+
+// ResponseCacheHeader is "hit" on responses served from the ResponseCache.
+const ResponseCacheHeader = "X-Companion-Response-Cache"
+
+// ResponseCache keeps the complete successful responses of deterministic
+// requests, Responses API and Chat Completions requests with a temperature
+// of 0, so that a client repeating one is answered without an upstream
+// request or account quota. Entries are keyed by the client key, path and
+// body, expire after their TTL and are evicted least recently used first
+// once the cache holds more than its size in bytes.
+type ResponseCache struct {
+	ttl     time.Duration
+	size    int
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru orders the entries, most recently used first.
+	lru  list.List
+	used int
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// bytes is what the entry counts against the cache size.
+func (e *cachedResponse) bytes() int {
+	n := len(e.key) + len(e.body)
+	for k, v := range e.header {
+		n += len(k)
+		for _, vv := range v {
+			n += len(vv)
+		}
+	}
+	return n
+}
+
+// NewResponseCache creates a ResponseCache keeping responses for ttl in at
+// most size bytes.
+func NewResponseCache(ttl time.Duration, size int) *ResponseCache {
+	return &ResponseCache{ttl: ttl, size: size, now: time.Now, entries: make(map[string]*list.Element)}
+}
+
+// get returns the unexpired entry of key, or nil.
+func (c *ResponseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cachedResponse)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// put stores e, evicting the least recently used entries to make room. An
+// entry larger than the whole cache is not stored.
+func (c *ResponseCache) put(e *cachedResponse) {
+	n := e.bytes()
+	if n > c.size {
+		return
+	}
+	e.expires = c.now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	for c.used+n > c.size {
+		c.remove(c.lru.Back())
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.used += n
+}
+
+func (c *ResponseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cachedResponse)
+	delete(c.entries, e.key)
+	c.used -= e.bytes()
+}
+
+// Len returns the number of cached responses and their size in bytes.
+func (c *ResponseCache) Len() (entries, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.used
+}
+
+var responseCacheRequests = metrics.Default.NewCounter("companion_response_cache_total", "Cacheable requests by whether the response cache answered them.", "result")
+
+// responseCacheKey returns the key of pr in the ResponseCache, or "" when
+// its response must not be cached: it is not a JSON Responses API or Chat
+// Completions request with a temperature of 0, or it forces an account.
+// Clients never share entries.
+func responseCacheKey(pr *ProxyRequest) string {
+	r := pr.Request
+	if r.Method != http.MethodPost || isForm(r.Header) || r.Header.Get(ForceAccountHeader) != "" ||
+		r.URL.Path != "/v1/responses" && r.URL.Path != "/v1/chat/completions" {
+		return ""
+	}
+	var m struct {
+		Temperature *float64 `json:"temperature"`
+	}
+	if json.Unmarshal(pr.Body, &m) != nil || m.Temperature == nil || *m.Temperature != 0 {
+		return ""
+	}
+	sum := sha256.New()
+	sum.Write([]byte(pr.ClientKey + "\x00" + r.URL.Path + "\x00"))
+	sum.Write(pr.Body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// responseCache answers deterministic requests from the ResponseCache and
+// stores the responses of those it passes on when they succeed and reach
+// the client complete. A client sending "Cache-Control: no-cache" gets a
+// fresh response, which replaces the cached one. Hits are logged without
+// an account.
+func (h *Handler) responseCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr := RequestFrom(r)
+		key := ""
+		if h.Cache != nil {
+			key = responseCacheKey(pr)
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			if e := h.Cache.get(key); e != nil {
+				responseCacheRequests.Inc("hit")
+				logger.Infoc(r.Context(), "answered from the response cache")
+				h.serveCached(w, pr, e, start)
+				return
+			}
+		}
+		responseCacheRequests.Inc("miss")
+		rec := &cacheRecorder{ResponseWriter: w, limit: h.Cache.size}
+		next.ServeHTTP(rec, r)
+		if rec.status != http.StatusOK || rec.overflow || rec.failed || pr.interrupted || hasTrailers(w.Header()) {
+			return
+		}
+		header := w.Header().Clone()
+		for _, k := range []string{RequestIDHeader, AccountHeader, AccountIDHeader, AttemptsHeader, CacheHeader} {
+			header.Del(k)
+		}
+		h.Cache.put(&cachedResponse{key: key, status: rec.status, header: header, body: rec.body})
+	})
+}
+
+// serveCached writes the cached response e and logs the hit.
+func (h *Handler) serveCached(w http.ResponseWriter, pr *ProxyRequest, e *cachedResponse, start time.Time) {
+	for k, v := range e.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set(ResponseCacheHeader, "hit")
+	w.WriteHeader(e.status)
+	if _, err := w.Write(e.body); err != nil {
+		logger.Warnc(pr.Request.Context(), "write cached response: %v", err)
+	}
+	r := pr.Request
+	body := e.body
+	if h.LogBodyLimit > 0 && len(body) > h.LogBodyLimit {
+		body = body[:h.LogBodyLimit]
+	}
+	rl := &log.RequestLog{
+		Time:       time.Now(),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		ReqHeader:  r.Header.Clone(),
+		RespHeader: e.header.Clone(),
+		Status:     e.status,
+		DurationMs: time.Since(start).Milliseconds(),
+		ClientKey:  pr.ClientKey,
+		Model:      pr.model(),
+		Session:    cacheKey(r, pr.Body),
+		CacheHit:   true,
+	}
+	h.recordLog(r.Context(), rl, func(rl *log.RequestLog) {
+		rl.ReqBody, rl.RespBody = string(pr.Body), string(body)
+		rl.EstimatedTokens = int64(tokenizer.EstimateRequest(pr.Body))
+	})
+}
+
+// hasTrailers reports whether header announces trailers, which are not
+// cached.
+func hasTrailers(header http.Header) bool {
+	if header.Get("Trailer") != "" {
+		return true
+	}
+	for k := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder passes a response on to the client while keeping a copy of
+// its status and body, up to limit bytes. failed records that the client
+// did not receive all of it.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     []byte
+	limit    int
+	overflow bool
+	failed   bool
+}
+
+func (c *cacheRecorder) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheRecorder) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow {
+		if len(c.body)+len(p) > c.limit {
+			c.overflow, c.body = true, nil
+		} else {
+			c.body = append(c.body, p...)
+		}
+	}
+	n, err := c.ResponseWriter.Write(p)
+	if err != nil {
+		c.failed = true
+	}
+	return n, err
+}
+
+func (c *cacheRecorder) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *cacheRecorder) Unwrap() http.ResponseWriter { return c.ResponseWriter }
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	calls := 0
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "fail") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"output_text":"4","usage":{"input_tokens":5,"output_tokens":1}}`)
+	})
+	h.Cache = NewResponseCache(time.Minute, 1<<20)
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	send := func(token, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	const body = `{"model":"gpt-5","input":"2+2?","temperature":0}`
+	first := send("c1", body)
+	second := send("c1", body)
+	if calls != 1 || second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Fatalf("%d upstream calls, second response %d %s", calls, second.Code, second.Body)
+	}
+	if second.Header().Get(ResponseCacheHeader) != "hit" || first.Header().Get(ResponseCacheHeader) != "" ||
+		second.Header().Get("Content-Type") != "application/json" || second.Header().Get(RequestIDHeader) == first.Header().Get(RequestIDHeader) {
+		t.Fatalf("unexpected headers %v", second.Header())
+	}
+	logs, _ := ls.List(ctx, 2, 0)
+	if len(logs) != 2 || !logs[0].CacheHit || logs[0].AccountID != 0 || logs[0].InputTokens != 0 || logs[0].EstimatedTokens == 0 || logs[1].CacheHit {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+
+	// Other clients, sampled requests, refreshes and failures miss.
+	send("c2", body)
+	send("c1", `{"model":"gpt-5","input":"2+2?","temperature":0.7}`)
+	send("c1", `{"model":"gpt-5","input":"2+2?","temperature":0.7}`)
+	send("c1", body, "Cache-Control", "no-cache")
+	send("c1", `{"model":"gpt-5","input":"fail","temperature":0}`)
+	send("c1", `{"model":"gpt-5","input":"fail","temperature":0}`)
+	if calls != 7 {
+		t.Fatalf("%d upstream calls, want 7", calls)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	now := time.Now()
+	c := NewResponseCache(time.Minute, 30)
+	c.now = func() time.Time { return now }
+	entry := func(key string) *cachedResponse {
+		return &cachedResponse{key: key, status: http.StatusOK, body: []byte("0123456789")}
+	}
+	c.put(entry("a"))
+	c.put(entry("b"))
+	c.get("a")
+	// "b" is the least recently used.
+	c.put(entry("c"))
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil {
+		t.Fatal("expected b evicted")
+	}
+	if n, size := c.Len(); n != 2 || size != 22 {
+		t.Fatalf("%d entries of %d bytes", n, size)
+	}
+	c.put(&cachedResponse{key: "big", body: make([]byte, 40)})
+	if c.get("big") != nil {
+		t.Fatal("stored an entry larger than the cache")
+	}
+	now = now.Add(time.Minute)
+	if c.get("a") != nil {
+		t.Fatal("expected a expired")
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+// Informational headers added to client responses when enabled in
+// Handler.ResponseHeaders, so downstream tooling can see how each call was
+// served.
+const (
+	// AccountHeader names the account that served the request.
+	AccountHeader = "X-Companion-Account"
+	// AccountIDHeader carries the ID of that account.
+	AccountIDHeader = "X-Companion-Account-Id"
+	// AttemptsHeader counts the upstream attempts made, including the one
+	// that served the request.
+	AttemptsHeader = "X-Companion-Attempts"
+	// CacheHeader is "hit" when cache affinity sent the request to the
+	// account that last served its prompt cache key and "miss" otherwise.
+	// It is only set for requests with a key while CacheAffinity is on.
+	CacheHeader = "X-Companion-Cache"
+)
+
+// responseHeaderOptions maps the names accepted by ParseResponseHeaders to
+// the headers they enable.
+var responseHeaderOptions = map[string]string{
+	"account":    AccountHeader,
+	"account-id": AccountIDHeader,
+	"attempts":   AttemptsHeader,
+	"cache":      CacheHeader,
+}
+
+// ParseResponseHeaders reads a comma-separated list of informational
+// response headers to enable, such as "account,attempts,cache", into the
+// header names for Handler.ResponseHeaders.
+func ParseResponseHeaders(s string) ([]string, error) {
+	var headers []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		h, ok := responseHeaderOptions[part]
+		if !ok {
+			return nil, fmt.Errorf("unknown response header %q", part)
+		}
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
+// setResponseHeaders adds the enabled informational headers to w for a
+// response served by account a after attempts attempts. cache is "hit",
+// "miss" or empty when cache affinity did not apply.
+func (h *Handler) setResponseHeaders(w http.ResponseWriter, a *acct.Account, attempts int, cache string) {
+	for _, name := range h.ResponseHeaders {
+		switch name {
+		case AccountHeader:
+			w.Header().Set(name, a.Name)
+		case AccountIDHeader:
+			w.Header().Set(name, strconv.FormatInt(a.ID, 10))
+		case AttemptsHeader:
+			w.Header().Set(name, strconv.Itoa(attempts))
+		case CacheHeader:
+			if cache != "" {
+				w.Header().Set(name, cache)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResponseHeaders(t *testing.T) {
+	got, err := ParseResponseHeaders(" Account, attempts ,cache")
+	if err != nil || strings.Join(got, ",") != AccountHeader+","+AttemptsHeader+","+CacheHeader {
+		t.Fatalf("unexpected headers %v %v", got, err)
+	}
+	if _, err := ParseResponseHeaders("account,price"); err == nil {
+		t.Fatal("expected error for unknown header")
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer k1" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "limited", "k1", "", 1)
+	b, _ := mgr.AddAPIKey(ctx, "spare", "k2", "", 2)
+	send := func(body string) http.Header {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(body)))
+		if rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+		return rec.Header()
+	}
+
+	if got := send(`{}`); got.Get(AccountHeader) != "" || got.Get(AttemptsHeader) != "" {
+		t.Fatalf("headers added while disabled: %v", got)
+	}
+	h.ResponseHeaders = []string{AccountHeader, AccountIDHeader, AttemptsHeader, CacheHeader}
+	// The first request exhausted the limited account.
+	mgr.Reactivate(ctx, a.ID)
+	got := send(`{}`)
+	if got.Get(AccountHeader) != "spare" || got.Get(AccountIDHeader) != strconv.FormatInt(b.ID, 10) || got.Get(AttemptsHeader) != "2" || got.Get(CacheHeader) != "" {
+		t.Fatalf("unexpected headers %v", got)
+	}
+
+	h.CacheAffinity = time.Hour
+	if got := send(`{"prompt_cache_key":"conv"}`); got.Get(CacheHeader) != "miss" || got.Get(AttemptsHeader) != "1" {
+		t.Fatalf("unexpected headers %v", got)
+	}
+	if got := send(`{"prompt_cache_key":"conv"}`); got.Get(CacheHeader) != "hit" {
+		t.Fatalf("unexpected headers %v", got)
+	}
+}
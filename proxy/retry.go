@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// retry is the final request stage. It asks the Selector for an account,
+// runs the attempt chain and moves on to another account when the upstream
+// fails or reports the account exhausted. Every account is tried at most
+// once per request. A response is only retried before any of it reaches
+// the client; one breaking off later is reported, see InterruptedCode.
+// When no account is left, or the last attempt exhausted its account too,
+// the last response rotated away from without exhausting its account is
+// returned unchanged, as is a 429 when pass-through applies to the client;
+// otherwise the client gets a 503.
+func (h *Handler) retry(w http.ResponseWriter, r *http.Request) {
+	pr := RequestFrom(r)
+	if r.Header.Get(ForceAccountHeader) != "" && !h.mayForce(pr) {
+		logger.Warnc(r.Context(), "client key %q may not send %s", pr.ClientKey, ForceAccountHeader)
+		fail(w, pr, http.StatusForbidden, "client key may not choose the account", errors.New("account forcing not allowed"))
+		return
+	}
+	ctx := scheduler.WithRoute(r.Context(), h.route(pr))
+	attempt := ChainAttempt(h.send, h.attemptMiddlewares()...)
+	tried := make(map[int64]bool)
+	tracing := h.tracing(pr)
+	var key string
+	if h.CacheAffinity > 0 {
+		key = cacheKey(pr.Request, pr.Body)
+	}
+	var pending *http.Response
+	defer func() {
+		if pending != nil {
+			pending.Body.Close()
+		}
+	}()
+	// rotate discards resp before trying another account, keeping it if it
+	// may have to be returned after all.
+	rotate := func(resp *http.Response, keep bool) {
+		if !keep && (resp.StatusCode != http.StatusTooManyRequests || !h.passes429(pr)) {
+			resp.Body.Close()
+			return
+		}
+		if pending != nil {
+			pending.Body.Close()
+		}
+		pending = resp
+	}
+	noAccounts := func(err error) {
+		if pending != nil {
+			writeResponse(w, pending)
+			pending = nil
+			return
+		}
+		msg := "no accounts available"
+		extra := map[string]any{}
+		var na *scheduler.NoAccountsError
+		if errors.As(err, &na) {
+			if h.AccountSummary {
+				extra["accounts"] = na.Summary
+			}
+			// Operator notes, such as when a plan renews, tell clients
+			// what they are waiting for.
+			if notes := na.Summary.Notes; len(notes) > 0 {
+				msg += ": " + strings.Join(notes, "; ")
+				extra["notes"] = notes
+			}
+		}
+		failWith(w, pr, http.StatusServiceUnavailable, msg, err, extra)
+	}
+	for i := 0; i < maxAttempts; i++ {
+		last := i == maxAttempts-1
+		pr.Hook.Attempt = i
+		trace, tctx := newTrace(ctx, tracing)
+		account, err := h.next(tctx, tried, key)
+		if err != nil {
+			logger.Errorc(ctx, "no accounts available: %v", err)
+			h.runErrorHooks(pr.Hook, err)
+			noAccounts(err)
+			return
+		}
+		tried[account.ID] = true
+		pr.Hook.Account = account
+		if err := h.runAccountSelectedHooks(pr.Hook, account); err != nil {
+			logger.Warnc(ctx, "account %d skipped by hook: %v", account.ID, err)
+			h.runErrorHooks(pr.Hook, err)
+			if last {
+				noAccounts(err)
+				return
+			}
+			continue
+		}
+		logger.Debugc(ctx, "attempt %d using account %d type %d", i, account.ID, account.Type)
+
+		resp, err := attempt(&Attempt{ProxyRequest: pr, Index: i, Account: account, Decision: trace, Start: time.Now()})
+		if err != nil {
+			var ae *abortError
+			if errors.As(err, &ae) {
+				fail(w, pr, ae.status, ae.msg, ae.err)
+				return
+			}
+			h.runErrorHooks(pr.Hook, err)
+			if ctx.Err() == context.DeadlineExceeded {
+				fail(w, pr, http.StatusGatewayTimeout, "request timeout", err)
+				return
+			}
+			if last || !h.backoff(ctx, i) {
+				fail(w, pr, http.StatusBadGateway, "upstream error", err)
+				return
+			}
+			continue
+		}
+
+		if reason := billingError(account, resp); reason != "" {
+			h.block(ctx, account, reason)
+			if !last {
+				rotate(resp, false)
+				continue
+			}
+		} else if n := h.streaks.record(account.ID, resp.StatusCode); h.quarantine(ctx, account, resp, n) || h.invalidToken(ctx, account, resp, n) {
+			if !last {
+				rotate(resp, false)
+				continue
+			}
+		} else {
+			switch rule := h.classify(resp); rule.Scope {
+			case ScopeAccount:
+				now := time.Now()
+				until := rateLimitReset(resp, now)
+				if until.IsZero() {
+					until = now.Add(rule.Cooldown)
+				}
+				logger.Warnc(ctx, "account %d exhausted by %s until %s", account.ID, rule, until.UTC().Format(time.RFC3339))
+				h.Scheduler.MarkExhausted(ctx, account.ID, until)
+				rotate(resp, false)
+				if !last {
+					continue
+				}
+				// The Selector tells when an account is available again,
+				// as it would for another attempt.
+				if _, err = h.next(tctx, tried, key); err == nil {
+					err = &scheduler.NoAccountsError{ResetAt: until}
+				}
+				noAccounts(err)
+				return
+			case ScopeRotate:
+				logger.Warnc(ctx, "account %d returned %d, trying next account", account.ID, resp.StatusCode)
+				if !last {
+					rotate(resp, true)
+					continue
+				}
+			}
+		}
+		var cache string
+		if key != "" {
+			cache = "miss"
+			if h.pins.get(key) == account.ID {
+				cache = "hit"
+			}
+		}
+		if key != "" && resp.StatusCode < 400 {
+			h.pins.set(key, account.ID, h.CacheAffinity)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			if err := awaitBody(resp); err != nil {
+				logger.Warnc(ctx, "account %d response failed before any output: %v", account.ID, err)
+				resp.Body.Close()
+				h.runErrorHooks(pr.Hook, err)
+				if last || !h.backoff(ctx, i) {
+					fail(w, pr, http.StatusBadGateway, "upstream error", err)
+					return
+				}
+				continue
+			}
+		}
+		h.setResponseHeaders(w, account, i+1, cache)
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			tunnel(w, r, resp)
+			return
+		}
+		if err := writeResponse(w, resp); err != nil {
+			h.interrupted(w, pr, resp, err)
+		}
+		return
+	}
+}
+
+// backoff waits before the attempt after transport error number i (from 0):
+// RetryBackoff doubled per attempt, with the upper half randomized so that
+// requests failing together do not retry together. It returns false when ctx
+// ends first.
+func (h *Handler) backoff(ctx context.Context, i int) bool {
+	if h.RetryBackoff <= 0 {
+		return true
+	}
+	d := h.RetryBackoff << i
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// passes429 reports whether the client of pr gets upstream 429 responses
+// instead of a 503 once every account is exhausted.
+func (h *Handler) passes429(pr *ProxyRequest) bool {
+	if h.Pass429 {
+		return true
+	}
+	for _, k := range h.Pass429Keys {
+		if k == pr.ClientKey && k != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryAfterError is implemented by Selector errors that know when an
+// account becomes available again. *scheduler.NoAccountsError implements it.
+type RetryAfterError interface {
+	error
+	RetryAt() time.Time
+}
+
+// fail writes a JSON error response for a request no account could serve and
+// publishes a RequestFailed event. When err carries a RetryAt time the client
+// is told when to retry through Retry-After and the body.
+func fail(w http.ResponseWriter, pr *ProxyRequest, status int, msg string, err error) {
+	failWith(w, pr, status, msg, err, nil)
+}
+
+// failWith is fail with extra fields added to the error body.
+func failWith(w http.ResponseWriter, pr *ProxyRequest, status int, msg string, err error, extra map[string]any) {
+	e := events.Event{
+		Type:    events.RequestFailed,
+		Message: msg,
+		Data:    map[string]any{"path": pr.Request.URL.Path, "status": status, "error": err.Error(), "request_id": pr.ID},
+	}
+	if pr.Hook.Account != nil {
+		e.AccountID = pr.Hook.Account.ID
+	}
+	events.Publish(e)
+	body := map[string]any{"message": msg, "type": "server_error"}
+	var ra RetryAfterError
+	if errors.As(err, &ra) && !ra.RetryAt().IsZero() {
+		secs := int64(math.Ceil(time.Until(ra.RetryAt()).Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		body["retry_after"] = secs
+		body["reset_at"] = ra.RetryAt().UTC().Format(time.RFC3339)
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	writeError(w, status, body)
+}
+
+// writeError writes an OpenAI-style JSON error response.
+func writeError(w http.ResponseWriter, status int, body map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]any{"error": body}); err != nil {
+		logger.Errorf("write error response: %v", err)
+	}
+}
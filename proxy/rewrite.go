@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// UpstreamMiddleware adjusts the upstream request of an attempt before it is
+// sent. It sees the selected account in at.Account and may replace
+// at.UpstreamBody, change the headers of at.Upstream, which already carry
+// the account's credentials, or block the attempt by returning an error;
+// a *HookError chooses the status the client gets, other errors fail the
+// request with 403. Blocking does not try another account.
+type UpstreamMiddleware func(at *Attempt) error
+
+// Use adds upstream middleware run after the built-in ones, which set the
+// store and include parameters for the account type, map the model and
+// apply FieldPolicies and Annotations, in the order added. Use must not be called while the
+// Handler is serving requests.
+func (h *Handler) Use(mws ...UpstreamMiddleware) {
+	h.rewrites = append(h.rewrites, mws...)
+}
+
+// upstreamMiddlewares returns the built-in upstream middleware followed by
+// the ones added with Use.
+func (h *Handler) upstreamMiddlewares() []UpstreamMiddleware {
+	return append([]UpstreamMiddleware{normalizeParams, h.fieldPolicies, h.annotate}, h.rewrites...)
+}
+
+// rewrite runs the upstream middleware on at, turning a block into an
+// abortError.
+func (h *Handler) rewrite(at *Attempt) error {
+	for _, mw := range h.upstreamMiddlewares() {
+		if err := mw(at); err != nil {
+			h.runErrorHooks(at.Hook, err)
+			var he *HookError
+			if errors.As(err, &he) && he.Status != 0 {
+				return &abortError{status: he.Status, msg: he.Message, err: err}
+			}
+			return &abortError{status: http.StatusForbidden, msg: "request blocked", err: err}
+		}
+	}
+	return nil
+}
+
+// normalizeParams is the built-in upstream middleware applying
+// normalizeBody to JSON bodies.
+func normalizeParams(at *Attempt) error {
+	if !isForm(at.Request.Header) {
+		at.UpstreamBody = normalizeBody(at.Account, at.Endpoint, at.UpstreamBody)
+	}
+	return nil
+}
+
+// fieldPolicies is the built-in upstream middleware applying FieldPolicies
+// to Responses API bodies.
+func (h *Handler) fieldPolicies(at *Attempt) error {
+	if !isForm(at.Request.Header) && strings.HasPrefix(at.Endpoint, "/v1/responses") {
+		at.UpstreamBody = applyFieldPolicies(h.FieldPolicies, at.Account.Type, at.UpstreamBody)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamMiddleware(t *testing.T) {
+	var gotBody, gotHeader string
+	calls := 0
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		b, _ := io.ReadAll(r.Body)
+		gotBody, gotHeader = string(b), r.Header.Get("X-Tenant")
+		io.WriteString(w, "ok")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	var seen string
+	h.Use(func(at *Attempt) error {
+		// The built-in normalization has already run.
+		seen = string(at.UpstreamBody)
+		at.Upstream.Header.Set("X-Tenant", "acme")
+		at.UpstreamBody = []byte(strings.Replace(string(at.UpstreamBody), "gpt-5", "gpt-5-mini", 1))
+		return nil
+	}, func(at *Attempt) error {
+		if strings.Contains(string(at.UpstreamBody), "forbidden") {
+			return &HookError{Status: http.StatusUnprocessableEntity, Message: "blocked by policy"}
+		}
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"model":"gpt-5","store":false}`)))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected resp %d %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(seen, `"store":true`) || gotBody != `{"model":"gpt-5-mini","store":true}` || gotHeader != "acme" {
+		t.Fatalf("seen %s, upstream got %s with tenant %q", seen, gotBody, gotHeader)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"input":"forbidden"}`)))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "blocked by policy") || calls != 1 {
+		t.Fatalf("unexpected resp %d %s after %d upstream calls", rec.Code, rec.Body.String(), calls)
+	}
+}
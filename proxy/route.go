@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// RouteHeader lets a client opt out of least-cost routing for a request:
+// "premium" has accounts selected in priority order, e.g. for a task that
+// should run on the best account regardless of price. The header is not
+// forwarded upstream.
+const RouteHeader = "X-Companion-Route"
+
+// ForceAccountHeader forces a request onto an account, named by name or
+// ID, or onto a group of accounts ("primary", "backup", "apikey" or
+// "chatgpt"), bypassing rotation, e.g. to debug one upstream or reproduce
+// an account-specific failure. Only the client keys in
+// Handler.ForceAccountKeys may send it. It shares its name with the
+// AccountHeader response header, and is not forwarded upstream.
+const ForceAccountHeader = "X-Companion-Account"
+
+// ClientPin designates the account serving a client key's requests.
+type ClientPin struct {
+	Account int64
+	// Fallback allows other accounts once the pinned one is unavailable;
+	// without it the client gets a 503 instead.
+	Fallback bool
+}
+
+// ParseClientPins reads a comma-separated list of key=account pins, such
+// as "ck-0123456789abcdef0123456789abcdef=3,ck-fedcba9876543210fedcba9876543210=5:fallback",
+// mapping client key IDs to account IDs. The ":fallback" suffix sets
+// ClientPin.Fallback. Keys that are not client key IDs are rejected.
+func ParseClientPins(s string) (map[string]ClientPin, error) {
+	pins := make(map[string]ClientPin)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("client pin %q: expected key=account", part)
+		}
+		id, opt, hasOpt := strings.Cut(val, ":")
+		var p ClientPin
+		var err error
+		if p.Account, err = strconv.ParseInt(id, 10, 64); err != nil || p.Account <= 0 {
+			return nil, fmt.Errorf("client pin %q: invalid account ID", part)
+		}
+		if hasOpt {
+			if opt != "fallback" {
+				return nil, fmt.Errorf("client pin %q: unknown option %q", part, opt)
+			}
+			p.Fallback = true
+		}
+		key = strings.TrimSpace(key)
+		if err := CheckClientKeyID(key); err != nil {
+			return nil, fmt.Errorf("client pin %q: %w", part, err)
+		}
+		pins[key] = p
+	}
+	return pins, nil
+}
+
+// route returns the scheduler Route of pr, which names the model of the
+// body as it reaches the retry stage, after request hooks, the account the
+// client is pinned or forced onto and whether only API key accounts serve
+// the path.
+func (h *Handler) route(pr *ProxyRequest) scheduler.Route {
+	v := pr.Request.Header.Get(RouteHeader)
+	pr.Request.Header.Del(RouteHeader)
+	r := scheduler.Route{Model: pr.model(), Premium: strings.EqualFold(strings.TrimSpace(v), "premium"), APIKeyOnly: apiKeyOnly(pr.Request.URL.Path)}
+	r.Force = strings.TrimSpace(pr.Request.Header.Get(ForceAccountHeader))
+	pr.Request.Header.Del(ForceAccountHeader)
+	if p, ok := h.ClientPins[pr.ClientKey]; ok && pr.ClientKey != "" {
+		r.Account, r.Fallback = p.Account, p.Fallback
+	}
+	routeFeatures(&r, pr.Request.URL.Path, pr.Request.Header, pr.Body)
+	return r
+}
+
+// routeFeatures sets the Endpoint, Stream and Tools of r, which accounts'
+// probed capabilities are checked against, for a request to path with
+// header and body.
+func routeFeatures(r *scheduler.Route, path string, header http.Header, body []byte) {
+	switch {
+	case strings.HasPrefix(path, "/v1/responses"):
+		r.Endpoint = acct.EndpointResponses
+	case strings.HasPrefix(path, "/v1/chat/completions"):
+		r.Endpoint = acct.EndpointChatCompletions
+	}
+	if isForm(header) {
+		return
+	}
+	var m struct {
+		Stream bool              `json:"stream"`
+		Tools  []json.RawMessage `json:"tools"`
+	}
+	if json.Unmarshal(body, &m) == nil {
+		r.Stream, r.Tools = m.Stream, len(m.Tools) > 0
+	}
+}
+
+// mayForce reports whether the client of pr may send ForceAccountHeader.
+func (h *Handler) mayForce(pr *ProxyRequest) bool {
+	for _, k := range h.ForceAccountKeys {
+		if k == pr.ClientKey && k != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/pricing"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+func TestRouteHeader(t *testing.T) {
+	var keys, forwarded []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Authorization"))
+		forwarded = append(forwarded, r.Header.Get(RouteHeader))
+	})
+	h.Scheduler.(*scheduler.Scheduler).SetMode(scheduler.ModeCost)
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "premium", "k1", "", 1)
+	cheap, _ := mgr.AddAPIKey(ctx, "cheap", "k2", "", 2)
+	cheap.Prices = pricing.Table{"gpt-5": {}}
+	mgr.Update(ctx, cheap)
+
+	for _, v := range []string{"", "Premium"} {
+		req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"model":"gpt-5"}`))
+		if v != "" {
+			req.Header.Set(RouteHeader, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	if len(keys) != 2 || keys[0] != "Bearer k2" || keys[1] != "Bearer k1" {
+		t.Fatalf("unexpected accounts %q", keys)
+	}
+	if forwarded[1] != "" {
+		t.Fatalf("route header forwarded: %q", forwarded)
+	}
+}
+
+func TestParseClientPins(t *testing.T) {
+	a, b := ClientKeyID("a"), ClientKeyID("b")
+	pins, err := ParseClientPins(" " + a + "=3, " + b + "=5:fallback ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pins[a] != (ClientPin{Account: 3}) || pins[b] != (ClientPin{Account: 5, Fallback: true}) {
+		t.Fatalf("unexpected pins %+v", pins)
+	}
+	for _, bad := range []string{a, "=3", a + "=x", a + "=0", a + "=3:maybe", "ck-0123456789ab=3"} {
+		if _, err := ParseClientPins(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestClientPin(t *testing.T) {
+	var keys []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Authorization"))
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "shared", "k1", "", 1)
+	pinned, _ := mgr.AddAPIKey(ctx, "pinned", "k2", "", 2)
+	h.ClientPins = map[string]ClientPin{ClientKeyID("strict"): {Account: pinned.ID}, ClientKeyID("lenient"): {Account: pinned.ID, Fallback: true}}
+	send := func(token string) int {
+		req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, token := range []string{"strict", "lenient", "other"} {
+		if code := send(token); code != 200 {
+			t.Fatalf("%s: status %d", token, code)
+		}
+	}
+	// The upstream sees the account's key, not the client's token.
+	if keys[0] != "Bearer k2" || keys[1] != "Bearer k2" || keys[2] != "Bearer k1" {
+		t.Fatalf("unexpected accounts %q", keys)
+	}
+	mgr.MarkExhausted(ctx, pinned.ID, time.Now().Add(time.Hour))
+	if code := send("strict"); code != http.StatusServiceUnavailable {
+		t.Fatalf("strict pin fell back, status %d", code)
+	}
+	if code := send("lenient"); code != 200 || keys[len(keys)-1] != "Bearer k1" {
+		t.Fatalf("fallback not used, status %d, accounts %q", code, keys)
+	}
+}
+
+func TestForceAccountHeader(t *testing.T) {
+	var keys []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ForceAccountHeader) != "" {
+			t.Error("force header forwarded upstream")
+		}
+		keys = append(keys, r.Header.Get("Authorization"))
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "first", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "second", "k2", "", 2)
+	h.ForceAccountKeys = []string{ClientKeyID("debugger")}
+	send := func(token, force string) int {
+		req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(ForceAccountHeader, force)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("debugger", "second"); code != 200 || keys[0] != "Bearer k2" {
+		t.Fatalf("status %d, accounts %q", code, keys)
+	}
+	if code := send("other", "second"); code != http.StatusForbidden || len(keys) != 1 {
+		t.Fatalf("unauthorized client forced an account: status %d, accounts %q", code, keys)
+	}
+	if code := send("debugger", "missing"); code != http.StatusServiceUnavailable {
+		t.Fatalf("unknown account served with status %d", code)
+	}
+}
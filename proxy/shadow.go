@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// maxShadows bounds the mirrored requests in flight; requests arriving
+// while it is reached are not mirrored.
+const maxShadows = 16
+
+// Shadow mirrors a share of the client requests to a second target, an
+// account or an OpenAI-compatible upstream, to compare it with the
+// accounts serving the clients. Mirrored requests are sent in the
+// background alongside the real ones; their responses are read and
+// discarded, and logged with log.RequestLog.Shadow set. Create it with
+// ParseShadow.
+type Shadow struct {
+	// Percent of the requests reaching the retry stage are mirrored.
+	Percent float64
+	// Account is the ID of the account mirrored requests are sent with,
+	// when non-zero. It is selected through the Selector, like with
+	// ForceAccountHeader, so nothing is mirrored while it is unavailable.
+	Account int64
+	// Upstream is, when Account is zero, the base URL mirrored requests are
+	// sent to with APIKey, like an API key account with that base URL.
+	Upstream string
+	APIKey   string
+
+	rand     func() float64
+	inflight chan struct{}
+}
+
+var shadowRequests = metrics.Default.NewCounter("companion_shadow_requests_total", "Client requests mirrored by shadow mode, by result.", "result")
+
+// ParseShadow reads the shadow target, an account ID or an upstream base
+// URL used with apiKey, mirroring percent of the requests.
+func ParseShadow(target, apiKey string, percent float64) (*Shadow, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("shadow percentage %v: must be above 0 and at most 100", percent)
+	}
+	s := &Shadow{Percent: percent, inflight: make(chan struct{}, maxShadows)}
+	if id, err := strconv.ParseInt(target, 10, 64); err == nil && id > 0 {
+		s.Account = id
+		return s, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("shadow target %q: expected an account ID or an http(s) URL", target)
+	}
+	if apiKey == "" {
+		return nil, fmt.Errorf("shadow target %q: an upstream needs an API key", target)
+	}
+	s.Upstream, s.APIKey = strings.TrimSuffix(target, "/"), apiKey
+	return s, nil
+}
+
+// sample reports whether a request is to be mirrored.
+func (s *Shadow) sample() bool {
+	roll := rand.Float64
+	if s.rand != nil {
+		roll = s.rand
+	}
+	return roll()*100 < s.Percent
+}
+
+// shadowAccount returns the account mirrored requests are sent with.
+func (h *Handler) shadowAccount(ctx context.Context, s *Shadow) (*acct.Account, error) {
+	if s.Account == 0 {
+		return &acct.Account{Name: "shadow", Type: acct.APIKeyAccount, APIKey: s.APIKey, BaseURL: s.Upstream}, nil
+	}
+	return h.Scheduler.Next(scheduler.WithRoute(ctx, scheduler.Route{Force: strconv.FormatInt(s.Account, 10)}), nil)
+}
+
+// shadow mirrors the sampled requests to the Shadow target before passing
+// them on. Upgrades, such as Realtime sessions, are never mirrored.
+func (h *Handler) shadow(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := h.Shadow
+		if s != nil && upgradeType(r.Header) == "" && s.sample() {
+			select {
+			case s.inflight <- struct{}{}:
+				h.mirror(s, RequestFrom(r))
+			default:
+				shadowRequests.Inc("skipped")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mirror sends a copy of pr to the target of s in the background, freeing
+// the in-flight slot taken for it once done. The copy is not attributed to
+// the client, goes through normalization and logging only and is not
+// reported to the Selector.
+func (h *Handler) mirror(s *Shadow, pr *ProxyRequest) {
+	cp := &ProxyRequest{Body: pr.Body, ID: pr.ID + "-shadow"}
+	ctx := withProxyRequest(context.WithoutCancel(pr.Request.Context()), cp)
+	r := pr.Request.Clone(ctx)
+	r.Header.Del(ForceAccountHeader)
+	r.Header.Del(RouteHeader)
+	cp.Request = r
+	cp.Hook = &HookContext{Context: ctx, Request: r, Values: make(map[string]any)}
+	attempt := ChainAttempt(h.send, h.normalize, h.logAttempt)
+	go func() {
+		defer func() { <-s.inflight }()
+		a, err := h.shadowAccount(ctx, s)
+		if err != nil {
+			logger.Warnc(ctx, "shadow account unavailable: %v", err)
+			shadowRequests.Inc("unavailable")
+			return
+		}
+		cp.Hook.Account = a
+		resp, err := attempt(&Attempt{ProxyRequest: cp, Account: a, Shadow: true, Start: time.Now()})
+		if err != nil {
+			shadowRequests.Inc("error")
+			return
+		}
+		// Reading the body to the end logs it.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		shadowRequests.Inc(fmt.Sprintf("%dxx", resp.StatusCode/100))
+	}()
+}
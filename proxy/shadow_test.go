@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logpkg "github.com/kxn/codex-companion/log"
+)
+
+func TestParseShadow(t *testing.T) {
+	s, err := ParseShadow("3", "", 10)
+	if err != nil || s.Account != 3 || s.Percent != 10 {
+		t.Fatalf("unexpected shadow %+v %v", s, err)
+	}
+	s, err = ParseShadow("https://example.com/v1/", "sk", 100)
+	if err != nil || s.Upstream != "https://example.com/v1" || s.APIKey != "sk" {
+		t.Fatalf("unexpected shadow %+v %v", s, err)
+	}
+	for _, bad := range []struct {
+		target, key string
+		percent     float64
+	}{{"3", "", 0}, {"3", "", 101}, {"example.com", "sk", 10}, {"https://example.com", "", 10}, {"-1", "", 10}} {
+		if _, err := ParseShadow(bad.target, bad.key, bad.percent); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestShadow(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer shadow-key" {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "shadow failed")
+			return
+		}
+		io.WriteString(w, "primary")
+	})
+	mirrored := make(chan string, 10)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.Header.Get("Authorization") + " " + r.URL.Path + " " + string(body)
+		io.WriteString(w, "other")
+	}))
+	defer other.Close()
+	ctx := context.Background()
+	primary, _ := mgr.AddAPIKey(ctx, "primary", "k", "", 1)
+	shadowAccount, _ := mgr.AddAPIKey(ctx, "shadow", "shadow-key", "", 2)
+	shadowLog := func() *logpkg.RequestLog {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			logs, _ := ls.List(ctx, 10, 0)
+			for _, l := range logs {
+				if l.Shadow {
+					ls.DeleteAccount(ctx, l.AccountID)
+					return l
+				}
+			}
+		}
+		t.Fatal("no shadow log")
+		return nil
+	}
+	send := func() {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-5","input":"hi"}`))
+		req.Header.Set("Authorization", "Bearer client")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != "primary" {
+			t.Fatalf("client got %d %q", rec.Code, rec.Body)
+		}
+	}
+
+	// An upstream target gets a copy with its own key.
+	h.Shadow, _ = ParseShadow(other.URL+"/v1", "other-key", 100)
+	send()
+	if got := <-mirrored; !strings.HasPrefix(got, "Bearer other-key /v1/responses ") || !strings.Contains(got, `"input":"hi"`) {
+		t.Fatalf("mirrored %q", got)
+	}
+	if l := shadowLog(); l.AccountID != 0 || l.Status != http.StatusOK || l.ClientKey != "" {
+		t.Fatalf("unexpected shadow log %+v", l)
+	}
+
+	// An account target is selected like a forced account, while the
+	// client keeps being served by rotation.
+	h.Shadow, _ = ParseShadow("2", "", 100)
+	send()
+	if l := shadowLog(); l.AccountID != shadowAccount.ID || l.Status != http.StatusInternalServerError {
+		t.Fatalf("unexpected shadow log %+v", l)
+	}
+	logs, _ := ls.List(ctx, 10, 0)
+	for _, l := range logs {
+		if l.AccountID != primary.ID || l.Shadow {
+			t.Fatalf("unexpected log %+v", l)
+		}
+	}
+
+	// Nothing is mirrored outside the sample.
+	h.Shadow.rand = func() float64 { return 0.5 }
+	h.Shadow.Percent = 10
+	send()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(mirrored); n != 0 {
+		t.Fatalf("%d requests mirrored outside the sample", n)
+	}
+}
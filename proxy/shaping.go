@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// shaper holds the per-account stream slots used by the shaping stage.
+type shaper struct {
+	mu    sync.Mutex
+	slots map[int64]chan struct{}
+}
+
+// acquire takes a stream slot of account id, waiting until one frees up or
+// ctx ends. The returned function releases the slot.
+func (s *shaper) acquire(ctx context.Context, id int64, max int) (func(), error) {
+	s.mu.Lock()
+	if s.slots == nil {
+		s.slots = make(map[int64]chan struct{})
+	}
+	ch, ok := s.slots[id]
+	if !ok || cap(ch) != max {
+		// Requests holding a slot of a replaced channel release into it
+		// harmlessly.
+		ch = make(chan struct{}, max)
+		s.slots[id] = ch
+	}
+	s.mu.Unlock()
+	select {
+	case ch <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-ch }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// shaping is the attempt stage applying the account's artificial limits:
+// it waits for one of MaxConcurrent stream slots, sleeps LatencyMs before
+// sending and paces the response body at BytesPerSec. The slot is held
+// until the client has received the whole body.
+func (h *Handler) shaping(next AttemptFunc) AttemptFunc {
+	return func(at *Attempt) (*http.Response, error) {
+		a := at.Account
+		ctx := at.Request.Context()
+		release := func() {}
+		if a.MaxConcurrent > 0 {
+			r, err := h.shaper.acquire(ctx, a.ID, a.MaxConcurrent)
+			if err != nil {
+				return nil, err
+			}
+			release = r
+		}
+		if a.LatencyMs > 0 {
+			t := time.NewTimer(time.Duration(a.LatencyMs) * time.Millisecond)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				release()
+				return nil, ctx.Err()
+			}
+		}
+		resp, err := next(at)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if a.MaxConcurrent > 0 || a.BytesPerSec > 0 {
+			logger.Debugc(ctx, "shaping account %d: concurrent=%d rate=%dB/s", a.ID, a.MaxConcurrent, a.BytesPerSec)
+			resp.Body = &shapedBody{rc: resp.Body, ctx: ctx, rate: a.BytesPerSec, release: release}
+		}
+		return resp, nil
+	}
+}
+
+// shapedBody paces reads to rate bytes per second and releases the stream
+// slot on Close.
+type shapedBody struct {
+	rc      io.ReadCloser
+	ctx     context.Context
+	rate    int64
+	release func()
+
+	start time.Time
+	n     int64
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	if b.rate <= 0 {
+		return b.rc.Read(p)
+	}
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+	// Read in chunks of about a tenth of a second so pacing stays smooth.
+	if chunk := b.rate / 10; chunk > 0 && int64(len(p)) > chunk {
+		p = p[:chunk]
+	} else if chunk == 0 {
+		p = p[:1]
+	}
+	n, err := b.rc.Read(p)
+	b.n += int64(n)
+	due := b.start.Add(time.Duration(float64(b.n) / float64(b.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-b.ctx.Done():
+			t.Stop()
+			return n, b.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// Write passes p on to the upstream side of an upgraded connection.
+func (b *shapedBody) Write(p []byte) (int, error) { return writeBody(b.rc, p) }
+
+func (b *shapedBody) Close() error {
+	err := b.rc.Close()
+	b.release()
+	return err
+}
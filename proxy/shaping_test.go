@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShaperLimitsConcurrency(t *testing.T) {
+	var s shaper
+	ctx := context.Background()
+	release, err := s.acquire(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(tctx, 1, 1); err == nil {
+		t.Fatalf("second slot acquired beyond limit")
+	}
+	if _, err := s.acquire(ctx, 2, 1); err != nil {
+		t.Fatalf("other account blocked: %v", err)
+	}
+	release()
+	release()
+	if r, err := s.acquire(ctx, 1, 1); err != nil {
+		t.Fatalf("slot not released: %v", err)
+	} else {
+		r()
+	}
+}
+
+func TestShapedBodyRate(t *testing.T) {
+	released := false
+	b := &shapedBody{rc: io.NopCloser(strings.NewReader(strings.Repeat("x", 200))), ctx: context.Background(), rate: 1000, release: func() { released = true }}
+	start := time.Now()
+	data, err := io.ReadAll(b)
+	if err != nil || len(data) != 200 {
+		t.Fatalf("read %d %v", len(data), err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("body not paced: %v", d)
+	}
+	b.Close()
+	if !released {
+		t.Fatalf("slot not released on close")
+	}
+}
+
+func TestServeHTTPShapingLatency(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	a.LatencyMs = 50
+	a.MaxConcurrent = 1
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := mgr.Get(ctx, a.ID)
+	if got.LatencyMs != 50 || got.MaxConcurrent != 1 {
+		t.Fatalf("shaping fields not persisted: %+v", got)
+	}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/responses", nil))
+		if rec.Code != 200 || rec.Body.String() != "ok" {
+			t.Fatalf("bad resp %d", rec.Code)
+		}
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("latency not applied: %v", d)
+	}
+	// both requests released their slot
+	release, err := h.shaper.acquire(ctx, a.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
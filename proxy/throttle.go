@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// upstreamLimit is one x-ratelimit-* limit reported by the upstream, such
+// as "requests" or "tokens".
+type upstreamLimit struct {
+	name             string
+	limit, remaining int64
+	reset            time.Time
+}
+
+// lowestLimit returns the limit of header with the smallest fraction
+// remaining. ok is false when header reports no complete limit: each needs
+// x-ratelimit-limit-*, x-ratelimit-remaining-* and x-ratelimit-reset-*.
+func lowestLimit(header http.Header, now time.Time) (l upstreamLimit, ok bool) {
+	for k, v := range header {
+		name, found := strings.CutPrefix(strings.ToLower(k), "x-ratelimit-limit-")
+		if !found || len(v) == 0 {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(v[0]), 10, 64)
+		if err != nil || limit <= 0 {
+			continue
+		}
+		remaining, err := strconv.ParseInt(strings.TrimSpace(header.Get("X-Ratelimit-Remaining-"+name)), 10, 64)
+		if err != nil {
+			continue
+		}
+		d, found := parseReset(header.Get("X-Ratelimit-Reset-" + name))
+		if !found {
+			continue
+		}
+		c := upstreamLimit{name: name, limit: limit, remaining: max(remaining, 0), reset: now.Add(d)}
+		if !ok || c.remaining*l.limit < l.remaining*c.limit {
+			l, ok = c, true
+		}
+	}
+	return l, ok
+}
+
+// pacer spaces the attempts of accounts running low on an upstream request
+// limit.
+type pacer struct {
+	mu sync.Mutex
+	m  map[int64]pace
+}
+
+type pace struct {
+	interval time.Duration
+	// next is the earliest start of the account's next attempt and until
+	// when the limit resets and pacing ends.
+	next, until time.Time
+}
+
+// reserve takes the next attempt slot of account id and returns how long
+// the attempt must wait for it.
+func (p *pacer) reserve(id int64, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.m[id]
+	if !ok {
+		return 0
+	}
+	if !now.Before(st.until) {
+		delete(p.m, id)
+		return 0
+	}
+	slot := st.next
+	if slot.Before(now) {
+		slot = now
+	}
+	st.next = slot.Add(st.interval)
+	p.m[id] = st
+	return slot.Sub(now)
+}
+
+// set paces account id at one attempt per interval until the time given;
+// a zero interval ends pacing.
+func (p *pacer) set(id int64, interval time.Duration, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if interval <= 0 {
+		delete(p.m, id)
+		return
+	}
+	if p.m == nil {
+		p.m = make(map[int64]pace)
+	}
+	st := p.m[id]
+	st.interval, st.until = interval, until
+	p.m[id] = st
+}
+
+// throttling is the attempt stage slowing accounts down before the upstream
+// rate limits them. It reads the x-ratelimit-* headers of every successful
+// response and, once the tightest limit has less than ThrottlePercent left,
+// spreads the account's remaining requests evenly until the limit resets.
+// An account with none left, or low on any other limit such as tokens,
+// whose cost per request is unknown, is taken out of rotation until the
+// reset instead. Waits for a slot end with the request context.
+func (h *Handler) throttling(next AttemptFunc) AttemptFunc {
+	return func(at *Attempt) (*http.Response, error) {
+		if h.ThrottlePercent <= 0 {
+			return next(at)
+		}
+		ctx := at.Request.Context()
+		if wait := h.pacer.reserve(at.Account.ID, time.Now()); wait > 0 {
+			logger.Debugc(ctx, "throttling account %d for %s", at.Account.ID, wait)
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		resp, err := next(at)
+		if err == nil && resp.StatusCode < 400 {
+			h.throttle(ctx, at.Account, resp.Header)
+		}
+		return resp, err
+	}
+}
+
+// throttle adapts the pace of account a to the limits in header.
+func (h *Handler) throttle(ctx context.Context, a *acct.Account, header http.Header) {
+	now := time.Now()
+	l, ok := lowestLimit(header, now)
+	if !ok || !l.reset.After(now) || l.remaining*100 >= l.limit*int64(h.ThrottlePercent) {
+		h.pacer.set(a.ID, 0, time.Time{})
+		return
+	}
+	if l.remaining == 0 || l.name != "requests" {
+		logger.Warnc(ctx, "account %d has %d of %d %s left, pausing until %s", a.ID, l.remaining, l.limit, l.name, l.reset.UTC().Format(time.RFC3339))
+		h.pacer.set(a.ID, 0, time.Time{})
+		h.Scheduler.MarkExhausted(ctx, a.ID, l.reset)
+		return
+	}
+	interval := l.reset.Sub(now) / time.Duration(l.remaining)
+	logger.Infoc(ctx, "account %d has %d of %d requests left, pacing at one per %s", a.ID, l.remaining, l.limit, interval)
+	h.pacer.set(a.ID, interval, l.reset)
+}
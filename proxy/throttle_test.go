@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLowestLimit(t *testing.T) {
+	now := time.Now()
+	h := http.Header{
+		"X-Ratelimit-Limit-Requests":     {"100"},
+		"X-Ratelimit-Remaining-Requests": {"40"},
+		"X-Ratelimit-Reset-Requests":     {"30s"},
+		"X-Ratelimit-Limit-Tokens":       {"10000"},
+		"X-Ratelimit-Remaining-Tokens":   {"500"},
+		"X-Ratelimit-Reset-Tokens":       {"2s"},
+		"X-Ratelimit-Limit-Images":       {"5"},
+	}
+	l, ok := lowestLimit(h, now)
+	if !ok || l.name != "tokens" || l.remaining != 500 || !l.reset.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("unexpected limit %+v %v", l, ok)
+	}
+	if _, ok := lowestLimit(http.Header{"X-Ratelimit-Limit-Requests": {"100"}}, now); ok {
+		t.Fatal("incomplete limit reported")
+	}
+}
+
+func TestPacer(t *testing.T) {
+	var p pacer
+	now := time.Now()
+	if d := p.reserve(1, now); d != 0 {
+		t.Fatalf("unpaced account waits %s", d)
+	}
+	p.set(1, time.Second, now.Add(time.Minute))
+	for i := range 3 {
+		if d := p.reserve(1, now); d != time.Duration(i)*time.Second {
+			t.Fatalf("attempt %d waits %s", i, d)
+		}
+	}
+	if d := p.reserve(1, now.Add(time.Minute)); d != 0 {
+		t.Fatalf("pacing outlived the reset: %s", d)
+	}
+	p.set(2, time.Second, now.Add(time.Minute))
+	p.set(2, 0, time.Time{})
+	if d := p.reserve(2, now); d != 0 {
+		t.Fatalf("cleared pace waits %s", d)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	var remaining, name string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ratelimit-Limit-"+name, "100")
+		w.Header().Set("X-Ratelimit-Remaining-"+name, remaining)
+		w.Header().Set("X-Ratelimit-Reset-"+name, "1m")
+	})
+	h.ThrottlePercent = 10
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	send := func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{}`)))
+		if rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+
+	name, remaining = "Requests", "50"
+	send()
+	if d := h.pacer.reserve(a.ID, time.Now()); d != 0 {
+		t.Fatalf("account with headroom paced: %s", d)
+	}
+	remaining = "6"
+	send()
+	if p := h.pacer.m[a.ID]; p.interval < 9*time.Second || p.interval > 10*time.Second {
+		t.Fatalf("expected a slot every 10s, got %s", p.interval)
+	}
+	remaining = "50"
+	start := time.Now()
+	send()
+	if time.Since(start) > time.Second {
+		t.Fatal("paced attempt waited for a later slot")
+	}
+	if d := h.pacer.reserve(a.ID, time.Now()); d != 0 {
+		t.Fatalf("pacing not lifted: %s", d)
+	}
+
+	name, remaining = "Tokens", "5"
+	send()
+	got, _ := mgr.Get(ctx, a.ID)
+	if d := time.Until(got.ResetAt); d < 50*time.Second || d > time.Minute {
+		t.Fatalf("expected the account paused for a minute, got %s", d)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/log"
+)
+
+// timing collects the phases of one upstream round trip via httptrace.
+// Dial callbacks may run concurrently when several addresses are tried, so
+// the fields are guarded; the first start and the last completion win.
+type timing struct {
+	mu                  sync.Mutex
+	start               time.Time
+	dnsStart, dnsDone   time.Time
+	connStart, connDone time.Time
+	tlsStart, tlsDone   time.Time
+	firstByte, bodyDone time.Time
+}
+
+func newTiming() *timing {
+	return &timing{start: time.Now()}
+}
+
+func (t *timing) set(field *time.Time, first bool) {
+	t.mu.Lock()
+	if !first || field.IsZero() {
+		*field = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *timing) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.set(&t.dnsStart, true) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone, false) },
+		ConnectStart:         func(string, string) { t.set(&t.connStart, true) },
+		ConnectDone:          func(string, string, error) { t.set(&t.connDone, false) },
+		TLSHandshakeStart:    func() { t.set(&t.tlsStart, true) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.set(&t.tlsDone, false) },
+		GotFirstResponseByte: func() { t.set(&t.firstByte, true) },
+	}
+}
+
+// done marks the end of the response body.
+func (t *timing) done() { t.set(&t.bodyDone, false) }
+
+func span(from, to time.Time) int64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from).Milliseconds()
+}
+
+// apply stores the collected phases on rl.
+func (t *timing) apply(rl *log.RequestLog) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rl.DNSMs = span(t.dnsStart, t.dnsDone)
+	rl.ConnectMs = span(t.connStart, t.connDone)
+	rl.TLSMs = span(t.tlsStart, t.tlsDone)
+	rl.TTFBMs = span(t.start, t.firstByte)
+	rl.StreamMs = span(t.firstByte, t.bodyDone)
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogTimingBreakdown(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+		io.WriteString(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(40 * time.Millisecond)
+		io.WriteString(w, "data: two\n\n")
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://localhost/v1/responses", nil))
+	logs, err := ls.List(ctx, 1, 0)
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("list logs: %v", err)
+	}
+	l := logs[0]
+	if l.TTFBMs < 35 || l.StreamMs < 35 || l.TTFBMs+l.StreamMs > l.DurationMs+1 {
+		t.Fatalf("unexpected timing ttfb=%d stream=%d total=%d", l.TTFBMs, l.StreamMs, l.DurationMs)
+	}
+	if l.DNSMs != 0 || l.TLSMs != 0 {
+		t.Fatalf("no DNS or TLS expected for a plain IP upstream: %+v", l)
+	}
+}
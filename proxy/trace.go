@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+// TraceHeader opts a request into a scheduler decision trace when
+// Handler.DecisionTrace is off: with "1" or "true" every attempt's log
+// entry records which accounts were considered and why each but the
+// selected one was skipped. The header is not forwarded upstream.
+const TraceHeader = "X-Companion-Trace"
+
+// tracing reports whether the attempts of pr record a decision trace.
+func (h *Handler) tracing(pr *ProxyRequest) bool {
+	v := strings.TrimSpace(pr.Request.Header.Get(TraceHeader))
+	pr.Request.Header.Del(TraceHeader)
+	return h.DecisionTrace || v == "1" || strings.EqualFold(v, "true")
+}
+
+// newTrace returns a Trace for the next account selection and the context
+// recording into it, or nil and ctx unchanged when tracing is off.
+func newTrace(ctx context.Context, on bool) (*scheduler.Trace, context.Context) {
+	if !on {
+		return nil, ctx
+	}
+	t := &scheduler.Trace{}
+	return t, scheduler.WithTrace(ctx, t)
+}
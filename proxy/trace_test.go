@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kxn/codex-companion/scheduler"
+)
+
+func TestDecisionTrace(t *testing.T) {
+	var forwarded []string
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get(TraceHeader))
+		if r.Header.Get("Authorization") == "Bearer k1" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	ctx := context.Background()
+	first, _ := mgr.AddAPIKey(ctx, "first", "k1", "", 1)
+	second, _ := mgr.AddAPIKey(ctx, "second", "k2", "", 2)
+	send := func(traced bool) {
+		req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"model":"gpt-5"}`))
+		if traced {
+			req.Header.Set(TraceHeader, "1")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+
+	send(true)
+	for _, v := range forwarded {
+		if v != "" {
+			t.Fatalf("trace header forwarded: %q", forwarded)
+		}
+	}
+	logs, _ := ls.List(ctx, 10, 0)
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(logs))
+	}
+	traces := make([]scheduler.Trace, 2)
+	for i, l := range logs {
+		full, err := ls.Get(ctx, l.ID)
+		if err != nil || json.Unmarshal([]byte(full.Decision), &traces[i]) != nil {
+			t.Fatalf("log %d without decision: %+v %v", l.ID, full, err)
+		}
+	}
+	// Logs are listed newest first.
+	retried, initial := traces[0], traces[1]
+	if initial.Model != "gpt-5" || initial.Candidates[0] != (scheduler.Candidate{AccountID: first.ID, Name: "first", Decision: scheduler.DecisionSelected, Detail: "priority 1"}) ||
+		initial.Candidates[1].Decision != scheduler.DecisionNotChosen {
+		t.Fatalf("unexpected first trace %+v", initial)
+	}
+	if retried.Candidates[0].Decision != scheduler.DecisionExhausted || retried.Candidates[1].AccountID != second.ID || retried.Candidates[1].Decision != scheduler.DecisionSelected {
+		t.Fatalf("unexpected retry trace %+v", retried)
+	}
+
+	send(false)
+	logs, _ = ls.List(ctx, 1, 0)
+	if full, _ := ls.Get(ctx, logs[0].ID); full.Decision != "" {
+		t.Fatalf("untraced request recorded a decision: %s", full.Decision)
+	}
+	h.DecisionTrace = true
+	send(false)
+	logs, _ = ls.List(ctx, 1, 0)
+	if full, _ := ls.Get(ctx, logs[0].ID); full.Decision == "" {
+		t.Fatal("DecisionTrace did not record a decision")
+	}
+}
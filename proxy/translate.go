@@ -0,0 +1,937 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+// translation converts a request between the Responses API and Chat
+// Completions for an account whose upstream only serves the other dialect,
+// and the response back: ChatGPT accounts, whose backend only serves the
+// Responses API, and API key accounts as their capabilities say, see
+// Capabilities.Serves.
+type translation struct {
+	// client is the endpoint the client called.
+	client string
+	// path and body are the translated client path and request body.
+	path string
+	body []byte
+	// stream and includeUsage are what the client asked for; only Chat
+	// Completions clients opt into usage in streams.
+	stream, includeUsage bool
+}
+
+// translate returns the translation of a JSON POST to /v1/responses or
+// /v1/chat/completions with body for a, or nil when a serves the endpoint
+// itself or the body is not a JSON object.
+func translate(a *acct.Account, r *http.Request, body []byte) *translation {
+	t := &translation{}
+	switch r.URL.Path {
+	case "/v1/responses":
+		t.client, t.path = acct.EndpointResponses, "/v1/chat/completions"
+	case "/v1/chat/completions":
+		t.client, t.path = acct.EndpointChatCompletions, "/v1/responses"
+	default:
+		return nil
+	}
+	serves := a.Capabilities.Serves(t.client)
+	if a.Type != acct.APIKeyAccount {
+		serves = acct.EndpointResponses
+	}
+	if r.Method != http.MethodPost || isForm(r.Header) || serves == t.client {
+		return nil
+	}
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil {
+		return nil
+	}
+	t.stream, _ = m["stream"].(bool)
+	if t.client == acct.EndpointResponses {
+		m = responsesToChat(m)
+	} else {
+		opts, _ := m["stream_options"].(map[string]any)
+		t.includeUsage, _ = opts["include_usage"].(bool)
+		m = chatToResponses(m)
+		if a.Type != acct.APIKeyAccount {
+			chatGPTRequest(m)
+		}
+	}
+	var err error
+	if t.body, err = json.Marshal(m); err != nil {
+		return nil
+	}
+	return t
+}
+
+// response converts a successful upstream response to the client's
+// dialect. Errors are passed on as they are: both APIs report them alike.
+// A body that cannot be converted is passed on too.
+func (t *translation) response(resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp, nil
+	}
+	if isEventStream(resp) && !t.stream && t.client == acct.EndpointChatCompletions {
+		return collectResponse(resp)
+	}
+	if isEventStream(resp) {
+		var c streamConverter = &chatStream{includeUsage: t.includeUsage, calls: make(map[string]int)}
+		if t.client == acct.EndpointResponses {
+			c = &responsesStream{calls: make(map[int]int), textIndex: -1}
+		}
+		resp.Body = &sseTranslator{rc: resp.Body, r: bufio.NewReader(resp.Body), conv: c}
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	if t.client == acct.EndpointResponses {
+		var c chatCompletion
+		if err = json.Unmarshal(body, &c); err == nil {
+			out = responseFromChat(c)
+		}
+	} else {
+		var r responseObject
+		if err = json.Unmarshal(body, &r); err == nil {
+			out = chatFromResponse(r)
+		}
+	}
+	if err == nil {
+		if b, merr := json.Marshal(out); merr == nil {
+			body = b
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+// responsesToChat converts a Responses API request to Chat Completions.
+// The instructions become a system message and input items messages;
+// reasoning items and tools other than functions, which Chat Completions
+// lacks, are dropped.
+func responsesToChat(m map[string]any) map[string]any {
+	out := map[string]any{"model": m["model"]}
+	var msgs []any
+	if s, ok := m["instructions"].(string); ok && s != "" {
+		msgs = append(msgs, map[string]any{"role": "system", "content": s})
+	}
+	switch in := m["input"].(type) {
+	case string:
+		msgs = append(msgs, map[string]any{"role": "user", "content": in})
+	case []any:
+		msgs = append(msgs, chatMessages(in)...)
+	}
+	out["messages"] = msgs
+	var tools []any
+	list, _ := m["tools"].([]any)
+	for _, v := range list {
+		t, _ := v.(map[string]any)
+		if t["type"] != "function" {
+			continue
+		}
+		fn := map[string]any{"name": t["name"], "parameters": t["parameters"]}
+		copyFields(fn, t, "description", "strict")
+		tools = append(tools, map[string]any{"type": "function", "function": fn})
+	}
+	if len(tools) > 0 {
+		out["tools"] = tools
+		copyFields(out, m, "parallel_tool_calls")
+		switch tc := m["tool_choice"].(type) {
+		case string:
+			out["tool_choice"] = tc
+		case map[string]any:
+			if tc["type"] == "function" {
+				out["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": tc["name"]}}
+			}
+		}
+	}
+	copyFields(out, m, "temperature", "top_p", "user", "stream")
+	if v, ok := m["max_output_tokens"]; ok {
+		out["max_tokens"] = v
+	}
+	if r, ok := m["reasoning"].(map[string]any); ok && r["effort"] != nil {
+		out["reasoning_effort"] = r["effort"]
+	}
+	if text, ok := m["text"].(map[string]any); ok {
+		if f, ok := text["format"].(map[string]any); ok {
+			switch f["type"] {
+			case "json_schema":
+				schema := map[string]any{}
+				copyFields(schema, f, "name", "description", "schema", "strict")
+				out["response_format"] = map[string]any{"type": "json_schema", "json_schema": schema}
+			case "json_object":
+				out["response_format"] = map[string]any{"type": "json_object"}
+			}
+		}
+	}
+	if m["stream"] == true {
+		// Usage is what logs and budgets count.
+		out["stream_options"] = map[string]any{"include_usage": true}
+	}
+	return out
+}
+
+// chatMessages converts Responses API input items to Chat Completions
+// messages. Function calls join the assistant message before them and
+// developer messages become system messages, which every relay knows.
+func chatMessages(items []any) []any {
+	var msgs []any
+	var last map[string]any
+	for _, v := range items {
+		item, _ := v.(map[string]any)
+		switch item["type"] {
+		case "function_call":
+			if last == nil {
+				last = map[string]any{"role": "assistant", "content": nil}
+				msgs = append(msgs, last)
+			}
+			calls, _ := last["tool_calls"].([]any)
+			last["tool_calls"] = append(calls, map[string]any{
+				"id":       item["call_id"],
+				"type":     "function",
+				"function": map[string]any{"name": item["name"], "arguments": item["arguments"]},
+			})
+		case "function_call_output":
+			msgs = append(msgs, map[string]any{"role": "tool", "tool_call_id": item["call_id"], "content": contentText(item["output"])})
+			last = nil
+		case "message", nil:
+			role, _ := item["role"].(string)
+			if role == "" {
+				continue
+			}
+			if role == "developer" {
+				role = "system"
+			}
+			msg := map[string]any{"role": role, "content": chatContent(item["content"], role)}
+			msgs = append(msgs, msg)
+			last = nil
+			if role == "assistant" {
+				last = msg
+			}
+		}
+	}
+	return msgs
+}
+
+// chatContent converts the content of a Responses API message for a Chat
+// Completions message of role. Text parts are joined unless user content
+// includes images, which need the parts form.
+func chatContent(content any, role string) any {
+	list, ok := content.([]any)
+	if !ok {
+		return content
+	}
+	var parts []any
+	var texts []string
+	images := false
+	for _, v := range list {
+		p, _ := v.(map[string]any)
+		switch p["type"] {
+		case "input_text", "output_text", "text":
+			s, _ := p["text"].(string)
+			texts = append(texts, s)
+			parts = append(parts, map[string]any{"type": "text", "text": s})
+		case "input_image":
+			img := map[string]any{"url": p["image_url"]}
+			copyFields(img, p, "detail")
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": img})
+			images = true
+		}
+	}
+	if images && role == "user" {
+		return parts
+	}
+	return strings.Join(texts, "\n")
+}
+
+// chatToResponses converts a Chat Completions request to the Responses
+// API. Messages become input items, tool calls and results function call
+// items; parameters the Responses API lacks, such as n and stop, are
+// dropped.
+func chatToResponses(m map[string]any) map[string]any {
+	out := map[string]any{"model": m["model"]}
+	input := []any{}
+	msgs, _ := m["messages"].([]any)
+	for _, v := range msgs {
+		msg, _ := v.(map[string]any)
+		role, _ := msg["role"].(string)
+		switch role {
+		case "":
+		case "tool":
+			input = append(input, map[string]any{"type": "function_call_output", "call_id": msg["tool_call_id"], "output": contentText(msg["content"])})
+		case "assistant":
+			if s := contentText(msg["content"]); s != "" {
+				input = append(input, map[string]any{"type": "message", "role": "assistant", "content": []any{map[string]any{"type": "output_text", "text": s}}})
+			}
+			calls, _ := msg["tool_calls"].([]any)
+			for _, c := range calls {
+				call, _ := c.(map[string]any)
+				fn, _ := call["function"].(map[string]any)
+				input = append(input, map[string]any{"type": "function_call", "call_id": call["id"], "name": fn["name"], "arguments": fn["arguments"]})
+			}
+		default:
+			input = append(input, map[string]any{"type": "message", "role": role, "content": responsesContent(msg["content"])})
+		}
+	}
+	out["input"] = input
+	var tools []any
+	list, _ := m["tools"].([]any)
+	for _, v := range list {
+		t, _ := v.(map[string]any)
+		fn, ok := t["function"].(map[string]any)
+		if t["type"] != "function" || !ok {
+			continue
+		}
+		tool := map[string]any{"type": "function"}
+		copyFields(tool, fn, "name", "description", "parameters", "strict")
+		tools = append(tools, tool)
+	}
+	if len(tools) > 0 {
+		out["tools"] = tools
+		copyFields(out, m, "parallel_tool_calls")
+		switch tc := m["tool_choice"].(type) {
+		case string:
+			out["tool_choice"] = tc
+		case map[string]any:
+			if fn, ok := tc["function"].(map[string]any); ok {
+				out["tool_choice"] = map[string]any{"type": "function", "name": fn["name"]}
+			}
+		}
+	}
+	copyFields(out, m, "temperature", "top_p", "user", "stream")
+	for _, k := range []string{"max_tokens", "max_completion_tokens"} {
+		if v, ok := m[k]; ok {
+			out["max_output_tokens"] = v
+		}
+	}
+	if e, ok := m["reasoning_effort"]; ok {
+		out["reasoning"] = map[string]any{"effort": e}
+	}
+	if f, ok := m["response_format"].(map[string]any); ok {
+		switch f["type"] {
+		case "json_schema":
+			format := map[string]any{"type": "json_schema"}
+			if s, ok := f["json_schema"].(map[string]any); ok {
+				copyFields(format, s, "name", "description", "schema", "strict")
+			}
+			out["text"] = map[string]any{"format": format}
+		case "json_object":
+			out["text"] = map[string]any{"format": map[string]any{"type": "json_object"}}
+		}
+	}
+	return out
+}
+
+// chatGPTRequest adapts a translated Chat Completions request to the
+// ChatGPT backend, which requires instructions and streaming: system and
+// developer messages move to the instructions, and the request streams
+// whatever the client asked for.
+func chatGPTRequest(m map[string]any) {
+	var instructions []string
+	input, _ := m["input"].([]any)
+	kept := []any{}
+	for _, v := range input {
+		item, _ := v.(map[string]any)
+		if role := item["role"]; role == "system" || role == "developer" {
+			instructions = append(instructions, contentText(item["content"]))
+			continue
+		}
+		kept = append(kept, v)
+	}
+	m["input"] = kept
+	m["instructions"] = strings.Join(instructions, "\n\n")
+	m["stream"] = true
+}
+
+// collectResponse converts the Responses API event stream of resp, sent
+// for a client that did not ask to stream, to a single chat completion. The
+// ChatGPT backend may leave the output of the final response empty, so the
+// items are taken from the output_item.done events. A failed response
+// becomes a 502 carrying its error.
+func collectResponse(resp *http.Response) (*http.Response, error) {
+	t := &sseTranslator{rc: resp.Body, r: bufio.NewReader(resp.Body)}
+	defer t.Close()
+	var items []responseItem
+	var final *responseObject
+	var failure json.RawMessage
+	for {
+		data, err := t.next()
+		var ev struct {
+			Type     string          `json:"type"`
+			Item     responseItem    `json:"item"`
+			Response *responseObject `json:"response"`
+		}
+		if len(data) > 0 && json.Unmarshal(data, &ev) == nil {
+			switch ev.Type {
+			case "response.output_item.done":
+				items = append(items, ev.Item)
+			case "response.completed", "response.incomplete":
+				final = ev.Response
+			case "response.failed":
+				failure = json.RawMessage(`{"message":"response failed"}`)
+				if ev.Response != nil && ev.Response.Error != nil {
+					failure = ev.Response.Error
+				}
+			case "error":
+				failure = data
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var body []byte
+	switch {
+	case final != nil:
+		if len(final.Output) == 0 {
+			final.Output = items
+		}
+		body, _ = json.Marshal(chatFromResponse(*final))
+	case failure != nil:
+		resp.StatusCode, resp.Status = http.StatusBadGateway, "502 Bad Gateway"
+		body = []byte(`{"error":` + string(failure) + `}`)
+	default:
+		return nil, errors.New("response stream ended without a response")
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+// responsesContent converts the content of a Chat Completions message to
+// Responses API input parts.
+func responsesContent(content any) []any {
+	if s, ok := content.(string); ok {
+		return []any{map[string]any{"type": "input_text", "text": s}}
+	}
+	var parts []any
+	list, _ := content.([]any)
+	for _, v := range list {
+		p, _ := v.(map[string]any)
+		switch p["type"] {
+		case "text":
+			parts = append(parts, map[string]any{"type": "input_text", "text": p["text"]})
+		case "image_url":
+			img, _ := p["image_url"].(map[string]any)
+			part := map[string]any{"type": "input_image", "image_url": img["url"]}
+			copyFields(part, img, "detail")
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// contentText returns the text of message content or a tool result given
+// as a string or as parts; other values are returned as JSON.
+func contentText(v any) string {
+	switch c := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case []any:
+		var texts []string
+		for _, p := range c {
+			if pm, ok := p.(map[string]any); ok {
+				if s, ok := pm["text"].(string); ok {
+					texts = append(texts, s)
+				}
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// copyFields copies the keys present in src to dst.
+func copyFields(dst, src map[string]any, keys ...string) {
+	for _, k := range keys {
+		if v, ok := src[k]; ok {
+			dst[k] = v
+		}
+	}
+}
+
+// chatCompletion is a Chat Completions response or stream chunk.
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatMessage struct {
+	Role      string         `json:"role,omitempty"`
+	Content   *string        `json:"content"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
+}
+
+type chatToolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type chatUsage struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	CompletionTokens    int64 `json:"completion_tokens"`
+	TotalTokens         int64 `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+// responses returns u in the Responses API form, or nil for nil.
+func (u *chatUsage) responses() *responsesUsage {
+	if u == nil {
+		return nil
+	}
+	r := &responsesUsage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+	r.InputTokensDetails.CachedTokens = u.PromptTokensDetails.CachedTokens
+	return r
+}
+
+// responseObject is a Responses API response.
+type responseObject struct {
+	ID                string `json:"id"`
+	Object            string `json:"object"`
+	CreatedAt         int64  `json:"created_at"`
+	Model             string `json:"model"`
+	Status            string `json:"status"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+	Output []responseItem  `json:"output"`
+	Usage  *responsesUsage `json:"usage,omitempty"`
+}
+
+type responseItem struct {
+	Type      string         `json:"type"`
+	ID        string         `json:"id,omitempty"`
+	Status    string         `json:"status,omitempty"`
+	Role      string         `json:"role,omitempty"`
+	Content   []responsePart `json:"content,omitempty"`
+	CallID    string         `json:"call_id,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Arguments string         `json:"arguments,omitempty"`
+}
+
+type responsePart struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type responsesUsage struct {
+	InputTokens        int64 `json:"input_tokens"`
+	OutputTokens       int64 `json:"output_tokens"`
+	TotalTokens        int64 `json:"total_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// chat returns u in the Chat Completions form, or nil for nil.
+func (u *responsesUsage) chat() *chatUsage {
+	if u == nil {
+		return nil
+	}
+	c := &chatUsage{PromptTokens: u.InputTokens, CompletionTokens: u.OutputTokens, TotalTokens: u.TotalTokens}
+	c.PromptTokensDetails.CachedTokens = u.InputTokensDetails.CachedTokens
+	return c
+}
+
+// newResponse returns an empty completed response for the chat completion
+// id.
+func newResponse(id string, created int64, model string) responseObject {
+	return responseObject{ID: "resp_" + id, Object: "response", CreatedAt: created, Model: model, Status: "completed", Output: []responseItem{}}
+}
+
+// incomplete marks r cut off by the output token limit.
+func (r *responseObject) incomplete() {
+	r.Status = "incomplete"
+	r.IncompleteDetails = &struct {
+		Reason string `json:"reason"`
+	}{"max_output_tokens"}
+}
+
+// responseFromChat converts a chat completion to a Responses API response.
+func responseFromChat(c chatCompletion) responseObject {
+	r := newResponse(c.ID, c.Created, c.Model)
+	if len(c.Choices) > 0 && c.Choices[0].Message != nil {
+		ch := c.Choices[0]
+		if m := ch.Message; m.Content != nil && *m.Content != "" {
+			r.Output = append(r.Output, responseItem{
+				Type: "message", ID: "msg_" + c.ID, Status: "completed", Role: "assistant",
+				Content: []responsePart{{Type: "output_text", Text: *m.Content, Annotations: []any{}}},
+			})
+		}
+		for _, tc := range ch.Message.ToolCalls {
+			r.Output = append(r.Output, responseItem{Type: "function_call", ID: "fc_" + tc.ID, Status: "completed", CallID: tc.ID, Name: tc.Function.Name, Arguments: tc.Function.Arguments})
+		}
+		if ch.FinishReason != nil && *ch.FinishReason == "length" {
+			r.incomplete()
+		}
+	}
+	r.Usage = c.Usage.responses()
+	return r
+}
+
+// chatFromResponse converts a Responses API response to a chat completion.
+func chatFromResponse(r responseObject) chatCompletion {
+	msg := &chatMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, it := range r.Output {
+		switch it.Type {
+		case "message":
+			for _, p := range it.Content {
+				if p.Type == "output_text" {
+					text.WriteString(p.Text)
+				}
+			}
+		case "function_call":
+			tc := chatToolCall{Index: len(msg.ToolCalls), ID: it.CallID, Type: "function"}
+			tc.Function.Name, tc.Function.Arguments = it.Name, it.Arguments
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		}
+	}
+	if text.Len() > 0 {
+		s := text.String()
+		msg.Content = &s
+	}
+	finish := finishReason(r, len(msg.ToolCalls) > 0)
+	return chatCompletion{
+		ID: r.ID, Object: "chat.completion", Created: r.CreatedAt, Model: r.Model,
+		Choices: []chatChoice{{Message: msg, FinishReason: &finish}},
+		Usage:   r.Usage.chat(),
+	}
+}
+
+// finishReason returns the Chat Completions finish reason of r.
+func finishReason(r responseObject, calls bool) string {
+	switch {
+	case calls:
+		return "tool_calls"
+	case r.IncompleteDetails != nil && r.IncompleteDetails.Reason == "max_output_tokens":
+		return "length"
+	case r.IncompleteDetails != nil && r.IncompleteDetails.Reason == "content_filter":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// streamConverter converts the events of an upstream event stream.
+type streamConverter interface {
+	// event converts the data of one event, finishing the converted
+	// stream once the upstream's ends.
+	event(data []byte, out *bytes.Buffer)
+	// finished reports whether the upstream's stream has ended: with
+	// [DONE], or with the event completing or failing the response.
+	finished() bool
+}
+
+// sseTranslator passes an event stream through conv event by event. A
+// stream closed before it finished is truncated, not complete: it fails
+// with io.ErrUnexpectedEOF, so the client is told of the interruption
+// instead of getting a completion made up for it.
+type sseTranslator struct {
+	rc   io.ReadCloser
+	r    *bufio.Reader
+	conv streamConverter
+	out  bytes.Buffer
+	err  error
+}
+
+func (t *sseTranslator) Read(p []byte) (int, error) {
+	for t.out.Len() == 0 && t.err == nil {
+		data, err := t.next()
+		if len(data) > 0 {
+			t.conv.event(data, &t.out)
+		}
+		if err == io.EOF && !t.conv.finished() {
+			err = io.ErrUnexpectedEOF
+		}
+		t.err = err
+	}
+	if t.out.Len() > 0 {
+		return t.out.Read(p)
+	}
+	return 0, t.err
+}
+
+func (t *sseTranslator) Close() error { return t.rc.Close() }
+
+// next returns the data of the next event, its data lines joined.
+func (t *sseTranslator) next() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := t.r.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if v, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(v, []byte(" "))...)
+		}
+		if err != nil || (len(line) == 0 && len(data) > 0) {
+			return data, err
+		}
+	}
+}
+
+// responsesStream converts Chat Completions chunks to Responses API
+// events: the response is created with the first chunk, text and tool call
+// deltas open output items as they appear, and the items and the response
+// are completed once the upstream sends [DONE].
+type responsesStream struct {
+	res        responseObject
+	started    bool
+	ended      bool
+	seq        int
+	text       strings.Builder
+	textIndex  int
+	calls      map[int]int
+	incomplete bool
+}
+
+// emit writes the event typ with fields.
+func (s *responsesStream) emit(out *bytes.Buffer, typ string, fields map[string]any) {
+	fields["type"] = typ
+	fields["sequence_number"] = s.seq
+	s.seq++
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(out, "event: %s\ndata: %s\n\n", typ, b)
+}
+
+func (s *responsesStream) event(data []byte, out *bytes.Buffer) {
+	if string(data) == "[DONE]" {
+		s.end(out)
+		return
+	}
+	var c chatCompletion
+	if json.Unmarshal(data, &c) != nil {
+		return
+	}
+	if !s.started {
+		s.started = true
+		s.res = newResponse(c.ID, c.Created, c.Model)
+		s.res.Status = "in_progress"
+		s.emit(out, "response.created", map[string]any{"response": s.res})
+		s.emit(out, "response.in_progress", map[string]any{"response": s.res})
+	}
+	if c.Usage != nil {
+		s.res.Usage = c.Usage.responses()
+	}
+	for _, ch := range c.Choices {
+		if d := ch.Delta; d != nil {
+			if d.Content != nil && *d.Content != "" {
+				s.textDelta(out, c.ID, *d.Content)
+			}
+			for _, tc := range d.ToolCalls {
+				s.callDelta(out, tc)
+			}
+		}
+		if ch.FinishReason != nil && *ch.FinishReason == "length" {
+			s.incomplete = true
+		}
+	}
+}
+
+func (s *responsesStream) textDelta(out *bytes.Buffer, id, delta string) {
+	if s.textIndex < 0 {
+		s.textIndex = len(s.res.Output)
+		item := responseItem{Type: "message", ID: "msg_" + id, Status: "in_progress", Role: "assistant"}
+		s.res.Output = append(s.res.Output, item)
+		s.emit(out, "response.output_item.added", map[string]any{"output_index": s.textIndex, "item": item})
+		s.emit(out, "response.content_part.added", map[string]any{
+			"item_id": item.ID, "output_index": s.textIndex, "content_index": 0,
+			"part": responsePart{Type: "output_text", Annotations: []any{}},
+		})
+	}
+	s.text.WriteString(delta)
+	s.emit(out, "response.output_text.delta", map[string]any{"item_id": s.res.Output[s.textIndex].ID, "output_index": s.textIndex, "content_index": 0, "delta": delta})
+}
+
+func (s *responsesStream) callDelta(out *bytes.Buffer, tc chatToolCall) {
+	i, ok := s.calls[tc.Index]
+	if !ok {
+		i = len(s.res.Output)
+		s.calls[tc.Index] = i
+		item := responseItem{Type: "function_call", ID: "fc_" + tc.ID, Status: "in_progress", CallID: tc.ID, Name: tc.Function.Name}
+		s.res.Output = append(s.res.Output, item)
+		s.emit(out, "response.output_item.added", map[string]any{"output_index": i, "item": item})
+	}
+	if tc.Function.Arguments == "" {
+		return
+	}
+	s.res.Output[i].Arguments += tc.Function.Arguments
+	s.emit(out, "response.function_call_arguments.delta", map[string]any{"item_id": s.res.Output[i].ID, "output_index": i, "delta": tc.Function.Arguments})
+}
+
+func (s *responsesStream) finished() bool { return s.ended }
+
+func (s *responsesStream) end(out *bytes.Buffer) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	if !s.started {
+		return
+	}
+	for i := range s.res.Output {
+		it := &s.res.Output[i]
+		it.Status = "completed"
+		switch it.Type {
+		case "message":
+			part := responsePart{Type: "output_text", Text: s.text.String(), Annotations: []any{}}
+			it.Content = []responsePart{part}
+			s.emit(out, "response.output_text.done", map[string]any{"item_id": it.ID, "output_index": i, "content_index": 0, "text": part.Text})
+			s.emit(out, "response.content_part.done", map[string]any{"item_id": it.ID, "output_index": i, "content_index": 0, "part": part})
+		case "function_call":
+			s.emit(out, "response.function_call_arguments.done", map[string]any{"item_id": it.ID, "output_index": i, "arguments": it.Arguments})
+		}
+		s.emit(out, "response.output_item.done", map[string]any{"output_index": i, "item": *it})
+	}
+	typ := "response.completed"
+	s.res.Status = "completed"
+	if s.incomplete {
+		typ = "response.incomplete"
+		s.res.incomplete()
+	}
+	s.emit(out, typ, map[string]any{"response": s.res})
+}
+
+// chatStream converts Responses API events to Chat Completions chunks,
+// ending with a usage chunk when the client asked for one and [DONE].
+type chatStream struct {
+	id, model    string
+	created      int64
+	includeUsage bool
+	calls        map[string]int
+	ended        bool
+}
+
+// send writes c as a chunk of the stream.
+func (s *chatStream) send(out *bytes.Buffer, c chatCompletion) {
+	c.ID, c.Object, c.Created, c.Model = s.id, "chat.completion.chunk", s.created, s.model
+	if c.Choices == nil {
+		c.Choices = []chatChoice{}
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(out, "data: %s\n\n", b)
+}
+
+// delta writes a chunk with d and the finish reason, if any.
+func (s *chatStream) delta(out *bytes.Buffer, d chatMessage, finish *string) {
+	s.send(out, chatCompletion{Choices: []chatChoice{{Delta: &d, FinishReason: finish}}})
+}
+
+func (s *chatStream) event(data []byte, out *bytes.Buffer) {
+	var ev struct {
+		Type     string          `json:"type"`
+		Delta    string          `json:"delta"`
+		ItemID   string          `json:"item_id"`
+		Item     responseItem    `json:"item"`
+		Response *responseObject `json:"response"`
+	}
+	if s.ended || json.Unmarshal(data, &ev) != nil {
+		return
+	}
+	switch ev.Type {
+	case "response.created":
+		if r := ev.Response; r != nil {
+			s.id, s.model, s.created = r.ID, r.Model, r.CreatedAt
+		}
+		empty := ""
+		s.delta(out, chatMessage{Role: "assistant", Content: &empty}, nil)
+	case "response.output_text.delta":
+		s.delta(out, chatMessage{Content: &ev.Delta}, nil)
+	case "response.output_item.added":
+		if ev.Item.Type != "function_call" {
+			return
+		}
+		i := len(s.calls)
+		s.calls[ev.Item.ID] = i
+		tc := chatToolCall{Index: i, ID: ev.Item.CallID, Type: "function"}
+		tc.Function.Name, tc.Function.Arguments = ev.Item.Name, ev.Item.Arguments
+		s.delta(out, chatMessage{ToolCalls: []chatToolCall{tc}}, nil)
+	case "response.function_call_arguments.delta":
+		i, ok := s.calls[ev.ItemID]
+		if !ok {
+			return
+		}
+		tc := chatToolCall{Index: i}
+		tc.Function.Arguments = ev.Delta
+		s.delta(out, chatMessage{ToolCalls: []chatToolCall{tc}}, nil)
+	case "response.completed", "response.incomplete":
+		var r responseObject
+		if ev.Response != nil {
+			r = *ev.Response
+		}
+		finish := finishReason(r, len(s.calls) > 0)
+		s.delta(out, chatMessage{}, &finish)
+		if s.includeUsage && r.Usage != nil {
+			s.send(out, chatCompletion{Usage: r.Usage.chat()})
+		}
+		s.end(out)
+	case "response.failed", "error":
+		// Chat Completions streams report errors as a chunk with an error.
+		e := json.RawMessage(data)
+		if ev.Response != nil && ev.Response.Error != nil {
+			e = ev.Response.Error
+		}
+		fmt.Fprintf(out, "data: {\"error\":%s}\n\n", e)
+		s.end(out)
+	}
+}
+
+func (s *chatStream) finished() bool { return s.ended }
+
+func (s *chatStream) end(out *bytes.Buffer) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	out.WriteString("data: [DONE]\n\n")
+}
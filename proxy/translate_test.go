@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+)
+
+func TestResponsesToChat(t *testing.T) {
+	var m map[string]any
+	json.Unmarshal([]byte(`{
+		"model": "gpt-5", "instructions": "Be brief.", "stream": true, "max_output_tokens": 100,
+		"reasoning": {"effort": "low"}, "parallel_tool_calls": false,
+		"tools": [{"type": "function", "name": "shell", "parameters": {"type": "object"}}, {"type": "web_search"}],
+		"input": [
+			{"type": "message", "role": "developer", "content": [{"type": "input_text", "text": "env"}]},
+			{"type": "message", "role": "user", "content": [{"type": "input_text", "text": "list"}, {"type": "input_text", "text": "files"}]},
+			{"type": "reasoning", "summary": []},
+			{"type": "function_call", "call_id": "c1", "name": "shell", "arguments": "{\"cmd\":\"ls\"}"},
+			{"type": "function_call_output", "call_id": "c1", "output": "a.go"}
+		]
+	}`), &m)
+	got, _ := json.Marshal(responsesToChat(m))
+	want := `{"max_tokens":100,"messages":[{"content":"Be brief.","role":"system"},{"content":"env","role":"system"},{"content":"list\nfiles","role":"user"},` +
+		`{"content":null,"role":"assistant","tool_calls":[{"function":{"arguments":"{\"cmd\":\"ls\"}","name":"shell"},"id":"c1","type":"function"}]},` +
+		`{"content":"a.go","role":"tool","tool_call_id":"c1"}],"model":"gpt-5","parallel_tool_calls":false,"reasoning_effort":"low","stream":true,` +
+		`"stream_options":{"include_usage":true},"tools":[{"function":{"name":"shell","parameters":{"type":"object"}},"type":"function"}]}`
+	if string(got) != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestChatToResponses(t *testing.T) {
+	var m map[string]any
+	json.Unmarshal([]byte(`{
+		"model": "gpt-5", "max_completion_tokens": 50, "n": 1, "stop": ["x"],
+		"tools": [{"type": "function", "function": {"name": "f", "parameters": {}}}],
+		"tool_choice": {"type": "function", "function": {"name": "f"}},
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [{"type": "text", "text": "hi"}, {"type": "image_url", "image_url": {"url": "data:x"}}]},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "c1", "type": "function", "function": {"name": "f", "arguments": "{}"}}]},
+			{"role": "tool", "tool_call_id": "c1", "content": "done"}
+		]
+	}`), &m)
+	got, _ := json.Marshal(chatToResponses(m))
+	want := `{"input":[{"content":[{"text":"Be brief.","type":"input_text"}],"role":"system","type":"message"},` +
+		`{"content":[{"text":"hi","type":"input_text"},{"image_url":"data:x","type":"input_image"}],"role":"user","type":"message"},` +
+		`{"arguments":"{}","call_id":"c1","name":"f","type":"function_call"},{"call_id":"c1","output":"done","type":"function_call_output"}],` +
+		`"max_output_tokens":50,"model":"gpt-5","tool_choice":{"name":"f","type":"function"},"tools":[{"name":"f","parameters":{},"type":"function"}]}`
+	if string(got) != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestServeHTTPTranslatesResponses(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("upstream path %s", r.URL.Path)
+		}
+		var m map[string]any
+		json.NewDecoder(r.Body).Decode(&m)
+		if m["stream"] != true {
+			io.WriteString(w, `{"id":"c1","object":"chat.completion","created":1,"model":"gpt-5","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, c := range []string{
+			`{"id":"c2","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"role":"assistant","content":"Let me"}}]}`,
+			`{"id":"c2","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"content":" look."}}]}`,
+			`{"id":"c2","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call1","type":"function","function":{"name":"shell","arguments":""}}]}}]}`,
+			`{"id":"c2","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"cmd\":"}}]}}]}`,
+			`{"id":"c2","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"ls\"}"}}]},"finish_reason":"tool_calls"}]}`,
+			`{"id":"c2","created":1,"model":"gpt-5","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":4,"total_tokens":13}}`,
+			`[DONE]`,
+		} {
+			io.WriteString(w, "data: "+c+"\n\n")
+		}
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "relay", "k", "", 0)
+	mgr.SetCapabilities(ctx, a.ID, &account.Capabilities{ChatCompletions: true, Streaming: true, Tools: true})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-5","input":"hi"}`)))
+	var res responseObject
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("status %d body %s", rec.Code, rec.Body)
+	}
+	if res.Object != "response" || res.Status != "completed" || len(res.Output) != 1 || res.Output[0].Content[0].Text != "hello" || res.Usage == nil || res.Usage.InputTokens != 5 {
+		t.Fatalf("unexpected response %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-5","input":"hi","stream":true,"tools":[{"type":"function","name":"shell"}]}`)))
+	var types []string
+	var completed responseObject
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var ev struct {
+			Type     string          `json:"type"`
+			Response *responseObject `json:"response"`
+		}
+		json.Unmarshal([]byte(data), &ev)
+		types = append(types, ev.Type)
+		if ev.Type == "response.completed" {
+			completed = *ev.Response
+		}
+	}
+	wantTypes := []string{
+		"response.created", "response.in_progress",
+		"response.output_item.added", "response.content_part.added", "response.output_text.delta", "response.output_text.delta",
+		"response.output_item.added", "response.function_call_arguments.delta", "response.function_call_arguments.delta",
+		"response.output_text.done", "response.content_part.done", "response.output_item.done",
+		"response.function_call_arguments.done", "response.output_item.done", "response.completed",
+	}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Fatalf("events %v", types)
+	}
+	if len(completed.Output) != 2 || completed.Output[0].Content[0].Text != "Let me look." || completed.Output[1].CallID != "call1" ||
+		completed.Output[1].Arguments != `{"cmd":"ls"}` || completed.Usage == nil || completed.Usage.OutputTokens != 4 {
+		t.Fatalf("unexpected completed response %+v", completed)
+	}
+	// The log keeps what the upstream sent, usage included.
+	logs, _ := ls.List(ctx, 1, 0)
+	if len(logs) != 1 || !strings.HasSuffix(logs[0].URL, "/v1/chat/completions") || logs[0].OutputTokens != 4 {
+		t.Fatalf("unexpected log %+v", logs)
+	}
+}
+
+func TestServeHTTPTranslatesChat(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/responses" {
+			t.Errorf("upstream path %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range []string{
+			`{"type":"response.created","response":{"id":"r1","created_at":1,"model":"gpt-5","status":"in_progress","output":[]}}`,
+			`{"type":"response.output_text.delta","item_id":"m1","delta":"Hi"}`,
+			`{"type":"response.output_item.added","item":{"type":"function_call","id":"fc1","call_id":"call1","name":"f"}}`,
+			`{"type":"response.function_call_arguments.delta","item_id":"fc1","delta":"{}"}`,
+			`{"type":"response.completed","response":{"id":"r1","status":"completed","output":[],"usage":{"input_tokens":3,"output_tokens":1,"total_tokens":4}}}`,
+		} {
+			io.WriteString(w, "event: x\ndata: "+ev+"\n\n")
+		}
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "relay", "k", "", 0)
+	mgr.SetCapabilities(ctx, a.ID, &account.Capabilities{Responses: true, Streaming: true, Tools: true})
+	rec := httptest.NewRecorder()
+	body := `{"model":"gpt-5","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	want := []string{
+		`{"id":"r1","object":"chat.completion.chunk","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+		`{"id":"r1","object":"chat.completion.chunk","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}`,
+		`{"id":"r1","object":"chat.completion.chunk","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"content":null,"tool_calls":[{"index":0,"id":"call1","type":"function","function":{"name":"f","arguments":""}}]},"finish_reason":null}]}`,
+		`{"id":"r1","object":"chat.completion.chunk","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"content":null,"tool_calls":[{"index":0,"function":{"arguments":"{}"}}]},"finish_reason":null}]}`,
+		`{"id":"r1","object":"chat.completion.chunk","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"content":null},"finish_reason":"tool_calls"}]}`,
+		`{"id":"r1","object":"chat.completion.chunk","created":1,"model":"gpt-5","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4,"prompt_tokens_details":{"cached_tokens":0}}}`,
+		`[DONE]`,
+	}
+	var got []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			got = append(got, data)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("chunks\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestServeHTTPTranslatesTruncatedStream(t *testing.T) {
+	var events []string
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range events {
+			io.WriteString(w, "data: "+ev+"\n\n")
+		}
+	})
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "relay", "k", "", 0)
+
+	// The upstream closes a Responses stream before response.completed.
+	mgr.SetCapabilities(ctx, a.ID, &account.Capabilities{Responses: true, Streaming: true})
+	events = []string{
+		`{"type":"response.created","response":{"id":"r1","created_at":1,"model":"gpt-5","status":"in_progress","output":[]}}`,
+		`{"type":"response.output_text.delta","item_id":"m1","delta":"Hi"}`,
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","stream":true,"messages":[{"role":"user","content":"hi"}]}`)))
+	if out := rec.Body.String(); !strings.Contains(out, `"Hi"`) || !strings.Contains(out, InterruptedCode) || strings.Contains(out, "finish_reason\":\"stop") || strings.Contains(out, "[DONE]") {
+		t.Fatalf("truncated stream reported as complete:\n%s", out)
+	}
+
+	// The upstream closes a Chat Completions stream before [DONE].
+	mgr.SetCapabilities(ctx, a.ID, &account.Capabilities{ChatCompletions: true, Streaming: true})
+	events = []string{
+		`{"id":"c1","created":1,"model":"gpt-5","choices":[{"index":0,"delta":{"role":"assistant","content":"Hi"}}]}`,
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model":"gpt-5","stream":true,"input":"hi"}`)))
+	if out := rec.Body.String(); !strings.Contains(out, "response.output_text.delta") || !strings.Contains(out, InterruptedCode) || strings.Contains(out, "response.completed") {
+		t.Fatalf("truncated stream reported as complete:\n%s", out)
+	}
+}
+
+func TestServeHTTPChatGPTChatCompletions(t *testing.T) {
+	t.Run("chatgpt", func(t *testing.T) {
+		h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/responses" {
+				t.Errorf("upstream path %s", r.URL.Path)
+			}
+			var m map[string]any
+			json.NewDecoder(r.Body).Decode(&m)
+			if m["instructions"] != "Be brief." || m["stream"] != true || m["store"] != false || len(m["input"].([]any)) != 1 {
+				t.Errorf("unexpected upstream body %v", m)
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "event: response.output_item.done\ndata: "+`{"type":"response.output_item.done","item":{"type":"message","role":"assistant","content":[{"type":"output_text","text":"pong"}]}}`+"\n\n")
+			io.WriteString(w, "event: response.completed\ndata: "+`{"type":"response.completed","response":{"id":"r1","model":"gpt-5","status":"completed","output":[],"usage":{"input_tokens":3,"output_tokens":1,"total_tokens":4}}}`+"\n\n")
+		})
+		ctx := context.Background()
+		a, _ := mgr.AddChatGPT(ctx, "cg", "rt", "aid", 0)
+		a.AccessToken, a.TokenExpiresAt = "at", time.Now().Add(time.Hour)
+		mgr.Update(ctx, a)
+		rec := httptest.NewRecorder()
+		body := `{"model":"gpt-5","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"ping"}]}`
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		var c chatCompletion
+		json.Unmarshal(rec.Body.Bytes(), &c)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" || len(c.Choices) != 1 ||
+			*c.Choices[0].Message.Content != "pong" || *c.Choices[0].FinishReason != "stop" || c.Usage.TotalTokens != 4 {
+			t.Fatalf("unexpected response %d %s", rec.Code, rec.Body)
+		}
+	})
+	t.Run("api key", func(t *testing.T) {
+		h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/chat/completions" {
+				t.Errorf("upstream path %s", r.URL.Path)
+			}
+			io.WriteString(w, `{"object":"chat.completion"}`)
+		})
+		mgr.AddAPIKey(context.Background(), "key", "k", "", 0)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[]}`)))
+		if rec.Body.String() != `{"object":"chat.completion"}` {
+			t.Fatalf("API key response changed: %s", rec.Body)
+		}
+	})
+}
@@ -0,0 +1,569 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	acct "github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/metrics"
+	"github.com/kxn/codex-companion/internal/outbound"
+	"github.com/kxn/codex-companion/internal/replay"
+	"github.com/kxn/codex-companion/internal/tokenizer"
+	"github.com/kxn/codex-companion/log"
+)
+
+// send is the innermost attempt stage: it performs the upstream round trip.
+// Upgrades are sent without Client.Timeout, which would otherwise cut the
+// tunnel off.
+func (h *Handler) send(at *Attempt) (*http.Response, error) {
+	client, err := h.client(at.Account)
+	if err != nil {
+		return nil, err
+	}
+	if upgradeType(at.Upstream.Header) != "" {
+		c := *client
+		c.Timeout = 0
+		return c.Do(at.Upstream)
+	}
+	resp, err := client.Do(at.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	decodeResponse(resp)
+	return resp, nil
+}
+
+// client returns the client reaching a's upstream: Client, with a transport
+// of the account's own when it has a ProxyURL or TLS settings. Invalid
+// settings fail the request rather than letting it leave through the
+// shared transport.
+func (h *Handler) client(a *acct.Account) (*http.Client, error) {
+	return h.transports.Client(h.Client, a.ID, outbound.Options{ProxyURL: a.ProxyURL, CAFile: a.CAFile, InsecureSkipVerify: a.InsecureSkipVerify})
+}
+
+// Subscribe drops the transport of an account updated or deleted on bus,
+// see outbound.Accounts.Subscribe. It returns the function cancelling the
+// subscription.
+func (h *Handler) Subscribe(bus *events.Bus) func() {
+	return h.transports.Subscribe(bus)
+}
+
+// maxBuffered is the size up to which non-streaming response bodies are
+// buffered, so they can be replayed to the client with an exact
+// Content-Length. Larger successful bodies are streamed through instead of
+// being held in memory.
+const maxBuffered = 1 << 20
+
+// logAttempt records every attempt through the LogSink. Error responses and
+// other bodies up to maxBuffered are buffered so they can be stored and then
+// replayed to the client; successful event streams and larger bodies are
+// forwarded as they arrive and recorded once they end. Only the first
+// LogBodyLimit bytes of a body are stored. Connection setup, time to first byte and body transfer are
+// timed with httptrace.
+func (h *Handler) logAttempt(next AttemptFunc) AttemptFunc {
+	return func(at *Attempt) (*http.Response, error) {
+		start := time.Now()
+		tm := newTiming()
+		at.Upstream = at.Upstream.WithContext(httptrace.WithClientTrace(at.Upstream.Context(), tm.trace()))
+		// The request size is what the transport actually sent.
+		var sent atomic.Int64
+		if body := at.Upstream.Body; body != nil && body != http.NoBody {
+			at.Upstream.Body = countingBody{rc: body, n: &sent}
+		}
+		resp, err := next(at)
+		r := at.Request
+		ctx := r.Context()
+		rl := &log.RequestLog{
+			Time:      time.Now(),
+			AccountID: at.Account.ID,
+			Method:    r.Method,
+			URL:       at.Upstream.URL.String(),
+			ReqHeader: r.Header.Clone(),
+			ClientKey: at.ClientKey,
+			Model:     at.model(),
+			Session:   cacheKey(r, at.Body),
+			Shadow:    at.Shadow,
+		}
+		// derive returns the function filling in the fields of rl that take
+		// parsing the bodies, which an Enricher runs after the insert.
+		derive := func(respBody []byte, usage func() (input, output, cached int64)) func(*log.RequestLog) {
+			return func(rl *log.RequestLog) {
+				rl.ReqBody = logBody(rl.ReqHeader, at.Body)
+				if len(at.Body) > 0 && !isForm(rl.ReqHeader) {
+					rl.EstimatedTokens = int64(tokenizer.EstimateRequest(at.Body))
+				}
+				if rl.Status == 0 {
+					// Transport errors have no response.
+					return
+				}
+				rl.RespBody = string(respBody)
+				if isBinary(rl.RespHeader) {
+					rl.RespBody = binarySummary(rl.RespHeader, rl.RespSize)
+				}
+				if rl.Status < 400 && usage != nil {
+					rl.InputTokens, rl.OutputTokens, rl.CachedTokens = usage()
+					countTokens(rl)
+				}
+			}
+		}
+		if at.Decision != nil {
+			if b, err := json.Marshal(at.Decision); err == nil {
+				rl.Decision = string(b)
+			}
+		}
+		if err != nil {
+			logger.Warnc(ctx, "upstream error: %v", err)
+			rl.DurationMs = time.Since(start).Milliseconds()
+			rl.Error = err.Error()
+			rl.ReqSize = int(sent.Load())
+			tm.apply(rl)
+			h.countTraffic(rl)
+			h.recordLog(ctx, rl, derive(nil, nil))
+			h.observe(at, 0, time.Since(start), err)
+			return nil, err
+		}
+		// Transports that bypass the network never report the first byte.
+		tm.set(&tm.firstByte, true)
+		logger.Debugc(ctx, "upstream %s %s status %d headers %v", at.Upstream.Method, at.Upstream.URL, resp.StatusCode, replay.SanitizeHeader(resp.Header))
+		rl.RespHeader = resp.Header.Clone()
+		rl.Status = resp.StatusCode
+		finish := func(respBody []byte, size int, usage func() (input, output, cached int64)) {
+			tm.done()
+			duration := time.Since(start)
+			if h.LogBodyLimit > 0 && len(respBody) > h.LogBodyLimit {
+				respBody = respBody[:h.LogBodyLimit]
+			}
+			rl.ReqSize, rl.RespSize = int(sent.Load()), size
+			rl.DurationMs = duration.Milliseconds()
+			tm.apply(rl)
+			if resp.StatusCode >= 400 {
+				rl.Error = string(respBody)
+			}
+			h.countTraffic(rl)
+			h.recordLog(ctx, rl, derive(respBody, usage))
+			h.observe(at, resp.StatusCode, duration, nil)
+			if h.SlowThreshold > 0 && duration >= h.SlowThreshold {
+				logger.Warnc(ctx, "slow request %s via account %d model %q status %d: total %dms (dns %dms, connect %dms, tls %dms, first byte %dms, streaming %dms)",
+					r.URL.Path, at.Account.ID, rl.Model, resp.StatusCode, rl.DurationMs, rl.DNSMs, rl.ConnectMs, rl.TLSMs, rl.TTFBMs, rl.StreamMs)
+			}
+			logger.Infoc(ctx, "proxied %s via account %d status %d in %dms", r.URL.Path, at.Account.ID, resp.StatusCode, duration.Milliseconds())
+		}
+		if resp.StatusCode < 400 && isEventStream(resp) {
+			resp.Body = &streamBody{rc: resp.Body, finish: finish}
+			return resp, nil
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			resp.Body = &tunnelBody{rc: resp.Body, sent: &sent, finish: func(size int) { finish(nil, size, nil) }}
+			return resp, nil
+		}
+		respBody, rerr := io.ReadAll(io.LimitReader(resp.Body, maxBuffered+1))
+		if rerr == nil && len(respBody) > maxBuffered && resp.StatusCode < 400 {
+			resp.Body = &captureBody{rc: resp.Body, head: respBody, limit: h.LogBodyLimit, finish: finish}
+			return resp, nil
+		}
+		if rerr == nil {
+			var rest []byte
+			rest, rerr = io.ReadAll(resp.Body)
+			respBody = append(respBody, rest...)
+		}
+		resp.Body.Close()
+		if rerr != nil {
+			// Nothing was forwarded yet, so the attempt fails like a
+			// transport error instead of passing on a truncated body.
+			logger.Warnc(ctx, "read response body: %v", rerr)
+			rl.Error = "read response body: " + rerr.Error()
+			finish(respBody, len(respBody), nil)
+			return nil, fmt.Errorf("read response body: %w", rerr)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		resp.ContentLength = int64(len(respBody))
+		finish(respBody, len(respBody), func() (int64, int64, int64) { return parseUsage(respBody) })
+		return resp, nil
+	}
+}
+
+// isEventStream reports whether resp is a server-sent event stream.
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// isBinary reports whether header announces a binary body, such as
+// generated speech, which logs describe instead of storing.
+func isBinary(header http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mt, "audio/"), strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "video/"):
+		return true
+	}
+	return mt == "application/octet-stream"
+}
+
+// binarySummary describes a binary body of size bytes with header.
+func binarySummary(header http.Header, size int) string {
+	return fmt.Sprintf("[%s, %d bytes]", header.Get("Content-Type"), size)
+}
+
+// logBody returns what the log stores of a request body with header. Binary
+// bodies are summarized, and so are the files of multipart forms, such as
+// the audio of a transcription, of which only the name, type and size are
+// kept next to the other fields.
+func logBody(header http.Header, body []byte) string {
+	if isBinary(header) {
+		return binarySummary(header, len(body))
+	}
+	mt, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		return string(body)
+	}
+	var sb strings.Builder
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return sb.String()
+		}
+		if err != nil {
+			return fmt.Sprintf("[%s, %d bytes]", mt, len(body))
+		}
+		if p.FileName() != "" {
+			n, _ := io.Copy(io.Discard, p)
+			fmt.Fprintf(&sb, "%s: [file %q, %s, %d bytes]\n", p.FormName(), p.FileName(), p.Header.Get("Content-Type"), n)
+			continue
+		}
+		v, _ := io.ReadAll(p)
+		fmt.Fprintf(&sb, "%s: %s\n", p.FormName(), v)
+	}
+}
+
+// countingBody counts the bytes of a request body as the transport reads
+// them. The transport may still be sending the body when the response
+// arrives, hence the atomic counter.
+type countingBody struct {
+	rc io.ReadCloser
+	n  *atomic.Int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (b countingBody) Close() error { return b.rc.Close() }
+
+// streamBody passes an event stream through to the client while keeping a
+// summary for the log and picking the token usage out of the final events.
+// finish runs once, at the end of the stream or when the body is closed,
+// with the summary and the full size of the stream.
+type streamBody struct {
+	rc     io.ReadCloser
+	log    streamLog
+	size   int
+	usage  sseUsage
+	finish func(respBody []byte, size int, usage func() (input, output, cached int64))
+	once   sync.Once
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.size += n
+	b.log.Write(p[:n])
+	b.usage.Write(p[:n])
+	if err != nil {
+		if err != io.EOF {
+			logger.Warnf("read response stream: %v", err)
+		}
+		b.end()
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	err := b.rc.Close()
+	b.end()
+	return err
+}
+
+func (b *streamBody) end() {
+	b.once.Do(func() {
+		b.finish(b.log.Bytes(), b.size, b.usage.Tokens)
+	})
+}
+
+// captureBody passes a large non-streaming body through to the client,
+// starting with the head already read, while keeping the first limit bytes
+// for the log (all of them when limit is zero) and the last usageTail bytes
+// to find the token usage in. finish runs once, at the end of the body or
+// when it is closed.
+type captureBody struct {
+	rc     io.ReadCloser
+	head   []byte
+	limit  int
+	log    []byte
+	tail   []byte
+	size   int
+	finish func(respBody []byte, size int, usage func() (input, output, cached int64))
+	once   sync.Once
+}
+
+// usageTail is how much of the end of a captured body is searched for the
+// token usage, which the Responses and Chat Completions APIs put last.
+const usageTail = 64 << 10
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(b.head) > 0 {
+		n = copy(p, b.head)
+		b.head = b.head[n:]
+	} else {
+		n, err = b.rc.Read(p)
+	}
+	b.size += n
+	if keep := n; b.limit == 0 || len(b.log) < b.limit {
+		if b.limit > 0 {
+			keep = min(n, b.limit-len(b.log))
+		}
+		b.log = append(b.log, p[:keep]...)
+	}
+	b.tail = append(b.tail, p[:n]...)
+	if len(b.tail) > 2*usageTail {
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-usageTail:]...)
+	}
+	if err != nil {
+		if err != io.EOF {
+			logger.Warnf("read response body: %v", err)
+		}
+		b.end()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.rc.Close()
+	b.end()
+	return err
+}
+
+func (b *captureBody) end() {
+	b.once.Do(func() {
+		usage := func() (int64, int64, int64) { return tailUsage(b.tail) }
+		if len(b.log) == b.size {
+			usage = func() (int64, int64, int64) { return parseUsage(b.log) }
+		}
+		b.finish(b.log, b.size, usage)
+	})
+}
+
+// streamLog summarizes an event stream written to it piece by piece for the
+// log. Events are kept as they are, except that runs of Responses API delta
+// events, whose content the final response.completed event repeats, are
+// replaced by an SSE comment counting them. Chat Completions chunks are all
+// kept since no event repeats them.
+type streamLog struct {
+	buf     bytes.Buffer
+	event   []byte
+	omitted int
+}
+
+func (l *streamLog) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.event = append(l.event, p...)
+			break
+		}
+		// The line may have begun in an earlier write.
+		start := bytes.LastIndexByte(l.event, '\n') + 1
+		l.event = append(l.event, p[:i+1]...)
+		p = p[i+1:]
+		if len(bytes.TrimRight(l.event[start:], "\r\n")) == 0 {
+			l.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush ends the current event.
+func (l *streamLog) flush() {
+	if isDeltaEvent(l.event) {
+		l.omitted++
+		l.event = l.event[:0]
+		return
+	}
+	if l.omitted > 0 {
+		fmt.Fprintf(&l.buf, ": %d delta events omitted\n\n", l.omitted)
+		l.omitted = 0
+	}
+	l.buf.Write(l.event)
+	l.event = l.event[:0]
+}
+
+// Bytes returns the summary, including an unterminated final event.
+func (l *streamLog) Bytes() []byte {
+	if len(l.event) > 0 || l.omitted > 0 {
+		l.flush()
+	}
+	return l.buf.Bytes()
+}
+
+// isDeltaEvent reports whether ev is a Responses API event whose type, from
+// its event line or else its data, ends in ".delta".
+func isDeltaEvent(ev []byte) bool {
+	for _, line := range bytes.Split(ev, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if name, ok := bytes.CutPrefix(line, []byte("event:")); ok {
+			name = bytes.TrimSpace(name)
+			return bytes.HasPrefix(name, []byte("response.")) && bytes.HasSuffix(name, []byte(".delta"))
+		}
+	}
+	var typ struct {
+		Type string `json:"type"`
+	}
+	for _, line := range bytes.Split(ev, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data:"))
+		if !ok {
+			continue
+		}
+		if !bytes.Contains(data, []byte(`.delta"`)) {
+			return false
+		}
+		if json.Unmarshal(bytes.TrimSpace(data), &typ) == nil {
+			return strings.HasPrefix(typ.Type, "response.") && strings.HasSuffix(typ.Type, ".delta")
+		}
+	}
+	return false
+}
+
+var (
+	attempts        = metrics.Default.NewCounter("companion_upstream_attempts_total", "Upstream attempts by account and status, 0 for transport errors.", "account", "status")
+	attemptDuration = metrics.Default.NewTimer("companion_upstream_attempt_duration_seconds", "Duration of upstream attempts by account and status.", "account", "status")
+	tokens          = metrics.Default.NewCounter("companion_tokens_total", "Upstream-reported tokens by account and kind.", "account", "kind")
+	traffic         = metrics.Default.NewCounter("companion_upstream_bytes_total", "Bytes sent to and received from the upstream by account and direction.", "account", "direction")
+	clientTraffic   = metrics.Default.NewCounter("companion_client_bytes_total", "Bytes sent to and received from the upstream by client key and direction.", "client", "direction")
+	// logInsertDuration is the time the request path spends writing logs.
+	logInsertDuration = metrics.Default.NewTimer("companion_log_insert_duration_seconds", "Duration of request log inserts.")
+)
+
+// countTraffic adds the request and response sizes of a logged attempt to
+// the traffic metrics and the month's bandwidth.
+func (h *Handler) countTraffic(rl *log.RequestLog) {
+	id := strconv.FormatInt(rl.AccountID, 10)
+	traffic.Add(float64(rl.ReqSize), id, "sent")
+	traffic.Add(float64(rl.RespSize), id, "received")
+	clientTraffic.Add(float64(rl.ReqSize), rl.ClientKey, "sent")
+	clientTraffic.Add(float64(rl.RespSize), rl.ClientKey, "received")
+	h.meter.add(rl)
+}
+
+// observe records an attempt outcome in the metrics and reports it to the
+// Selector if it is interested. Shadow attempts are left out, since no
+// client depended on them.
+func (h *Handler) observe(at *Attempt, status int, latency time.Duration, err error) {
+	if at.Shadow {
+		return
+	}
+	id, code := strconv.FormatInt(at.Account.ID, 10), strconv.Itoa(status)
+	attempts.Inc(id, code)
+	attemptDuration.Observe(latency, id, code)
+	if o, ok := h.Scheduler.(AttemptObserver); ok {
+		o.ObserveAttempt(at.Account.ID, status, latency, err)
+	}
+}
+
+// writeResponse copies an upstream response to the client, without its
+// hop-by-hop headers. An upstream request ID is passed on as
+// UpstreamRequestIDHeader so it does not duplicate the proxy's.
+//
+// The upstream Content-Length is never copied because hooks and shaping may
+// have rewritten the body: buffered responses are measured again, while
+// event streams, bodies over maxBuffered and responses carrying trailers are
+// sent chunked, with the trailers forwarded once the body is done.
+//
+// It returns the error of an upstream body breaking off after part of it
+// was forwarded, see Handler.interrupted; errors writing to the client are
+// only logged.
+func writeResponse(w http.ResponseWriter, resp *http.Response) error {
+	defer resp.Body.Close()
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+	if id := header.Values(RequestIDHeader); len(id) > 0 && w.Header().Get(RequestIDHeader) != "" {
+		header.Del(RequestIDHeader)
+		header[UpstreamRequestIDHeader] = id
+	}
+	for k, v := range header {
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
+	var body io.Reader = resp.Body
+	if !isEventStream(resp) && len(resp.Trailer) == 0 && bodyAllowed(resp.StatusCode) {
+		// Bodies up to maxBuffered get an exact Content-Length, even when
+		// a hook rewrote them; larger ones are streamed chunked.
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxBuffered+1))
+		if err != nil {
+			logger.Errorf("read response: %v", err)
+		}
+		if len(b) <= maxBuffered {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			body = bytes.NewReader(b)
+		} else {
+			body = io.MultiReader(bytes.NewReader(b), resp.Body)
+		}
+	}
+	if len(resp.Trailer) > 0 {
+		keys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Set("Trailer", strings.Join(keys, ", "))
+	}
+	w.WriteHeader(resp.StatusCode)
+	src := &sourceReader{r: body}
+	if _, err := io.Copy(flushWriter{w}, src); err != nil && src.err == nil {
+		logger.Errorf("write response: %v", err)
+	}
+	if src.err != nil {
+		return src.err
+	}
+	// Trailers are only known after the body has been read to the end;
+	// the prefix also forwards those the upstream did not announce.
+	for k, v := range resp.Trailer {
+		for _, vv := range v {
+			w.Header().Add(http.TrailerPrefix+k, vv)
+		}
+	}
+	return nil
+}
+
+// bodyAllowed reports whether a response with status may carry a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// flushWriter flushes after every write so streamed events reach the client
+// as soon as they arrive.
+type flushWriter struct{ w http.ResponseWriter }
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChunkedEventStreamWithTrailer(t *testing.T) {
+	events := []string{"event: response.created\ndata: {}\n\n", "event: response.completed\ndata: {}\n\n"}
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Trailer", "X-Checksum")
+		for _, ev := range events {
+			io.WriteString(w, ev)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "1")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	resp, err := http.Post(front.URL+"/v1/responses", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != strings.Join(events, "") {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("expected a chunked response, got length %d encoding %v", resp.ContentLength, resp.TransferEncoding)
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" || resp.Trailer.Get("X-Late") != "1" {
+		t.Fatalf("trailers not forwarded: %v", resp.Trailer)
+	}
+}
+
+func TestLongStream(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/models" {
+			// No headers within the header timeout.
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 5 {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.WriteString(w, "event: response.completed\ndata: {}\n\n")
+	})
+	// Stands in for outbound.HeaderTimeout, which once bounded the whole
+	// response.
+	h.Client.Transport.(*http.Transport).ResponseHeaderTimeout = 100 * time.Millisecond
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	resp, err := http.Post(front.URL+"/v1/responses", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.HasSuffix(string(body), "event: response.completed\ndata: {}\n\n") || strings.Contains(string(body), "stream_interrupted") {
+		t.Fatalf("stream cut off: %q %v", body, err)
+	}
+
+	start := time.Now()
+	resp, err = http.Get(front.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || time.Since(start) > 250*time.Millisecond {
+		t.Fatalf("header timeout not applied: %d after %v", resp.StatusCode, time.Since(start))
+	}
+}
+
+// rewriteHook replaces every response body, changing its length.
+type rewriteHook struct{}
+
+func (rewriteHook) OnResponse(hc *HookContext, resp *http.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(append(b, " and more"...)))
+	return nil
+}
+
+func TestRewrittenBodyContentLength(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	h.Register(rewriteHook{})
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok and more" || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("unexpected body %q with length %d", body, resp.ContentLength)
+	}
+}
+
+func TestChunkedRequestBodyLength(t *testing.T) {
+	var length int64
+	var got []byte
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		length = r.ContentLength
+		got, _ = io.ReadAll(r.Body)
+	})
+	a, _ := mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	a.ModelMap = map[string]string{"gpt-5": "gpt-5-codex-with-a-longer-name"}
+	if err := mgr.Update(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	// Hiding the reader's type makes the client send the body chunked.
+	body := struct{ io.Reader }{strings.NewReader(`{"model":"gpt-5"}`)}
+	resp, err := http.Post(front.URL+"/v1/responses", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.Contains(string(got), "gpt-5-codex-with-a-longer-name") || length != int64(len(got)) {
+		t.Fatalf("upstream received %q with length %d", got, length)
+	}
+}
+
+func TestStreamLogSummary(t *testing.T) {
+	stream := "event: response.created\ndata: {\"type\":\"response.created\"}\n\n" +
+		"event: response.output_text.delta\ndata: {\"delta\":\"a\"}\n\n" +
+		"event: response.output_text.delta\r\ndata: {\"delta\":\"b\"}\r\n\r\n" +
+		"data: {\"type\":\"response.reasoning_summary_text.delta\"}\n\n" +
+		"event: response.output_item.done\ndata: {}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"c\"}}]}\n\n" +
+		"event: response.completed\ndata: {\"type\":\"response.completed\"}"
+	var l streamLog
+	// Written in small pieces, as the stream arrives.
+	for i := 0; i < len(stream); i += 7 {
+		l.Write([]byte(stream[i:min(i+7, len(stream))]))
+	}
+	want := "event: response.created\ndata: {\"type\":\"response.created\"}\n\n" +
+		": 3 delta events omitted\n\n" +
+		"event: response.output_item.done\ndata: {}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"c\"}}]}\n\n" +
+		"event: response.completed\ndata: {\"type\":\"response.completed\"}"
+	if got := string(l.Bytes()); got != want {
+		t.Fatalf("unexpected summary:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestLargeBodyStreamed(t *testing.T) {
+	payload := `{"output":"` + strings.Repeat("x", 2*maxBuffered) + `","usage":{"input_tokens":7,"output_tokens":9}}`
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, payload)
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	h.LogBodyLimit = 1024
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	resp, err := http.Post(front.URL+"/v1/responses", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != payload {
+		t.Fatalf("body of %d bytes not passed through: %v", len(body), err)
+	}
+	if resp.ContentLength != -1 {
+		t.Fatalf("expected a chunked response, got length %d", resp.ContentLength)
+	}
+	logs, _ := ls.List(context.Background(), 1, 0)
+	full, _ := ls.Get(context.Background(), logs[0].ID)
+	if full.RespBody != payload[:1024] || full.RespSize != len(payload) || full.InputTokens != 7 || full.OutputTokens != 9 {
+		t.Fatalf("unexpected log: %d bytes of %d, tokens %d/%d", len(full.RespBody), full.RespSize, full.InputTokens, full.OutputTokens)
+	}
+
+	// Small bodies are still buffered, with only the limit logged.
+	payload = `{"output":"` + strings.Repeat("y", 2048) + `"}`
+	resp, err = http.Post(front.URL+"/v1/responses", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != payload || resp.ContentLength != int64(len(payload)) {
+		t.Fatalf("unexpected small body of %d bytes with length %d", len(body), resp.ContentLength)
+	}
+	logs, _ = ls.List(context.Background(), 1, 0)
+	if full, _ := ls.Get(context.Background(), logs[0].ID); len(full.RespBody) != 1024 || full.RespSize != len(payload) {
+		t.Fatalf("unexpected log: %d bytes of %d", len(full.RespBody), full.RespSize)
+	}
+}
+
+func TestRequestSizeCounted(t *testing.T) {
+	var received atomic.Int64
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+		io.WriteString(w, `{}`)
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	body := `{"model":"gpt-5","input":"` + strings.Repeat("z", 5000) + `"}`
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(body))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	logs, _ := ls.List(context.Background(), 1, 0)
+	if len(logs) != 1 || logs[0].ReqSize == 0 || int64(logs[0].ReqSize) != received.Load() || logs[0].RespSize != 2 {
+		t.Fatalf("unexpected sizes %+v, upstream received %d", logs, received.Load())
+	}
+}
+
+func TestAccountProxy(t *testing.T) {
+	var direct, proxied atomic.Int32
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		direct.Add(1)
+		io.WriteString(w, "direct")
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		io.WriteString(w, "proxied "+r.Header.Get("Authorization"))
+	}))
+	defer proxy.Close()
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	a.ProxyURL = proxy.URL
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	send := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/models", nil))
+		return rec.Body.String()
+	}
+	if got := send(); got != "proxied Bearer k1" || direct.Load() != 0 {
+		t.Fatalf("got %q, %d direct requests", got, direct.Load())
+	}
+
+	// An invalid proxy never lets the account's traffic out directly.
+	a.ProxyURL = "ftp://proxy:21"
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if got := send(); got != "direct" || proxied.Load() != 1 {
+		t.Fatalf("got %q, %d proxied requests", got, proxied.Load())
+	}
+}
+
+func TestAccountCA(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "default")
+	})
+	private := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "private")
+	}))
+	defer private.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: private.Certificate().Raw}), 0o600)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "self-hosted", "k", private.URL, 1)
+	send := func() (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/v1/models", nil))
+		return rec.Code, rec.Body.String()
+	}
+	// The private CA is unknown to the shared transport.
+	if code, _ := send(); code == http.StatusOK {
+		t.Fatal("untrusted certificate accepted")
+	}
+	a.CAFile = ca
+	if err := mgr.Update(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := send(); code != http.StatusOK || body != "private" {
+		t.Fatalf("got %d %q", code, body)
+	}
+}
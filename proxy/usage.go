@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/log"
+)
+
+// UsageSource reports the consumption recorded by the proxy. *log.Store
+// implements it.
+type UsageSource interface {
+	Usage(ctx context.Context, since, until time.Time) ([]log.Usage, error)
+}
+
+var _ UsageSource = (*log.Store)(nil)
+
+const day = 24 * time.Hour
+
+// usage answers the usage endpoints clients poll from the companion's own
+// records instead of forwarding them: the pooled upstream accounts' usage is
+// meaningless to a single client. Each client only sees the consumption of
+// its own key.
+func (h *Handler) usage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Usage == nil || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/usage":
+			h.legacyUsage(w, r)
+		case "/v1/organization/usage/completions":
+			h.completionsUsage(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// clientUsage returns the usage of the requesting client in [since, until).
+func (h *Handler) clientUsage(r *http.Request, since, until time.Time) ([]log.Usage, error) {
+	all, err := h.Usage.Usage(r.Context(), since, until)
+	if err != nil {
+		return nil, err
+	}
+	key := RequestFrom(r).ClientKey
+	var res []log.Usage
+	for _, u := range all {
+		if u.ClientKey == key {
+			res = append(res, u)
+		}
+	}
+	return res, nil
+}
+
+// legacyUsage serves GET /v1/usage?date=YYYY-MM-DD in the format of the
+// legacy dashboard endpoint. The date defaults to today (UTC).
+func (h *Handler) legacyUsage(w http.ResponseWriter, r *http.Request) {
+	date := time.Now().UTC().Truncate(day)
+	if s := r.URL.Query().Get("date"); s != "" {
+		d, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			usageError(w, "invalid date, expected YYYY-MM-DD")
+			return
+		}
+		date = d
+	}
+	usage, err := h.clientUsage(r, date, date.Add(day))
+	if err != nil {
+		logger.Errorf("usage query failed: %v", err)
+		http.Error(w, "usage unavailable", http.StatusInternalServerError)
+		return
+	}
+	type entry struct {
+		AggregationTimestamp int64  `json:"aggregation_timestamp"`
+		Requests             int64  `json:"n_requests"`
+		Operation            string `json:"operation"`
+		ContextTokens        int64  `json:"n_context_tokens_total"`
+		GeneratedTokens      int64  `json:"n_generated_tokens_total"`
+	}
+	data := make([]entry, 0, len(usage))
+	for _, u := range usage {
+		data = append(data, entry{u.Day.Unix(), u.Requests, "completion", u.InputTokens, u.OutputTokens})
+	}
+	writeJSON(w, map[string]any{"object": "list", "data": data})
+}
+
+// completionsUsage serves GET /v1/organization/usage/completions with daily
+// buckets. start_time is required; end_time defaults to now.
+func (h *Handler) completionsUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if bw := q.Get("bucket_width"); bw != "" && bw != "1d" {
+		usageError(w, "only bucket_width=1d is supported")
+		return
+	}
+	start, err := strconv.ParseInt(q.Get("start_time"), 10, 64)
+	if err != nil {
+		usageError(w, "start_time must be a unix timestamp")
+		return
+	}
+	since, until := time.Unix(start, 0).UTC().Truncate(day), time.Now().UTC()
+	if s := q.Get("end_time"); s != "" {
+		end, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || end < start {
+			usageError(w, "end_time must be a unix timestamp after start_time")
+			return
+		}
+		until = time.Unix(end, 0).UTC()
+	}
+	usage, err := h.clientUsage(r, since, until)
+	if err != nil {
+		logger.Errorf("usage query failed: %v", err)
+		http.Error(w, "usage unavailable", http.StatusInternalServerError)
+		return
+	}
+	type result struct {
+		Object        string `json:"object"`
+		InputTokens   int64  `json:"input_tokens"`
+		OutputTokens  int64  `json:"output_tokens"`
+		ModelRequests int64  `json:"num_model_requests"`
+	}
+	type bucket struct {
+		Object    string   `json:"object"`
+		StartTime int64    `json:"start_time"`
+		EndTime   int64    `json:"end_time"`
+		Results   []result `json:"results"`
+	}
+	var data []bucket
+	for d := since; d.Before(until); d = d.Add(day) {
+		b := bucket{Object: "bucket", StartTime: d.Unix(), EndTime: d.Add(day).Unix(), Results: []result{}}
+		for _, u := range usage {
+			if u.Day.Equal(d) {
+				b.Results = append(b.Results, result{"organization.usage.completions.result", u.InputTokens, u.OutputTokens, u.Requests})
+			}
+		}
+		data = append(data, b)
+	}
+	if data == nil {
+		data = []bucket{}
+	}
+	writeJSON(w, map[string]any{"object": "page", "data": data, "has_more": false, "next_page": nil})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("encode usage failed: %v", err)
+	}
+}
+
+// usageError writes an OpenAI-style invalid request error.
+func usageError(w http.ResponseWriter, msg string) {
+	writeError(w, http.StatusBadRequest, map[string]any{"message": msg, "type": "invalid_request_error"})
+}
+
+// tokenUsage is the usage object of Responses and Chat Completions payloads.
+type tokenUsage struct {
+	InputTokens         int64         `json:"input_tokens"`
+	OutputTokens        int64         `json:"output_tokens"`
+	PromptTokens        int64         `json:"prompt_tokens"`
+	CompletionTokens    int64         `json:"completion_tokens"`
+	InputTokensDetails  *tokenDetails `json:"input_tokens_details"`
+	PromptTokensDetails *tokenDetails `json:"prompt_tokens_details"`
+}
+
+// tokenDetails breaks down the input tokens; CachedTokens were read from
+// the prompt cache.
+type tokenDetails struct {
+	CachedTokens int64 `json:"cached_tokens"`
+}
+
+// parseUsage extracts token usage, including the cached part of the input,
+// from a JSON response or an SSE stream. For streams the last event carrying
+// usage wins, which is response.completed for the Responses API and the final
+// chunk for Chat Completions.
+func parseUsage(body []byte) (input, output, cached int64) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		return usageOf(trimmed).tokens()
+	}
+	var u sseUsage
+	u.Write(body)
+	return u.Tokens()
+}
+
+// usageOf returns the usage of a JSON response or SSE event payload, either
+// top-level or nested in "response", or nil when it has none.
+func usageOf(b []byte) *tokenUsage {
+	var payload struct {
+		Usage    *tokenUsage `json:"usage"`
+		Response *struct {
+			Usage *tokenUsage `json:"usage"`
+		} `json:"response"`
+	}
+	if json.Unmarshal(b, &payload) != nil {
+		return nil
+	}
+	if payload.Usage != nil {
+		return payload.Usage
+	}
+	if payload.Response != nil {
+		return payload.Response.Usage
+	}
+	return nil
+}
+
+// tailUsage extracts token usage from the end of a JSON response too large
+// to keep whole: the object following the last "usage" key.
+func tailUsage(tail []byte) (input, output, cached int64) {
+	i := bytes.LastIndex(tail, []byte(`"usage"`))
+	if i < 0 {
+		return 0, 0, 0
+	}
+	rest, ok := bytes.CutPrefix(bytes.TrimLeft(tail[i+len(`"usage"`):], " \t\r\n"), []byte(":"))
+	if !ok {
+		return 0, 0, 0
+	}
+	var u tokenUsage
+	if json.NewDecoder(bytes.NewReader(rest)).Decode(&u) != nil {
+		return 0, 0, 0
+	}
+	return u.tokens()
+}
+
+func (u *tokenUsage) tokens() (input, output, cached int64) {
+	if u == nil {
+		return 0, 0, 0
+	}
+	for _, d := range []*tokenDetails{u.InputTokensDetails, u.PromptTokensDetails} {
+		if d != nil {
+			cached += d.CachedTokens
+		}
+	}
+	return u.InputTokens + u.PromptTokens, u.OutputTokens + u.CompletionTokens, cached
+}
+
+// sseUsage picks the token usage out of an SSE stream written to it piece by
+// piece, keeping only the current partial line. Only data lines mentioning
+// "usage" are decoded, so the many delta events cost a substring search.
+type sseUsage struct {
+	line  []byte
+	found *tokenUsage
+}
+
+func (u *sseUsage) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			u.line = append(u.line, p...)
+			break
+		}
+		u.line = append(u.line, p[:i]...)
+		u.scan()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (u *sseUsage) scan() {
+	data, ok := bytes.CutPrefix(bytes.TrimRight(u.line, "\r"), []byte("data:"))
+	u.line = u.line[:0]
+	if !ok || !bytes.Contains(data, []byte(`"usage"`)) {
+		return
+	}
+	if t := usageOf(bytes.TrimSpace(data)); t != nil {
+		u.found = t
+	}
+}
+
+// Tokens returns the usage of the last event seen, including an
+// unterminated final line.
+func (u *sseUsage) Tokens() (input, output, cached int64) {
+	if len(u.line) > 0 {
+		u.scan()
+	}
+	return u.found.tokens()
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUsage(t *testing.T) {
+	cases := []struct {
+		name                  string
+		body                  string
+		input, output, cached int64
+	}{
+		{"responses", `{"id":"r","usage":{"input_tokens":12,"output_tokens":3,"input_tokens_details":{"cached_tokens":8}}}`, 12, 3, 8},
+		{"chat", `{"usage":{"prompt_tokens":4,"completion_tokens":2,"prompt_tokens_details":{"cached_tokens":1}}}`, 4, 2, 1},
+		{"stream", "event: response.created\ndata: {\"type\":\"response.created\",\"response\":{}}\n\n" +
+			"event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"usage\":{\"input_tokens\":8,\"output_tokens\":5}}}\n\n", 8, 5, 0},
+		{"chat stream", "data: {\"choices\":[]}\n\ndata: {\"usage\":{\"prompt_tokens\":6,\"completion_tokens\":1}}\n\ndata: [DONE]\n\n", 6, 1, 0},
+		{"none", `ok`, 0, 0, 0},
+	}
+	for _, c := range cases {
+		in, out, cached := parseUsage([]byte(c.body))
+		if in != c.input || out != c.output || cached != c.cached {
+			t.Fatalf("%s: got %d/%d/%d, want %d/%d/%d", c.name, in, out, cached, c.input, c.output, c.cached)
+		}
+		// Streams arrive in arbitrary pieces.
+		var u sseUsage
+		for i := 0; i < len(c.body); i += 7 {
+			u.Write([]byte(c.body[i:min(i+7, len(c.body))]))
+		}
+		if in, out, _ := u.Tokens(); c.name != "responses" && c.name != "chat" && (in != c.input || out != c.output) {
+			t.Fatalf("%s: streamed got %d/%d, want %d/%d", c.name, in, out, c.input, c.output)
+		}
+	}
+}
+
+func TestStreamedUsage(t *testing.T) {
+	release := make(chan struct{})
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: response.created\ndata: {\"type\":\"response.created\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"usage\":{\"input_tokens\":9,\"output_tokens\":4}}}\n\n")
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/responses", "application/json", strings.NewReader(`{"model":"gpt-5","stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The first event arrives while the upstream is still streaming.
+	first := make([]byte, len("event: response.created\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(rest), "response.completed") {
+		t.Fatalf("stream incomplete: %q", rest)
+	}
+	logs, _ := ls.List(ctx, 1, 0)
+	if len(logs) != 1 || logs[0].InputTokens != 9 || logs[0].OutputTokens != 4 {
+		t.Fatalf("stream not logged: %+v", logs)
+	}
+	if l, _ := ls.Get(ctx, logs[0].ID); l == nil || !strings.Contains(l.RespBody, "response.completed") {
+		t.Fatalf("stream body not logged: %+v", l)
+	}
+}
+
+func TestUsageEndpoints(t *testing.T) {
+	upstreamCalls := 0
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		io.WriteString(w, `{"usage":{"input_tokens":10,"output_tokens":4}}`)
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	do("POST", "http://localhost/v1/responses", "alice")
+	do("POST", "http://localhost/v1/responses", "alice")
+	do("POST", "http://localhost/v1/responses", "bob")
+	calls := upstreamCalls
+
+	rec := do("GET", "http://localhost/v1/usage", "alice")
+	var legacy struct {
+		Data []struct {
+			Requests        int64 `json:"n_requests"`
+			ContextTokens   int64 `json:"n_context_tokens_total"`
+			GeneratedTokens int64 `json:"n_generated_tokens_total"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&legacy); err != nil || len(legacy.Data) != 1 {
+		t.Fatalf("legacy usage: %v %+v", err, legacy)
+	}
+	if d := legacy.Data[0]; d.Requests != 2 || d.ContextTokens != 20 || d.GeneratedTokens != 8 {
+		t.Fatalf("unexpected legacy usage %+v", d)
+	}
+	if rec := do("GET", "http://localhost/v1/usage?date=2001-01-01", "alice"); rec.Body.String() != "{\"data\":[],\"object\":\"list\"}\n" {
+		t.Fatalf("old date: %s", rec.Body.String())
+	}
+	if rec := do("GET", "http://localhost/v1/usage?date=today", "alice"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad date status %d", rec.Code)
+	}
+
+	start := time.Now().Add(-48 * time.Hour).Unix()
+	rec = do("GET", fmt.Sprintf("http://localhost/v1/organization/usage/completions?start_time=%d", start), "bob")
+	var page struct {
+		Data []struct {
+			Results []struct {
+				InputTokens   int64 `json:"input_tokens"`
+				ModelRequests int64 `json:"num_model_requests"`
+			} `json:"results"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil || len(page.Data) != 3 {
+		t.Fatalf("completions usage: %v %+v", err, page)
+	}
+	if r := page.Data[2].Results; len(r) != 1 || r[0].ModelRequests != 1 || r[0].InputTokens != 10 || len(page.Data[0].Results) != 0 {
+		t.Fatalf("unexpected buckets %+v", page.Data)
+	}
+	if rec := do("GET", "http://localhost/v1/organization/usage/completions?start_time=1&bucket_width=1h", "bob"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bucket width status %d", rec.Code)
+	}
+	if upstreamCalls != calls {
+		t.Fatalf("usage endpoints were forwarded upstream")
+	}
+}
+
+func TestLogRecordsModelAndTokens(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"usage":{"input_tokens":3,"output_tokens":2}}`)
+	})
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	req := httptest.NewRequest("POST", "http://localhost/v1/responses", strings.NewReader(`{"model":"gpt-5","input":"hi"}`))
+	req.Header.Set("Authorization", "Bearer client")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	logs, err := ls.List(ctx, 1, 0)
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("list logs: %v", err)
+	}
+	if l := logs[0]; l.Model != "gpt-5" || l.InputTokens != 3 || l.OutputTokens != 2 || l.ClientKey != ClientKeyID("client") {
+		t.Fatalf("unexpected log %+v", l)
+	}
+}
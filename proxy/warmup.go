@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	acct "github.com/kxn/codex-companion/account"
+)
+
+// DefaultWarmupModel is the model of warm-up probes when WarmupModel is
+// empty.
+const DefaultWarmupModel = "gpt-5"
+
+// Warmup sends a tiny Responses API request with a's credentials and
+// returns an error unless it succeeds. Unlike Probe, which only lists the
+// models, it is subject to the account's rate limits, so it tells whether an
+// exhausted account can serve requests again. ChatGPT tokens must be
+// current.
+func (h *Handler) Warmup(ctx context.Context, a *acct.Account) error {
+	model := h.WarmupModel
+	if model == "" {
+		model = DefaultWarmupModel
+	}
+	m := map[string]any{
+		"model":        model,
+		"instructions": "Reply with one word.",
+		"input":        []map[string]any{{"role": "user", "content": []map[string]any{{"type": "input_text", "text": "ping"}}}},
+		"stream":       true,
+	}
+	// Only the API takes an output limit; the Codex backend rejects it.
+	if a.Type == acct.APIKeyAccount {
+		m["max_output_tokens"] = 16
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	body = normalizeBody(a, "/v1/responses", body)
+	base, path := h.upstreamTarget(a, "/v1/responses")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	setCredentials(req.Header, a)
+	client, err := h.client(a)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read the short stream to the end so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	h.streaks.record(a.ID, resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	return nil
+}
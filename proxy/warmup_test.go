@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmup(t *testing.T) {
+	var limited atomic.Bool
+	limited.Store(true)
+	bodies := make(chan map[string]any, 4)
+	paths := make(chan string, 4)
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]any
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &m)
+		bodies <- m
+		paths <- r.URL.Path + " " + r.Header.Get("Authorization")
+		if limited.Load() {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: response.completed\ndata: {}\n\n")
+	})
+	ctx := context.Background()
+	key, _ := mgr.AddAPIKey(ctx, "key", "k", "", 1)
+	key.ModelMap = map[string]string{"gpt-5": "gpt-5-mini"}
+	if err := h.Warmup(ctx, key); err == nil {
+		t.Fatal("expected a rate-limited warm-up to fail")
+	}
+	if m := <-bodies; m["model"] != "gpt-5-mini" || m["max_output_tokens"] != float64(16) || m["stream"] != true {
+		t.Fatalf("unexpected probe body %v", m)
+	}
+	if p := <-paths; p != "/v1/responses Bearer k" {
+		t.Fatalf("unexpected probe target %s", p)
+	}
+
+	limited.Store(false)
+	h.WarmupModel = "gpt-5-codex"
+	cg, _ := mgr.AddChatGPT(ctx, "cg", "rt", "aid", 2)
+	cg.AccessToken, cg.TokenExpiresAt = "at", time.Now().Add(time.Hour)
+	if err := h.Warmup(ctx, cg); err != nil {
+		t.Fatalf("warm-up: %v", err)
+	}
+	if m := <-bodies; m["model"] != "gpt-5-codex" || m["max_output_tokens"] != nil || m["store"] != false {
+		t.Fatalf("unexpected ChatGPT probe body %v", m)
+	}
+	if p := <-paths; p != "/responses Bearer at" {
+		t.Fatalf("unexpected ChatGPT probe target %s", p)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// upgradeType returns the protocol a request or response with header h
+// upgrades to, such as "websocket", or "" when it does not upgrade.
+func upgradeType(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// model returns the model the request names: the body's model, the model
+// field of a form upload or, for an upgrade such as a Realtime session,
+// whose handshake has no body, the model query parameter.
+func (pr *ProxyRequest) model() string {
+	if isForm(pr.Request.Header) {
+		return formModel(pr.Request.Header, pr.Body)
+	}
+	if m := requestModel(pr.Body); m != "" || upgradeType(pr.Request.Header) == "" {
+		return m
+	}
+	return pr.Request.URL.Query().Get("model")
+}
+
+var errNotWritable = errors.New("response body is not writable")
+
+// writeBody writes p to the upstream side of rc, the body of a 101
+// response, which is the upgraded connection.
+func writeBody(rc io.ReadCloser, p []byte) (int, error) {
+	if w, ok := rc.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errNotWritable
+}
+
+// tunnelBody is the body of a 101 response passed through logAttempt. It
+// counts the bytes sent both ways, adding those written to sent, and
+// records the attempt once the tunnel closes.
+type tunnelBody struct {
+	rc     io.ReadCloser
+	n      int
+	sent   *atomic.Int64
+	finish func(size int)
+	once   sync.Once
+}
+
+func (b *tunnelBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.n += n
+	return n, err
+}
+
+func (b *tunnelBody) Write(p []byte) (int, error) {
+	n, err := writeBody(b.rc, p)
+	b.sent.Add(int64(n))
+	return n, err
+}
+
+func (b *tunnelBody) Close() error {
+	err := b.rc.Close()
+	b.once.Do(func() { b.finish(b.n) })
+	return err
+}
+
+// tunnel completes an upgrade the upstream accepted with resp: it sends
+// the 101 response to the client over its hijacked connection and copies
+// bytes both ways until either side closes or the request ends.
+func tunnel(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	defer resp.Body.Close()
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		logger.Errorc(r.Context(), "upstream switched protocols without a connection")
+		writeError(w, http.StatusBadGateway, map[string]any{"message": "upstream error", "type": "server_error"})
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Errorc(r.Context(), "hijack client connection: %v", err)
+		writeError(w, http.StatusInternalServerError, map[string]any{"message": "upgrade not supported", "type": "server_error"})
+		return
+	}
+	defer conn.Close()
+	// The server's read and write timeouts are meant for requests, not for
+	// sessions that stay open for minutes.
+	conn.SetDeadline(time.Time{})
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Upgrade", upgradeType(resp.Header))
+	res := &http.Response{StatusCode: resp.StatusCode, ProtoMajor: 1, ProtoMinor: 1, Header: w.Header()}
+	if err := res.Write(brw); err != nil {
+		logger.Warnc(r.Context(), "write upgrade response: %v", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		logger.Warnc(r.Context(), "write upgrade response: %v", err)
+		return
+	}
+	logger.Infoc(r.Context(), "tunneling %s session", upgradeType(resp.Header))
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, brw.Reader)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, upstream)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-r.Context().Done():
+		err = r.Context().Err()
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Debugc(r.Context(), "tunnel ended: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebSocketTunnel(t *testing.T) {
+	h, mgr, ls := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/realtime" || r.Header.Get("Authorization") != "Bearer k" || upgradeType(r.Header) != "websocket" || r.Header.Get("Sec-WebSocket-Key") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: xyz\r\n\r\n")
+		brw.Flush()
+		// Echo until the client closes.
+		io.Copy(conn, brw)
+	})
+	h.Client.Timeout = 50 * time.Millisecond
+	ctx := context.Background()
+	mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /v1/realtime?model=gpt-realtime HTTP/1.1\r\nHost: x\r\nAuthorization: Bearer client\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: abc\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "xyz" || upgradeType(resp.Header) != "websocket" || resp.Header.Get(RequestIDHeader) == "" {
+		t.Fatalf("unexpected handshake %d %v", resp.StatusCode, resp.Header)
+	}
+	// The session outlives Client.Timeout.
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q %v", buf, err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		logs, _ := ls.List(ctx, 10, 0)
+		if len(logs) == 1 {
+			if logs[0].Status != http.StatusSwitchingProtocols || logs[0].RespSize != 5 || logs[0].ReqSize != 5 || logs[0].Model != "gpt-realtime" {
+				t.Fatalf("unexpected log %+v", logs[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketRejected(t *testing.T) {
+	h, mgr, _ := setupProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "no realtime")
+	})
+	mgr.AddAPIKey(context.Background(), "a", "k", "", 1)
+	req := httptest.NewRequest("GET", "/v1/realtime", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "no realtime" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
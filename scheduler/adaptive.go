@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// Adaptive tuning parameters.
+const (
+	// ewmaAlpha weights the newest observation in the moving averages.
+	ewmaAlpha = 0.1
+	// minSamples is the number of observations required before an account's
+	// priority is adjusted.
+	minSamples = 20
+	// maxAdjustment bounds the adjustment in either direction.
+	maxAdjustment = 5
+	// demoteErrorRate and promoteErrorRate are the error-rate thresholds for
+	// demoting and promoting an account by one step.
+	demoteErrorRate  = 0.2
+	promoteErrorRate = 0.05
+	// fastLatencyRatio promotes a healthy account past its configured
+	// priority only when its latency is below this fraction of the mean.
+	fastLatencyRatio = 0.75
+)
+
+// AccountStats is the adaptive scheduler's view of one account.
+type AccountStats struct {
+	AccountID  int64   `json:"account_id"`
+	Samples    int     `json:"samples"`
+	ErrorRate  float64 `json:"error_rate"`
+	LatencyMs  float64 `json:"latency_ms"`
+	Adjustment int     `json:"adjustment"`
+
+	hasLatency bool
+}
+
+type adaptiveState struct {
+	mu    sync.Mutex
+	stats map[int64]*AccountStats
+}
+
+// ObserveAttempt records the outcome of an upstream attempt. Rate limits
+// are handled by exhaustion and do not count as errors; server errors and
+// transport failures do. The outcome also counts towards the ramp-up of a
+// new account.
+func (s *Scheduler) ObserveAttempt(id int64, status int, latency time.Duration, err error) {
+	s.observeRampUp(id, status, err)
+	if status == 429 {
+		return
+	}
+	failed := 0.0
+	if err != nil || status >= 500 {
+		failed = 1
+	}
+	s.adaptive.mu.Lock()
+	defer s.adaptive.mu.Unlock()
+	if s.adaptive.stats == nil {
+		s.adaptive.stats = make(map[int64]*AccountStats)
+	}
+	st, ok := s.adaptive.stats[id]
+	if !ok {
+		st = &AccountStats{AccountID: id, ErrorRate: failed}
+		s.adaptive.stats[id] = st
+	}
+	st.Samples++
+	st.ErrorRate += ewmaAlpha * (failed - st.ErrorRate)
+	// Transport failures often end in a timeout and would skew latency.
+	if err == nil {
+		ms := float64(latency.Milliseconds())
+		if !st.hasLatency {
+			st.LatencyMs, st.hasLatency = ms, true
+		} else {
+			st.LatencyMs += ewmaAlpha * (ms - st.LatencyMs)
+		}
+	}
+}
+
+// Stats returns the adaptive statistics of every observed account together
+// with the stored adjustments, ordered by account id.
+func (s *Scheduler) Stats(ctx context.Context) ([]AccountStats, error) {
+	accounts, err := s.mgr.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.adaptive.mu.Lock()
+	defer s.adaptive.mu.Unlock()
+	res := make([]AccountStats, 0, len(accounts))
+	for _, a := range accounts {
+		st := AccountStats{AccountID: a.ID}
+		if cur, ok := s.adaptive.stats[a.ID]; ok {
+			st = *cur
+		}
+		st.Adjustment = a.PriorityAdjustment
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].AccountID < res[j].AccountID })
+	return res, nil
+}
+
+// StartTuner periodically nudges priority adjustments from the observed
+// statistics. It only has an effect when Adaptive is set.
+func (s *Scheduler) StartTuner(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if s.Adaptive {
+					s.tune(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// tune moves each sufficiently observed account's adjustment one step:
+// flaky accounts are demoted, healthy ones promoted back towards their
+// configured priority and, when clearly faster than average, beyond it.
+func (s *Scheduler) tune(ctx context.Context) {
+	accounts, err := s.mgr.List(ctx)
+	if err != nil {
+		logger.Errorf("tune list accounts: %v", err)
+		return
+	}
+	s.adaptive.mu.Lock()
+	var sum float64
+	var n int
+	for _, st := range s.adaptive.stats {
+		if st.Samples >= minSamples {
+			sum += st.LatencyMs
+			n++
+		}
+	}
+	mean := 0.0
+	if n > 0 {
+		mean = sum / float64(n)
+	}
+	changes := make(map[int64]int)
+	for _, a := range accounts {
+		st, ok := s.adaptive.stats[a.ID]
+		if !ok || st.Samples < minSamples {
+			continue
+		}
+		adj := a.PriorityAdjustment
+		switch {
+		case st.ErrorRate > demoteErrorRate && adj < maxAdjustment:
+			adj++
+		case st.ErrorRate < promoteErrorRate && adj > 0:
+			adj--
+		case st.ErrorRate < promoteErrorRate && n > 1 && st.LatencyMs < fastLatencyRatio*mean && adj > -maxAdjustment:
+			adj--
+		}
+		if adj != a.PriorityAdjustment {
+			changes[a.ID] = adj
+			logger.Infof("adaptive priority: account %d adjustment %d -> %d (error rate %.2f, latency %.0fms)", a.ID, a.PriorityAdjustment, adj, st.ErrorRate, st.LatencyMs)
+		}
+	}
+	s.adaptive.mu.Unlock()
+	for id, adj := range changes {
+		s.mgr.SetPriorityAdjustment(ctx, id, adj)
+	}
+}
+
+// ResetAdjustment reverts the adaptive adjustment of account id, or of all
+// accounts when id is zero, and forgets the collected statistics.
+func (s *Scheduler) ResetAdjustment(ctx context.Context, id int64) error {
+	accounts, err := s.mgr.List(ctx)
+	if err != nil {
+		return err
+	}
+	s.adaptive.mu.Lock()
+	for _, a := range accounts {
+		if id == 0 || a.ID == id {
+			delete(s.adaptive.stats, a.ID)
+		}
+	}
+	s.adaptive.mu.Unlock()
+	for _, a := range accounts {
+		if (id == 0 || a.ID == id) && a.PriorityAdjustment != 0 {
+			if err := s.mgr.SetPriorityAdjustment(ctx, a.ID, 0); err != nil {
+				return err
+			}
+			logger.Infof("adaptive priority: reset account %d", a.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveDemotesFlakyAccount(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "flaky", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "healthy", "k2", "", 2)
+	s.Adaptive = true
+	for i := 0; i < minSamples; i++ {
+		s.ObserveAttempt(a1.ID, 502, 100*time.Millisecond, nil)
+		s.ObserveAttempt(a2.ID, 200, 100*time.Millisecond, nil)
+		s.ObserveAttempt(a2.ID, 429, time.Millisecond, nil)
+	}
+	s.tune(ctx)
+	s.tune(ctx)
+	got, _ := mgr.Get(ctx, a1.ID)
+	if got.PriorityAdjustment != 2 {
+		t.Fatalf("expected flaky account demoted twice, got %d", got.PriorityAdjustment)
+	}
+	next, err := s.Next(ctx, nil)
+	if err != nil || next.ID != a2.ID {
+		t.Fatalf("expected healthy account first, got %+v %v", next, err)
+	}
+
+	stats, _ := s.Stats(ctx)
+	if len(stats) != 2 || stats[0].Adjustment != 2 || stats[1].ErrorRate != 0 || stats[1].Samples != minSamples {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	s.Adaptive = false
+	if next, _ := s.Next(ctx, nil); next.ID != a1.ID {
+		t.Fatalf("adjustments must be ignored when adaptive mode is off")
+	}
+
+	if err := s.ResetAdjustment(ctx, a1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mgr.Get(ctx, a1.ID); got.PriorityAdjustment != 0 {
+		t.Fatalf("adjustment not reset")
+	}
+}
+
+func TestAdaptivePromotesFastAccount(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "slow", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "fast", "k2", "", 1)
+	// an old failure decays; its duration does not skew the latency
+	s.ObserveAttempt(a2.ID, 0, time.Minute, errors.New("timeout"))
+	for i := 0; i < 2*minSamples; i++ {
+		s.ObserveAttempt(a1.ID, 200, time.Second, nil)
+		s.ObserveAttempt(a2.ID, 200, 100*time.Millisecond, nil)
+	}
+	s.tune(ctx)
+	if got, _ := mgr.Get(ctx, a2.ID); got.PriorityAdjustment != -1 {
+		t.Fatalf("expected fast account promoted, got %d", got.PriorityAdjustment)
+	}
+	if got, _ := mgr.Get(ctx, a1.ID); got.PriorityAdjustment != 0 {
+		t.Fatalf("slow account changed: %d", got.PriorityAdjustment)
+	}
+}
@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"math"
+	"sort"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/pricing"
+)
+
+// price returns what serving model costs on a, in USD per million input
+// plus output tokens: the account's own price for the model it sends
+// upstream, else the scheduler's. It is +Inf when neither knows the model.
+func (s *Scheduler) price(a *account.Account, model string) float64 {
+	if m, ok := a.ModelMap[model]; ok {
+		model = m
+	}
+	p, ok := a.Prices.Lookup(model)
+	if !ok {
+		prices := s.Prices
+		if prices == nil {
+			prices = pricing.Default
+		}
+		if p, ok = prices.Lookup(model); !ok {
+			return math.Inf(1)
+		}
+	}
+	return p.Input + p.Output
+}
+
+// sortByCost orders candidates cheapest first for model, keeping priority
+// order among equally priced accounts and backup accounts last.
+func (s *Scheduler) sortByCost(candidates []*account.Account, model string) {
+	cost := make(map[int64]float64, len(candidates))
+	for _, a := range candidates {
+		cost[a.ID] = s.price(a, model)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Backup != candidates[j].Backup {
+			return candidates[j].Backup
+		}
+		return cost[candidates[i].ID] < cost[candidates[j].ID]
+	})
+}
@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/pricing"
+)
+
+func TestCostSelection(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	s.SetMode(ModeCost)
+	s.Prices = pricing.Table{"gpt-5": {Input: 1, Output: 10}, "gpt-5-mini": {Input: 0.25, Output: 2}}
+	ctx := context.Background()
+	premium, _ := mgr.AddAPIKey(ctx, "premium", "k1", "", 1)
+	mapped, _ := mgr.AddAPIKey(ctx, "mapped", "k2", "", 2)
+	discount, _ := mgr.AddAPIKey(ctx, "discount", "k3", "", 3)
+	mapped.ModelMap = map[string]string{"gpt-5": "gpt-5-mini"}
+	mgr.Update(ctx, mapped)
+	discount.Prices = pricing.Table{"gpt-5": {Input: 0.5, Output: 5}}
+	mgr.Update(ctx, discount)
+
+	next := func(r Route) int64 {
+		t.Helper()
+		a, err := s.Next(WithRoute(ctx, r), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.ID
+	}
+	if got := next(Route{Model: "gpt-5"}); got != mapped.ID {
+		t.Fatalf("expected the account mapping to the cheaper model, got %d", got)
+	}
+	mgr.MarkExhausted(ctx, mapped.ID, time.Now().Add(time.Hour))
+	if got := next(Route{Model: "gpt-5-2025-08-07"}); got != discount.ID {
+		t.Fatalf("expected the account with the price override, got %d", got)
+	}
+	if got := next(Route{Model: "gpt-5", Premium: true}); got != premium.ID {
+		t.Fatalf("expected priority order for premium, got %d", got)
+	}
+	// Without a known price or model the priority order applies.
+	if got := next(Route{Model: "llama"}); got != premium.ID {
+		t.Fatalf("expected priority order for unpriced model, got %d", got)
+	}
+	if got := next(Route{}); got != premium.ID {
+		t.Fatalf("expected priority order without model, got %d", got)
+	}
+}
+
+func TestPrice(t *testing.T) {
+	s := New(nil)
+	a := &account.Account{Prices: pricing.Table{"local": {}}}
+	if p := s.price(a, "local"); p != 0 {
+		t.Fatalf("override price %v", p)
+	}
+	if p := s.price(a, "gpt-5"); p != pricing.Default["gpt-5"].Input+pricing.Default["gpt-5"].Output {
+		t.Fatalf("default price %v", p)
+	}
+	if p := s.price(a, "unknown"); !math.IsInf(p, 1) {
+		t.Fatalf("unknown model priced %v", p)
+	}
+}
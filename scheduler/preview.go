@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+)
+
+// Preview returns the account NextFor would choose for the first attempt
+// of a request for route if accounts were the configured accounts and mode
+// the selection mode, judging availability at now. Unlike NextFor it has no
+// side effects: tokens are not refreshed and failovers are not recorded, so
+// proposed settings can be evaluated before they are applied. Weighted
+// selection is random; Preview reports the candidate of the highest weight
+// in the tier instead, and ranks accounts ramping up as if they were in
+// full rotation. It returns nil when no account could serve the route.
+func (s *Scheduler) Preview(accounts []*account.Account, mode string, route Route, now time.Time) *account.Account {
+	sorted := append([]*account.Account(nil), accounts...)
+	if s.Adaptive {
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].EffectivePriority() < sorted[j].EffectivePriority() })
+	} else {
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	}
+	var candidates []*account.Account
+	for _, a := range sorted {
+		switch {
+		case route.APIKeyOnly && a.Type != account.APIKeyAccount, !a.Available(now),
+			a.Capabilities.Lacks(route.Endpoint, route.Stream, route.Tools) != "":
+			continue
+		case a.ID == route.Account:
+			return a
+		case route.Account != 0 && !route.Fallback:
+			continue
+		}
+		candidates = append(candidates, a)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if mode == ModeCost && !route.Premium && route.Model != "" {
+		s.sortByCost(candidates, route.Model)
+	} else {
+		sort.SliceStable(candidates, func(i, j int) bool { return !candidates[i].Backup && candidates[j].Backup })
+	}
+	best := candidates[0]
+	if mode == ModeWeighted {
+		for _, a := range candidates[1:] {
+			if a.Backup == best.Backup && a.Weight > best.Weight {
+				best = a
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/pricing"
+)
+
+func TestPreview(t *testing.T) {
+	s := New(nil)
+	s.Prices = pricing.Table{"gpt-5": {Input: 1, Output: 10}, "gpt-5-mini": {Input: 0.25, Output: 2}}
+	now := time.Now()
+	chatgpt := &account.Account{ID: 1, Type: account.ChatGPTAccount, Priority: 0, Weight: 1}
+	heavy := &account.Account{ID: 2, Priority: 1, Weight: 3, ModelMap: map[string]string{"gpt-5": "gpt-5-mini"}}
+	backup := &account.Account{ID: 3, Priority: 2, Weight: 5, Backup: true}
+	accounts := []*account.Account{backup, heavy, chatgpt}
+	id := func(mode string, r Route) int64 {
+		t.Helper()
+		if a := s.Preview(accounts, mode, r, now); a != nil {
+			return a.ID
+		}
+		return 0
+	}
+	for _, c := range []struct {
+		mode  string
+		route Route
+		want  int64
+	}{
+		{ModePriority, Route{}, 1},
+		{ModeWeighted, Route{}, 2},
+		{ModeCost, Route{Model: "gpt-5"}, 2},
+		{ModeCost, Route{Model: "gpt-5", Premium: true}, 1},
+		{ModePriority, Route{APIKeyOnly: true}, 2},
+		{ModePriority, Route{Account: 3}, 3},
+		{ModePriority, Route{Account: 9}, 0},
+		{ModePriority, Route{Account: 9, Fallback: true}, 1},
+	} {
+		if got := id(c.mode, c.route); got != c.want {
+			t.Errorf("%s %+v: expected account %d, got %d", c.mode, c.route, c.want, got)
+		}
+	}
+	chatgpt.Exhausted, chatgpt.ResetAt = true, now.Add(time.Hour)
+	heavy.MaintenanceEnd = now.Add(time.Hour)
+	if got := id(ModePriority, Route{}); got != 3 {
+		t.Fatalf("expected the backup account, got %d", got)
+	}
+	// Preview leaves the order of the accounts passed in alone.
+	if accounts[0] != backup {
+		t.Fatal("accounts reordered")
+	}
+}
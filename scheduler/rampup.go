@@ -0,0 +1,159 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+)
+
+// rampUpShare is the trust of an account that has just started ramping up.
+// Trust grows exponentially with each consecutive success, reaching 1 once
+// the account has had the Manager's RampUp of them.
+const rampUpShare = 1.0 / 32
+
+// RampUpStats is the scheduler's view of an account ramping up.
+type RampUpStats struct {
+	AccountID int64 `json:"account_id"`
+	// Remaining is the number of consecutive successes the account still
+	// needs to join full rotation.
+	Remaining int `json:"remaining"`
+	// Trust is the chance the account keeps its place in the ranking of a
+	// request instead of being ranked behind the other accounts of its
+	// tier, roughly the share of its usual traffic it receives.
+	Trust float64 `json:"trust"`
+}
+
+type rampUpState struct {
+	mu sync.Mutex
+	// remaining holds the RampUp of the accounts seen ramping up, so the
+	// attempts of other accounts need no lookup.
+	remaining map[int64]int
+}
+
+// trust returns the trust of a, 1 for an account in full rotation.
+func (s *Scheduler) trust(a *account.Account) float64 {
+	n := s.mgr.RampUp
+	if a.RampUp <= 0 || n <= 0 {
+		return 1
+	}
+	return math.Pow(rampUpShare, float64(min(a.RampUp, n))/float64(n))
+}
+
+// demoteRampUp rolls against the trust of each candidate ramping up and
+// ranks those that lose behind the other candidates of their tier, so they
+// are used only in about the share of requests their trust gives, or when
+// nothing else is left. Candidates must be ordered by tier; an account the
+// route is pinned to keeps its place. It returns the demoted accounts.
+func (s *Scheduler) demoteRampUp(candidates []*account.Account, route Route, trace *Trace) map[int64]bool {
+	if s.mgr.RampUp <= 0 {
+		return nil
+	}
+	var demoted map[int64]bool
+	for _, a := range candidates {
+		if a.RampUp <= 0 || a.ID == route.Account {
+			continue
+		}
+		s.trackRampUp(a)
+		if trust := s.trust(a); s.rand() >= trust {
+			if demoted == nil {
+				demoted = make(map[int64]bool)
+			}
+			demoted[a.ID] = true
+			trace.set(a, DecisionRampUp, fmt.Sprintf("trust %.0f%%, %d successes to go", 100*trust, a.RampUp))
+		}
+	}
+	if demoted != nil {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].Backup != candidates[j].Backup {
+				return candidates[j].Backup
+			}
+			return !demoted[candidates[i].ID] && demoted[candidates[j].ID]
+		})
+	}
+	return demoted
+}
+
+// trackRampUp remembers that a is ramping up, unless it already is known to.
+func (s *Scheduler) trackRampUp(a *account.Account) {
+	s.rampUp.mu.Lock()
+	defer s.rampUp.mu.Unlock()
+	if s.rampUp.remaining == nil {
+		s.rampUp.remaining = make(map[int64]int)
+	}
+	if _, ok := s.rampUp.remaining[a.ID]; !ok {
+		s.rampUp.remaining[a.ID] = a.RampUp
+	}
+}
+
+// observeRampUp counts a successful attempt of an account ramping up
+// towards full rotation. Failures that may be the account's fault, such as
+// rejected credentials, rate limits and server errors, start its ramp-up
+// over; other client errors do not count.
+func (s *Scheduler) observeRampUp(id int64, status int, err error) {
+	n := s.mgr.RampUp
+	if n <= 0 {
+		return
+	}
+	s.rampUp.mu.Lock()
+	defer s.rampUp.mu.Unlock()
+	left, ok := s.rampUp.remaining[id]
+	if !ok {
+		return
+	}
+	switch {
+	case err == nil && status < 400:
+		left--
+	case err != nil || status >= 500 || status == 401 || status == 403 || status == 429:
+		if left == n {
+			return
+		}
+		left = n
+	default:
+		return
+	}
+	if err := s.mgr.SetRampUp(context.Background(), id, left); err != nil {
+		logger.Errorf("store ramp-up of account %d failed: %v", id, err)
+		return
+	}
+	if left > 0 {
+		s.rampUp.remaining[id] = left
+		return
+	}
+	delete(s.rampUp.remaining, id)
+	logger.Infof("account %d completed its ramp-up, joining full rotation", id)
+	events.Publish(events.Event{Type: events.AccountTrusted, AccountID: id, Message: fmt.Sprintf("%d consecutive successes", n)})
+}
+
+// RampUp returns the accounts ramping up, ordered by account id.
+func (s *Scheduler) RampUp(ctx context.Context) ([]RampUpStats, error) {
+	accounts, err := s.mgr.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := []RampUpStats{}
+	for _, a := range accounts {
+		if a.RampUp > 0 && s.mgr.RampUp > 0 {
+			res = append(res, RampUpStats{AccountID: a.ID, Remaining: a.RampUp, Trust: s.trust(a)})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].AccountID < res[j].AccountID })
+	return res, nil
+}
+
+// EndRampUp puts account id in full rotation at once.
+func (s *Scheduler) EndRampUp(ctx context.Context, id int64) error {
+	s.rampUp.mu.Lock()
+	defer s.rampUp.mu.Unlock()
+	if err := s.mgr.SetRampUp(ctx, id, 0); err != nil {
+		return err
+	}
+	delete(s.rampUp.remaining, id)
+	logger.Infof("ramp-up of account %d ended by the operator", id)
+	return nil
+}
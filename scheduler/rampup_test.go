@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRampUp(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	old, _ := mgr.AddAPIKey(ctx, "old", "k1", "", 1)
+	mgr.RampUp = 3
+	fresh, _ := mgr.AddAPIKey(ctx, "fresh", "k2", "", 0)
+	remaining := func() int {
+		a, _ := mgr.Get(ctx, fresh.ID)
+		return a.RampUp
+	}
+	if old.RampUp != 0 || remaining() != 3 {
+		t.Fatalf("ramp-up of old %d, fresh %d", old.RampUp, remaining())
+	}
+
+	// A fresh account keeps its place only in a small share of requests.
+	s.rand = func() float64 { return 0.5 }
+	var tr Trace
+	if a, _ := s.Next(WithTrace(ctx, &tr), nil); a.ID != old.ID {
+		t.Fatalf("expected old, got %s", a.Name)
+	}
+	if c := tr.Candidates[0]; c.AccountID != fresh.ID || c.Decision != DecisionRampUp {
+		t.Fatalf("unexpected trace %+v", tr.Candidates)
+	}
+	s.rand = func() float64 { return 0.01 }
+	if a, _ := s.Next(ctx, nil); a.ID != fresh.ID {
+		t.Fatalf("expected fresh, got %s", a.Name)
+	}
+	// It still serves requests no other account can.
+	s.rand = func() float64 { return 0.99 }
+	if a, _ := s.Next(ctx, map[int64]bool{old.ID: true}); a.ID != fresh.ID {
+		t.Fatalf("expected fresh, got %s", a.Name)
+	}
+
+	// Client errors do not count; failures start the ramp-up over.
+	s.ObserveAttempt(fresh.ID, 200, time.Second, nil)
+	s.ObserveAttempt(fresh.ID, 400, time.Second, nil)
+	s.ObserveAttempt(fresh.ID, 200, time.Second, nil)
+	if remaining() != 1 {
+		t.Fatalf("%d successes to go, want 1", remaining())
+	}
+	stats, err := s.RampUp(ctx)
+	if err != nil || len(stats) != 1 || stats[0].Remaining != 1 || stats[0].Trust <= 0.1 || stats[0].Trust >= 1 {
+		t.Fatalf("unexpected stats %+v %v", stats, err)
+	}
+	s.ObserveAttempt(fresh.ID, 429, time.Second, nil)
+	if remaining() != 3 {
+		t.Fatalf("%d successes to go after a failure, want 3", remaining())
+	}
+	for range 3 {
+		s.ObserveAttempt(fresh.ID, 200, time.Second, nil)
+	}
+	if remaining() != 0 {
+		t.Fatalf("%d successes to go, want 0", remaining())
+	}
+	if a, _ := s.Next(ctx, nil); a.ID != fresh.ID {
+		t.Fatalf("expected fresh in full rotation, got %s", a.Name)
+	}
+	if stats, _ := s.RampUp(ctx); len(stats) != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The operator can end a ramp-up early.
+	next, _ := mgr.AddAPIKey(ctx, "next", "k3", "", -1)
+	if err := s.EndRampUp(ctx, next.ID); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Next(ctx, nil); a.ID != next.ID {
+		t.Fatalf("expected next, got %s", a.Name)
+	}
+}
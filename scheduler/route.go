@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/kxn/codex-companion/account"
+)
+
+// Route describes the request an account is selected for.
+type Route struct {
+	// Model is the model the client requested; ModeCost prices accounts
+	// for it.
+	Model string
+	// Premium selects accounts in priority order even in ModeCost.
+	Premium bool
+	// Account, when non-zero, is the only account the request may use,
+	// e.g. because its client is pinned to it. With Fallback the other
+	// accounts are used once it is unavailable.
+	Account  int64
+	Fallback bool
+	// Force names the account, by name or ID, or the group of accounts the
+	// request is forced onto, e.g. to debug one upstream. Only matching
+	// accounts are used, in priority order, ignoring weights, prices and
+	// cache affinity.
+	Force string
+	// APIKeyOnly limits the selection to API key accounts, for endpoints
+	// such as embeddings that the ChatGPT backend does not serve.
+	APIKeyOnly bool
+	// Endpoint (account.EndpointResponses or EndpointChatCompletions),
+	// Stream and Tools describe the request, so that accounts whose probed
+	// Capabilities rule it out are skipped.
+	Endpoint string
+	Stream   bool
+	Tools    bool
+}
+
+type routeKey struct{}
+
+// WithRoute attaches r to ctx for the selections made with it.
+func WithRoute(ctx context.Context, r Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, r)
+}
+
+// RouteFrom returns the Route attached to ctx, or the zero Route.
+func RouteFrom(ctx context.Context) Route {
+	r, _ := ctx.Value(routeKey{}).(Route)
+	return r
+}
+
+// Groups of accounts a Route can be forced onto.
+const (
+	GroupPrimary = "primary"
+	GroupBackup  = "backup"
+	GroupAPIKey  = "apikey"
+	GroupChatGPT = "chatgpt"
+)
+
+// forces reports whether force names a or a group it belongs to. Group
+// names win over account names.
+func forces(force string, a *account.Account) bool {
+	switch strings.ToLower(force) {
+	case GroupPrimary:
+		return !a.Backup
+	case GroupBackup:
+		return a.Backup
+	case GroupAPIKey:
+		return a.Type == account.APIKeyAccount
+	case GroupChatGPT:
+		return a.Type == account.ChatGPTAccount
+	}
+	return a.Name == force || strconv.FormatInt(a.ID, 10) == force
+}
@@ -0,0 +1,466 @@
+// Package scheduler picks the account that serves each proxied request and
+// returns exhausted accounts to rotation once their reset time passes.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/auth"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/logger"
+	"github.com/kxn/codex-companion/internal/pricing"
+)
+
+// Selection modes.
+const (
+	// ModePriority always uses the available account with the lowest
+	// priority value; the others are failovers.
+	ModePriority = "priority"
+	// ModeWeighted spreads requests over the available accounts in
+	// proportion to their weights.
+	ModeWeighted = "weighted"
+	// ModeCost uses the available account that serves the requested model
+	// at the lowest price, falling back to priority order between equally
+	// priced accounts and for Premium routes.
+	ModeCost = "cost"
+)
+
+// Scheduler selects which account to use.
+type Scheduler struct {
+	// Adaptive orders accounts by their effective priority, which the tuner
+	// adjusts from observed error rates and latency.
+	Adaptive bool
+	// Prices is the model price table ModeCost compares accounts with,
+	// unless an account overrides it; nil means pricing.Default.
+	Prices pricing.Table
+	// Warmup, when set, probes an exhausted account whose reset time has
+	// passed before the reactivator returns it to rotation. The account
+	// stays exhausted, and is probed again on the next run, until Warmup
+	// succeeds, so a limit that has not really reset is not re-tripped by a
+	// burst of real requests.
+	Warmup func(ctx context.Context, a *account.Account) error
+
+	mgr      *account.Manager
+	mu       sync.Mutex
+	mode     string
+	adaptive adaptiveState
+	rampUp   rampUpState
+	rand     func() float64
+	// onBackup is whether the last request started on a backup account.
+	onBackup bool
+}
+
+// New creates a Scheduler over the accounts stored in mgr.
+func New(mgr *account.Manager) *Scheduler {
+	return &Scheduler{mgr: mgr, mode: ModePriority, rand: rand.Float64}
+}
+
+// SetMode switches between ModePriority, ModeWeighted and ModeCost.
+func (s *Scheduler) SetMode(mode string) error {
+	if mode != ModePriority && mode != ModeWeighted && mode != ModeCost {
+		return fmt.Errorf("unknown scheduler mode %q", mode)
+	}
+	s.mu.Lock()
+	s.mode = mode
+	s.mu.Unlock()
+	logger.Infof("scheduler mode %s", mode)
+	return nil
+}
+
+// Mode returns the current selection mode.
+func (s *Scheduler) Mode() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode
+}
+
+// Next returns the next available account that is not in exclude. The
+// Route attached to ctx, if any, informs ModeCost.
+func (s *Scheduler) Next(ctx context.Context, exclude map[int64]bool) (*account.Account, error) {
+	return s.NextFor(ctx, exclude, 0)
+}
+
+// NextFor is Next, except that the account with ID preferred is chosen
+// whenever it is available, regardless of priority and weights, unless it
+// is a backup account while a primary is available. An account pinned by
+// the Route takes precedence over preferred and is used even from the
+// backup tier; so are the accounts the Route is forced onto.
+func (s *Scheduler) NextFor(ctx context.Context, exclude map[int64]bool, preferred int64) (*account.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logger.Debugc(ctx, "scheduler selecting next account")
+	accounts, err := s.mgr.List(ctx)
+	if err != nil {
+		logger.Errorc(ctx, "list accounts failed: %v", err)
+		return nil, err
+	}
+	if s.Adaptive {
+		sort.SliceStable(accounts, func(i, j int) bool { return accounts[i].EffectivePriority() < accounts[j].EffectivePriority() })
+	} else {
+		sort.Slice(accounts, func(i, j int) bool { return accounts[i].Priority < accounts[j].Priority })
+	}
+	now := time.Now()
+	var resetAt time.Time
+	summary := Summary{Accounts: len(accounts)}
+	route := RouteFrom(ctx)
+	if route.Force != "" {
+		preferred = 0
+	}
+	trace := traceFrom(ctx)
+	if trace != nil {
+		trace.Mode, trace.Model, trace.Premium = s.mode, route.Model, route.Premium
+		trace.Pinned, trace.Preferred, trace.Forced = route.Account, preferred, route.Force
+	}
+	candidates := accounts[:0]
+	for _, a := range accounts {
+		if route.APIKeyOnly && a.Type != account.APIKeyAccount {
+			summary.Unsupported++
+			trace.set(a, DecisionUnsupported, "API key accounts only")
+			continue
+		}
+		if lack := a.Capabilities.Lacks(route.Endpoint, route.Stream, route.Tools); lack != "" {
+			summary.Unsupported++
+			trace.set(a, DecisionUnsupported, "upstream lacks "+lack)
+			continue
+		}
+		if a.InvalidToken() {
+			logger.Debugc(ctx, "account %d has an invalid token", a.ID)
+			summary.InvalidToken++
+			summary.note(a, "invalid_token")
+			trace.set(a, DecisionInvalidToken, "")
+			continue
+		}
+		if a.InMaintenance(now) {
+			logger.Debugc(ctx, "account %d in maintenance until %v", a.ID, a.MaintenanceEnd)
+			if resetAt.IsZero() || a.MaintenanceEnd.Before(resetAt) {
+				resetAt = a.MaintenanceEnd
+			}
+			summary.Maintenance++
+			summary.note(a, "maintenance")
+			summary.Resets = append(summary.Resets, a.MaintenanceEnd.UTC())
+			trace.set(a, DecisionMaintenance, "until "+a.MaintenanceEnd.UTC().Format(time.RFC3339))
+			continue
+		}
+		if a.Exhausted && now.Before(a.ResetAt) {
+			logger.Debugc(ctx, "account %d exhausted until %v", a.ID, a.ResetAt)
+			if resetAt.IsZero() || a.ResetAt.Before(resetAt) {
+				resetAt = a.ResetAt
+			}
+			until := "until " + a.ResetAt.UTC().Format(time.RFC3339)
+			if a.BlockReason != "" {
+				summary.Blocked++
+				summary.note(a, "blocked")
+				trace.set(a, DecisionBlocked, a.BlockReason+", "+until)
+			} else {
+				summary.Exhausted++
+				summary.note(a, "exhausted")
+				trace.set(a, DecisionExhausted, until)
+			}
+			summary.Resets = append(summary.Resets, a.ResetAt.UTC())
+			continue
+		}
+		if exclude[a.ID] {
+			summary.Tried++
+			trace.set(a, DecisionTried, "")
+			continue
+		}
+		trace.set(a, DecisionNotChosen, s.rank(a, route))
+		candidates = append(candidates, a)
+	}
+	if route.Account != 0 && !route.Fallback {
+		pinned := candidates[:0]
+		for _, a := range candidates {
+			if a.ID == route.Account {
+				pinned = append(pinned, a)
+			} else {
+				trace.set(a, DecisionNotPinned, "")
+			}
+		}
+		candidates = pinned
+	}
+	if route.Force != "" {
+		forced := candidates[:0]
+		for _, a := range candidates {
+			if forces(route.Force, a) {
+				forced = append(forced, a)
+			} else {
+				trace.set(a, DecisionNotPinned, "not "+route.Force)
+			}
+		}
+		candidates = forced
+	}
+	// Backup accounts are only considered once no primary is left.
+	if s.mode == ModeCost && !route.Premium && route.Model != "" && route.Force == "" {
+		s.sortByCost(candidates, route.Model)
+	} else {
+		sort.SliceStable(candidates, func(i, j int) bool { return !candidates[i].Backup && candidates[j].Backup })
+	}
+	demoted := s.demoteRampUp(candidates, route, trace)
+	for len(candidates) > 0 {
+		tier := candidates
+		for j, a := range candidates {
+			if a.Backup != candidates[0].Backup || demoted[a.ID] != demoted[candidates[0].ID] {
+				tier = candidates[:j]
+				break
+			}
+		}
+		i := 0
+		if s.mode == ModeWeighted && route.Force == "" {
+			i = s.pickWeighted(tier)
+		}
+		for j, a := range tier {
+			if preferred != 0 && a.ID == preferred {
+				i = j
+			}
+		}
+		for j, a := range candidates {
+			if a.ID == route.Account {
+				i = j
+			}
+		}
+		a := candidates[i]
+		if a.Type == account.ChatGPTAccount {
+			if err := auth.Refresh(ctx, s.mgr, a); err != nil {
+				logger.Warnc(ctx, "refresh account %d failed: %v", a.ID, err)
+				summary.RefreshFailed++
+				summary.note(a, "refresh_failed")
+				trace.set(a, DecisionRefreshFailed, err.Error())
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				continue
+			}
+		}
+		logger.Debugc(ctx, "selected account %d", a.ID)
+		if trace != nil {
+			detail := s.rank(a, route)
+			switch {
+			case a.ID == route.Account:
+				detail = "pinned, " + detail
+			case route.Force != "":
+				detail = "forced, " + detail
+			case a.ID == preferred:
+				detail = "cache affinity, " + detail
+			}
+			trace.set(a, DecisionSelected, detail)
+		}
+		if len(exclude) == 0 && a.ID != route.Account && route.Force == "" {
+			s.noteTier(a)
+		}
+		return a, nil
+	}
+	logger.Warnc(ctx, "no accounts available")
+	sort.Slice(summary.Resets, func(i, j int) bool { return summary.Resets[i].Before(summary.Resets[j]) })
+	return nil, &NoAccountsError{ResetAt: resetAt, Summary: summary}
+}
+
+// noteTier logs and publishes a switch between the primary and backup tiers.
+// Only the first attempt of each request is considered, so retries after an
+// ordinary upstream error do not count as a failover.
+func (s *Scheduler) noteTier(a *account.Account) {
+	if a.Backup == s.onBackup {
+		return
+	}
+	s.onBackup = a.Backup
+	if a.Backup {
+		logger.Warnf("no primary account available, failing over to backup account %d", a.ID)
+		events.Publish(events.Event{Type: events.FailoverToBackup, AccountID: a.ID, Message: "no primary account available"})
+	} else {
+		logger.Infof("primary account %d available again, failing back", a.ID)
+		events.Publish(events.Event{Type: events.FailbackToPrimary, AccountID: a.ID})
+	}
+}
+
+// NoAccountsError is returned by Next when no account can be used.
+type NoAccountsError struct {
+	// ResetAt is the earliest time an exhausted account or one in
+	// maintenance becomes available again; zero when there is none.
+	ResetAt time.Time
+	// Summary tells why the accounts could not be used.
+	Summary Summary
+}
+
+// Summary counts the accounts by why they could not be used without
+// identifying them, so it can be shown to clients.
+type Summary struct {
+	// Accounts is the number of configured accounts.
+	Accounts int `json:"accounts"`
+	// Exhausted counts rate-limited accounts and Blocked those taken out
+	// of rotation for a longer reason such as a billing error.
+	Exhausted int `json:"exhausted"`
+	Blocked   int `json:"blocked"`
+	// Maintenance counts accounts inside a scheduled maintenance window.
+	Maintenance int `json:"maintenance"`
+	// RefreshFailed counts ChatGPT accounts whose token refresh failed.
+	RefreshFailed int `json:"refresh_failed"`
+	// InvalidToken counts accounts whose credentials were found invalid
+	// and must be replaced.
+	InvalidToken int `json:"invalid_token"`
+	// Tried counts the other accounts excluded because they already
+	// failed the request.
+	Tried int `json:"tried"`
+	// Unsupported counts the accounts whose type or probed capabilities
+	// cannot serve the request, such as ChatGPT accounts for embeddings.
+	Unsupported int `json:"unsupported"`
+	// Resets lists when the exhausted, blocked and maintained accounts
+	// become available again, earliest first.
+	Resets []time.Time `json:"resets,omitempty"`
+	// Notes are the operator notes of the unavailable accounts for their
+	// state, see account.Account.Notes, each listed once. Unlike the rest
+	// of Summary they are shown to clients whether or not the counts are.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// note adds the note of a for state to s.Notes.
+func (s *Summary) note(a *account.Account, state string) {
+	if n := a.Note(state); n != "" && !slices.Contains(s.Notes, n) {
+		s.Notes = append(s.Notes, n)
+	}
+}
+
+func (e *NoAccountsError) Error() string { return "no accounts available" }
+
+// RetryAt returns ResetAt.
+func (e *NoAccountsError) RetryAt() time.Time { return e.ResetAt }
+
+// pickWeighted returns the index of a candidate chosen with probability
+// proportional to its weight. Without any positive weight the first
+// candidate in priority order is used.
+func (s *Scheduler) pickWeighted(candidates []*account.Account) int {
+	total := 0.0
+	for _, a := range candidates {
+		if a.Weight > 0 {
+			total += a.Weight
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	r := s.rand() * total
+	for i, a := range candidates {
+		if a.Weight <= 0 {
+			continue
+		}
+		if r < a.Weight {
+			return i
+		}
+		r -= a.Weight
+	}
+	// Rounding may leave r just above the last weight.
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if candidates[i].Weight > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// StartReactivator starts background goroutine to reactivate exhausted accounts
+// and end elapsed maintenance windows.
+func (s *Scheduler) StartReactivator(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.reactivate(ctx)
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) reactivate(ctx context.Context) {
+	accounts, err := s.mgr.List(ctx)
+	if err != nil {
+		logger.Errorf("reactivate list accounts: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, a := range accounts {
+		if !a.MaintenanceEnd.IsZero() && !now.Before(a.MaintenanceEnd) {
+			if err := s.mgr.EndMaintenance(ctx, a.ID); err != nil {
+				continue
+			}
+			events.Publish(events.Event{Type: events.AccountReactivated, AccountID: a.ID, Message: "maintenance ended"})
+		}
+		if a.Exhausted && now.After(a.ResetAt) && !a.InvalidToken() {
+			msg := ""
+			if s.Warmup != nil {
+				if err := s.warmup(ctx, a); err != nil {
+					logger.Warnf("warm-up probe of account %d failed, keeping it exhausted: %v", a.ID, err)
+					continue
+				}
+				msg = "warm-up probe succeeded"
+			}
+			logger.Infof("reactivating account %d", a.ID)
+			if err := s.mgr.Reactivate(ctx, a.ID); err != nil {
+				logger.Errorf("reactivate account %d failed: %v", a.ID, err)
+				continue
+			}
+			events.Publish(events.Event{Type: events.AccountReactivated, AccountID: a.ID, Message: msg})
+		}
+	}
+}
+
+// warmup runs Warmup on a, refreshing a ChatGPT token first when due.
+func (s *Scheduler) warmup(ctx context.Context, a *account.Account) error {
+	if a.Type == account.ChatGPTAccount {
+		if err := auth.Refresh(auth.WithTrigger(ctx, auth.TriggerWarmup), s.mgr, a); err != nil {
+			return fmt.Errorf("refresh token: %w", err)
+		}
+	}
+	return s.Warmup(ctx, a)
+}
+
+// MarkExhausted marks an account as exhausted until resetAt.
+func (s *Scheduler) MarkExhausted(ctx context.Context, id int64, resetAt time.Time) {
+	logger.Warnf("marking account %d exhausted until %v", id, resetAt)
+	if err := s.mgr.MarkExhausted(ctx, id, resetAt); err != nil {
+		logger.Errorf("mark exhausted %d failed: %v", id, err)
+	}
+	events.Publish(events.Event{Type: events.AccountExhausted, AccountID: id, Data: map[string]any{"reset_at": resetAt}})
+}
+
+// MarkBlocked takes an account out of rotation until resetAt because of a
+// quota or billing error and notifies subscribers.
+func (s *Scheduler) MarkBlocked(ctx context.Context, id int64, reason string, resetAt time.Time) {
+	if err := s.mgr.MarkBlocked(ctx, id, reason, resetAt); err != nil {
+		logger.Errorf("mark blocked %d failed: %v", id, err)
+	}
+	events.Publish(events.Event{Type: events.AccountBillingBlocked, AccountID: id, Message: reason, Data: map[string]any{"reset_at": resetAt}})
+}
+
+// ExpireToken makes a ChatGPT account refresh its token before it is used
+// next, e.g. after the upstream rejected it.
+func (s *Scheduler) ExpireToken(ctx context.Context, id int64) {
+	if err := s.mgr.ExpireToken(ctx, id); err != nil {
+		logger.Errorf("expire token %d failed: %v", id, err)
+	}
+}
+
+// MarkInvalidToken takes an account whose credentials the upstream keeps
+// rejecting out of rotation until they are replaced and notifies
+// subscribers; msg describes the rejections.
+func (s *Scheduler) MarkInvalidToken(ctx context.Context, id int64, msg string) {
+	if err := s.mgr.MarkBlocked(ctx, id, account.BlockInvalidToken, time.Time{}); err != nil {
+		logger.Errorf("mark invalid token %d failed: %v", id, err)
+	}
+	events.Publish(events.Event{Type: events.AccountInvalidToken, AccountID: id, Message: msg})
+}
+
+// Quarantine takes an account the upstream keeps refusing out of rotation
+// until resetAt and notifies subscribers; msg describes the refusals.
+func (s *Scheduler) Quarantine(ctx context.Context, id int64, msg string, resetAt time.Time) {
+	if err := s.mgr.MarkBlocked(ctx, id, account.BlockQuarantined, resetAt); err != nil {
+		logger.Errorf("quarantine %d failed: %v", id, err)
+	}
+	events.Publish(events.Event{Type: events.AccountQuarantined, AccountID: id, Message: msg, Data: map[string]any{"reset_at": resetAt}})
+}
@@ -0,0 +1,477 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kxn/codex-companion/account"
+	"github.com/kxn/codex-companion/internal/events"
+	"github.com/kxn/codex-companion/internal/webhook"
+	_ "modernc.org/sqlite"
+)
+
+func setupScheduler(t *testing.T) (*Scheduler, *account.Manager) {
+	t.Helper()
+	mgr := account.NewManagerWithStorage(account.NewMemoryStore())
+	s := New(mgr)
+	return s, mgr
+}
+
+type rtFunc func(*http.Request) (*http.Response, error)
+
+func (f rtFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func swap(rt http.RoundTripper) func() {
+	old := http.DefaultClient
+	http.DefaultClient = &http.Client{Transport: rt}
+	return func() { http.DefaultClient = old }
+}
+
+func TestNextSelectsHighestPriority(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a1", "k1", "", 1)
+	_, _ = mgr.AddAPIKey(ctx, "a2", "k2", "", 2)
+	got, err := s.Next(ctx, nil)
+	if err != nil || got.ID != a1.ID {
+		t.Fatalf("unexpected: %+v %v", got, err)
+	}
+}
+
+func TestNextSkipsExhausted(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a1", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "a2", "k2", "", 2)
+	mgr.MarkExhausted(ctx, a1.ID, time.Now().Add(time.Hour))
+	got, err := s.Next(ctx, nil)
+	if err != nil || got.ID != a2.ID {
+		t.Fatalf("expected a2, got %+v %v", got, err)
+	}
+}
+
+func TestNextNoAccountsResetAt(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a1", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "a2", "k2", "", 2)
+	soon := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	a1.Notes = map[string]string{"*": "billing is being sorted out"}
+	a2.Notes = map[string]string{"exhausted": "Team plan renews on the 3rd", "blocked": "unused"}
+	mgr.Update(ctx, a1)
+	mgr.Update(ctx, a2)
+	mgr.MarkBlocked(ctx, a1.ID, "insufficient_quota", later)
+	mgr.MarkExhausted(ctx, a2.ID, soon)
+	_, err := s.Next(ctx, nil)
+	var na *NoAccountsError
+	if !errors.As(err, &na) || !na.RetryAt().Equal(soon) {
+		t.Fatalf("expected earliest reset %v, got %v", soon, err)
+	}
+	sum := na.Summary
+	if sum.Accounts != 2 || sum.Exhausted != 1 || sum.Blocked != 1 || sum.RefreshFailed != 0 ||
+		len(sum.Resets) != 2 || !sum.Resets[0].Equal(soon) || !sum.Resets[1].Equal(later) ||
+		len(sum.Notes) != 2 || sum.Notes[0] != "billing is being sorted out" || sum.Notes[1] != "Team plan renews on the 3rd" {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+}
+
+func TestNextRefreshFailureFallback(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	cg, _ := mgr.AddChatGPT(ctx, "cg", "rt", "", 1)
+	cg.TokenExpiresAt = time.Now().Add(-time.Minute)
+	mgr.Update(ctx, cg)
+	ak, _ := mgr.AddAPIKey(ctx, "a", "k", "", 2)
+	defer swap(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 500, Body: io.NopCloser(strings.NewReader("")), Header: make(http.Header)}, nil
+	}))()
+	got, err := s.Next(ctx, nil)
+	if err != nil || got.ID != ak.ID {
+		t.Fatalf("expected fallback, got %+v %v", got, err)
+	}
+}
+
+func TestNextRefreshesChatGPT(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	cg, _ := mgr.AddChatGPT(ctx, "cg", "rt", "", 1)
+	cg.TokenExpiresAt = time.Now().Add(-time.Minute)
+	mgr.Update(ctx, cg)
+	defer swap(rtFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"access_token":"new","refresh_token":"rt2","expires_in":60}`
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	}))()
+	got, err := s.Next(ctx, nil)
+	if err != nil || got.ID != cg.ID {
+		t.Fatalf("expected chatgpt account, got %+v %v", got, err)
+	}
+	if got.AccessToken != "new" || got.RefreshToken != "rt2" {
+		t.Fatalf("token not refreshed: %+v", got)
+	}
+	stored, _ := mgr.Get(ctx, cg.ID)
+	if stored.AccessToken != "new" || stored.RefreshToken != "rt2" {
+		t.Fatalf("db not updated: %+v", stored)
+	}
+}
+
+func TestReactivate(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(-time.Minute))
+	s.reactivate(ctx)
+	got, _ := mgr.Get(ctx, a.ID)
+	if got.Exhausted {
+		t.Fatalf("not reactivated")
+	}
+}
+
+func TestReactivateWarmup(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	waiting, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(-time.Minute))
+	mgr.MarkExhausted(ctx, waiting.ID, time.Now().Add(time.Hour))
+	var probed []int64
+	fail := true
+	s.Warmup = func(ctx context.Context, a *account.Account) error {
+		probed = append(probed, a.ID)
+		if fail {
+			return errors.New("429")
+		}
+		return nil
+	}
+	s.reactivate(ctx)
+	if got, _ := mgr.Get(ctx, a.ID); !got.Exhausted {
+		t.Fatalf("reactivated despite failed warm-up")
+	}
+	fail = false
+	got := make(chan events.Event, 1)
+	defer events.Default.Subscribe(func(e events.Event) { got <- e }, events.AccountReactivated)()
+	s.reactivate(ctx)
+	if got, _ := mgr.Get(ctx, a.ID); got.Exhausted {
+		t.Fatalf("not reactivated after successful warm-up")
+	}
+	if len(probed) != 2 || probed[0] != a.ID || probed[1] != a.ID {
+		t.Fatalf("unexpected probes %v", probed)
+	}
+	if e := <-got; e.AccountID != a.ID || e.Message != "warm-up probe succeeded" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestMarkExhausted(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	reset := time.Now().Add(time.Hour)
+	s.MarkExhausted(ctx, a.ID, reset)
+	got, _ := mgr.Get(ctx, a.ID)
+	if !got.Exhausted || got.ResetAt.Before(reset.Add(-time.Minute)) {
+		t.Fatalf("mark failed: %+v", got)
+	}
+}
+
+func TestStartReactivator(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	mgr.MarkExhausted(ctx, a.ID, time.Now().Add(-time.Minute))
+	s.StartReactivator(ctx, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	got, _ := mgr.Get(ctx, a.ID)
+	if got.Exhausted {
+		t.Fatalf("account not reactivated")
+	}
+}
+
+func TestAccountEvents(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	got := make(chan events.Event, 10)
+	unsub := events.Default.Subscribe(func(e events.Event) { got <- e }, events.AccountExhausted, events.AccountReactivated)
+	defer unsub()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	s.MarkExhausted(ctx, a.ID, time.Now().Add(-time.Minute))
+	s.reactivate(ctx)
+	for _, want := range []events.Type{events.AccountExhausted, events.AccountReactivated} {
+		select {
+		case e := <-got:
+			if e.Type != want || e.AccountID != a.ID {
+				t.Fatalf("unexpected event %+v, want %s", e, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestNextForPrefersAccount(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a1", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "a2", "k2", "", 2)
+	if got, err := s.NextFor(ctx, nil, a2.ID); err != nil || got.ID != a2.ID {
+		t.Fatalf("expected preferred a2, got %+v %v", got, err)
+	}
+	mgr.MarkExhausted(ctx, a2.ID, time.Now().Add(time.Hour))
+	if got, err := s.NextFor(ctx, nil, a2.ID); err != nil || got.ID != a1.ID {
+		t.Fatalf("expected fallback to a1, got %+v %v", got, err)
+	}
+}
+
+func TestNextAPIKeyOnly(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := WithRoute(context.Background(), Route{APIKeyOnly: true})
+	defer swap(rtFunc(func(*http.Request) (*http.Response, error) {
+		t.Fatal("ChatGPT account refreshed")
+		return nil, nil
+	}))()
+	cg, _ := mgr.AddChatGPT(ctx, "cg", "rt", "", 0)
+	_, err := s.Next(ctx, nil)
+	var na *NoAccountsError
+	if !errors.As(err, &na) || na.Summary.Unsupported != 1 {
+		t.Fatalf("unexpected error %v %+v", err, na)
+	}
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	tr := &Trace{}
+	got, err := s.Next(WithTrace(ctx, tr), nil)
+	if err != nil || got.ID != a.ID {
+		t.Fatalf("expected API key account, got %+v %v", got, err)
+	}
+	if tr.Candidates[0].AccountID != cg.ID || tr.Candidates[0].Decision != DecisionUnsupported {
+		t.Fatalf("unexpected trace %+v", tr.Candidates)
+	}
+}
+
+func TestNextCapabilities(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	relay, _ := mgr.AddAPIKey(ctx, "relay", "k1", "https://relay.example/v1", 0)
+	mgr.SetCapabilities(ctx, relay.ID, &account.Capabilities{ChatCompletions: true, Streaming: true})
+	full, _ := mgr.AddAPIKey(ctx, "full", "k2", "", 1)
+	next := func(r Route) (int64, *Trace) {
+		t.Helper()
+		tr := &Trace{}
+		a, err := s.Next(WithTrace(WithRoute(ctx, r), tr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.ID, tr
+	}
+	if got, _ := next(Route{Endpoint: account.EndpointChatCompletions, Stream: true}); got != relay.ID {
+		t.Fatalf("expected the relay for streamed chat completions, got %d", got)
+	}
+	// Responses API requests are translated to chat completions.
+	if got, _ := next(Route{Endpoint: account.EndpointResponses}); got != relay.ID {
+		t.Fatalf("expected the relay for responses, got %d", got)
+	}
+	got, tr := next(Route{Endpoint: account.EndpointChatCompletions, Tools: true})
+	if got != full.ID || tr.Candidates[0].Decision != DecisionUnsupported || tr.Candidates[0].Detail != "upstream lacks tools" {
+		t.Fatalf("expected the relay skipped for tools, got %d %+v", got, tr.Candidates)
+	}
+}
+
+func TestNextSkipsMaintenance(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a1, _ := mgr.AddAPIKey(ctx, "a1", "k1", "", 1)
+	a2, _ := mgr.AddAPIKey(ctx, "a2", "k2", "", 2)
+	end := time.Now().Add(time.Hour).Truncate(time.Second)
+	a1.MaintenanceEnd = end
+	if err := mgr.Update(ctx, a1); err != nil {
+		t.Fatal(err)
+	}
+	// A window that has not started yet does not affect selection.
+	a2.MaintenanceStart, a2.MaintenanceEnd = end, end.Add(time.Hour)
+	mgr.Update(ctx, a2)
+	if got, err := s.Next(ctx, nil); err != nil || got.ID != a2.ID {
+		t.Fatalf("expected a2 while a1 is in maintenance, got %v %v", got, err)
+	}
+	_, err := s.Next(ctx, map[int64]bool{a2.ID: true})
+	var na *NoAccountsError
+	if !errors.As(err, &na) || !na.RetryAt().Equal(end) || na.Summary.Maintenance != 1 || na.Summary.Tried != 1 {
+		t.Fatalf("unexpected error %v %+v", err, na)
+	}
+}
+
+func TestReactivateEndsMaintenance(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	a, _ := mgr.AddAPIKey(ctx, "a", "k", "", 1)
+	a.MaintenanceStart, a.MaintenanceEnd = time.Now().Add(-time.Hour), time.Now().Add(-time.Minute)
+	mgr.Update(ctx, a)
+	got := make(chan events.Event, 1)
+	defer events.Default.Subscribe(func(e events.Event) { got <- e }, events.AccountReactivated)()
+	s.reactivate(ctx)
+	if a, _ := mgr.Get(ctx, a.ID); !a.MaintenanceStart.IsZero() || !a.MaintenanceEnd.IsZero() {
+		t.Fatalf("maintenance window not cleared: %+v", a)
+	}
+	if e := <-got; e.AccountID != a.ID || e.Message != "maintenance ended" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestFailoverWithSlowWebhookStore(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "db") + "?_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q, err := webhook.New(db, []string{"http://127.0.0.1:1/hook"}, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsub := q.Subscribe(events.Default)
+	defer unsub()
+	// Another connection holds the write lock, so enqueueing waits for the
+	// busy timeout.
+	lock, _ := sql.Open("sqlite", dsn)
+	defer lock.Close()
+	tx, err := lock.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries`); err != nil {
+		t.Fatal(err)
+	}
+
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	primary, _ := mgr.AddAPIKey(ctx, "primary", "k1", "", 1)
+	backup, _ := mgr.AddAPIKey(ctx, "backup", "k2", "", 2)
+	backup.Backup = true
+	mgr.Update(ctx, backup)
+	mgr.MarkExhausted(ctx, primary.ID, time.Now().Add(time.Hour))
+	start := time.Now()
+	if a, err := s.NextFor(ctx, nil, 0); err != nil || a.ID != backup.ID {
+		t.Fatalf("expected failover to backup, got %v %v", a, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("selection waited %v for the webhook store", d)
+	}
+	tx.Rollback()
+	unsub()
+	list, _ := q.List(ctx, "", 10, 0)
+	if len(list) == 0 || list[0].EventType != string(events.FailoverToBackup) {
+		t.Fatalf("failover not enqueued once the store was free: %+v", list)
+	}
+}
+
+func TestBackupTier(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	s.SetMode(ModeWeighted)
+	ctx := context.Background()
+	primary, _ := mgr.AddAPIKey(ctx, "primary", "k1", "", 2)
+	backup, _ := mgr.AddAPIKey(ctx, "backup", "k2", "", 1)
+	backup.Backup, backup.Weight = true, 100
+	mgr.Update(ctx, backup)
+	got := make(chan events.Event, 4)
+	defer events.Default.Subscribe(func(e events.Event) { got <- e }, events.FailoverToBackup, events.FailbackToPrimary)()
+
+	// The backup's better priority, weight and affinity do not matter while
+	// the primary is available.
+	for range 5 {
+		if a, err := s.NextFor(ctx, nil, backup.ID); err != nil || a.ID != primary.ID {
+			t.Fatalf("expected primary, got %v %v", a, err)
+		}
+	}
+	mgr.MarkExhausted(ctx, primary.ID, time.Now().Add(time.Hour))
+	if a, err := s.Next(ctx, nil); err != nil || a.ID != backup.ID {
+		t.Fatalf("expected failover to backup, got %v %v", a, err)
+	}
+	if e := <-got; e.Type != events.FailoverToBackup || e.AccountID != backup.ID {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	mgr.Reactivate(ctx, primary.ID)
+	if a, err := s.Next(ctx, nil); err != nil || a.ID != primary.ID {
+		t.Fatalf("expected failback to primary, got %v %v", a, err)
+	}
+	if e := <-got; e.Type != events.FailbackToPrimary || e.AccountID != primary.ID {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	// Retrying a request on the backup is not a failover.
+	if a, _ := s.Next(ctx, map[int64]bool{primary.ID: true}); a.ID != backup.ID {
+		t.Fatalf("expected backup for retry, got %v", a)
+	}
+	select {
+	case e := <-got:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestPinnedRoute(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	primary, _ := mgr.AddAPIKey(ctx, "primary", "k1", "", 1)
+	pinned, _ := mgr.AddAPIKey(ctx, "pinned", "k2", "", 2)
+	pinned.Backup = true
+	mgr.Update(ctx, pinned)
+
+	strict := WithRoute(ctx, Route{Account: pinned.ID})
+	lenient := WithRoute(ctx, Route{Account: pinned.ID, Fallback: true})
+	for _, c := range []context.Context{strict, lenient} {
+		if a, err := s.NextFor(c, nil, primary.ID); err != nil || a.ID != pinned.ID {
+			t.Fatalf("expected pinned backup account, got %v %v", a, err)
+		}
+	}
+	if _, err := s.Next(strict, map[int64]bool{pinned.ID: true}); err == nil {
+		t.Fatal("strict pin used another account")
+	}
+	if a, err := s.Next(lenient, map[int64]bool{pinned.ID: true}); err != nil || a.ID != primary.ID {
+		t.Fatalf("expected fallback to primary, got %v %v", a, err)
+	}
+}
+
+func TestForcedRoute(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	primary, _ := mgr.AddAPIKey(ctx, "primary", "k1", "", 1)
+	second, _ := mgr.AddAPIKey(ctx, "second", "k2", "", 2)
+	backup, _ := mgr.AddAPIKey(ctx, "backup", "k3", "", 3)
+	backup.Backup = true
+	mgr.Update(ctx, backup)
+
+	for force, want := range map[string]int64{"second": second.ID, strconv.FormatInt(backup.ID, 10): backup.ID, "backup": backup.ID, "primary": primary.ID} {
+		// Cache affinity does not apply to forced requests.
+		if a, err := s.NextFor(WithRoute(ctx, Route{Force: force}), nil, second.ID); err != nil || a.ID != want {
+			t.Fatalf("forced onto %q: got %v %v", force, a, err)
+		}
+	}
+	forced := WithRoute(ctx, Route{Force: "second"})
+	if _, err := s.Next(forced, map[int64]bool{second.ID: true}); err == nil {
+		t.Fatal("forced request used another account")
+	}
+	if _, err := s.Next(WithRoute(ctx, Route{Force: "nonexistent"}), nil); err == nil {
+		t.Fatal("forced onto an unknown account")
+	}
+}
+
+func TestInvalidTokenSkipped(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	bad, _ := mgr.AddAPIKey(ctx, "bad", "k1", "", 1)
+	s.MarkInvalidToken(ctx, bad.ID, "401")
+	s.reactivate(ctx)
+	_, err := s.Next(ctx, nil)
+	var na *NoAccountsError
+	if !errors.As(err, &na) || na.Summary.InvalidToken != 1 || !na.ResetAt.IsZero() {
+		t.Fatalf("expected invalid token summary, got %v", err)
+	}
+	if a, _ := mgr.Get(ctx, bad.ID); !a.InvalidToken() || a.Available(time.Now()) {
+		t.Fatalf("invalid token cleared by reactivator: %+v", a)
+	}
+}
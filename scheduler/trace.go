@@ -0,0 +1,106 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/kxn/codex-companion/account"
+)
+
+// Decisions about an account recorded in a Trace.
+const (
+	DecisionSelected      = "selected"
+	DecisionNotChosen     = "not_chosen"
+	DecisionInvalidToken  = "invalid_token"
+	DecisionMaintenance   = "maintenance"
+	DecisionExhausted     = "exhausted"
+	DecisionBlocked       = "blocked"
+	DecisionTried         = "already_tried"
+	DecisionNotPinned     = "not_pinned"
+	DecisionRefreshFailed = "refresh_failed"
+	DecisionUnsupported   = "unsupported"
+	DecisionRampUp        = "ramping_up"
+)
+
+// Candidate is the decision about one account in a selection.
+type Candidate struct {
+	AccountID int64  `json:"account_id"`
+	Name      string `json:"name"`
+	Decision  string `json:"decision"`
+	// Detail explains the decision, e.g. the reset time of an exhausted
+	// account or the priority, weight or price an available one was
+	// ranked by.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Trace records how one account was selected: the selection mode, the
+// route and every account considered, in the order they were ranked.
+type Trace struct {
+	Mode    string `json:"mode"`
+	Model   string `json:"model,omitempty"`
+	Premium bool   `json:"premium,omitempty"`
+	// Pinned is the account the route is pinned to, Preferred the one
+	// prompt cache affinity asked for.
+	Pinned    int64 `json:"pinned,omitempty"`
+	Preferred int64 `json:"preferred,omitempty"`
+	// Forced is the account or group the route is forced onto.
+	Forced     string      `json:"forced,omitempty"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+type traceKey struct{}
+
+// WithTrace makes the selection made with ctx record its decisions in t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the Trace attached to ctx, or nil.
+func traceFrom(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// set records the decision about a, replacing an earlier one. A nil Trace
+// records nothing.
+func (t *Trace) set(a *account.Account, decision, detail string) {
+	if t == nil {
+		return
+	}
+	for i := range t.Candidates {
+		if t.Candidates[i].AccountID == a.ID {
+			t.Candidates[i].Decision, t.Candidates[i].Detail = decision, detail
+			return
+		}
+	}
+	t.Candidates = append(t.Candidates, Candidate{AccountID: a.ID, Name: a.Name, Decision: decision, Detail: detail})
+}
+
+// rank describes what an available account was ranked by in the current
+// mode.
+func (s *Scheduler) rank(a *account.Account, route Route) string {
+	var d string
+	switch {
+	case s.mode == ModeCost && !route.Premium && route.Model != "":
+		if p := s.price(a, route.Model); math.IsInf(p, 1) {
+			d = "no price for " + route.Model
+		} else {
+			d = "price " + strconv.FormatFloat(p, 'f', -1, 64)
+		}
+	case s.mode == ModeWeighted:
+		d = "weight " + strconv.FormatFloat(a.Weight, 'f', -1, 64)
+	case s.Adaptive:
+		d = fmt.Sprintf("priority %d%+d", a.Priority, a.PriorityAdjustment)
+	default:
+		d = fmt.Sprintf("priority %d", a.Priority)
+	}
+	if a.Backup {
+		d += ", backup"
+	}
+	if trust := s.trust(a); trust < 1 {
+		d += fmt.Sprintf(", ramping up (trust %.0f%%)", 100*trust)
+	}
+	return d
+}
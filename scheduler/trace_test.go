@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	tried, _ := mgr.AddAPIKey(ctx, "tried", "k1", "", 1)
+	best, _ := mgr.AddAPIKey(ctx, "best", "k2", "", 2)
+	other, _ := mgr.AddAPIKey(ctx, "other", "k3", "", 3)
+	spent, _ := mgr.AddAPIKey(ctx, "spent", "k4", "", 4)
+	bad, _ := mgr.AddAPIKey(ctx, "bad", "k5", "", 5)
+	mgr.MarkExhausted(ctx, spent.ID, time.Now().Add(time.Hour))
+	s.MarkInvalidToken(ctx, bad.ID, "401")
+
+	var tr Trace
+	a, err := s.Next(WithTrace(WithRoute(ctx, Route{Model: "gpt-5"}), &tr), map[int64]bool{tried.ID: true})
+	if err != nil || a.ID != best.ID {
+		t.Fatalf("expected best, got %v %v", a, err)
+	}
+	if tr.Mode != ModePriority || tr.Model != "gpt-5" || len(tr.Candidates) != 5 {
+		t.Fatalf("unexpected trace %+v", tr)
+	}
+	want := map[int64]string{
+		tried.ID: DecisionTried,
+		best.ID:  DecisionSelected,
+		other.ID: DecisionNotChosen,
+		spent.ID: DecisionExhausted,
+		bad.ID:   DecisionInvalidToken,
+	}
+	for _, c := range tr.Candidates {
+		if want[c.AccountID] != c.Decision {
+			t.Fatalf("account %s: got %s, want %s", c.Name, c.Decision, want[c.AccountID])
+		}
+	}
+	if c := tr.Candidates[1]; c.AccountID != best.ID || c.Detail != "priority 2" {
+		t.Fatalf("unexpected selected candidate %+v", c)
+	}
+	if c := tr.Candidates[3]; !strings.HasPrefix(c.Detail, "until ") {
+		t.Fatalf("exhausted candidate without reset time: %+v", c)
+	}
+
+	// A pinned route skips the other available accounts.
+	tr = Trace{}
+	if a, err := s.Next(WithTrace(WithRoute(ctx, Route{Account: other.ID}), &tr), nil); err != nil || a.ID != other.ID {
+		t.Fatalf("expected pinned account, got %v %v", a, err)
+	}
+	if tr.Pinned != other.ID || tr.Candidates[0].Decision != DecisionNotPinned || tr.Candidates[2].Detail != "pinned, priority 3" {
+		t.Fatalf("unexpected pinned trace %+v", tr)
+	}
+}
@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWeightedSelection(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	if err := s.SetMode("random"); err == nil {
+		t.Fatalf("expected unknown mode error")
+	}
+	if err := s.SetMode(ModeWeighted); err != nil || s.Mode() != ModeWeighted {
+		t.Fatalf("set mode: %v", err)
+	}
+	team, _ := mgr.AddAPIKey(ctx, "team", "k1", "", 1)
+	key, _ := mgr.AddAPIKey(ctx, "key", "k2", "", 2)
+	spare, _ := mgr.AddAPIKey(ctx, "spare", "k3", "", 3)
+	team.Weight = 7
+	key.Weight = 3
+	spare.Weight = 0
+	mgr.Update(ctx, team)
+	mgr.Update(ctx, key)
+	mgr.Update(ctx, spare)
+
+	for r, want := range map[float64]int64{0: team.ID, 0.69: team.ID, 0.7: key.ID, 0.99: key.ID} {
+		s.rand = func() float64 { return r }
+		got, err := s.Next(ctx, nil)
+		if err != nil || got.ID != want {
+			t.Fatalf("rand %v: expected %d, got %+v %v", r, want, got, err)
+		}
+	}
+
+	// exhausted accounts give up their share
+	mgr.MarkExhausted(ctx, key.ID, time.Now().Add(time.Hour))
+	s.rand = func() float64 { return 0.99 }
+	if got, _ := s.Next(ctx, nil); got.ID != team.ID {
+		t.Fatalf("expected team, got %d", got.ID)
+	}
+	// zero-weight accounts are the last resort
+	mgr.MarkExhausted(ctx, team.ID, time.Now().Add(time.Hour))
+	if got, _ := s.Next(ctx, nil); got.ID != spare.ID {
+		t.Fatalf("expected spare, got %d", got.ID)
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	s, mgr := setupScheduler(t)
+	ctx := context.Background()
+	s.SetMode(ModeWeighted)
+	a, _ := mgr.AddAPIKey(ctx, "a", "k1", "", 1)
+	b, _ := mgr.AddAPIKey(ctx, "b", "k2", "", 2)
+	a.Weight = 7
+	b.Weight = 3
+	mgr.Update(ctx, a)
+	mgr.Update(ctx, b)
+	counts := map[int64]int{}
+	for i := 0; i < 1000; i++ {
+		got, err := s.Next(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[got.ID]++
+	}
+	if counts[a.ID] < 600 || counts[a.ID] > 800 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}